@@ -1,14 +1,27 @@
 package api
 
 import (
+	"errors"
 	"github.com/sirupsen/logrus"
 	"net/http"
+	"time"
 
+	"gitlab.com/yakshaving.art/meeseeks-box/commands"
 	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
 	"gitlab.com/yakshaving.art/meeseeks-box/persistence"
 	"gitlab.com/yakshaving.art/meeseeks-box/text/parser"
 )
 
+// ErrTokenExpired is returned when an expired token is used
+var ErrTokenExpired = errors.New("token expired")
+
+// ErrCommandNotAllowed is returned when the token can't call the command
+var ErrCommandNotAllowed = errors.New("command not allowed for this token")
+
+// ErrChannelNotAllowed is returned when the caller picks a channel the token
+// can't use
+var ErrChannelNotAllowed = errors.New("channel not allowed for this token")
+
 // Enricher is a helper client used to augment the metadata of the user
 // and channel extracted from the registered token.
 type Enricher interface {
@@ -39,27 +52,47 @@ func New(enricher Enricher, path string) *Service {
 	return s
 }
 
-func (s *Service) sendMessage(token meeseeks.APIToken, message string) error {
+func (s *Service) sendMessage(token meeseeks.APIToken, message, channel string) error {
+	args, err := parser.Parse(token.Text + " " + message)
+	if err != nil {
+		return err
+	}
+	req, err := s.newRequest(token, args, channel)
+	if err != nil {
+		return err
+	}
+
+	s.requestsCh <- req
+	return nil
+}
+
+// newRequest returns the request of the args, attributed to the user and the
+// channel of the token, or the channel the caller picked
+func (s *Service) newRequest(token meeseeks.APIToken, args []string, channel string) (meeseeks.Request, error) {
+	if len(args) == 0 {
+		return meeseeks.Request{}, errors.New("no command was sent")
+	}
+
 	channelID, err := s.enricher.ParseChannelLink(token.ChannelLink)
 	if err != nil {
 		logrus.Errorf("Failed to parse channel link %s: %s. Dropping message!", token.ChannelLink, err)
 		// TODO: this error should go to the administration channel
-		return err
+		return meeseeks.Request{}, err
+	}
+	if channel != "" {
+		if channelID, err = s.pickChannel(token, channel); err != nil {
+			return meeseeks.Request{}, err
+		}
 	}
 
 	userID, err := s.enricher.ParseUserLink(token.UserLink)
 	if err != nil {
 		logrus.Errorf("Failed to parse user link %s: %s. Dropping message!", token.UserLink, err)
 		// TODO: this error should go to the administration channel
-		return err
+		return meeseeks.Request{}, err
 	}
 
-	args, err := parser.Parse(token.Text + " " + message)
-	if err != nil {
-		return err
-	}
-
-	s.requestsCh <- meeseeks.Request{
+	req := meeseeks.Request{
 		Command:     args[0],
 		Args:        args[1:],
 		UserID:      userID,
@@ -70,7 +103,29 @@ func (s *Service) sendMessage(token meeseeks.APIToken, message string) error {
 		ChannelLink: s.enricher.GetChannelLink(channelID),
 		IsIM:        s.enricher.IsIM(channelID),
 	}
-	return nil
+
+	// Aliases are resolved to check the command they call
+	resolved := req
+	commands.Find(&resolved)
+	if !token.Scopes.AllowsCommand(resolved.Command) {
+		return meeseeks.Request{}, ErrCommandNotAllowed
+	}
+	return req, nil
+}
+
+// pickChannel returns the ID of the channel the caller picked, which has to be
+// the one of the token or one of its channels. It can be a link or an ID
+func (s *Service) pickChannel(token meeseeks.APIToken, channel string) (string, error) {
+	picked, err := s.enricher.ParseChannelLink(channel)
+	if err != nil {
+		picked = channel
+	}
+	for _, link := range append([]string{token.ChannelLink}, token.Scopes.Channels...) {
+		if id, err := s.enricher.ParseChannelLink(link); err == nil && id == picked {
+			return id, nil
+		}
+	}
+	return "", ErrChannelNotAllowed
 }
 
 // Listen starts listen on the passed in channel
@@ -97,10 +152,27 @@ func (s *Service) Shutdown() error {
 
 // HandlePostToken implements the http handle request function interface
 func (s *Service) HandlePostToken(w http.ResponseWriter, r *http.Request) {
+	token, ok := tokenOf(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.sendMessage(token, r.FormValue("message"), r.FormValue("channel")); err != nil {
+		replyError(w, err)
+		return
+	}
+
+	touch(token)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// tokenOf returns the token of the call, replying with the error when there is
+// no token or it can't be used
+func tokenOf(w http.ResponseWriter, r *http.Request) (meeseeks.APIToken, bool) {
 	tokenID := r.Header.Get("TOKEN")
 	if tokenID == "" {
 		http.Error(w, "no token", http.StatusBadRequest)
-		return
+		return meeseeks.APIToken{}, false
 	}
 	logrus.Debugf("received token %s through API", tokenID) // Add requester info
 
@@ -108,13 +180,29 @@ func (s *Service) HandlePostToken(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		logrus.Debugf("Token %s is unknown", token) // Add requester info
 		http.Error(w, err.Error(), http.StatusUnauthorized)
-		return
+		return meeseeks.APIToken{}, false
 	}
 
-	if err := s.sendMessage(token, r.FormValue("message")); err != nil {
+	if token.Scopes.Expired(time.Now()) {
+		http.Error(w, ErrTokenExpired.Error(), http.StatusUnauthorized)
+		return meeseeks.APIToken{}, false
+	}
+	return token, true
+}
+
+// replyError replies with the error of a request the token can't send
+func replyError(w http.ResponseWriter, err error) {
+	switch err {
+	case ErrCommandNotAllowed, ErrChannelNotAllowed:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
 		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
 	}
+}
 
-	w.WriteHeader(http.StatusAccepted)
+// touch records that the token was used
+func touch(token meeseeks.APIToken) {
+	if err := persistence.APITokens().Touch(token.TokenID, time.Now()); err != nil {
+		logrus.Errorf("Could not record the use of token %s: %s", token.TokenID, err)
+	}
 }
@@ -1,12 +1,15 @@
 package api_test
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strings"
 	"testing"
+	"time"
 
 	"gitlab.com/yakshaving.art/meeseeks-box/api"
 	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
@@ -68,6 +71,7 @@ func TestAPIServer(t *testing.T) {
 			"someoneLink",
 			"generalLink",
 			"echo something",
+			meeseeks.APITokenScopes{},
 		)
 		mocks.Must(t, "failed to create the token", err)
 
@@ -163,3 +167,157 @@ func TestAPIServer(t *testing.T) {
 		}
 	}))
 }
+
+func TestScopedTokens(t *testing.T) {
+	mocks.Must(t, "failed to create a temporary DB", mocks.WithTmpDB(func(dbpath string) {
+		mocks.NewHarness().WithEchoCommand().WithDBPath(dbpath).Load()
+
+		scopedToken, err := persistence.APITokens().Create(
+			"someoneLink",
+			"generalLink",
+			"",
+			meeseeks.APITokenScopes{
+				Commands:  []string{"echo"},
+				Channels:  []string{"deploysLink"},
+				ExpiresAt: time.Now().Add(time.Hour),
+			},
+		)
+		mocks.Must(t, "failed to create the token", err)
+		expiredToken, err := persistence.APITokens().Create(
+			"someoneLink",
+			"generalLink",
+			"echo something",
+			meeseeks.APITokenScopes{ExpiresAt: time.Now().Add(-time.Hour)},
+		)
+		mocks.Must(t, "failed to create the token", err)
+
+		s := api.New(mocks.EnricherStub{}, "/api/scoped")
+		defer s.Shutdown()
+
+		ch := make(chan meeseeks.Request, 1)
+		go s.Listen(ch)
+
+		post := func(token string, values url.Values) (int, string) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/api/scoped", strings.NewReader(values.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.Header.Set("TOKEN", token)
+			s.HandlePostToken(w, r)
+			return w.Code, strings.TrimSpace(w.Body.String())
+		}
+
+		code, _ := post(scopedToken, url.Values{"message": {"echo hello"}, "channel": {"deploysLink"}})
+		mocks.AssertEquals(t, http.StatusAccepted, code)
+		req := <-ch
+		mocks.AssertEquals(t, "echo", req.Command)
+		mocks.AssertEquals(t, []string{"hello"}, req.Args)
+		mocks.AssertEquals(t, "deploys", req.ChannelID)
+
+		token, err := persistence.APITokens().Get(scopedToken)
+		mocks.Must(t, "failed to get the token", err)
+		mocks.AssertEquals(t, false, token.LastUsed.IsZero())
+
+		code, body := post(scopedToken, url.Values{"message": {"rm -rf /"}})
+		mocks.AssertEquals(t, http.StatusForbidden, code)
+		mocks.AssertEquals(t, "command not allowed for this token", body)
+
+		code, body = post(scopedToken, url.Values{"message": {"echo hello"}, "channel": {"randomLink"}})
+		mocks.AssertEquals(t, http.StatusForbidden, code)
+		mocks.AssertEquals(t, "channel not allowed for this token", body)
+
+		code, body = post(expiredToken, url.Values{})
+		mocks.AssertEquals(t, http.StatusUnauthorized, code)
+		mocks.AssertEquals(t, "token expired", body)
+	}))
+}
+
+func TestRunningCommands(t *testing.T) {
+	mocks.Must(t, "failed to create a temporary DB", mocks.WithTmpDB(func(dbpath string) {
+		mocks.NewHarness().WithEchoCommand().WithDBPath(dbpath).Load()
+
+		token, err := persistence.APITokens().Create("someoneLink", "generalLink", "", meeseeks.APITokenScopes{})
+		mocks.Must(t, "failed to create the token", err)
+
+		s := api.New(mocks.EnricherStub{}, "/api/run")
+		defer s.Shutdown()
+
+		// The executor takes the echo requests and echoes their args, and
+		// knows no other command
+		ch := make(chan meeseeks.Request)
+		go s.Listen(ch)
+		go func() {
+			for req := range ch {
+				if req.Command != "echo" {
+					persistence.Audit().Record(meeseeks.AuditEntry{Decision: meeseeks.AuditUnknown, Request: req})
+					continue
+				}
+				job, err := persistence.Jobs().Create(req)
+				mocks.Must(t, "could not create job", err)
+				persistence.Audit().Record(meeseeks.AuditEntry{Decision: meeseeks.AuditAccepted, JobID: job.ID, Request: req})
+				persistence.LogWriter().Append(job.ID, strings.Join(req.Args, " "))
+				persistence.Jobs().Finish(job.ID, meeseeks.JobSucceededStatus)
+			}
+		}()
+
+		run := func(method, body string) *http.Response {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(method, "/api/run", strings.NewReader(body))
+			r.Header.Set("TOKEN", token)
+			s.HandleRun(w, r)
+			return w.Result()
+		}
+		decode := func(t *testing.T, resp *http.Response) api.RunResponse {
+			run := api.RunResponse{}
+			mocks.Must(t, "could not decode the response", json.NewDecoder(resp.Body).Decode(&run))
+			mocks.AssertMatches(t, "^[0-9a-f-]{36}$", run.CallID)
+			return run
+		}
+
+		t.Run("without waiting", func(t *testing.T) {
+			resp := run(http.MethodPost, `{"command": "echo", "args": ["hello"]}`)
+			mocks.AssertEquals(t, http.StatusAccepted, resp.StatusCode)
+			if decode(t, resp).JobID == 0 {
+				t.Fatalf("the call got no job")
+			}
+		})
+
+		t.Run("waiting for the output", func(t *testing.T) {
+			resp := run(http.MethodPost, `{"command": "echo", "args": ["hello", "world"], "wait": true}`)
+			mocks.AssertEquals(t, http.StatusOK, resp.StatusCode)
+			got := decode(t, resp)
+			mocks.AssertEquals(t, "Succeeded", got.Status)
+			mocks.AssertEquals(t, "hello world", got.Output)
+		})
+
+		t.Run("streaming the output", func(t *testing.T) {
+			resp := run(http.MethodPost, `{"command": "echo", "args": ["streamed"], "stream": true}`)
+			mocks.AssertEquals(t, http.StatusOK, resp.StatusCode)
+			body, err := ioutil.ReadAll(resp.Body)
+			mocks.Must(t, "could not read the stream", err)
+			mocks.AssertEquals(t, "streamed", string(body))
+			mocks.AssertEquals(t, "Succeeded", resp.Trailer.Get(api.StatusTrailer))
+		})
+
+		tt := []struct {
+			name   string
+			method string
+			body   string
+			status int
+			err    string
+		}{
+			{"unknown command", http.MethodPost, `{"command": "unknown"}`, http.StatusNotFound, "unknown command unknown"},
+			{"no command", http.MethodPost, `{"args": ["hello"]}`, http.StatusBadRequest, "no command was sent"},
+			{"invalid timeout", http.MethodPost, `{"command": "echo", "timeout": "soon"}`, http.StatusBadRequest, "invalid timeout soon"},
+			{"not a post", http.MethodGet, "", http.StatusMethodNotAllowed, "only POST is allowed"},
+		}
+		for _, tc := range tt {
+			t.Run(tc.name, func(t *testing.T) {
+				resp := run(tc.method, tc.body)
+				mocks.AssertEquals(t, tc.status, resp.StatusCode)
+				body, err := ioutil.ReadAll(resp.Body)
+				mocks.Must(t, "could not read the response", err)
+				mocks.AssertEquals(t, tc.err, strings.TrimSpace(string(body)))
+			})
+		}
+	}))
+}
@@ -0,0 +1,126 @@
+// Package client calls the API of a Meeseeks to run commands and get their
+// output, without the dependencies of the server, so scripts can run the same
+// commands as the chat
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// statusTrailer is the trailer a streamed call gets the status of its job in,
+// api.StatusTrailer
+const statusTrailer = "X-Meeseeks-Job-Status"
+
+// Exit codes of the statuses that are not the ones of a finished job
+const (
+	// ExitRejected is the exit code of a call that the Meeseeks rejected, like
+	// an unknown command or one the token can't run, or that failed
+	ExitRejected = 2
+	// ExitUnfinished is the exit code of a job that didn't finish in time, or
+	// a call that is waiting for an approval
+	ExitUnfinished = 3
+)
+
+// exitCodes are the exit codes of the statuses of a finished job, shaped like
+// the ones of a shell: timeout(1) for a timed out job and SIGKILL and SIGTERM
+// for a killed or interrupted one
+var exitCodes = map[string]int{
+	"Succeeded":   0,
+	"Successful":  0,
+	"Failed":      1,
+	"TimedOut":    124,
+	"Killed":      137,
+	"Interrupted": 143,
+}
+
+// ExitCode returns the exit code of the status of a job or a call
+func ExitCode(status string) int {
+	if code, ok := exitCodes[status]; ok {
+		return code
+	}
+	return ExitUnfinished
+}
+
+// Run is a call to run a command, like api.RunRequest
+type Run struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+	Channel string   `json:"channel,omitempty"`
+	Wait    bool     `json:"wait"`
+	Stream  bool     `json:"stream"`
+	Timeout string   `json:"timeout,omitempty"`
+}
+
+// Result is what a call to run a command gets back, like api.RunResponse
+type Result struct {
+	CallID string `json:"call_id"`
+	JobID  uint64 `json:"job_id,omitempty"`
+	Status string `json:"status"`
+	Output string `json:"output,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Client calls the run path of a Meeseeks with a token
+type Client struct {
+	URL   string
+	Token string
+	HTTP  *http.Client
+}
+
+// New returns a client that calls the run url with the token
+func New(url, token string) Client {
+	return Client{
+		URL:   url,
+		Token: token,
+		HTTP:  http.DefaultClient,
+	}
+}
+
+// Run runs the command and returns the result of the call. A streamed call
+// writes the output to out as it's written and gets the status of the job
+// once it's done, the output of a call that waits is written when it's done
+func (c Client) Run(run Run, out io.Writer) (Result, error) {
+	body, err := json.Marshal(run)
+	if err != nil {
+		return Result{}, err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.URL, bytes.NewReader(body))
+	if err != nil {
+		return Result{}, fmt.Errorf("invalid url %s: %s", c.URL, err)
+	}
+	req.Header.Set("TOKEN", c.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return Result{}, fmt.Errorf("could not call %s: %s", c.URL, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 300:
+		b, _ := ioutil.ReadAll(resp.Body)
+		return Result{}, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+
+	case strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain"):
+		if _, err := io.Copy(out, resp.Body); err != nil {
+			return Result{}, fmt.Errorf("could not read the output: %s", err)
+		}
+		return Result{Status: resp.Trailer.Get(statusTrailer)}, nil
+	}
+
+	result := Result{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return result, fmt.Errorf("invalid response: %s", err)
+	}
+	if _, err := io.WriteString(out, result.Output); err != nil {
+		return result, fmt.Errorf("could not write the output: %s", err)
+	}
+	return result, nil
+}
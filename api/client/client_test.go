@@ -0,0 +1,118 @@
+package client_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/api"
+	"gitlab.com/yakshaving.art/meeseeks-box/api/client"
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+	"gitlab.com/yakshaving.art/meeseeks-box/mocks"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence"
+)
+
+func TestRunningCommandsWithTheClient(t *testing.T) {
+	mocks.Must(t, "failed to create a temporary DB", mocks.WithTmpDB(func(dbpath string) {
+		mocks.NewHarness().WithEchoCommand().WithDBPath(dbpath).Load()
+
+		token, err := persistence.APITokens().Create("someoneLink", "generalLink", "", meeseeks.APITokenScopes{})
+		mocks.Must(t, "failed to create the token", err)
+
+		s := api.New(mocks.EnricherStub{}, "/client/message")
+		defer s.Shutdown()
+		server := httptest.NewServer(http.HandlerFunc(s.HandleRun))
+		defer server.Close()
+
+		// The executor echoes the args of echo and fails the jobs of fail,
+		// and knows no other command
+		ch := make(chan meeseeks.Request)
+		go s.Listen(ch)
+		go func() {
+			for req := range ch {
+				status := map[string]meeseeks.JobStatus{
+					"echo": meeseeks.JobSucceededStatus,
+					"fail": meeseeks.JobFailedStatus,
+				}[req.Command]
+				if status == "" {
+					persistence.Audit().Record(meeseeks.AuditEntry{Decision: meeseeks.AuditUnknown, Request: req})
+					continue
+				}
+				job, err := persistence.Jobs().Create(req)
+				mocks.Must(t, "could not create job", err)
+				persistence.Audit().Record(meeseeks.AuditEntry{Decision: meeseeks.AuditAccepted, JobID: job.ID, Request: req})
+				persistence.LogWriter().Append(job.ID, strings.Join(req.Args, " "))
+				persistence.Jobs().Finish(job.ID, status)
+			}
+		}()
+
+		tt := []struct {
+			name     string
+			token    string
+			run      client.Run
+			status   string
+			output   string
+			exitCode int
+			err      string
+		}{
+			{
+				name:   "streaming the output",
+				token:  token,
+				run:    client.Run{Command: "echo", Args: []string{"hello", "world"}, Stream: true},
+				status: "Succeeded",
+				output: "hello world",
+			},
+			{
+				name:     "waiting for a failing job",
+				token:    token,
+				run:      client.Run{Command: "fail", Args: []string{"oops"}, Wait: true},
+				status:   "Failed",
+				output:   "oops",
+				exitCode: 1,
+			},
+			{
+				name:     "unknown command",
+				token:    token,
+				run:      client.Run{Command: "unknown", Stream: true},
+				exitCode: client.ExitRejected,
+				err:      "404 Not Found: unknown command unknown",
+			},
+			{
+				name:     "unknown token",
+				token:    "unknown-token",
+				run:      client.Run{Command: "echo", Stream: true},
+				exitCode: client.ExitRejected,
+				err:      "401 Unauthorized: no token found",
+			},
+		}
+		for _, tc := range tt {
+			t.Run(tc.name, func(t *testing.T) {
+				out := bytes.Buffer{}
+				result, err := client.New(server.URL, tc.token).Run(tc.run, &out)
+				if tc.err != "" {
+					mocks.AssertEquals(t, tc.err, err.Error())
+					return
+				}
+				mocks.Must(t, "could not run the command", err)
+				mocks.AssertEquals(t, tc.status, result.Status)
+				mocks.AssertEquals(t, tc.output, out.String())
+				mocks.AssertEquals(t, tc.exitCode, client.ExitCode(result.Status))
+			})
+		}
+	}))
+}
+
+func TestExitCodes(t *testing.T) {
+	for status, code := range map[string]int{
+		"Succeeded":       0,
+		"Failed":          1,
+		"TimedOut":        124,
+		"Killed":          137,
+		"Running":         client.ExitUnfinished,
+		"PendingApproval": client.ExitUnfinished,
+	} {
+		mocks.AssertEquals(t, code, client.ExitCode(status))
+	}
+}
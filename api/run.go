@@ -0,0 +1,240 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence"
+	"gitlab.com/yakshaving.art/meeseeks-box/text/parser"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultRunTimeout is how long a call waits for the output of its job when it
+// sets no timeout
+const DefaultRunTimeout = 10 * time.Minute
+
+// StatusTrailer is the trailer a streamed call gets the status of its job in
+const StatusTrailer = "X-Meeseeks-Job-Status"
+
+// The statuses of a call that has no job yet
+const (
+	RunAccepted = "Accepted"
+	RunPending  = "PendingApproval"
+)
+
+// decisionTimeout is how long a call waits for the request to be taken, and
+// pollInterval how often the job is checked while it waits for it
+var decisionTimeout = 10 * time.Second
+var pollInterval = 100 * time.Millisecond
+
+// RunRequest is a call to run a command, with the token in the TOKEN header
+// like the messages. The command and args are added to the text of the
+// token, Channel picks one of the channels of the token to reply in, and Wait
+// and Stream return the output of the job once it's done or as it's written,
+// for up to Timeout, like 30s or 5m
+type RunRequest struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+	Channel string   `json:"channel"`
+	Wait    bool     `json:"wait"`
+	Stream  bool     `json:"stream"`
+	Timeout string   `json:"timeout"`
+}
+
+// RunResponse is what a call to run a command gets back, the job and its
+// status, and its output and error when it waited for it
+type RunResponse struct {
+	CallID string `json:"call_id"`
+	JobID  uint64 `json:"job_id,omitempty"`
+	Status string `json:"status"`
+	Output string `json:"output,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// RegisterRunPath starts listening for calls to run commands in the path
+func (s *Service) RegisterRunPath(path string) {
+	http.HandleFunc(path, s.HandleRun)
+}
+
+// HandleRun runs the command of the call as the user of the token, and
+// replies with its job, or its output when the call waits for it
+func (s *Service) HandleRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token, ok := tokenOf(w, r)
+	if !ok {
+		return
+	}
+
+	run := RunRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&run); err != nil {
+		http.Error(w, fmt.Sprintf("invalid call: %s", err), http.StatusBadRequest)
+		return
+	}
+	timeout := DefaultRunTimeout
+	if run.Timeout != "" {
+		d, err := time.ParseDuration(run.Timeout)
+		if err != nil || d <= 0 {
+			http.Error(w, fmt.Sprintf("invalid timeout %s", run.Timeout), http.StatusBadRequest)
+			return
+		}
+		timeout = d
+	}
+	if run.Command == "" {
+		http.Error(w, "no command was sent", http.StatusBadRequest)
+		return
+	}
+
+	args, err := parser.Parse(token.Text)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req, err := s.newRequest(token, append(append(args, run.Command), run.Args...), run.Channel)
+	if err != nil {
+		replyError(w, err)
+		return
+	}
+	req.CallID = uuid.New().String()
+
+	since := time.Now().UTC()
+	s.requestsCh <- req
+	touch(token)
+
+	resp := RunResponse{CallID: req.CallID, Status: RunAccepted}
+	entry, ok := waitForDecision(req.CallID, since)
+	if !ok {
+		replyJSON(w, http.StatusAccepted, resp)
+		return
+	}
+	switch entry.Decision {
+	case meeseeks.AuditUnknown:
+		http.Error(w, fmt.Sprintf("unknown command %s", req.Command), http.StatusNotFound)
+		return
+	case meeseeks.AuditUnauthorized:
+		http.Error(w, fmt.Sprintf("the user of the token is not allowed to run %s", req.Command), http.StatusForbidden)
+		return
+	case meeseeks.AuditPending:
+		resp.Status = RunPending
+		replyJSON(w, http.StatusAccepted, resp)
+		return
+	}
+
+	// Untracked commands, like most builtins, have no job to follow
+	resp.JobID = entry.JobID
+	if resp.JobID == 0 {
+		replyJSON(w, http.StatusAccepted, resp)
+		return
+	}
+
+	switch {
+	case run.Stream:
+		streamJob(w, resp.JobID, timeout)
+	case run.Wait:
+		job, finished := waitForJob(resp.JobID, time.Now().Add(timeout), nil)
+		resp.Status = string(job.Status)
+		if !finished {
+			replyJSON(w, http.StatusAccepted, resp)
+			return
+		}
+		log, err := persistence.LogReader().Get(resp.JobID)
+		if err != nil && err != meeseeks.ErrNoLogsForJob {
+			logrus.Errorf("Could not get the logs of job %d for the API: %s", resp.JobID, err)
+		}
+		resp.Output, resp.Error = log.Output, log.Error
+		replyJSON(w, http.StatusOK, resp)
+	default:
+		if job, err := persistence.Jobs().Get(resp.JobID); err == nil {
+			resp.Status = string(job.Status)
+		}
+		replyJSON(w, http.StatusAccepted, resp)
+	}
+}
+
+// waitForDecision returns the audit entry of the decision taken on the
+// request of the call, and false when it wasn't taken in time
+func waitForDecision(callID string, since time.Time) (meeseeks.AuditEntry, bool) {
+	deadline := time.Now().Add(decisionTimeout)
+	for {
+		entries, err := persistence.Audit().Find(meeseeks.AuditFilter{
+			Limit: 1,
+			Since: since,
+			Match: func(e meeseeks.AuditEntry) bool {
+				return e.Request.CallID == callID && e.Decision != meeseeks.AuditDispatched
+			},
+		})
+		if err != nil {
+			logrus.Errorf("Could not find the decision taken on API call %s: %s", callID, err)
+		}
+		if len(entries) > 0 {
+			return entries[0], true
+		}
+		if time.Now().After(deadline) {
+			return meeseeks.AuditEntry{}, false
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// waitForJob waits for the job to finish until the deadline, calling the
+// function each time it's checked, and returns true when it's done
+func waitForJob(jobID uint64, deadline time.Time, check func()) (meeseeks.Job, bool) {
+	for {
+		job, err := persistence.Jobs().Get(jobID)
+		if err != nil {
+			logrus.Errorf("Could not get job %d for the API: %s", jobID, err)
+		} else {
+			if check != nil {
+				check()
+			}
+			if job.Status.IsFinished() {
+				return job, true
+			}
+		}
+		if time.Now().After(deadline) {
+			return job, false
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// streamJob writes the output of the job as it's written, until it's done or
+// the timeout is over, and the status it got to in the status trailer
+func streamJob(w http.ResponseWriter, jobID uint64, timeout time.Duration) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Trailer", StatusTrailer)
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	written := 0
+	job, _ := waitForJob(jobID, time.Now().Add(timeout), func() {
+		log, err := persistence.LogReader().Get(jobID)
+		if err != nil || len(log.Output) <= written {
+			return
+		}
+		w.Write([]byte(log.Output[written:]))
+		written = len(log.Output)
+		flusher.Flush()
+	})
+	w.Header().Set(StatusTrailer, string(job.Status))
+}
+
+func replyJSON(w http.ResponseWriter, status int, resp RunResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logrus.Errorf("Could not reply to API call %s: %s", resp.CallID, err)
+	}
+}
@@ -0,0 +1,131 @@
+package alerts
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+)
+
+// DefaultAttempts is how many unauthorized attempts trigger an alert when no
+// number is configured
+const DefaultAttempts = 5
+
+// DefaultWindow is how far back attempts are counted when no window is configured
+const DefaultWindow = 10 * time.Minute
+
+// Config holds where and when to alert about the users that keep running
+// commands they are not allowed to
+//
+// ChannelID is the channel the alerts are sent to, and an alert is sent when
+// a user is rejected Attempts times within Window seconds
+type Config struct {
+	ChannelID string        `yaml:"channel_id"`
+	Attempts  int           `yaml:"attempts"`
+	Window    time.Duration `yaml:"window"`
+}
+
+// Enabled returns true if a channel to alert is configured
+func (c Config) Enabled() bool {
+	return c.ChannelID != ""
+}
+
+// Validate checks that the configuration is usable
+func (c Config) Validate() error {
+	if c.Attempts < 0 {
+		return fmt.Errorf("alerts attempts can't be negative")
+	}
+	if c.Window < 0 {
+		return fmt.Errorf("alerts window can't be negative")
+	}
+	return nil
+}
+
+func (c Config) attempts() int {
+	if c.Attempts <= 0 {
+		return DefaultAttempts
+	}
+	return c.Attempts
+}
+
+func (c Config) window() time.Duration {
+	if c.Window <= 0 {
+		return DefaultWindow
+	}
+	return c.Window * time.Second
+}
+
+// Alert is the notice to send to the channel
+type Alert struct {
+	ChannelID string
+	Text      string
+}
+
+// attempt is a rejected request
+type attempt struct {
+	command string
+	at      time.Time
+}
+
+var config Config
+var attempts = map[string][]attempt{}
+var mutex sync.Mutex
+
+// Configure sets where and when to alert, the attempts counted so far are
+// dropped
+func Configure(cnf Config) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	config = cnf
+	attempts = map[string][]attempt{}
+}
+
+// Record counts the rejected request and returns an alert when the user
+// reached the configured attempts within the window. The attempts of the user
+// start counting again after an alert so it is not repeated on every one
+func Record(req meeseeks.Request, now time.Time) (Alert, bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if !config.Enabled() {
+		return Alert{}, false
+	}
+
+	since := now.Add(-config.window())
+	recent := make([]attempt, 0)
+	for _, a := range attempts[req.Username] {
+		if a.at.After(since) {
+			recent = append(recent, a)
+		}
+	}
+	recent = append(recent, attempt{command: req.Command, at: now})
+
+	if len(recent) < config.attempts() {
+		attempts[req.Username] = recent
+		return Alert{}, false
+	}
+	delete(attempts, req.Username)
+
+	return Alert{
+		ChannelID: config.ChannelID,
+		Text: fmt.Sprintf("User %s was not allowed to run a command %d times in the last %s, tried: %s",
+			req.Username, len(recent), config.window(), strings.Join(commandsOf(recent), ", ")),
+	}, true
+}
+
+// commandsOf returns the commands that were tried, in the order they were first tried
+func commandsOf(tried []attempt) []string {
+	commands := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, a := range tried {
+		if seen[a.command] {
+			continue
+		}
+		seen[a.command] = true
+		commands = append(commands, a.command)
+	}
+	return commands
+}
@@ -0,0 +1,76 @@
+package alerts_test
+
+import (
+	"testing"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/auth/alerts"
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+	"gitlab.com/yakshaving.art/meeseeks-box/mocks"
+)
+
+func TestAlerts(t *testing.T) {
+	defer alerts.Configure(alerts.Config{})
+
+	now := time.Date(2018, 5, 1, 10, 0, 0, 0, time.UTC)
+	tt := []struct {
+		name     string
+		cnf      alerts.Config
+		attempts []meeseeks.Request
+		offset   time.Duration
+		expected []bool
+		text     string
+	}{
+		{
+			name:     "disabled",
+			cnf:      alerts.Config{},
+			attempts: []meeseeks.Request{{Username: "someone", Command: "deploy"}, {Username: "someone", Command: "deploy"}},
+			expected: []bool{false, false},
+		},
+		{
+			name: "alerts on the last attempt",
+			cnf:  alerts.Config{ChannelID: "admins", Attempts: 3},
+			attempts: []meeseeks.Request{
+				{Username: "someone", Command: "deploy"},
+				{Username: "someone", Command: "audit"},
+				{Username: "other", Command: "audit"},
+				{Username: "someone", Command: "deploy"},
+				{Username: "someone", Command: "deploy"},
+			},
+			expected: []bool{false, false, false, true, false},
+			text:     "User someone was not allowed to run a command 3 times in the last 10m0s, tried: deploy, audit",
+		},
+		{
+			name: "attempts outside of the window are not counted",
+			cnf:  alerts.Config{ChannelID: "admins", Attempts: 2, Window: 30},
+			attempts: []meeseeks.Request{
+				{Username: "someone", Command: "deploy"},
+				{Username: "someone", Command: "deploy"},
+			},
+			offset:   time.Minute,
+			expected: []bool{false, false},
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			alerts.Configure(tc.cnf)
+			alerted := make([]bool, 0)
+			text := ""
+			for i, req := range tc.attempts {
+				alert, ok := alerts.Record(req, now.Add(time.Duration(i)*tc.offset))
+				alerted = append(alerted, ok)
+				if ok {
+					mocks.AssertEquals(t, tc.cnf.ChannelID, alert.ChannelID)
+					text = alert.Text
+				}
+			}
+			mocks.AssertEquals(t, tc.expected, alerted)
+			mocks.AssertEquals(t, tc.text, text)
+		})
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	mocks.AssertEquals(t, "alerts attempts can't be negative", alerts.Config{Attempts: -1}.Validate().Error())
+	mocks.AssertEquals(t, "alerts window can't be negative", alerts.Config{Window: -1}.Validate().Error())
+}
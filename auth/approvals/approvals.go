@@ -0,0 +1,123 @@
+package approvals
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/auth"
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultTimeout is how long a request waits for its approvals when no
+// timeout is configured
+const DefaultTimeout = time.Hour
+
+// Validate checks that the approvals of a command are usable
+func Validate(opts meeseeks.ApprovalOpts) error {
+	if opts.Required < 0 {
+		return fmt.Errorf("approval required can't be negative")
+	}
+	if opts.Timeout < 0 {
+		return fmt.Errorf("approval timeout can't be negative")
+	}
+	return nil
+}
+
+// Open starts waiting for the approvals of the request, it's stored so the
+// approvals can be given on any replica and survive restarts
+func Open(req meeseeks.Request, opts meeseeks.ApprovalOpts, now time.Time) (meeseeks.Approval, error) {
+	timeout := opts.Timeout * time.Second
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	return persistence.Approvals().Create(meeseeks.Approval{
+		Request:   req,
+		Opts:      opts,
+		Approvers: []string{},
+		ExpiresAt: now.Add(timeout),
+	})
+}
+
+// Approve adds the user of the request as an approver of the pending one. The
+// approvers have to belong to the group of the command, or hold the approve
+// permission on it, and can't approve their own requests. Once it gets all the
+// approvals it stops being pending and can be consumed to run it
+func Approve(id uint64, approver meeseeks.Request, now time.Time) (meeseeks.Approval, error) {
+	notPending := fmt.Errorf("there is no pending approval %d", id)
+	a, err := persistence.Approvals().Update(id, func(a *meeseeks.Approval) error {
+		if a.Approved() || !now.Before(a.ExpiresAt) {
+			return notPending
+		}
+		if a.Request.Username == approver.Username {
+			return fmt.Errorf("requests can't be approved by who made them")
+		}
+		if !canApprove(*a, approver) {
+			return fmt.Errorf("%s is not allowed to approve %s", approver.Username, a.Request.Command)
+		}
+		for _, name := range a.Approvers {
+			if name == approver.Username {
+				return fmt.Errorf("%s already approved request %d", approver.Username, id)
+			}
+		}
+		a.Approvers = append(a.Approvers, approver.Username)
+		return nil
+	})
+	if err == meeseeks.ErrNoApproval {
+		return meeseeks.Approval{}, notPending
+	}
+	return a, err
+}
+
+// List returns the requests that are waiting for approvals, oldest first
+func List(now time.Time) ([]meeseeks.Approval, error) {
+	all, err := persistence.Approvals().List(now)
+	if err != nil {
+		return nil, fmt.Errorf("could not list approvals: %s", err)
+	}
+	list := make([]meeseeks.Approval, 0, len(all))
+	for _, a := range all {
+		if !a.Approved() {
+			list = append(list, a)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list, nil
+}
+
+// Consume returns the approval of the request when it got all of them, it can
+// only be consumed once
+func Consume(req meeseeks.Request) (meeseeks.Approval, bool) {
+	if req.ApprovalID == 0 {
+		return meeseeks.Approval{}, false
+	}
+	a, err := persistence.Approvals().Get(req.ApprovalID)
+	if err != nil {
+		if err != meeseeks.ErrNoApproval {
+			logrus.Errorf("Could not get approval %d: %s", req.ApprovalID, err)
+		}
+		return meeseeks.Approval{}, false
+	}
+	if !a.Approved() || a.Request.Username != req.Username || a.Request.Command != req.Command {
+		return meeseeks.Approval{}, false
+	}
+	// Only the one that removes it gets to run it
+	if err := persistence.Approvals().Remove(a.ID); err != nil {
+		if err != meeseeks.ErrNoApproval {
+			logrus.Errorf("Could not consume approval %d: %s", a.ID, err)
+		}
+		return meeseeks.Approval{}, false
+	}
+	return a, true
+}
+
+func canApprove(a meeseeks.Approval, approver meeseeks.Request) bool {
+	if a.Opts.Group != "" && auth.InAnyGroup(approver, []string{a.Opts.Group}) {
+		return true
+	}
+	return auth.HasPermission(approver.Username, a.Request.Command, auth.PermissionApprove)
+}
@@ -0,0 +1,105 @@
+package approvals_test
+
+import (
+	"testing"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/auth"
+	"gitlab.com/yakshaving.art/meeseeks-box/auth/approvals"
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+	"gitlab.com/yakshaving.art/meeseeks-box/mocks"
+)
+
+func TestQuorumApprovals(t *testing.T) {
+	auth.Configure(map[string][]string{
+		auth.AdminGroup: {"admin_user"},
+		"leads":         {"lead_1", "lead_2", "lead_3", "requester"},
+	})
+	defer auth.Configure(map[string][]string{})
+
+	mocks.Must(t, "failed to approve", mocks.WithTmpDB(func(_ string) {
+		now := time.Now()
+		req := meeseeks.Request{Username: "requester", Command: "deploy", Args: []string{"prod"}}
+		p, err := approvals.Open(req, meeseeks.ApprovalOpts{Group: "leads", Required: 2}, now)
+		mocks.Must(t, "could not open approval", err)
+		mocks.AssertEquals(t, "0/2", p.Progress())
+		mocks.AssertEquals(t, now.Add(approvals.DefaultTimeout), p.ExpiresAt)
+
+		tt := []struct {
+			name     string
+			approver string
+			progress string
+			err      string
+		}{
+			{name: "requester can't approve", approver: "requester", err: "requests can't be approved by who made them"},
+			{name: "not in the group", approver: "someone", err: "someone is not allowed to approve deploy"},
+			{name: "first approval", approver: "lead_1", progress: "1/2"},
+			{name: "same approver twice", approver: "lead_1", err: "lead_1 already approved request"},
+			{name: "second approval", approver: "lead_2", progress: "2/2"},
+			{name: "approved requests are not pending", approver: "lead_3", err: "there is no pending approval"},
+			{name: "unknown request", approver: "lead_3", err: "there is no pending approval"},
+		}
+		for _, tc := range tt {
+			t.Run(tc.name, func(t *testing.T) {
+				id := p.ID
+				if tc.name == "unknown request" {
+					id = 42
+				}
+				approved, err := approvals.Approve(id, meeseeks.Request{Username: tc.approver}, now)
+				if tc.err != "" {
+					mocks.AssertMatches(t, tc.err, err.Error())
+					return
+				}
+				mocks.Must(t, "could not approve", err)
+				mocks.AssertEquals(t, tc.progress, approved.Progress())
+			})
+		}
+
+		pending, err := approvals.List(now)
+		mocks.Must(t, "could not list approvals", err)
+		mocks.AssertEquals(t, 0, len(pending))
+
+		_, ok := approvals.Consume(req)
+		mocks.AssertEquals(t, false, ok)
+
+		req.ApprovalID = p.ID
+		_, ok = approvals.Consume(meeseeks.Request{Username: "someone", Command: "deploy", ApprovalID: p.ID})
+		mocks.AssertEquals(t, false, ok)
+		approved, ok := approvals.Consume(req)
+		mocks.AssertEquals(t, true, ok)
+		mocks.AssertEquals(t, []string{"lead_1", "lead_2"}, approved.Approvers)
+		_, ok = approvals.Consume(req)
+		mocks.AssertEquals(t, false, ok)
+	}))
+}
+
+func TestApprovalsExpire(t *testing.T) {
+	auth.Configure(map[string][]string{
+		auth.AdminGroup: {"admin_user"},
+	})
+	defer auth.Configure(map[string][]string{})
+
+	mocks.Must(t, "failed to expire approvals", mocks.WithTmpDB(func(_ string) {
+		now := time.Now()
+		p, err := approvals.Open(meeseeks.Request{Username: "requester", Command: "deploy"},
+			meeseeks.ApprovalOpts{Required: 1, Timeout: 60}, now)
+		mocks.Must(t, "could not open approval", err)
+		pending, err := approvals.List(now)
+		mocks.Must(t, "could not list approvals", err)
+		mocks.AssertEquals(t, 1, len(pending))
+
+		_, err = approvals.Approve(p.ID, meeseeks.Request{Username: "admin_user"}, now.Add(time.Minute))
+		mocks.AssertMatches(t, "there is no pending approval", err.Error())
+		pending, err = approvals.List(now.Add(time.Minute))
+		mocks.Must(t, "could not list approvals", err)
+		mocks.AssertEquals(t, 0, len(pending))
+	}))
+}
+
+func TestValidate(t *testing.T) {
+	mocks.AssertEquals(t, nil, approvals.Validate(meeseeks.ApprovalOpts{Group: "leads"}))
+	mocks.AssertEquals(t, "approval required can't be negative",
+		approvals.Validate(meeseeks.ApprovalOpts{Required: -1}).Error())
+	mocks.AssertEquals(t, "approval timeout can't be negative",
+		approvals.Validate(meeseeks.ApprovalOpts{Timeout: -1}).Error())
+}
@@ -3,7 +3,9 @@ package auth
 import (
 	"errors"
 	"fmt"
+	"path"
 	"sort"
+	"sync"
 
 	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
 	log "github.com/sirupsen/logrus"
@@ -20,6 +22,19 @@ type CommandAuthorization interface {
 	GetAllowedChannels() []string
 }
 
+// ChannelDenier is implemented by the commands that are never allowed in
+// some channels, whatever their channel strategy
+type ChannelDenier interface {
+	GetDeniedChannels() []string
+}
+
+// ArgsRestricter is implemented by the commands that only allow some groups
+// to pass some argument values, the keys are patterns that can use shell
+// wildcards and the values the groups allowed to pass matching arguments
+type ArgsRestricter interface {
+	GetRestrictedArgs() map[string][]string
+}
+
 // Authorizer is the interface used to check if a user is allowed to run a command
 type Authorizer interface {
 	Check(meeseeks.Request, CommandAuthorization) error
@@ -31,6 +46,12 @@ var ErrUserNotAllowed = errors.New("user no allowed")
 // ErrChannelNotAllowed is the error returne when the auth check fails because the command was invoked in a not allowed channel
 var ErrChannelNotAllowed = errors.New("command not allowed in channel")
 
+// ErrChannelDenied is the error returned when the auth check fails because the command was invoked in a denied channel
+var ErrChannelDenied = errors.New("command denied in channel")
+
+// ErrArgNotAllowed is the error returned when the auth check fails because the user is not in a group allowed to pass an argument
+var ErrArgNotAllowed = errors.New("argument not allowed")
+
 // ErrOnlyIMAllowed is the error returned when the auth check fails because the command was invoked on a public channel
 var ErrOnlyIMAllowed = errors.New("command only allowed in IM")
 
@@ -40,11 +61,17 @@ var ErrGroupNotFound = fmt.Errorf("groups does not exists")
 // ErrUserNotInGroup is the error returned when a user does not belong to a given group
 var ErrUserNotInGroup = fmt.Errorf("user does not belong to group")
 
+// ErrLastAdmin is the error returned when trying to remove the last user of the admin group
+var ErrLastAdmin = fmt.Errorf("can't remove the last admin")
+
 // Authorization Strategies determine who has access to what
 const (
 	AuthStrategyAny          = "any"
 	AuthStrategyAllowedGroup = "group"
 	AuthStrategyNone         = "none"
+	AuthStrategyRole         = "role"
+	AuthStrategyExternal     = "external"
+	AuthStrategyOPA          = "opa"
 )
 
 // Channel Strategies determine in which kind of channel a command can be executed
@@ -58,6 +85,9 @@ var authStrategies = map[string]Authorizer{
 	AuthStrategyAny:          anyUserAllowed{},
 	AuthStrategyAllowedGroup: userInGroupAllowed{},
 	AuthStrategyNone:         noUserAllowed{},
+	AuthStrategyRole:         userRoleAllowed{},
+	AuthStrategyExternal:     externalAllowed{},
+	AuthStrategyOPA:          opaAllowed{},
 }
 
 var channelStrategies = map[string]Authorizer{
@@ -66,6 +96,28 @@ var channelStrategies = map[string]Authorizer{
 	ChannelStrategyIMOnly:          imOnlyAllowed{},
 }
 
+// DecidesRemotely returns true if the command is authorized by a service over
+// the network, the external service or OPA, which can take a while to reply
+func DecidesRemotely(cmd CommandAuthorization) bool {
+	switch cmd.GetAuthStrategy() {
+	case AuthStrategyExternal, AuthStrategyOPA:
+		return true
+	}
+	return false
+}
+
+// ValidAuthStrategy returns true if the auth strategy exists
+func ValidAuthStrategy(strategy string) bool {
+	_, ok := authStrategies[strategy]
+	return ok
+}
+
+// ValidChannelStrategy returns true if the channel strategy exists
+func ValidChannelStrategy(strategy string) bool {
+	_, ok := channelStrategies[strategy]
+	return ok
+}
+
 // Check checks if a user is allowed to run a command given the command authorization strategy
 func Check(req meeseeks.Request, cmd CommandAuthorization) error {
 	authStrategy, ok := authStrategies[cmd.GetAuthStrategy()]
@@ -74,10 +126,28 @@ func Check(req meeseeks.Request, cmd CommandAuthorization) error {
 		authStrategy = authStrategies[AuthStrategyNone]
 	}
 
-	if err := authStrategy.Check(req, cmd); err != nil {
+	if hasGrant(req.Username, meeseeks.GrantCommand, req.Command) {
+		log.Debugf("User %s was granted command %s", req.Username, req.Command)
+	} else if err := authStrategy.Check(req, cmd); err != nil {
 		return err
 	}
 
+	if r, ok := cmd.(ArgsRestricter); ok {
+		if err := checkRestrictedArgs(req, r.GetRestrictedArgs()); err != nil {
+			return err
+		}
+	}
+
+	if t, ok := cmd.(TimeRestricter); ok && t.GetTimeWindows().Enabled() {
+		if err := checkTimeWindows(req, t.GetTimeWindows()); err != nil {
+			return err
+		}
+	}
+
+	if d, ok := cmd.(ChannelDenier); ok && !req.IsIM && MatchChannel(req.Channel, d.GetDeniedChannels()) {
+		return ErrChannelDenied
+	}
+
 	channelStrategy, ok := channelStrategies[cmd.GetChannelStrategy()]
 	if !ok {
 		log.Errorf("Command does not have a valid auth strategy, falling back to any: %+v", cmd)
@@ -87,6 +157,54 @@ func Check(req meeseeks.Request, cmd CommandAuthorization) error {
 	return channelStrategy.Check(req, cmd)
 }
 
+// checkRestrictedArgs checks that the user belongs to a group allowed to pass
+// every argument of the request that matches a restricted pattern
+func checkRestrictedArgs(req meeseeks.Request, restricted map[string][]string) error {
+	for _, arg := range req.Args {
+		for pattern, allowedGroups := range restricted {
+			if ok, err := path.Match(pattern, arg); err != nil || !ok {
+				continue
+			}
+			if !requesterInAnyGroup(req, allowedGroups) {
+				log.Debugf("User %s is not allowed to pass argument %s", req.Username, arg)
+				return ErrArgNotAllowed
+			}
+		}
+	}
+	return nil
+}
+
+// MatchChannel returns true if the channel matches any of the patterns, which
+// are channel names that can use shell wildcards like deploy-*
+func MatchChannel(channel string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if ok, err := path.Match(pattern, channel); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateChannelPatterns checks that the channel patterns are well formed
+func ValidateChannelPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid channel pattern %s: %s", pattern, err)
+		}
+	}
+	return nil
+}
+
+// ValidateRestrictedArgs checks that the restricted argument patterns are well formed
+func ValidateRestrictedArgs(restricted map[string][]string) error {
+	for pattern := range restricted {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid argument pattern %s: %s", pattern, err)
+		}
+	}
+	return nil
+}
+
 type anyUserAllowed struct {
 }
 
@@ -106,15 +224,35 @@ func (a noUserAllowed) Check(_ meeseeks.Request, _ CommandAuthorization) error {
 type userInGroupAllowed struct {
 }
 
+// Check implements Authorizer.Check, the members of the groups can be chat
+// users or the identities they linked
 func (a userInGroupAllowed) Check(req meeseeks.Request, cmd CommandAuthorization) error {
+	if requesterInAnyGroup(req, cmd.GetAllowedGroups()) {
+		return nil
+	}
+	return ErrUserNotAllowed
+}
+
+// InAnyGroup returns true if the user of the request, or its identity,
+// belongs to any of the groups
+func InAnyGroup(req meeseeks.Request, groups []string) bool {
+	return requesterInAnyGroup(req, groups)
+}
+
+// requesterInAnyGroup returns true if the user of the request, or its identity,
+// belongs to any of the groups
+func requesterInAnyGroup(req meeseeks.Request, allowedGroups []string) bool {
 	username := req.Username
 
-	for _, group := range cmd.GetAllowedGroups() {
+	for _, group := range allowedGroups {
 		err := groups.CheckUserInGroup(username, group)
+		if err == ErrUserNotInGroup && req.Identity != "" {
+			err = groups.CheckUserInGroup(req.Identity, group)
+		}
 		switch err {
 		case nil:
 			log.Debugf("User %s found in group %s", username, group)
-			return nil
+			return true
 		case ErrUserNotInGroup:
 			log.Debugf("User %s is not in group %s", username, group)
 		case ErrGroupNotFound:
@@ -123,40 +261,144 @@ func (a userInGroupAllowed) Check(req meeseeks.Request, cmd CommandAuthorization
 			log.Errorf("Unexpected error %s", err)
 		}
 	}
-	return ErrUserNotAllowed
+	return false
 }
 
 // Groups is used to keep configured groups
 type Groups struct {
 	groups map[string]map[string]bool
+	lock   sync.RWMutex
 }
 
 var groups *Groups
 var knownUsers map[string]struct{}
+var groupStore meeseeks.GroupMemberships
+
+// SetGroupStore sets where the runtime changes to the groups are recorded,
+// Configure merges them with the configured groups
+func SetGroupStore(store meeseeks.GroupMemberships) {
+	groupStore = store
+}
 
-// Configure loads all the configured groups
-//
-// This should go away the moment we start storing groups in some storage
-func Configure(configuredGroups map[string][]string) {
+// Configure loads all the configured groups and merges them with the runtime
+// changes recorded in the group store, if there is one, so they are not lost
+// when the configuration is reloaded
+func Configure(configuredGroups map[string][]string) error {
 	g := Groups{
 		groups: map[string]map[string]bool{},
 	}
-	knownUsers = make(map[string]struct{})
 
 	for name, users := range configuredGroups {
 		group := make(map[string]bool)
 		for _, user := range users {
 			group[user] = true
-			knownUsers[user] = struct{}{}
 		}
 		g.groups[name] = group
 	}
 
+	var err error
+	if groupStore != nil {
+		memberships, listErr := groupStore.List()
+		if listErr != nil {
+			err = fmt.Errorf("could not load group memberships: %s", listErr)
+		}
+		g.apply(memberships)
+	}
+	g.updateKnownUsers()
+
 	groups = &g
+	return err
 }
 
-// CheckUserInGroup returns nil if the user belongs to the given group, else, an error
-func (g *Groups) CheckUserInGroup(username, group string) error {
+// ApplyMemberships applies the recorded runtime memberships on top of the configured groups
+func ApplyMemberships(memberships []meeseeks.GroupMembership) {
+	groups.lock.Lock()
+	defer groups.lock.Unlock()
+
+	groups.apply(memberships)
+	groups.updateKnownUsers()
+}
+
+// AddUserToGroup adds the user to the group, creating the group if it does not exist
+func AddUserToGroup(group, username string) {
+	groups.lock.Lock()
+	defer groups.lock.Unlock()
+
+	groups.add(group, username)
+	groups.updateKnownUsers()
+}
+
+// RemoveUserFromGroup removes the user from the group, the last admin can't be removed
+func RemoveUserFromGroup(group, username string) error {
+	groups.lock.Lock()
+	defer groups.lock.Unlock()
+
+	if err := groups.remove(group, username); err != nil {
+		return err
+	}
+	groups.updateKnownUsers()
+	return nil
+}
+
+// SetGroupMembers replaces the users of the group, creating the group if it
+// does not exist. The runtime changes recorded for the group are applied on
+// top, and the admin group can't be left empty
+func SetGroupMembers(group string, usernames []string) error {
+	if group == AdminGroup && len(usernames) == 0 {
+		return ErrLastAdmin
+	}
+
+	recorded := make([]meeseeks.GroupMembership, 0)
+	if groupStore != nil {
+		memberships, err := groupStore.List()
+		if err != nil {
+			return fmt.Errorf("could not load group memberships: %s", err)
+		}
+		for _, m := range memberships {
+			if m.Group == group {
+				recorded = append(recorded, m)
+			}
+		}
+	}
+
+	groups.lock.Lock()
+	defer groups.lock.Unlock()
+
+	users := make(map[string]bool)
+	for _, username := range usernames {
+		users[username] = true
+	}
+	groups.groups[group] = users
+	groups.apply(recorded)
+	groups.updateKnownUsers()
+	return nil
+}
+
+// apply applies the memberships, must be called with the lock held
+func (g *Groups) apply(memberships []meeseeks.GroupMembership) {
+	for _, m := range memberships {
+		if m.Member {
+			g.add(m.Group, m.Username)
+			continue
+		}
+		if err := g.remove(m.Group, m.Username); err != nil && err != ErrUserNotInGroup && err != ErrGroupNotFound {
+			log.Errorf("Could not remove user %s from group %s: %s", m.Username, m.Group, err)
+		}
+	}
+}
+
+// add adds the user to the group, must be called with the lock held
+func (g *Groups) add(group, username string) {
+	users, ok := g.groups[group]
+	if !ok {
+		users = make(map[string]bool)
+		g.groups[group] = users
+	}
+	users[username] = true
+}
+
+// remove removes the user from the group, must be called with the lock held
+func (g *Groups) remove(group, username string) error {
 	users, ok := g.groups[group]
 	if !ok {
 		return ErrGroupNotFound
@@ -164,11 +406,45 @@ func (g *Groups) CheckUserInGroup(username, group string) error {
 	if _, ok := users[username]; !ok {
 		return ErrUserNotInGroup
 	}
+	if group == AdminGroup && len(users) == 1 {
+		return ErrLastAdmin
+	}
+	delete(users, username)
+	return nil
+}
+
+// updateKnownUsers rebuilds the known users from the groups, must be called with the lock held
+func (g *Groups) updateKnownUsers() {
+	users := make(map[string]struct{})
+	for _, group := range g.groups {
+		for user := range group {
+			users[user] = struct{}{}
+		}
+	}
+	knownUsers = users
+}
+
+// CheckUserInGroup returns nil if the user belongs to the given group, or was
+// temporarily granted it, else, an error
+func (g *Groups) CheckUserInGroup(username, group string) error {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+
+	users, ok := g.groups[group]
+	if !ok {
+		return ErrGroupNotFound
+	}
+	if _, ok := users[username]; !ok && !hasGrant(username, meeseeks.GrantGroup, group) {
+		return ErrUserNotInGroup
+	}
 	return nil
 }
 
 // GetGroups returns the groups and users that are setup
 func GetGroups() map[string][]string {
+	groups.lock.RLock()
+	defer groups.lock.RUnlock()
+
 	g := make(map[string][]string)
 	for group, users := range groups.groups {
 		groupUsers := make([]string, 0)
@@ -181,10 +457,16 @@ func GetGroups() map[string][]string {
 	return g
 }
 
-// IsKnownUser returns true if the user is configured in any group
+// IsKnownUser returns true if the user is configured in any group, or has a
+// temporary grant
 func IsKnownUser(username string) (ok bool) {
-	_, ok = knownUsers[username]
-	return
+	groups.lock.RLock()
+	defer groups.lock.RUnlock()
+
+	if _, ok = knownUsers[username]; ok {
+		return
+	}
+	return hasAnyGrant(username)
 }
 
 type anyChannelAllowed struct{}
@@ -208,10 +490,8 @@ type channelExplicitlyAllowed struct{}
 
 // Check implements Authorizer.Check
 func (a channelExplicitlyAllowed) Check(req meeseeks.Request, cmd CommandAuthorization) error {
-	for _, ch := range cmd.GetAllowedChannels() {
-		if req.Channel == ch {
-			return nil
-		}
+	if MatchChannel(req.Channel, cmd.GetAllowedChannels()) {
+		return nil
 	}
 	return ErrChannelNotAllowed
 }
@@ -1,7 +1,14 @@
 package auth_test
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"gitlab.com/yakshaving.art/meeseeks-box/auth"
 	"gitlab.com/yakshaving.art/meeseeks-box/commands"
@@ -192,3 +199,481 @@ func Test_Groups(t *testing.T) {
 		},
 		auth.GetGroups())
 }
+
+func Test_RuntimeGroupChanges(t *testing.T) {
+	auth.Configure(
+		map[string][]string{
+			auth.AdminGroup: {"user1"},
+			"developer":     {"user1", "user2"},
+		},
+	)
+	auth.AddUserToGroup("operator", "user3")
+	mocks.AssertEquals(t, true, auth.IsKnownUser("user3"))
+
+	mocks.Must(t, "could not remove user", auth.RemoveUserFromGroup("developer", "user2"))
+	mocks.AssertEquals(t, false, auth.IsKnownUser("user2"))
+
+	mocks.AssertEquals(t, auth.ErrGroupNotFound, auth.RemoveUserFromGroup("nonexisting", "user1"))
+	mocks.AssertEquals(t, auth.ErrUserNotInGroup, auth.RemoveUserFromGroup("developer", "user2"))
+	mocks.AssertEquals(t, auth.ErrLastAdmin, auth.RemoveUserFromGroup(auth.AdminGroup, "user1"))
+
+	auth.ApplyMemberships([]meeseeks.GroupMembership{
+		{Group: "developer", Username: "user1", Member: false},
+		{Group: "developer", Username: "user4", Member: true},
+		{Group: auth.AdminGroup, Username: "user1", Member: false},
+	})
+	mocks.AssertEquals(t,
+		map[string][]string{
+			"developer":     {"user4"},
+			"operator":      {"user3"},
+			auth.AdminGroup: {"user1"},
+		},
+		auth.GetGroups())
+}
+
+type recordedMemberships []meeseeks.GroupMembership
+
+func (r recordedMemberships) Add(group, username string) error    { return nil }
+func (r recordedMemberships) Remove(group, username string) error { return nil }
+func (r recordedMemberships) List() ([]meeseeks.GroupMembership, error) {
+	return r, nil
+}
+
+type recordedGrants struct {
+	grants *[]meeseeks.Grant
+}
+
+func (r recordedGrants) Create(g meeseeks.Grant) (meeseeks.Grant, error) {
+	*r.grants = append(*r.grants, g)
+	return g, nil
+}
+func (r recordedGrants) List(_ time.Time) ([]meeseeks.Grant, error) {
+	return *r.grants, nil
+}
+
+func Test_GrantsOfOtherReplicasArePickedUp(t *testing.T) {
+	mocks.Must(t, "could not configure groups", auth.Configure(map[string][]string{
+		auth.AdminGroup: {"admin_user"},
+	}))
+	defer auth.Configure(map[string][]string{})
+
+	recorded := []meeseeks.Grant{}
+	auth.SetGrantStore(recordedGrants{&recorded}, 50*time.Millisecond)
+	defer auth.SetGrantStore(nil, 0)
+	auth.ApplyGrants(nil)
+	defer auth.ApplyGrants(nil)
+
+	cmd := shell.New(meeseeks.CommandOpts{
+		Cmd:           "deploy",
+		AuthStrategy:  auth.AuthStrategyAllowedGroup,
+		AllowedGroups: []string{auth.AdminGroup},
+	})
+	req := meeseeks.Request{Command: "deploy", Username: "someone"}
+	mocks.AssertEquals(t, auth.ErrUserNotAllowed, auth.Check(req, cmd))
+
+	// Granted on another replica
+	recorded = append(recorded, meeseeks.Grant{Username: "someone", Kind: meeseeks.GrantCommand,
+		Target: "deploy", ExpiresAt: time.Now().Add(time.Hour)})
+	mocks.AssertEquals(t, auth.ErrUserNotAllowed, auth.Check(req, cmd))
+
+	time.Sleep(100 * time.Millisecond)
+	mocks.AssertEquals(t, nil, auth.Check(req, cmd))
+}
+
+func Test_ConfigureMergesRecordedMemberships(t *testing.T) {
+	auth.SetGroupStore(recordedMemberships{
+		{Group: "developer", Username: "user2", Member: false},
+		{Group: "developer", Username: "user3", Member: true},
+		{Group: "operator", Username: "user3", Member: true},
+	})
+	defer auth.SetGroupStore(nil)
+
+	mocks.Must(t, "could not configure groups", auth.Configure(map[string][]string{
+		auth.AdminGroup: {"user1"},
+		"developer":     {"user1", "user2"},
+	}))
+	mocks.AssertEquals(t,
+		map[string][]string{
+			"developer":     {"user1", "user3"},
+			"operator":      {"user3"},
+			auth.AdminGroup: {"user1"},
+		},
+		auth.GetGroups())
+
+	mocks.Must(t, "could not set group members", auth.SetGroupMembers("developer", []string{"user2", "user4"}))
+	mocks.AssertEquals(t, []string{"user3", "user4"}, auth.GetGroups()["developer"])
+	mocks.AssertEquals(t, false, auth.IsKnownUser("user2"))
+}
+
+func Test_Roles(t *testing.T) {
+	auth.Configure(map[string][]string{
+		auth.AdminGroup: {"admin_user"},
+		"sre":           {"sre_user"},
+		"oncall":        {"oncall_user"},
+		"devs":          {"dev_user", "sre_user"},
+	})
+	mocks.Must(t, "configure roles", auth.ConfigureRoles(map[string]auth.Role{
+		"developer": {
+			Groups:      []string{"devs"},
+			Permissions: map[string][]string{auth.AnyCommand: {auth.PermissionViewLogs}},
+		},
+		"sre": {
+			Groups:   []string{"sre", "oncall"},
+			Inherits: []string{"developer"},
+			Permissions: map[string][]string{
+				"deploy": {auth.PermissionRun, auth.PermissionCancel},
+			},
+		},
+	}))
+	defer auth.ConfigureRoles(nil)
+
+	tt := []struct {
+		name       string
+		username   string
+		command    string
+		permission string
+		expected   bool
+	}{
+		{"sre can run", "sre_user", "deploy", auth.PermissionRun, true},
+		{"sre can cancel", "sre_user", "deploy", auth.PermissionCancel, true},
+		{"sre inherits view logs", "oncall_user", "deploy", auth.PermissionViewLogs, true},
+		{"sre can't run other commands", "sre_user", "rollback", auth.PermissionRun, false},
+		{"sre can't approve", "sre_user", "deploy", auth.PermissionApprove, false},
+		{"dev can view logs of any command", "dev_user", "rollback", auth.PermissionViewLogs, true},
+		{"dev can't run", "dev_user", "deploy", auth.PermissionRun, false},
+		{"admin can do anything", "admin_user", "deploy", auth.PermissionApprove, true},
+		{"unknown user can't do anything", "stranger", "deploy", auth.PermissionViewLogs, false},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			mocks.AssertEquals(t, tc.expected, auth.HasPermission(tc.username, tc.command, tc.permission))
+		})
+	}
+
+	cmd := shell.New(meeseeks.CommandOpts{Cmd: "deploy", AuthStrategy: auth.AuthStrategyRole})
+	mocks.AssertEquals(t, nil, auth.Check(meeseeks.Request{Command: "deploy", Username: "oncall_user"}, cmd))
+	mocks.AssertEquals(t, auth.ErrUserNotAllowed, auth.Check(meeseeks.Request{Command: "deploy", Username: "dev_user"}, cmd))
+}
+
+func Test_InvalidRoles(t *testing.T) {
+	tt := []struct {
+		name     string
+		roles    map[string]auth.Role
+		expected string
+	}{
+		{
+			name: "invalid permission",
+			roles: map[string]auth.Role{
+				"sre": {Permissions: map[string][]string{"deploy": {"delete"}}},
+			},
+			expected: "role sre grants invalid permission delete on deploy, valid ones are run, view-logs, cancel and approve",
+		},
+		{
+			name: "unknown inherited role",
+			roles: map[string]auth.Role{
+				"sre": {Inherits: []string{"developer"}},
+			},
+			expected: "role sre inherits unknown role developer",
+		},
+		{
+			name: "inheritance cycle",
+			roles: map[string]auth.Role{
+				"developer": {Inherits: []string{"sre"}},
+				"sre":       {Inherits: []string{"developer"}},
+			},
+			expected: "role developer inherits itself: developer -> sre -> developer",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			mocks.AssertEquals(t, tc.expected, auth.ConfigureRoles(tc.roles).Error())
+		})
+	}
+}
+
+func Test_GroupsMatchLinkedIdentities(t *testing.T) {
+	auth.Configure(map[string][]string{
+		"sre": {"someone@example.com"},
+	})
+	cmd := shell.New(meeseeks.CommandOpts{
+		Cmd:           "deploy",
+		AuthStrategy:  auth.AuthStrategyAllowedGroup,
+		AllowedGroups: []string{"sre"},
+	})
+	mocks.AssertEquals(t, nil, auth.Check(meeseeks.Request{
+		Command: "deploy", Username: "someone", Identity: "someone@example.com"}, cmd))
+	mocks.AssertEquals(t, auth.ErrUserNotAllowed, auth.Check(meeseeks.Request{
+		Command: "deploy", Username: "someone"}, cmd))
+}
+
+func Test_ChannelPatterns(t *testing.T) {
+	auth.Configure(map[string][]string{})
+	deploy := shell.New(meeseeks.CommandOpts{
+		Cmd:             "deploy",
+		AuthStrategy:    auth.AuthStrategyAny,
+		ChannelStrategy: auth.ChannelStrategyAllowedChannels,
+		AllowedChannels: []string{"deploy-*", "ops"},
+		DeniedChannels:  []string{"deploy-prod-*"},
+	})
+	anywhere := shell.New(meeseeks.CommandOpts{
+		Cmd:            "echo",
+		AuthStrategy:   auth.AuthStrategyAny,
+		DeniedChannels: []string{"general", "announce?"},
+	})
+
+	tt := []struct {
+		name     string
+		cmd      meeseeks.Command
+		req      meeseeks.Request
+		expected error
+	}{
+		{"wildcard allowed", deploy, meeseeks.Request{Channel: "deploy-staging"}, nil},
+		{"exact allowed", deploy, meeseeks.Request{Channel: "ops"}, nil},
+		{"not allowed", deploy, meeseeks.Request{Channel: "general"}, auth.ErrChannelNotAllowed},
+		{"denied over allowed", deploy, meeseeks.Request{Channel: "deploy-prod-eu"}, auth.ErrChannelDenied},
+		{"denied with any channel", anywhere, meeseeks.Request{Channel: "general"}, auth.ErrChannelDenied},
+		{"denied single char wildcard", anywhere, meeseeks.Request{Channel: "announce1"}, auth.ErrChannelDenied},
+		{"not denied", anywhere, meeseeks.Request{Channel: "random"}, nil},
+		{"deny lists don't apply to IMs", anywhere, meeseeks.Request{Channel: "general", IsIM: true}, nil},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			mocks.AssertEquals(t, tc.expected, auth.Check(tc.req, tc.cmd))
+		})
+	}
+}
+
+func Test_RestrictedArgs(t *testing.T) {
+	auth.Configure(map[string][]string{
+		auth.AdminGroup: {"admin_user"},
+		"sre":           {"sre_user"},
+	})
+	cmd := shell.New(meeseeks.CommandOpts{
+		Cmd:          "deploy",
+		AuthStrategy: auth.AuthStrategyAny,
+		RestrictedArgs: map[string][]string{
+			"production": {auth.AdminGroup},
+			"prod-*":     {auth.AdminGroup, "sre"},
+		},
+	})
+
+	tt := []struct {
+		name     string
+		username string
+		args     []string
+		expected error
+	}{
+		{"anyone can pass other args", "someone", []string{"staging", "-v"}, nil},
+		{"restricted arg", "someone", []string{"production"}, auth.ErrArgNotAllowed},
+		{"restricted arg in any position", "sre_user", []string{"-v", "production"}, auth.ErrArgNotAllowed},
+		{"allowed group", "admin_user", []string{"production"}, nil},
+		{"wildcard restricted arg", "someone", []string{"prod-eu"}, auth.ErrArgNotAllowed},
+		{"wildcard allowed group", "sre_user", []string{"prod-eu"}, nil},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			mocks.AssertEquals(t, tc.expected, auth.Check(meeseeks.Request{
+				Command: "deploy", Username: tc.username, Args: tc.args}, cmd))
+		})
+	}
+}
+
+func Test_TimeWindows(t *testing.T) {
+	officeHours := meeseeks.TimeWindowOpts{
+		Timezone: "Europe/Berlin",
+		Windows: []meeseeks.TimeWindow{
+			{Days: []string{"mon", "tue", "wed", "Thursday"}, From: "09:00", To: "17:00"},
+			{Days: []string{"fri"}, From: "22:00", To: "02:00"},
+		},
+	}
+
+	tt := []struct {
+		name     string
+		at       string
+		expected bool
+	}{
+		{"monday morning", "2019-03-04T09:00:00+01:00", true},
+		{"monday evening", "2019-03-04T17:00:00+01:00", false},
+		{"thursday in utc", "2019-03-07T15:30:00Z", true},
+		{"thursday in utc after hours", "2019-03-07T16:30:00Z", false},
+		{"friday afternoon", "2019-03-08T12:00:00+01:00", false},
+		{"friday night", "2019-03-08T23:00:00+01:00", true},
+		{"past midnight into saturday", "2019-03-09T01:59:00+01:00", true},
+		{"saturday night", "2019-03-09T23:00:00+01:00", false},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			at, err := time.Parse(time.RFC3339, tc.at)
+			mocks.Must(t, "invalid time", err)
+			in, err := auth.InTimeWindow(officeHours, at)
+			mocks.Must(t, "could not check time window", err)
+			mocks.AssertEquals(t, tc.expected, in)
+		})
+	}
+
+	auth.Configure(map[string][]string{
+		auth.AdminGroup: {"admin_user"},
+	})
+	tomorrow := time.Now().Add(24 * time.Hour).Weekday().String()
+	closed := shell.New(meeseeks.CommandOpts{
+		Cmd:          "deploy",
+		AuthStrategy: auth.AuthStrategyAny,
+		TimeWindows: meeseeks.TimeWindowOpts{
+			Windows:        []meeseeks.TimeWindow{{Days: []string{tomorrow}, From: "00:00", To: "24:00"}},
+			OverrideGroups: []string{auth.AdminGroup},
+		},
+	})
+	open := shell.New(meeseeks.CommandOpts{
+		Cmd:          "deploy",
+		AuthStrategy: auth.AuthStrategyAny,
+		TimeWindows: meeseeks.TimeWindowOpts{
+			Windows: []meeseeks.TimeWindow{{From: "00:00", To: "24:00"}},
+		},
+	})
+	mocks.AssertEquals(t, auth.ErrOutsideTimeWindow, auth.Check(meeseeks.Request{Username: "someone"}, closed))
+	mocks.AssertEquals(t, nil, auth.Check(meeseeks.Request{Username: "admin_user"}, closed))
+	mocks.AssertEquals(t, nil, auth.Check(meeseeks.Request{Username: "someone"}, open))
+
+	for _, w := range []meeseeks.TimeWindowOpts{
+		{Timezone: "Mars/Olympus"},
+		{Windows: []meeseeks.TimeWindow{{Days: []string{"someday"}, From: "09:00", To: "17:00"}}},
+		{Windows: []meeseeks.TimeWindow{{From: "9am", To: "17:00"}}},
+		{Windows: []meeseeks.TimeWindow{{From: "09:00", To: "09:00"}}},
+	} {
+		if err := auth.ValidateTimeWindows(w); err == nil {
+			t.Fatalf("time windows %#v should be invalid", w)
+		}
+	}
+}
+
+func Test_ExternalAuth(t *testing.T) {
+	auth.Configure(map[string][]string{
+		auth.AdminGroup: {"admin_user"},
+	})
+	cmd := shell.New(meeseeks.CommandOpts{
+		Cmd:          "deploy",
+		AuthStrategy: auth.AuthStrategyExternal,
+	})
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		req := auth.ExternalRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Username == "broken" {
+			http.Error(w, "boom", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(auth.ExternalDecision{
+			Allow:  req.Channel == "deploys" && req.Command == "deploy" && len(req.Args) == 1 && req.Args[0] == req.Username,
+			Reason: "users can only deploy themselves in deploys",
+		})
+	}))
+	defer s.Close()
+
+	mocks.AssertEquals(t, auth.ErrUserNotAllowed, auth.Check(meeseeks.Request{
+		Command: "deploy", Username: "someone", Args: []string{"someone"}, Channel: "deploys"}, cmd))
+
+	mocks.Must(t, "could not configure external auth", auth.ConfigureExternal(auth.ExternalConfig{
+		URL: s.URL, Token: "secret"}))
+	defer auth.ConfigureExternal(auth.ExternalConfig{})
+
+	tt := []struct {
+		name     string
+		username string
+		channel  string
+		expected error
+	}{
+		{"allowed by the service", "someone", "deploys", nil},
+		{"denied by the service", "someone", "general", auth.ErrUserNotAllowed},
+		{"service fails", "broken", "deploys", auth.ErrUserNotAllowed},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			mocks.AssertEquals(t, tc.expected, auth.Check(meeseeks.Request{
+				Command: "deploy", Username: tc.username, Args: []string{tc.username}, Channel: tc.channel}, cmd))
+		})
+	}
+
+	mocks.Must(t, "could not configure external auth", auth.ConfigureExternal(auth.ExternalConfig{URL: s.URL}))
+	mocks.AssertEquals(t, auth.ErrUserNotAllowed, auth.Check(meeseeks.Request{
+		Command: "deploy", Username: "someone", Args: []string{"someone"}, Channel: "deploys"}, cmd))
+}
+
+func Test_OPA(t *testing.T) {
+	auth.Configure(map[string][]string{
+		auth.AdminGroup: {"admin_user"},
+		"sre":           {"sre_user"},
+	})
+	cmd := shell.New(meeseeks.CommandOpts{
+		Cmd:          "deploy",
+		AuthStrategy: auth.AuthStrategyOPA,
+		Labels:       map[string]string{"env": "production"},
+	})
+
+	pushed := ""
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPut && r.URL.Path == "/v1/policies/meeseeks-deploy":
+			b, _ := ioutil.ReadAll(r.Body)
+			pushed = string(b)
+			w.Write([]byte("{}"))
+		case r.Method == http.MethodPost && r.URL.Path == "/v1/data/meeseeks/allow":
+			payload := struct {
+				Input auth.OPAInput `json:"input"`
+			}{}
+			json.NewDecoder(r.Body).Decode(&payload)
+			allowed := len(payload.Input.Groups) == 1 && payload.Input.Groups[0] == "sre" &&
+				payload.Input.Labels["env"] == "production" && !payload.Input.Time.IsZero()
+			json.NewEncoder(w).Encode(map[string]interface{}{"result": allowed})
+		case r.Method == http.MethodPost && r.URL.Path == "/v1/data/meeseeks/decision":
+			json.NewEncoder(w).Encode(map[string]interface{}{"result": map[string]interface{}{"allow": true}})
+		case r.Method == http.MethodPost:
+			w.Write([]byte("{}")) // undefined documents have no result
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+	defer s.Close()
+	defer auth.ConfigureOPA(auth.OPAConfig{})
+
+	dir, err := ioutil.TempDir("", "policies")
+	mocks.Must(t, "could not create policies dir", err)
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"deploy.rego", "other.rego"} {
+		mocks.Must(t, "could not write policy", ioutil.WriteFile(filepath.Join(dir, name), []byte("package meeseeks\n"), 0644))
+	}
+
+	tt := []struct {
+		name     string
+		path     string
+		username string
+		expected error
+	}{
+		{"allowed by the policy", "", "sre_user", nil},
+		{"denied by the policy", "", "someone", auth.ErrUserNotAllowed},
+		{"allowed by an object decision", "meeseeks/decision", "someone", nil},
+		{"undefined decision", "meeseeks/undefined", "sre_user", auth.ErrUserNotAllowed},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			mocks.Must(t, "could not configure opa", auth.ConfigureOPA(auth.OPAConfig{URL: s.URL, Path: tc.path}))
+			mocks.AssertEquals(t, tc.expected, auth.Check(meeseeks.Request{
+				Command: "deploy", Username: tc.username}, cmd))
+		})
+	}
+
+	// A policy that can't be pushed doesn't stop the configuration
+	mocks.Must(t, "could not configure opa", auth.ConfigureOPA(auth.OPAConfig{
+		URL: s.URL, Policies: []string{filepath.Join(dir, "other.rego")}}))
+	mocks.AssertEquals(t, "", pushed)
+
+	mocks.Must(t, "could not push policy", auth.ConfigureOPA(auth.OPAConfig{
+		URL: s.URL, Policies: []string{filepath.Join(dir, "deploy.rego")}}))
+	mocks.AssertEquals(t, "package meeseeks\n", pushed)
+}
@@ -0,0 +1,183 @@
+package breakglass
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/auth"
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultMaxDuration is how long break glass can last when no maximum is configured
+const DefaultMaxDuration = 4 * time.Hour
+
+// Config holds who can run any command while break glass is on, and where
+// it's announced
+//
+// The members of Groups can run any command, whatever its auth, for as long
+// as break glass lasts, up to MaxDuration seconds. ChannelID is the channel
+// where its start and end are announced
+type Config struct {
+	ChannelID   string        `yaml:"channel_id"`
+	Groups      []string      `yaml:"groups"`
+	MaxDuration time.Duration `yaml:"max_duration"`
+}
+
+// Enabled returns true if there are groups that break glass relaxes the auth for
+func (c Config) Enabled() bool {
+	return len(c.Groups) > 0
+}
+
+// Validate checks that the configuration is usable
+func (c Config) Validate() error {
+	if c.MaxDuration < 0 {
+		return fmt.Errorf("break glass max duration can't be negative")
+	}
+	if c.ChannelID != "" && !c.Enabled() {
+		return fmt.Errorf("break glass requires the groups it relaxes the auth for")
+	}
+	return nil
+}
+
+func (c Config) maxDuration() time.Duration {
+	if c.MaxDuration <= 0 {
+		return DefaultMaxDuration
+	}
+	return c.MaxDuration * time.Second
+}
+
+// Incident is the reason break glass is on
+type Incident struct {
+	Name      string
+	StartedBy string
+	StartedAt time.Time
+	EndsAt    time.Time
+}
+
+// Active returns true if the incident has not ended at the given time
+func (i Incident) Active(now time.Time) bool {
+	return i.Name != "" && now.Before(i.EndsAt)
+}
+
+var config Config
+var current Incident
+var expiry *time.Timer
+var announce = func(channelID, text string) {}
+var mutex sync.Mutex
+
+// Configure sets who break glass relaxes the auth for, an incident that is
+// already on keeps going
+func Configure(cnf Config) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	config = cnf
+}
+
+// SetAnnouncer sets how the start and end of break glass are sent to the channel
+func SetAnnouncer(f func(channelID, text string)) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	announce = f
+}
+
+// Start turns break glass on for the incident for the given duration
+func Start(name, startedBy string, duration time.Duration, now time.Time) (Incident, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if !config.Enabled() {
+		return Incident{}, fmt.Errorf("break glass is not configured")
+	}
+	if duration <= 0 {
+		return Incident{}, fmt.Errorf("how long break glass lasts should be passed with -for")
+	}
+	if duration > config.maxDuration() {
+		return Incident{}, fmt.Errorf("break glass can't last more than %s", config.maxDuration())
+	}
+	if current.Active(now) {
+		return Incident{}, fmt.Errorf("break glass is already on for incident %s", current.Name)
+	}
+
+	current = Incident{Name: name, StartedBy: startedBy, StartedAt: now, EndsAt: now.Add(duration)}
+	expiry = time.AfterFunc(duration, func() { expire(name) })
+
+	text := fmt.Sprintf("Break glass is on for incident %s, started by %s: members of %s can run any command for %s",
+		name, startedBy, strings.Join(config.Groups, ", "), duration)
+	logrus.Warn(text)
+	notify(text)
+
+	return current, nil
+}
+
+// End turns break glass off before it expires
+func End(endedBy string, now time.Time) (Incident, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if !current.Active(now) {
+		return Incident{}, fmt.Errorf("break glass is not on")
+	}
+	ended := current
+	stop()
+
+	text := fmt.Sprintf("Break glass is off for incident %s, ended by %s", ended.Name, endedBy)
+	logrus.Warn(text)
+	notify(text)
+
+	return ended, nil
+}
+
+// Current returns the incident break glass is on for, if any
+func Current(now time.Time) (Incident, bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return current, current.Active(now)
+}
+
+// Allows returns the incident that lets the user of the request run any
+// command, if break glass is on and the user belongs to one of the groups
+func Allows(req meeseeks.Request, now time.Time) (Incident, bool) {
+	mutex.Lock()
+	incident, groups := current, config.Groups
+	mutex.Unlock()
+
+	if !incident.Active(now) || !auth.InAnyGroup(req, groups) {
+		return Incident{}, false
+	}
+	return incident, true
+}
+
+// expire turns break glass off when the incident it was started for runs out
+func expire(name string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if current.Name != name {
+		return
+	}
+	stop()
+
+	text := fmt.Sprintf("Break glass is off for incident %s, it expired", name)
+	logrus.Warn(text)
+	notify(text)
+}
+
+func stop() {
+	if expiry != nil {
+		expiry.Stop()
+	}
+	current, expiry = Incident{}, nil
+}
+
+func notify(text string) {
+	if config.ChannelID != "" {
+		announce(config.ChannelID, text)
+	}
+}
@@ -0,0 +1,70 @@
+package breakglass_test
+
+import (
+	"testing"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/auth"
+	"gitlab.com/yakshaving.art/meeseeks-box/auth/breakglass"
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+	"gitlab.com/yakshaving.art/meeseeks-box/mocks"
+)
+
+func TestBreakGlass(t *testing.T) {
+	auth.Configure(map[string][]string{
+		auth.AdminGroup: {"admin_user"},
+		"oncall":        {"oncall_user"},
+	})
+	defer auth.Configure(map[string][]string{})
+
+	announced := make(chan string, 10)
+	breakglass.SetAnnouncer(func(channelID, text string) {
+		announced <- channelID + ": " + text
+	})
+	defer breakglass.SetAnnouncer(func(_, _ string) {})
+	defer breakglass.Configure(breakglass.Config{})
+
+	now := time.Now()
+	oncall := meeseeks.Request{Username: "oncall_user", Command: "deploy"}
+	other := meeseeks.Request{Username: "someone", Command: "deploy"}
+
+	_, err := breakglass.Start("db-outage", "admin_user", time.Hour, now)
+	mocks.AssertEquals(t, "break glass is not configured", err.Error())
+
+	breakglass.Configure(breakglass.Config{ChannelID: "incidents", Groups: []string{"oncall"}, MaxDuration: 3600})
+
+	_, err = breakglass.Start("db-outage", "admin_user", 2*time.Hour, now)
+	mocks.AssertEquals(t, "break glass can't last more than 1h0m0s", err.Error())
+	_, err = breakglass.Start("db-outage", "admin_user", 0, now)
+	mocks.AssertEquals(t, "how long break glass lasts should be passed with -for", err.Error())
+	_, err = breakglass.End("admin_user", now)
+	mocks.AssertEquals(t, "break glass is not on", err.Error())
+
+	_, ok := breakglass.Allows(oncall, now)
+	mocks.AssertEquals(t, false, ok)
+
+	incident, err := breakglass.Start("db-outage", "admin_user", 50*time.Millisecond, now)
+	mocks.Must(t, "could not break glass", err)
+	mocks.AssertEquals(t, "incidents: Break glass is on for incident db-outage, started by admin_user: "+
+		"members of oncall can run any command for 50ms", <-announced)
+
+	_, err = breakglass.Start("other-outage", "admin_user", time.Hour, now)
+	mocks.AssertEquals(t, "break glass is already on for incident db-outage", err.Error())
+
+	allowed, ok := breakglass.Allows(oncall, now)
+	mocks.AssertEquals(t, true, ok)
+	mocks.AssertEquals(t, incident, allowed)
+	_, ok = breakglass.Allows(other, now)
+	mocks.AssertEquals(t, false, ok)
+
+	mocks.AssertEquals(t, "incidents: Break glass is off for incident db-outage, it expired", <-announced)
+	_, ok = breakglass.Current(time.Now())
+	mocks.AssertEquals(t, false, ok)
+}
+
+func TestInvalidConfig(t *testing.T) {
+	mocks.AssertEquals(t, "break glass max duration can't be negative",
+		breakglass.Config{Groups: []string{"oncall"}, MaxDuration: -3600}.Validate().Error())
+	mocks.AssertEquals(t, "break glass requires the groups it relaxes the auth for",
+		breakglass.Config{ChannelID: "incidents"}.Validate().Error())
+}
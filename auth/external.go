@@ -0,0 +1,183 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+	"gitlab.com/yakshaving.art/meeseeks-box/secrets/vault"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultExternalTimeout is how long the external service has to decide when
+// no timeout is configured
+const DefaultExternalTimeout = 5 * time.Second
+
+// ExternalConfig holds the service that decides on the commands with the
+// external auth strategy
+//
+// The context of each request is posted to URL as JSON, with Token as a
+// bearer token when it's set, it can be a vault reference. The service has
+// Timeout seconds to reply with a 200 and an allow field, anything else
+// denies the request
+type ExternalConfig struct {
+	URL     string        `yaml:"url"`
+	Token   string        `yaml:"token"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// Enabled returns true if an external service is configured
+func (c ExternalConfig) Enabled() bool {
+	return c.URL != ""
+}
+
+// Validate checks that the configuration is usable
+func (c ExternalConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid external auth url %s, it has to be an http or https url", c.URL)
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("external auth timeout can't be negative")
+	}
+	return nil
+}
+
+func (c ExternalConfig) timeout() time.Duration {
+	if c.Timeout <= 0 {
+		return DefaultExternalTimeout
+	}
+	return c.Timeout * time.Second
+}
+
+// ExternalRequest is the context of the request sent to the external service
+type ExternalRequest struct {
+	Username  string   `json:"username"`
+	UserID    string   `json:"user_id"`
+	Identity  string   `json:"identity,omitempty"`
+	Command   string   `json:"command"`
+	Args      []string `json:"args"`
+	Channel   string   `json:"channel"`
+	ChannelID string   `json:"channel_id"`
+	IsIM      bool     `json:"is_im"`
+}
+
+// ExternalDecision is the reply of the external service, Reason is logged
+// when the request is denied
+type ExternalDecision struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason"`
+}
+
+var externalConfig ExternalConfig
+var externalLock sync.Mutex
+
+// ConfigureExternal sets the service that decides on the commands with the
+// external auth strategy, resolving its token
+func ConfigureExternal(cnf ExternalConfig) error {
+	token, err := vault.Resolve(cnf.Token)
+	if err != nil {
+		return fmt.Errorf("could not resolve the external auth token: %s", err)
+	}
+	cnf.Token = token
+
+	externalLock.Lock()
+	defer externalLock.Unlock()
+
+	externalConfig = cnf
+	return nil
+}
+
+type externalAllowed struct {
+}
+
+// Check implements Authorizer.Check, the request is denied when the service
+// is not configured or can't be reached
+func (a externalAllowed) Check(req meeseeks.Request, _ CommandAuthorization) error {
+	externalLock.Lock()
+	cnf := externalConfig
+	externalLock.Unlock()
+
+	if !cnf.Enabled() {
+		log.Errorf("Command %s uses the external auth strategy but no external auth is configured", req.Command)
+		return ErrUserNotAllowed
+	}
+
+	decision, err := askExternal(cnf, req)
+	if err != nil {
+		log.Errorf("Could not check command %s from user %s with the external auth: %s", req.Command, req.Username, err)
+		return ErrUserNotAllowed
+	}
+	if !decision.Allow {
+		log.Debugf("External auth denied command %s to user %s: %s", req.Command, req.Username, decision.Reason)
+		return ErrUserNotAllowed
+	}
+	return nil
+}
+
+func askExternal(cnf ExternalConfig, req meeseeks.Request) (ExternalDecision, error) {
+	decision := ExternalDecision{}
+	if err := postJSON(cnf.URL, cnf.Token, cnf.timeout(), newExternalRequest(req), &decision); err != nil {
+		return ExternalDecision{}, err
+	}
+	return decision, nil
+}
+
+func newExternalRequest(req meeseeks.Request) ExternalRequest {
+	args := req.Args
+	if args == nil {
+		args = []string{}
+	}
+	return ExternalRequest{
+		Username:  req.Username,
+		UserID:    req.UserID,
+		Identity:  req.Identity,
+		Command:   req.Command,
+		Args:      args,
+		Channel:   req.Channel,
+		ChannelID: req.ChannelID,
+		IsIM:      req.IsIM,
+	}
+}
+
+// postJSON posts the payload to the endpoint and decodes the reply into v,
+// only a 200 is taken as a reply
+func postJSON(endpoint, token string, timeout time.Duration, payload, v interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	r, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	client := http.Client{Timeout: timeout}
+	resp, err := client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", endpoint, resp.Status)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("could not parse the reply of %s: %s", endpoint, err)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"sync"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultGrantsTTL is how long the grants are cached before they are read
+// from the store again
+const DefaultGrantsTTL = 5 * time.Second
+
+var grants = make([]meeseeks.Grant, 0)
+var grantsLoadedAt time.Time
+var grantStore meeseeks.Grants
+var grantsTTL time.Duration
+var grantsLock sync.RWMutex
+
+// SetGrantStore sets where the grants are recorded. They are read from it
+// again once they are older than the ttl, so the grants given on other
+// replicas are picked up without waiting for a reload
+func SetGrantStore(store meeseeks.Grants, ttl time.Duration) {
+	grantsLock.Lock()
+	defer grantsLock.Unlock()
+
+	grantStore, grantsTTL = store, ttl
+}
+
+// ApplyGrants replaces the temporary grants with the recorded ones
+func ApplyGrants(recorded []meeseeks.Grant) {
+	grantsLock.Lock()
+	defer grantsLock.Unlock()
+
+	grants = append(make([]meeseeks.Grant, 0, len(recorded)), recorded...)
+	grantsLoadedAt = time.Now()
+}
+
+// AddGrant adds a temporary grant, it's dropped once it expires
+func AddGrant(grant meeseeks.Grant) {
+	grantsLock.Lock()
+	defer grantsLock.Unlock()
+
+	now := time.Now()
+	active := make([]meeseeks.Grant, 0, len(grants)+1)
+	for _, g := range grants {
+		if g.Active(now) {
+			active = append(active, g)
+		}
+	}
+	grants = append(active, grant)
+}
+
+// activeGrants returns the cached grants, reading them from the store first
+// when they are too old. When the store fails the cached ones are used until
+// they are too old again
+func activeGrants(now time.Time) []meeseeks.Grant {
+	grantsLock.RLock()
+	cached, store, stale := grants, grantStore, now.Sub(grantsLoadedAt) >= grantsTTL
+	grantsLock.RUnlock()
+
+	if store == nil || !stale {
+		return cached
+	}
+	recorded, err := store.List(now)
+	if err != nil {
+		log.Errorf("Could not load grants, using the cached ones: %s", err)
+		grantsLock.Lock()
+		grantsLoadedAt = now
+		grantsLock.Unlock()
+		return cached
+	}
+	ApplyGrants(recorded)
+	return recorded
+}
+
+// hasGrant returns true if the user was granted the target and the grant has
+// not expired
+func hasGrant(username, kind, target string) bool {
+	now := time.Now()
+	for _, g := range activeGrants(now) {
+		if g.Username == username && g.Kind == kind && g.Target == target && g.Active(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasAnyGrant returns true if the user has any grant that has not expired
+func hasAnyGrant(username string) bool {
+	now := time.Now()
+	for _, g := range activeGrants(now) {
+		if g.Username == username && g.Active(now) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,275 @@
+package ldap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/auth"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultInterval is how often the groups are synced when no interval is configured
+const DefaultInterval = 15 * time.Minute
+
+// DefaultFilter finds the members of a directory group, %s is replaced with its DN
+const DefaultFilter = "(memberOf=%s)"
+
+// DefaultUsernameAttribute is the attribute of the accounts that holds the chat username
+const DefaultUsernameAttribute = "uid"
+
+// DefaultCommand is the OpenLDAP client used to query the directory
+const DefaultCommand = "ldapsearch"
+
+// How long a single search can take
+const searchTimeout = time.Minute
+
+// Config holds how to reach the directory and which groups to sync
+//
+// Groups maps the meeseeks groups to the DN of the directory groups that hold
+// their members, and UsernameAttribute is the attribute of the member
+// accounts that holds their chat username. They are synced every Interval
+// seconds
+type Config struct {
+	URL               string            `yaml:"url"`
+	BindDN            string            `yaml:"bind_dn"`
+	PasswordFile      string            `yaml:"password_file"`
+	BaseDN            string            `yaml:"base_dn"`
+	Filter            string            `yaml:"filter"`
+	UsernameAttribute string            `yaml:"username_attribute"`
+	Groups            map[string]string `yaml:"groups"`
+	Interval          time.Duration     `yaml:"interval"`
+	Command           string            `yaml:"command"`
+}
+
+// Enabled returns true if a directory is configured
+func (c Config) Enabled() bool {
+	return c.URL != ""
+}
+
+// Validate checks that the configuration is usable
+func (c Config) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") {
+		return fmt.Errorf("invalid ldap url %s, it has to be an ldap or ldaps url", c.URL)
+	}
+	if c.BaseDN == "" {
+		return fmt.Errorf("ldap requires a base_dn")
+	}
+	if len(c.Groups) == 0 {
+		return fmt.Errorf("ldap requires at least one group to sync")
+	}
+	if c.Filter != "" && !strings.Contains(c.Filter, "%s") {
+		return fmt.Errorf("invalid ldap filter %s, it has to contain %%s for the group DN", c.Filter)
+	}
+	if c.Interval < 0 {
+		return fmt.Errorf("ldap interval can't be negative")
+	}
+	return nil
+}
+
+var config Config
+var synced = map[string][]string{}
+var mutex sync.Mutex
+
+// Configure sets the directory to sync the groups from. As configuring the
+// groups resets them, the members of the last sync are applied again to the
+// groups that are still synced
+func Configure(cnf Config) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	config = cnf
+	for group, users := range synced {
+		if _, ok := cnf.Groups[group]; !ok {
+			delete(synced, group)
+			continue
+		}
+		if err := auth.SetGroupMembers(group, users); err != nil {
+			logrus.Errorf("Could not apply the synced members of group %s: %s", group, err)
+		}
+	}
+}
+
+// Sync replaces the members of every synced group with the chat usernames of
+// the members of its directory group. A group that fails to sync keeps its
+// members, and the rest are still synced
+func Sync() error {
+	mutex.Lock()
+	cnf := config
+	mutex.Unlock()
+
+	if !cnf.Enabled() {
+		return nil
+	}
+
+	failed := make([]string, 0)
+	for _, group := range sortedGroups(cnf) {
+		users, err := search(cnf, cnf.Groups[group])
+		if err == nil {
+			err = auth.SetGroupMembers(group, users)
+		}
+		if err != nil {
+			logrus.Errorf("Could not sync group %s from %s: %s", group, cnf.Groups[group], err)
+			failed = append(failed, group)
+			continue
+		}
+		logrus.Debugf("Synced group %s with members %v", group, users)
+
+		mutex.Lock()
+		synced[group] = users
+		mutex.Unlock()
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("could not sync groups %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// Start syncs the groups right away and then on every interval until the
+// returned function is called, it does nothing when no directory is configured
+func Start() func() {
+	mutex.Lock()
+	cnf := config
+	mutex.Unlock()
+
+	if !cnf.Enabled() {
+		return func() {}
+	}
+	interval := cnf.Interval * time.Second
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if err := Sync(); err != nil {
+				logrus.Errorf("Failed to sync groups from ldap: %s", err)
+			}
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return func() { close(stop) }
+}
+
+func sortedGroups(cnf Config) []string {
+	groups := make([]string, 0, len(cnf.Groups))
+	for group := range cnf.Groups {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+// search runs ldapsearch to get the usernames of the members of the group
+func search(cnf Config, groupDN string) ([]string, error) {
+	command := cnf.Command
+	if command == "" {
+		command = DefaultCommand
+	}
+	filter := cnf.Filter
+	if filter == "" {
+		filter = DefaultFilter
+	}
+	attribute := cnf.UsernameAttribute
+	if attribute == "" {
+		attribute = DefaultUsernameAttribute
+	}
+
+	args := []string{"-LLL", "-x", "-H", cnf.URL, "-b", cnf.BaseDN}
+	if cnf.BindDN != "" {
+		args = append(args, "-D", cnf.BindDN)
+	}
+	if cnf.PasswordFile != "" {
+		args = append(args, "-y", cnf.PasswordFile)
+	}
+	args = append(args, fmt.Sprintf(filter, escapeFilter(groupDN)), attribute)
+
+	ctx, cancel := context.WithTimeout(context.Background(), searchTimeout)
+	defer cancel()
+
+	stderr := bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, command, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("search failed: %s %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return parseAttribute(out, attribute)
+}
+
+// parseAttribute reads the values of the attribute from LDIF, unfolding the
+// continuation lines and decoding the base64 values
+func parseAttribute(ldif []byte, attribute string) ([]string, error) {
+	lines := make([]string, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(ldif))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, " ") && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read search results: %s", err)
+	}
+
+	values := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, line := range lines {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || !strings.EqualFold(parts[0], attribute) {
+			continue
+		}
+		value := strings.TrimSpace(parts[1])
+		if strings.HasPrefix(parts[1], ":") {
+			decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(parts[1][1:]))
+			if err != nil {
+				return nil, fmt.Errorf("invalid base64 value for %s: %s", attribute, err)
+			}
+			value = string(decoded)
+		}
+		if value == "" || seen[value] {
+			continue
+		}
+		seen[value] = true
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	return values, nil
+}
+
+// escapeFilter escapes the characters that have a meaning in a search filter
+func escapeFilter(value string) string {
+	replacer := strings.NewReplacer(
+		`\`, `\5c`,
+		`*`, `\2a`,
+		`(`, `\28`,
+		`)`, `\29`,
+		"\x00", `\00`,
+	)
+	return replacer.Replace(value)
+}
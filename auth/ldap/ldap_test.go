@@ -0,0 +1,122 @@
+package ldap_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/auth"
+	"gitlab.com/yakshaving.art/meeseeks-box/auth/ldap"
+	"gitlab.com/yakshaving.art/meeseeks-box/mocks"
+)
+
+// fakeSearch answers like ldapsearch would for the members of each group
+const fakeSearch = `#!/bin/sh
+case "$*" in
+*cn=sre,*)
+	cat <<LDIF
+dn: uid=alice,ou=people,dc=example,dc=com
+uid: alice
+
+dn: uid=bob,ou=people,dc=example,dc=com
+uid: b
+ ob
+
+dn: uid=carol,ou=people,dc=example,dc=com
+uid:: Y2Fyb2w=
+LDIF
+	;;
+*cn=devs,*)
+	echo "dn: uid=dave,ou=people,dc=example,dc=com"
+	echo "uid: dave"
+	;;
+*)
+	echo "ldap_bind: Invalid credentials (49)" >&2
+	exit 49
+	;;
+esac
+`
+
+func TestSyncingGroups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meeseeks-ldap")
+	mocks.Must(t, "could not create tmp dir", err)
+	defer os.RemoveAll(dir)
+
+	command := filepath.Join(dir, "ldapsearch")
+	mocks.Must(t, "could not write ldapsearch", ioutil.WriteFile(command, []byte(fakeSearch), 0755))
+
+	auth.Configure(map[string][]string{
+		auth.AdminGroup: {"admin_user"},
+		"sre":           {"mallory"},
+		"broken":        {"eve"},
+	})
+	cnf := ldap.Config{
+		URL:     "ldaps://ldap.example.com",
+		BaseDN:  "ou=people,dc=example,dc=com",
+		Command: command,
+		Groups: map[string]string{
+			"sre":    "cn=sre,ou=groups,dc=example,dc=com",
+			"devs":   "cn=devs,ou=groups,dc=example,dc=com",
+			"broken": "cn=broken,ou=groups,dc=example,dc=com",
+		},
+	}
+	ldap.Configure(cnf)
+	defer ldap.Configure(ldap.Config{})
+
+	err = ldap.Sync()
+	mocks.AssertEquals(t, "could not sync groups broken", err.Error())
+	mocks.AssertEquals(t, map[string][]string{
+		auth.AdminGroup: {"admin_user"},
+		"broken":        {"eve"},
+		"devs":          {"dave"},
+		"sre":           {"alice", "bob", "carol"},
+	}, auth.GetGroups())
+
+	// Loading the configuration again resets the groups, the synced members stay
+	auth.Configure(map[string][]string{
+		auth.AdminGroup: {"admin_user"},
+	})
+	delete(cnf.Groups, "devs")
+	ldap.Configure(cnf)
+	mocks.AssertEquals(t, map[string][]string{
+		auth.AdminGroup: {"admin_user"},
+		"sre":           {"alice", "bob", "carol"},
+	}, auth.GetGroups())
+}
+
+func TestInvalidConfig(t *testing.T) {
+	tt := []struct {
+		name     string
+		cnf      ldap.Config
+		expected string
+	}{
+		{
+			name:     "invalid url",
+			cnf:      ldap.Config{URL: "http://ldap.example.com"},
+			expected: "invalid ldap url http://ldap.example.com, it has to be an ldap or ldaps url",
+		},
+		{
+			name:     "no base dn",
+			cnf:      ldap.Config{URL: "ldap://ldap.example.com"},
+			expected: "ldap requires a base_dn",
+		},
+		{
+			name:     "no groups",
+			cnf:      ldap.Config{URL: "ldap://ldap.example.com", BaseDN: "dc=example,dc=com"},
+			expected: "ldap requires at least one group to sync",
+		},
+		{
+			name: "filter without the group",
+			cnf: ldap.Config{URL: "ldap://ldap.example.com", BaseDN: "dc=example,dc=com",
+				Groups: map[string]string{"sre": "cn=sre"}, Filter: "(objectClass=person)"},
+			expected: "invalid ldap filter (objectClass=person), it has to contain %s for the group DN",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			mocks.AssertEquals(t, tc.expected, tc.cnf.Validate().Error())
+		})
+	}
+	mocks.AssertEquals(t, nil, ldap.Config{}.Validate())
+}
@@ -0,0 +1,368 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultLinkTTL is how long a link can be used when no ttl is configured
+const DefaultLinkTTL = 10 * time.Minute
+
+// DefaultScopes are the scopes requested when none are configured
+var DefaultScopes = []string{"openid", "email"}
+
+// How long a call to the provider can take
+const providerTimeout = 10 * time.Second
+
+// ErrIdentityRequired is returned when a user that has not linked an identity
+// runs a command and linking is required
+var ErrIdentityRequired = errors.New("user has no linked identity")
+
+// ErrNotConfigured is returned when linking is used without a provider
+var ErrNotConfigured = errors.New("identity linking is not configured")
+
+// Config holds the OIDC provider the chat users link their identity with
+//
+// RedirectURL is where the provider sends the users back, it has to be
+// registered in the provider and reach the HTTP server of the Meeseeks.
+// RequireLink rejects the commands of the users that have not linked an
+// identity, and LinkTTL is how many seconds the links they get can be used
+type Config struct {
+	Issuer           string        `yaml:"issuer"`
+	ClientID         string        `yaml:"client_id"`
+	ClientSecretFile string        `yaml:"client_secret_file"`
+	RedirectURL      string        `yaml:"redirect_url"`
+	Scopes           []string      `yaml:"scopes"`
+	RequireLink      bool          `yaml:"require_link"`
+	LinkTTL          time.Duration `yaml:"link_ttl"`
+}
+
+// Enabled returns true if a provider is configured
+func (c Config) Enabled() bool {
+	return c.Issuer != ""
+}
+
+// Validate checks that the configuration is usable
+func (c Config) Validate() error {
+	if !c.Enabled() {
+		if c.RequireLink {
+			return fmt.Errorf("oidc require_link needs an issuer")
+		}
+		return nil
+	}
+	for _, u := range [][]string{{"issuer", c.Issuer}, {"redirect_url", c.RedirectURL}} {
+		parsed, err := url.Parse(u[1])
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("invalid oidc %s %s, it has to be an http or https url", u[0], u[1])
+		}
+	}
+	if c.ClientID == "" {
+		return fmt.Errorf("oidc requires a client_id")
+	}
+	if c.LinkTTL < 0 {
+		return fmt.Errorf("oidc link ttl can't be negative")
+	}
+	return nil
+}
+
+// CallbackPath returns the path of the redirect url, where the callback is handled
+func (c Config) CallbackPath() string {
+	u, err := url.Parse(c.RedirectURL)
+	if err != nil {
+		return ""
+	}
+	return u.Path
+}
+
+// provider holds the endpoints published in the discovery document
+type provider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+var config Config
+var discovered *provider
+var mutex sync.Mutex
+
+// Configure sets the provider to link identities with, links that were
+// already sent keep working
+func Configure(cnf Config) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if cnf.Issuer != config.Issuer {
+		discovered = nil
+	}
+	config = cnf
+}
+
+func currentConfig() Config {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return config
+}
+
+// Identify sets the identity linked to the user of the request, if any
+func Identify(req meeseeks.Request) meeseeks.Request {
+	if !currentConfig().Enabled() {
+		return req
+	}
+	identity, err := persistence.Identities().Get(req.UserID)
+	switch err {
+	case nil:
+		req.Identity = identity.Name()
+	case meeseeks.ErrNoIdentity:
+	default:
+		logrus.Errorf("Could not get the identity of user %s: %s", req.Username, err)
+	}
+	return req
+}
+
+// Check returns ErrIdentityRequired if linking is required and the request
+// has no identity
+func Check(req meeseeks.Request) error {
+	if currentConfig().RequireLink && req.Identity == "" {
+		return ErrIdentityRequired
+	}
+	return nil
+}
+
+// NewLink returns a one time url the user has to open to link its identity,
+// it expires after the link ttl
+func NewLink(req meeseeks.Request) (string, time.Duration, error) {
+	cnf := currentConfig()
+	if !cnf.Enabled() {
+		return "", 0, ErrNotConfigured
+	}
+	p, err := discover(cnf)
+	if err != nil {
+		return "", 0, err
+	}
+
+	state, err := newState()
+	if err != nil {
+		return "", 0, err
+	}
+	ttl := cnf.LinkTTL * time.Second
+	if ttl <= 0 {
+		ttl = DefaultLinkTTL
+	}
+
+	// The link is stored so it can be followed on any replica that shares
+	// the database, and across restarts
+	err = persistence.Identities().AddLink(meeseeks.IdentityLink{
+		State:     state,
+		UserID:    req.UserID,
+		Username:  req.Username,
+		ExpiresAt: time.Now().Add(ttl),
+	})
+	if err != nil {
+		return "", 0, fmt.Errorf("could not store link: %s", err)
+	}
+
+	scopes := cnf.Scopes
+	if len(scopes) == 0 {
+		scopes = DefaultScopes
+	}
+	params := url.Values{
+		"response_type": {"code"},
+		"client_id":     {cnf.ClientID},
+		"redirect_uri":  {cnf.RedirectURL},
+		"scope":         {strings.Join(scopes, " ")},
+		"state":         {state},
+	}
+	separator := "?"
+	if strings.Contains(p.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return p.AuthorizationEndpoint + separator + params.Encode(), ttl, nil
+}
+
+// RegisterCallback starts handling the callback in the path of the redirect
+// url, it does nothing when no provider is configured
+func RegisterCallback() {
+	cnf := currentConfig()
+	if !cnf.Enabled() {
+		return
+	}
+	logrus.Infof("Handling oidc callbacks on %s", cnf.CallbackPath())
+	http.HandleFunc(cnf.CallbackPath(), HandleCallback)
+}
+
+// HandleCallback implements the http handle request function interface, it
+// takes the user back from the provider and links the identity it logged in
+// with to the chat user the link was sent to
+func HandleCallback(w http.ResponseWriter, r *http.Request) {
+	if e := r.FormValue("error"); e != "" {
+		http.Error(w, fmt.Sprintf("the identity provider returned %s", e), http.StatusBadRequest)
+		return
+	}
+
+	link, err := persistence.Identities().TakeLink(r.FormValue("state"), time.Now())
+	switch err {
+	case nil:
+	case meeseeks.ErrNoIdentityLink:
+		http.Error(w, "the link is invalid or expired, ask for a new one", http.StatusBadRequest)
+		return
+	default:
+		logrus.Errorf("Could not get the identity link: %s", err)
+		http.Error(w, "could not get the link", http.StatusInternalServerError)
+		return
+	}
+
+	identity, err := exchange(currentConfig(), r.FormValue("code"))
+	if err != nil {
+		logrus.Errorf("Could not link the identity of user %s: %s", link.Username, err)
+		http.Error(w, "could not get the identity from the provider", http.StatusBadGateway)
+		return
+	}
+	identity.UserID = link.UserID
+	identity.Username = link.Username
+	identity.LinkedAt = time.Now().UTC()
+
+	if err := persistence.Identities().Link(identity); err != nil {
+		logrus.Errorf("Could not store the identity of user %s: %s", link.Username, err)
+		http.Error(w, "could not store the identity", http.StatusInternalServerError)
+		return
+	}
+	logrus.Infof("User %s linked identity %s", link.Username, identity.Name())
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "%s is now linked to %s, you can close this page\n", link.Username, identity.Name())
+}
+
+func newState() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("could not create link: %s", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// discover gets the endpoints of the provider, once
+func discover(cnf Config) (provider, error) {
+	mutex.Lock()
+	p := discovered
+	mutex.Unlock()
+	if p != nil {
+		return *p, nil
+	}
+
+	p = &provider{}
+	if err := getJSON(strings.TrimSuffix(cnf.Issuer, "/")+"/.well-known/openid-configuration", "", p); err != nil {
+		return provider{}, fmt.Errorf("could not discover the oidc provider: %s", err)
+	}
+	// The identities are recorded with the issuer of the document, which has
+	// to be the configured one so another provider can't pass for it
+	if strings.TrimSuffix(p.Issuer, "/") != strings.TrimSuffix(cnf.Issuer, "/") {
+		return provider{}, fmt.Errorf("the oidc provider publishes the issuer %q instead of %q", p.Issuer, cnf.Issuer)
+	}
+	if p.AuthorizationEndpoint == "" || p.TokenEndpoint == "" || p.UserinfoEndpoint == "" {
+		return provider{}, fmt.Errorf("the oidc provider does not publish the authorization, token and userinfo endpoints")
+	}
+
+	mutex.Lock()
+	discovered = p
+	mutex.Unlock()
+	return *p, nil
+}
+
+// exchange trades the code for an access token and gets the account of the
+// user from the userinfo endpoint
+func exchange(cnf Config, code string) (meeseeks.Identity, error) {
+	p, err := discover(cnf)
+	if err != nil {
+		return meeseeks.Identity{}, err
+	}
+
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {cnf.RedirectURL},
+		"client_id":    {cnf.ClientID},
+	}
+	if cnf.ClientSecretFile != "" {
+		secret, err := ioutil.ReadFile(cnf.ClientSecretFile)
+		if err != nil {
+			return meeseeks.Identity{}, fmt.Errorf("could not read client secret: %s", err)
+		}
+		form.Set("client_secret", strings.TrimSpace(string(secret)))
+	}
+
+	client := http.Client{Timeout: providerTimeout}
+	resp, err := client.PostForm(p.TokenEndpoint, form)
+	if err != nil {
+		return meeseeks.Identity{}, fmt.Errorf("could not get token: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return meeseeks.Identity{}, fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+	token := struct {
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return meeseeks.Identity{}, fmt.Errorf("could not parse token: %s", err)
+	}
+
+	userinfo := struct {
+		Subject       string `json:"sub"`
+		Email         string `json:"email"`
+		EmailVerified *bool  `json:"email_verified"`
+	}{}
+	if err := getJSON(p.UserinfoEndpoint, token.AccessToken, &userinfo); err != nil {
+		return meeseeks.Identity{}, fmt.Errorf("could not get userinfo: %s", err)
+	}
+	if userinfo.Subject == "" {
+		return meeseeks.Identity{}, fmt.Errorf("userinfo has no subject")
+	}
+
+	identity := meeseeks.Identity{
+		Issuer:  p.Issuer,
+		Subject: userinfo.Subject,
+	}
+	// Only an email the provider verified tells who the user is, a missing
+	// claim is not taken as verified
+	if userinfo.EmailVerified != nil && *userinfo.EmailVerified {
+		identity.Email = userinfo.Email
+	}
+	return identity, nil
+}
+
+func getJSON(url, accessToken string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+
+	client := http.Client{Timeout: providerTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
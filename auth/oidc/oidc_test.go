@@ -0,0 +1,249 @@
+package oidc_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/auth/oidc"
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+	"gitlab.com/yakshaving.art/meeseeks-box/mocks"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence"
+)
+
+func newProvider(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	var provider *httptest.Server
+	discovery := func(w http.ResponseWriter, _ *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 provider.URL,
+			"authorization_endpoint": provider.URL + "/authorize",
+			"token_endpoint":         provider.URL + "/token",
+			"userinfo_endpoint":      provider.URL + "/userinfo",
+		})
+	}
+	mux.HandleFunc("/.well-known/openid-configuration", discovery)
+	// A tenant that publishes the document of another issuer
+	mux.HandleFunc("/tenant/.well-known/openid-configuration", discovery)
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		mocks.AssertEquals(t, "authorization_code", r.FormValue("grant_type"))
+		mocks.AssertEquals(t, "meeseeks", r.FormValue("client_id"))
+		switch r.FormValue("code") {
+		case "good-code":
+			json.NewEncoder(w).Encode(map[string]string{"access_token": "access-token"})
+		case "unverified-code":
+			json.NewEncoder(w).Encode(map[string]string{"access_token": "unverified-token"})
+		default:
+			http.Error(w, "invalid_grant", http.StatusBadRequest)
+		}
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "Bearer unverified-token" {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"sub":   "someone@example.com",
+				"email": "someone@example.com",
+			})
+			return
+		}
+		mocks.AssertEquals(t, "Bearer access-token", r.Header.Get("Authorization"))
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"sub":            "00u1abcd",
+			"email":          "someone@example.com",
+			"email_verified": true,
+		})
+	})
+	provider = httptest.NewServer(mux)
+	return provider
+}
+
+func callback(t *testing.T, params url.Values) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	oidc.HandleCallback(w, httptest.NewRequest(http.MethodGet, "/oidc/callback?"+params.Encode(), nil))
+	return w
+}
+
+func TestLinkingAnIdentity(t *testing.T) {
+	provider := newProvider(t)
+	defer provider.Close()
+
+	oidc.Configure(oidc.Config{
+		Issuer:      provider.URL,
+		ClientID:    "meeseeks",
+		RedirectURL: "https://meeseeks.example.com/oidc/callback",
+		RequireLink: true,
+	})
+	defer oidc.Configure(oidc.Config{})
+
+	mocks.Must(t, "failed to link an identity", mocks.WithTmpDB(func(_ string) {
+		req := meeseeks.Request{Command: "echo", Username: "someone", UserID: "U123"}
+
+		req = oidc.Identify(req)
+		mocks.AssertEquals(t, "", req.Identity)
+		mocks.AssertEquals(t, oidc.ErrIdentityRequired, oidc.Check(req))
+
+		link, _, err := oidc.NewLink(req)
+		mocks.Must(t, "could not create link", err)
+		u, err := url.Parse(link)
+		mocks.Must(t, "invalid link", err)
+		mocks.AssertEquals(t, provider.URL+"/authorize", u.Scheme+"://"+u.Host+u.Path)
+		mocks.AssertEquals(t, "openid email", u.Query().Get("scope"))
+		mocks.AssertEquals(t, "https://meeseeks.example.com/oidc/callback", u.Query().Get("redirect_uri"))
+		state := u.Query().Get("state")
+
+		w := callback(t, url.Values{"state": {"forged"}, "code": {"good-code"}})
+		mocks.AssertEquals(t, http.StatusBadRequest, w.Code)
+
+		w = callback(t, url.Values{"state": {state}, "code": {"good-code"}})
+		mocks.AssertEquals(t, http.StatusOK, w.Code)
+		mocks.AssertEquals(t, "someone is now linked to someone@example.com, you can close this page\n", w.Body.String())
+
+		w = callback(t, url.Values{"state": {state}, "code": {"good-code"}})
+		mocks.AssertEquals(t, http.StatusBadRequest, w.Code)
+
+		identity, err := persistence.Identities().Get("U123")
+		mocks.Must(t, "could not get identity", err)
+		mocks.AssertEquals(t, provider.URL, identity.Issuer)
+		mocks.AssertEquals(t, "00u1abcd", identity.Subject)
+		mocks.AssertEquals(t, "someone", identity.Username)
+
+		req = oidc.Identify(req)
+		mocks.AssertEquals(t, "someone@example.com", req.Identity)
+		mocks.AssertEquals(t, nil, oidc.Check(req))
+
+		mocks.Must(t, "could not unlink", persistence.Identities().Unlink("U123"))
+		mocks.AssertEquals(t, meeseeks.ErrNoIdentity, persistence.Identities().Unlink("U123"))
+	}))
+}
+
+func TestRejectedCodesAreNotLinked(t *testing.T) {
+	provider := newProvider(t)
+	defer provider.Close()
+
+	oidc.Configure(oidc.Config{
+		Issuer:      provider.URL,
+		ClientID:    "meeseeks",
+		RedirectURL: "https://meeseeks.example.com/oidc/callback",
+	})
+	defer oidc.Configure(oidc.Config{})
+
+	mocks.Must(t, "failed to reject a code", mocks.WithTmpDB(func(_ string) {
+		link, _, err := oidc.NewLink(meeseeks.Request{Username: "someone", UserID: "U123"})
+		mocks.Must(t, "could not create link", err)
+		u, _ := url.Parse(link)
+
+		w := callback(t, url.Values{"state": {u.Query().Get("state")}, "code": {"bad-code"}})
+		mocks.AssertEquals(t, http.StatusBadGateway, w.Code)
+
+		_, err = persistence.Identities().Get("U123")
+		mocks.AssertEquals(t, meeseeks.ErrNoIdentity, err)
+	}))
+}
+
+func TestProvidersOfAnotherIssuerAreRejected(t *testing.T) {
+	provider := newProvider(t)
+	defer provider.Close()
+
+	oidc.Configure(oidc.Config{
+		Issuer:      provider.URL + "/tenant",
+		ClientID:    "meeseeks",
+		RedirectURL: "https://meeseeks.example.com/oidc/callback",
+	})
+	defer oidc.Configure(oidc.Config{})
+
+	mocks.Must(t, "failed to reject the provider", mocks.WithTmpDB(func(_ string) {
+		_, _, err := oidc.NewLink(meeseeks.Request{Username: "someone", UserID: "U123"})
+		mocks.AssertEquals(t, fmt.Sprintf("the oidc provider publishes the issuer %q instead of %q",
+			provider.URL, provider.URL+"/tenant"), fmt.Sprint(err))
+	}))
+}
+
+func TestExpiredLinksAreRejected(t *testing.T) {
+	provider := newProvider(t)
+	defer provider.Close()
+
+	oidc.Configure(oidc.Config{
+		Issuer:      provider.URL,
+		ClientID:    "meeseeks",
+		RedirectURL: "https://meeseeks.example.com/oidc/callback",
+	})
+	defer oidc.Configure(oidc.Config{})
+
+	mocks.Must(t, "failed to reject an expired link", mocks.WithTmpDB(func(_ string) {
+		mocks.Must(t, "could not add link", persistence.Identities().AddLink(meeseeks.IdentityLink{
+			State:     "expired-state",
+			UserID:    "U123",
+			Username:  "someone",
+			ExpiresAt: time.Now().Add(-time.Second),
+		}))
+
+		w := callback(t, url.Values{"state": {"expired-state"}, "code": {"good-code"}})
+		mocks.AssertEquals(t, http.StatusBadRequest, w.Code)
+		mocks.AssertEquals(t, "the link is invalid or expired, ask for a new one\n", w.Body.String())
+
+		_, err := persistence.Identities().Get("U123")
+		mocks.AssertEquals(t, meeseeks.ErrNoIdentity, err)
+	}))
+}
+
+func TestInvalidConfig(t *testing.T) {
+	tt := []struct {
+		name     string
+		cnf      oidc.Config
+		expected string
+	}{
+		{
+			name:     "required without issuer",
+			cnf:      oidc.Config{RequireLink: true},
+			expected: "oidc require_link needs an issuer",
+		},
+		{
+			name:     "invalid redirect url",
+			cnf:      oidc.Config{Issuer: "https://login.example.com", RedirectURL: "/oidc/callback"},
+			expected: "invalid oidc redirect_url /oidc/callback, it has to be an http or https url",
+		},
+		{
+			name: "no client id",
+			cnf: oidc.Config{Issuer: "https://login.example.com",
+				RedirectURL: "https://meeseeks.example.com/oidc/callback"},
+			expected: "oidc requires a client_id",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			mocks.AssertEquals(t, tc.expected, tc.cnf.Validate().Error())
+		})
+	}
+}
+
+func TestUnverifiedEmailsAreNotTheIdentity(t *testing.T) {
+	provider := newProvider(t)
+	defer provider.Close()
+
+	oidc.Configure(oidc.Config{
+		Issuer:      provider.URL,
+		ClientID:    "meeseeks",
+		RedirectURL: "https://meeseeks.example.com/oidc/callback",
+	})
+	defer oidc.Configure(oidc.Config{})
+
+	mocks.Must(t, "failed to link an identity", mocks.WithTmpDB(func(_ string) {
+		req := meeseeks.Request{Command: "echo", Username: "someone", UserID: "U123"}
+		link, _, err := oidc.NewLink(req)
+		mocks.Must(t, "could not create link", err)
+		u, _ := url.Parse(link)
+
+		w := callback(t, url.Values{"state": {u.Query().Get("state")}, "code": {"unverified-code"}})
+		mocks.AssertEquals(t, http.StatusOK, w.Code)
+
+		identity, err := persistence.Identities().Get("U123")
+		mocks.Must(t, "could not get identity", err)
+		mocks.AssertEquals(t, "", identity.Email)
+
+		req = oidc.Identify(req)
+		mocks.AssertEquals(t, provider.URL+"#someone@example.com", req.Identity)
+	}))
+}
@@ -0,0 +1,212 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+	"gitlab.com/yakshaving.art/meeseeks-box/secrets/vault"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultOPAPath is the document of the decision when no path is configured
+const DefaultOPAPath = "meeseeks/allow"
+
+// DefaultOPATimeout is how long OPA has to decide when no timeout is configured
+const DefaultOPATimeout = 5 * time.Second
+
+// OPAConfig holds the Open Policy Agent that decides on the commands with the
+// opa auth strategy
+//
+// The decision is the document in Path, like meeseeks/allow, it can be a
+// boolean or an object with an allow field. Policies are rego files that are
+// pushed to OPA when the configuration is loaded, they are not needed when
+// OPA loads the policies from a bundle. Token is sent as a bearer token when
+// it's set, it can be a vault reference, and OPA has Timeout seconds to decide
+type OPAConfig struct {
+	URL      string        `yaml:"url"`
+	Path     string        `yaml:"path"`
+	Policies []string      `yaml:"policies"`
+	Token    string        `yaml:"token"`
+	Timeout  time.Duration `yaml:"timeout"`
+}
+
+// Enabled returns true if OPA is configured
+func (c OPAConfig) Enabled() bool {
+	return c.URL != ""
+}
+
+// Validate checks that the configuration is usable
+func (c OPAConfig) Validate() error {
+	if !c.Enabled() {
+		if len(c.Policies) > 0 {
+			return fmt.Errorf("opa policies require an opa url")
+		}
+		return nil
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid opa url %s, it has to be an http or https url", c.URL)
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("opa timeout can't be negative")
+	}
+	return nil
+}
+
+func (c OPAConfig) path() string {
+	if c.Path == "" {
+		return DefaultOPAPath
+	}
+	return strings.Trim(c.Path, "/")
+}
+
+func (c OPAConfig) timeout() time.Duration {
+	if c.Timeout <= 0 {
+		return DefaultOPATimeout
+	}
+	return c.Timeout * time.Second
+}
+
+// OPAInput is the input the policies decide on, the request context along
+// with the groups of the user, the labels of the command and when it's run
+type OPAInput struct {
+	ExternalRequest
+	Groups []string          `json:"groups"`
+	Labels map[string]string `json:"labels"`
+	Time   time.Time         `json:"time"`
+}
+
+var opaConfig OPAConfig
+var opaLock sync.Mutex
+
+// ConfigureOPA sets the agent that decides on the commands with the opa auth
+// strategy, resolving its token and pushing the policies to it. A policy that
+// can't be pushed is logged but doesn't fail the configuration, OPA keeps the
+// policies it had and the requests it can't decide on are denied anyway
+func ConfigureOPA(cnf OPAConfig) error {
+	token, err := vault.Resolve(cnf.Token)
+	if err != nil {
+		return fmt.Errorf("could not resolve the opa token: %s", err)
+	}
+	cnf.Token = token
+
+	for _, policy := range cnf.Policies {
+		if err := pushPolicy(cnf, policy); err != nil {
+			log.Errorf("%s", err)
+		}
+	}
+
+	opaLock.Lock()
+	defer opaLock.Unlock()
+
+	opaConfig = cnf
+	return nil
+}
+
+// pushPolicy creates or updates the policy in OPA, named after its file
+func pushPolicy(cnf OPAConfig, policy string) error {
+	rego, err := ioutil.ReadFile(policy)
+	if err != nil {
+		return fmt.Errorf("could not read opa policy: %s", err)
+	}
+	id := "meeseeks-" + strings.TrimSuffix(filepath.Base(policy), filepath.Ext(policy))
+
+	r, err := http.NewRequest(http.MethodPut, strings.TrimSuffix(cnf.URL, "/")+"/v1/policies/"+id, bytes.NewReader(rego))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "text/plain")
+	if cnf.Token != "" {
+		r.Header.Set("Authorization", "Bearer "+cnf.Token)
+	}
+
+	client := http.Client{Timeout: cnf.timeout()}
+	resp, err := client.Do(r)
+	if err != nil {
+		return fmt.Errorf("could not push opa policy %s: %s", policy, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("could not push opa policy %s: opa returned %s %s", policy, resp.Status,
+			strings.TrimSpace(string(body)))
+	}
+	log.Infof("Pushed opa policy %s as %s", policy, id)
+	return nil
+}
+
+type opaAllowed struct {
+}
+
+// Check implements Authorizer.Check, the request is denied when OPA is not
+// configured, can't be reached or the decision is not defined
+func (a opaAllowed) Check(req meeseeks.Request, cmd CommandAuthorization) error {
+	opaLock.Lock()
+	cnf := opaConfig
+	opaLock.Unlock()
+
+	if !cnf.Enabled() {
+		log.Errorf("Command %s uses the opa auth strategy but opa is not configured", req.Command)
+		return ErrUserNotAllowed
+	}
+
+	input := OPAInput{
+		ExternalRequest: newExternalRequest(req),
+		Groups:          groupsOf(req),
+		Labels:          map[string]string{},
+		Time:            time.Now().UTC(),
+	}
+	if labeled, ok := cmd.(meeseeks.Labeled); ok && labeled.GetLabels() != nil {
+		input.Labels = labeled.GetLabels()
+	}
+
+	reply := struct {
+		Result *json.RawMessage `json:"result"`
+	}{}
+	endpoint := strings.TrimSuffix(cnf.URL, "/") + "/v1/data/" + cnf.path()
+	if err := postJSON(endpoint, cnf.Token, cnf.timeout(), map[string]interface{}{"input": input}, &reply); err != nil {
+		log.Errorf("Could not check command %s from user %s with opa: %s", req.Command, req.Username, err)
+		return ErrUserNotAllowed
+	}
+	if reply.Result == nil {
+		log.Errorf("Opa has no decision in %s for command %s", cnf.path(), req.Command)
+		return ErrUserNotAllowed
+	}
+
+	decision := ExternalDecision{}
+	if err := json.Unmarshal(*reply.Result, &decision.Allow); err != nil {
+		if err := json.Unmarshal(*reply.Result, &decision); err != nil {
+			log.Errorf("Opa decision %s is not a boolean or an object with allow: %s", cnf.path(), err)
+			return ErrUserNotAllowed
+		}
+	}
+	if !decision.Allow {
+		log.Debugf("Opa denied command %s to user %s: %s", req.Command, req.Username, decision.Reason)
+		return ErrUserNotAllowed
+	}
+	return nil
+}
+
+// groupsOf returns the groups the user of the request, or its identity,
+// belongs to
+func groupsOf(req meeseeks.Request) []string {
+	names := make([]string, 0)
+	for group := range GetGroups() {
+		if requesterInAnyGroup(req, []string{group}) {
+			names = append(names, group)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
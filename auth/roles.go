@@ -0,0 +1,172 @@
+package auth
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+)
+
+// Permissions a role can grant on a command
+const (
+	PermissionRun      = "run"
+	PermissionViewLogs = "view-logs"
+	PermissionCancel   = "cancel"
+	PermissionApprove  = "approve"
+)
+
+// AnyCommand is used in the permissions of a role to grant them on every command
+const AnyCommand = "*"
+
+var validPermissions = map[string]bool{
+	PermissionRun:      true,
+	PermissionViewLogs: true,
+	PermissionCancel:   true,
+	PermissionApprove:  true,
+}
+
+// Role aggregates groups and grants their members permissions per command.
+//
+// A role also holds the permissions of the roles it inherits, so a wider role
+// can be built on top of a narrower one without repeating it
+type Role struct {
+	Groups      []string            `yaml:"groups"`
+	Inherits    []string            `yaml:"inherits"`
+	Permissions map[string][]string `yaml:"permissions"`
+}
+
+var roles = map[string]Role{}
+var rolesLock sync.RWMutex
+
+// ValidateRoles checks that the roles only grant known permissions and only
+// inherit roles that exist, without cycles
+func ValidateRoles(configuredRoles map[string]Role) error {
+	names := make([]string, 0, len(configuredRoles))
+	for name := range configuredRoles {
+		names = append(names, name)
+	}
+	sort.Strings(names) // Sort them to return stable errors
+
+	for _, name := range names {
+		role := configuredRoles[name]
+		for command, permissions := range role.Permissions {
+			for _, permission := range permissions {
+				if !validPermissions[permission] {
+					return fmt.Errorf("role %s grants invalid permission %s on %s, valid ones are %s, %s, %s and %s",
+						name, permission, command, PermissionRun, PermissionViewLogs, PermissionCancel, PermissionApprove)
+				}
+			}
+		}
+		for _, inherited := range role.Inherits {
+			if _, ok := configuredRoles[inherited]; !ok {
+				return fmt.Errorf("role %s inherits unknown role %s", name, inherited)
+			}
+		}
+		if err := checkInheritanceCycle(configuredRoles, name, []string{name}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkInheritanceCycle(configuredRoles map[string]Role, name string, path []string) error {
+	for _, inherited := range configuredRoles[name].Inherits {
+		for _, seen := range path {
+			if seen == inherited {
+				return fmt.Errorf("role %s inherits itself: %s", path[0],
+					strings.Join(append(path, inherited), " -> "))
+			}
+		}
+		if err := checkInheritanceCycle(configuredRoles, inherited, append(path, inherited)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ConfigureRoles loads the configured roles, replacing the previous ones
+func ConfigureRoles(configuredRoles map[string]Role) error {
+	if err := ValidateRoles(configuredRoles); err != nil {
+		return err
+	}
+
+	r := make(map[string]Role, len(configuredRoles))
+	for name, role := range configuredRoles {
+		r[name] = role
+	}
+
+	rolesLock.Lock()
+	defer rolesLock.Unlock()
+	roles = r
+	return nil
+}
+
+// HasPermission returns true if the user holds the permission on the command
+// through any of the roles of the groups it belongs to. Admins hold every
+// permission
+func HasPermission(username, command, permission string) bool {
+	if groups.CheckUserInGroup(username, AdminGroup) == nil {
+		return true
+	}
+
+	rolesLock.RLock()
+	defer rolesLock.RUnlock()
+
+	for name, role := range roles {
+		if !userInAnyGroup(username, role.Groups) {
+			continue
+		}
+		if roleGrants(name, command, permission, map[string]bool{}) {
+			log.Debugf("User %s has permission %s on %s through role %s", username, permission, command, name)
+			return true
+		}
+	}
+	return false
+}
+
+func userInAnyGroup(username string, roleGroups []string) bool {
+	for _, group := range roleGroups {
+		if groups.CheckUserInGroup(username, group) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// roleGrants walks the role and the ones it inherits looking for the
+// permission, must be called with the roles lock held
+func roleGrants(name, command, permission string, visited map[string]bool) bool {
+	if visited[name] {
+		return false
+	}
+	visited[name] = true
+
+	role := roles[name]
+	for _, target := range []string{command, AnyCommand} {
+		for _, p := range role.Permissions[target] {
+			if p == permission {
+				return true
+			}
+		}
+	}
+	for _, inherited := range role.Inherits {
+		if roleGrants(inherited, command, permission, visited) {
+			return true
+		}
+	}
+	return false
+}
+
+type userRoleAllowed struct {
+}
+
+// Check implements Authorizer.Check
+func (a userRoleAllowed) Check(req meeseeks.Request, _ CommandAuthorization) error {
+	if HasPermission(req.Username, req.Command, PermissionRun) {
+		return nil
+	}
+	return ErrUserNotAllowed
+}
@@ -0,0 +1,151 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+)
+
+// TimeRestricter is implemented by the commands that can only run in some
+// windows of time
+type TimeRestricter interface {
+	GetTimeWindows() meeseeks.TimeWindowOpts
+}
+
+// ErrOutsideTimeWindow is the error returned when the auth check fails because the command can't run at this time
+var ErrOutsideTimeWindow = errors.New("command not allowed at this time")
+
+const windowTimeLayout = "15:04"
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "sunday": time.Sunday,
+	"mon": time.Monday, "monday": time.Monday,
+	"tue": time.Tuesday, "tuesday": time.Tuesday,
+	"wed": time.Wednesday, "wednesday": time.Wednesday,
+	"thu": time.Thursday, "thursday": time.Thursday,
+	"fri": time.Friday, "friday": time.Friday,
+	"sat": time.Saturday, "saturday": time.Saturday,
+}
+
+// ValidateTimeWindows checks that the timezone, the days and the times of the
+// windows are valid
+func ValidateTimeWindows(opts meeseeks.TimeWindowOpts) error {
+	if _, err := location(opts.Timezone); err != nil {
+		return err
+	}
+	for _, w := range opts.Windows {
+		if _, _, err := parseWindow(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// InTimeWindow returns true if the time falls in any of the windows, in the
+// timezone of the windows
+func InTimeWindow(opts meeseeks.TimeWindowOpts, t time.Time) (bool, error) {
+	loc, err := location(opts.Timezone)
+	if err != nil {
+		return false, err
+	}
+	t = t.In(loc)
+	minute := t.Hour()*60 + t.Minute()
+
+	for _, w := range opts.Windows {
+		from, to, err := parseWindow(w)
+		if err != nil {
+			return false, err
+		}
+		if from < to {
+			if onDay(w, t.Weekday()) && minute >= from && minute < to {
+				return true, nil
+			}
+			continue
+		}
+		// The window goes past midnight, it belongs to the day it starts
+		if onDay(w, t.Weekday()) && minute >= from {
+			return true, nil
+		}
+		if onDay(w, (t.Weekday()+6)%7) && minute < to {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// location returns the timezone, the local one when there is none
+func location(timezone string) (*time.Location, error) {
+	if timezone == "" {
+		return time.Local, nil
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone %s: %s", timezone, err)
+	}
+	return loc, nil
+}
+
+// parseWindow returns the minutes of the day the window starts and ends
+func parseWindow(w meeseeks.TimeWindow) (int, int, error) {
+	for _, day := range w.Days {
+		if _, ok := weekdays[dayKey(day)]; !ok {
+			return 0, 0, fmt.Errorf("invalid day %s in time window, valid ones are mon, tue, wed, thu, fri, sat and sun", day)
+		}
+	}
+	from, err := parseMinute(w.From)
+	if err != nil {
+		return 0, 0, err
+	}
+	to, err := parseMinute(w.To)
+	if err != nil {
+		return 0, 0, err
+	}
+	if from == to {
+		return 0, 0, fmt.Errorf("time window from %s to %s is empty", w.From, w.To)
+	}
+	return from, to, nil
+}
+
+func parseMinute(value string) (int, error) {
+	if value == "24:00" {
+		return 24 * 60, nil
+	}
+	t, err := time.Parse(windowTimeLayout, value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %s in time window, it has to be like 09:00", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func onDay(w meeseeks.TimeWindow, day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, d := range w.Days {
+		if weekdays[dayKey(d)] == day {
+			return true
+		}
+	}
+	return false
+}
+
+// dayKey accepts the days both abbreviated and whole, in any case
+func dayKey(day string) string {
+	return strings.ToLower(day)
+}
+
+// checkTimeWindows returns ErrOutsideTimeWindow if the command can't run now
+// and the user is not in an override group
+func checkTimeWindows(req meeseeks.Request, opts meeseeks.TimeWindowOpts) error {
+	in, err := InTimeWindow(opts, time.Now())
+	if err != nil {
+		return fmt.Errorf("could not check time windows: %s", err)
+	}
+	if in || requesterInAnyGroup(req, opts.OverrideGroups) {
+		return nil
+	}
+	return ErrOutsideTimeWindow
+}
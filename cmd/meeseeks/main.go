@@ -0,0 +1,85 @@
+// Command meeseeks runs a command of a Meeseeks through its API with a token,
+// streams its output to the terminal and exits with the status of its job
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/api/client"
+	"gitlab.com/yakshaving.art/meeseeks-box/version"
+)
+
+func main() {
+	url := flag.String("url", envOr("MEESEEKS_URL", "http://localhost:9696/commands/run"), "url of the run path of the api, by default loaded from the MEESEEKS_URL environment variable")
+	token := flag.String("token", os.Getenv("MEESEEKS_TOKEN"), "api token to run the command with, by default loaded from the MEESEEKS_TOKEN environment variable")
+	channel := flag.String("channel", "", "channel of the token to run the command in, the one of the token by default")
+	timeout := flag.Duration("timeout", 0, "how long to wait for the job to finish, 10m by default")
+	detach := flag.Bool("detach", false, "don't wait for the job, print its ID and exit")
+	showVersion := flag.Bool("version", false, "print the version and exit")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] command [args...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf("Version: %s Commit: %s Date: %s\n", version.Version, version.Commit, version.Date)
+		os.Exit(0)
+	}
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(client.ExitRejected)
+	}
+	if *token == "" {
+		fmt.Fprintln(os.Stderr, "no token, set it with -token or MEESEEKS_TOKEN")
+		os.Exit(client.ExitRejected)
+	}
+
+	run := client.Run{
+		Command: flag.Arg(0),
+		Args:    flag.Args()[1:],
+		Channel: *channel,
+		Stream:  !*detach,
+	}
+	if *timeout > 0 {
+		run.Timeout = timeout.String()
+	}
+
+	result, err := client.New(*url, *token).Run(run, os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(client.ExitRejected)
+	}
+	os.Exit(exitWith(result, *detach))
+}
+
+// exitWith tells what happened to the call when there is no job status to
+// exit with, and returns the exit code
+func exitWith(result client.Result, detach bool) int {
+	switch {
+	case detach && result.JobID != 0:
+		fmt.Println(result.JobID)
+		return 0
+	case result.Status == "PendingApproval":
+		fmt.Fprintf(os.Stderr, "the command is waiting for an approval, call %s\n", result.CallID)
+	case result.Status == "Accepted":
+		fmt.Fprintf(os.Stderr, "the command was accepted but there is no job to follow, call %s\n", result.CallID)
+	case result.Status == "":
+		fmt.Fprintln(os.Stderr, "the output ended without the status of the job")
+	case client.ExitCode(result.Status) == client.ExitUnfinished:
+		fmt.Fprintf(os.Stderr, "the job didn't finish in time, it's %s\n", result.Status)
+	}
+	if result.Error != "" {
+		fmt.Fprintln(os.Stderr, result.Error)
+	}
+	return client.ExitCode(result.Status)
+}
+
+func envOr(name, value string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return value
+}
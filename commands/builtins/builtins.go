@@ -4,35 +4,48 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"gitlab.com/yakshaving.art/meeseeks-box/auth"
+	"gitlab.com/yakshaving.art/meeseeks-box/auth/approvals"
+	"gitlab.com/yakshaving.art/meeseeks-box/auth/breakglass"
+	"gitlab.com/yakshaving.art/meeseeks-box/auth/oidc"
 	"gitlab.com/yakshaving.art/meeseeks-box/commands"
 	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks/subscriptions"
 	"gitlab.com/yakshaving.art/meeseeks-box/persistence"
+	"gitlab.com/yakshaving.art/meeseeks-box/remote/agenttokens"
+	"gitlab.com/yakshaving.art/meeseeks-box/remote/registry"
+	"gitlab.com/yakshaving.art/meeseeks-box/text/formatter"
 	"gitlab.com/yakshaving.art/meeseeks-box/text/template"
 	"gitlab.com/yakshaving.art/meeseeks-box/version"
-	"github.com/renstrom/dedent"
 )
 
 // Builtin Commands Names
 const (
-	BuiltinVersionCommand   = "version"
-	BuiltinHelpCommand      = "help"
-	BuiltinGroupsCommand    = "groups"
-	BuiltinJobsCommand      = "jobs"
-	BuiltinFindJobCommand   = "job"
-	BuiltinAuditCommand     = "audit"
-	BuiltinAuditJobCommand  = "auditjob"
-	BuiltinAuditLogsCommand = "auditlogs"
-	BuiltinLastCommand      = "last"
-	BuiltinTailCommand      = "tail"
-	BuiltinHeadCommand      = "head"
-	BuiltinLogsCommand      = "logs"
-	BuiltinCancelJobCommand = "cancel"
-	BuiltinKillJobCommand   = "kill"
+	BuiltinVersionCommand     = "version"
+	BuiltinHelpCommand        = "help"
+	BuiltinGroupsCommand      = "groups"
+	BuiltinGroupAddCommand    = "group-add"
+	BuiltinGroupDelCommand    = "group-remove"
+	BuiltinJobsCommand        = "jobs"
+	BuiltinMyJobsCommand      = "my-jobs"
+	BuiltinChannelJobsCommand = "channel-jobs"
+	BuiltinFindJobCommand     = "job"
+	BuiltinAuditCommand       = "audit"
+	BuiltinAuditJobCommand    = "auditjob"
+	BuiltinAuditLogsCommand   = "auditlogs"
+	BuiltinLastCommand        = "last"
+	BuiltinTailCommand        = "tail"
+	BuiltinHeadCommand        = "head"
+	BuiltinLogsCommand        = "logs"
+	BuiltinCancelJobCommand   = "cancel"
+	BuiltinKillJobCommand     = "kill"
+	BuiltinRerunJobCommand    = "rerun"
+	BuiltinNotifyCommand      = "notify"
 
 	BuiltinNewAPITokenCommand    = "token-new"
 	BuiltinListAPITokenCommand   = "tokens"
@@ -41,6 +54,26 @@ const (
 	BuiltinNewAliasCommand    = "alias"
 	BuiltinDeleteAliasCommand = "unalias"
 	BuiltinGetAliasesCommand  = "aliases"
+
+	BuiltinLinkCommand   = "link"
+	BuiltinUnlinkCommand = "unlink"
+
+	BuiltinGrantCommand  = "grant"
+	BuiltinGrantsCommand = "grants"
+
+	BuiltinBreakGlassCommand    = "break-glass"
+	BuiltinBreakGlassEndCommand = "break-glass-end"
+
+	BuiltinApproveCommand          = "approve"
+	BuiltinPendingApprovalsCommand = "pending-approvals"
+
+	BuiltinNewAgentTokenCommand    = "agent-token-new"
+	BuiltinRotateAgentTokenCommand = "agent-token-rotate"
+	BuiltinRevokeAgentTokenCommand = "agent-token-revoke"
+	BuiltinListAgentTokensCommand  = "agent-tokens"
+	BuiltinAgentsCommand           = "agents"
+
+	BuiltinRenderTemplateCommand = "render-template"
 )
 
 // Commands is the basic set of builtin commands
@@ -60,18 +93,66 @@ var Commands = map[string]meeseeks.Command{
 		),
 		cmd: cmd{BuiltinGroupsCommand},
 	},
+	BuiltinGroupAddCommand: groupAddCommand{
+		help: newHelp(
+			"adds a user to a group, surviving restarts and reloads (admin only)",
+			"group to add the user to, mandatory",
+			"user to add, mandatory",
+		),
+		cmd: cmd{BuiltinGroupAddCommand},
+	},
+	BuiltinGroupDelCommand: groupRemoveCommand{
+		help: newHelp(
+			"removes a user from a group, surviving restarts and reloads (admin only)",
+			"group to remove the user from, mandatory",
+			"user to remove, mandatory",
+		),
+		cmd: cmd{BuiltinGroupDelCommand},
+	},
 	BuiltinJobsCommand: jobsCommand{
 		help: newHelp(
 			"shows the last executed jobs for the calling user",
 			"-limit: how many jobs to show, 5 by default",
+			"-status: only show jobs in this status (queued, running, succeeded, failed, killed or timedout)",
+			"-user: user to show the jobs of, the calling user by default",
+			"-channel: only show jobs that were called in this channel",
+			"-before: only show jobs older than this job ID, to get the next page",
+			"-label: only show jobs with this label, as name=value, can be repeated",
 		),
 		cmd: cmd{BuiltinJobsCommand},
 	},
+	BuiltinMyJobsCommand: myJobsCommand{
+		help: newHelp(
+			"shows the last jobs of the calling user",
+			"-limit: how many jobs to show, 5 by default",
+			"-status: only show jobs in this status (queued, running, succeeded, failed, killed or timedout)",
+			"-label: only show jobs with this label, as name=value, can be repeated",
+			"-before: only show jobs older than this job ID, to get the next page",
+		),
+		cmd: cmd{BuiltinMyJobsCommand},
+	},
+	BuiltinChannelJobsCommand: channelJobsCommand{
+		help: newHelp(
+			"shows the last jobs that were called in the current channel, by any user",
+			"-limit: how many jobs to show, 5 by default",
+			"-status: only show jobs in this status (queued, running, succeeded, failed, killed or timedout)",
+			"-label: only show jobs with this label, as name=value, can be repeated",
+			"-before: only show jobs older than this job ID, to get the next page",
+		),
+		cmd: cmd{BuiltinChannelJobsCommand},
+	},
 	BuiltinAuditCommand: auditCommand{
 		help: newHelp(
-			"lists jobs from all users or a specific one (admin only)",
+			"lists who ran what, where and with which args, and which requests were rejected (admin only)",
 			"-user: user to filter for",
-			"-limit: how many jobs to show, 5 by default",
+			"-command: command to filter for",
+			"-channel: channel to filter for",
+			"-since: only show entries after this time, as a duration ago (24h), a date (2006-01-02) or RFC3339",
+			"-until: only show entries before this time, same formats as -since",
+			"-status: only show entries whose job is in this status (queued, running, succeeded, failed, killed or timedout)",
+			"-decision: only show entries with this decision (accepted, unauthorized, unknown, pending-approval or dispatched)",
+			"-incident: only show entries taken while break glass was on for this incident",
+			"-limit: how many entries to show, 5 by default",
 		),
 		cmd: cmd{BuiltinAuditCommand},
 	},
@@ -92,7 +173,10 @@ var Commands = map[string]meeseeks.Command{
 	},
 	BuiltinLastCommand: lastCommand{
 		help: newHelp(
-			"shows the last job metadata executed by the current user",
+			"shows the last job executed by the current user, with its status, duration and output tail",
+			"-all: look for the last job across all users",
+			"-lines: how many lines of output to show, 5 by default",
+			"command to look the last job up for, optional",
 		),
 		cmd: cmd{BuiltinLastCommand},
 	},
@@ -103,18 +187,11 @@ var Commands = map[string]meeseeks.Command{
 		),
 		cmd: cmd{BuiltinFindJobCommand},
 	},
-	BuiltinTailCommand: tailCommand{
-		help: newHelp(
-			"returns the last lines of the last executed job, or one selected by job ID",
-			"-limit: how many lines to show",
-			"job ID to look for, optional, if not provided the last executed one will be looked up",
-		),
-		cmd: cmd{BuiltinTailCommand},
-	},
 	BuiltinHeadCommand: headCommand{
 		help: newHelp(
 			"returns the top N log lines of a command output or error",
 			"-limit: how many lines to show",
+			"-timestamps: shows when each line was written since the job started, and the stderr lines",
 			"job ID to look for, optional, if not provided the last executed one will be looked up",
 		),
 		cmd: cmd{BuiltinHeadCommand},
@@ -122,6 +199,7 @@ var Commands = map[string]meeseeks.Command{
 	BuiltinLogsCommand: logsCommand{
 		help: newHelp(
 			"returns the full output of the job passed as argument",
+			"-timestamps: shows when each line was written since the job started, and the stderr lines",
 			"job ID to look for, mandatory",
 		),
 		cmd: cmd{BuiltinLogsCommand},
@@ -129,6 +207,9 @@ var Commands = map[string]meeseeks.Command{
 	BuiltinNewAPITokenCommand: newAPITokenCommand{
 		help: newHelp(
 			"creates a new API token",
+			"-commands: comma separated commands the token can call, the caller sends the command when the token has none",
+			"-channels: comma separated channels the caller can pick besides the one of the token",
+			"-expires: how long the token works, like 720h, forever by default",
 			"user that will be impersonated by the api, mandatory",
 			"channel that will be used as the one in which the job was called",
 			"command the token will be calling",
@@ -171,6 +252,103 @@ var Commands = map[string]meeseeks.Command{
 		),
 		cmd: cmd{BuiltinGetAliasesCommand},
 	},
+	BuiltinLinkCommand: linkCommand{
+		help: newHelp(
+			"sends a link to log in with the identity provider and link it to the current user",
+		),
+		cmd: cmd{BuiltinLinkCommand},
+	},
+	BuiltinUnlinkCommand: unlinkCommand{
+		help: newHelp(
+			"removes the identity linked to the current user",
+		),
+		cmd: cmd{BuiltinUnlinkCommand},
+	},
+	BuiltinGrantCommand: grantCommand{
+		help: newHelp(
+			"temporarily allows a user to run a command, or adds it to a group, until the grant expires (admin only)",
+			"-for: how long the grant lasts, like 2h, mandatory",
+			"user to grant, mandatory",
+			"command or group to grant, mandatory",
+		),
+		cmd: cmd{BuiltinGrantCommand},
+	},
+	BuiltinGrantsCommand: grantsCommand{
+		help: newHelp(
+			"lists the temporary grants that have not expired (admin only)",
+		),
+		cmd: cmd{BuiltinGrantsCommand},
+	},
+	BuiltinBreakGlassCommand: breakGlassCommand{
+		help: newHelp(
+			"lets the break glass groups run any command for a while, for an incident (admin only)",
+			"-for: how long break glass lasts, like 1h, mandatory",
+			"name of the incident, mandatory",
+		),
+		cmd: cmd{BuiltinBreakGlassCommand},
+	},
+	BuiltinBreakGlassEndCommand: breakGlassEndCommand{
+		help: newHelp(
+			"ends break glass before it expires (admin only)",
+		),
+		cmd: cmd{BuiltinBreakGlassEndCommand},
+	},
+	BuiltinNotifyCommand: notifyCommand{
+		help: newHelp(
+			"sends you a direct message when a job finishes, like: notify me when 42 finishes",
+			"-off: stops notifying you about the job",
+			"job ID to notify about, mandatory",
+		),
+		cmd: cmd{BuiltinNotifyCommand},
+	},
+	BuiltinPendingApprovalsCommand: pendingApprovalsCommand{
+		help: newHelp(
+			"lists the requests that wait for approvals, with how many they got",
+		),
+		cmd: cmd{BuiltinPendingApprovalsCommand},
+	},
+	BuiltinNewAgentTokenCommand: newAgentTokenCommand{
+		help: newHelp(
+			"issues the token a remote agent registers with (admin only)",
+			"name of the agent, mandatory",
+		),
+		cmd: cmd{BuiltinNewAgentTokenCommand},
+	},
+	BuiltinRotateAgentTokenCommand: rotateAgentTokenCommand{
+		help: newHelp(
+			"replaces the token of a remote agent, disconnecting the agents that use the previous one (admin only)",
+			"name of the agent, mandatory",
+		),
+		cmd: cmd{BuiltinRotateAgentTokenCommand},
+	},
+	BuiltinRevokeAgentTokenCommand: revokeAgentTokenCommand{
+		help: newHelp(
+			"revokes the token of a remote agent, disconnecting the agents that use it (admin only)",
+			"name of the agent, mandatory",
+		),
+		cmd: cmd{BuiltinRevokeAgentTokenCommand},
+	},
+	BuiltinListAgentTokensCommand: listAgentTokensCommand{
+		help: newHelp(
+			"lists the agents that have a token (admin only)",
+		),
+		cmd: cmd{BuiltinListAgentTokensCommand},
+	},
+	BuiltinAgentsCommand: agentsCommand{
+		help: newHelp(
+			"lists the remote agents that are registered, where they run and their commands",
+		),
+		cmd: cmd{BuiltinAgentsCommand},
+	},
+	BuiltinRenderTemplateCommand: renderTemplateCommand{
+		help: newHelp(
+			"renders the success or failure template of a command with a sample output, as it would reply in this channel (admin only)",
+			"command whose template to render, mandatory",
+			"success or failure, mandatory",
+			"sample output, optional",
+		),
+		cmd: cmd{BuiltinRenderTemplateCommand},
+	},
 	BuiltinHelpCommand: helpCommand{
 		help: newHelp(
 			"shows the help for all the commands, or a single one",
@@ -183,14 +361,19 @@ var Commands = map[string]meeseeks.Command{
 	// Added as a placeholder so they are recognized as a builtin command
 	BuiltinCancelJobCommand: nil,
 	BuiltinKillJobCommand:   nil,
+	BuiltinTailCommand:      nil,
+	BuiltinRerunJobCommand:  nil,
 }
 
 var errNoJobIDAsArgument = fmt.Errorf("no job id passed")
 
 // LoadBuiltins loads the builtin commands
-func LoadBuiltins(cancelCommand, killCommand meeseeks.Command) error {
+func LoadBuiltins(cancelCommand, killCommand, tailCommand, rerunCommand, approveCommand meeseeks.Command) error {
 	Commands[BuiltinCancelJobCommand] = cancelCommand
 	Commands[BuiltinKillJobCommand] = killCommand
+	Commands[BuiltinTailCommand] = tailCommand
+	Commands[BuiltinRerunJobCommand] = rerunCommand
+	Commands[BuiltinApproveCommand] = approveCommand
 
 	reg := make([]commands.CommandRegistration, 0)
 
@@ -267,6 +450,15 @@ func (a allowAdmins) GetAllowedGroups() []string {
 	return []string{auth.AdminGroup}
 }
 
+func (a allowAdmins) adminOnly() {}
+
+// IsAdminOnly returns true if the command is a builtin only admins can run,
+// these are never relaxed, not even by break glass
+func IsAdminOnly(cmd meeseeks.Command) bool {
+	_, ok := cmd.(interface{ adminOnly() })
+	return ok
+}
+
 type noHandshake struct {
 }
 
@@ -330,6 +522,10 @@ var helpCommandTemplate = `*{{ .name }}* - {{ .help.GetSummary }}
 {{ if gt ( len .help.GetArgs ) 0 }}
 *Arguments*{{ range $a := .help.GetArgs }}
 - {{ $a }}{{ end }}{{ end }}
+{{- if or .owner .source }}
+{{ with .owner }}
+Owned by *{{ . }}*{{ end }}{{ with .source }}
+Defined in _{{ . }}_{{ end }}{{ end }}
 `
 
 func (h helpCommand) Execute(_ context.Context, job meeseeks.Job) (string, error) {
@@ -363,9 +559,15 @@ func (h helpCommand) Execute(_ context.Context, job meeseeks.Job) (string, error
 			if err != nil {
 				return "", err
 			}
+			var owner, source string
+			if owned, ok := cmd.(meeseeks.Owned); ok {
+				owner, source = owned.GetOwner(), owned.GetSource()
+			}
 			return tmpl.Render(map[string]interface{}{
-				"name": flags.Arg(0),
-				"help": cmd.GetHelp(),
+				"name":   flags.Arg(0),
+				"help":   cmd.GetHelp(),
+				"owner":  owner,
+				"source": source,
 			})
 		}
 		return "", fmt.Errorf("could not find command %s", flags.Arg(0))
@@ -391,7 +593,7 @@ type cancelJobCommand struct {
 func NewCancelJobCommand(f func(jobID uint64)) meeseeks.Command {
 	return cancelJobCommand{
 		help: newHelp(
-			"sends a cancellation signal to a job owned by the current user",
+			"sends a cancellation signal to a job owned by the current user, or one its roles can cancel",
 			"job ID to send the signal to",
 		),
 		cancelFunc: f,
@@ -407,7 +609,8 @@ func (c cancelJobCommand) Execute(_ context.Context, job meeseeks.Job) (string,
 	if err != nil {
 		return "", err
 	}
-	if job.Request.Username != j.Request.Username {
+	if job.Request.Username != j.Request.Username &&
+		!auth.HasPermission(job.Request.Username, j.Request.Command, auth.PermissionCancel) {
 		return "", meeseeks.ErrNoJobWithID
 	}
 	c.cancelFunc(jobID)
@@ -450,231 +653,235 @@ func (k killJobCommand) Execute(_ context.Context, job meeseeks.Job) (string, er
 	return fmt.Sprintf("Issued command cancellation to job %d", jobID), nil
 }
 
-type groupsCommand struct {
+type rerunJobCommand struct {
 	cmd
 	help
 	noHandshake
 	noRecord
 	emptyArgs
-	allowAdmins
+	allowAll
 	anyChannel
 	defaultTimeout
+	submitFunc func(meeseeks.Request)
 }
 
-var groupsTemplate = dedent.Dedent(`
-	{{- range $group, $users := .groups }}
-	- {{ $group }}:
-		{{- range $index, $user := $users }}{{ if ne $index 0 }},{{ end }} {{ $user }}{{ end }}
-	{{- end }}
-	`)
+// NewRerunJobCommand creates a command that will invoke the passed submit
+// function with a new request for the command of a past job
+func NewRerunJobCommand(f func(meeseeks.Request)) meeseeks.Command {
+	return rerunJobCommand{
+		help: newHelp(
+			"runs the command of a past job again, with the same args and in the same channel",
+			"job ID to run again",
+		),
+		cmd:        cmd{BuiltinRerunJobCommand},
+		submitFunc: f,
+	}
+}
 
-func (g groupsCommand) Execute(_ context.Context, job meeseeks.Job) (string, error) {
-	tmpl, err := template.New("version", groupsTemplate)
+func (r rerunJobCommand) Execute(_ context.Context, job meeseeks.Job) (string, error) {
+	jobID, err := parseJobID(job.Request.Args)
 	if err != nil {
 		return "", err
 	}
-	return tmpl.Render(map[string]interface{}{
-		"groups": auth.GetGroups(),
+	original, err := persistence.Jobs().Get(jobID)
+	if err != nil {
+		return "", err
+	}
+	if original.Request.IsIM && original.Request.Username != job.Request.Username {
+		return "", meeseeks.ErrNoJobWithID // Don't talk in other users DMs
+	}
+
+	// The new request is made by the calling user, so it goes through the
+	// authorization of the command as it is configured now
+	r.submitFunc(meeseeks.Request{
+		Command:     original.Request.Command,
+		Args:        original.Request.Args,
+		Username:    job.Request.Username,
+		UserID:      job.Request.UserID,
+		UserLink:    job.Request.UserLink,
+		Channel:     original.Request.Channel,
+		ChannelID:   original.Request.ChannelID,
+		ChannelLink: original.Request.ChannelLink,
+		IsIM:        original.Request.IsIM,
+		RerunOf:     jobID,
 	})
+	return fmt.Sprintf("Running job %d again", jobID), nil
 }
 
-type jobsCommand struct {
+type notifyCommand struct {
 	cmd
 	help
 	noHandshake
 	noRecord
+	emptyArgs
 	allowAll
 	anyChannel
-	emptyArgs
 	defaultTimeout
 }
 
-var jobsTemplate = strings.Join([]string{
-	"{{- $length := len .jobs }}{{- if eq $length 0 }}",
-	"No jobs found\n",
-	"{{ else }}",
-	"{{- range $job := .jobs }}",
-	"*{{ $job.ID }}* - {{ HumanizeTime $job.StartTime }}",
-	" - *{{ $job.Request.Command }}*",
-	" by *{{ $job.Request.Username }}*",
-	" in *{{ if $job.Request.IsIM }}DM{{ else }}{{ $job.Request.ChannelLink }}{{ end }}*",
-	" - *{{ $job.Status }}*\n",
-	"{{ end }}",
-	"{{ end }}",
-}, "")
-
-// jobMultiMatch builds a Match function from a list of Match functions
-func jobsMultiMatch(matchers ...func(meeseeks.Job) bool) func(meeseeks.Job) bool {
-	return func(job meeseeks.Job) bool {
-		for _, matcher := range matchers {
-			if !matcher(job) {
-				return false
-			}
-		}
-		return true
-	}
-}
+// notifyFillers are the words that make the command read like a sentence
+var notifyFillers = map[string]bool{"me": true, "when": true, "finishes": true}
 
-func (j jobsCommand) Execute(_ context.Context, job meeseeks.Job) (string, error) {
-	flags := flag.NewFlagSet("jobs", flag.ContinueOnError)
-	limit := flags.Int("limit", 5, "how many jobs to return")
-	status := flags.String("status", "", "filter jobs per status (running, failed or successful)")
-	if err := flags.Parse(job.Request.Args); err != nil {
+func (n notifyCommand) Execute(_ context.Context, job meeseeks.Job) (string, error) {
+	flags := flag.NewFlagSet("notify", flag.ContinueOnError)
+	off := flags.Bool("off", false, "stop notifying about the job")
+	args, err := parseInterspersedFlags(flags, job.Request.Args)
+	if err != nil {
 		return "", err
 	}
+	words := make([]string, 0)
+	for _, arg := range args {
+		if !notifyFillers[arg] {
+			words = append(words, arg)
+		}
+	}
 
-	callingUser := job.Request.Username
-	requestedStatus := strings.Title(*status)
-	jobs, err := persistence.Jobs().Find(meeseeks.JobFilter{
-		Limit: *limit,
-		Match: jobsMultiMatch(
-			isUser(callingUser),
-			isStatusOrEmpty(requestedStatus),
-		),
-	})
-
+	jobID, err := parseJobID(words)
 	if err != nil {
 		return "", err
 	}
-	tmpl, err := template.New("jobs", jobsTemplate)
+	j, err := persistence.Jobs().Get(jobID)
 	if err != nil {
 		return "", err
 	}
-	return tmpl.Render(map[string]interface{}{
-		"jobs": jobs,
-	})
+	if j.Request.IsIM && j.Request.Username != job.Request.Username {
+		return "", meeseeks.ErrNoJobWithID // Don't talk about other users DMs
+	}
+
+	if *off {
+		if !subscriptions.Unsubscribe(jobID, job.Request.UserID) {
+			return "", fmt.Errorf("you were not going to be notified about job %d", jobID)
+		}
+		return fmt.Sprintf("You won't be notified when job %d finishes", jobID), nil
+	}
+	if j.Status.IsFinished() {
+		return "", fmt.Errorf("job %d already finished, it's %s", jobID, j.Status)
+	}
+	if !subscriptions.Subscribe(jobID, job.Request.UserID) {
+		return fmt.Sprintf("You will already be notified when job %d finishes", jobID), nil
+	}
+
+	// The job could have finished while subscribing, after the executor took
+	// the ones that were already subscribed
+	if j, err = persistence.Jobs().Get(jobID); err == nil && j.Status.IsFinished() {
+		subscriptions.Unsubscribe(jobID, job.Request.UserID)
+		return "", fmt.Errorf("job %d already finished, it's %s", jobID, j.Status)
+	}
+	return fmt.Sprintf("I'll send you a message when job %d finishes", jobID), nil
 }
 
-type auditCommand struct {
+type approveCommand struct {
 	cmd
 	help
 	noHandshake
 	noRecord
-	allowAdmins
-	anyChannel
 	emptyArgs
+	allowAll
+	anyChannel
 	defaultTimeout
+	submitFunc func(meeseeks.Request)
 }
 
-func (j auditCommand) Execute(_ context.Context, job meeseeks.Job) (string, error) {
-	flags := flag.NewFlagSet("audit", flag.ContinueOnError)
-	limit := flags.Int("limit", 5, "how many jobs to return")
-	user := flags.String("user", "", "the user to audit")
-	status := flags.String("status", "", "filter jobs per status (running, failed or successful)")
-	if err := flags.Parse(job.Request.Args); err != nil {
-		return "", err
-	}
-
-	requestedStatus := strings.Title(*status)
-
-	jobs, err := persistence.Jobs().Find(meeseeks.JobFilter{
-		Limit: *limit,
-		Match: jobsMultiMatch(
-			isStatusOrEmpty(requestedStatus),
-			func(j meeseeks.Job) bool {
-				if *user == "" {
-					return true
-				}
-				return *user == j.Request.Username
-			},
+// NewApproveCommand creates a command that approves a pending request, and
+// invokes the passed submit function with it once it got all its approvals
+func NewApproveCommand(f func(meeseeks.Request)) meeseeks.Command {
+	return approveCommand{
+		help: newHelp(
+			"approves a request that waits for approvals, it runs once it gets all of them",
+			"ID of the request to approve",
 		),
-	})
+		cmd:        cmd{BuiltinApproveCommand},
+		submitFunc: f,
+	}
+}
 
+func (a approveCommand) Execute(_ context.Context, job meeseeks.Job) (string, error) {
+	if len(job.Request.Args) != 1 {
+		return "", fmt.Errorf("only the ID of the request should be passed as an argument")
+	}
+	id, err := strconv.ParseUint(job.Request.Args[0], 10, 64)
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("invalid request ID %s: %s", job.Request.Args[0], err)
 	}
-	tmpl, err := template.New("jobs", jobsTemplate)
+
+	p, err := approvals.Approve(id, job.Request, time.Now())
 	if err != nil {
 		return "", err
 	}
-	return tmpl.Render(map[string]interface{}{
-		"jobs": jobs,
-	})
+	if !p.Approved() {
+		return fmt.Sprintf("Approved request %d, it has %s approvals", p.ID, p.Progress()), nil
+	}
+
+	req := p.Request
+	req.ApprovalID = p.ID
+	a.submitFunc(req)
+	return fmt.Sprintf("Request %d got all its approvals, running %s", p.ID, req.Command), nil
 }
 
-type lastCommand struct {
+type pendingApprovalsCommand struct {
 	cmd
 	help
 	noHandshake
 	noRecord
+	emptyArgs
 	allowAll
 	anyChannel
-	emptyArgs
 	defaultTimeout
 }
 
-var jobTemplate = `
-{{- with $job := .job }}{{ with $r := $job.Request }}* *ID* {{ $job.ID }}
-* *Status* {{ $job.Status}}
-* *Command* {{ $r.Command }}{{ with $args := $r.Args }}
-* *Args* "{{ Join $args "\" \"" }}" {{ end }}
-* *Where* {{ if $r.IsIM }}IM{{ else }}{{ $r.ChannelLink }}{{ end }}
-* *When* {{ HumanizeTime $job.StartTime }}
-{{- end }}{{- end }}
-`
+var pendingApprovalsTemplate = `{{ if eq (len .pending) 0 }}No requests wait for approvals{{ else }}{{ range $p := .pending }}- *{{ $p.ID }}* {{ $p.Request.Command }}{{ if $p.Request.Args }} {{ Join $p.Request.Args " " }}{{ end }} by {{ $p.Request.Username }}, {{ $p.Progress }} approvals{{ if $p.Opts.Group }} from {{ $p.Opts.Group }}{{ end }}{{ if $p.Approvers }} ({{ Join $p.Approvers ", " }}){{ end }}, expires {{ HumanizeTime $p.ExpiresAt }}
+{{ end }}{{ end }}`
 
-func (l lastCommand) Execute(_ context.Context, job meeseeks.Job) (string, error) {
-	callingUser := job.Request.Username
-	jobs, err := persistence.Jobs().Find(meeseeks.JobFilter{
-		Limit: 1,
-		Match: isUser(callingUser),
-	})
+func (p pendingApprovalsCommand) Execute(_ context.Context, _ meeseeks.Job) (string, error) {
+	tmpl, err := template.New("pending-approvals", pendingApprovalsTemplate)
 	if err != nil {
-		return "", fmt.Errorf("failed to get the last job: %s", err)
-	}
-	if len(jobs) == 0 {
-		return "", fmt.Errorf("no last command for current user")
+		return "", err
 	}
-	tmpl, err := template.New("job", jobTemplate)
+	pending, err := approvals.List(time.Now())
 	if err != nil {
 		return "", err
 	}
 	return tmpl.Render(map[string]interface{}{
-		"job": jobs[0],
+		"pending": pending,
 	})
 }
 
-type findJobCommand struct {
+type groupsCommand struct {
 	cmd
 	help
 	noHandshake
 	noRecord
-	allowAll
-	anyChannel
 	emptyArgs
+	allowAdmins
+	anyChannel
 	defaultTimeout
 }
 
-func (l findJobCommand) Execute(_ context.Context, job meeseeks.Job) (string, error) {
-	id, err := parseJobID(job.Request.Args)
+var groupsTemplate = `{{ Table (Row "Group" "Members") .groups }}`
+
+func (g groupsCommand) Execute(_ context.Context, job meeseeks.Job) (string, error) {
+	tmpl, err := template.New("groups", groupsTemplate)
 	if err != nil {
 		return "", err
 	}
 
-	callingUser := job.Request.Username
-	jobs, err := persistence.Jobs().Find(meeseeks.JobFilter{
-		Limit: 1,
-		Match: jobsMultiMatch(
-			isUser(callingUser),
-			isJobID(id)),
-	})
-	if err != nil {
-		return "", fmt.Errorf("failed to get the last job: %s", err)
-	}
-	if len(jobs) == 0 {
-		return "", fmt.Errorf("no last command for current user")
+	groups := auth.GetGroups()
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
 	}
+	sort.Strings(names)
 
-	tmpl, err := template.New("job", jobTemplate)
-	if err != nil {
-		return "", err
+	rows := make([][]string, 0, len(groups))
+	for _, name := range names {
+		rows = append(rows, []string{name, strings.Join(groups[name], ", ")})
 	}
 	return tmpl.Render(map[string]interface{}{
-		"job": jobs[0],
+		"groups": rows,
 	})
 }
 
-type auditJobCommand struct {
+type groupAddCommand struct {
 	cmd
 	help
 	noHandshake
@@ -685,50 +892,579 @@ type auditJobCommand struct {
 	defaultTimeout
 }
 
-func (l auditJobCommand) Execute(_ context.Context, job meeseeks.Job) (string, error) {
-	id, err := parseJobID(job.Request.Args)
-	if err != nil {
-		return "", err
-	}
-
-	jobs, err := persistence.Jobs().Find(meeseeks.JobFilter{
-		Limit: 1,
-		Match: isJobID(id),
-	})
-	if err != nil {
-		return "", fmt.Errorf("failed to get job %d: %s", job.ID, err)
-	}
-	if len(jobs) == 0 {
-		return "", fmt.Errorf("job not found")
+func (g groupAddCommand) Execute(_ context.Context, job meeseeks.Job) (string, error) {
+	if len(job.Request.Args) != 2 {
+		return "", fmt.Errorf("a group and a user should be passed as arguments")
 	}
+	group, user := job.Request.Args[0], job.Request.Args[1]
 
-	tmpl, err := template.New("job", jobTemplate)
-	if err != nil {
-		return "", err
+	if err := persistence.Groups().Add(group, user); err != nil {
+		return "", fmt.Errorf("could not persist group membership: %s", err)
 	}
-	return tmpl.Render(map[string]interface{}{
-		"job": jobs[0],
-	})
+	auth.AddUserToGroup(group, user)
+	return fmt.Sprintf("User *%s* has been added to group *%s*", user, group), nil
 }
 
-type auditLogsCommand struct {
+type groupRemoveCommand struct {
 	cmd
 	help
 	noHandshake
 	noRecord
-	allowAll
+	allowAdmins
 	anyChannel
 	emptyArgs
 	defaultTimeout
 }
 
-func (t auditLogsCommand) Execute(_ context.Context, job meeseeks.Job) (string, error) {
-	id, err := parseJobID(job.Request.Args)
-	if err != nil {
-		return "", err
+func (g groupRemoveCommand) Execute(_ context.Context, job meeseeks.Job) (string, error) {
+	if len(job.Request.Args) != 2 {
+		return "", fmt.Errorf("a group and a user should be passed as arguments")
 	}
+	group, user := job.Request.Args[0], job.Request.Args[1]
 
-	jobs, err := persistence.Jobs().Find(meeseeks.JobFilter{
+	if err := auth.RemoveUserFromGroup(group, user); err != nil {
+		return "", fmt.Errorf("could not remove user %s from group %s: %s", user, group, err)
+	}
+	if err := persistence.Groups().Remove(group, user); err != nil {
+		auth.AddUserToGroup(group, user)
+		return "", fmt.Errorf("could not persist group membership: %s", err)
+	}
+	return fmt.Sprintf("User *%s* has been removed from group *%s*", user, group), nil
+}
+
+type jobsCommand struct {
+	cmd
+	help
+	noHandshake
+	noRecord
+	allowAll
+	anyChannel
+	emptyArgs
+	defaultTimeout
+}
+
+var jobsTemplate = strings.Join([]string{
+	"{{- $length := len .jobs }}{{- if eq $length 0 }}",
+	"No jobs found\n",
+	"{{ else }}",
+	"{{- range $job := .jobs }}",
+	"*{{ $job.ID }}* - {{ HumanizeTime $job.StartTime }}",
+	" - *{{ $job.Request.Command }}*",
+	" by *{{ $job.Request.Username }}*",
+	" in *{{ if $job.Request.IsIM }}DM{{ else }}{{ $job.Request.ChannelLink }}{{ end }}*",
+	" - *{{ $job.Status }}*",
+	"{{ range $name, $value := $job.Labels }} `{{ $name }}={{ $value }}`{{ end }}\n",
+	"{{ end }}",
+	"{{- if .next }}_more jobs with_ `-before {{ .next }}`\n{{ end }}",
+	"{{ end }}",
+}, "")
+
+// labelsFlag is a repeatable flag that parses name=value labels
+type labelsFlag map[string]string
+
+func (l labelsFlag) String() string {
+	labels := make([]string, 0, len(l))
+	for name, value := range l {
+		labels = append(labels, fmt.Sprintf("%s=%s", name, value))
+	}
+	sort.Strings(labels)
+	return strings.Join(labels, ",")
+}
+
+func (l labelsFlag) Set(label string) error {
+	parts := strings.SplitN(label, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("invalid label %s, labels are name=value", label)
+	}
+	l[parts[0]] = parts[1]
+	return nil
+}
+
+// jobMultiMatch builds a Match function from a list of Match functions
+func jobsMultiMatch(matchers ...func(meeseeks.Job) bool) func(meeseeks.Job) bool {
+	return func(job meeseeks.Job) bool {
+		for _, matcher := range matchers {
+			if !matcher(job) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func (j jobsCommand) Execute(_ context.Context, job meeseeks.Job) (string, error) {
+	f := newJobsFlags("jobs")
+	user := f.flags.String("user", job.Request.Username, "filter jobs per user")
+	channel := f.flags.String("channel", "", "filter jobs per channel")
+	if err := f.flags.Parse(job.Request.Args); err != nil {
+		return "", err
+	}
+	return f.render(meeseeks.JobFilter{Username: *user}, isChannelOrEmpty(*channel))
+}
+
+type myJobsCommand struct {
+	cmd
+	help
+	noHandshake
+	noRecord
+	allowAll
+	anyChannel
+	emptyArgs
+	defaultTimeout
+}
+
+func (m myJobsCommand) Execute(_ context.Context, job meeseeks.Job) (string, error) {
+	f := newJobsFlags("my-jobs")
+	if err := f.flags.Parse(job.Request.Args); err != nil {
+		return "", err
+	}
+	return f.render(meeseeks.JobFilter{Username: job.Request.Username})
+}
+
+type channelJobsCommand struct {
+	cmd
+	help
+	noHandshake
+	noRecord
+	allowAll
+	anyChannel
+	emptyArgs
+	defaultTimeout
+}
+
+func (c channelJobsCommand) Execute(_ context.Context, job meeseeks.Job) (string, error) {
+	f := newJobsFlags("channel-jobs")
+	if err := f.flags.Parse(job.Request.Args); err != nil {
+		return "", err
+	}
+	return f.render(meeseeks.JobFilter{ChannelID: job.Request.ChannelID})
+}
+
+// jobsFlags holds the flags shared by the commands that list jobs
+type jobsFlags struct {
+	flags  *flag.FlagSet
+	limit  *int
+	status *string
+	before *uint64
+	labels labelsFlag
+}
+
+func newJobsFlags(name string) jobsFlags {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	f := jobsFlags{
+		flags:  flags,
+		limit:  flags.Int("limit", 5, "how many jobs to return"),
+		status: flags.String("status", "", "filter jobs per status (queued, running, succeeded, failed, killed or timedout)"),
+		before: flags.Uint64("before", 0, "only jobs older than this job ID"),
+		labels: labelsFlag{},
+	}
+	flags.Var(f.labels, "label", "filter jobs per label, as name=value")
+	return f
+}
+
+// render finds a page of the jobs that match the filter and the parsed flags
+// and renders them with a hint to get the next page if there is one
+func (f jobsFlags) render(filter meeseeks.JobFilter, matchers ...func(meeseeks.Job) bool) (string, error) {
+	limit := *f.limit
+	if limit <= 0 {
+		return "", fmt.Errorf("invalid limit %d, it has to be greater than 0", limit)
+	}
+
+	filter.Limit = limit + 1 // One more to know if there is a next page
+	filter.Before = *f.before
+	filter.Labels = f.labels
+	status, err := parseStatusFlag(*f.status)
+	if err != nil {
+		return "", err
+	}
+	filter.Match = jobsMultiMatch(append(matchers, isStatusOrEmpty(status))...)
+
+	jobs, err := persistence.Jobs().Find(filter)
+	if err != nil {
+		return "", err
+	}
+
+	var next uint64
+	if len(jobs) > limit {
+		jobs = jobs[:limit]
+		next = jobs[limit-1].ID
+	}
+
+	tmpl, err := template.New("jobs", jobsTemplate)
+	if err != nil {
+		return "", err
+	}
+	return tmpl.Render(map[string]interface{}{
+		"jobs": jobs,
+		"next": next,
+	})
+}
+
+type auditCommand struct {
+	cmd
+	help
+	noHandshake
+	noRecord
+	allowAdmins
+	anyChannel
+	emptyArgs
+	defaultTimeout
+}
+
+var auditTemplate = strings.Join([]string{
+	"{{- $length := len .entries }}{{- if eq $length 0 }}",
+	"No audit entries found\n",
+	"{{ else }}",
+	"{{- range $e := .entries }}{{ with $r := $e.Request }}",
+	"{{ HumanizeTime $e.Time }}",
+	" - *{{ $r.Command }}*{{ with $args := $r.Args }} `{{ Join $args \" \" }}`{{ end }}",
+	" by *{{ $r.Username }}*{{ with $r.Identity }} ({{ . }}){{ end }}",
+	" in *{{ if $r.IsIM }}DM{{ else }}{{ $r.ChannelLink }}{{ end }}*",
+	"{{ if $e.JobID }} - job *{{ $e.JobID }}*{{ end }}",
+	"{{ if ne $e.Decision \"accepted\" }} - _{{ $e.Decision }}_{{ end }}",
+	"{{ with $e.Agent }} to agent *{{ .ID }}*{{ with .Identity }} ({{ . }}){{ end }}{{ end }}",
+	"{{ with $e.Incident }} - break glass *{{ . }}*{{ end }}",
+	"{{ with $e.Owner }} - owned by {{ . }}{{ end }}\n",
+	"{{ end }}{{ end }}",
+	"{{ end }}",
+}, "")
+
+// auditMultiMatch builds a Match function from a list of Match functions
+func auditMultiMatch(matchers ...func(meeseeks.AuditEntry) bool) func(meeseeks.AuditEntry) bool {
+	return func(e meeseeks.AuditEntry) bool {
+		for _, matcher := range matchers {
+			if !matcher(e) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func (j auditCommand) Execute(_ context.Context, job meeseeks.Job) (string, error) {
+	flags := flag.NewFlagSet("audit", flag.ContinueOnError)
+	limit := flags.Int("limit", 5, "how many entries to return")
+	user := flags.String("user", "", "the user to audit")
+	command := flags.String("command", "", "the command to audit")
+	channel := flags.String("channel", "", "the channel to audit")
+	since := flags.String("since", "", "only show entries after this time")
+	until := flags.String("until", "", "only show entries before this time")
+	status := flags.String("status", "", "filter entries per job status (queued, running, succeeded, failed, killed or timedout)")
+	decision := flags.String("decision", "", "filter entries per decision (accepted, unauthorized, unknown, pending-approval or dispatched)")
+	agent := flags.String("agent", "", "filter entries per remote agent, by ID, cert identity, token or a name=value label")
+	incident := flags.String("incident", "", "filter entries per break glass incident")
+	if err := flags.Parse(job.Request.Args); err != nil {
+		return "", err
+	}
+
+	jobStatus, err := parseStatusFlag(*status)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now().UTC()
+	sinceTime, err := parseTimeFlag(*since, now)
+	if err != nil {
+		return "", fmt.Errorf("invalid since value: %s", err)
+	}
+	untilTime, err := parseTimeFlag(*until, now)
+	if err != nil {
+		return "", fmt.Errorf("invalid until value: %s", err)
+	}
+
+	entries, err := persistence.Audit().Find(meeseeks.AuditFilter{
+		Limit: *limit,
+		Since: sinceTime,
+		Until: untilTime,
+		Match: auditMultiMatch(
+			func(e meeseeks.AuditEntry) bool {
+				return *user == "" || *user == e.Request.Username || *user == e.Request.UserID
+			},
+			func(e meeseeks.AuditEntry) bool {
+				return *command == "" || *command == e.Request.Command
+			},
+			func(e meeseeks.AuditEntry) bool {
+				if *channel == "" {
+					return true
+				}
+				ch := strings.TrimPrefix(*channel, "#")
+				return ch == e.Request.Channel || ch == e.Request.ChannelID || *channel == e.Request.ChannelLink
+			},
+			func(e meeseeks.AuditEntry) bool {
+				return *decision == "" || *decision == e.Decision
+			},
+			func(e meeseeks.AuditEntry) bool {
+				return *incident == "" || *incident == e.Incident
+			},
+			auditAgentMatch(*agent),
+			auditJobStatusOrEmpty(jobStatus),
+		),
+	})
+	if err != nil {
+		return "", err
+	}
+	tmpl, err := template.New("audit", auditTemplate)
+	if err != nil {
+		return "", err
+	}
+	return tmpl.Render(map[string]interface{}{
+		"entries": entries,
+	})
+}
+
+// auditAgentMatch matches the entries of the jobs dispatched to the agent,
+// which is its ID, the identity of its cert, the name of its token or one of
+// its labels as name=value. Any entry is matched when the agent is empty
+func auditAgentMatch(agent string) func(meeseeks.AuditEntry) bool {
+	return func(e meeseeks.AuditEntry) bool {
+		if agent == "" {
+			return true
+		}
+		if e.Agent == nil {
+			return false
+		}
+		if agent == e.Agent.ID || agent == e.Agent.Identity || agent == e.Agent.Token {
+			return true
+		}
+		parts := strings.SplitN(agent, "=", 2)
+		if len(parts) != 2 {
+			return false
+		}
+		value, ok := e.Agent.Labels[parts[0]]
+		return ok && value == parts[1]
+	}
+}
+
+// auditJobStatusOrEmpty matches the entries that recorded a job which is in the
+// requested status, any entry is matched when the status is empty
+func auditJobStatusOrEmpty(status meeseeks.JobStatus) func(meeseeks.AuditEntry) bool {
+	return func(e meeseeks.AuditEntry) bool {
+		if status == "" {
+			return true
+		}
+		if e.JobID == 0 {
+			return false
+		}
+		j, err := persistence.Jobs().Get(e.JobID)
+		return err == nil && j.Status == status
+	}
+}
+
+// parseTimeFlag parses a point in time that can be expressed as a duration
+// before now, a plain date or an RFC3339 timestamp. An empty value returns
+// the zero time
+func parseTimeFlag(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s is not a duration, a date or an RFC3339 time", value)
+	}
+	return t, nil
+}
+
+type lastCommand struct {
+	cmd
+	help
+	noHandshake
+	noRecord
+	allowAll
+	anyChannel
+	emptyArgs
+	defaultTimeout
+}
+
+var jobTemplate = `
+{{- with $job := .job }}{{ with $r := $job.Request }}* *ID* {{ $job.ID }}{{ with $job.ULID }}
+* *ULID* {{ . }}{{ end }}
+* *Status* {{ $job.Status}}
+* *Command* {{ $r.Command }}{{ with $args := $r.Args }}
+* *Args* "{{ Join $args "\" \"" }}" {{ end }}
+* *Where* {{ if $r.IsIM }}IM{{ else }}{{ $r.ChannelLink }}{{ end }}
+* *When* {{ HumanizeTime $job.StartTime }}{{ with $r.RerunOf }}
+* *Rerun of* {{ . }}{{ end }}{{ with $job.Note }}
+* *Note* {{ . }}{{ end }}
+{{- end }}{{- end }}
+`
+
+var lastJobTemplate = `
+{{- with $job := .job }}{{ with $r := $job.Request }}* *ID* {{ $job.ID }}
+* *Status* {{ $job.Status}}
+* *Command* {{ $r.Command }}{{ with $args := $r.Args }}
+* *Args* "{{ Join $args "\" \"" }}" {{ end }}{{ if $.all }}
+* *By* {{ $r.Username }}{{ end }}
+* *Where* {{ if $r.IsIM }}IM{{ else }}{{ $r.ChannelLink }}{{ end }}
+* *When* {{ HumanizeTime $job.StartTime }}{{ with $d := $.duration }}
+* *Duration* {{ $d }}{{ end }}{{ with $out := $.output }}
+* *Output*
+` + "```" + `
+{{ $out }}
+` + "```" + `{{ end }}
+{{- end }}{{- end }}
+`
+
+func (l lastCommand) Execute(_ context.Context, job meeseeks.Job) (string, error) {
+	flags := flag.NewFlagSet("last", flag.ContinueOnError)
+	all := flags.Bool("all", false, "look for the last job across all users")
+	lines := flags.Int("lines", 5, "how many lines of output to show")
+	args, err := parseInterspersedFlags(flags, job.Request.Args)
+	if err != nil {
+		return "", err
+	}
+
+	matchers := make([]func(meeseeks.Job) bool, 0)
+	if !*all {
+		matchers = append(matchers, isUser(job.Request.Username))
+	}
+	command := ""
+	if len(args) > 0 {
+		command = args[0]
+		matchers = append(matchers, isCommand(command))
+	}
+
+	jobs, err := persistence.Jobs().Find(meeseeks.JobFilter{
+		Limit: 1,
+		Match: jobsMultiMatch(matchers...),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get the last job: %s", err)
+	}
+	if len(jobs) == 0 {
+		if command != "" {
+			return "", fmt.Errorf("no last job for command %s", command)
+		}
+		return "", fmt.Errorf("no last command for current user")
+	}
+	last := jobs[0]
+
+	duration := ""
+	if !last.EndTime.IsZero() {
+		duration = last.EndTime.Sub(last.StartTime).Round(time.Millisecond).String()
+	}
+
+	output := ""
+	if *lines > 0 {
+		jobLogs, err := persistence.LogReader().Tail(last.ID, *lines)
+		if err != nil && err != meeseeks.ErrNoLogsForJob {
+			return "", fmt.Errorf("failed to read the last job output: %s", err)
+		}
+		output = jobLogs.Output
+	}
+
+	tmpl, err := template.New("job", lastJobTemplate)
+	if err != nil {
+		return "", err
+	}
+	return tmpl.Render(map[string]interface{}{
+		"job":      last,
+		"all":      *all,
+		"duration": duration,
+		"output":   output,
+	})
+}
+
+type findJobCommand struct {
+	cmd
+	help
+	noHandshake
+	noRecord
+	allowAll
+	anyChannel
+	emptyArgs
+	defaultTimeout
+}
+
+func (l findJobCommand) Execute(_ context.Context, job meeseeks.Job) (string, error) {
+	id, err := parseJobID(job.Request.Args)
+	if err != nil {
+		return "", err
+	}
+
+	callingUser := job.Request.Username
+	jobs, err := persistence.Jobs().Find(meeseeks.JobFilter{
+		Limit: 1,
+		Match: jobsMultiMatch(
+			isUser(callingUser),
+			isJobID(id)),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get the last job: %s", err)
+	}
+	if len(jobs) == 0 {
+		return "", fmt.Errorf("no last command for current user")
+	}
+
+	tmpl, err := template.New("job", jobTemplate)
+	if err != nil {
+		return "", err
+	}
+	return tmpl.Render(map[string]interface{}{
+		"job": jobs[0],
+	})
+}
+
+type auditJobCommand struct {
+	cmd
+	help
+	noHandshake
+	noRecord
+	allowAdmins
+	anyChannel
+	emptyArgs
+	defaultTimeout
+}
+
+func (l auditJobCommand) Execute(_ context.Context, job meeseeks.Job) (string, error) {
+	id, err := parseJobID(job.Request.Args)
+	if err != nil {
+		return "", err
+	}
+
+	jobs, err := persistence.Jobs().Find(meeseeks.JobFilter{
+		Limit: 1,
+		Match: isJobID(id),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get job %d: %s", job.ID, err)
+	}
+	if len(jobs) == 0 {
+		return "", fmt.Errorf("job not found")
+	}
+
+	tmpl, err := template.New("job", jobTemplate)
+	if err != nil {
+		return "", err
+	}
+	return tmpl.Render(map[string]interface{}{
+		"job": jobs[0],
+	})
+}
+
+type auditLogsCommand struct {
+	cmd
+	help
+	noHandshake
+	noRecord
+	allowAll
+	anyChannel
+	emptyArgs
+	defaultTimeout
+}
+
+func (t auditLogsCommand) Execute(_ context.Context, job meeseeks.Job) (string, error) {
+	id, err := parseJobID(job.Request.Args)
+	if err != nil {
+		return "", err
+	}
+
+	jobs, err := persistence.Jobs().Find(meeseeks.JobFilter{
 		Limit: 1,
 		Match: isJobID(id),
 	})
@@ -757,15 +1493,46 @@ type tailCommand struct {
 	anyChannel
 	emptyArgs
 	defaultTimeout
+	replyFunc func(formatter.Reply)
+}
+
+// GetTimeout disables the timeout, as following a job lasts as long as the job does
+func (t tailCommand) GetTimeout() time.Duration {
+	return 0
 }
 
-func (t tailCommand) Execute(_ context.Context, job meeseeks.Job) (string, error) {
+// NewTailCommand creates a tail command that will use the passed reply function to
+// send the new log lines of a running job when following it
+func NewTailCommand(f func(formatter.Reply)) meeseeks.Command {
+	return tailCommand{
+		help: newHelp(
+			"returns the last lines of the last executed job, or one selected by job ID",
+			"-limit: how many lines to show",
+			"-follow: keeps sending new log lines until the job finishes",
+			"-interval: how often to send new lines when following, 5s by default",
+			"-thread: sends the new lines in a thread when following",
+			"-timestamps: shows when each line was written since the job started, and the stderr lines",
+			"job ID to look for, optional, if not provided the last executed one will be looked up",
+		),
+		cmd:       cmd{BuiltinTailCommand},
+		replyFunc: f,
+	}
+}
+
+func (t tailCommand) Execute(ctx context.Context, job meeseeks.Job) (string, error) {
 	flags := flag.NewFlagSet("tail", flag.ContinueOnError)
 	limit := flags.Int("limit", 5, "how many lines to return")
+	follow := flags.Bool("follow", false, "keep sending new lines until the job finishes")
+	interval := flags.Duration("interval", 5*time.Second, "how often to send new lines when following")
+	thread := flags.Bool("thread", false, "send new lines in a thread when following")
+	timestamps := flags.Bool("timestamps", false, "show the time and stream of each line")
 
-	flags.Parse(job.Request.Args)
+	args, err := parseInterspersedFlags(flags, job.Request.Args)
+	if err != nil {
+		return "", err
+	}
 
-	jobID, err := parseJobID(flags.Args())
+	jobID, err := parseJobID(args)
 
 	if err == errNoJobIDAsArgument {
 		jobID, err = findLastJobIDForUser(job.Request.Username)
@@ -774,11 +1541,77 @@ func (t tailCommand) Execute(_ context.Context, job meeseeks.Job) (string, error
 		return "", err
 	}
 
+	if *follow {
+		return t.follow(ctx, job.Request, jobID, *interval, *thread)
+	}
+
 	jobLogs, err := persistence.LogReader().Tail(jobID, *limit)
 	if err != nil {
 		return "", err
 	}
-	return jobLogs.Output, jobLogs.GetError()
+	return renderLogs(jobID, jobLogs, *timestamps)
+}
+
+// follow sends the new log lines of a job in batches every interval until the
+// job is not running anymore, then returns whatever lines are left
+func (t tailCommand) follow(ctx context.Context, req meeseeks.Request, jobID uint64, interval time.Duration,
+	inThread bool) (string, error) {
+	if _, err := persistence.Jobs().Get(jobID); err != nil {
+		return "", err
+	}
+
+	sent := 0
+	newLines := func() ([]string, meeseeks.JobLog, error) {
+		jobLogs, err := persistence.LogReader().Get(jobID)
+		if err == meeseeks.ErrNoLogsForJob {
+			return []string{}, jobLogs, nil
+		}
+		if err != nil || jobLogs.Output == "" {
+			return []string{}, jobLogs, err
+		}
+		lines := strings.Split(jobLogs.Output, "\n")
+		if len(lines) <= sent {
+			return []string{}, jobLogs, nil
+		}
+		lines = lines[sent:]
+		sent += len(lines)
+		return lines, jobLogs, nil
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("stopped following job %d: %s", jobID, ctx.Err())
+		case <-ticker.C:
+		}
+
+		j, err := persistence.Jobs().Get(jobID)
+		if err != nil {
+			return "", err
+		}
+
+		lines, jobLogs, err := newLines()
+		if err != nil {
+			return "", err
+		}
+
+		if j.Status != meeseeks.JobRunningStatus {
+			return strings.Join(lines, "\n"), jobLogs.GetError()
+		}
+
+		if len(lines) == 0 || t.replyFunc == nil {
+			continue
+		}
+
+		reply := formatter.ProgressReply(req).WithOutput(strings.Join(lines, "\n"))
+		if inThread {
+			reply = reply.InThread()
+		}
+		t.replyFunc(reply)
+	}
 }
 
 type headCommand struct {
@@ -795,6 +1628,7 @@ type headCommand struct {
 func (h headCommand) Execute(_ context.Context, job meeseeks.Job) (string, error) {
 	flags := flag.NewFlagSet("head", flag.ContinueOnError)
 	limit := flags.Int("limit", 5, "how many lines to return")
+	timestamps := flags.Bool("timestamps", false, "show the time and stream of each line")
 
 	flags.Parse(job.Request.Args)
 
@@ -811,7 +1645,7 @@ func (h headCommand) Execute(_ context.Context, job meeseeks.Job) (string, error
 	if err != nil {
 		return "", err
 	}
-	return jobLogs.Output, jobLogs.GetError()
+	return renderLogs(jobID, jobLogs, *timestamps)
 }
 
 type logsCommand struct {
@@ -826,7 +1660,15 @@ type logsCommand struct {
 }
 
 func (t logsCommand) Execute(_ context.Context, job meeseeks.Job) (string, error) {
-	id, err := parseJobID(job.Request.Args)
+	flags := flag.NewFlagSet("logs", flag.ContinueOnError)
+	timestamps := flags.Bool("timestamps", false, "show the time and stream of each line")
+
+	args, err := parseInterspersedFlags(flags, job.Request.Args)
+	if err != nil {
+		return "", err
+	}
+
+	id, err := parseJobID(args)
 	if err != nil {
 		return "", err
 	}
@@ -835,7 +1677,7 @@ func (t logsCommand) Execute(_ context.Context, job meeseeks.Job) (string, error
 	jobs, err := persistence.Jobs().Find(meeseeks.JobFilter{
 		Limit: 1,
 		Match: jobsMultiMatch(
-			isUser(callingUser),
+			logsVisibleTo(callingUser),
 			isJobID(id)),
 	})
 	if err != nil {
@@ -850,7 +1692,40 @@ func (t logsCommand) Execute(_ context.Context, job meeseeks.Job) (string, error
 	if err != nil {
 		return "", err
 	}
-	return jobLogs.Output, jobLogs.GetError()
+	return renderLogs(j.ID, jobLogs, *timestamps)
+}
+
+var logLinesTemplate = strings.Join([]string{
+	"{{ range $i, $l := .lines }}{{ if $i }}\n{{ end }}",
+	"{{ if not $l.Time.IsZero }}[{{ Elapsed $.start $l.Time }}] {{ end }}",
+	"{{ if eq $l.Stream \"stderr\" }}(stderr) {{ end }}{{ $l.Text }}{{ end }}",
+}, "")
+
+// renderLogs returns the output of a job log, with timestamps each line is
+// prefixed with the time it was written since the job started and the stderr
+// lines are marked. Lines stored without a time get no timestamp
+func renderLogs(jobID uint64, jobLogs meeseeks.JobLog, timestamps bool) (string, error) {
+	if !timestamps {
+		return jobLogs.Output, jobLogs.GetError()
+	}
+
+	j, err := persistence.Jobs().Get(jobID)
+	if err != nil {
+		return "", err
+	}
+
+	tmpl, err := template.New("logs", logLinesTemplate)
+	if err != nil {
+		return "", err
+	}
+	out, err := tmpl.Render(map[string]interface{}{
+		"start": j.StartTime,
+		"lines": jobLogs.GetLines(),
+	})
+	if err != nil {
+		return "", err
+	}
+	return out, jobLogs.GetError()
 }
 
 type newAPITokenCommand struct {
@@ -865,18 +1740,50 @@ type newAPITokenCommand struct {
 }
 
 func (n newAPITokenCommand) Execute(_ context.Context, job meeseeks.Job) (string, error) {
-	if len(job.Request.Args) < 3 {
+	// Flags go first, the arguments of the command may look like flags too
+	flags := flag.NewFlagSet("token-new", flag.ContinueOnError)
+	commandsList := flags.String("commands", "", "commands the token can call")
+	channelsList := flags.String("channels", "", "channels the caller can pick")
+	expires := flags.Duration("expires", 0, "how long the token works")
+	if err := flags.Parse(job.Request.Args); err != nil {
+		return "", err
+	}
+	args := flags.Args()
+
+	scopes := meeseeks.APITokenScopes{
+		Commands: splitList(*commandsList),
+		Channels: splitList(*channelsList),
+	}
+	if len(args) < 2 || (len(args) < 3 && len(scopes.Commands) == 0) {
 		return "", fmt.Errorf("not enough arguments passed in")
 	}
+	if *expires < 0 {
+		return "", fmt.Errorf("the token expiration can't be negative")
+	}
+	if *expires > 0 {
+		scopes.ExpiresAt = time.Now().Add(*expires)
+	}
 
 	t, err := persistence.APITokens().Create(
-		job.Request.Args[0],
-		job.Request.Args[1],
-		strings.Join(job.Request.Args[2:], " "),
+		args[0],
+		args[1],
+		strings.Join(args[2:], " "),
+		scopes,
 	)
 	return fmt.Sprintf("created token %s", t), err
 }
 
+// splitList splits a comma separated list, dropping the empty values
+func splitList(list string) []string {
+	values := make([]string, 0)
+	for _, v := range strings.Split(list, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
 type revokeAPITokenCommand struct {
 	cmd
 	help
@@ -910,7 +1817,11 @@ type listAPITokensCommand struct {
 	defaultTimeout
 }
 
-var listTokensTemplate = `{{ if eq (len .tokens) 0 }}No tokens could be found{{ else }}{{ range $t := .tokens }}- *{{ $t.TokenID }}* {{ $t.UserLink }} at {{ $t.ChannelLink }} _{{ $t.Text}}_
+var listTokensTemplate = `{{ if eq (len .tokens) 0 }}No tokens could be found{{ else }}{{ range $t := .tokens }}- *{{ $t.TokenID }}* {{ $t.UserLink }} at {{ $t.ChannelLink }}{{ with $t.Text }} _{{ . }}_{{ end }}` +
+	`{{ with $t.Scopes.Commands }} commands {{ Join . ", " }}{{ end }}` +
+	`{{ with $t.Scopes.Channels }} channels {{ Join . ", " }}{{ end }}` +
+	`{{ if not $t.Scopes.ExpiresAt.IsZero }} expires {{ HumanizeTime $t.Scopes.ExpiresAt }}{{ end }}` +
+	`{{ if $t.LastUsed.IsZero }} never used{{ else }} last used {{ HumanizeTime $t.LastUsed }}{{ end }}
 {{ end }}{{ end }}`
 
 // apiTokenMultiMatch builds a Match function from a list of Match functions
@@ -1046,10 +1957,19 @@ func (l getAliasesCommand) Execute(_ context.Context, job meeseeks.Job) (string,
 
 // Helper functions from now on
 
+// parseJobID returns the job ID passed as the first argument, either the
+// sequential ID or the ULID of the job
 func parseJobID(args []string) (uint64, error) {
 	if len(args) == 0 {
 		return 0, errNoJobIDAsArgument
 	}
+	if meeseeks.IsJobULID(args[0]) {
+		job, err := persistence.Jobs().GetByULID(args[0])
+		if err != nil {
+			return 0, err
+		}
+		return job.ID, nil
+	}
 	id, err := strconv.ParseUint(args[0], 10, 64)
 	if err != nil {
 		return 0, fmt.Errorf("invalid job ID %s: %s", args[0], err)
@@ -1058,19 +1978,69 @@ func parseJobID(args []string) (uint64, error) {
 	return id, nil
 }
 
+// parseInterspersedFlags parses the flags allowing them to be found after the
+// positional arguments, returning the positional arguments in order
+func parseInterspersedFlags(flags *flag.FlagSet, args []string) ([]string, error) {
+	positional := make([]string, 0)
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		if flags.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+}
+
 func isUser(username string) func(meeseeks.Job) bool {
 	return func(j meeseeks.Job) bool {
 		return j.Request.Username == username
 	}
 }
 
+// logsVisibleTo matches the jobs of the user and the ones whose logs it can
+// view through a role
+func logsVisibleTo(username string) func(meeseeks.Job) bool {
+	return func(job meeseeks.Job) bool {
+		return job.Request.Username == username ||
+			auth.HasPermission(username, job.Request.Command, auth.PermissionViewLogs)
+	}
+}
+
+func isCommand(command string) func(meeseeks.Job) bool {
+	return func(j meeseeks.Job) bool {
+		return j.Request.Command == command
+	}
+}
+
 func isJobID(jobID uint64) func(meeseeks.Job) bool {
 	return func(j meeseeks.Job) bool {
 		return j.ID == jobID
 	}
 }
 
-func isStatusOrEmpty(status string) func(meeseeks.Job) bool {
+func isChannelOrEmpty(channel string) func(meeseeks.Job) bool {
+	return func(j meeseeks.Job) bool {
+		if channel == "" {
+			return true
+		}
+		ch := strings.TrimPrefix(channel, "#")
+		return ch == j.Request.Channel || ch == j.Request.ChannelID || channel == j.Request.ChannelLink
+	}
+}
+
+// parseStatusFlag returns the job status named in a flag, or an empty one if
+// the flag is not set
+func parseStatusFlag(name string) (meeseeks.JobStatus, error) {
+	if name == "" {
+		return "", nil
+	}
+	return meeseeks.ParseJobStatus(name)
+}
+
+func isStatusOrEmpty(status meeseeks.JobStatus) func(meeseeks.Job) bool {
 	return func(j meeseeks.Job) bool {
 		if status == "" {
 			return true
@@ -1093,3 +2063,344 @@ func findLastJobIDForUser(callingUser string) (uint64, error) {
 	return jobs[0].ID, nil
 
 }
+
+type linkCommand struct {
+	cmd
+	help
+	noHandshake
+	noRecord
+	allowAll
+	imOnlyChannel
+	emptyArgs
+	defaultTimeout
+}
+
+func (l linkCommand) Execute(_ context.Context, job meeseeks.Job) (string, error) {
+	link, ttl, err := oidc.NewLink(job.Request)
+	if err != nil {
+		return "", err
+	}
+	out := fmt.Sprintf("Log in at %s to link your identity, the link can be used once in the next %s", link, ttl)
+	if job.Request.Identity != "" {
+		out += fmt.Sprintf(", it will replace %s", job.Request.Identity)
+	}
+	return out, nil
+}
+
+type unlinkCommand struct {
+	cmd
+	help
+	noHandshake
+	noRecord
+	allowAll
+	anyChannel
+	emptyArgs
+	defaultTimeout
+}
+
+func (u unlinkCommand) Execute(_ context.Context, job meeseeks.Job) (string, error) {
+	if err := persistence.Identities().Unlink(job.Request.UserID); err != nil {
+		return "", err
+	}
+	return "Your identity has been unlinked", nil
+}
+
+type grantCommand struct {
+	cmd
+	help
+	noHandshake
+	noRecord
+	allowAdmins
+	anyChannel
+	emptyArgs
+	defaultTimeout
+}
+
+func (g grantCommand) Execute(_ context.Context, job meeseeks.Job) (string, error) {
+	flags := flag.NewFlagSet("grant", flag.ContinueOnError)
+	duration := flags.Duration("for", 0, "how long the grant lasts")
+
+	args, err := parseInterspersedFlags(flags, job.Request.Args)
+	if err != nil {
+		return "", err
+	}
+	if len(args) != 2 {
+		return "", fmt.Errorf("a user and a command or group should be passed as arguments")
+	}
+	if *duration <= 0 {
+		return "", fmt.Errorf("how long the grant lasts should be passed with -for")
+	}
+	user, target := args[0], args[1]
+
+	kind := meeseeks.GrantCommand
+	if _, ok := commands.Find(&meeseeks.Request{Command: target}); !ok {
+		if _, ok := auth.GetGroups()[target]; !ok {
+			return "", fmt.Errorf("there is no command or group %s", target)
+		}
+		kind = meeseeks.GrantGroup
+	}
+
+	now := time.Now().UTC()
+	grant, err := persistence.Grants().Create(meeseeks.Grant{
+		Username:  user,
+		Kind:      kind,
+		Target:    target,
+		GrantedBy: job.Request.Username,
+		CreatedAt: now,
+		ExpiresAt: now.Add(*duration),
+	})
+	if err != nil {
+		return "", fmt.Errorf("could not persist grant: %s", err)
+	}
+	auth.AddGrant(grant)
+
+	if kind == meeseeks.GrantGroup {
+		return fmt.Sprintf("User *%s* is in group *%s* for %s", user, target, *duration), nil
+	}
+	return fmt.Sprintf("User *%s* can run *%s* for %s", user, target, *duration), nil
+}
+
+type grantsCommand struct {
+	cmd
+	help
+	noHandshake
+	noRecord
+	allowAdmins
+	anyChannel
+	emptyArgs
+	defaultTimeout
+}
+
+var grantsTemplate = `{{ if eq (len .grants) 0 }}No grants could be found{{ else }}{{ range $g := .grants }}- *{{ $g.Username }}* {{ if eq $g.Kind "group" }}is in group{{ else }}can run{{ end }} *{{ $g.Target }}* until {{ HumanizeTime $g.ExpiresAt }}, granted by {{ $g.GrantedBy }}
+{{ end }}{{ end }}`
+
+func (g grantsCommand) Execute(_ context.Context, _ meeseeks.Job) (string, error) {
+	grants, err := persistence.Grants().List(time.Now())
+	if err != nil {
+		return "", fmt.Errorf("could not list grants: %s", err)
+	}
+
+	tmpl, err := template.New("grants", grantsTemplate)
+	if err != nil {
+		return "", err
+	}
+	return tmpl.Render(map[string]interface{}{
+		"grants": grants,
+	})
+}
+
+type newAgentTokenCommand struct {
+	cmd
+	help
+	noHandshake
+	noRecord
+	allowAdmins
+	imOnlyChannel
+	emptyArgs
+	defaultTimeout
+}
+
+func (n newAgentTokenCommand) Execute(_ context.Context, job meeseeks.Job) (string, error) {
+	if len(job.Request.Args) != 1 {
+		return "", fmt.Errorf("only the name of the agent should be passed as an argument")
+	}
+	token, err := agenttokens.Issue(job.Request.Args[0], job.Request.Username)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("created the token of agent *%s*, write it to its token file: %s", job.Request.Args[0], token), nil
+}
+
+type rotateAgentTokenCommand struct {
+	cmd
+	help
+	noHandshake
+	noRecord
+	allowAdmins
+	imOnlyChannel
+	emptyArgs
+	defaultTimeout
+}
+
+func (r rotateAgentTokenCommand) Execute(_ context.Context, job meeseeks.Job) (string, error) {
+	if len(job.Request.Args) != 1 {
+		return "", fmt.Errorf("only the name of the agent should be passed as an argument")
+	}
+	token, err := agenttokens.Rotate(job.Request.Args[0], job.Request.Username)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("rotated the token of agent *%s*, write it to its token file: %s", job.Request.Args[0], token), nil
+}
+
+type revokeAgentTokenCommand struct {
+	cmd
+	help
+	noHandshake
+	noRecord
+	allowAdmins
+	imOnlyChannel
+	emptyArgs
+	defaultTimeout
+}
+
+func (r revokeAgentTokenCommand) Execute(_ context.Context, job meeseeks.Job) (string, error) {
+	if len(job.Request.Args) != 1 {
+		return "", fmt.Errorf("only the name of the agent should be passed as an argument")
+	}
+	if err := agenttokens.Revoke(job.Request.Args[0]); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Token of agent *%s* has been revoked", job.Request.Args[0]), nil
+}
+
+type listAgentTokensCommand struct {
+	cmd
+	help
+	noHandshake
+	noRecord
+	allowAdmins
+	imOnlyChannel
+	emptyArgs
+	defaultTimeout
+}
+
+var listAgentTokensTemplate = `{{ if eq (len .tokens) 0 }}No agent tokens could be found{{ else }}{{ range $t := .tokens }}- *{{ $t.Name }}* issued by {{ $t.CreatedBy }} {{ HumanizeTime $t.CreatedAt }}
+{{ end }}{{ end }}`
+
+func (l listAgentTokensCommand) Execute(_ context.Context, _ meeseeks.Job) (string, error) {
+	tokens, err := persistence.AgentTokens().List()
+	if err != nil {
+		return "", fmt.Errorf("could not list agent tokens: %s", err)
+	}
+
+	tmpl, err := template.New("agent-tokens", listAgentTokensTemplate)
+	if err != nil {
+		return "", err
+	}
+	return tmpl.Render(map[string]interface{}{
+		"tokens": tokens,
+	})
+}
+
+type agentsCommand struct {
+	cmd
+	help
+	noHandshake
+	noRecord
+	emptyArgs
+	allowAll
+	anyChannel
+	defaultTimeout
+}
+
+var agentsTemplate = `{{ if eq (len .agents) 0 }}No agents are registered{{ else }}{{ range $a := .agents }}- *{{ $a.ID }}*{{ if $a.Hostname }} on {{ $a.Hostname }}{{ end }} ({{ $a.OS }}/{{ $a.Arch }}{{ if $a.Version }}, version {{ $a.Version }}{{ end }}){{ if $a.Identity }} as {{ $a.Identity }}{{ end }}, registered {{ HumanizeTime $a.RegisteredAt }}{{ range $name, $value := $a.Labels }} ` + "`{{ $name }}={{ $value }}`" + `{{ end }}{{ if $a.Commands }}, runs {{ Join $a.Commands ", " }}{{ end }}
+{{ end }}{{ end }}`
+
+func (a agentsCommand) Execute(_ context.Context, _ meeseeks.Job) (string, error) {
+	tmpl, err := template.New("agents", agentsTemplate)
+	if err != nil {
+		return "", err
+	}
+	return tmpl.Render(map[string]interface{}{
+		"agents": registry.List(),
+	})
+}
+
+type breakGlassCommand struct {
+	cmd
+	help
+	noHandshake
+	noRecord
+	allowAdmins
+	anyChannel
+	emptyArgs
+	defaultTimeout
+}
+
+func (b breakGlassCommand) Execute(_ context.Context, job meeseeks.Job) (string, error) {
+	flags := flag.NewFlagSet("break-glass", flag.ContinueOnError)
+	duration := flags.Duration("for", 0, "how long break glass lasts")
+
+	args, err := parseInterspersedFlags(flags, job.Request.Args)
+	if err != nil {
+		return "", err
+	}
+	if len(args) != 1 {
+		return "", fmt.Errorf("the name of the incident should be passed as an argument")
+	}
+
+	incident, err := breakglass.Start(args[0], job.Request.Username, *duration, time.Now())
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Break glass is on for incident *%s* until %s", incident.Name,
+		incident.EndsAt.UTC().Format(time.RFC3339)), nil
+}
+
+type breakGlassEndCommand struct {
+	cmd
+	help
+	noHandshake
+	noRecord
+	allowAdmins
+	anyChannel
+	emptyArgs
+	defaultTimeout
+}
+
+func (b breakGlassEndCommand) Execute(_ context.Context, job meeseeks.Job) (string, error) {
+	incident, err := breakglass.End(job.Request.Username, time.Now())
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Break glass is off for incident *%s*", incident.Name), nil
+}
+
+type renderTemplateCommand struct {
+	cmd
+	help
+	noHandshake
+	noRecord
+	allowAdmins
+	anyChannel
+	emptyArgs
+	defaultTimeout
+}
+
+const (
+	sampleOutput = "sample output"
+	sampleError  = "sample error"
+)
+
+func (r renderTemplateCommand) Execute(_ context.Context, job meeseeks.Job) (string, error) {
+	if len(job.Request.Args) < 2 {
+		return "", fmt.Errorf("a command and success or failure should be passed as arguments")
+	}
+	command, action := job.Request.Args[0], job.Request.Args[1]
+
+	output := sampleOutput
+	if len(job.Request.Args) > 2 {
+		output = strings.Join(job.Request.Args[2:], " ")
+	}
+
+	// The reply is rendered as if the command was called by the same user in the
+	// same channel, so it gets the overrides of the command and of the channel
+	req := job.Request
+	req.Command = command
+	req.Args = []string{}
+	if _, ok := commands.Find(&req); !ok {
+		return "", fmt.Errorf("there is no command %s", command)
+	}
+
+	var reply formatter.Reply
+	switch action {
+	case template.Success:
+		reply = formatter.SuccessReply(req)
+	case template.Failure:
+		reply = formatter.FailureReply(req, fmt.Errorf(sampleError))
+	default:
+		return "", fmt.Errorf("can't render template %s, only success or failure", action)
+	}
+	return reply.WithOutput(output).Render()
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"strings"
 	"testing"
+	"time"
 
 	"gitlab.com/yakshaving.art/meeseeks-box/auth"
 	"gitlab.com/yakshaving.art/meeseeks-box/commands"
@@ -13,6 +14,10 @@ import (
 	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
 	"gitlab.com/yakshaving.art/meeseeks-box/mocks"
 	"gitlab.com/yakshaving.art/meeseeks-box/persistence"
+	"gitlab.com/yakshaving.art/meeseeks-box/remote/agenttokens"
+	"gitlab.com/yakshaving.art/meeseeks-box/remote/registry"
+	"gitlab.com/yakshaving.art/meeseeks-box/text/formatter"
+	"gitlab.com/yakshaving.art/meeseeks-box/text/template"
 )
 
 var basicGroups = map[string][]string{
@@ -35,8 +40,12 @@ func Test_BuiltinCommands(t *testing.T) {
 
 	cancelCmd := builtins.NewCancelJobCommand(func(_ uint64) {})
 	killCmd := builtins.NewKillJobCommand(func(_ uint64) {})
+	tailCmd := builtins.NewTailCommand(func(_ formatter.Reply) {})
 
-	builtins.LoadBuiltins(cancelCmd, killCmd)
+	rerunCmd := builtins.NewRerunJobCommand(func(_ meeseeks.Request) {})
+	approveCmd := builtins.NewApproveCommand(func(_ meeseeks.Request) {})
+
+	builtins.LoadBuiltins(cancelCmd, killCmd, tailCmd, rerunCmd, approveCmd)
 
 	tt := []struct {
 		name                    string
@@ -50,6 +59,7 @@ func Test_BuiltinCommands(t *testing.T) {
 		expectedAllowedGroups   []string
 		expectedChannelStrategy string
 		expectedAllowedChannels []string
+		expectedNoTimeout       bool
 	}{
 		{
 			name: "version command",
@@ -82,25 +92,45 @@ func Test_BuiltinCommands(t *testing.T) {
 				UserID:  "userid",
 			},
 			job: meeseeks.Job{Request: meeseeks.Request{Args: []string{"-all"}}},
-			expected: `- alias: adds an alias for a command for the current user
+			expected: `- agent-token-new: issues the token a remote agent registers with (admin only)
+- agent-token-revoke: revokes the token of a remote agent, disconnecting the agents that use it (admin only)
+- agent-token-rotate: replaces the token of a remote agent, disconnecting the agents that use the previous one (admin only)
+- agent-tokens: lists the agents that have a token (admin only)
+- agents: lists the remote agents that are registered, where they run and their commands
+- alias: adds an alias for a command for the current user
 - aliases: list all the aliases for the current user
-- audit: lists jobs from all users or a specific one (admin only)
+- approve: approves a request that waits for approvals, it runs once it gets all of them
+- audit: lists who ran what, where and with which args, and which requests were rejected (admin only)
 - auditjob: shows a command metadata by job ID (admin only)
 - auditlogs: shows the logs of a job by ID (admin only)
-- cancel: sends a cancellation signal to a job owned by the current user
+- break-glass: lets the break glass groups run any command for a while, for an incident (admin only)
+- break-glass-end: ends break glass before it expires (admin only)
+- cancel: sends a cancellation signal to a job owned by the current user, or one its roles can cancel
+- channel-jobs: shows the last jobs that were called in the current channel, by any user
+- grant: temporarily allows a user to run a command, or adds it to a group, until the grant expires (admin only)
+- grants: lists the temporary grants that have not expired (admin only)
+- group-add: adds a user to a group, surviving restarts and reloads (admin only)
+- group-remove: removes a user from a group, surviving restarts and reloads (admin only)
 - groups: prints the configured groups
 - head: returns the top N log lines of a command output or error
 - help: shows the help for all the commands, or a single one
 - job: show metadata of one job by id
 - jobs: shows the last executed jobs for the calling user
 - kill: sends a cancellation signal to a job, admin only
-- last: shows the last job metadata executed by the current user
+- last: shows the last job executed by the current user, with its status, duration and output tail
+- link: sends a link to log in with the identity provider and link it to the current user
 - logs: returns the full output of the job passed as argument
+- my-jobs: shows the last jobs of the calling user
+- notify: sends you a direct message when a job finishes, like: notify me when 42 finishes
+- pending-approvals: lists the requests that wait for approvals, with how many they got
+- render-template: renders the success or failure template of a command with a sample output, as it would reply in this channel (admin only)
+- rerun: runs the command of a past job again, with the same args and in the same channel
 - tail: returns the last lines of the last executed job, or one selected by job ID
 - token-new: creates a new API token
 - token-revoke: revokes an API token
 - tokens: lists the API tokens
 - unalias: deletes an alias
+- unlink: removes the identity linked to the current user
 - version: prints the running meeseeks version
 `,
 			expectedAuthStrategy:    auth.AuthStrategyAny,
@@ -116,6 +146,9 @@ func Test_BuiltinCommands(t *testing.T) {
 			expected: `*token-new* - creates a new API token
 
 *Arguments*
+- -commands: comma separated commands the token can call, the caller sends the command when the token has none
+- -channels: comma separated channels the caller can pick besides the one of the token
+- -expires: how long the token works, like 720h, forever by default
 - user that will be impersonated by the api, mandatory
 - channel that will be used as the one in which the job was called
 - command the token will be calling
@@ -132,9 +165,10 @@ func Test_BuiltinCommands(t *testing.T) {
 			},
 
 			job: meeseeks.Job{},
-			expected: `
-- admins: admin_user
-- other: user_one, user_two
+			expected: `Group   Members
+------  ------------------
+admins  admin_user
+other   user_one, user_two
 `,
 			expectedAuthStrategy:    auth.AuthStrategyAllowedGroup,
 			expectedAllowedGroups:   []string{auth.AdminGroup},
@@ -153,9 +187,9 @@ func Test_BuiltinCommands(t *testing.T) {
 			setup: func() {
 				j, err := persistence.Jobs().Create(req)
 				mocks.Must(t, "could not create job", err)
-				persistence.Jobs().Succeed(j.ID)
+				persistence.Jobs().Finish(j.ID, meeseeks.JobSucceededStatus)
 			},
-			expected:                "*1* - now - *command* by *someone* in *<#123>* - *Successful*\n",
+			expected:                "*1* - now - *command* by *someone* in *<#123>* - *Succeeded*\n",
 			expectedAuthStrategy:    auth.AuthStrategyAny,
 			expectedChannelStrategy: auth.ChannelStrategyAny,
 		},
@@ -172,9 +206,33 @@ func Test_BuiltinCommands(t *testing.T) {
 			setup: func() {
 				j, err := persistence.Jobs().Create(req)
 				mocks.Must(t, "could not create job", err)
-				persistence.Jobs().Succeed(j.ID)
+				_, err = persistence.Audit().Record(meeseeks.AuditEntry{
+					Decision: meeseeks.AuditAccepted, JobID: j.ID, Request: req})
+				mocks.Must(t, "could not record audit entry", err)
 			},
-			expected:                "*1* - now - *command* by *someone* in *<#123>* - *Successful*\n",
+			expected:                "now - *command* `arg1 arg2` by *someone* in *<#123>* - job *1*\n",
+			expectedAuthStrategy:    auth.AuthStrategyAllowedGroup,
+			expectedAllowedGroups:   []string{auth.AdminGroup},
+			expectedChannelStrategy: auth.ChannelStrategyAny,
+		},
+		{
+			name: "test audit command with a linked identity",
+			req: meeseeks.Request{
+				Command: builtins.BuiltinAuditCommand,
+				UserID:  "userid",
+			},
+
+			job: meeseeks.Job{
+				Request: meeseeks.Request{},
+			},
+			setup: func() {
+				r := req
+				r.Identity = "someone@example.com"
+				_, err := persistence.Audit().Record(meeseeks.AuditEntry{
+					Decision: meeseeks.AuditUnauthorized, Request: r})
+				mocks.Must(t, "could not record audit entry", err)
+			},
+			expected:                "now - *command* `arg1 arg2` by *someone* (someone@example.com) in *<#123>* - _unauthorized_\n",
 			expectedAuthStrategy:    auth.AuthStrategyAllowedGroup,
 			expectedAllowedGroups:   []string{auth.AdminGroup},
 			expectedChannelStrategy: auth.ChannelStrategyAny,
@@ -193,7 +251,124 @@ func Test_BuiltinCommands(t *testing.T) {
 				persistence.Jobs().Create(req)
 				persistence.Jobs().Create(req)
 			},
-			expected:                "*2* - now - *command* by *someone* in *<#123>* - *Running*\n",
+			expected:                "*2* - now - *command* by *someone* in *<#123>* - *Running*\n_more jobs with_ `-before 2`\n",
+			expectedAuthStrategy:    auth.AuthStrategyAny,
+			expectedChannelStrategy: auth.ChannelStrategyAny,
+		},
+		{
+			name: "test jobs command next page",
+			req: meeseeks.Request{
+				Command: builtins.BuiltinJobsCommand,
+				UserID:  "userid",
+			},
+
+			job: meeseeks.Job{
+				Request: meeseeks.Request{Username: "someone", Args: []string{"-limit=1", "-before=2"}},
+			},
+			setup: func() {
+				persistence.Jobs().Create(req)
+				persistence.Jobs().Create(req)
+			},
+			expected:                "*1* - now - *command* by *someone* in *<#123>* - *Running*\n",
+			expectedAuthStrategy:    auth.AuthStrategyAny,
+			expectedChannelStrategy: auth.ChannelStrategyAny,
+		},
+		{
+			name: "test jobs command for another user and channel",
+			req: meeseeks.Request{
+				Command: builtins.BuiltinJobsCommand,
+				UserID:  "userid",
+			},
+
+			job: meeseeks.Job{
+				Request: meeseeks.Request{Username: "someone", Args: []string{"-user", "other", "-channel", "#general"}},
+			},
+			setup: func() {
+				persistence.Jobs().Create(req)
+				persistence.Jobs().Create(meeseeks.Request{
+					Command:     "command",
+					Channel:     "general",
+					ChannelID:   "123",
+					ChannelLink: "<#123>",
+					Username:    "other",
+				})
+				persistence.Jobs().Create(meeseeks.Request{
+					Command:   "command",
+					Channel:   "random",
+					ChannelID: "456",
+					Username:  "other",
+				})
+			},
+			expected:                "*2* - now - *command* by *other* in *<#123>* - *Running*\n",
+			expectedAuthStrategy:    auth.AuthStrategyAny,
+			expectedChannelStrategy: auth.ChannelStrategyAny,
+		},
+		{
+			name: "test jobs command with label",
+			req: meeseeks.Request{
+				Command: builtins.BuiltinJobsCommand,
+				UserID:  "userid",
+			},
+
+			job: meeseeks.Job{
+				Request: meeseeks.Request{Username: "someone", Args: []string{"-label", "env=prod"}},
+			},
+			setup: func() {
+				j, err := persistence.Jobs().Create(req)
+				mocks.Must(t, "could not create job", err)
+				mocks.Must(t, "could not label job", persistence.Jobs().AddLabels(j.ID, map[string]string{"env": "prod", "service": "billing"}))
+				j, err = persistence.Jobs().Create(req)
+				mocks.Must(t, "could not create job", err)
+				mocks.Must(t, "could not label job", persistence.Jobs().AddLabels(j.ID, map[string]string{"env": "staging"}))
+			},
+			expected:                "*1* - now - *command* by *someone* in *<#123>* - *Running* `env=prod` `service=billing`\n",
+			expectedAuthStrategy:    auth.AuthStrategyAny,
+			expectedChannelStrategy: auth.ChannelStrategyAny,
+		},
+		{
+			name: "test my-jobs command",
+			req: meeseeks.Request{
+				Command: builtins.BuiltinMyJobsCommand,
+				UserID:  "userid",
+			},
+
+			job: meeseeks.Job{
+				Request: meeseeks.Request{Username: "someone", Args: []string{"-limit=1"}},
+			},
+			setup: func() {
+				persistence.Jobs().Create(req)
+				persistence.Jobs().Create(req)
+				persistence.Jobs().Create(meeseeks.Request{
+					Command:     "command",
+					ChannelID:   "123",
+					ChannelLink: "<#123>",
+					Username:    "other",
+				})
+			},
+			expected:                "*2* - now - *command* by *someone* in *<#123>* - *Running*\n_more jobs with_ `-before 2`\n",
+			expectedAuthStrategy:    auth.AuthStrategyAny,
+			expectedChannelStrategy: auth.ChannelStrategyAny,
+		},
+		{
+			name: "test channel-jobs command",
+			req: meeseeks.Request{
+				Command: builtins.BuiltinChannelJobsCommand,
+				UserID:  "userid",
+			},
+
+			job: meeseeks.Job{
+				Request: meeseeks.Request{Username: "someone", ChannelID: "456"},
+			},
+			setup: func() {
+				persistence.Jobs().Create(req)
+				persistence.Jobs().Create(meeseeks.Request{
+					Command:     "command",
+					ChannelID:   "456",
+					ChannelLink: "<#456>",
+					Username:    "other",
+				})
+			},
+			expected:                "*2* - now - *command* by *other* in *<#456>* - *Running*\n",
 			expectedAuthStrategy:    auth.AuthStrategyAny,
 			expectedChannelStrategy: auth.ChannelStrategyAny,
 		},
@@ -254,7 +429,7 @@ func Test_BuiltinCommands(t *testing.T) {
 				persistence.Jobs().Create(req)
 				persistence.Jobs().Create(req)
 			},
-			expected:                "* *ID* 1\n* *Status* Running\n* *Command* command\n* *Args* \"arg1\" \"arg2\" \n* *Where* <#123>\n* *When* now\n",
+			expectedMatch:           "^\\* \\*ID\\* 1\n\\* \\*ULID\\* [0-9A-Z]{26}\n\\* \\*Status\\* Running\n\\* \\*Command\\* command\n\\* \\*Args\\* \"arg1\" \"arg2\" \n\\* \\*Where\\* <#123>\n\\* \\*When\\* now\n$",
 			expectedAuthStrategy:    auth.AuthStrategyAny,
 			expectedChannelStrategy: auth.ChannelStrategyAny,
 		},
@@ -357,15 +532,16 @@ func Test_BuiltinCommands(t *testing.T) {
 								}),
 							}}})
 
-				_, err = persistence.Jobs().Create(
-					meeseeks.Request{
+				_, err = persistence.Audit().Record(meeseeks.AuditEntry{
+					Decision: meeseeks.AuditAccepted,
+					Request: meeseeks.Request{
 						Command: "noop",
 						UserID:  "userid",
-					})
+					}})
 				mocks.Must(t, "do nothing", err)
 
 			},
-			expected:                "*1* - now - *noop* by ** in ** - *Running*\n",
+			expected:                "now - *noop* by ** in **\n",
 			expectedAuthStrategy:    auth.AuthStrategyAllowedGroup,
 			expectedAllowedGroups:   []string{auth.AdminGroup},
 			expectedChannelStrategy: auth.ChannelStrategyAny,
@@ -384,7 +560,7 @@ func Test_BuiltinCommands(t *testing.T) {
 				persistence.Jobs().Create(req)
 				persistence.Jobs().Create(req)
 			},
-			expected:                "* *ID* 1\n* *Status* Running\n* *Command* command\n* *Args* \"arg1\" \"arg2\" \n* *Where* <#123>\n* *When* now\n",
+			expectedMatch:           "^\\* \\*ID\\* 1\n\\* \\*ULID\\* [0-9A-Z]{26}\n\\* \\*Status\\* Running\n\\* \\*Command\\* command\n\\* \\*Args\\* \"arg1\" \"arg2\" \n\\* \\*Where\\* <#123>\n\\* \\*When\\* now\n$",
 			expectedAuthStrategy:    auth.AuthStrategyAllowedGroup,
 			expectedAllowedGroups:   []string{auth.AdminGroup},
 			expectedChannelStrategy: auth.ChannelStrategyAny,
@@ -422,6 +598,7 @@ func Test_BuiltinCommands(t *testing.T) {
 			expected:                "line 1.4",
 			expectedAuthStrategy:    auth.AuthStrategyAny,
 			expectedChannelStrategy: auth.ChannelStrategyAny,
+			expectedNoTimeout:       true,
 		},
 		{
 			name: "test tail command",
@@ -454,6 +631,7 @@ func Test_BuiltinCommands(t *testing.T) {
 			expected:                "line 2.2\nline 2.3",
 			expectedAuthStrategy:    auth.AuthStrategyAny,
 			expectedChannelStrategy: auth.ChannelStrategyAny,
+			expectedNoTimeout:       true,
 		},
 		{
 			name: "test head command",
@@ -538,6 +716,35 @@ func Test_BuiltinCommands(t *testing.T) {
 			expectedAuthStrategy:    auth.AuthStrategyAny,
 			expectedChannelStrategy: auth.ChannelStrategyAny,
 		},
+		{
+			name: "test logs command with timestamps",
+			req: meeseeks.Request{
+				Command: builtins.BuiltinLogsCommand,
+				UserID:  "userid",
+			},
+
+			job: meeseeks.Job{
+				Request: meeseeks.Request{Username: "someone", Args: []string{"-timestamps", "1"}},
+			},
+			setup: func() {
+				j, err := persistence.Jobs().Create(req)
+				mocks.Must(t, "create job", err)
+				w := persistence.LogWriter()
+				w.AppendLine(j.ID, meeseeks.LogLine{
+					Time:   j.StartTime.Add(1500 * time.Millisecond),
+					Stream: meeseeks.StdoutStream,
+					Text:   "something to say",
+				})
+				w.AppendLine(j.ID, meeseeks.LogLine{
+					Time:   j.StartTime.Add(2 * time.Second),
+					Stream: meeseeks.StderrStream,
+					Text:   "something went wrong",
+				})
+			},
+			expected:                "[+1.5s] something to say\n[+2s] (stderr) something went wrong",
+			expectedAuthStrategy:    auth.AuthStrategyAny,
+			expectedChannelStrategy: auth.ChannelStrategyAny,
+		},
 		{
 			name: "test auditlogs command",
 			req: meeseeks.Request{
@@ -593,6 +800,7 @@ func Test_BuiltinCommands(t *testing.T) {
 					"userLink",
 					"channelLink",
 					"something",
+					meeseeks.APITokenScopes{},
 				)
 				mocks.Must(t, "create token", err)
 
@@ -683,7 +891,11 @@ func Test_BuiltinCommands(t *testing.T) {
 				}
 
 				// mocks.AssertEquals(t, cmd.GetCmd(), tc.req.Command)
-				mocks.AssertEquals(t, cmd.GetTimeout(), meeseeks.DefaultCommandTimeout)
+				expectedTimeout := meeseeks.DefaultCommandTimeout
+				if tc.expectedNoTimeout {
+					expectedTimeout = 0
+				}
+				mocks.AssertEquals(t, expectedTimeout, cmd.GetTimeout())
 				mocks.AssertEquals(t, []string{}, cmd.GetAllowedChannels())
 				mocks.AssertEquals(t, []string{}, cmd.GetArgs())
 				mocks.AssertEquals(t, false, cmd.MustRecord())
@@ -723,8 +935,112 @@ func Test_BuiltinCommands(t *testing.T) {
 	}
 }
 
-func Test_FilterJobsAudit(t *testing.T) {
-	mocks.Must(t, "failed to audit the correct jobs", mocks.WithTmpDB(func(_ string) {
+func Test_LastCommand(t *testing.T) {
+	mocks.Must(t, "failed to find the last jobs", mocks.WithTmpDB(func(_ string) {
+		deploy := meeseeks.Request{
+			Command:     "deploy",
+			Channel:     "general",
+			ChannelID:   "123",
+			ChannelLink: "<#123>",
+			Username:    "someoneelse",
+		}
+
+		j1, err := persistence.Jobs().Create(deploy)
+		mocks.Must(t, "could not create job", err)
+		for _, line := range []string{"line1", "line2", "line3"} {
+			mocks.Must(t, "could not append logs", persistence.LogWriter().Append(j1.ID, line))
+		}
+		mocks.Must(t, "could not finish job", persistence.Jobs().Finish(j1.ID, meeseeks.JobSucceededStatus))
+
+		_, err = persistence.Jobs().Create(req)
+		mocks.Must(t, "could not create job", err)
+
+		cmd, ok := commands.Find(&meeseeks.Request{
+			Command: builtins.BuiltinLastCommand,
+			UserID:  "userid",
+		})
+		if !ok {
+			t.Fatalf("could not find command %s", builtins.BuiltinLastCommand)
+		}
+		last := func(args ...string) (string, error) {
+			return cmd.Execute(context.Background(), meeseeks.Job{
+				Request: meeseeks.Request{Username: "someone", Args: args},
+			})
+		}
+
+		out, err := last("command")
+		mocks.Must(t, "failed to get the last job for command", err)
+		mocks.AssertEquals(t, "* *ID* 2\n* *Status* Running\n* *Command* command\n* *Args* \"arg1\" \"arg2\" \n* *Where* <#123>\n* *When* now\n", out)
+
+		_, err = last("deploy")
+		mocks.AssertEquals(t, "no last job for command deploy", err.Error())
+
+		out, err = last("deploy", "-all", "-lines", "2")
+		mocks.Must(t, "failed to get the last job across users", err)
+		mocks.AssertMatches(t,
+			"^\\* \\*ID\\* 1\n\\* \\*Status\\* Succeeded\n\\* \\*Command\\* deploy\n\\* \\*By\\* someoneelse\n"+
+				"\\* \\*Where\\* <#123>\n\\* \\*When\\* now\n\\* \\*Duration\\* .+\n\\* \\*Output\\*\n```\nline2\nline3\n```\n$",
+			out)
+	}))
+}
+
+func TestGroupMembershipLifecycle(t *testing.T) {
+	exec := func(command string, args ...string) (string, error) {
+		r := meeseeks.Request{
+			Command: command,
+			UserID:  "admin_user",
+			Args:    args,
+		}
+		cmd, ok := commands.Find(&r)
+		if !ok {
+			t.Fatalf("could not find command %s", r.Command)
+		}
+		return cmd.Execute(context.Background(), persistence.Jobs().Null(r))
+	}
+
+	mocks.Must(t, "failed to change group memberships", mocks.WithTmpDB(func(_ string) {
+		defer auth.Configure(basicGroups)
+		auth.Configure(map[string][]string{
+			auth.AdminGroup: {"admin_user"},
+			"other":         {"user_one", "user_two"},
+		})
+
+		out, err := exec(builtins.BuiltinGroupAddCommand, "other", "user_three")
+		mocks.Must(t, "could not add user to group", err)
+		mocks.AssertEquals(t, "User *user_three* has been added to group *other*", out)
+
+		out, err = exec(builtins.BuiltinGroupDelCommand, "other", "user_one")
+		mocks.Must(t, "could not remove user from group", err)
+		mocks.AssertEquals(t, "User *user_one* has been removed from group *other*", out)
+
+		_, err = exec(builtins.BuiltinGroupDelCommand, "other", "user_one")
+		mocks.AssertEquals(t, "could not remove user user_one from group other: user does not belong to group", err.Error())
+
+		_, err = exec(builtins.BuiltinGroupDelCommand, auth.AdminGroup, "admin_user")
+		mocks.AssertEquals(t, "could not remove user admin_user from group admin: can't remove the last admin", err.Error())
+
+		_, err = exec(builtins.BuiltinGroupAddCommand, "other")
+		mocks.AssertEquals(t, "a group and a user should be passed as arguments", err.Error())
+
+		mocks.AssertEquals(t, []string{"user_three", "user_two"}, auth.GetGroups()["other"])
+
+		// Reloading the configuration keeps the runtime changes
+		auth.SetGroupStore(persistence.Groups())
+		defer auth.SetGroupStore(nil)
+		mocks.Must(t, "could not configure groups", auth.Configure(map[string][]string{
+			auth.AdminGroup: {"admin_user"},
+			"other":         {"user_one", "user_two"},
+		}))
+		mocks.AssertEquals(t, []string{"user_three", "user_two"}, auth.GetGroups()["other"])
+
+		// And so does syncing the group members
+		mocks.Must(t, "could not set group members", auth.SetGroupMembers("other", []string{"user_one", "user_four"}))
+		mocks.AssertEquals(t, []string{"user_four", "user_three"}, auth.GetGroups()["other"])
+	}))
+}
+
+func Test_FilterAudit(t *testing.T) {
+	mocks.Must(t, "failed to audit the correct entries", mocks.WithTmpDB(func(_ string) {
 		r1 := meeseeks.Request{
 			Command:     "command",
 			Channel:     "general",
@@ -741,13 +1057,42 @@ func Test_FilterJobsAudit(t *testing.T) {
 			Username:    "someoneelse",
 			Args:        []string{"something", "else"},
 		}
+		r3 := meeseeks.Request{
+			Command:     "other",
+			Channel:     "random",
+			ChannelID:   "456",
+			ChannelLink: "<#456>",
+			Username:    "someone",
+		}
 
 		auth.Configure(basicGroups)
-		persistence.Jobs().Create(r1)
-		persistence.Jobs().Create(r2)
-		persistence.Jobs().Create(r1)
-		persistence.Jobs().Create(r1)
-		persistence.Jobs().Create(r2)
+		for _, r := range []meeseeks.Request{r1, r2, r1, r3, r2} {
+			j, err := persistence.Jobs().Create(r)
+			mocks.Must(t, "could not create job", err)
+			_, err = persistence.Audit().Record(meeseeks.AuditEntry{
+				Decision: meeseeks.AuditAccepted, JobID: j.ID, Request: r})
+			mocks.Must(t, "could not record audit entry", err)
+		}
+		persistence.Jobs().Finish(3, meeseeks.JobFailedStatus)
+		_, err := persistence.Audit().Record(meeseeks.AuditEntry{
+			Decision: meeseeks.AuditUnauthorized, Reason: "not allowed", Request: r3})
+		mocks.Must(t, "could not record audit entry", err)
+
+		r4 := meeseeks.Request{
+			Command:     "deploy",
+			Channel:     "ops",
+			ChannelID:   "789",
+			ChannelLink: "<#789>",
+			Username:    "robot",
+		}
+		j, err := persistence.Jobs().Create(r4)
+		mocks.Must(t, "could not create job", err)
+		_, err = persistence.Audit().Record(meeseeks.AuditEntry{
+			Decision: meeseeks.AuditDispatched, JobID: j.ID, Request: r4,
+			Agent: &meeseeks.AuditAgent{ID: "agent-1", Identity: "agent-1.example.com", Token: "builder",
+				Labels: map[string]string{"region": "eu"}},
+		})
+		mocks.Must(t, "could not record audit entry", err)
 
 		cmd, ok := commands.Find(&meeseeks.Request{
 			Command: "audit",
@@ -757,21 +1102,87 @@ func Test_FilterJobsAudit(t *testing.T) {
 			t.Fatalf("could not find command %s", "audit")
 		}
 
-		audit, err := cmd.Execute(context.Background(), meeseeks.Job{
-			Request: meeseeks.Request{Args: []string{"-user", "someone"}},
-		})
-		if err != nil {
-			t.Fatalf("Failed to execute audit: %s", err)
+		tt := []struct {
+			name     string
+			args     []string
+			expected string
+		}{
+			{
+				name: "by user",
+				args: []string{"-user", "someone"},
+				expected: "now - *other* by *someone* in *<#456>* - _unauthorized_\n" +
+					"now - *other* by *someone* in *<#456>* - job *4*\n" +
+					"now - *command* `some thing` by *someone* in *<#123>* - job *3*\n" +
+					"now - *command* `some thing` by *someone* in *<#123>* - job *1*\n",
+			},
+			{
+				name: "by user with limit",
+				args: []string{"-user", "someone", "-limit", "2"},
+				expected: "now - *other* by *someone* in *<#456>* - _unauthorized_\n" +
+					"now - *other* by *someone* in *<#456>* - job *4*\n",
+			},
+			{
+				name: "by command",
+				args: []string{"-command", "other"},
+				expected: "now - *other* by *someone* in *<#456>* - _unauthorized_\n" +
+					"now - *other* by *someone* in *<#456>* - job *4*\n",
+			},
+			{
+				name:     "by decision",
+				args:     []string{"-decision", "unauthorized"},
+				expected: "now - *other* by *someone* in *<#456>* - _unauthorized_\n",
+			},
+			{
+				name: "by channel and user",
+				args: []string{"-channel", "#general", "-user", "someoneelse"},
+				expected: "now - *command* `something else` by *someoneelse* in *<#123>* - job *5*\n" +
+					"now - *command* `something else` by *someoneelse* in *<#123>* - job *2*\n",
+			},
+			{
+				name:     "by job status",
+				args:     []string{"-status", "failed"},
+				expected: "now - *command* `some thing` by *someone* in *<#123>* - job *3*\n",
+			},
+			{
+				name:     "by agent label",
+				args:     []string{"-agent", "region=eu"},
+				expected: "now - *deploy* by *robot* in *<#789>* - job *6* - _dispatched_ to agent *agent-1* (agent-1.example.com)\n",
+			},
+			{
+				name:     "by agent token",
+				args:     []string{"-agent", "builder"},
+				expected: "now - *deploy* by *robot* in *<#789>* - job *6* - _dispatched_ to agent *agent-1* (agent-1.example.com)\n",
+			},
+			{
+				name:     "by unknown agent",
+				args:     []string{"-agent", "region=us"},
+				expected: "No audit entries found\n",
+			},
+			{
+				name:     "in the future",
+				args:     []string{"-since", "2100-01-01"},
+				expected: "No audit entries found\n",
+			},
+			{
+				name:     "in the past",
+				args:     []string{"-until", "1h", "-limit", "10"},
+				expected: "No audit entries found\n",
+			},
+		}
+		for _, tc := range tt {
+			t.Run(tc.name, func(t *testing.T) {
+				out, err := cmd.Execute(context.Background(), meeseeks.Job{
+					Request: meeseeks.Request{Args: tc.args},
+				})
+				mocks.Must(t, "failed to execute audit", err)
+				mocks.AssertEquals(t, tc.expected, out)
+			})
 		}
-		mocks.AssertEquals(t, "*4* - now - *command* by *someone* in *<#123>* - *Running*\n*3* - now - *command* by *someone* in *<#123>* - *Running*\n*1* - now - *command* by *someone* in *<#123>* - *Running*\n", audit)
 
-		limit, err := cmd.Execute(context.Background(), meeseeks.Job{
-			Request: meeseeks.Request{Args: []string{"-user", "someone", "-limit", "2"}},
+		_, err = cmd.Execute(context.Background(), meeseeks.Job{
+			Request: meeseeks.Request{Args: []string{"-since", "yesterday"}},
 		})
-		if err != nil {
-			t.Fatalf("Failed to execute audit: %s", err)
-		}
-		mocks.AssertEquals(t, "*4* - now - *command* by *someone* in *<#123>* - *Running*\n*3* - now - *command* by *someone* in *<#123>* - *Running*\n", limit)
+		mocks.AssertEquals(t, "invalid since value: yesterday is not a duration, a date or an RFC3339 time", err.Error())
 	}))
 }
 
@@ -811,7 +1222,7 @@ func TestAPITokenLifecycle(t *testing.T) {
 			IsIM:    true,
 		})
 		mocks.Must(t, "can't list api tokens:", err)
-		mocks.AssertEquals(t, fmt.Sprintf("- *%s* apiuser at yolo _rm -rf_\n", token), out)
+		mocks.AssertEquals(t, fmt.Sprintf("- *%s* apiuser at yolo _rm -rf_ never used\n", token), out)
 
 		out, err = exec(meeseeks.Request{
 			Command: builtins.BuiltinRevokeAPITokenCommand,
@@ -831,3 +1242,506 @@ func TestAPITokenLifecycle(t *testing.T) {
 		mocks.AssertEquals(t, "No tokens could be found", out)
 	}))
 }
+
+func TestRerunSubmitsTheOriginalCommand(t *testing.T) {
+	mocks.Must(t, "failed to rerun a job", mocks.WithTmpDB(func(_ string) {
+		submitted := make([]meeseeks.Request, 0)
+		rerun := builtins.NewRerunJobCommand(func(r meeseeks.Request) {
+			submitted = append(submitted, r)
+		})
+
+		j, err := persistence.Jobs().Create(req)
+		mocks.Must(t, "create job", err)
+		im, err := persistence.Jobs().Create(meeseeks.Request{
+			Command:  "command",
+			Username: "someone",
+			IsIM:     true,
+		})
+		mocks.Must(t, "create job", err)
+
+		caller := meeseeks.Request{
+			Username:  "someoneelse",
+			UserID:    "someoneelseID",
+			UserLink:  "<@someoneelseID>",
+			Channel:   "random",
+			ChannelID: "456",
+		}
+
+		caller.Args = []string{fmt.Sprintf("%d", j.ID)}
+		out, err := rerun.Execute(context.Background(), meeseeks.Job{Request: caller})
+		mocks.Must(t, "could not rerun job", err)
+		mocks.AssertEquals(t, "Running job 1 again", out)
+		mocks.AssertEquals(t, []meeseeks.Request{{
+			Command:     "command",
+			Args:        []string{"arg1", "arg2"},
+			Username:    "someoneelse",
+			UserID:      "someoneelseID",
+			UserLink:    "<@someoneelseID>",
+			Channel:     "general",
+			ChannelID:   "123",
+			ChannelLink: "<#123>",
+			RerunOf:     j.ID,
+		}}, submitted)
+
+		caller.Args = []string{fmt.Sprintf("%d", im.ID)}
+		_, err = rerun.Execute(context.Background(), meeseeks.Job{Request: caller})
+		mocks.AssertEquals(t, meeseeks.ErrNoJobWithID, err)
+
+		caller.Args = []string{j.ULID}
+		out, err = rerun.Execute(context.Background(), meeseeks.Job{Request: caller})
+		mocks.Must(t, "could not rerun job by ULID", err)
+		mocks.AssertEquals(t, "Running job 1 again", out)
+
+		caller.Args = []string{"10"}
+		_, err = rerun.Execute(context.Background(), meeseeks.Job{Request: caller})
+		mocks.AssertEquals(t, meeseeks.ErrNoJobWithID, err)
+		mocks.AssertEquals(t, 2, len(submitted))
+	}))
+}
+
+func TestTailFollowSendsNewLinesUntilTheJobFinishes(t *testing.T) {
+	formatter.Configure(formatter.FormatConfig{})
+
+	mocks.Must(t, "failed to follow job logs", mocks.WithTmpDB(func(_ string) {
+		replies := make(chan formatter.Reply, 10)
+		builtins.LoadBuiltins(
+			builtins.NewCancelJobCommand(func(_ uint64) {}),
+			builtins.NewKillJobCommand(func(_ uint64) {}),
+			builtins.NewTailCommand(func(r formatter.Reply) {
+				replies <- r
+			}),
+			builtins.NewRerunJobCommand(func(_ meeseeks.Request) {}),
+			builtins.NewApproveCommand(func(_ meeseeks.Request) {}))
+
+		j, err := persistence.Jobs().Create(req)
+		mocks.Must(t, "create job", err)
+
+		w := persistence.LogWriter()
+		w.Append(j.ID, "line 1")
+		w.Append(j.ID, "line 2")
+
+		cmd, ok := commands.Find(&meeseeks.Request{Command: builtins.BuiltinTailCommand})
+		mocks.AssertEquals(t, true, ok)
+
+		type result struct {
+			out string
+			err error
+		}
+		done := make(chan result)
+		go func() {
+			out, err := cmd.Execute(context.Background(), meeseeks.Job{
+				Request: meeseeks.Request{
+					Username: "someone",
+					Args:     []string{"1", "-follow", "-interval", "10ms", "-thread"},
+				},
+			})
+			done <- result{out, err}
+		}()
+
+		first := <-replies
+		out, err := first.Render()
+		mocks.Must(t, "render progress reply", err)
+		mocks.AssertEquals(t, "```\nline 1\nline 2```", out)
+
+		w.Append(j.ID, "line 3")
+		mocks.Must(t, "finish job", persistence.Jobs().Finish(j.ID, meeseeks.JobSucceededStatus))
+
+		r := <-done
+		mocks.Must(t, "tail follow failed", r.err)
+
+		// the last line may be sent as progress if the job was still running when it got read
+		if r.out == "" {
+			last := <-replies
+			out, err = last.Render()
+			mocks.Must(t, "render progress reply", err)
+			mocks.AssertEquals(t, "```\nline 3```", out)
+		} else {
+			mocks.AssertEquals(t, "line 3", r.out)
+		}
+	}))
+}
+
+func TestRolesGiveAccessToTheJobsOfOthers(t *testing.T) {
+	auth.Configure(map[string][]string{
+		"sre":  {"sre_user"},
+		"devs": {"dev_user"},
+	})
+	defer auth.Configure(basicGroups)
+	mocks.Must(t, "configure roles", auth.ConfigureRoles(map[string]auth.Role{
+		"developer": {
+			Groups:      []string{"devs"},
+			Permissions: map[string][]string{auth.AnyCommand: {auth.PermissionViewLogs}},
+		},
+		"sre": {
+			Groups:      []string{"sre"},
+			Inherits:    []string{"developer"},
+			Permissions: map[string][]string{"command": {auth.PermissionRun, auth.PermissionCancel}},
+		},
+	}))
+	defer auth.ConfigureRoles(nil)
+
+	mocks.Must(t, "failed to use roles", mocks.WithTmpDB(func(_ string) {
+		j, err := persistence.Jobs().Create(req)
+		mocks.Must(t, "create job", err)
+		persistence.LogWriter().Append(j.ID, "something to say")
+
+		exec := func(command, username string) (string, error) {
+			r := meeseeks.Request{Command: command, Username: username, Args: []string{fmt.Sprintf("%d", j.ID)}}
+			cmd, ok := commands.Find(&r)
+			if !ok {
+				t.Fatalf("could not find command %s", command)
+			}
+			return cmd.Execute(context.Background(), meeseeks.Job{Request: r})
+		}
+
+		for _, user := range []string{"sre_user", "dev_user"} {
+			out, err := exec(builtins.BuiltinLogsCommand, user)
+			mocks.Must(t, "could not read the logs", err)
+			mocks.AssertEquals(t, "something to say", out)
+		}
+		_, err = exec(builtins.BuiltinLogsCommand, "stranger")
+		mocks.AssertEquals(t, "no job with id 1 for user stranger", err.Error())
+
+		out, err := exec(builtins.BuiltinCancelJobCommand, "sre_user")
+		mocks.Must(t, "could not cancel the job", err)
+		mocks.AssertEquals(t, "Issued command cancellation to job 1", out)
+
+		_, err = exec(builtins.BuiltinCancelJobCommand, "dev_user")
+		mocks.AssertEquals(t, meeseeks.ErrNoJobWithID, err)
+	}))
+}
+
+func TestTemporaryGrants(t *testing.T) {
+	auth.Configure(map[string][]string{
+		auth.AdminGroup: {"admin_user"},
+		"oncall":        {"oncall_user"},
+	})
+	defer auth.Configure(basicGroups)
+	defer auth.ApplyGrants(nil)
+
+	mocks.Must(t, "failed to grant", mocks.WithTmpDB(func(_ string) {
+		exec := func(command string, args ...string) (string, error) {
+			r := meeseeks.Request{Command: command, Username: "admin_user", Args: args}
+			cmd, ok := commands.Find(&r)
+			if !ok {
+				t.Fatalf("could not find command %s", command)
+			}
+			return cmd.Execute(context.Background(), meeseeks.Job{Request: r})
+		}
+		auditCmd, _ := commands.Find(&meeseeks.Request{Command: builtins.BuiltinAuditCommand})
+		oncallCmd := shell.New(meeseeks.CommandOpts{
+			Cmd:           "page",
+			AuthStrategy:  auth.AuthStrategyAllowedGroup,
+			AllowedGroups: []string{"oncall"},
+		})
+		audit := meeseeks.Request{Command: builtins.BuiltinAuditCommand, Username: "someone"}
+		page := meeseeks.Request{Command: "page", Username: "someone"}
+
+		mocks.AssertEquals(t, auth.ErrUserNotAllowed, auth.Check(audit, auditCmd))
+		mocks.AssertEquals(t, auth.ErrUserNotAllowed, auth.Check(page, oncallCmd))
+
+		out, err := exec(builtins.BuiltinGrantCommand, "someone", builtins.BuiltinAuditCommand, "-for", "2h")
+		mocks.Must(t, "could not grant command", err)
+		mocks.AssertEquals(t, "User *someone* can run *audit* for 2h0m0s", out)
+		mocks.AssertEquals(t, nil, auth.Check(audit, auditCmd))
+
+		out, err = exec(builtins.BuiltinGrantCommand, "-for", "50ms", "someone", "oncall")
+		mocks.Must(t, "could not grant group", err)
+		mocks.AssertEquals(t, "User *someone* is in group *oncall* for 50ms", out)
+		mocks.AssertEquals(t, nil, auth.Check(page, oncallCmd))
+		mocks.AssertEquals(t, true, auth.IsKnownUser("someone"))
+
+		out, err = exec(builtins.BuiltinGrantsCommand)
+		mocks.Must(t, "could not list grants", err)
+		mocks.AssertMatches(t, "- \\*someone\\* can run \\*audit\\* until 1 hour from now, granted by admin_user\n"+
+			"- \\*someone\\* is in group \\*oncall\\* until now, granted by admin_user\n", out)
+
+		time.Sleep(100 * time.Millisecond)
+		mocks.AssertEquals(t, auth.ErrUserNotAllowed, auth.Check(page, oncallCmd))
+
+		// The recorded grants survive a reload
+		auth.ApplyGrants(nil)
+		mocks.AssertEquals(t, auth.ErrUserNotAllowed, auth.Check(audit, auditCmd))
+		grants, err := persistence.Grants().List(time.Now())
+		mocks.Must(t, "could not list grants", err)
+		auth.ApplyGrants(grants)
+		mocks.AssertEquals(t, nil, auth.Check(audit, auditCmd))
+
+		_, err = exec(builtins.BuiltinGrantCommand, "someone", "nothing", "-for", "2h")
+		mocks.AssertEquals(t, "there is no command or group nothing", err.Error())
+		_, err = exec(builtins.BuiltinGrantCommand, "someone", "oncall")
+		mocks.AssertEquals(t, "how long the grant lasts should be passed with -for", err.Error())
+	}))
+}
+
+func TestScopedAPITokens(t *testing.T) {
+	exec := func(args ...string) (string, error) {
+		r := meeseeks.Request{
+			Command: builtins.BuiltinNewAPITokenCommand,
+			UserID:  "apiuser",
+			IsIM:    true,
+			Args:    args,
+		}
+		cmd, ok := commands.Find(&r)
+		if !ok {
+			t.Fatalf("could not find command %s", r.Command)
+		}
+		return cmd.Execute(context.Background(), persistence.Jobs().Null(r))
+	}
+
+	mocks.Must(t, "failed to create scoped tokens", mocks.WithTmpDB(func(_ string) {
+		out, err := exec("-commands", "echo,deploy", "-channels", "deploys", "-expires", "720h", "apiuser", "yolo")
+		mocks.Must(t, "can't create a scoped api token:", err)
+
+		token, err := persistence.APITokens().Get(strings.Split(out, " ")[2])
+		mocks.Must(t, "can't get the api token:", err)
+		mocks.AssertEquals(t, "", token.Text)
+		mocks.AssertEquals(t, []string{"echo", "deploy"}, token.Scopes.Commands)
+		mocks.AssertEquals(t, []string{"deploys"}, token.Scopes.Channels)
+		mocks.AssertEquals(t, true, token.Scopes.ExpiresAt.After(time.Now().Add(719*time.Hour)))
+
+		_, err = exec("apiuser", "yolo")
+		mocks.AssertEquals(t, "not enough arguments passed in", err.Error())
+		_, err = exec("-expires", "-1h", "apiuser", "yolo", "echo")
+		mocks.AssertEquals(t, "the token expiration can't be negative", err.Error())
+
+		mocks.Must(t, "can't touch the api token:", persistence.APITokens().Touch(token.TokenID, time.Now()))
+		r := meeseeks.Request{Command: builtins.BuiltinListAPITokenCommand, UserID: "apiuser", IsIM: true}
+		cmd, _ := commands.Find(&r)
+		out, err = cmd.Execute(context.Background(), persistence.Jobs().Null(r))
+		mocks.Must(t, "can't list api tokens:", err)
+		mocks.AssertEquals(t, fmt.Sprintf("- *%s* apiuser at yolo commands echo, deploy channels deploys "+
+			"expires 4 weeks from now last used now\n", token.TokenID), out)
+	}))
+}
+
+func TestAgentTokens(t *testing.T) {
+	exec := func(command string, args ...string) (string, error) {
+		r := meeseeks.Request{Command: command, Username: "admin_user", IsIM: true, Args: args}
+		cmd, ok := commands.Find(&r)
+		if !ok {
+			t.Fatalf("could not find command %s", command)
+		}
+		return cmd.Execute(context.Background(), meeseeks.Job{Request: r})
+	}
+	tokenOf := func(out string) string {
+		parts := strings.Split(out, " ")
+		return parts[len(parts)-1]
+	}
+
+	mocks.Must(t, "failed to manage agent tokens", mocks.WithTmpDB(func(_ string) {
+		out, err := exec(builtins.BuiltinNewAgentTokenCommand, "builder")
+		mocks.Must(t, "could not issue agent token", err)
+		mocks.AssertMatches(t, "^created the token of agent \\*builder\\*, write it to its token file: builder\\.[0-9a-f]{64}$", out)
+		first := tokenOf(out)
+
+		name, err := agenttokens.Verify(first)
+		mocks.Must(t, "could not verify agent token", err)
+		mocks.AssertEquals(t, "builder", name)
+
+		_, err = exec(builtins.BuiltinNewAgentTokenCommand, "builder")
+		mocks.AssertEquals(t, "agent builder already has a token, rotate it instead", err.Error())
+
+		out, err = exec(builtins.BuiltinRotateAgentTokenCommand, "builder")
+		mocks.Must(t, "could not rotate agent token", err)
+		_, err = agenttokens.Verify(first)
+		mocks.AssertEquals(t, agenttokens.ErrInvalidToken, err)
+		name, err = agenttokens.Verify(tokenOf(out))
+		mocks.Must(t, "could not verify rotated agent token", err)
+		mocks.AssertEquals(t, "builder", name)
+
+		out, err = exec(builtins.BuiltinListAgentTokensCommand)
+		mocks.Must(t, "could not list agent tokens", err)
+		mocks.AssertEquals(t, "- *builder* issued by admin_user now\n", out)
+
+		out, err = exec(builtins.BuiltinRevokeAgentTokenCommand, "builder")
+		mocks.Must(t, "could not revoke agent token", err)
+		mocks.AssertEquals(t, "Token of agent *builder* has been revoked", out)
+		_, err = exec(builtins.BuiltinRotateAgentTokenCommand, "builder")
+		mocks.AssertEquals(t, meeseeks.ErrNoAgentToken, err)
+
+		out, err = exec(builtins.BuiltinListAgentTokensCommand)
+		mocks.Must(t, "could not list agent tokens", err)
+		mocks.AssertEquals(t, "No agent tokens could be found", out)
+	}))
+}
+
+func TestAgents(t *testing.T) {
+	exec := func() (string, error) {
+		r := meeseeks.Request{Command: builtins.BuiltinAgentsCommand, Username: "someone"}
+		cmd, ok := commands.Find(&r)
+		if !ok {
+			t.Fatalf("could not find command %s", builtins.BuiltinAgentsCommand)
+		}
+		return cmd.Execute(context.Background(), meeseeks.Job{Request: r})
+	}
+
+	out, err := exec()
+	mocks.Must(t, "could not list agents", err)
+	mocks.AssertEquals(t, "No agents are registered", out)
+
+	registry.Add(registry.Agent{
+		ID:           "agent-1",
+		Identity:     "builder",
+		Labels:       map[string]string{"tier": "web", "region": "eu"},
+		OS:           "linux",
+		Arch:         "amd64",
+		Hostname:     "builder-01",
+		Version:      "1.2.3",
+		Commands:     []string{"deploy", "rollback"},
+		RegisteredAt: time.Now(),
+	})
+	defer registry.Remove("agent-1")
+
+	out, err = exec()
+	mocks.Must(t, "could not list agents", err)
+	mocks.AssertEquals(t, "- *agent-1* on builder-01 (linux/amd64, version 1.2.3) as builder, registered now "+
+		"`region=eu` `tier=web`, runs deploy, rollback\n", out)
+}
+
+func TestRenderTemplate(t *testing.T) {
+	formatter.Configure(formatter.FormatConfig{
+		Templates: map[string]string{
+			template.Success: "{{ .user }} got {{ .output }}",
+		},
+		Commands: map[string]formatter.CommandFormat{
+			builtins.BuiltinVersionCommand: {
+				Templates: map[string]string{
+					template.Failure: "{{ .command }} broke with {{ .error }} in {{ .channel }}: {{ .output }}",
+				},
+			},
+		},
+	})
+	defer formatter.Configure(formatter.FormatConfig{})
+
+	exec := func(args ...string) (string, error) {
+		r := meeseeks.Request{Command: builtins.BuiltinRenderTemplateCommand, Username: "admin_user", Channel: "ops", Args: args}
+		cmd, ok := commands.Find(&r)
+		if !ok {
+			t.Fatalf("could not find command %s", builtins.BuiltinRenderTemplateCommand)
+		}
+		return cmd.Execute(context.Background(), meeseeks.Job{Request: r})
+	}
+
+	mocks.Must(t, "failed to render templates", mocks.WithTmpDB(func(_ string) {
+		tt := []struct {
+			name     string
+			args     []string
+			expected string
+			err      string
+		}{
+			{
+				name:     "success with the sample output",
+				args:     []string{"version", "success"},
+				expected: "admin_user got sample output",
+			},
+			{
+				name:     "failure of the command with an output",
+				args:     []string{"version", "failure", "it", "blew", "up"},
+				expected: "version broke with sample error in ops: it blew up",
+			},
+			{
+				name: "missing arguments",
+				args: []string{"version"},
+				err:  "a command and success or failure should be passed as arguments",
+			},
+			{
+				name: "unknown command",
+				args: []string{"portal-gun", "success"},
+				err:  "there is no command portal-gun",
+			},
+			{
+				name: "unknown template",
+				args: []string{"version", "handshake"},
+				err:  "can't render template handshake, only success or failure",
+			},
+		}
+		for _, tc := range tt {
+			t.Run(tc.name, func(t *testing.T) {
+				out, err := exec(tc.args...)
+				if tc.err != "" {
+					mocks.AssertEquals(t, tc.err, fmt.Sprint(err))
+					return
+				}
+				mocks.Must(t, "could not render the template", err)
+				mocks.AssertEquals(t, tc.expected, out)
+			})
+		}
+	}))
+}
+
+func TestNotifySubscribesTheCaller(t *testing.T) {
+	mocks.Must(t, "failed to notify about a job", mocks.WithTmpDB(func(_ string) {
+		notify := builtins.Commands[builtins.BuiltinNotifyCommand]
+
+		_, err := persistence.Jobs().Create(req)
+		mocks.Must(t, "create job", err)
+		_, err = persistence.Jobs().Create(meeseeks.Request{
+			Command:  "command",
+			Username: "someone",
+			IsIM:     true,
+		})
+		mocks.Must(t, "create job", err)
+		done, err := persistence.Jobs().Create(req)
+		mocks.Must(t, "create job", err)
+		mocks.Must(t, "finish job", persistence.Jobs().Finish(done.ID, meeseeks.JobFailedStatus))
+
+		tt := []struct {
+			name     string
+			args     []string
+			expected string
+			err      string
+		}{
+			{
+				name:     "subscribing",
+				args:     []string{"me", "when", "1", "finishes"},
+				expected: "I'll send you a message when job 1 finishes",
+			},
+			{
+				name:     "subscribing twice",
+				args:     []string{"1"},
+				expected: "You will already be notified when job 1 finishes",
+			},
+			{
+				name:     "unsubscribing",
+				args:     []string{"-off", "1"},
+				expected: "You won't be notified when job 1 finishes",
+			},
+			{
+				name: "unsubscribing twice",
+				args: []string{"-off", "1"},
+				err:  "you were not going to be notified about job 1",
+			},
+			{
+				name: "finished job",
+				args: []string{"me", "when", "3", "finishes"},
+				err:  "job 3 already finished, it's Failed",
+			},
+			{
+				name: "job in a DM of another user",
+				args: []string{"2"},
+				err:  meeseeks.ErrNoJobWithID.Error(),
+			},
+			{
+				name: "no job",
+				args: []string{"me", "when", "finishes"},
+				err:  "no job id passed",
+			},
+		}
+		for _, tc := range tt {
+			t.Run(tc.name, func(t *testing.T) {
+				out, err := notify.Execute(context.Background(), meeseeks.Job{Request: meeseeks.Request{
+					Username: "someoneelse",
+					UserID:   "someoneelseID",
+					Args:     tc.args,
+				}})
+				if tc.err != "" {
+					mocks.AssertEquals(t, tc.err, err.Error())
+					return
+				}
+				mocks.Must(t, "could not notify", err)
+				mocks.AssertEquals(t, tc.expected, out)
+			})
+		}
+	}))
+}
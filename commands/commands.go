@@ -53,6 +53,15 @@ func All() map[string]meeseeks.Command {
 	return c
 }
 
+// KindOf returns the kind of a registered command, or an empty string if the
+// command is not known
+func KindOf(name string) string {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return commands[name].kind
+}
+
 // RegistrationArgs allows to register new commands
 type RegistrationArgs struct {
 	Kind     string
@@ -0,0 +1,219 @@
+package plugins
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/auth"
+	"gitlab.com/yakshaving.art/meeseeks-box/commands"
+	"gitlab.com/yakshaving.art/meeseeks-box/commands/shell"
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+
+	"github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ManifestFlag is the flag plugins are called with to print their manifest
+const ManifestFlag = "--meeseeks-manifest"
+
+// DefaultManifestTimeout is how long a plugin has to print its manifest when
+// no timeout is configured
+const DefaultManifestTimeout = 5 * time.Second
+
+// WASMExtension is the extension of the WebAssembly modules that are loaded as plugins
+const WASMExtension = ".wasm"
+
+// Config is the struct that handles the plugins discovery configuration
+//
+// WASMRuntime is the command used to run WebAssembly modules, as in
+// [wasmtime, run], the module path and the arguments are appended to it.
+// It can't have the arguments that grant filesystem, environment or network
+// access to the module, so only args go in and output and errors come out.
+//
+// The modules don't choose who can run them, they all get the
+// WASMAuthStrategy and WASMAllowedGroups, and nobody can when it's not set
+type Config struct {
+	Path              string        `yaml:"path"`
+	Timeout           time.Duration `yaml:"timeout"`
+	WASMRuntime       []string      `yaml:"wasm_runtime"`
+	WASMAuthStrategy  string        `yaml:"wasm_auth_strategy"`
+	WASMAllowedGroups []string      `yaml:"wasm_allowed_groups"`
+}
+
+// grantingWASMArgs are the arguments of the WASI runtimes that give the module
+// access to the host, --dir=. is checked as --dir and -S inherit-env as -S
+var grantingWASMArgs = map[string]bool{
+	"--dir":               true,
+	"--mapdir":            true,
+	"--env":               true,
+	"--inherit-env":       true,
+	"--inherit-network":   true,
+	"--net":               true,
+	"--tcplisten":         true,
+	"--volume":            true,
+	"--mount":             true,
+	"-S":                  true,
+	"--wasi":              true,
+	"--allow-precompiled": true,
+}
+
+// Validate checks that the WebAssembly runtime grants nothing to the modules
+func (c Config) Validate() error {
+	for _, arg := range c.WASMRuntime {
+		name := strings.SplitN(arg, "=", 2)[0]
+		if grantingWASMArgs[name] || strings.HasPrefix(name, "-S") {
+			return fmt.Errorf("wasm runtime argument %s grants access to the host", arg)
+		}
+	}
+	return nil
+}
+
+// Manifest is the description of the command a plugin provides, it can be
+// printed both in JSON or YAML
+type Manifest struct {
+	Name            string                  `yaml:"name"`
+	Args            []string                `yaml:"args"`
+	AllowedGroups   []string                `yaml:"allowed_groups"`
+	AuthStrategy    string                  `yaml:"auth_strategy"`
+	ChannelStrategy string                  `yaml:"channel_strategy"`
+	AllowedChannels []string                `yaml:"allowed_channels"`
+	DeniedChannels  []string                `yaml:"denied_channels"`
+	RestrictedArgs  map[string][]string     `yaml:"restricted_args"`
+	TimeWindows     meeseeks.TimeWindowOpts `yaml:"time_windows"`
+	NoHandshake     bool                    `yaml:"no_handshake"`
+	Timeout         time.Duration           `yaml:"timeout"`
+	Help            struct {
+		Summary string   `yaml:"summary"`
+		Args    []string `yaml:"args"`
+	} `yaml:"help"`
+	Stream struct {
+		Lines    int           `yaml:"lines"`
+		Interval time.Duration `yaml:"interval"`
+		Edit     bool          `yaml:"edit"`
+	} `yaml:"stream"`
+	Labels  map[string]string `yaml:"labels"`
+	Webhook struct {
+		URL         string        `yaml:"url"`
+		Timeout     time.Duration `yaml:"timeout"`
+		OutputLines int           `yaml:"output_lines"`
+	} `yaml:"webhook"`
+}
+
+// Discover calls every executable in the configured path asking for its
+// manifest and builds the commands to register.
+//
+// Plugins that fail to provide a valid manifest are skipped
+func Discover(cnf Config) ([]commands.CommandRegistration, error) {
+	cmds := make([]commands.CommandRegistration, 0)
+	if cnf.Path == "" {
+		return cmds, nil
+	}
+
+	if err := cnf.Validate(); err != nil {
+		return cmds, err
+	}
+
+	timeout := cnf.Timeout * time.Second
+	if timeout == 0 {
+		timeout = DefaultManifestTimeout
+	}
+
+	files, err := ioutil.ReadDir(cnf.Path)
+	if err != nil {
+		return cmds, fmt.Errorf("could not read plugins path %s: %s", cnf.Path, err)
+	}
+
+	for _, f := range files {
+		path := filepath.Join(cnf.Path, f.Name())
+
+		var cmd string
+		var args []string
+		var wasm bool
+		switch {
+		case f.Mode().IsRegular() && strings.HasSuffix(f.Name(), WASMExtension):
+			if len(cnf.WASMRuntime) == 0 {
+				logrus.Warnf("Skipping WebAssembly plugin %s as there is no runtime configured", path)
+				continue
+			}
+			cmd = cnf.WASMRuntime[0]
+			args = append(append([]string{}, cnf.WASMRuntime[1:]...), path)
+			wasm = true
+
+		case f.Mode().IsRegular() && f.Mode().Perm()&0111 != 0:
+			cmd = path
+
+		default:
+			logrus.Debugf("Skipping %s as it is not an executable file", f.Name())
+			continue
+		}
+
+		m, err := readManifest(cmd, args, timeout)
+		if err != nil {
+			logrus.Errorf("Skipping plugin %s: %s", path, err)
+			continue
+		}
+		if m.Name == "" {
+			m.Name = strings.TrimSuffix(f.Name(), WASMExtension)
+		}
+		if wasm {
+			m.AuthStrategy, m.AllowedGroups = cnf.WASMAuthStrategy, cnf.WASMAllowedGroups
+			if m.AuthStrategy == "" {
+				m.AuthStrategy = auth.AuthStrategyNone
+			}
+		}
+
+		logrus.Infof("Loaded plugin %s as command %s", path, m.Name)
+		cmds = append(cmds, commands.CommandRegistration{
+			Name: m.Name,
+			Cmd: shell.New(meeseeks.CommandOpts{
+				AuthStrategy:    m.AuthStrategy,
+				AllowedGroups:   m.AllowedGroups,
+				ChannelStrategy: m.ChannelStrategy,
+				AllowedChannels: m.AllowedChannels,
+				DeniedChannels:  m.DeniedChannels,
+				RestrictedArgs:  m.RestrictedArgs,
+				TimeWindows:     m.TimeWindows,
+				Args:            append(args, m.Args...),
+				Handshake:       !m.NoHandshake,
+				Cmd:             cmd,
+				Help: meeseeks.NewHelp(
+					m.Help.Summary,
+					m.Help.Args...),
+				Timeout: m.Timeout * time.Second,
+				Stream: meeseeks.StreamOpts{
+					Lines:    m.Stream.Lines,
+					Interval: m.Stream.Interval * time.Second,
+					Edit:     m.Stream.Edit,
+				},
+				Labels: m.Labels,
+				Webhook: meeseeks.WebhookOpts{
+					URL:         m.Webhook.URL,
+					Timeout:     m.Webhook.Timeout * time.Second,
+					OutputLines: m.Webhook.OutputLines,
+				},
+			}),
+		})
+	}
+	return cmds, nil
+}
+
+func readManifest(cmd string, args []string, timeout time.Duration) (Manifest, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, cmd, append(append([]string{}, args...), ManifestFlag)...).Output()
+	if err != nil {
+		return Manifest{}, fmt.Errorf("could not get manifest: %s", err)
+	}
+
+	m := Manifest{}
+	if err := yaml.Unmarshal(out, &m); err != nil {
+		return Manifest{}, fmt.Errorf("could not parse manifest: %s", err)
+	}
+	return m, nil
+}
@@ -0,0 +1,148 @@
+package plugins_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/commands/plugins"
+	"gitlab.com/yakshaving.art/meeseeks-box/mocks"
+)
+
+var pluginScripts = map[string]struct {
+	content string
+	mode    os.FileMode
+}{
+	"json-plugin": {
+		content: `#!/bin/sh
+if [ "$1" = "--meeseeks-manifest" ]; then
+	echo '{"name": "deploy", "auth_strategy": "group", "allowed_groups": ["admin"], "help": {"summary": "deploys things", "args": ["env"]}}'
+fi
+`,
+		mode: 0755,
+	},
+	"yaml-plugin": {
+		content: `#!/bin/sh
+if [ "$1" = "--meeseeks-manifest" ]; then
+	echo 'args: ["-v"]'
+	echo 'no_handshake: true'
+	echo 'timeout: 30'
+fi
+`,
+		mode: 0755,
+	},
+	"broken-plugin": {
+		content: "#!/bin/sh\nexit 1\n",
+		mode:    0755,
+	},
+	"not-a-plugin": {
+		content: "just some text",
+		mode:    0644,
+	},
+}
+
+func TestDiscoverPlugins(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meeseeks-plugins")
+	mocks.Must(t, "could not create plugins dir", err)
+	defer os.RemoveAll(dir)
+
+	for name, script := range pluginScripts {
+		mocks.Must(t, "could not write plugin", ioutil.WriteFile(filepath.Join(dir, name), []byte(script.content), script.mode))
+	}
+
+	cmds, err := plugins.Discover(plugins.Config{Path: dir})
+	mocks.Must(t, "could not discover plugins", err)
+	mocks.AssertEquals(t, 2, len(cmds))
+
+	sort.Slice(cmds, func(i, j int) bool { return cmds[i].Name < cmds[j].Name })
+
+	deploy := cmds[0]
+	mocks.AssertEquals(t, "deploy", deploy.Name)
+	mocks.AssertEquals(t, filepath.Join(dir, "json-plugin"), deploy.Cmd.GetCmd())
+	mocks.AssertEquals(t, "group", deploy.Cmd.GetAuthStrategy())
+	mocks.AssertEquals(t, []string{"admin"}, deploy.Cmd.GetAllowedGroups())
+	mocks.AssertEquals(t, "deploys things", deploy.Cmd.GetHelp().GetSummary())
+	mocks.AssertEquals(t, []string{"env"}, deploy.Cmd.GetHelp().GetArgs())
+	mocks.AssertEquals(t, true, deploy.Cmd.HasHandshake())
+
+	yamlPlugin := cmds[1]
+	mocks.AssertEquals(t, "yaml-plugin", yamlPlugin.Name)
+	mocks.AssertEquals(t, []string{"-v"}, yamlPlugin.Cmd.GetArgs())
+	mocks.AssertEquals(t, false, yamlPlugin.Cmd.HasHandshake())
+}
+
+func TestDiscoverWithoutPathDoesNothing(t *testing.T) {
+	cmds, err := plugins.Discover(plugins.Config{})
+	mocks.Must(t, "could not discover plugins", err)
+	mocks.AssertEquals(t, 0, len(cmds))
+}
+
+func TestDiscoverOnInvalidPathFails(t *testing.T) {
+	_, err := plugins.Discover(plugins.Config{Path: "/nonexisting/path"})
+	mocks.AssertEquals(t, "could not read plugins path /nonexisting/path: open /nonexisting/path: no such file or directory", err.Error())
+}
+
+func TestDiscoverWASMPlugins(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meeseeks-plugins")
+	mocks.Must(t, "could not create plugins dir", err)
+	defer os.RemoveAll(dir)
+
+	// A fake runtime that answers the manifest call with the module name
+	runtime := filepath.Join(dir, "runtime")
+	mocks.Must(t, "could not write runtime", ioutil.WriteFile(runtime, []byte(`#!/bin/sh
+if [ "$3" = "--meeseeks-manifest" ]; then
+	echo "help: {summary: runs $(basename $2)}"
+	echo "auth_strategy: any"
+fi
+`), 0755))
+
+	pluginsDir := filepath.Join(dir, "plugins")
+	mocks.Must(t, "could not create plugins dir", os.Mkdir(pluginsDir, 0755))
+	mocks.Must(t, "could not write module", ioutil.WriteFile(filepath.Join(pluginsDir, "hello.wasm"), []byte("\x00asm"), 0644))
+
+	cmds, err := plugins.Discover(plugins.Config{Path: pluginsDir})
+	mocks.Must(t, "could not discover plugins", err)
+	mocks.AssertEquals(t, 0, len(cmds))
+
+	cmds, err = plugins.Discover(plugins.Config{
+		Path:        pluginsDir,
+		WASMRuntime: []string{runtime, "run"},
+	})
+	mocks.Must(t, "could not discover plugins", err)
+	mocks.AssertEquals(t, 1, len(cmds))
+
+	hello := cmds[0]
+	mocks.AssertEquals(t, "hello", hello.Name)
+	mocks.AssertEquals(t, runtime, hello.Cmd.GetCmd())
+	mocks.AssertEquals(t, []string{"run", filepath.Join(pluginsDir, "hello.wasm")}, hello.Cmd.GetArgs())
+	mocks.AssertEquals(t, "runs hello.wasm", hello.Cmd.GetHelp().GetSummary())
+	mocks.AssertEquals(t, "none", hello.Cmd.GetAuthStrategy())
+
+	cmds, err = plugins.Discover(plugins.Config{
+		Path:              pluginsDir,
+		WASMRuntime:       []string{runtime, "run"},
+		WASMAuthStrategy:  "group",
+		WASMAllowedGroups: []string{"admin"},
+	})
+	mocks.Must(t, "could not discover plugins", err)
+	mocks.AssertEquals(t, "group", cmds[0].Cmd.GetAuthStrategy())
+	mocks.AssertEquals(t, []string{"admin"}, cmds[0].Cmd.GetAllowedGroups())
+}
+
+func TestWASMRuntimesThatGrantAccessAreRejected(t *testing.T) {
+	for _, runtime := range [][]string{
+		{"wasmtime", "run", "--dir=/"},
+		{"wasmtime", "run", "--env", "TOKEN"},
+		{"wasmtime", "run", "-S", "inherit-env"},
+		{"wasmtime", "run", "-Sinherit-network"},
+		{"wasmer", "run", "--mapdir", "/:/"},
+	} {
+		_, err := plugins.Discover(plugins.Config{Path: "/nonexisting/path", WASMRuntime: runtime})
+		mocks.AssertEquals(t, fmt.Sprintf("wasm runtime argument %s grants access to the host", runtime[2]), err.Error())
+	}
+	mocks.Must(t, "could not validate a runtime that grants nothing",
+		plugins.Config{WASMRuntime: []string{"wasmtime", "run", "--fuel", "1000"}}.Validate())
+}
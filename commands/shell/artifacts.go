@@ -0,0 +1,123 @@
+package shell
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/artifacts"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ValidateArtifacts checks that the patterns of the artifacts are valid and
+// stay in the working directory of the job
+func ValidateArtifacts(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid artifacts pattern %s: %s", pattern, err)
+		}
+		clean := filepath.Clean(pattern)
+		if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("invalid artifacts pattern %s, it has to be relative to the working directory of the job", pattern)
+		}
+	}
+	return nil
+}
+
+// collectArtifacts keeps the files the job left in its working directory that
+// match the patterns, the ones that can't be kept are logged and skipped. The
+// jobs that don't get a working directory of their own keep none, as the
+// patterns would match in the one of the Meeseeks
+func collectArtifacts(jobID uint64, dir string, patterns []string) {
+	if len(patterns) == 0 || !artifacts.Enabled() {
+		return
+	}
+	if dir == "" {
+		logrus.Warnf("job %d has no working directory of its own, its artifacts are not kept", jobID)
+		return
+	}
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		logrus.Errorf("could not look for the artifacts of job %d: %s", jobID, err)
+		return
+	}
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(filepath.Join(root, pattern))
+		if err != nil {
+			logrus.Errorf("could not look for the artifacts of job %d: %s", jobID, err)
+			continue
+		}
+		for _, match := range matches {
+			name := filepath.Base(match)
+			content, err := readArtifact(root, match)
+			if err == errNotAFile {
+				continue
+			}
+			if err != nil {
+				logrus.Warnf("skipping artifact %s of job %d: %s", name, jobID, err)
+				continue
+			}
+			if err := artifacts.Save(jobID, name, content); err != nil {
+				logrus.Errorf("could not keep artifact %s of job %d: %s", name, jobID, err)
+			}
+		}
+	}
+}
+
+var errNotAFile = errors.New("not a file")
+
+// readArtifact reads the file the match points to, which has to be a regular
+// file in the working directory. Links are not followed, the job may run as a
+// user that can't read what they point to while the Meeseeks can
+func readArtifact(root, match string) ([]byte, error) {
+	parent, err := filepath.EvalSymlinks(filepath.Dir(match))
+	if err != nil {
+		return nil, err
+	}
+	if rel, err := filepath.Rel(root, parent); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, fmt.Errorf("it is outside the working directory of the job")
+	}
+	path := filepath.Join(parent, filepath.Base(match))
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, errNotAFile
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("it is not a regular file")
+	}
+	if info.Size() > artifacts.MaxSize() {
+		return nil, fmt.Errorf("it is %d bytes, more than the %d allowed", info.Size(), artifacts.MaxSize())
+	}
+
+	f, err := os.OpenFile(path, os.O_RDONLY|noFollow, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// The file could have been replaced since it was checked
+	opened, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !os.SameFile(info, opened) {
+		return nil, fmt.Errorf("it changed while it was read")
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(f, artifacts.MaxSize()+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(content)) > artifacts.MaxSize() {
+		return nil, fmt.Errorf("it is more than the %d bytes allowed", artifacts.MaxSize())
+	}
+	return content, nil
+}
@@ -0,0 +1,9 @@
+//go:build !windows
+// +build !windows
+
+package shell
+
+import "syscall"
+
+// noFollow makes opening a link fail instead of opening what it points to
+const noFollow = syscall.O_NOFOLLOW
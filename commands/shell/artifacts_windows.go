@@ -0,0 +1,8 @@
+//go:build windows
+// +build windows
+
+package shell
+
+// noFollow is not needed on windows, where the artifacts are checked not to
+// be links before they are opened
+const noFollow = 0
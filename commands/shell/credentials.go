@@ -0,0 +1,74 @@
+package shell
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// ValidateRunAs checks that the user and the group a command runs as exist
+func ValidateRunAs(userName, groupName string) error {
+	if userName == "" && groupName == "" {
+		return nil
+	}
+	_, _, err := resolveRunAs(userName, groupName)
+	return err
+}
+
+// resolveRunAs returns the uid and the gid of the user and the group, which
+// can be names or numeric IDs. The group is the primary one of the user when
+// it's not set, and the user is the current one when only the group is
+func resolveRunAs(userName, groupName string) (uint32, uint32, error) {
+	uid, gid := os.Getuid(), os.Getgid()
+	if userName != "" {
+		u, err := lookupUser(userName)
+		if err != nil {
+			return 0, 0, err
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return 0, 0, fmt.Errorf("invalid uid %s of user %s", u.Uid, userName)
+		}
+		if gid, err = strconv.Atoi(u.Gid); err != nil {
+			return 0, 0, fmt.Errorf("invalid gid %s of user %s", u.Gid, userName)
+		}
+	}
+	if groupName != "" {
+		id, err := lookupGroup(groupName)
+		if err != nil {
+			return 0, 0, err
+		}
+		gid = id
+	}
+	return uint32(uid), uint32(gid), nil
+}
+
+func lookupUser(name string) (*user.User, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		if u, err := user.LookupId(name); err == nil {
+			return u, nil
+		}
+		// A numeric user that is not in the passwd file keeps its ID as the gid
+		return &user.User{Uid: name, Gid: name}, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown user %s", name)
+	}
+	return u, nil
+}
+
+func lookupGroup(name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, fmt.Errorf("unknown group %s", name)
+	}
+	id, err := strconv.Atoi(g.Gid)
+	if err != nil {
+		return 0, fmt.Errorf("invalid gid %s of group %s", g.Gid, name)
+	}
+	return id, nil
+}
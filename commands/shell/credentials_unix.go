@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package shell
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// runAs makes the command run with the uid and the gid, without supplementary
+// groups, the Meeseeks needs the privileges to switch to them
+func runAs(cmd *exec.Cmd, uid, gid uint32) error {
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: uid, Gid: gid},
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build windows
+// +build windows
+
+package shell
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// runAs fails on windows, commands can't switch users there
+func runAs(_ *exec.Cmd, _, _ uint32) error {
+	return fmt.Errorf("running commands as another user is not supported on windows")
+}
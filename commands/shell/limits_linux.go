@@ -0,0 +1,146 @@
+//go:build linux
+// +build linux
+
+package shell
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+
+	"github.com/sirupsen/logrus"
+)
+
+// cgroupRoot is the cgroup v2 group the jobs with cpu or memory limits are
+// placed in, each in its own child group that is removed when it finishes
+var cgroupRoot = "/sys/fs/cgroup/meeseeks"
+
+// cpuPeriod is the period of the cpu quota of the jobs, in microseconds
+const cpuPeriod = 100000
+
+// limit sets up the limits of the job before its process is started. The
+// cpu and the memory are limited with a cgroup the process is started in, so
+// it never runs outside of it, and the cpu time with the rlimit the process
+// is started with, so the processes it forks inherit it. The returned func
+// kills what is left in the cgroup and removes it once the process is done
+func limit(cmd *exec.Cmd, jobID uint64, limits meeseeks.ResourceLimits) (func(), error) {
+	if limits.CPUTime > 0 {
+		if err := limitCPUTime(cmd, limits); err != nil {
+			return func() {}, err
+		}
+	}
+	if limits.CPU == 0 && limits.Memory == 0 {
+		return func() {}, nil
+	}
+
+	group, err := createCgroup(jobID, limits)
+	if err != nil {
+		return func() {}, err
+	}
+	dir, err := os.Open(group)
+	if err != nil {
+		removeCgroup(group)
+		return func() {}, fmt.Errorf("could not open cgroup %s: %s", group, err)
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(dir.Fd())
+
+	return func() {
+		dir.Close()
+		removeCgroup(group)
+	}, nil
+}
+
+// removeCgroup kills the processes the job left behind in its cgroup, as a
+// cgroup can't be removed while it has any, and removes it
+func removeCgroup(group string) {
+	if err := writeCgroupFile(group, "cgroup.kill", "1"); err != nil {
+		// Kernels older than 5.14 have no cgroup.kill
+		procs, _ := ioutil.ReadFile(filepath.Join(group, "cgroup.procs"))
+		for _, pid := range strings.Fields(string(procs)) {
+			if p, err := strconv.Atoi(pid); err == nil {
+				syscall.Kill(p, syscall.SIGKILL)
+			}
+		}
+	}
+
+	// The processes take a moment to die after they are killed
+	var err error
+	for i := 0; i < 50; i++ {
+		if err = os.Remove(group); err == nil || os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	logrus.Errorf("could not remove cgroup %s: %s", group, err)
+}
+
+// createCgroup creates the cgroup of the job with its cpu and memory limits
+func createCgroup(jobID uint64, limits meeseeks.ResourceLimits) (string, error) {
+	if err := os.MkdirAll(cgroupRoot, 0755); err != nil {
+		return "", fmt.Errorf("could not create cgroup %s: %s", cgroupRoot, err)
+	}
+	if err := writeCgroupFile(cgroupRoot, "cgroup.subtree_control", "+cpu +memory"); err != nil {
+		return "", err
+	}
+
+	group := filepath.Join(cgroupRoot, fmt.Sprintf("job-%d", jobID))
+	if err := os.Mkdir(group, 0755); err != nil && !os.IsExist(err) {
+		return "", fmt.Errorf("could not create cgroup %s: %s", group, err)
+	}
+	if limits.CPU > 0 {
+		quota := fmt.Sprintf("%d %d", int64(limits.CPU*cpuPeriod), cpuPeriod)
+		if err := writeCgroupFile(group, "cpu.max", quota); err != nil {
+			removeCgroup(group)
+			return "", err
+		}
+	}
+	if limits.Memory > 0 {
+		if err := writeCgroupFile(group, "memory.max", strconv.FormatInt(limits.Memory<<20, 10)); err != nil {
+			removeCgroup(group)
+			return "", err
+		}
+	}
+	return group, nil
+}
+
+func writeCgroupFile(group, name, value string) error {
+	if err := ioutil.WriteFile(filepath.Join(group, name), []byte(value), 0644); err != nil {
+		return fmt.Errorf("could not set %s of cgroup %s: %s", name, group, err)
+	}
+	return nil
+}
+
+// limitCPUTime runs the command through prlimit, which sets the cpu time
+// rlimit, in seconds, and then execs it, so the command never runs without
+// it. The process gets a SIGXCPU when it goes over it and is killed a second
+// later
+func limitCPUTime(cmd *exec.Cmd, limits meeseeks.ResourceLimits) error {
+	if cmd.Err != nil {
+		// The command can't be found, starting it fails with why
+		return nil
+	}
+	prlimit, err := exec.LookPath("prlimit")
+	if err != nil {
+		return fmt.Errorf("could not limit the cpu time: %s", err)
+	}
+	seconds := uint64(limits.GetCPUTime().Seconds())
+	if seconds == 0 {
+		seconds = 1
+	}
+	cmd.Args = append([]string{prlimit, fmt.Sprintf("--cpu=%d:%d", seconds, seconds+1), "--", cmd.Path},
+		cmd.Args[1:]...)
+	cmd.Path = prlimit
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package shell
+
+import (
+	"fmt"
+	"os/exec"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+)
+
+// limit fails on every platform but linux, the jobs of commands with limits
+// can't run
+func limit(_ *exec.Cmd, _ uint64, _ meeseeks.ResourceLimits) (func(), error) {
+	return func() {}, fmt.Errorf("resource limits are only enforced on linux")
+}
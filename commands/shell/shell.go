@@ -6,10 +6,14 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"os"
 	"os/exec"
+	"sync"
 
 	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
 	"gitlab.com/yakshaving.art/meeseeks-box/persistence"
+	"gitlab.com/yakshaving.art/meeseeks-box/secrets/vault"
+	"gitlab.com/yakshaving.art/meeseeks-box/text/ansi"
 	"github.com/sirupsen/logrus"
 )
 
@@ -29,22 +33,22 @@ func (c shellCommand) Execute(ctx context.Context, job meeseeks.Job) (string, er
 	cmdArgs := append(c.GetArgs(), job.Request.Args...)
 	logrus.Debugf("Calling command %s with args %#v", c.GetCmd(), cmdArgs)
 
-	ctx, cancelFunc := context.WithTimeout(ctx, c.GetTimeout())
-	defer cancelFunc()
-
 	outputBuffer := bytes.NewBufferString("")
+	outputLock := sync.Mutex{}
 
 	logW := persistence.LogWriter()
 
-	AppendLogs := func(line string) {
+	AppendLogs := func(stream, line string) {
+		outputLock.Lock()
+		defer outputLock.Unlock()
 
+		line = ansi.Process(c.GetANSI(), line)
 		outputBuffer.WriteString(line)
 		outputBuffer.WriteString("\n")
 
-		if e := logW.Append(job.ID, line); e != nil {
+		if e := logW.AppendLine(job.ID, meeseeks.NewLogLine(stream, line)); e != nil {
 			logrus.Errorf("Could not append '%s' to job %d logs: %s", line, job.ID, e)
 		}
-
 	}
 	SetError := func(err error) error {
 		if e := logW.SetError(job.ID, err); e != nil {
@@ -54,6 +58,44 @@ func (c shellCommand) Execute(ctx context.Context, job meeseeks.Job) (string, er
 	}
 
 	cmd := exec.CommandContext(ctx, c.GetCmd(), cmdArgs...)
+	if len(c.GetSecrets()) > 0 {
+		env, err := secretsEnv(c.GetSecrets())
+		if err != nil {
+			return "", SetError(err)
+		}
+		cmd.Env = append(os.Environ(), env...)
+	}
+	workdir, cleanup, err := createWorkdir(job.ID)
+	if err != nil {
+		return "", SetError(err)
+	}
+	defer cleanup()
+	cmd.Dir = workdir
+
+	if userName, groupName := c.GetUser(); userName != "" || groupName != "" {
+		uid, gid, err := resolveRunAs(userName, groupName)
+		if err != nil {
+			return "", SetError(err)
+		}
+		if err := runAs(cmd, uid, gid); err != nil {
+			return "", SetError(err)
+		}
+		if workdir != "" {
+			if err := os.Chown(workdir, int(uid), int(gid)); err != nil {
+				return "", SetError(fmt.Errorf("could not hand the working directory over to the user of the job: %s", err))
+			}
+		}
+	}
+	if c.GetLimits().Enabled() {
+		// A job is never run without the limits of its command, they are set up
+		// before the pipes so a failure leaves nothing open behind
+		release, err := limit(cmd, job.ID, c.GetLimits())
+		if err != nil {
+			return "", SetError(fmt.Errorf("could not limit the resources of job %d: %s", job.ID, err))
+		}
+		defer release()
+	}
+
 	op, err := cmd.StdoutPipe()
 	if err != nil {
 		return "", SetError(fmt.Errorf("could not create stdout pipe: %s", err))
@@ -63,15 +105,24 @@ func (c shellCommand) Execute(ctx context.Context, job meeseeks.Job) (string, er
 		return "", SetError(fmt.Errorf("could not create stderr pipe: %s", err))
 	}
 
-	tr := io.MultiReader(op, ep)
+	// Buffered, so the scanners are not left waiting when the command fails
+	// to start and nobody waits for them
+	done := make(chan struct{}, 1)
 
-	done := make(chan struct{})
-
-	go func() {
-		s := bufio.NewScanner(tr)
+	// Both streams have to be read whole before waiting for the command
+	scanners := sync.WaitGroup{}
+	scan := func(stream string, r io.Reader) {
+		defer scanners.Done()
+		s := bufio.NewScanner(r)
 		for s.Scan() {
-			AppendLogs(s.Text())
+			AppendLogs(stream, s.Text())
 		}
+	}
+	scanners.Add(2)
+	go scan(meeseeks.StdoutStream, op)
+	go scan(meeseeks.StderrStream, ep)
+	go func() {
+		scanners.Wait()
 		done <- struct{}{}
 	}()
 
@@ -90,6 +141,8 @@ func (c shellCommand) Execute(ctx context.Context, job meeseeks.Job) (string, er
 		// We are finishing because we are actually done
 		err = cmd.Wait()
 	}
+	// Failed jobs keep their artifacts too, like the reports of failed tests
+	collectArtifacts(job.ID, workdir, c.GetArtifacts())
 
 	if err != nil {
 		logrus.Errorf("command failed: %s", err)
@@ -98,3 +151,17 @@ func (c shellCommand) Execute(ctx context.Context, job meeseeks.Job) (string, er
 
 	return outputBuffer.String(), err
 }
+
+// secretsEnv resolves the secrets into environment variables, they are
+// resolved on every run so rotated secrets are picked up
+func secretsEnv(secrets map[string]string) ([]string, error) {
+	env := make([]string, 0, len(secrets))
+	for name, ref := range secrets {
+		value, err := vault.Resolve(ref)
+		if err != nil {
+			return nil, fmt.Errorf("could not resolve secret %s: %s", name, err)
+		}
+		env = append(env, name+"="+value)
+	}
+	return env, nil
+}
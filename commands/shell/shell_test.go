@@ -2,12 +2,22 @@ package shell_test
 
 import (
 	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
 
 	"gitlab.com/yakshaving.art/meeseeks-box/commands/shell"
 	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
 	"gitlab.com/yakshaving.art/meeseeks-box/mocks"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/artifacts"
+	"gitlab.com/yakshaving.art/meeseeks-box/text/ansi"
 )
 
 var echoCommand = shell.New(meeseeks.CommandOpts{
@@ -26,6 +36,12 @@ var sleepCommand = shell.New(meeseeks.CommandOpts{
 	Help: meeseeks.NewHelp("command that sleeps"),
 })
 
+var streamsCommand = shell.New(meeseeks.CommandOpts{
+	Cmd:  "sh",
+	Args: []string{"-c", "echo out; echo err >&2"},
+	Help: meeseeks.NewHelp("command that writes to stdout and stderr"),
+})
+
 func TestShellCommand(t *testing.T) {
 	mocks.AssertEquals(t, "echo", echoCommand.GetCmd())
 	mocks.AssertEquals(t, []string{}, echoCommand.GetArgs())
@@ -59,6 +75,21 @@ func TestExecuteFail(t *testing.T) {
 	})
 }
 
+func TestExecuteWithUnresolvedSecrets(t *testing.T) {
+	mocks.WithTmpDB(func(_ string) {
+		cmd := shell.New(meeseeks.CommandOpts{
+			Cmd:     "env",
+			Secrets: map[string]string{"TOKEN": "vault:secret/data/meeseeks#token"},
+		})
+		_, err := cmd.Execute(context.Background(), meeseeks.Job{
+			ID:      2,
+			Request: meeseeks.Request{},
+		})
+		mocks.AssertEquals(t, "could not resolve secret TOKEN: vault is not configured, "+
+			"can't resolve vault:secret/data/meeseeks#token", err.Error())
+	})
+}
+
 func TestSleepingCanBeWokenUp(t *testing.T) {
 	mocks.WithTmpDB(func(_ string) {
 		ctx, cancel := context.WithCancel(context.Background())
@@ -73,3 +104,267 @@ func TestSleepingCanBeWokenUp(t *testing.T) {
 		mocks.AssertEquals(t, "context canceled", err.Error())
 	})
 }
+
+func TestExecuteKeepsTheStreamOfEachLine(t *testing.T) {
+	mocks.WithTmpDB(func(_ string) {
+		_, err := streamsCommand.Execute(context.Background(), meeseeks.Job{
+			ID:      4,
+			Request: meeseeks.Request{},
+		})
+		mocks.Must(t, "failed to execute command", err)
+
+		jobLog, err := persistence.LogReader().Get(4)
+		mocks.Must(t, "could not read logs", err)
+
+		streams := map[string]string{}
+		for _, line := range jobLog.Lines {
+			streams[line.Text] = line.Stream
+		}
+		mocks.AssertEquals(t, map[string]string{
+			"out": meeseeks.StdoutStream,
+			"err": meeseeks.StderrStream,
+		}, streams)
+	})
+}
+
+func TestExecuteStripsTheEscapeSequences(t *testing.T) {
+	mocks.WithTmpDB(func(_ string) {
+		tt := []struct {
+			name     string
+			mode     string
+			expected string
+		}{
+			{
+				name:     "stripped by default",
+				expected: "Apply complete!\n",
+			},
+			{
+				name:     "emphasis",
+				mode:     ansi.Emphasis,
+				expected: "*Apply complete!*\n",
+			},
+		}
+		for i, tc := range tt {
+			t.Run(tc.name, func(t *testing.T) {
+				cmd := shell.New(meeseeks.CommandOpts{
+					Cmd:  "printf",
+					Args: []string{"\x1b[1;32mApply complete!\x1b[0m\n"},
+					ANSI: tc.mode,
+				})
+				out, err := cmd.Execute(context.Background(), meeseeks.Job{
+					ID:      uint64(10 + i),
+					Request: meeseeks.Request{},
+				})
+				mocks.Must(t, "failed to execute command", err)
+				mocks.AssertEquals(t, tc.expected, out)
+
+				jobLog, err := persistence.LogReader().Get(uint64(10 + i))
+				mocks.Must(t, "could not read logs", err)
+				mocks.AssertEquals(t, strings.TrimSuffix(tc.expected, "\n"), jobLog.Lines[0].Text)
+			})
+		}
+	})
+}
+
+func TestExecuteOverTheCPUTimeLimit(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("resource limits are only enforced on linux")
+	}
+	mocks.WithTmpDB(func(_ string) {
+		cmd := shell.New(meeseeks.CommandOpts{
+			Cmd:    "sh",
+			Args:   []string{"-c", "while :; do :; done"},
+			Limits: meeseeks.ResourceLimits{CPUTime: 1},
+		})
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		_, err := cmd.Execute(ctx, meeseeks.Job{
+			ID:      3,
+			Request: meeseeks.Request{},
+		})
+		mocks.AssertEquals(t, "signal: CPU time limit exceeded", fmt.Sprint(err))
+	})
+}
+
+func TestTheCPUTimeLimitIsSetBeforeTheCommandRuns(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("resource limits are only enforced on linux")
+	}
+	mocks.WithTmpDB(func(_ string) {
+		// The shell forks ulimit right away, before a limit set on the
+		// running process would reach it
+		cmd := shell.New(meeseeks.CommandOpts{
+			Cmd:    "sh",
+			Args:   []string{"-c", "(ulimit -t)"},
+			Limits: meeseeks.ResourceLimits{CPUTime: 5},
+		})
+		out, err := cmd.Execute(context.Background(), meeseeks.Job{
+			ID:      4,
+			Request: meeseeks.Request{},
+		})
+		mocks.Must(t, "could not run the limited command", err)
+		mocks.AssertEquals(t, "5\n", out)
+	})
+}
+
+func TestExecuteAsAnotherUser(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("only root can run commands as another user")
+	}
+	mocks.WithTmpDB(func(_ string) {
+		cmd := shell.New(meeseeks.CommandOpts{
+			Cmd:   "id",
+			Args:  []string{"-u"},
+			User:  "nobody",
+			Group: "65534",
+		})
+		out, err := cmd.Execute(context.Background(), meeseeks.Job{
+			ID:      4,
+			Request: meeseeks.Request{},
+		})
+		mocks.Must(t, "failed to execute id as nobody", err)
+		mocks.AssertEquals(t, "65534\n", out)
+	})
+}
+
+func TestValidateRunAs(t *testing.T) {
+	mocks.Must(t, "no user should be valid", shell.ValidateRunAs("", ""))
+	mocks.Must(t, "a numeric user should be valid", shell.ValidateRunAs("4242", ""))
+	mocks.AssertEquals(t, "unknown user meeseeks-nobody", fmt.Sprint(shell.ValidateRunAs("meeseeks-nobody", "")))
+	mocks.AssertEquals(t, "unknown group meeseeks-nogroup", fmt.Sprint(shell.ValidateRunAs("", "meeseeks-nogroup")))
+}
+
+func TestExecuteInTheWorkdirOfTheJob(t *testing.T) {
+	root, err := ioutil.TempDir("", "meeseeks-workdirs")
+	mocks.Must(t, "failed to create workdirs root", err)
+	defer os.RemoveAll(root)
+
+	cmd := shell.New(meeseeks.CommandOpts{
+		Cmd:  "sh",
+		Args: []string{"-c", "pwd; touch artifact"},
+	})
+	expired := filepath.Join(root, "job-1")
+	mocks.Must(t, "failed to create expired workdir", os.Mkdir(expired, 0700))
+	old := time.Now().Add(-2 * time.Hour)
+	mocks.Must(t, "failed to age expired workdir", os.Chtimes(expired, old, old))
+
+	tt := []struct {
+		name     string
+		workdirs shell.Workdirs
+		jobID    uint64
+		kept     bool
+	}{
+		{
+			name:     "removed when the job is done",
+			workdirs: shell.Workdirs{Enabled: true, Root: root},
+			jobID:    5,
+			kept:     false,
+		},
+		{
+			name:     "kept when the job is done",
+			workdirs: shell.Workdirs{Enabled: true, Root: root, Keep: 3600},
+			jobID:    6,
+			kept:     true,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			mocks.WithTmpDB(func(_ string) {
+				shell.ConfigureWorkdirs(tc.workdirs)
+				defer shell.ConfigureWorkdirs(shell.Workdirs{})
+
+				out, err := cmd.Execute(context.Background(), meeseeks.Job{
+					ID:      tc.jobID,
+					Request: meeseeks.Request{},
+				})
+				mocks.Must(t, "failed to execute command in its workdir", err)
+
+				workdir := strings.TrimSuffix(out, "\n")
+				mocks.AssertMatches(t, fmt.Sprintf("^%s/job-%d-[0-9]+$", regexp.QuoteMeta(root), tc.jobID), workdir)
+
+				_, err = os.Stat(filepath.Join(workdir, "artifact"))
+				mocks.AssertEquals(t, tc.kept, err == nil)
+			})
+		})
+	}
+
+	_, err = os.Stat(expired)
+	mocks.AssertEquals(t, true, os.IsNotExist(err))
+}
+
+func TestExecuteKeepsTheArtifacts(t *testing.T) {
+	root, err := ioutil.TempDir("", "meeseeks-workdirs")
+	mocks.Must(t, "failed to create workdirs root", err)
+	defer os.RemoveAll(root)
+	path, err := ioutil.TempDir("", "meeseeks-artifacts")
+	mocks.Must(t, "failed to create artifacts path", err)
+	defer os.RemoveAll(path)
+
+	shell.ConfigureWorkdirs(shell.Workdirs{Enabled: true, Root: root})
+	defer shell.ConfigureWorkdirs(shell.Workdirs{})
+	mocks.Must(t, "failed to configure artifacts", artifacts.Configure(artifacts.Config{Path: path}))
+	defer artifacts.Configure(artifacts.Config{})
+
+	cmd := shell.New(meeseeks.CommandOpts{
+		Cmd:       "sh",
+		Args:      []string{"-c", "mkdir out; echo passed > out/report.txt; touch notes.md; exit 1"},
+		Artifacts: []string{"out/*.txt", "*.log"},
+	})
+	mocks.WithTmpDB(func(_ string) {
+		_, err := cmd.Execute(context.Background(), meeseeks.Job{
+			ID:      7,
+			Request: meeseeks.Request{},
+		})
+		mocks.AssertEquals(t, "exit status 1", fmt.Sprint(err))
+	})
+	mocks.AssertEquals(t, []string{"report.txt"}, artifacts.Links(7))
+}
+
+func TestExecuteDoesNotFollowArtifactLinks(t *testing.T) {
+	root, err := ioutil.TempDir("", "meeseeks-workdirs")
+	mocks.Must(t, "failed to create workdirs root", err)
+	defer os.RemoveAll(root)
+	path, err := ioutil.TempDir("", "meeseeks-artifacts")
+	mocks.Must(t, "failed to create artifacts path", err)
+	defer os.RemoveAll(path)
+	secrets, err := ioutil.TempDir("", "meeseeks-secrets")
+	mocks.Must(t, "failed to create secrets dir", err)
+	defer os.RemoveAll(secrets)
+	mocks.Must(t, "failed to write secret", ioutil.WriteFile(filepath.Join(secrets, "token.xml"), []byte("secret"), 0600))
+
+	shell.ConfigureWorkdirs(shell.Workdirs{Enabled: true, Root: root})
+	defer shell.ConfigureWorkdirs(shell.Workdirs{})
+	mocks.Must(t, "failed to configure artifacts", artifacts.Configure(artifacts.Config{Path: path}))
+	defer artifacts.Configure(artifacts.Config{})
+
+	cmd := shell.New(meeseeks.CommandOpts{
+		Cmd: "sh",
+		Args: []string{"-c", fmt.Sprintf("echo ok > report.xml; ln -s %s/token.xml leaked.xml; ln -s %s out",
+			secrets, secrets)},
+		Artifacts: []string{"*.xml", "out/*.xml"},
+	})
+	mocks.WithTmpDB(func(_ string) {
+		_, err := cmd.Execute(context.Background(), meeseeks.Job{ID: 8})
+		mocks.Must(t, "failed to execute", err)
+	})
+	mocks.AssertEquals(t, []string{"report.xml"}, artifacts.Links(8))
+}
+
+func TestExecuteKeepsNoArtifactsWithoutAWorkdir(t *testing.T) {
+	path, err := ioutil.TempDir("", "meeseeks-artifacts")
+	mocks.Must(t, "failed to create artifacts path", err)
+	defer os.RemoveAll(path)
+	mocks.Must(t, "failed to configure artifacts", artifacts.Configure(artifacts.Config{Path: path}))
+	defer artifacts.Configure(artifacts.Config{})
+
+	cmd := shell.New(meeseeks.CommandOpts{
+		Cmd:       "true",
+		Artifacts: []string{"*.go"},
+	})
+	mocks.WithTmpDB(func(_ string) {
+		_, err := cmd.Execute(context.Background(), meeseeks.Job{ID: 9})
+		mocks.Must(t, "failed to execute", err)
+	})
+	mocks.AssertEquals(t, []string{}, artifacts.Links(9))
+}
@@ -0,0 +1,153 @@
+package shell
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// workdirPrefix is the prefix of the working directory of each job
+const workdirPrefix = "job-"
+
+// Workdirs configures the working directory each job gets, so the jobs of a
+// command that run at the same time don't share their files. The directories
+// are created in Root, the temp dir when it's not set, and are removed when
+// the job finishes unless Keep is set, then they are kept for that many
+// seconds with whatever the job left in them
+type Workdirs struct {
+	Enabled bool          `yaml:"enabled"`
+	Root    string        `yaml:"root"`
+	Keep    time.Duration `yaml:"keep"`
+}
+
+// Validate checks that the configuration is usable
+func (w Workdirs) Validate() error {
+	if w.Keep < 0 {
+		return fmt.Errorf("job workdirs keep can't be negative")
+	}
+	return nil
+}
+
+// GetRoot returns the directory the working directories are created in
+func (w Workdirs) GetRoot() string {
+	if w.Root == "" {
+		return filepath.Join(os.TempDir(), "meeseeks-jobs")
+	}
+	return w.Root
+}
+
+// GetKeep returns how long the working directories are kept after their job
+// finished
+func (w Workdirs) GetKeep() time.Duration {
+	return w.Keep * time.Second
+}
+
+var workdirs Workdirs
+var workdirsLock sync.Mutex
+
+// running are the working directories of the jobs that are running, they are
+// never removed as expired
+var running = map[string]bool{}
+
+// ConfigureWorkdirs sets up the working directories of the jobs
+func ConfigureWorkdirs(cnf Workdirs) {
+	workdirsLock.Lock()
+	defer workdirsLock.Unlock()
+
+	workdirs = cnf
+}
+
+func workdirsConfig() Workdirs {
+	workdirsLock.Lock()
+	defer workdirsLock.Unlock()
+
+	return workdirs
+}
+
+// createWorkdir creates the working directory of the job and returns it with
+// the func that cleans it up when the job is done, an empty one when the jobs
+// don't get their own directory
+func createWorkdir(jobID uint64) (string, func(), error) {
+	cnf := workdirsConfig()
+	if !cnf.Enabled {
+		return "", func() {}, nil
+	}
+	root := cnf.GetRoot()
+	if cnf.Keep > 0 {
+		removeExpiredWorkdirs(root, cnf.GetKeep(), time.Now())
+	}
+
+	// The users the jobs run as have to get through the root to reach their
+	// own directory, but not list the ones of the other jobs
+	if err := os.MkdirAll(root, 0711); err != nil {
+		return "", func() {}, fmt.Errorf("could not create the root of the working directories: %s", err)
+	}
+	// The suffix keeps the directory of a job from being guessed, or taken
+	// over, before the job gets it
+	dir, err := ioutil.TempDir(root, fmt.Sprintf("%s%d-", workdirPrefix, jobID))
+	if err != nil {
+		return "", func() {}, fmt.Errorf("could not create working directory of job %d: %s", jobID, err)
+	}
+	name := filepath.Base(dir)
+	setRunning(name, true)
+
+	cleanup := func() {
+		defer setRunning(name, false)
+
+		if cnf.Keep > 0 {
+			// The expiration starts when the job is done
+			now := time.Now()
+			os.Chtimes(dir, now, now)
+			return
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			logrus.Errorf("could not remove working directory of job %d: %s", jobID, err)
+		}
+	}
+	return dir, cleanup, nil
+}
+
+func setRunning(name string, on bool) {
+	workdirsLock.Lock()
+	defer workdirsLock.Unlock()
+
+	if on {
+		running[name] = true
+	} else {
+		delete(running, name)
+	}
+}
+
+func isRunning(name string) bool {
+	workdirsLock.Lock()
+	defer workdirsLock.Unlock()
+
+	return running[name]
+}
+
+// removeExpiredWorkdirs removes the working directories that were kept for
+// longer than keep
+func removeExpiredWorkdirs(root string, keep time.Duration, now time.Time) {
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), workdirPrefix) {
+			continue
+		}
+		if isRunning(entry.Name()) || now.Sub(entry.ModTime()) <= keep {
+			continue
+		}
+		logrus.Debugf("removing expired working directory %s", entry.Name())
+		if err := os.RemoveAll(filepath.Join(root, entry.Name())); err != nil {
+			logrus.Errorf("could not remove expired working directory %s: %s", entry.Name(), err)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/commands/plugins"
+	"gitlab.com/yakshaving.art/meeseeks-box/commands/shell"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/db"
+	"gitlab.com/yakshaving.art/meeseeks-box/remote/agent"
+	"gitlab.com/yakshaving.art/meeseeks-box/secrets/vault"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Environment variables that override the agent configuration file, the
+// flags of the agent override them in turn
+const (
+	EnvAgentServers      = "MEESEEKS_AGENT_SERVERS"
+	EnvAgentLabels       = "MEESEEKS_AGENT_LABELS"
+	EnvAgentTokenFile    = "MEESEEKS_AGENT_TOKEN_FILE"
+	EnvAgentSecurityMode = "MEESEEKS_AGENT_SECURITY_MODE"
+	EnvAgentCertPath     = "MEESEEKS_AGENT_CERT_PATH"
+	EnvAgentKeyPath      = "MEESEEKS_AGENT_KEY_PATH"
+	EnvAgentCAPath       = "MEESEEKS_AGENT_CA_PATH"
+)
+
+// AgentConfig is the configuration file of an agent, which has its own shape
+// instead of the one of the server: the servers it registers with, how it
+// connects to them and its labels, along with the commands it runs and what
+// they need, like the database of their jobs
+//
+// Servers are the grpc addresses of the servers, more than one like an HA
+// pair. TLS holds the security mode, insecure, tls or mtls, and the certs it
+// needs, and TokenFile the file with the token the agent registers with.
+// Timeout is the one of the keepalive pings, the dial and the calls to the
+// server that are not set, like agent.Configuration.GRPCTimeout. It and the
+// other durations, like the Heartbeat interval, are in seconds.
+// DiscoverLabels sets where more labels are discovered from when it starts,
+// like the metadata of the cloud instance it runs on
+type AgentConfig struct {
+	Servers        []string          `yaml:"servers"`
+	Labels         map[string]string `yaml:"labels"`
+	DiscoverLabels agent.Discovery   `yaml:"discover_labels"`
+	TokenFile      string            `yaml:"token_file"`
+	TLS            AgentTLS          `yaml:"tls"`
+	Timeout        time.Duration     `yaml:"timeout"`
+	Heartbeat      time.Duration     `yaml:"heartbeat_interval"`
+	BacklogSize    int               `yaml:"backlog_size"`
+	Compression    string            `yaml:"compression"`
+	MaxMessageSize int               `yaml:"max_message_size"`
+
+	KeepaliveTime    time.Duration `yaml:"keepalive_time"`
+	KeepaliveTimeout time.Duration `yaml:"keepalive_timeout"`
+	DialTimeout      time.Duration `yaml:"dial_timeout"`
+	RPCTimeout       time.Duration `yaml:"rpc_timeout"`
+
+	Database     db.DatabaseConfig  `yaml:"database"`
+	Vault        vault.Config       `yaml:"vault"`
+	Commands     map[string]Command `yaml:"commands"`
+	Defaults     CommandDefaults    `yaml:"command_defaults"`
+	CommandsPath string             `yaml:"commands_path"`
+	Plugins      plugins.Config     `yaml:"plugins"`
+	Workdirs     shell.Workdirs     `yaml:"job_workdirs"`
+}
+
+// AgentTLS is how the agent secures its connection to the servers, the cert
+// is the one of the server with tls, and the one of the agent with mtls
+type AgentTLS struct {
+	Mode string `yaml:"mode"`
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	CA   string `yaml:"ca"`
+}
+
+// ReadAgentFile reads the configuration file of an agent, which can be YAML,
+// JSON or TOML like the one of the server
+func ReadAgentFile(filename string) (AgentConfig, error) {
+	a := AgentConfig{
+		Database: defaultConfig().Database,
+	}
+
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return a, fmt.Errorf("could not read agent configuration file %s: %s", filename, err)
+	}
+	b, err = toYAML(b, formatOf(filename))
+	if err != nil {
+		return a, err
+	}
+	b, err = expandConfigEnv(b)
+	if err != nil {
+		return a, err
+	}
+	b, err = expandCommandTemplates(b)
+	if err != nil {
+		return a, err
+	}
+	if err := checkKnownKeys(b, AgentConfig{}); err != nil {
+		return a, fmt.Errorf("agent configuration is invalid: %s", err)
+	}
+	if err := yaml.Unmarshal(b, &a); err != nil {
+		return a, fmt.Errorf("could not parse agent configuration: %s", err)
+	}
+	if _, err := a.Config(); err != nil {
+		return a, fmt.Errorf("agent configuration is invalid: %s", err)
+	}
+	return a, nil
+}
+
+// ReloadAgentFile reads the configuration file of the agent again and loads
+// its commands, like ReloadFile. The servers, the tls and the labels are
+// only read when the agent starts
+func ReloadAgentFile(filename string) (Diff, error) {
+	a, err := ReadAgentFile(filename)
+	if err != nil {
+		return Diff{}, err
+	}
+	cnf, err := a.Config()
+	if err != nil {
+		return Diff{}, err
+	}
+	return reload(cnf)
+}
+
+// Config returns the configuration the commands of the agent are loaded with
+func (a AgentConfig) Config() (Config, error) {
+	c := defaultConfig()
+	c.Database = a.Database
+	c.Vault = a.Vault
+	c.Commands = a.Commands
+	c.Defaults = a.Defaults
+	c.CommandsPath = a.CommandsPath
+	c.Plugins = a.Plugins
+	c.Workdirs = a.Workdirs
+
+	if err := readCommandFiles(&c); err != nil {
+		return c, err
+	}
+	commands := make(map[string]Command, len(c.Commands))
+	for name, cmd := range c.Commands {
+		commands[name] = c.Defaults.apply(cmd)
+	}
+	c.Commands = commands
+
+	if err := validateDatabase(c.Database); err != nil {
+		return c, err
+	}
+	if err := c.Workdirs.Validate(); err != nil {
+		return c, err
+	}
+	if err := c.Vault.Validate(); err != nil {
+		return c, err
+	}
+	if err := validateCommands(c.Commands, c.Vault); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+// ApplyEnv overrides the agent configuration with the environment variables
+// that are set, the labels are added to the ones of the file
+func (a *AgentConfig) ApplyEnv() error {
+	if servers := os.Getenv(EnvAgentServers); servers != "" {
+		a.Servers = strings.Split(servers, ",")
+	}
+	if labels := os.Getenv(EnvAgentLabels); labels != "" {
+		if err := a.AddLabels(labels); err != nil {
+			return fmt.Errorf("%s: %s", EnvAgentLabels, err)
+		}
+	}
+	for env, value := range map[string]*string{
+		EnvAgentTokenFile:    &a.TokenFile,
+		EnvAgentSecurityMode: &a.TLS.Mode,
+		EnvAgentCertPath:     &a.TLS.Cert,
+		EnvAgentKeyPath:      &a.TLS.Key,
+		EnvAgentCAPath:       &a.TLS.CA,
+	} {
+		if v := os.Getenv(env); v != "" {
+			*value = v
+		}
+	}
+	return nil
+}
+
+// AddLabels adds the comma separated labels, like tier=web,region=eu, to
+// the ones of the agent, replacing the ones with the same name
+func (a *AgentConfig) AddLabels(labels string) error {
+	if a.Labels == nil {
+		a.Labels = map[string]string{}
+	}
+	for _, label := range strings.Split(labels, ",") {
+		parts := strings.SplitN(label, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return fmt.Errorf("invalid label %q, it should be name=value", label)
+		}
+		a.Labels[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return nil
+}
+
+// Validate checks that the agent has servers to register with and that it
+// can connect to them as configured
+func (a AgentConfig) Validate() error {
+	if len(a.Servers) == 0 {
+		return fmt.Errorf("the agent has no servers to register with")
+	}
+	for _, server := range a.Servers {
+		if strings.TrimSpace(server) == "" {
+			return fmt.Errorf("invalid empty server in %s", strings.Join(a.Servers, ","))
+		}
+	}
+	if err := a.DiscoverLabels.Validate(); err != nil {
+		return err
+	}
+	cnf := a.Agent()
+	return cnf.Validate()
+}
+
+// Agent returns the configuration the agent connects to the servers with
+func (a AgentConfig) Agent() agent.Configuration {
+	labels := make(map[string]string, len(a.Labels))
+	for name, value := range a.Labels {
+		labels[name] = value
+	}
+	return agent.Configuration{
+		Token:        "null-token",
+		TokenFile:    a.TokenFile,
+		GRPCTimeout:  a.Timeout * time.Second,
+		Labels:       labels,
+		SecurityMode: a.TLS.Mode,
+		CertPath:     a.TLS.Cert,
+		KeyPath:      a.TLS.Key,
+		CAPath:       a.TLS.CA,
+
+		HeartbeatInterval: a.Heartbeat * time.Second,
+		BacklogSize:       a.BacklogSize,
+
+		Compression:    a.Compression,
+		MaxMessageSize: a.MaxMessageSize,
+
+		KeepaliveTime:    a.KeepaliveTime * time.Second,
+		KeepaliveTimeout: a.KeepaliveTimeout * time.Second,
+		DialTimeout:      a.DialTimeout * time.Second,
+		RPCTimeout:       a.RPCTimeout * time.Second,
+	}
+}
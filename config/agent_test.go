@@ -0,0 +1,133 @@
+package config_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/config"
+	"gitlab.com/yakshaving.art/meeseeks-box/mocks"
+
+	"github.com/renstrom/dedent"
+)
+
+func writeAgentFile(t *testing.T, dir, content string) string {
+	filename := filepath.Join(dir, "agent.yml")
+	mocks.Must(t, "failed to write agent configuration", ioutil.WriteFile(filename, []byte(content), 0600))
+	return filename
+}
+
+func TestReadingTheAgentConfigurationFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meeseeks-agent-config")
+	mocks.Must(t, "failed to create temp dir", err)
+	defer os.RemoveAll(dir)
+
+	a, err := config.ReadAgentFile(writeAgentFile(t, dir, dedent.Dedent(`
+		servers: ["meeseeks-1:9697", "meeseeks-2:9697"]
+		labels:
+		  tier: web
+		tls:
+		  mode: insecure
+		heartbeat_interval: 5
+		keepalive_time: 20
+		command_defaults:
+		  timeout: 30
+		commands:
+		  echo:
+		    command: echo
+		    auth_strategy: any
+		`)))
+	mocks.Must(t, "could not read agent configuration", err)
+	mocks.AssertEquals(t, []string{"meeseeks-1:9697", "meeseeks-2:9697"}, a.Servers)
+	mocks.AssertEquals(t, map[string]string{"tier": "web"}, a.Labels)
+	mocks.Must(t, "agent configuration is invalid", a.Validate())
+
+	agentCnf := a.Agent()
+	mocks.AssertEquals(t, 5*time.Second, agentCnf.GetHeartbeatInterval())
+	mocks.AssertEquals(t, 20*time.Second, agentCnf.KeepaliveTime)
+	mocks.AssertEquals(t, "insecure", agentCnf.SecurityMode)
+
+	cnf, err := a.Config()
+	mocks.Must(t, "could not get the configuration of the commands", err)
+	mocks.AssertEquals(t, "meeseeks.db", cnf.Database.Path)
+	mocks.AssertEquals(t, "echo", cnf.Commands["echo"].Cmd)
+	mocks.AssertEquals(t, time.Duration(30), cnf.Commands["echo"].Timeout)
+}
+
+func TestTheAgentConfigurationIsOverriddenByTheEnvironment(t *testing.T) {
+	a := config.AgentConfig{
+		Servers: []string{"meeseeks:9697"},
+		Labels:  map[string]string{"tier": "web", "region": "us"},
+		TLS:     config.AgentTLS{Mode: "tls", Cert: "server.pem"},
+	}
+	os.Setenv(config.EnvAgentServers, "meeseeks-1:9697,meeseeks-2:9697")
+	os.Setenv(config.EnvAgentLabels, "region=eu,zone=a")
+	os.Setenv(config.EnvAgentSecurityMode, "mtls")
+	defer os.Unsetenv(config.EnvAgentServers)
+	defer os.Unsetenv(config.EnvAgentLabels)
+	defer os.Unsetenv(config.EnvAgentSecurityMode)
+
+	mocks.Must(t, "could not apply the environment", a.ApplyEnv())
+	mocks.AssertEquals(t, []string{"meeseeks-1:9697", "meeseeks-2:9697"}, a.Servers)
+	mocks.AssertEquals(t, map[string]string{"tier": "web", "region": "eu", "zone": "a"}, a.Labels)
+	mocks.AssertEquals(t, config.AgentTLS{Mode: "mtls", Cert: "server.pem"}, a.TLS)
+
+	os.Setenv(config.EnvAgentLabels, "region")
+	mocks.AssertEquals(t, `MEESEEKS_AGENT_LABELS: invalid label "region", it should be name=value`, fmt.Sprint(a.ApplyEnv()))
+}
+
+func TestInvalidAgentConfigurations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meeseeks-agent-config")
+	mocks.Must(t, "failed to create temp dir", err)
+	defer os.RemoveAll(dir)
+
+	tt := []struct {
+		name     string
+		content  string
+		expected string
+	}{
+		{
+			name:     "no servers",
+			content:  "labels:\n  tier: web\n",
+			expected: "the agent has no servers to register with",
+		},
+		{
+			name:     "empty server",
+			content:  "servers: [\"meeseeks:9697\", \"\"]\n",
+			expected: "invalid empty server in meeseeks:9697,",
+		},
+		{
+			name:     "unknown security mode",
+			content:  "servers: [\"meeseeks:9697\"]\ntls:\n  mode: plain\n",
+			expected: "invalid security mode plain, it can be insecure, tls or mtls",
+		},
+		{
+			name:     "unknown label source",
+			content:  "servers: [\"meeseeks:9697\"]\ndiscover_labels:\n  sources: [azure]\n",
+			expected: "invalid label source azure, it can be ec2, gce, kubernetes or env",
+		},
+		{
+			name:     "invalid compression",
+			content:  "servers: [\"meeseeks:9697\"]\ncompression: zip\n",
+			expected: "invalid compression zip, it can be none or gzip",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			a, err := config.ReadAgentFile(writeAgentFile(t, dir, tc.content))
+			mocks.Must(t, "could not read agent configuration", err)
+			mocks.AssertEquals(t, tc.expected, fmt.Sprint(a.Validate()))
+		})
+	}
+
+	_, err = config.ReadAgentFile(writeAgentFile(t, dir, "commands:\n  echo:\n    limits:\n      cpu: -1\n"))
+	mocks.AssertEquals(t, "agent configuration is invalid: command echo: resource limits can't be negative", fmt.Sprint(err))
+
+	config.SetStrict(true)
+	defer config.SetStrict(false)
+	_, err = config.ReadAgentFile(writeAgentFile(t, dir, "servers: [\"meeseeks:9697\"]\ngroups:\n  admin: [\"someone\"]\n"))
+	mocks.AssertEquals(t, "agent configuration is invalid: unknown keys groups", fmt.Sprint(err))
+}
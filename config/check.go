@@ -0,0 +1,98 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/auth"
+	"gitlab.com/yakshaving.art/meeseeks-box/text/template"
+)
+
+// Check looks for the mistakes that don't stop a configuration from loading
+// but leave it doing something else than intended, like commands with an auth
+// strategy that doesn't exist, which fall back to none, or templates that
+// don't exist. All the mistakes are returned, sorted to be stable
+func Check(c Config) []error {
+	problems := make([]string, 0)
+
+	problems = append(problems, checkTemplates("format", c.Format.Templates)...)
+	problems = append(problems, checkLocale("format", c.Format.Locale)...)
+	for name, channel := range c.Format.Channels {
+		problems = append(problems, checkTemplates("format of channel "+name, channel.Templates)...)
+		problems = append(problems, checkLocale("format of channel "+name, channel.Locale)...)
+	}
+
+	groups := map[string]bool{auth.AdminGroup: true}
+	for group := range c.Groups {
+		groups[group] = true
+	}
+	for group := range c.LDAP.Groups {
+		groups[group] = true
+	}
+
+	for name, cmd := range c.Commands {
+		if cmd.Cmd == "" {
+			problems = append(problems, fmt.Sprintf("command %s: it has no command to run", name))
+		}
+		problems = append(problems, checkTemplates("command "+name, cmd.Templates)...)
+
+		switch {
+		case cmd.AuthStrategy != "" && !auth.ValidAuthStrategy(cmd.AuthStrategy):
+			problems = append(problems, fmt.Sprintf("command %s: invalid auth strategy %s", name, cmd.AuthStrategy))
+		case cmd.AuthStrategy == auth.AuthStrategyAllowedGroup && len(cmd.AllowedGroups) == 0:
+			problems = append(problems, fmt.Sprintf("command %s: the group auth strategy needs allowed_groups", name))
+		case cmd.AuthStrategy == auth.AuthStrategyRole && len(c.Roles) == 0:
+			problems = append(problems, fmt.Sprintf("command %s: the role auth strategy needs roles", name))
+		case cmd.AuthStrategy == auth.AuthStrategyExternal && !c.ExternalAuth.Enabled():
+			problems = append(problems, fmt.Sprintf("command %s: the external auth strategy needs external_auth", name))
+		case cmd.AuthStrategy == auth.AuthStrategyOPA && !c.OPA.Enabled():
+			problems = append(problems, fmt.Sprintf("command %s: the opa auth strategy needs opa", name))
+		}
+		for _, group := range cmd.AllowedGroups {
+			if !groups[group] {
+				problems = append(problems, fmt.Sprintf("command %s: unknown allowed group %s", name, group))
+			}
+		}
+
+		switch {
+		case cmd.ChannelStrategy != "" && !auth.ValidChannelStrategy(cmd.ChannelStrategy):
+			problems = append(problems, fmt.Sprintf("command %s: invalid channel strategy %s", name, cmd.ChannelStrategy))
+		case cmd.ChannelStrategy == auth.ChannelStrategyAllowedChannels && len(cmd.AllowedChannels) == 0:
+			problems = append(problems, fmt.Sprintf("command %s: the channel strategy needs allowed_channels", name))
+		}
+
+		if cmd.Approval.Group != "" && !groups[cmd.Approval.Group] {
+			problems = append(problems, fmt.Sprintf("command %s: unknown approval group %s", name, cmd.Approval.Group))
+		}
+	}
+
+	sort.Strings(problems)
+	errs := make([]error, 0, len(problems))
+	for _, p := range problems {
+		errs = append(errs, fmt.Errorf("%s", p))
+	}
+	return errs
+}
+
+// checkLocale looks for a locale without translations, which falls back to
+// the English messages
+func checkLocale(prefix, locale string) []string {
+	if locale == "" || template.KnownLocale(locale) {
+		return nil
+	}
+	return []string{fmt.Sprintf("%s: unknown locale %s, the messages are in %s", prefix, locale,
+		template.DefaultLocale)}
+}
+
+// checkTemplates looks for the templates that don't exist, the ones that
+// don't parse don't load
+func checkTemplates(prefix string, templates map[string]string) []string {
+	problems := make([]string, 0)
+	defaults := template.GetDefaultTemplates()
+	for name := range templates {
+		if _, ok := defaults[name]; !ok {
+			problems = append(problems, fmt.Sprintf("%s: unknown template %s", prefix, name))
+		}
+	}
+	return problems
+}
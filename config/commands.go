@@ -0,0 +1,71 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// commandFile is a command defined in its own file, named after the file
+// unless it sets a name
+type commandFile struct {
+	Name    string `yaml:"name"`
+	Command `yaml:",inline"`
+}
+
+// readCommandFiles adds the commands defined in the yaml, json or toml files
+// of the commands path to the configuration, their source is the file they
+// are defined in unless they set one
+func readCommandFiles(c *Config) error {
+	if c.CommandsPath == "" {
+		return nil
+	}
+	files, err := ioutil.ReadDir(c.CommandsPath)
+	if err != nil {
+		return fmt.Errorf("could not read commands path %s: %s", c.CommandsPath, err)
+	}
+
+	if c.Commands == nil {
+		c.Commands = make(map[string]Command)
+	}
+	for _, f := range files {
+		if !isFragment(f) {
+			continue
+		}
+		filename := filepath.Join(c.CommandsPath, f.Name())
+		b, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return fmt.Errorf("could not read command file %s: %s", filename, err)
+		}
+		b, err = toYAML(b, formatOf(filename))
+		if err != nil {
+			return fmt.Errorf("command file %s: %s", filename, err)
+		}
+		b, err = expandConfigEnv(b)
+		if err != nil {
+			return fmt.Errorf("command file %s: %s", filename, err)
+		}
+		if err := checkKnownKeys(b, commandFile{}); err != nil {
+			return fmt.Errorf("command file %s: %s", filename, err)
+		}
+
+		cmd := commandFile{}
+		if err := yaml.Unmarshal(b, &cmd); err != nil {
+			return fmt.Errorf("could not parse command file %s: %s", filename, err)
+		}
+		if cmd.Name == "" {
+			cmd.Name = strings.TrimSuffix(f.Name(), filepath.Ext(f.Name()))
+		}
+		if _, ok := c.Commands[cmd.Name]; ok {
+			return fmt.Errorf("command %s of %s is already defined", cmd.Name, filename)
+		}
+		if cmd.Source == "" {
+			cmd.Source = filename
+		}
+		c.Commands[cmd.Name] = cmd.Command
+	}
+	return nil
+}
@@ -4,39 +4,105 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/url"
 	"os"
+	"regexp"
+	"sort"
+	"sync"
 	"time"
 
 	"gitlab.com/yakshaving.art/meeseeks-box/commands"
+	"gitlab.com/yakshaving.art/meeseeks-box/commands/plugins"
 	"gitlab.com/yakshaving.art/meeseeks-box/commands/shell"
 	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks/grafana"
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks/reports"
 
 	"gitlab.com/yakshaving.art/meeseeks-box/auth"
+	"gitlab.com/yakshaving.art/meeseeks-box/auth/alerts"
+	"gitlab.com/yakshaving.art/meeseeks-box/auth/approvals"
+	"gitlab.com/yakshaving.art/meeseeks-box/auth/breakglass"
+	"gitlab.com/yakshaving.art/meeseeks-box/auth/ldap"
+	"gitlab.com/yakshaving.art/meeseeks-box/auth/oidc"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/artifacts"
 	"gitlab.com/yakshaving.art/meeseeks-box/persistence/db"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/audit"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/logs/archive"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/logs/limit"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/redis"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/retention"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/sqldb"
+	"gitlab.com/yakshaving.art/meeseeks-box/remote/server"
+	"gitlab.com/yakshaving.art/meeseeks-box/secrets/vault"
+	"gitlab.com/yakshaving.art/meeseeks-box/text/ansi"
 	"gitlab.com/yakshaving.art/meeseeks-box/text/formatter"
+	"gitlab.com/yakshaving.art/meeseeks-box/text/template"
+	"gitlab.com/yakshaving.art/meeseeks-box/webhooks"
 
+	"github.com/sirupsen/logrus"
 	yaml "gopkg.in/yaml.v2"
 )
 
-// ReadFile reads the given filename and returns a configuration object
+// ReadFile reads the given filename and returns a configuration object, the
+// filename can also be a directory of fragments or a key in consul or etcd.
+// The file can be YAML, JSON or TOML, by its extension or its content
 func ReadFile(filename string) (Config, error) {
+	source, err := NewSource(filename)
+	if err != nil {
+		return Config{}, err
+	}
+	if source != nil {
+		return readSource(filename, source)
+	}
+
+	if info, err := os.Stat(filename); err == nil && info.IsDir() {
+		return ReadDir(filename)
+	}
+
 	f, err := os.Open(filename)
 	if err != nil {
 		return Config{}, fmt.Errorf("could not open configuration file %s: %s", filename, err)
 	}
 
-	cnf, err := New(f)
+	cnf, err := NewFormat(f, formatOf(filename))
 	if err != nil {
 		return cnf, fmt.Errorf("configuration is invalid: %s", err)
 	}
 	return cnf, nil
 }
 
+// DriverBolt is the default database driver, an embedded BoltDB file
+const DriverBolt = "bolt"
+
 // LoadConfiguration loads the configuration in all the dependent subsystems
 func LoadConfiguration(cnf Config) error {
-	if err := db.Configure(cnf.Database); err != nil {
+	if err := vault.Configure(cnf.Vault); err != nil {
+		return fmt.Errorf("could not configure vault: %s", err)
+	}
+	dsn, err := vault.Resolve(cnf.Database.DSN)
+	if err != nil {
+		return fmt.Errorf("could not resolve database dsn: %s", err)
+	}
+	cnf.Database.DSN = dsn
+
+	if err := configureDatabase(cnf.Database); err != nil {
 		return fmt.Errorf("could not configure database: %s", err)
 	}
+	if err := configureLimits(cnf.Output, cnf.Archive.Enabled()); err != nil {
+		return fmt.Errorf("could not configure output limits: %s", err)
+	}
+	if err := configureArchive(cnf.Archive); err != nil {
+		return fmt.Errorf("could not configure logs archive: %s", err)
+	}
+	if err := configureAudit(cnf.Audit); err != nil {
+		return fmt.Errorf("could not configure audit sinks: %s", err)
+	}
+	retention.Configure(cnf.Retention)
+	if err := artifacts.Configure(cnf.Artifacts); err != nil {
+		return err
+	}
+	shell.ConfigureWorkdirs(cnf.Workdirs)
 
 	cmds := make([]commands.CommandRegistration, 0)
 	for name, cmd := range cnf.Commands {
@@ -47,6 +113,9 @@ func LoadConfiguration(cnf Config) error {
 				AllowedGroups:   cmd.AllowedGroups,
 				ChannelStrategy: cmd.ChannelStrategy,
 				AllowedChannels: cmd.AllowedChannels,
+				DeniedChannels:  cmd.DeniedChannels,
+				RestrictedArgs:  cmd.RestrictedArgs,
+				TimeWindows:     cmd.TimeWindows,
 				Args:            cmd.Args,
 				Handshake:       !cmd.NoHandshake,
 				Cmd:             cmd.Cmd,
@@ -54,9 +123,46 @@ func LoadConfiguration(cnf Config) error {
 					cmd.Help.Summary,
 					cmd.Help.Args...),
 				Timeout: cmd.Timeout * time.Second,
+				Stream: meeseeks.StreamOpts{
+					Lines:    cmd.Stream.Lines,
+					Interval: cmd.Stream.Interval * time.Second,
+					Edit:     cmd.Stream.Edit,
+				},
+				Labels: cmd.Labels,
+				Webhook: meeseeks.WebhookOpts{
+					URL:         cmd.Webhook.URL,
+					Timeout:     cmd.Webhook.Timeout * time.Second,
+					OutputLines: cmd.Webhook.OutputLines,
+				},
+				Notify: meeseeks.NotifyOpts{
+					Caller: cmd.Notify.Caller,
+					After:  cmd.Notify.After * time.Second,
+				},
+				Secrets:   cmd.Secrets,
+				Approval:  cmd.Approval,
+				Owner:     cmd.Owner,
+				Source:    cmd.Source,
+				ANSI:      cmd.ANSI,
+				Limits:    cmd.Limits,
+				User:      cmd.User,
+				Group:     cmd.Group,
+				Artifacts: cmd.Artifacts,
 			}),
 		})
 	}
+
+	pluginCmds, err := plugins.Discover(cnf.Plugins)
+	if err != nil {
+		return fmt.Errorf("could not discover plugins: %s", err)
+	}
+	for _, plugin := range pluginCmds {
+		if _, ok := cnf.Commands[plugin.Name]; ok {
+			logrus.Warnf("Plugin command %s is shadowed by a configured command", plugin.Name)
+			continue
+		}
+		cmds = append(cmds, plugin)
+	}
+
 	if err := commands.Register(commands.RegistrationArgs{
 		Kind:     commands.KindLocalCommand,
 		Action:   commands.ActionRegister,
@@ -65,15 +171,415 @@ func LoadConfiguration(cnf Config) error {
 		return fmt.Errorf("could not load commands: %s", err)
 	}
 
-	auth.Configure(cnf.Groups)
-	formatter.Configure(cnf.Format)
+	auth.SetGroupStore(persistence.Groups())
+	if err := auth.Configure(cnf.Groups); err != nil {
+		return err
+	}
+	auth.SetGrantStore(persistence.Grants(), auth.DefaultGrantsTTL)
+	grants, err := persistence.Grants().List(time.Now())
+	if err != nil {
+		return fmt.Errorf("could not load grants: %s", err)
+	}
+	auth.ApplyGrants(grants)
+	ldap.Configure(cnf.LDAP)
+	oidc.Configure(cnf.OIDC)
+	alerts.Configure(cnf.Alerts)
+	grafana.Configure(cnf.Grafana)
+	if err := reports.Configure(cnf.ErrorReports); err != nil {
+		return err
+	}
+	breakglass.Configure(cnf.BreakGlass)
+	if err := auth.ConfigureExternal(cnf.ExternalAuth); err != nil {
+		return err
+	}
+	if err := auth.ConfigureOPA(cnf.OPA); err != nil {
+		return err
+	}
+	if err := webhooks.Configure(cnf.Webhooks); err != nil {
+		return err
+	}
+	if err := webhooks.ConfigureMappings(cnf.WebhookMappings); err != nil {
+		return err
+	}
+	if err := webhooks.ConfigureAlertmanager(cnf.Alertmanager); err != nil {
+		return err
+	}
+	server.ConfigurePolicies(cnf.Agents)
+	server.ConfigureRoutes(cnf.AgentRoutes)
+	server.ConfigureDispatch(cnf.Dispatch)
+	server.ConfigureCanaries(cnf.Canaries)
+	server.ConfigureConflicts(cnf.Conflicts)
+	server.ConfigureHeartbeats(cnf.Heartbeats)
+	if err := auth.ConfigureRoles(cnf.Roles); err != nil {
+		return fmt.Errorf("could not configure roles: %s", err)
+	}
+
+	format := cnf.Format
+	format.Commands = make(map[string]formatter.CommandFormat)
+	for name, cmd := range cnf.Commands {
+		if len(cmd.Templates) > 0 || len(cmd.ReplyStyle) > 0 || cmd.Colors != (formatter.MessageColors{}) || cmd.Language != "" {
+			format.Commands[name] = formatter.CommandFormat{
+				Templates:  cmd.Templates,
+				ReplyStyle: cmd.ReplyStyle,
+				Colors:     cmd.Colors,
+				Language:   cmd.Language,
+			}
+		}
+	}
+	formatter.Configure(format)
+
+	reloadMutex.Lock()
+	reloadChannel = cnf.Reload.ChannelID
+	loaded = cnf
+	reloadMutex.Unlock()
 
 	return nil
 }
 
-// New parses the configuration from a reader into an object and returns it
+var reloadChannel string
+var loaded Config
+var reloadMutex sync.Mutex
+
+// ReloadFile reads the configuration file again and loads it, returning what
+// changed from the configuration that was loaded before. The previous
+// configuration is kept when the file can't be read or is invalid
+func ReloadFile(filename string) (Diff, error) {
+	cnf, err := ReadFile(filename)
+	if err != nil {
+		return Diff{}, err
+	}
+	return reload(cnf)
+}
+
+func reload(cnf Config) (Diff, error) {
+	reloadMutex.Lock()
+	previous := loaded
+	reloadMutex.Unlock()
+
+	if err := LoadConfiguration(cnf); err != nil {
+		return Diff{}, err
+	}
+	return Compare(previous, cnf), nil
+}
+
+// ReloadChannel returns the channel the outcome of a reload is reported to,
+// the one of the configuration that was last loaded
+func ReloadChannel() string {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	return reloadChannel
+}
+
+var sqlStore *sqldb.Store
+var sqlStoreConfig db.DatabaseConfig
+
+// configureDatabase registers the services of the configured database. The
+// SQL store that is open is kept when its driver and dsn didn't change,
+// otherwise the new database is registered before the previous store is
+// closed, so the services never point to a closed one
+func configureDatabase(cnf db.DatabaseConfig) error {
+	previous := sqlStore
+
+	switch cnf.Driver {
+	case "", DriverBolt:
+		if err := db.Configure(cnf); err != nil {
+			return err
+		}
+		sqlStore = nil
+		if previous != nil {
+			persistence.Register(persistence.BoltProviders())
+			previous.Close()
+		}
+		return nil
+	}
+
+	if previous != nil && sqlStoreConfig.Driver == cnf.Driver && sqlStoreConfig.DSN == cnf.DSN {
+		return nil
+	}
+	store, err := sqldb.Open(cnf.Driver, cnf.DSN)
+	if err != nil {
+		return err
+	}
+	sqlStore, sqlStoreConfig = store, cnf
+
+	persistence.Register(persistence.Providers{
+		Aliases:     store.Aliases(),
+		Jobs:        store.Jobs(),
+		APITokens:   store.APITokens(),
+		Audit:       store.Audit(),
+		Groups:      store.Groups(),
+		LogReader:   store.LogReader(),
+		LogWriter:   store.LogWriter(),
+		Locker:      store.Locker(),
+		Identities:  store.Identities(),
+		Grants:      store.Grants(),
+		AgentTokens: store.AgentTokens(),
+		Approvals:   store.Approvals(),
+	})
+	if previous != nil {
+		previous.Close()
+	}
+	return nil
+}
+
+// outputLimiter is the limiter the jobs write their output through, it's kept
+// for as long as the process runs once the output is limited
+var outputLimiter *limit.Limiter
+
+// configureLimits wraps the jobs and log services so the output of each job is
+// capped. The limiter is kept on reloads and only its caps change, as the jobs
+// that are running write through the one they started with. The archiver goes
+// on top, so when logs are archived the limiter spools them to have them whole
+func configureLimits(cnf limit.Config, spool bool) error {
+	jobs := limit.Unwrap(archive.Unwrap(persistence.Jobs()))
+	reader := limit.UnwrapReader(archive.UnwrapReader(persistence.LogReader()))
+	writer := limit.UnwrapWriter(persistence.LogWriter())
+
+	limit.Configure(cnf)
+	switch {
+	case outputLimiter != nil:
+		outputLimiter.Reconfigure(cnf, spool, jobs, reader, writer)
+	case cnf.Enabled():
+		outputLimiter = limit.New(cnf, spool, jobs, reader, writer)
+	}
+	if outputLimiter != nil {
+		jobs, reader, writer = outputLimiter.Jobs(), outputLimiter.LogReader(), outputLimiter.LogWriter()
+	}
+
+	persistence.Register(persistence.Providers{
+		Jobs:      jobs,
+		LogReader: reader,
+		LogWriter: writer,
+	})
+	return nil
+}
+
+// configureArchive wraps the jobs and log reader services so logs are archived
+// when jobs finish, any previous archiver is dropped first
+func configureArchive(cnf archive.Config) error {
+	jobs := archive.Unwrap(persistence.Jobs())
+	reader := archive.UnwrapReader(persistence.LogReader())
+
+	if cnf.Enabled() {
+		store, err := archive.NewBucketStore(cnf)
+		if err != nil {
+			return err
+		}
+		archiver, err := archive.New(store, cnf.KeyLayout, jobs, reader, persistence.LogWriter())
+		if err != nil {
+			return err
+		}
+		jobs, reader = archiver.Jobs(), archiver.LogReader()
+	}
+
+	persistence.Register(persistence.Providers{
+		Jobs:      jobs,
+		LogReader: reader,
+	})
+	return nil
+}
+
+var auditSinks []audit.Sink
+
+// configureAudit adds the configured sinks to the audit log, closing the
+// ones from a previous configuration
+func configureAudit(cnf audit.Config) error {
+	for _, sink := range auditSinks {
+		sink.Close()
+	}
+	auditSinks = nil
+	log := audit.Unwrap(persistence.Audit())
+
+	sinks, err := audit.NewSinks(cnf)
+	if err != nil {
+		return err
+	}
+	if len(sinks) > 0 {
+		auditSinks = sinks
+		log = audit.WithSinks(log, sinks...)
+	}
+
+	persistence.Register(persistence.Providers{
+		Audit: log,
+	})
+	return nil
+}
+
+// New parses the configuration from a reader into an object and returns it,
+// the format is detected from the content
 func New(r io.Reader) (Config, error) {
-	c := Config{
+	return NewFormat(r, "")
+}
+
+// NewFormat parses the configuration in the format, which is detected from
+// the content when it's empty, into an object and returns it
+func NewFormat(r io.Reader, format string) (Config, error) {
+	c := defaultConfig()
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return c, fmt.Errorf("could not read configuration: %s", err)
+	}
+
+	b, err = toYAML(b, format)
+	if err != nil {
+		return c, err
+	}
+	b, err = expandConfigEnv(b)
+	if err != nil {
+		return c, err
+	}
+	b, err = upgradeConfig(b)
+	if err != nil {
+		return c, err
+	}
+	b, err = expandCommandTemplates(b)
+	if err != nil {
+		return c, err
+	}
+	if err := checkKnownKeys(b, Config{}); err != nil {
+		return c, err
+	}
+
+	err = yaml.Unmarshal(b, &c)
+	if err != nil {
+		return c, fmt.Errorf("could not parse configuration: %s", err)
+	}
+	if err := readCommandFiles(&c); err != nil {
+		return c, err
+	}
+	for name, cmd := range c.Commands {
+		c.Commands[name] = c.Defaults.apply(cmd)
+	}
+
+	if err := validateDatabase(c.Database); err != nil {
+		return c, err
+	}
+	if err := c.Archive.Validate(); err != nil {
+		return c, err
+	}
+	if err := c.Workdirs.Validate(); err != nil {
+		return c, err
+	}
+	if err := c.Artifacts.Validate(); err != nil {
+		return c, err
+	}
+	if err := c.Retention.Validate(); err != nil {
+		return c, err
+	}
+	if err := c.Audit.Validate(); err != nil {
+		return c, err
+	}
+	if err := c.Grafana.Validate(); err != nil {
+		return c, err
+	}
+	if err := c.ErrorReports.Validate(); err != nil {
+		return c, err
+	}
+	if err := c.Output.Validate(); err != nil {
+		return c, err
+	}
+	if err := c.Recovery.Validate(); err != nil {
+		return c, err
+	}
+	if err := auth.ValidateRoles(c.Roles); err != nil {
+		return c, err
+	}
+	if err := c.LDAP.Validate(); err != nil {
+		return c, err
+	}
+	if err := c.OIDC.Validate(); err != nil {
+		return c, err
+	}
+	if err := c.Alerts.Validate(); err != nil {
+		return c, err
+	}
+	if err := c.BreakGlass.Validate(); err != nil {
+		return c, err
+	}
+	if err := c.ExternalAuth.Validate(); err != nil {
+		return c, err
+	}
+	if err := c.OPA.Validate(); err != nil {
+		return c, err
+	}
+	if err := c.Vault.Validate(); err != nil {
+		return c, err
+	}
+	if err := validateTemplates(c.Format.Templates); err != nil {
+		return c, fmt.Errorf("format: %s", err)
+	}
+	if c.Format.LogsLink != "" {
+		if err := validateTemplates(map[string]string{"logs_link": c.Format.LogsLink}); err != nil {
+			return c, fmt.Errorf("format: %s", err)
+		}
+	}
+	if c.Format.Limits.Timeout < 0 || c.Format.Limits.MaxBytes < 0 {
+		return c, fmt.Errorf("format: template limits can't be negative")
+	}
+	for name, channel := range c.Format.Channels {
+		if err := validateTemplates(channel.Templates); err != nil {
+			return c, fmt.Errorf("format of channel %s: %s", name, err)
+		}
+	}
+	for name, source := range c.Webhooks {
+		if err := source.Validate(); err != nil {
+			return c, fmt.Errorf("webhook %s: %s", name, err)
+		}
+	}
+	for name, mapping := range c.WebhookMappings {
+		if _, ok := c.Webhooks[name]; ok {
+			return c, fmt.Errorf("webhook mapping %s has the name of a webhook", name)
+		}
+		if err := mapping.Validate(); err != nil {
+			return c, fmt.Errorf("webhook mapping %s: %s", name, err)
+		}
+	}
+	if err := c.Alertmanager.Validate(); err != nil {
+		return c, err
+	}
+	if err := c.Dispatch.Validate(); err != nil {
+		return c, err
+	}
+	if err := c.Canaries.Validate(); err != nil {
+		return c, err
+	}
+	if err := c.Conflicts.Validate(); err != nil {
+		return c, err
+	}
+	if err := c.Heartbeats.Validate(); err != nil {
+		return c, err
+	}
+	for i, policy := range c.Agents {
+		if err := policy.Validate(); err != nil {
+			return c, fmt.Errorf("agent policy %d: %s", i+1, err)
+		}
+	}
+
+	if err := validateCommands(c.Commands, c.Vault); err != nil {
+		return c, err
+	}
+
+	for kind, size := range c.Pools {
+		switch kind {
+		case commands.KindLocalCommand, commands.KindRemoteCommand, commands.KindBuiltinCommand:
+		default:
+			return c, fmt.Errorf("invalid pool %s, valid pools are %s, %s and %s", kind,
+				commands.KindLocalCommand, commands.KindRemoteCommand, commands.KindBuiltinCommand)
+		}
+		if size <= 0 {
+			return c, fmt.Errorf("invalid size %d for pool %s, it should be greater than 0", size, kind)
+		}
+	}
+
+	return c, nil
+}
+
+// defaultConfig returns the configuration the files are parsed over
+func defaultConfig() Config {
+	return Config{
+		Version: CurrentVersion,
 		Database: db.DatabaseConfig{
 			Path:    "meeseeks.db",
 			Mode:    0600,
@@ -89,40 +595,364 @@ func New(r io.Reader) (Config, error) {
 		},
 		Pool: 20,
 	}
+}
 
-	b, err := ioutil.ReadAll(r)
-	if err != nil {
-		return c, fmt.Errorf("could not read configuration: %s", err)
+func validateDatabase(cnf db.DatabaseConfig) error {
+	switch cnf.Driver {
+	case "", DriverBolt:
+	case sqldb.DriverSQLite, sqldb.DriverMySQL:
+		if cnf.DSN == "" {
+			return fmt.Errorf("database driver %s requires a dsn", cnf.Driver)
+		}
+	default:
+		return fmt.Errorf("invalid database driver %s, valid drivers are %s, %s and %s", cnf.Driver,
+			DriverBolt, sqldb.DriverSQLite, sqldb.DriverMySQL)
 	}
+	return nil
+}
 
-	err = yaml.Unmarshal(b, &c)
-	if err != nil {
-		return c, fmt.Errorf("could not parse configuration: %s", err)
+func validateCommands(cmds map[string]Command, vaultCnf vault.Config) error {
+	for name, cmd := range cmds {
+		if cmd.Notify.After < 0 {
+			return fmt.Errorf("command %s: notify after can't be negative", name)
+		}
+		if err := cmd.Webhook.Validate(); err != nil {
+			return fmt.Errorf("command %s: %s", name, err)
+		}
+		if err := auth.ValidateRestrictedArgs(cmd.RestrictedArgs); err != nil {
+			return fmt.Errorf("command %s: %s", name, err)
+		}
+		if err := validateSecrets(cmd.Secrets, vaultCnf); err != nil {
+			return fmt.Errorf("command %s: %s", name, err)
+		}
+		if err := ansi.Validate(cmd.ANSI); err != nil {
+			return fmt.Errorf("command %s: %s", name, err)
+		}
+		if err := auth.ValidateTimeWindows(cmd.TimeWindows); err != nil {
+			return fmt.Errorf("command %s: %s", name, err)
+		}
+		if err := approvals.Validate(cmd.Approval); err != nil {
+			return fmt.Errorf("command %s: %s", name, err)
+		}
+		if err := cmd.Limits.Validate(); err != nil {
+			return fmt.Errorf("command %s: %s", name, err)
+		}
+		if err := shell.ValidateRunAs(cmd.User, cmd.Group); err != nil {
+			return fmt.Errorf("command %s: %s", name, err)
+		}
+		if err := shell.ValidateArtifacts(cmd.Artifacts); err != nil {
+			return fmt.Errorf("command %s: %s", name, err)
+		}
+		if err := validateTemplates(cmd.Templates); err != nil {
+			return fmt.Errorf("command %s: %s", name, err)
+		}
+		for _, channels := range [][]string{cmd.AllowedChannels, cmd.DeniedChannels} {
+			if err := auth.ValidateChannelPatterns(channels); err != nil {
+				return fmt.Errorf("command %s: %s", name, err)
+			}
+		}
 	}
-
-	return c, nil
+	return nil
 }
 
 // Config is the struct used to load MrMeeseeks configuration yaml
+//
+// Version is the version of the shape of the configuration, older versions
+// are upgraded to the current one when they are loaded
+//
+// CommandsPath is optional, a directory with a yaml file per command that
+// are added to Commands, named after the file unless they set a name.
+// Defaults are applied to all the commands, wherever they are defined. The
+// command_templates section stamps out commands with the parameters of each
+// of their instances, they are added to Commands when it's parsed
+//
+// Pool is how many jobs can run concurrently, Pools overrides it for a kind
+// of command (local, remote or builtin) so they don't block each other
+//
+// Redis is optional, when set the pending jobs queue is shared with other
+// replicas using the same Redis and database
+//
+// Archive is optional, when set the logs of finished jobs are moved to a
+// bucket
+//
+// Retention holds the policies used to prune old jobs and their logs, and
+// Audit the sinks that get a copy of every audit entry. Grafana is optional,
+// when set the jobs of some commands are annotated in it, and ErrorReports
+// the trackers the internal errors and panics are reported to
+//
+// Recovery sets what to do with the jobs that were running when the previous
+// process stopped, and Output caps how much of the output of each job is
+// stored and replied. Reload sets where reloading the configuration is
+// reported
+//
+// Roles aggregate groups and grant their members permissions per command, a
+// command uses them with the role auth strategy
+//
+// LDAP is optional, when set the members of the groups it maps are synced
+// from the directory
+//
+// OIDC is optional, when set the users can link their chat user to an
+// identity of the provider
+//
+// Alerts is optional, when set the users that are rejected too often are
+// reported to a channel, and BreakGlass sets who can run any command while
+// break glass is on for an incident. ExternalAuth is the service that decides
+// on the commands with the external auth strategy, and OPA the policy agent
+// that decides on the ones with the opa auth strategy
+//
+// Vault is optional, when set values like the database dsn and the secrets
+// of the commands can point to secrets in it
+//
+// Webhooks are the external systems that can trigger commands with signed
+// calls, and WebhookMappings the ones that call with their own payloads, like
+// forges, which are mapped into commands. Alertmanager sets the commands that
+// run when the alerts an Alertmanager sends fire. Agents the policies of the commands that remote agents can
+// register, without them agents can register any command. AgentRoutes are
+// the labels of the agents that run each remote command when more than one
+// registered it, unless the request picks them with --on, and Dispatch how
+// the jobs are spread over the agents that have them, Canaries the share of
+// the jobs of a command that goes to the agents with some labels, like the
+// ones of a new version. Conflicts sets what to do when an agent registers a
+// command that is registered with other options, and Heartbeats when an
+// agent that stopped sending heartbeats is unregistered, and the channel told
+//
+// Workdirs sets whether each job runs in its own working directory, and how
+// long the directories are kept after the job is done, and Artifacts where the
+// files the jobs leave are kept and how they are linked
 type Config struct {
-	Database db.DatabaseConfig      `yaml:"database"`
-	Commands map[string]Command     `yaml:"commands"`
-	Groups   map[string][]string    `yaml:"groups"`
-	Pool     int                    `yaml:"pool"`
-	Format   formatter.FormatConfig `yaml:"format"`
+	Version         int                         `yaml:"version"`
+	Database        db.DatabaseConfig           `yaml:"database"`
+	Commands        map[string]Command          `yaml:"commands"`
+	Defaults        CommandDefaults             `yaml:"command_defaults"`
+	CommandsPath    string                      `yaml:"commands_path"`
+	Groups          map[string][]string         `yaml:"groups"`
+	Roles           map[string]auth.Role        `yaml:"roles"`
+	LDAP            ldap.Config                 `yaml:"ldap"`
+	OIDC            oidc.Config                 `yaml:"oidc"`
+	Alerts          alerts.Config               `yaml:"alerts"`
+	BreakGlass      breakglass.Config           `yaml:"break_glass"`
+	ExternalAuth    auth.ExternalConfig         `yaml:"external_auth"`
+	OPA             auth.OPAConfig              `yaml:"opa"`
+	Vault           vault.Config                `yaml:"vault"`
+	Webhooks        map[string]webhooks.Source  `yaml:"webhooks"`
+	WebhookMappings map[string]webhooks.Mapping `yaml:"webhook_mappings"`
+	Alertmanager    webhooks.Alertmanager       `yaml:"alertmanager"`
+	Agents          []server.AgentPolicy        `yaml:"agents"`
+	AgentRoutes     server.Routes               `yaml:"agent_routes"`
+	Dispatch        server.Dispatch             `yaml:"agent_dispatch"`
+	Canaries        server.Canaries             `yaml:"agent_canaries"`
+	Conflicts       server.Conflicts            `yaml:"agent_conflicts"`
+	Heartbeats      server.Heartbeats           `yaml:"agent_heartbeats"`
+	Pool            int                         `yaml:"pool"`
+	Pools           map[string]int              `yaml:"pools"`
+	Format          formatter.FormatConfig      `yaml:"format"`
+	Plugins         plugins.Config              `yaml:"plugins"`
+	Redis           redis.Config                `yaml:"redis"`
+	Archive         archive.Config              `yaml:"archive"`
+	Retention       retention.Config            `yaml:"retention"`
+	Audit           audit.Config                `yaml:"audit"`
+	Grafana         grafana.Config              `yaml:"grafana"`
+	ErrorReports    reports.Config              `yaml:"error_reports"`
+	Recovery        Recovery                    `yaml:"recovery"`
+	Reload          Reload                      `yaml:"reload"`
+	Output          limit.Config                `yaml:"output"`
+	Workdirs        shell.Workdirs              `yaml:"job_workdirs"`
+	Artifacts       artifacts.Config            `yaml:"artifacts"`
 }
 
 // Command is the struct that handles a command configuration
+//
+// Owner and Source are who maintains the command and where it's defined, they
+// are shown in its help and recorded in the audit log. Templates, ReplyStyle
+// and the Colors that are set override the ones of the format section for
+// the command.
+// Language is the one of the code fence of the output, like json, it's
+// detected from the output unless it's set, and none disables it. ANSI is
+// how the escape sequences of the output are handled, strip, keep or emphasis.
+// Limits are the resources each job can take from the host that runs it, and
+// User and Group the account it runs as, names or numeric IDs. Artifacts are
+// the patterns of the files, relative to its working directory, that are kept
+// from each job
 type Command struct {
-	Cmd             string        `yaml:"command"`
-	Args            []string      `yaml:"args"`
-	AllowedGroups   []string      `yaml:"allowed_groups"`
-	AuthStrategy    string        `yaml:"auth_strategy"`
-	ChannelStrategy string        `yaml:"channel_strategy"`
-	AllowedChannels []string      `yaml:"allowed_channels"`
-	NoHandshake     bool          `yaml:"no_handshake"`
-	Timeout         time.Duration `yaml:"timeout"`
-	Help            CommandHelp   `yaml:"help"`
+	Cmd             string                  `yaml:"command"`
+	Args            []string                `yaml:"args"`
+	AllowedGroups   []string                `yaml:"allowed_groups"`
+	AuthStrategy    string                  `yaml:"auth_strategy"`
+	ChannelStrategy string                  `yaml:"channel_strategy"`
+	AllowedChannels []string                `yaml:"allowed_channels"`
+	DeniedChannels  []string                `yaml:"denied_channels"`
+	RestrictedArgs  map[string][]string     `yaml:"restricted_args"`
+	TimeWindows     meeseeks.TimeWindowOpts `yaml:"time_windows"`
+	NoHandshake     bool                    `yaml:"no_handshake"`
+	Timeout         time.Duration           `yaml:"timeout"`
+	Help            CommandHelp             `yaml:"help"`
+	Stream          CommandStream           `yaml:"stream"`
+	Labels          map[string]string       `yaml:"labels"`
+	Webhook         CommandWebhook          `yaml:"webhook"`
+	Notify          CommandNotify           `yaml:"notify"`
+	Secrets         map[string]string       `yaml:"secrets"`
+	Approval        meeseeks.ApprovalOpts   `yaml:"approval"`
+	Owner           string                  `yaml:"owner"`
+	Source          string                  `yaml:"source"`
+	Templates       map[string]string       `yaml:"templates"`
+	ReplyStyle      map[string]string       `yaml:"reply_styles"`
+	Colors          formatter.MessageColors `yaml:"colors"`
+	Language        string                  `yaml:"output_language"`
+	ANSI            string                  `yaml:"ansi"`
+	Limits          meeseeks.ResourceLimits `yaml:"limits"`
+	User            string                  `yaml:"user"`
+	Group           string                  `yaml:"group"`
+	Artifacts       []string                `yaml:"artifacts"`
+}
+
+// CommandStream is the struct that handles how the output of a command is
+// sent while it runs, the interval is in seconds
+type CommandStream struct {
+	Lines    int           `yaml:"lines"`
+	Interval time.Duration `yaml:"interval"`
+	Edit     bool          `yaml:"edit"`
+}
+
+// CommandDefaults is the struct that handles the settings every command gets
+// unless it sets its own, the timeout is in seconds. The templates and reply
+// styles are merged with the ones of each command, which win
+type CommandDefaults struct {
+	Timeout      time.Duration     `yaml:"timeout"`
+	AuthStrategy string            `yaml:"auth_strategy"`
+	Templates    map[string]string `yaml:"templates"`
+	ReplyStyle   map[string]string `yaml:"reply_styles"`
+}
+
+// apply returns the command with the defaults it doesn't set
+func (d CommandDefaults) apply(cmd Command) Command {
+	if cmd.Timeout == 0 {
+		cmd.Timeout = d.Timeout
+	}
+	if cmd.AuthStrategy == "" {
+		cmd.AuthStrategy = d.AuthStrategy
+	}
+	cmd.Templates = mergeDefaults(d.Templates, cmd.Templates)
+	cmd.ReplyStyle = mergeDefaults(d.ReplyStyle, cmd.ReplyStyle)
+	return cmd
+}
+
+// mergeDefaults returns the values with the defaults they don't set
+func mergeDefaults(defaults, values map[string]string) map[string]string {
+	if len(defaults) == 0 {
+		return values
+	}
+	merged := make(map[string]string, len(defaults)+len(values))
+	for k, v := range defaults {
+		merged[k] = v
+	}
+	for k, v := range values {
+		merged[k] = v
+	}
+	return merged
+}
+
+// CommandNotify is the struct that handles whether the caller of a job of a
+// command gets a direct message when it finishes, only when it took longer
+// than After seconds
+type CommandNotify struct {
+	Caller bool          `yaml:"caller"`
+	After  time.Duration `yaml:"after"`
+}
+
+// CommandWebhook is the struct that handles where the jobs of a command are
+// posted when they finish, the timeout is in seconds
+type CommandWebhook struct {
+	URL         string        `yaml:"url"`
+	Timeout     time.Duration `yaml:"timeout"`
+	OutputLines int           `yaml:"output_lines"`
+}
+
+// Validate checks that the webhook is usable
+func (w CommandWebhook) Validate() error {
+	if w.URL == "" {
+		return nil
+	}
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("invalid webhook url %s, it has to be an http or https url", w.URL)
+	}
+	if w.OutputLines < 0 {
+		return fmt.Errorf("webhook output lines can't be negative")
+	}
+	return nil
+}
+
+var envNameRegex = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+
+// validateSecrets checks that the secrets are set in valid environment
+// variables, and that there is a vault to take them from
+func validateSecrets(secrets map[string]string, cnf vault.Config) error {
+	for name, ref := range secrets {
+		if !envNameRegex.MatchString(name) {
+			return fmt.Errorf("invalid secret name %s, it has to be a valid environment variable", name)
+		}
+		if !vault.IsReference(ref) {
+			return fmt.Errorf("invalid secret %s, it has to be a vault reference like vault:path#field", name)
+		}
+		if !cnf.Enabled() {
+			return fmt.Errorf("secret %s requires vault to be configured", name)
+		}
+	}
+	return nil
+}
+
+// validateTemplates checks that the templates parse, so a broken one fails
+// the load instead of every reply that renders it. They are checked in order
+// to return stable errors
+func validateTemplates(templates map[string]string) error {
+	names := make([]string, 0, len(templates))
+	for name := range templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := template.New(name, templates[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reload is the struct that handles where the outcome of reloading the
+// configuration is reported besides the log, like an admin channel
+type Reload struct {
+	ChannelID string `yaml:"channel_id"`
+}
+
+// Recovery is the struct that handles how interrupted jobs are recovered on
+// startup, with notify their channels are told that they were interrupted.
+//
+// Queued sets what to do with the jobs that were waiting to run, resume them
+// (the default) or fail them
+type Recovery struct {
+	Notify bool   `yaml:"notify"`
+	Queued string `yaml:"queued"`
+}
+
+// Ways of recovering queued jobs
+const (
+	RecoveryResume = "resume"
+	RecoveryFail   = "fail"
+)
+
+// ResumesQueued returns true if the queued jobs have to be run again
+func (r Recovery) ResumesQueued() bool {
+	return r.Queued != RecoveryFail
+}
+
+// Validate checks that the recovery is usable
+func (r Recovery) Validate() error {
+	switch r.Queued {
+	case "", RecoveryResume, RecoveryFail:
+		return nil
+	}
+	return fmt.Errorf("invalid recovery %s for queued jobs, valid ones are %s and %s",
+		r.Queued, RecoveryResume, RecoveryFail)
 }
 
 // CommandHelp is the struct that handles the help of a command
@@ -1,10 +1,17 @@
 package config_test
 
 import (
+	"encoding/base64"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -14,7 +21,10 @@ import (
 	"gitlab.com/yakshaving.art/meeseeks-box/commands"
 	"gitlab.com/yakshaving.art/meeseeks-box/config"
 	"gitlab.com/yakshaving.art/meeseeks-box/mocks"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence"
 	"gitlab.com/yakshaving.art/meeseeks-box/persistence/db"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/redis"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/retention"
 	"gitlab.com/yakshaving.art/meeseeks-box/text/formatter"
 	"github.com/renstrom/dedent"
 )
@@ -39,6 +49,7 @@ func Test_ConfigurationReading(t *testing.T) {
 			"Default configuration",
 			"",
 			config.Config{
+				Version: config.CurrentVersion,
 				Format: formatter.FormatConfig{
 					Colors:     defaultColors,
 					ReplyStyle: map[string]string{},
@@ -55,6 +66,7 @@ func Test_ConfigurationReading(t *testing.T) {
 				    handshake: ["hallo"]
 				`),
 			config.Config{
+				Version: config.CurrentVersion,
 				Format: formatter.FormatConfig{
 					Colors:     defaultColors,
 					ReplyStyle: map[string]string{},
@@ -76,6 +88,7 @@ func Test_ConfigurationReading(t *testing.T) {
 				    error: "#000000"
 				`),
 			config.Config{
+				Version: config.CurrentVersion,
 				Format: formatter.FormatConfig{
 					Colors: formatter.MessageColors{
 						Info:    "#FFFFFF",
@@ -98,6 +111,7 @@ func Test_ConfigurationReading(t *testing.T) {
 				    args: ["none"]
 				`),
 			config.Config{
+				Version: config.CurrentVersion,
 				Commands: map[string]config.Command{
 					"something": {
 						Cmd:  "ssh",
@@ -112,6 +126,145 @@ func Test_ConfigurationReading(t *testing.T) {
 				Pool:     20,
 			},
 		},
+		{
+			"With streamed commands",
+			dedent.Dedent(`
+				commands:
+				  deploy:
+				    command: "deploy.sh"
+				    stream:
+				      lines: 10
+				      interval: 5
+				      edit: true
+				`),
+			config.Config{
+				Version: config.CurrentVersion,
+				Commands: map[string]config.Command{
+					"deploy": {
+						Cmd: "deploy.sh",
+						Stream: config.CommandStream{
+							Lines:    10,
+							Interval: 5,
+							Edit:     true,
+						},
+					},
+				},
+				Format: formatter.FormatConfig{
+					Colors:     defaultColors,
+					ReplyStyle: map[string]string{},
+				},
+				Database: defaultDatabase,
+				Pool:     20,
+			},
+		},
+		{
+			"With labeled commands",
+			dedent.Dedent(`
+				commands:
+				  deploy:
+				    command: "deploy.sh"
+				    labels:
+				      env: prod
+				      service: billing
+				`),
+			config.Config{
+				Version: config.CurrentVersion,
+				Commands: map[string]config.Command{
+					"deploy": {
+						Cmd: "deploy.sh",
+						Labels: map[string]string{
+							"env":     "prod",
+							"service": "billing",
+						},
+					},
+				},
+				Format: formatter.FormatConfig{
+					Colors:     defaultColors,
+					ReplyStyle: map[string]string{},
+				},
+				Database: defaultDatabase,
+				Pool:     20,
+			},
+		},
+		{
+			"With pools",
+			dedent.Dedent(`
+				pool: 10
+				pools:
+				  local: 5
+				  builtin: 2
+				`),
+			config.Config{
+				Version: config.CurrentVersion,
+				Format: formatter.FormatConfig{
+					Colors:     defaultColors,
+					ReplyStyle: map[string]string{},
+				},
+				Database: defaultDatabase,
+				Pool:     10,
+				Pools: map[string]int{
+					"local":   5,
+					"builtin": 2,
+				},
+			},
+		},
+		{
+			"With redis",
+			dedent.Dedent(`
+				redis:
+				  address: localhost:6379
+				  db: 2
+				`),
+			config.Config{
+				Version: config.CurrentVersion,
+				Format: formatter.FormatConfig{
+					Colors:     defaultColors,
+					ReplyStyle: map[string]string{},
+				},
+				Database: defaultDatabase,
+				Pool:     20,
+				Redis: redis.Config{
+					Address: "localhost:6379",
+					DB:      2,
+				},
+			},
+		},
+		{
+			"With retention",
+			dedent.Dedent(`
+				retention:
+				  max_age: 2592000
+				  max_jobs_per_command: 100
+				  max_total_size: 1048576
+				`),
+			config.Config{
+				Version: config.CurrentVersion,
+				Format: formatter.FormatConfig{
+					Colors:     defaultColors,
+					ReplyStyle: map[string]string{},
+				},
+				Database: defaultDatabase,
+				Pool:     20,
+				Retention: retention.Config{
+					MaxAge:            2592000,
+					MaxJobsPerCommand: 100,
+					MaxTotalSize:      1048576,
+				},
+			},
+		},
+		{
+			"With the current version",
+			"version: 1",
+			config.Config{
+				Version: config.CurrentVersion,
+				Format: formatter.FormatConfig{
+					Colors:     defaultColors,
+					ReplyStyle: map[string]string{},
+				},
+				Database: defaultDatabase,
+				Pool:     20,
+			},
+		},
 	}
 	for _, tc := range tt {
 		t.Run(tc.Name, func(t *testing.T) {
@@ -143,6 +296,231 @@ func Test_Errors(t *testing.T) {
 			badReader{},
 			"could not read configuration: bad reader",
 		},
+		{
+			"newer version",
+			strings.NewReader("version: 2"),
+			"configuration version 2 is newer than the version 1 this meeseeks reads, upgrade the meeseeks to load it",
+		},
+		{
+			"invalid version",
+			strings.NewReader("version: v1"),
+			"invalid configuration version v1, it has to be a number from 1 to 1",
+		},
+		{
+			"invalid pool kind",
+			strings.NewReader("pools:\n  shell: 2"),
+			"invalid pool shell, valid pools are local, remote and builtin",
+		},
+		{
+			"invalid pool size",
+			strings.NewReader("pools:\n  local: 0"),
+			"invalid size 0 for pool local, it should be greater than 0",
+		},
+		{
+			"invalid database driver",
+			strings.NewReader("database:\n  driver: postgres"),
+			"invalid database driver postgres, valid drivers are bolt, sqlite and mysql",
+		},
+		{
+			"sql database without dsn",
+			strings.NewReader("database:\n  driver: mysql"),
+			"database driver mysql requires a dsn",
+		},
+		{
+			"invalid archive provider",
+			strings.NewReader("archive:\n  bucket: logs\n  provider: dropbox"),
+			"invalid archive provider dropbox, valid providers are s3 and gcs",
+		},
+		{
+			"negative job workdirs keep",
+			strings.NewReader("job_workdirs:\n  enabled: true\n  keep: -1"),
+			"job workdirs keep can't be negative",
+		},
+		{
+			"negative retention",
+			strings.NewReader("retention:\n  max_jobs_per_command: -1"),
+			"retention policies can't be negative",
+		},
+		{
+			"invalid audit webhook",
+			strings.NewReader("audit:\n  webhook:\n    url: syslog://localhost"),
+			"invalid audit webhook url syslog://localhost, it has to be an http or https url",
+		},
+		{
+			"audit kafka without topic",
+			strings.NewReader("audit:\n  kafka:\n    rest_proxy: http://kafka-rest:8082"),
+			"audit kafka requires a topic",
+		},
+		{
+			"invalid command webhook",
+			strings.NewReader("commands:\n  deploy:\n    command: deploy\n    webhook:\n      url: tickets"),
+			"command deploy: invalid webhook url tickets, it has to be an http or https url",
+		},
+		{
+			"sentry dsn without a key",
+			strings.NewReader("error_reports:\n  sentry:\n    dsn: https://sentry.example.com/42"),
+			"invalid sentry dsn https://sentry.example.com/42, it has no key",
+		},
+		{
+			"grafana without commands",
+			strings.NewReader("grafana:\n  url: http://grafana:3000\n  token: secret"),
+			"grafana requires the commands to annotate",
+		},
+		{
+			"negative command notify after",
+			strings.NewReader("commands:\n  deploy:\n    command: deploy\n    notify:\n      caller: true\n      after: -1"),
+			"command deploy: notify after can't be negative",
+		},
+		{
+			"negative command limits",
+			strings.NewReader("commands:\n  deploy:\n    command: deploy\n    limits:\n      memory: -1"),
+			"command deploy: resource limits can't be negative",
+		},
+		{
+			"unknown command user",
+			strings.NewReader("commands:\n  deploy:\n    command: deploy\n    user: meeseeks-nobody"),
+			"command deploy: unknown user meeseeks-nobody",
+		},
+		{
+			"artifacts out of the working directory",
+			strings.NewReader("commands:\n  deploy:\n    command: deploy\n    artifacts:\n    - ../*.log"),
+			"command deploy: invalid artifacts pattern ../*.log, it has to be relative to the working directory of the job",
+		},
+		{
+			"negative template limits",
+			strings.NewReader("format:\n  limits:\n    max_bytes: -1"),
+			"format: template limits can't be negative",
+		},
+		{
+			"invalid agent dispatch strategy",
+			strings.NewReader("agent_dispatch:\n  commands:\n    deploy: busiest"),
+			"invalid agent dispatch strategy busiest, valid ones are first, round-robin, least-busy and random",
+		},
+		{
+			"agent canary over all the jobs",
+			strings.NewReader("agent_canaries:\n  deploy:\n    labels:\n      version: v2\n    percent: 120"),
+			"canary of command deploy has to get between 0 and 100 percent of the jobs",
+		},
+		{
+			"agent canary without labels",
+			strings.NewReader("agent_canaries:\n  deploy:\n    percent: 5"),
+			"canary of command deploy has no labels",
+		},
+		{
+			"invalid agent conflicts policy",
+			strings.NewReader("agent_conflicts:\n  commands:\n    deploy: override"),
+			"invalid agent conflicts policy override, valid ones are join, reject and version",
+		},
+		{
+			"negative agent heartbeats misses",
+			strings.NewReader("agent_heartbeats:\n  misses: -2"),
+			"agent heartbeats misses can't be negative",
+		},
+		{
+			"invalid command ansi mode",
+			strings.NewReader("commands:\n  plan:\n    command: terraform\n    ansi: colors"),
+			"command plan: invalid ansi mode colors, it should be strip, keep or emphasis",
+		},
+		{
+			"invalid queued jobs recovery",
+			strings.NewReader("recovery:\n  queued: drop"),
+			"invalid recovery drop for queued jobs, valid ones are resume and fail",
+		},
+		{
+			"invalid role permission",
+			strings.NewReader("roles:\n  sre:\n    permissions:\n      deploy: [destroy]"),
+			"role sre grants invalid permission destroy on deploy, valid ones are run, view-logs, cancel and approve",
+		},
+		{
+			"invalid ldap url",
+			strings.NewReader("ldap:\n  url: ldap.example.com"),
+			"invalid ldap url ldap.example.com, it has to be an ldap or ldaps url",
+		},
+		{
+			"oidc without client id",
+			strings.NewReader("oidc:\n  issuer: https://login.example.com\n  redirect_url: https://meeseeks.example.com/oidc/callback"),
+			"oidc requires a client_id",
+		},
+		{
+			"negative alerts attempts",
+			strings.NewReader("alerts:\n  channel_id: C0123\n  attempts: -1"),
+			"alerts attempts can't be negative",
+		},
+		{
+			"secret without vault",
+			strings.NewReader("commands:\n  deploy:\n    command: deploy\n    secrets:\n      TOKEN: vault:secret/data/deploy#token"),
+			"command deploy: secret TOKEN requires vault to be configured",
+		},
+		{
+			"invalid secret name",
+			strings.NewReader("vault:\n  address: https://vault:8200\ncommands:\n  deploy:\n    command: deploy\n    secrets:\n      DEPLOY-TOKEN: vault:secret/data/deploy#token"),
+			"command deploy: invalid secret name DEPLOY-TOKEN, it has to be a valid environment variable",
+		},
+		{
+			"webhook without secret",
+			strings.NewReader("webhooks:\n  ci:\n    user: ciLink\n    channel: deploysLink\n    command: deploy"),
+			"webhook ci: webhook requires a secret",
+		},
+		{
+			"webhook mapping with an invalid path",
+			strings.NewReader("webhook_mappings:\n  forge:\n    secret: s3cr3t\n    user: ciLink\n    channel: deploysLink\n    command: deploy\n    vars:\n      repo: repository.name"),
+			"webhook mapping forge: var repo: invalid path repository.name, it has to start with $",
+		},
+		{
+			"alertmanager rule without command",
+			strings.NewReader("alertmanager:\n  token: t0k3n\n  user: ciLink\n  channel: alertsLink\n  rules:\n    - alert: DiskFull"),
+			"alertmanager rule 1: rule requires a command",
+		},
+		{
+			"agent policy without commands",
+			strings.NewReader("agents:\n  - token: builder"),
+			"agent policy 1: agent policy requires at least one command pattern",
+		},
+		{
+			"agent policy with invalid auth strategy",
+			strings.NewReader("agents:\n  - labels:\n      tier: build\n    commands: [\"build-*\"]\n    auth_strategies: [everyone]"),
+			"agent policy 1: invalid auth strategy everyone",
+		},
+		{
+			"break glass without groups",
+			strings.NewReader("break_glass:\n  channel_id: C0123"),
+			"break glass requires the groups it relaxes the auth for",
+		},
+		{
+			"invalid external auth url",
+			strings.NewReader("external_auth:\n  url: policies.example.com"),
+			"invalid external auth url policies.example.com, it has to be an http or https url",
+		},
+		{
+			"opa policies without opa",
+			strings.NewReader("opa:\n  policies: [meeseeks.rego]"),
+			"opa policies require an opa url",
+		},
+		{
+			"negative approvals",
+			strings.NewReader("commands:\n  deploy:\n    command: deploy\n    approval:\n      group: leads\n      required: -1"),
+			"command deploy: approval required can't be negative",
+		},
+		{
+			"invalid denied channel pattern",
+			strings.NewReader("commands:\n  deploy:\n    command: deploy\n    denied_channels: [\"prod-[\"]"),
+			"command deploy: invalid channel pattern prod-[: syntax error in pattern",
+		},
+		{
+			"invalid restricted arg pattern",
+			strings.NewReader("commands:\n  deploy:\n    command: deploy\n    restricted_args:\n      \"prod-[\": [admin]"),
+			"command deploy: invalid argument pattern prod-[: syntax error in pattern",
+		},
+		{
+			"invalid time window",
+			strings.NewReader("commands:\n  deploy:\n    command: deploy\n    time_windows:\n      windows:\n      - from: \"9am\"\n        to: \"17:00\""),
+			"command deploy: invalid time 9am in time window, it has to be like 09:00",
+		},
+		{
+			"negative output limits",
+			strings.NewReader("output:\n  max_bytes: -1"),
+			"output limits can't be negative",
+		},
 	}
 	for _, tc := range tc {
 		t.Run(tc.name, func(t *testing.T) {
@@ -222,3 +600,902 @@ func TestReloadingConfigurationReplacesThings(t *testing.T) {
 	mocks.AssertEquals(t, first.GetAuthStrategy(), "any")
 	mocks.AssertEquals(t, second.GetAuthStrategy(), "group")
 }
+
+func TestReloadingKeepsTheDatabaseInUseOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meeseeks-reload")
+	mocks.Must(t, "could not create tmp dir", err)
+	defer os.RemoveAll(dir)
+
+	load := func(database string) {
+		c, err := config.New(strings.NewReader(database))
+		mocks.Must(t, "could not read configuration", err)
+		mocks.Must(t, "failed to load configuration", config.LoadConfiguration(c))
+	}
+	sqlite := fmt.Sprintf("database:\n  driver: sqlite\n  dsn: %s\n", filepath.Join(dir, "meeseeks.sqlite"))
+	bolt := fmt.Sprintf("database:\n  path: %s\n  file_mode: 0600\n  timeout: 1\n", filepath.Join(dir, "meeseeks.db"))
+	defer load(bolt)
+
+	load(sqlite)
+	aliases := persistence.Aliases()
+	mocks.Must(t, "could not create alias", aliases.Create("someone", "hi", "echo", "hello"))
+
+	load(sqlite)
+	_, _, err = aliases.Get("someone", "hi")
+	mocks.Must(t, "the store in use was closed on reload", err)
+
+	load(bolt)
+	_, err = persistence.Aliases().List("someone")
+	mocks.Must(t, "the services were not moved to bolt", err)
+	load(bolt)
+	_, err = persistence.Aliases().List("someone")
+	mocks.Must(t, "the bolt database was closed on reload", err)
+}
+
+func TestReloadingKeepsTheOutputOfTheRunningJobsLimited(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meeseeks-reload")
+	mocks.Must(t, "could not create tmp dir", err)
+	defer os.RemoveAll(dir)
+
+	load := func(output string) {
+		c, err := config.New(strings.NewReader(fmt.Sprintf("database:\n  path: %s\n%s",
+			filepath.Join(dir, "meeseeks.db"), output)))
+		mocks.Must(t, "could not read configuration", err)
+		mocks.Must(t, "failed to load configuration", config.LoadConfiguration(c))
+	}
+	defer load("")
+
+	load("output:\n  max_lines: 4\n")
+	job, err := persistence.Jobs().Create(meeseeks.Request{Command: "echo"})
+	mocks.Must(t, "could not create job", err)
+	writer := persistence.LogWriter()
+	for i := 1; i <= 5; i++ {
+		mocks.Must(t, "could not append line", writer.Append(job.ID, fmt.Sprintf("line%d", i)))
+	}
+
+	// The job keeps writing through the writer it got before the reload, and
+	// it's finished by the services of the new configuration
+	load("output:\n  max_lines: 10\n")
+	for i := 6; i <= 10; i++ {
+		mocks.Must(t, "could not append line", writer.Append(job.ID, fmt.Sprintf("line%d", i)))
+	}
+	mocks.Must(t, "could not finish job", persistence.Jobs().Finish(job.ID, meeseeks.JobSucceededStatus))
+
+	jobLog, err := persistence.LogReader().Get(job.ID)
+	mocks.Must(t, "could not read logs", err)
+	mocks.AssertEquals(t, "line1\nline2\n[... 6 lines (36 bytes) truncated ...]\nline9\nline10", jobLog.Output)
+
+	// Without limits the output of the new jobs is stored as is
+	load("")
+	job, err = persistence.Jobs().Create(meeseeks.Request{Command: "echo"})
+	mocks.Must(t, "could not create job", err)
+	for i := 1; i <= 5; i++ {
+		mocks.Must(t, "could not append line", persistence.LogWriter().Append(job.ID, fmt.Sprintf("line%d", i)))
+	}
+	mocks.Must(t, "could not finish job", persistence.Jobs().Finish(job.ID, meeseeks.JobSucceededStatus))
+	jobLog, err = persistence.LogReader().Get(job.ID)
+	mocks.Must(t, "could not read logs", err)
+	mocks.AssertEquals(t, "line1\nline2\nline3\nline4\nline5", jobLog.Output)
+}
+
+func TestReloadingReportsToTheChannelInUse(t *testing.T) {
+	_, err := config.ReloadFile("./test-fixtures/basic-config.yml")
+	mocks.Must(t, "failed to reload configuration", err)
+	mocks.AssertEquals(t, "", config.ReloadChannel())
+
+	diff, err := config.ReloadFile("./test-fixtures/reload-config.yml")
+	mocks.Must(t, "failed to reload configuration", err)
+	mocks.AssertEquals(t, "C0ADMIN", config.ReloadChannel())
+	mocks.AssertEquals(t, "commands removed: echo-2; commands changed: echo (timeout, help); "+
+		"sections changed: format, reload", diff.String())
+
+	_, err = config.ReloadFile("./test-fixtures/non-existing-config.yml")
+	mocks.AssertMatches(t, "could not open configuration file", err.Error())
+	mocks.AssertEquals(t, "C0ADMIN", config.ReloadChannel())
+
+	_, err = config.ReloadFile("./test-fixtures/basic-config.yml")
+	mocks.Must(t, "failed to reload configuration", err)
+	mocks.AssertEquals(t, "", config.ReloadChannel())
+}
+
+func TestReloadsReportWhatChanged(t *testing.T) {
+	before, err := config.New(strings.NewReader(`
+groups:
+  admin: ["alice", "bob"]
+  ops: ["carol"]
+commands:
+  echo:
+    command: echo
+  ls:
+    command: ls
+`))
+	mocks.Must(t, "could not parse the configuration", err)
+
+	tt := []struct {
+		name     string
+		config   string
+		expected string
+	}{
+		{
+			name: "nothing changed",
+			config: `
+groups:
+  admin: ["bob", "alice"]
+  ops: ["carol"]
+commands:
+  echo:
+    command: echo
+  ls:
+    command: ls
+`,
+			expected: "nothing changed",
+		},
+		{
+			name: "everything changed",
+			config: `
+pool: 2
+groups:
+  admin: ["alice", "dave"]
+  dev: ["erin"]
+commands:
+  echo:
+    command: echo
+    args: ["-n"]
+    timeout: 5
+  deploy:
+    command: deploy.sh
+`,
+			expected: "commands added: deploy; commands removed: ls; commands changed: echo (args, timeout); " +
+				"groups added: dev; groups removed: ops; groups changed: admin (+dave -bob); sections changed: pool",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			after, err := config.New(strings.NewReader(tc.config))
+			mocks.Must(t, "could not parse the configuration", err)
+
+			diff := config.Compare(before, after)
+			mocks.AssertEquals(t, tc.expected, diff.String())
+			mocks.AssertEquals(t, tc.expected == "nothing changed", diff.Empty())
+		})
+	}
+}
+
+func TestReadingAConfigurationDirectory(t *testing.T) {
+	c, err := config.ReadFile("./test-fixtures/conf.d")
+	mocks.Must(t, "could not read configuration directory", err)
+	mocks.AssertEquals(t, "./meeseeks-workspace.db", c.Database.Path)
+	mocks.AssertEquals(t, 5, c.Pool)
+	mocks.AssertEquals(t, map[string][]string{
+		"admin":  {"pablo", "daniele"},
+		"team-a": {"alice"},
+		"team-b": {"bob"},
+	}, c.Groups)
+	mocks.AssertEquals(t, 2, len(c.Commands))
+	mocks.AssertEquals(t, []string{"team-b"}, c.Commands["deploy-b"].AllowedGroups)
+}
+
+func TestConfigurationFragmentsConflicts(t *testing.T) {
+	tt := []struct {
+		name      string
+		fragments map[string]string
+		expected  string
+	}{
+		{
+			"no fragments",
+			map[string]string{"README": "nothing to see"},
+			"has no yaml files",
+		},
+		{
+			"command defined twice",
+			map[string]string{
+				"a.yml": "commands:\n  deploy:\n    command: echo",
+				"b.yml": "commands:\n  deploy:\n    command: true",
+			},
+			"could not merge configuration fragment b.yml: command deploy is already defined in a.yml",
+		},
+		{
+			"value set twice",
+			map[string]string{
+				"a.yml": "database:\n  path: a.db",
+				"b.yml": "database:\n  path: b.db",
+			},
+			"could not merge configuration fragment b.yml: database.path is already set to a.db in a.yml",
+		},
+		{
+			"list and map",
+			map[string]string{
+				"a.yml": "groups:\n  admin: [pablo]",
+				"b.yml": "groups:\n  admin:\n    pablo: true",
+			},
+			"could not merge configuration fragment b.yml: groups.admin is a list in a.yml",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "conf.d")
+			mocks.Must(t, "could not create configuration directory", err)
+			defer os.RemoveAll(dir)
+			for name, content := range tc.fragments {
+				mocks.Must(t, "could not write fragment", ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+			}
+
+			_, err = config.ReadFile(dir)
+			mocks.AssertMatches(t, tc.expected, fmt.Sprint(err))
+		})
+	}
+}
+
+func TestEnvironmentVariablesAreExpanded(t *testing.T) {
+	os.Setenv("MEESEEKS_TEST_DB", "/var/lib/meeseeks.db")
+	os.Setenv("MEESEEKS_TEST_POOL", "7")
+	defer os.Unsetenv("MEESEEKS_TEST_DB")
+	defer os.Unsetenv("MEESEEKS_TEST_POOL")
+
+	c, err := config.New(strings.NewReader(dedent.Dedent(`
+		database:
+		  path: ${MEESEEKS_TEST_DB}
+		pool: ${MEESEEKS_TEST_POOL}
+		commands:
+		  echo:
+		    command: ${MEESEEKS_TEST_COMMAND:-echo}
+		    args: ["$${HOME}", "in ${MEESEEKS_TEST_UNSET}"]
+		`)))
+	mocks.Must(t, "could not parse configuration", err)
+	mocks.AssertEquals(t, "/var/lib/meeseeks.db", c.Database.Path)
+	mocks.AssertEquals(t, 7, c.Pool)
+	mocks.AssertEquals(t, "echo", c.Commands["echo"].Cmd)
+	mocks.AssertEquals(t, []string{"${HOME}", "in "}, c.Commands["echo"].Args)
+
+	_, err = config.New(strings.NewReader("vault:\n  address: ${MEESEEKS_TEST_VAULT:?set the vault address}"))
+	mocks.AssertEquals(t, "could not expand vault.address: MEESEEKS_TEST_VAULT is not set, set the vault address",
+		err.Error())
+
+	_, err = config.New(strings.NewReader("commands:\n  echo:\n    args: [\"${MEESEEKS_TEST_ARG:?}\"]"))
+	mocks.AssertEquals(t, "could not expand commands.echo.args[0]: MEESEEKS_TEST_ARG is not set, it's required",
+		err.Error())
+}
+
+func TestCheckingTheConfiguration(t *testing.T) {
+	c, err := config.New(strings.NewReader(dedent.Dedent(`
+		groups:
+		  ops: [pablo]
+		format:
+		  locale: klingon
+		  templates:
+		    sucess: "done"
+		commands:
+		  noop:
+		    auth_strategy: any
+		  deploy:
+		    command: deploy
+		    auth_strategy: group
+		    allowed_groups: [ops, devs]
+		    channel_strategy: channel
+		  rollback:
+		    command: rollback
+		    auth_strategy: anyone
+		    channel_strategy: somewhere
+		    approval:
+		      group: managers
+		  ping:
+		    command: ping
+		    auth_strategy: group
+		`)))
+	mocks.Must(t, "could not parse configuration", err)
+
+	problems := make([]string, 0)
+	for _, err := range config.Check(c) {
+		problems = append(problems, err.Error())
+	}
+	mocks.AssertEquals(t, []string{
+		"command deploy: the channel strategy needs allowed_channels",
+		"command deploy: unknown allowed group devs",
+		"command noop: it has no command to run",
+		"command ping: the group auth strategy needs allowed_groups",
+		"command rollback: invalid auth strategy anyone",
+		"command rollback: invalid channel strategy somewhere",
+		"command rollback: unknown approval group managers",
+		"format: unknown locale klingon, the messages are in en",
+		"format: unknown template sucess",
+	}, problems)
+
+	c, err = config.New(strings.NewReader(dedent.Dedent(`
+		commands:
+		  echo:
+		    command: echo
+		    auth_strategy: any
+		`)))
+	mocks.Must(t, "could not parse configuration", err)
+	mocks.AssertEquals(t, 0, len(config.Check(c)))
+}
+
+func TestReadingTheConfigurationFromAStore(t *testing.T) {
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/kv/meeseeks/config" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("X-Consul-Index", "12")
+		fmt.Fprint(w, "pool: 3")
+	}))
+	defer consul.Close()
+
+	etcd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"kvs": [{"value": %q, "mod_revision": "4"}]}`,
+			base64.StdEncoding.EncodeToString([]byte("pool: 5")))
+	}))
+	defer etcd.Close()
+
+	tt := []struct {
+		name     string
+		location string
+		pool     int
+		err      string
+	}{
+		{
+			name:     "consul",
+			location: strings.Replace(consul.URL, "http://", "consul://", 1) + "/meeseeks/config",
+			pool:     3,
+		},
+		{
+			name:     "etcd",
+			location: strings.Replace(etcd.URL, "http://", "etcd://", 1) + "/meeseeks/config",
+			pool:     5,
+		},
+		{
+			name:     "missing key",
+			location: strings.Replace(consul.URL, "http://", "consul://", 1) + "/other",
+			err:      "could not read configuration from consul://.*/other: consul key other does not exist",
+		},
+		{
+			name:     "no key",
+			location: "etcd://localhost:2379",
+			err:      "etcd location etcd://localhost:2379 has no key",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := config.ReadFile(tc.location)
+			if tc.err != "" {
+				mocks.AssertMatches(t, tc.err, fmt.Sprint(err))
+				return
+			}
+			mocks.Must(t, "could not read configuration", err)
+			mocks.AssertEquals(t, tc.pool, c.Pool)
+		})
+	}
+}
+
+func TestConfigurationChangesInConsulAreWatched(t *testing.T) {
+	var lock sync.Mutex
+	index := 1
+	waiting := make(chan bool, 1)
+	changed := make(chan bool)
+
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		current := fmt.Sprint(index)
+		lock.Unlock()
+		if r.URL.Query().Get("index") == current {
+			waiting <- true
+			select { // Blocking query, it returns when the key changes
+			case <-changed:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		w.Header().Set("X-Consul-Index", fmt.Sprint(index))
+		fmt.Fprintf(w, "pool: %d", index)
+	}))
+	defer consul.Close()
+
+	reloaded := make(chan bool, 1)
+	stop := config.Watch(strings.Replace(consul.URL, "http://", "consul://", 1)+"/meeseeks/config", 0, func() {
+		reloaded <- true
+	})
+	defer stop()
+
+	select {
+	case <-waiting:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the configuration is not being watched")
+	}
+	lock.Lock()
+	index = 2
+	lock.Unlock()
+	changed <- true
+
+	select {
+	case <-reloaded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the configuration change was not picked up")
+	}
+}
+
+func TestConfigurationServedOverHTTPIsRefreshed(t *testing.T) {
+	var lock sync.Mutex
+	version := 1
+	fetched := make(chan bool, 10)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer s3cr3t" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		lock.Lock()
+		etag := fmt.Sprintf(`"v%d"`, version)
+		body := fmt.Sprintf(`{"pool": %d}`, version)
+		lock.Unlock()
+
+		select {
+		case fetched <- r.Header.Get("If-None-Match") == etag:
+		default:
+		}
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		fmt.Fprint(w, body)
+	}))
+	defer server.Close()
+
+	_, err := config.ReadFile(server.URL + "/config.json")
+	mocks.AssertMatches(t, "403 Forbidden", fmt.Sprint(err))
+
+	os.Setenv("MEESEEKS_CONFIG_AUTHORIZATION", "Bearer s3cr3t")
+	defer os.Unsetenv("MEESEEKS_CONFIG_AUTHORIZATION")
+
+	c, err := config.ReadFile(server.URL + "/config.json")
+	mocks.Must(t, "could not read configuration from the url", err)
+	mocks.AssertEquals(t, 1, c.Pool)
+	<-fetched
+
+	reloaded := make(chan bool, 1)
+	stop := config.Watch(server.URL+"/config.json", 10*time.Millisecond, func() {
+		reloaded <- true
+	})
+	defer stop()
+
+	for notModified := false; !notModified; { // Wait until the watch is polling with the ETag
+		select {
+		case notModified = <-fetched:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the configuration is not being refreshed")
+		}
+	}
+	lock.Lock()
+	version = 2
+	lock.Unlock()
+
+	select {
+	case <-reloaded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the configuration change was not picked up")
+	}
+}
+
+func TestMountedConfigMapChangesAreWatched(t *testing.T) {
+	dir, err := ioutil.TempDir("", "configmap")
+	mocks.Must(t, "could not create configmap directory", err)
+	defer os.RemoveAll(dir)
+
+	// Kubernetes mounts the keys as symlinks to a ..data symlink, which is
+	// swapped to a new directory on every update
+	writeVersion := func(version string) {
+		mocks.Must(t, "could not create version", os.Mkdir(filepath.Join(dir, version), 0755))
+		mocks.Must(t, "could not write config", ioutil.WriteFile(filepath.Join(dir, version, "config.yml"),
+			[]byte("pool: "+strings.TrimPrefix(version, "..v")), 0644))
+		mocks.Must(t, "could not link version", os.Symlink(version, filepath.Join(dir, "..data_tmp")))
+		mocks.Must(t, "could not swap version", os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")))
+	}
+	writeVersion("..v1")
+	mocks.Must(t, "could not link config", os.Symlink("..data/config.yml", filepath.Join(dir, "config.yml")))
+
+	reloaded := make(chan bool, 1)
+	stop := config.Watch(filepath.Join(dir, "config.yml"), 10*time.Millisecond, func() {
+		reloaded <- true
+	})
+	defer stop()
+
+	time.Sleep(50 * time.Millisecond)
+	writeVersion("..v2")
+
+	select {
+	case <-reloaded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the configmap change was not picked up")
+	}
+	c, err := config.ReadFile(filepath.Join(dir, "config.yml"))
+	mocks.Must(t, "could not read configuration", err)
+	mocks.AssertEquals(t, 2, c.Pool)
+}
+
+func TestCommandsAreReadFromTheirOwnFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "commands")
+	mocks.Must(t, "could not create commands directory", err)
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{
+		"deploy.yml":   "command: deploy\nowner: team-a\n",
+		"rollback.yml": "name: undo\ncommand: rollback\nowner: team-b\nsource: https://git.example.com/team-b\n",
+		"README.md":    "not a command",
+	} {
+		mocks.Must(t, "could not write command file", ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+
+	c, err := config.New(strings.NewReader(fmt.Sprintf("commands_path: %s\ncommands:\n  echo:\n    command: echo", dir)))
+	mocks.Must(t, "could not parse configuration", err)
+	mocks.AssertEquals(t, 3, len(c.Commands))
+	mocks.AssertEquals(t, "deploy", c.Commands["deploy"].Cmd)
+	mocks.AssertEquals(t, "team-a", c.Commands["deploy"].Owner)
+	mocks.AssertEquals(t, filepath.Join(dir, "deploy.yml"), c.Commands["deploy"].Source)
+	mocks.AssertEquals(t, "rollback", c.Commands["undo"].Cmd)
+	mocks.AssertEquals(t, "https://git.example.com/team-b", c.Commands["undo"].Source)
+
+	_, err = config.New(strings.NewReader(fmt.Sprintf("commands_path: %s\ncommands:\n  deploy:\n    command: echo", dir)))
+	mocks.AssertEquals(t, fmt.Sprintf("command deploy of %s is already defined", filepath.Join(dir, "deploy.yml")),
+		fmt.Sprint(err))
+}
+
+func TestConfigurationInOtherFormats(t *testing.T) {
+	tt := []struct {
+		name    string
+		content string
+	}{
+		{
+			name: "yaml",
+			content: dedent.Dedent(`
+				pool: 5
+				groups:
+				  admin: [pablo]
+				commands:
+				  echo:
+				    command: echo
+				    args: ["hello", "world"]
+				    timeout: 30
+				    labels:
+				      team: a
+				`),
+		},
+		{
+			name: "json",
+			content: `{
+				"pool": 5,
+				"groups": {"admin": ["pablo"]},
+				"commands": {
+					"echo": {
+						"command": "echo",
+						"args": ["hello", "world"],
+						"timeout": 30,
+						"labels": {"team": "a"}
+					}
+				}
+			}`,
+		},
+		{
+			name: "toml",
+			content: dedent.Dedent(`
+				# the pool is shared
+				pool = 5
+
+				[groups]
+				admin = [ "pablo" ]
+
+				[commands.echo]
+				command = "echo"
+				args = [
+				  "hello",
+				  'world', # trailing commas are fine
+				]
+				timeout = 30
+				labels = { team = "a" }
+				`),
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := config.New(strings.NewReader(tc.content))
+			mocks.Must(t, "could not parse configuration", err)
+			mocks.AssertEquals(t, 5, c.Pool)
+			mocks.AssertEquals(t, map[string][]string{"admin": {"pablo"}}, c.Groups)
+			mocks.AssertEquals(t, "echo", c.Commands["echo"].Cmd)
+			mocks.AssertEquals(t, []string{"hello", "world"}, c.Commands["echo"].Args)
+			mocks.AssertEquals(t, time.Duration(30), c.Commands["echo"].Timeout)
+			mocks.AssertEquals(t, map[string]string{"team": "a"}, c.Commands["echo"].Labels)
+		})
+	}
+
+	c, err := config.NewFormat(strings.NewReader(dedent.Dedent(`
+		[[agents]]
+		labels = { tier = "prod" }
+		commands = ["deploy"]
+
+		[[agents]]
+		commands = ["*"]
+		`)), config.FormatTOML)
+	mocks.Must(t, "could not parse arrays of tables", err)
+	mocks.AssertEquals(t, 2, len(c.Agents))
+	mocks.AssertEquals(t, []string{"*"}, c.Agents[1].Commands)
+
+	_, err = config.New(strings.NewReader("pool = 5\npool = 6"))
+	mocks.AssertEquals(t, `could not parse configuration: toml: line 2 (last key "pool"): Key 'pool' has already been defined.`, err.Error())
+
+	_, err = config.New(strings.NewReader("[groups]\nadmin = []\n\n[groups]\nops = []"))
+	mocks.AssertEquals(t, "could not parse configuration: toml: line 4: Key 'groups' has already been defined.", err.Error())
+
+	_, err = config.New(strings.NewReader("[commands.echo]\ncommand = \"echo"))
+	mocks.AssertEquals(t, `could not parse configuration: toml: line 1 (last key "commands.echo.command"): unexpected EOF; expected '"'`, err.Error())
+}
+
+func TestCommandDefaultsAreApplied(t *testing.T) {
+	c, err := config.New(strings.NewReader(dedent.Dedent(`
+		command_defaults:
+		  timeout: 120
+		  auth_strategy: group
+		  templates:
+		    success: "done"
+		    failure: "failed"
+		  reply_styles:
+		    success: text
+		commands:
+		  echo:
+		    command: echo
+		    allowed_groups: [admin]
+		  deploy:
+		    command: deploy
+		    timeout: 600
+		    auth_strategy: role
+		    templates:
+		      success: "deployed"
+		`)))
+	mocks.Must(t, "could not parse configuration", err)
+
+	echo := c.Commands["echo"]
+	mocks.AssertEquals(t, time.Duration(120), echo.Timeout)
+	mocks.AssertEquals(t, auth.AuthStrategyAllowedGroup, echo.AuthStrategy)
+	mocks.AssertEquals(t, map[string]string{"success": "done", "failure": "failed"}, echo.Templates)
+	mocks.AssertEquals(t, map[string]string{"success": "text"}, echo.ReplyStyle)
+
+	deploy := c.Commands["deploy"]
+	mocks.AssertEquals(t, time.Duration(600), deploy.Timeout)
+	mocks.AssertEquals(t, auth.AuthStrategyRole, deploy.AuthStrategy)
+	mocks.AssertEquals(t, map[string]string{"success": "deployed", "failure": "failed"}, deploy.Templates)
+}
+
+func TestTemplatesThatDontParseFailTheLoad(t *testing.T) {
+	tt := []struct {
+		name     string
+		config   string
+		expected string
+	}{
+		{
+			name: "format template",
+			config: dedent.Dedent(`
+				format:
+				  templates:
+				    success: "{{ .user "
+				`),
+			expected: "format: could not parse template success: template: success:1: unclosed action",
+		},
+		{
+			name: "channel template",
+			config: dedent.Dedent(`
+				format:
+				  channels:
+				    alerts:
+				      templates:
+				        success: "{{ .user "
+				`),
+			expected: "format of channel alerts: could not parse template success: template: success:1: unclosed action",
+		},
+		{
+			name: "command template",
+			config: dedent.Dedent(`
+				commands:
+				  deploy:
+				    command: deploy
+				    templates:
+				      failure: "{{ .error }}\n{{ end }}"
+				`),
+			expected: "command deploy: could not parse template failure: template: failure:2: unexpected {{end}}",
+		},
+		{
+			name: "default command template",
+			config: dedent.Dedent(`
+				command_defaults:
+				  templates:
+				    handshake: "{{ Unknown }}"
+				commands:
+				  echo:
+				    command: echo
+				`),
+			expected: "command echo: could not parse template handshake: template: handshake:1: " +
+				"function \"Unknown\" not defined",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := config.New(strings.NewReader(tc.config))
+			mocks.AssertEquals(t, tc.expected, fmt.Sprint(err))
+		})
+	}
+}
+
+func TestCommandTemplatesStampOutCommands(t *testing.T) {
+	c, err := config.New(strings.NewReader(dedent.Dedent(`
+		command_templates:
+		  kubectl:
+		    command: kubectl
+		    args: ["--context", "{{ .cluster }}", "--namespace", "{{ .namespace }}"]
+		    allowed_groups: ["{{ .cluster }}-admins"]
+		    timeout: "{{ .timeout }}"
+		    help:
+		      summary: "runs kubectl against {{ .cluster }}"
+		    templates:
+		      success: "{{ .user }} ran it"
+		    instances:
+		      kubectl-prod:
+		        cluster: prod
+		        namespace: default
+		        timeout: 60
+		      kubectl-staging:
+		        cluster: staging
+		        namespace: apps
+		        timeout: 30
+		commands:
+		  echo:
+		    command: echo
+		`)))
+	mocks.Must(t, "could not parse configuration", err)
+
+	mocks.AssertEquals(t, 3, len(c.Commands))
+	prod := c.Commands["kubectl-prod"]
+	mocks.AssertEquals(t, "kubectl", prod.Cmd)
+	mocks.AssertEquals(t, []string{"--context", "prod", "--namespace", "default"}, prod.Args)
+	mocks.AssertEquals(t, []string{"prod-admins"}, prod.AllowedGroups)
+	mocks.AssertEquals(t, time.Duration(60), prod.Timeout)
+	mocks.AssertEquals(t, "runs kubectl against prod", prod.Help.Summary)
+	mocks.AssertEquals(t, map[string]string{"success": "{{ .user }} ran it"}, prod.Templates)
+
+	staging := c.Commands["kubectl-staging"]
+	mocks.AssertEquals(t, []string{"--context", "staging", "--namespace", "apps"}, staging.Args)
+	mocks.AssertEquals(t, time.Duration(30), staging.Timeout)
+}
+
+func TestInvalidCommandTemplatesAreRejected(t *testing.T) {
+	tt := []struct {
+		name     string
+		config   string
+		expected string
+	}{
+		{
+			name: "no instances",
+			config: `
+command_templates:
+  kubectl:
+    command: kubectl
+`,
+			expected: "command template kubectl has no instances",
+		},
+		{
+			name: "missing parameter",
+			config: `
+command_templates:
+  kubectl:
+    command: kubectl
+    args: ["{{ .cluster }}"]
+    instances:
+      kubectl-prod:
+        namespace: default
+`,
+			expected: "instance kubectl-prod of command template kubectl: args could not render",
+		},
+		{
+			name: "command already defined",
+			config: `
+command_templates:
+  kubectl:
+    command: kubectl
+    instances:
+      kubectl-prod: {}
+commands:
+  kubectl-prod:
+    command: kubectl
+`,
+			expected: "command kubectl-prod of command template kubectl is already defined",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := config.New(strings.NewReader(tc.config))
+			mocks.AssertMatches(t, tc.expected, fmt.Sprint(err))
+		})
+	}
+}
+
+func TestStrictConfigurationsRejectUnknownKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "commands")
+	mocks.Must(t, "could not create commands directory", err)
+	defer os.RemoveAll(dir)
+	mocks.Must(t, "could not write command file", ioutil.WriteFile(filepath.Join(dir, "deploy.yml"),
+		[]byte("command: deploy\nalowed_groups: [ops]\n"), 0644))
+
+	tt := []struct {
+		name     string
+		config   string
+		expected string
+	}{
+		{
+			name: "valid",
+			config: dedent.Dedent(`
+				pool: 2
+				groups:
+				  admin: [pablo]
+				format:
+				  reply_styles:
+				    success: text
+				command_templates:
+				  kubectl:
+				    command: kubectl
+				    args: ["{{ .cluster }}"]
+				    instances:
+				      kubectl-prod:
+				        cluster: prod
+				commands:
+				  echo:
+				    command: echo
+				    allowed_groups: [admin]
+				    stream:
+				      lines: 10
+				    labels:
+				      anything: goes
+				`),
+			expected: "<nil>",
+		},
+		{
+			name: "misspelled keys",
+			config: dedent.Dedent(`
+				pool_size: 2
+				commands:
+				  echo:
+				    command: echo
+				    alowed_groups: [admin]
+				    help:
+				      sumary: echoes
+				`),
+			expected: "unknown keys commands.echo.alowed_groups, commands.echo.help.sumary, pool_size",
+		},
+		{
+			name: "misspelled key in a command template",
+			config: dedent.Dedent(`
+				command_templates:
+				  kubectl:
+				    comand: kubectl
+				    instances:
+				      kubectl-prod: {}
+				`),
+			expected: "unknown keys commands.kubectl-prod.comand",
+		},
+		{
+			name:     "misspelled key in a command file",
+			config:   "commands_path: " + dir,
+			expected: "command file " + filepath.Join(dir, "deploy.yml") + ": unknown keys alowed_groups",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := config.New(strings.NewReader(tc.config))
+			mocks.Must(t, "unknown keys should be ignored unless strict", err)
+
+			config.SetStrict(true)
+			defer config.SetStrict(false)
+
+			_, err = config.New(strings.NewReader(tc.config))
+			mocks.AssertEquals(t, tc.expected, fmt.Sprint(err))
+		})
+	}
+}
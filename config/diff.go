@@ -0,0 +1,178 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Diff is what changed between two configurations, the commands and groups
+// one by one and the rest by the sections that changed
+type Diff struct {
+	CommandsAdded   []string
+	CommandsRemoved []string
+	CommandsChanged map[string][]string
+	GroupsAdded     []string
+	GroupsRemoved   []string
+	GroupsChanged   map[string]MembersDiff
+	Sections        []string
+}
+
+// MembersDiff is who was added to a group and who was removed from it
+type MembersDiff struct {
+	Added   []string
+	Removed []string
+}
+
+// Empty returns true when nothing changed
+func (d Diff) Empty() bool {
+	return len(d.CommandsAdded) == 0 && len(d.CommandsRemoved) == 0 && len(d.CommandsChanged) == 0 &&
+		len(d.GroupsAdded) == 0 && len(d.GroupsRemoved) == 0 && len(d.GroupsChanged) == 0 &&
+		len(d.Sections) == 0
+}
+
+// String returns the diff as a single line, like
+// commands added: deploy; groups changed: admin (+alice -bob)
+func (d Diff) String() string {
+	if d.Empty() {
+		return "nothing changed"
+	}
+
+	parts := make([]string, 0)
+	add := func(title string, items []string) {
+		if len(items) > 0 {
+			parts = append(parts, fmt.Sprintf("%s: %s", title, strings.Join(items, ", ")))
+		}
+	}
+
+	changed := make([]string, 0, len(d.CommandsChanged))
+	for _, name := range sortedKeys(d.CommandsChanged) {
+		changed = append(changed, fmt.Sprintf("%s (%s)", name, strings.Join(d.CommandsChanged[name], ", ")))
+	}
+	add("commands added", d.CommandsAdded)
+	add("commands removed", d.CommandsRemoved)
+	add("commands changed", changed)
+
+	changed = make([]string, 0, len(d.GroupsChanged))
+	for _, name := range sortedKeys(d.GroupsChanged) {
+		members := make([]string, 0)
+		for _, m := range d.GroupsChanged[name].Added {
+			members = append(members, "+"+m)
+		}
+		for _, m := range d.GroupsChanged[name].Removed {
+			members = append(members, "-"+m)
+		}
+		changed = append(changed, fmt.Sprintf("%s (%s)", name, strings.Join(members, " ")))
+	}
+	add("groups added", d.GroupsAdded)
+	add("groups removed", d.GroupsRemoved)
+	add("groups changed", changed)
+
+	add("sections changed", d.Sections)
+	return strings.Join(parts, "; ")
+}
+
+// Compare returns what changed from one configuration to the next one
+func Compare(before, after Config) Diff {
+	d := Diff{
+		CommandsAdded:   make([]string, 0),
+		CommandsRemoved: make([]string, 0),
+		CommandsChanged: make(map[string][]string),
+		GroupsAdded:     make([]string, 0),
+		GroupsRemoved:   make([]string, 0),
+		GroupsChanged:   make(map[string]MembersDiff),
+		Sections:        make([]string, 0),
+	}
+
+	for name, cmd := range after.Commands {
+		previous, ok := before.Commands[name]
+		if !ok {
+			d.CommandsAdded = append(d.CommandsAdded, name)
+			continue
+		}
+		if fields := changedFields(previous, cmd); len(fields) > 0 {
+			d.CommandsChanged[name] = fields
+		}
+	}
+	for name := range before.Commands {
+		if _, ok := after.Commands[name]; !ok {
+			d.CommandsRemoved = append(d.CommandsRemoved, name)
+		}
+	}
+
+	for name, members := range after.Groups {
+		previous, ok := before.Groups[name]
+		if !ok {
+			d.GroupsAdded = append(d.GroupsAdded, name)
+			continue
+		}
+		m := MembersDiff{
+			Added:   missingFrom(previous, members),
+			Removed: missingFrom(members, previous),
+		}
+		if len(m.Added) > 0 || len(m.Removed) > 0 {
+			d.GroupsChanged[name] = m
+		}
+	}
+	for name := range before.Groups {
+		if _, ok := after.Groups[name]; !ok {
+			d.GroupsRemoved = append(d.GroupsRemoved, name)
+		}
+	}
+
+	for _, field := range changedFields(before, after) {
+		if field != "commands" && field != "groups" {
+			d.Sections = append(d.Sections, field)
+		}
+	}
+
+	sort.Strings(d.CommandsAdded)
+	sort.Strings(d.CommandsRemoved)
+	sort.Strings(d.GroupsAdded)
+	sort.Strings(d.GroupsRemoved)
+	return d
+}
+
+// changedFields returns the yaml names of the fields that are different
+// between two structs of the same type, in the order they are declared
+func changedFields(before, after interface{}) []string {
+	o, n := reflect.ValueOf(before), reflect.ValueOf(after)
+	fields := make([]string, 0)
+	for i := 0; i < o.NumField(); i++ {
+		if reflect.DeepEqual(o.Field(i).Interface(), n.Field(i).Interface()) {
+			continue
+		}
+		name := strings.Split(o.Type().Field(i).Tag.Get("yaml"), ",")[0]
+		if name == "" {
+			name = strings.ToLower(o.Type().Field(i).Name)
+		}
+		fields = append(fields, name)
+	}
+	return fields
+}
+
+// missingFrom returns the values that are not in the list, sorted
+func missingFrom(list, values []string) []string {
+	in := make(map[string]bool, len(list))
+	for _, v := range list {
+		in[v] = true
+	}
+	missing := make([]string, 0)
+	for _, v := range values {
+		if !in[v] {
+			missing = append(missing, v)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+func sortedKeys(m interface{}) []string {
+	keys := make([]string, 0)
+	for _, k := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,139 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ReadDir reads the fragments of a configuration directory and merges them
+// into a configuration, conf.d style
+//
+// The fragments are the .yml, .yaml, .json and .toml files of the directory,
+// merged in the order of their names: maps are merged key by key and lists
+// are appended, so each fragment can add its own commands and members to the
+// groups. A command can only be defined in one fragment, and a value can't be
+// set to something different by two of them
+func ReadDir(dirname string) (Config, error) {
+	files, err := ioutil.ReadDir(dirname)
+	if err != nil {
+		return Config{}, fmt.Errorf("could not open configuration directory %s: %s", dirname, err)
+	}
+
+	merged := map[interface{}]interface{}{}
+	owners := map[string]string{}
+	fragments := 0
+	for _, f := range files { // ReadDir sorts them by name
+		if !isFragment(f) {
+			continue
+		}
+		fragments++
+
+		b, err := ioutil.ReadFile(filepath.Join(dirname, f.Name()))
+		if err != nil {
+			return Config{}, fmt.Errorf("could not read configuration fragment %s: %s", f.Name(), err)
+		}
+		b, err = toYAML(b, formatOf(f.Name()))
+		if err != nil {
+			return Config{}, fmt.Errorf("configuration fragment %s: %s", f.Name(), err)
+		}
+		fragment := map[interface{}]interface{}{}
+		if err := yaml.Unmarshal(b, &fragment); err != nil {
+			return Config{}, fmt.Errorf("could not parse configuration fragment %s: %s", f.Name(), err)
+		}
+		if err := mergeFragment(merged, fragment, "", f.Name(), owners); err != nil {
+			return Config{}, fmt.Errorf("could not merge configuration fragment %s: %s", f.Name(), err)
+		}
+	}
+	if fragments == 0 {
+		return Config{}, fmt.Errorf("configuration directory %s has no yaml files", dirname)
+	}
+
+	b, err := yaml.Marshal(merged)
+	if err != nil {
+		return Config{}, fmt.Errorf("could not merge configuration fragments: %s", err)
+	}
+	cnf, err := New(bytes.NewReader(b))
+	if err != nil {
+		return cnf, fmt.Errorf("configuration is invalid: %s", err)
+	}
+	return cnf, nil
+}
+
+// isFragment returns true for the files of a configuration directory that are
+// merged, the ones that are not hidden with a yaml, json or toml extension
+func isFragment(f os.FileInfo) bool {
+	return !f.IsDir() && !strings.HasPrefix(f.Name(), ".") && formatOf(f.Name()) != ""
+}
+
+// mergeFragment merges the fragment into the configuration merged so far,
+// owners keeps which fragment set each key to point to it on conflicts
+func mergeFragment(into, fragment map[interface{}]interface{}, path, file string, owners map[string]string) error {
+	keys := make([]interface{}, 0, len(fragment))
+	for k := range fragment {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j]) })
+
+	for _, k := range keys {
+		value := fragment[k]
+		key := fmt.Sprint(k)
+		if path != "" {
+			key = path + "." + key
+		}
+
+		existing, ok := into[k]
+		if !ok {
+			into[k] = value
+			owners[key] = file
+			continue
+		}
+		if path == "commands" {
+			return fmt.Errorf("command %s is already defined in %s", k, ownerOf(key, owners))
+		}
+
+		switch e := existing.(type) {
+		case map[interface{}]interface{}:
+			m, ok := value.(map[interface{}]interface{})
+			if !ok {
+				return fmt.Errorf("%s is a map in %s", key, ownerOf(key, owners))
+			}
+			if err := mergeFragment(e, m, key, file, owners); err != nil {
+				return err
+			}
+		case []interface{}:
+			l, ok := value.([]interface{})
+			if !ok {
+				return fmt.Errorf("%s is a list in %s", key, ownerOf(key, owners))
+			}
+			into[k] = append(e, l...)
+		default:
+			if !reflect.DeepEqual(existing, value) {
+				return fmt.Errorf("%s is already set to %v in %s", key, existing, ownerOf(key, owners))
+			}
+		}
+	}
+	return nil
+}
+
+// ownerOf returns the fragment that set the key, or the closest map that
+// holds it
+func ownerOf(key string, owners map[string]string) string {
+	for {
+		if owner, ok := owners[key]; ok {
+			return owner
+		}
+		i := strings.LastIndex(key, ".")
+		if i < 0 {
+			return ""
+		}
+		key = key[:i]
+	}
+}
@@ -0,0 +1,126 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// envPattern matches ${VAR}, ${VAR:-default} and ${VAR:?error}, along with $${
+// which escapes a literal ${
+var envPattern = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)(?::([-?])([^}]*))?\}`)
+
+// Expanded values that are taken as numbers or booleans instead of strings
+var (
+	intPattern  = regexp.MustCompile(`^(0|-?[1-9][0-9]*)$`)
+	boolPattern = regexp.MustCompile(`^(true|false)$`)
+)
+
+// expandConfigEnv parses the configuration, replaces the environment
+// variables in its values and returns it serialized again
+func expandConfigEnv(b []byte) ([]byte, error) {
+	parsed := map[interface{}]interface{}{}
+	if err := yaml.Unmarshal(b, &parsed); err != nil {
+		return nil, fmt.Errorf("could not parse configuration: %s", err)
+	}
+	expanded, err := expandEnv(parsed, "")
+	if err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(expanded)
+}
+
+// expandEnv replaces the environment variables in the values of the parsed
+// configuration, walking through its maps and lists
+func expandEnv(node interface{}, path string) (interface{}, error) {
+	switch n := node.(type) {
+	case map[interface{}]interface{}:
+		keys := make([]string, 0, len(n))
+		byName := make(map[string]interface{}, len(n))
+		for k := range n {
+			keys = append(keys, fmt.Sprint(k))
+			byName[fmt.Sprint(k)] = k
+		}
+		sort.Strings(keys) // Sort them to return stable errors
+		for _, key := range keys {
+			k := byName[key]
+			if path != "" {
+				key = path + "." + key
+			}
+			v, err := expandEnv(n[k], key)
+			if err != nil {
+				return nil, err
+			}
+			n[k] = v
+		}
+		return n, nil
+
+	case []interface{}:
+		for i, item := range n {
+			v, err := expandEnv(item, fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return nil, err
+			}
+			n[i] = v
+		}
+		return n, nil
+
+	case string:
+		expanded, err := expandString(n)
+		if err != nil {
+			return nil, fmt.Errorf("could not expand %s: %s", path, err)
+		}
+		if expanded == n {
+			return n, nil
+		}
+		// A value that is only a number or a boolean once expanded is taken
+		// as such, so variables can set the pool or a flag too
+		if intPattern.MatchString(expanded) {
+			if i, err := strconv.Atoi(expanded); err == nil {
+				return i, nil
+			}
+		}
+		if boolPattern.MatchString(expanded) {
+			return expanded == "true", nil
+		}
+		return expanded, nil
+	}
+	return node, nil
+}
+
+// expandString replaces the environment variables in the value like a shell
+// does: ${VAR} is empty when VAR is not set or empty, ${VAR:-default} falls
+// back to the default and ${VAR:?error} fails with the error
+func expandString(value string) (string, error) {
+	var err error
+	expanded := envPattern.ReplaceAllStringFunc(value, func(match string) string {
+		if match == "$${" {
+			return "${"
+		}
+		parts := envPattern.FindStringSubmatch(match)
+		name, op, arg := parts[1], parts[2], parts[3]
+
+		v := os.Getenv(name)
+		if v != "" {
+			return v
+		}
+		switch op {
+		case "-":
+			return arg
+		case "?":
+			if err == nil {
+				if strings.TrimSpace(arg) == "" {
+					arg = "it's required"
+				}
+				err = fmt.Errorf("%s is not set, %s", name, arg)
+			}
+		}
+		return ""
+	})
+	return expanded, err
+}
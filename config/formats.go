@@ -0,0 +1,132 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// The formats the configuration can be written in, all of them are read into
+// the same configuration with the same keys
+const (
+	FormatYAML = "yaml"
+	FormatJSON = "json"
+	FormatTOML = "toml"
+)
+
+// tomlLine matches the first line of a TOML document, a table or a key
+var tomlLine = regexp.MustCompile(`^(\[\[?[A-Za-z0-9_"'. -]+\]\]?|[A-Za-z0-9_"'.-]+\s*=)`)
+
+// formatOf returns the format of a file by its extension, or empty when it
+// has to be detected from its content
+func formatOf(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yml", ".yaml":
+		return FormatYAML
+	case ".json":
+		return FormatJSON
+	case ".toml":
+		return FormatTOML
+	}
+	return ""
+}
+
+// detectFormat guesses the format from the first line that is not blank or a
+// comment, anything that is not JSON or TOML is taken as YAML
+func detectFormat(b []byte) string {
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(line, "{"):
+			return FormatJSON
+		case tomlLine.MatchString(line):
+			return FormatTOML
+		}
+		return FormatYAML
+	}
+	return FormatYAML
+}
+
+// toYAML converts the configuration to YAML from its format, detecting it
+// when it's empty
+func toYAML(b []byte, format string) ([]byte, error) {
+	if format == "" {
+		format = detectFormat(b)
+	}
+
+	var parsed interface{}
+	switch format {
+	case FormatJSON:
+		d := json.NewDecoder(bytes.NewReader(b))
+		d.UseNumber()
+		if err := d.Decode(&parsed); err != nil {
+			return nil, fmt.Errorf("could not parse configuration: %s", err)
+		}
+		parsed = jsonNumbers(parsed)
+
+	case FormatTOML:
+		t := map[string]interface{}{}
+		if err := toml.Unmarshal(b, &t); err != nil {
+			return nil, fmt.Errorf("could not parse configuration: %s", err)
+		}
+		parsed = tomlDates(t)
+
+	default:
+		return b, nil
+	}
+	return yaml.Marshal(parsed)
+}
+
+// jsonNumbers replaces the JSON numbers with integers when they are, so they
+// are not turned into floats on the way to YAML
+func jsonNumbers(v interface{}) interface{} {
+	switch n := v.(type) {
+	case map[string]interface{}:
+		for k, item := range n {
+			n[k] = jsonNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range n {
+			n[i] = jsonNumbers(item)
+		}
+	case json.Number:
+		if i, err := n.Int64(); err == nil {
+			return i
+		}
+		f, _ := n.Float64()
+		return f
+	}
+	return v
+}
+
+// tomlDates replaces the TOML dates and times with strings, the configuration
+// has none and they are kept the way they were written
+func tomlDates(v interface{}) interface{} {
+	switch n := v.(type) {
+	case map[string]interface{}:
+		for k, item := range n {
+			n[k] = tomlDates(item)
+		}
+	case []map[string]interface{}:
+		for _, item := range n {
+			tomlDates(item)
+		}
+	case []interface{}:
+		for i, item := range n {
+			n[i] = tomlDates(item)
+		}
+	case time.Time:
+		return n.Format(time.RFC3339Nano)
+	}
+	return v
+}
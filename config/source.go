@@ -0,0 +1,348 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Source is a key in a remote store the configuration is read from instead
+// of a file, so it can be changed for a whole fleet at once
+type Source interface {
+	// Read returns the configuration and the index it was modified at
+	Read() ([]byte, uint64, error)
+	// Wait blocks until the key is modified after the index and returns the
+	// new one, or the same one when it gives up waiting
+	Wait(ctx context.Context, index uint64) (uint64, error)
+}
+
+// watchTimeout is how long a single wait for a change lasts
+const watchTimeout = 5 * time.Minute
+
+// watchRetry is how long to wait after the store fails before trying again
+const watchRetry = 5 * time.Second
+
+// NewSource returns the source of a location like consul://host:8500/key or
+// etcd://host:2379/key, with consul+https or etcd+https to use TLS, or an
+// http or https url. It returns nil when the location is not a remote store,
+// but a path
+//
+// The consul token is taken from CONSUL_HTTP_TOKEN, like the consul cli does,
+// and the Authorization header of the urls from MEESEEKS_CONFIG_AUTHORIZATION
+func NewSource(location string) (Source, error) {
+	u, err := url.Parse(location)
+	if err != nil || u.Host == "" {
+		return nil, nil
+	}
+
+	scheme := "http"
+	store := u.Scheme
+	if strings.HasSuffix(store, "+https") {
+		scheme = "https"
+		store = strings.TrimSuffix(store, "+https")
+	}
+	key := strings.Trim(u.Path, "/")
+
+	switch store {
+	case "http", "https":
+		return &httpSource{
+			url:           location,
+			authorization: os.Getenv("MEESEEKS_CONFIG_AUTHORIZATION"),
+		}, nil
+	case "consul":
+		if key == "" {
+			return nil, fmt.Errorf("consul location %s has no key", location)
+		}
+		return consulSource{
+			address: fmt.Sprintf("%s://%s", scheme, u.Host),
+			key:     key,
+			token:   os.Getenv("CONSUL_HTTP_TOKEN"),
+		}, nil
+	case "etcd":
+		if key == "" {
+			return nil, fmt.Errorf("etcd location %s has no key", location)
+		}
+		return etcdSource{
+			address: fmt.Sprintf("%s://%s", scheme, u.Host),
+			key:     "/" + key,
+		}, nil
+	}
+	return nil, nil
+}
+
+// readSource reads the configuration from the remote store
+func readSource(location string, source Source) (Config, error) {
+	b, _, err := source.Read()
+	if err != nil {
+		return Config{}, fmt.Errorf("could not read configuration from %s: %s", location, err)
+	}
+	format := ""
+	if u, err := url.Parse(location); err == nil {
+		format = formatOf(u.Path)
+	}
+	cnf, err := NewFormat(bytes.NewReader(b), format)
+	if err != nil {
+		return cnf, fmt.Errorf("configuration is invalid: %s", err)
+	}
+	return cnf, nil
+}
+
+type consulSource struct {
+	address string
+	key     string
+	token   string
+}
+
+func (c consulSource) Read() ([]byte, uint64, error) {
+	return c.get(context.Background(), "")
+}
+
+func (c consulSource) Wait(ctx context.Context, index uint64) (uint64, error) {
+	_, next, err := c.get(ctx, fmt.Sprintf("&index=%d&wait=%s", index, watchTimeout))
+	return next, err
+}
+
+// get reads the raw value of the key, a blocking query when the query has an
+// index
+func (c consulSource) get(ctx context.Context, query string) ([]byte, uint64, error) {
+	r, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/v1/kv/%s?raw%s", c.address, c.key, query), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if c.token != "" {
+		r.Header.Set("X-Consul-Token", c.token)
+	}
+
+	client := http.Client{Timeout: watchTimeout + 30*time.Second}
+	resp, err := client.Do(r.WithContext(ctx))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, 0, fmt.Errorf("consul key %s does not exist", c.key)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("consul returned %s", resp.Status)
+	}
+	index, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("consul returned an invalid index: %s", err)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	return b, index, err
+}
+
+type etcdSource struct {
+	address string
+	key     string
+}
+
+// etcdKeyValue is a key of the etcd v3 JSON gateway, where the keys and the
+// values are encoded in base64 and the numbers are strings
+type etcdKeyValue struct {
+	Value       string `json:"value"`
+	ModRevision string `json:"mod_revision"`
+}
+
+func (e etcdSource) Read() ([]byte, uint64, error) {
+	reply := struct {
+		Kvs []etcdKeyValue `json:"kvs"`
+	}{}
+	resp, err := e.post(context.Background(), "/v3/kv/range", map[string]interface{}{
+		"key": base64.StdEncoding.EncodeToString([]byte(e.key)),
+	}, 30*time.Second)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return nil, 0, fmt.Errorf("could not parse the reply of etcd: %s", err)
+	}
+	if len(reply.Kvs) == 0 {
+		return nil, 0, fmt.Errorf("etcd key %s does not exist", e.key)
+	}
+	return e.decode(reply.Kvs[0])
+}
+
+// Wait watches the key from the next revision, the gateway streams the
+// watch responses one after the other until one has the events
+func (e etcdSource) Wait(ctx context.Context, index uint64) (uint64, error) {
+	ctx, cancel := context.WithTimeout(ctx, watchTimeout)
+	defer cancel()
+
+	resp, err := e.post(ctx, "/v3/watch", map[string]interface{}{
+		"create_request": map[string]interface{}{
+			"key":            base64.StdEncoding.EncodeToString([]byte(e.key)),
+			"start_revision": strconv.FormatUint(index+1, 10),
+		},
+	}, 0)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return index, nil
+		}
+		return index, err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		watch := struct {
+			Result struct {
+				Header struct {
+					Revision string `json:"revision"`
+				} `json:"header"`
+				Events []struct {
+					Kv etcdKeyValue `json:"kv"`
+				} `json:"events"`
+			} `json:"result"`
+		}{}
+		if err := decoder.Decode(&watch); err != nil {
+			if ctx.Err() == context.DeadlineExceeded {
+				return index, nil
+			}
+			return index, fmt.Errorf("could not parse the watch of etcd: %s", err)
+		}
+		if len(watch.Result.Events) == 0 {
+			continue
+		}
+		// A deleted key has no revision of its own, the one of the store is
+		// good enough to reload and fail reading it
+		revision := watch.Result.Events[len(watch.Result.Events)-1].Kv.ModRevision
+		if revision == "" {
+			revision = watch.Result.Header.Revision
+		}
+		return strconv.ParseUint(revision, 10, 64)
+	}
+}
+
+func (e etcdSource) post(ctx context.Context, path string, payload interface{}, timeout time.Duration) (*http.Response, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	r, err := http.NewRequest(http.MethodPost, e.address+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", "application/json")
+
+	client := http.Client{Timeout: timeout}
+	resp, err := client.Do(r.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("etcd returned %s", resp.Status)
+	}
+	return resp, nil
+}
+
+func (e etcdSource) decode(kv etcdKeyValue) ([]byte, uint64, error) {
+	b, err := base64.StdEncoding.DecodeString(kv.Value)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not decode the value of etcd: %s", err)
+	}
+	index, err := strconv.ParseUint(kv.ModRevision, 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("etcd returned an invalid revision: %s", err)
+	}
+	return b, index, nil
+}
+
+// httpSource is a configuration served over http, it has no way of notifying
+// changes so it's polled on an interval, asking for it only if its ETag
+// changed. Its index is a hash of the ETag, or of the content when there is
+// none
+type httpSource struct {
+	url           string
+	authorization string
+	interval      time.Duration
+
+	lock sync.Mutex
+	etag string
+}
+
+func (h *httpSource) Read() ([]byte, uint64, error) {
+	b, index, _, err := h.get(context.Background(), "")
+	return b, index, err
+}
+
+// Wait polls the url after the interval, it returns the same index when it
+// was not modified
+func (h *httpSource) Wait(ctx context.Context, index uint64) (uint64, error) {
+	select {
+	case <-ctx.Done():
+		return index, nil
+	case <-time.After(h.interval):
+	}
+
+	h.lock.Lock()
+	etag := h.etag
+	h.lock.Unlock()
+
+	_, next, modified, err := h.get(ctx, etag)
+	if err != nil || !modified {
+		return index, err
+	}
+	return next, nil
+}
+
+// get reads the configuration unless it still has the etag
+func (h *httpSource) get(ctx context.Context, etag string) ([]byte, uint64, bool, error) {
+	r, err := http.NewRequest(http.MethodGet, h.url, nil)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	if h.authorization != "" {
+		r.Header.Set("Authorization", h.authorization)
+	}
+	if etag != "" {
+		r.Header.Set("If-None-Match", etag)
+	}
+
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(r.WithContext(ctx))
+	if err != nil {
+		return nil, 0, false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, 0, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, false, fmt.Errorf("%s returned %s", h.url, resp.Status)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	etag = resp.Header.Get("ETag")
+	h.lock.Lock()
+	h.etag = etag
+	h.lock.Unlock()
+
+	hash := fnv.New64a()
+	if etag != "" {
+		hash.Write([]byte(etag))
+	} else {
+		hash.Write(b)
+	}
+	return b, hash.Sum64(), true, nil
+}
@@ -0,0 +1,153 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+var strict bool
+var strictMutex sync.Mutex
+
+// SetStrict sets whether the configurations with keys that are not known
+// fail to load, instead of ignoring them, like a misspelled allowed_groups
+// which leaves a command open to everyone
+func SetStrict(enabled bool) {
+	strictMutex.Lock()
+	defer strictMutex.Unlock()
+
+	strict = enabled
+}
+
+func isStrict() bool {
+	strictMutex.Lock()
+	defer strictMutex.Unlock()
+
+	return strict
+}
+
+// checkKnownKeys fails with all the keys of the configuration that the value
+// doesn't have when the strict mode is on
+func checkKnownKeys(b []byte, value interface{}) error {
+	if !isStrict() {
+		return nil
+	}
+
+	parsed := map[interface{}]interface{}{}
+	if err := yaml.Unmarshal(b, &parsed); err != nil {
+		return fmt.Errorf("could not parse configuration: %s", err)
+	}
+	unknown := unknownKeys(parsed, reflect.TypeOf(value), "")
+	if len(unknown) == 0 {
+		return nil
+	}
+	sort.Strings(unknown)
+	return fmt.Errorf("unknown keys %s", strings.Join(unknown, ", "))
+}
+
+var unmarshalerType = reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem()
+
+// unknownKeys walks through the parsed configuration along with the type it
+// is unmarshalled into, and returns the path of the keys the type doesn't
+// have a field for
+func unknownKeys(node interface{}, t reflect.Type, path string) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if reflect.PtrTo(t).Implements(unmarshalerType) {
+		return nil
+	}
+
+	unknown := make([]string, 0)
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := node.(map[interface{}]interface{})
+		if !ok {
+			return nil
+		}
+		fields, open := yamlFields(t)
+		if open {
+			return nil
+		}
+		for k, v := range m {
+			key := fmt.Sprint(k)
+			field, ok := fields[key]
+			if !ok {
+				unknown = append(unknown, joinPath(path, key))
+				continue
+			}
+			unknown = append(unknown, unknownKeys(v, field, joinPath(path, key))...)
+		}
+
+	case reflect.Map:
+		m, ok := node.(map[interface{}]interface{})
+		if !ok {
+			return nil
+		}
+		for k, v := range m {
+			unknown = append(unknown, unknownKeys(v, t.Elem(), joinPath(path, fmt.Sprint(k)))...)
+		}
+
+	case reflect.Slice, reflect.Array:
+		l, ok := node.([]interface{})
+		if !ok {
+			return nil
+		}
+		for i, v := range l {
+			unknown = append(unknown, unknownKeys(v, t.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	}
+	return unknown
+}
+
+// yamlFields returns the types of the fields of a struct by their yaml keys,
+// with the ones of the inlined structs, and whether it inlines a map that
+// takes any key
+func yamlFields(t reflect.Type) (map[string]reflect.Type, bool) {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" && !f.Anonymous { // Unexported
+			continue
+		}
+		tag := strings.Split(f.Tag.Get("yaml"), ",")
+		if tag[0] == "-" {
+			continue
+		}
+		inline := false
+		for _, flag := range tag[1:] {
+			inline = inline || flag == "inline"
+		}
+		if inline {
+			if f.Type.Kind() == reflect.Map {
+				return nil, true
+			}
+			inlined, open := yamlFields(f.Type)
+			if open {
+				return nil, true
+			}
+			for k, v := range inlined {
+				fields[k] = v
+			}
+			continue
+		}
+
+		name := tag[0]
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = f.Type
+	}
+	return fields, false
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
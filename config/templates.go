@@ -0,0 +1,151 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"text/template"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// expandCommandTemplates parses the configuration, stamps out a command for
+// each instance of its command templates and returns it serialized again
+//
+// A command template is a command with an instances map, each instance is the
+// name of a command and the parameters its values are rendered with, like
+// {{ .cluster }}. The templates of the messages of the command are left as
+// they are, they are rendered when the command replies
+func expandCommandTemplates(b []byte) ([]byte, error) {
+	parsed := map[interface{}]interface{}{}
+	if err := yaml.Unmarshal(b, &parsed); err != nil {
+		return nil, fmt.Errorf("could not parse configuration: %s", err)
+	}
+	templates, ok := parsed["command_templates"]
+	if !ok {
+		return b, nil
+	}
+	delete(parsed, "command_templates")
+
+	templatesMap, ok := templates.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("command_templates has to be a map of command templates")
+	}
+	cmds, ok := parsed["commands"].(map[interface{}]interface{})
+	if !ok {
+		if parsed["commands"] != nil {
+			return nil, fmt.Errorf("commands has to be a map of commands")
+		}
+		cmds = map[interface{}]interface{}{}
+		parsed["commands"] = cmds
+	}
+
+	for _, name := range sortedNames(templatesMap) { // Sort them to return stable errors
+		tmpl, ok := templatesMap[name].(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("command template %s has to be a command", name)
+		}
+		instances, ok := tmpl["instances"].(map[interface{}]interface{})
+		if !ok || len(instances) == 0 {
+			return nil, fmt.Errorf("command template %s has no instances", name)
+		}
+
+		for _, instance := range sortedNames(instances) {
+			if _, ok := cmds[instance]; ok {
+				return nil, fmt.Errorf("command %s of command template %s is already defined", instance, name)
+			}
+			params := map[string]string{}
+			if instances[instance] != nil {
+				values, ok := instances[instance].(map[interface{}]interface{})
+				if !ok {
+					return nil, fmt.Errorf("instance %s of command template %s has to be a map of parameters",
+						instance, name)
+				}
+				for k, v := range values {
+					params[fmt.Sprint(k)] = fmt.Sprint(v)
+				}
+			}
+
+			cmd := make(map[interface{}]interface{}, len(tmpl))
+			for k, v := range tmpl {
+				switch k {
+				case "instances":
+				case "templates":
+					cmd[k] = v
+				default:
+					rendered, err := renderParams(v, params)
+					if err != nil {
+						return nil, fmt.Errorf("instance %s of command template %s: %s %s", instance, name, k, err)
+					}
+					cmd[k] = rendered
+				}
+			}
+			cmds[instance] = cmd
+		}
+	}
+	return yaml.Marshal(parsed)
+}
+
+// renderParams renders the parameters in the values of a command, walking
+// through its maps and lists. It returns copies so the template is untouched
+func renderParams(node interface{}, params map[string]string) (interface{}, error) {
+	switch n := node.(type) {
+	case map[interface{}]interface{}:
+		rendered := make(map[interface{}]interface{}, len(n))
+		for k, item := range n {
+			v, err := renderParams(item, params)
+			if err != nil {
+				return nil, err
+			}
+			rendered[k] = v
+		}
+		return rendered, nil
+
+	case []interface{}:
+		rendered := make([]interface{}, len(n))
+		for i, item := range n {
+			v, err := renderParams(item, params)
+			if err != nil {
+				return nil, err
+			}
+			rendered[i] = v
+		}
+		return rendered, nil
+
+	case string:
+		t, err := template.New("param").Option("missingkey=error").Parse(n)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse %q: %s", n, err)
+		}
+		out := bytes.NewBufferString("")
+		if err := t.Execute(out, params); err != nil {
+			return nil, fmt.Errorf("could not render %q: %s", n, err)
+		}
+		rendered := out.String()
+		if rendered == n {
+			return n, nil
+		}
+		// Same as with the environment, parameters can set numbers and flags
+		if intPattern.MatchString(rendered) {
+			if i, err := strconv.Atoi(rendered); err == nil {
+				return i, nil
+			}
+		}
+		if boolPattern.MatchString(rendered) {
+			return rendered == "true", nil
+		}
+		return rendered, nil
+	}
+	return node, nil
+}
+
+// sortedNames returns the keys of a parsed map as strings, sorted
+func sortedNames(m map[interface{}]interface{}) []string {
+	names := make([]string, 0, len(m))
+	for k := range m {
+		names = append(names, fmt.Sprint(k))
+	}
+	sort.Strings(names)
+	return names
+}
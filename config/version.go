@@ -0,0 +1,56 @@
+package config
+
+import (
+	"fmt"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// upgrade takes a parsed configuration from one version to the next one
+type upgrade func(c map[interface{}]interface{}) error
+
+// upgrades are applied in order to the configurations of older versions, the
+// first one takes a configuration from version 1 to version 2 and so on.
+//
+// A breaking change to the configuration adds the upgrade that rewrites the
+// older configurations into the new shape, so they keep loading
+var upgrades = []upgrade{}
+
+// CurrentVersion is the version of the configuration this meeseeks reads, a
+// configuration without a version is taken as version 1
+var CurrentVersion = len(upgrades) + 1
+
+// upgradeConfig parses the version of the configuration, applies the upgrades
+// it needs and returns it serialized again at the current version
+func upgradeConfig(b []byte) ([]byte, error) {
+	parsed := map[interface{}]interface{}{}
+	if err := yaml.Unmarshal(b, &parsed); err != nil {
+		return nil, fmt.Errorf("could not parse configuration: %s", err)
+	}
+
+	version := 1
+	if v, ok := parsed["version"]; ok {
+		i, ok := v.(int)
+		if !ok || i < 1 {
+			return nil, fmt.Errorf("invalid configuration version %v, it has to be a number from 1 to %d",
+				v, CurrentVersion)
+		}
+		version = i
+	}
+	if version > CurrentVersion {
+		return nil, fmt.Errorf("configuration version %d is newer than the version %d this meeseeks reads, "+
+			"upgrade the meeseeks to load it", version, CurrentVersion)
+	}
+	if version == CurrentVersion {
+		return b, nil
+	}
+
+	for ; version < CurrentVersion; version++ {
+		if err := upgrades[version-1](parsed); err != nil {
+			return nil, fmt.Errorf("could not upgrade configuration from version %d to %d: %s",
+				version, version+1, err)
+		}
+	}
+	parsed["version"] = CurrentVersion
+	return yaml.Marshal(parsed)
+}
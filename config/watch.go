@@ -0,0 +1,135 @@
+package config
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Watch calls onChange every time the configuration changes until the
+// returned function is called
+//
+// A key in a remote store is watched for as long as it lives. A url, a file
+// or a directory of fragments is checked on every interval, and not at all
+// when the interval is 0. The content of the files is compared and not their
+// modification time, so the ConfigMaps and Secrets that Kubernetes mounts,
+// which are updated by swapping a symlink to a new directory, are picked up
+// too, and the urls are asked for with the ETag they had
+func Watch(location string, interval time.Duration, onChange func()) func() {
+	source, err := NewSource(location)
+	if err != nil {
+		return func() {}
+	}
+	if source == nil {
+		return watchPath(location, interval, onChange)
+	}
+	if h, ok := source.(*httpSource); ok {
+		if interval <= 0 {
+			return func() {}
+		}
+		h.interval = interval
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		var index uint64
+		if _, i, err := source.Read(); err == nil {
+			index = i
+		}
+		for {
+			next, err := source.Wait(ctx, index)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				logrus.Errorf("Failed to watch configuration %s: %s", location, err)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(watchRetry):
+				}
+				continue
+			}
+			if next == index {
+				continue
+			}
+			logrus.Infof("Configuration %s changed, reloading it", location)
+			index = next
+			onChange()
+		}
+	}()
+
+	return cancel
+}
+
+func watchPath(location string, interval time.Duration, onChange func()) func() {
+	if interval <= 0 {
+		return func() {}
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		last, _ := fingerprint(location)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+
+			// The files may be missing for a moment while they are replaced,
+			// the next check gets them
+			current, err := fingerprint(location)
+			if err != nil {
+				logrus.Debugf("Could not check configuration %s for changes: %s", location, err)
+				continue
+			}
+			if current == last {
+				continue
+			}
+			logrus.Infof("Configuration %s changed, reloading it", location)
+			last = current
+			onChange()
+		}
+	}()
+
+	return func() { close(stop) }
+}
+
+// fingerprint returns a hash of the content of the configuration file, or of
+// the fragments of the configuration directory, following the symlinks
+func fingerprint(location string) (string, error) {
+	files := []string{location}
+	if info, err := os.Stat(location); err == nil && info.IsDir() {
+		entries, err := ioutil.ReadDir(location)
+		if err != nil {
+			return "", err
+		}
+		files = files[:0]
+		for _, f := range entries {
+			if isFragment(f) {
+				files = append(files, filepath.Join(location, f.Name()))
+			}
+		}
+	}
+
+	h := sha256.New()
+	for _, name := range files {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s %d\n", name, len(b))
+		h.Write(b)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
@@ -1,30 +1,44 @@
 module gitlab.com/yakshaving.art/meeseeks-box
 
-go 1.12
+go 1.20
 
 require (
-	github.com/beorn7/perks v0.0.0-20180321164747-3a771d992973
+	github.com/BurntSushi/toml v1.4.0
+	github.com/alicebob/miniredis v2.5.0+incompatible
 	github.com/coreos/bbolt v1.3.0
 	github.com/dustin/go-humanize v1.0.0
+	github.com/go-sql-driver/mysql v1.5.0
 	github.com/golang/protobuf v1.1.0
+	github.com/gomodule/redigo v1.7.0
 	github.com/google/uuid v0.0.0-20161128191214-064e2069ce9c
-	github.com/gorilla/websocket v1.2.0
 	github.com/grpc-ecosystem/go-grpc-prometheus v1.2.0
 	github.com/jpillora/backoff v0.0.0-20170918002102-8eab2debe79d
-	github.com/matttproud/golang_protobuf_extensions v1.0.1
+	github.com/mattn/go-sqlite3 v1.10.0
+	github.com/minio/minio-go v6.0.14+incompatible
 	github.com/nlopes/slack v0.0.0-20180224122029-1217b9d3e430
+	github.com/oklog/ulid v1.3.1
 	github.com/onrik/logrus v0.0.0-20180710135805-00f4ddfaeb23
 	github.com/prometheus/client_golang v0.8.0
 	github.com/prometheus/client_model v0.0.0-20180712105110-5c3871d89910
-	github.com/prometheus/common v0.0.0-20180518154759-7600349dcfe1
-	github.com/prometheus/procfs v0.0.0-20180725123919-05ee40e3a273
 	github.com/renstrom/dedent v1.0.0
 	github.com/sirupsen/logrus v1.0.6
-	golang.org/x/crypto v0.0.0-20180723164146-c126467f60eb
 	golang.org/x/net v0.0.0-20180730214132-a0f8a16cb08c
-	golang.org/x/sys v0.0.0-20180727230415-bd9dbc187b6e
-	golang.org/x/text v0.3.0
-	google.golang.org/genproto v0.0.0-20180726180014-2a72893556e4
 	google.golang.org/grpc v1.13.0
 	gopkg.in/yaml.v2 v2.2.1
 )
+
+require (
+	github.com/alicebob/gopher-json v0.0.0-20180125190556-5a6b3ba71ee6 // indirect
+	github.com/beorn7/perks v0.0.0-20180321164747-3a771d992973 // indirect
+	github.com/go-ini/ini v1.42.0 // indirect
+	github.com/gorilla/websocket v1.2.0 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/mitchellh/go-homedir v1.1.0 // indirect
+	github.com/prometheus/common v0.0.0-20180518154759-7600349dcfe1 // indirect
+	github.com/prometheus/procfs v0.0.0-20180725123919-05ee40e3a273 // indirect
+	github.com/yuin/gopher-lua v0.0.0-20180827083657-b942cacc89fe // indirect
+	golang.org/x/crypto v0.0.0-20180723164146-c126467f60eb // indirect
+	golang.org/x/sys v0.0.0-20180727230415-bd9dbc187b6e // indirect
+	golang.org/x/text v0.3.0 // indirect
+	google.golang.org/genproto v0.0.0-20180726180014-2a72893556e4 // indirect
+)
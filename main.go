@@ -5,19 +5,30 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"gitlab.com/yakshaving.art/meeseeks-box/api"
+	"gitlab.com/yakshaving.art/meeseeks-box/auth/ldap"
+	"gitlab.com/yakshaving.art/meeseeks-box/auth/oidc"
 	"gitlab.com/yakshaving.art/meeseeks-box/config"
 	"gitlab.com/yakshaving.art/meeseeks-box/http"
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
 	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks/executor"
 	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks/metrics"
 	"gitlab.com/yakshaving.art/meeseeks-box/persistence"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/artifacts"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/audit"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/redis"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/retention"
 	"gitlab.com/yakshaving.art/meeseeks-box/remote/agent"
 	"gitlab.com/yakshaving.art/meeseeks-box/remote/server"
+	"gitlab.com/yakshaving.art/meeseeks-box/secrets/vault"
 	"gitlab.com/yakshaving.art/meeseeks-box/slack"
+	"gitlab.com/yakshaving.art/meeseeks-box/text/formatter"
 	"gitlab.com/yakshaving.art/meeseeks-box/version"
+	"gitlab.com/yakshaving.art/meeseeks-box/webhooks"
 
 	"github.com/onrik/logrus/filename"
 	"github.com/sirupsen/logrus"
@@ -27,6 +38,25 @@ func main() {
 	args := parseArgs()
 
 	configureLogger(args)
+	// Validating is strict, so the typos are caught before they are deployed
+	config.SetStrict(args.StrictConfig || args.ValidateConfig)
+
+	if args.ValidateConfig {
+		problems := validateConfig(args)
+		for _, problem := range problems {
+			fmt.Fprintln(os.Stderr, problem)
+		}
+		if len(problems) > 0 {
+			os.Exit(1)
+		}
+		fmt.Printf("Configuration %s is valid\n", configFile(args))
+		os.Exit(0)
+	}
+
+	if args.ExportAudit != "" {
+		must("could not export the audit log: %s", exportAudit(args))
+		os.Exit(0)
+	}
 
 	shutdownFunc, reloadFunc, err := launch(args)
 	must("could not launch meeseeks-box: %s", err)
@@ -45,34 +75,92 @@ type args struct {
 	DebugSlack        bool
 	Address           string
 	APIPath           string
+	APIRunPath        string
+	WebhooksPath      string
+	AlertmanagerPath  string
 	MetricsPath       string
 	SlackToken        string
 	ExecutionMode     string
 	AgentOf           string
+	AgentConfigFile   string
+	AgentLabels       string
 	GRPCServerAddress string
 	GRPCServerEnabled bool
 	GRPCSecurityMode  string
 	GRPCCertPath      string
 	GRPCKeyPath       string
+	GRPCCAPath        string
+	GRPCRequireToken  bool
+	GRPCCompression   string
+	GRPCMaxMessage    int
+	GRPCKeepalive     time.Duration
+	GRPCKeepaliveWait time.Duration
+	GRPCKeepaliveMin  time.Duration
+	GRPCDialTimeout   time.Duration
+	GRPCRPCTimeout    time.Duration
+	AgentTokenFile    string
+	AgentHeartbeat    time.Duration
+	AgentBacklog      int
+	GRPCCertWatch     time.Duration
+	ShutdownGrace     time.Duration
+	ExportAudit       string
+	ValidateConfig    bool
+	StrictConfig      bool
+	WatchInterval     time.Duration
+
+	// SetFlags are the flags that were passed, which override the agent
+	// configuration file
+	SetFlags map[string]bool
 }
 
 func parseArgs() args {
-	configFile := flag.String("config", os.ExpandEnv("${HOME}/.meeseeks.yaml"), "meeseeks configuration file")
+	configFile := flag.String("config", os.ExpandEnv("${HOME}/.meeseeks.yaml"), "meeseeks configuration file, a directory of fragments, a consul://host:port/key or etcd://host:port/key to read it from and watch, or an https url")
 	debugMode := flag.Bool("debug", false, "enabled debug mode")
 	debugSlack := flag.Bool("debug-slack", false, "enabled debug mode for slack")
 	showVersion := flag.Bool("version", false, "print the version and exit")
 	address := flag.String("http-address", ":9696", "http endpoint in which to listen")
 	apiPath := flag.String("api-path", "/message", "api path in to listen for api calls")
+	apiRunPath := flag.String("api-run-path", "/commands/run", "api path in to listen for calls to run commands and get their output")
+	webhooksPath := flag.String("webhooks-path", "/webhooks/", "path in which to listen for signed webhook calls, followed by the name of the source")
+	alertmanagerPath := flag.String("alertmanager-path", "/alertmanager", "path in which to listen for the webhook calls of an alertmanager")
 	metricsPath := flag.String("metrics-path", "/metrics", "path to in which to expose prometheus metrics")
 	slackStealth := flag.Bool("stealth", false, "Enable slack stealth mode")
-	slackToken := flag.String("slack-token", os.Getenv("SLACK_TOKEN"), "slack token, by default loaded from the SLACK_TOKEN environment variable")
-	agentOf := flag.String("agent-of", "", "remote server to connect to, enables agent mode")
+	slackToken := flag.String("slack-token", os.Getenv("SLACK_TOKEN"), "slack token, by default loaded from the SLACK_TOKEN environment variable, it can be a vault reference")
+	agentOf := flag.String("agent-of", "", "remote server to connect to, enables agent mode, a comma separated list registers the agent with all of them, like an HA pair")
+	agentConfig := flag.String("agent-config", os.Getenv("MEESEEKS_AGENT_CONFIG"), "agent configuration file with the servers, tls, labels and commands of the agent, enables agent mode, by default loaded from the MEESEEKS_AGENT_CONFIG environment variable")
+	agentLabels := flag.String("agent-labels", "", "comma separated labels of the agent, like tier=web,region=eu, added to the ones of the agent configuration")
 	grpcServerAddress := flag.String("grpc-address", ":9697", "grpc server endpoint, used to connect remote agents")
 	grpcServerEnabled := flag.Bool("with-grpc-server", false, "enable grpc remote server to connect to")
 
-	grpcSecurityMode := flag.String("grpc-security-mode", "insecure", "grpc security mode, by default insecure, can be set to tls (for now)")
-	grpcCertPath := flag.String("grpc-cert-path", "", "Cert to use with the GRPC server")
-	grpcKeyPath := flag.String("grpc-key-path", "", "Key to use with the GRPC server")
+	grpcSecurityMode := flag.String("grpc-security-mode", "insecure", "grpc security mode, by default insecure, can be set to tls or mtls")
+	grpcCertPath := flag.String("grpc-cert-path", "", "Cert to use with the GRPC server, or the cert of the agent with mtls")
+	grpcKeyPath := flag.String("grpc-key-path", "", "Key to use with the GRPC server, or the key of the agent with mtls")
+	grpcCAPath := flag.String("grpc-ca-path", "", "CA that signs the certs of the server and the agents with mtls, it can be a bundle of more than one while they are rotated")
+	grpcCompression := flag.String("grpc-compression", "none", "how the agent compresses the messages to the server, none or gzip, the server answers in kind")
+	grpcMaxMessageSize := flag.Int("grpc-max-message-size", 0, "largest grpc message in bytes, like the output of a command, 4MB by default")
+	grpcKeepalive := flag.Duration("grpc-keepalive-time", 0, "how often to ping the other end of an idle grpc connection so NATs and firewalls don't drop it, every 5s by default in the agent and every 2h in the server")
+	grpcKeepaliveWait := flag.Duration("grpc-keepalive-timeout", 0, "how long to wait for the answer to a keepalive ping before the connection is taken as gone, the grpc timeout by default in the agent and 20s in the server")
+	grpcKeepaliveMin := flag.Duration("grpc-keepalive-min-time", 0, "how often the agents can ping the server, 5s by default, agents that ping more often are disconnected")
+	grpcDialTimeout := flag.Duration("grpc-dial-timeout", 0, "how long the agent can take to connect to the server, or the server to finish the handshake of a new connection, 10s by default in the agent and 2m in the server")
+	grpcRPCTimeout := flag.Duration("grpc-rpc-timeout", 0, "deadline of each grpc call of the agents that is not a stream, like a heartbeat, 10s by default in the agent and none in the server")
+	grpcRequireToken := flag.Bool("grpc-require-agent-token", false, "only accept agents that register with a token issued with agent-token-new")
+	agentTokenFile := flag.String("agent-token-file", "", "file holding the token the agent registers with, read again when the server rejects it")
+	agentBacklog := flag.Int("agent-backlog-size", agent.DefaultBacklogSize, "how many log lines the agent keeps while it can't reach the server, to send them once it's back")
+	agentHeartbeat := flag.Duration("agent-heartbeat-interval", 10*time.Second, "how often the agent tells the server it's alive, the server unregisters the agents that stop")
+
+	shutdownGrace := flag.Duration("shutdown-grace-period", 0, "how long to wait for running jobs on shutdown before cancelling them, by default it waits for as long as they take")
+	exportAudit := flag.String("export-audit", "", "write the whole audit log as JSON lines to this file (- for stdout) and exit")
+	// Kubernetes updates the mounted ConfigMaps and Secrets in place, so the
+	// configuration is watched by default when running in it
+	watchInterval := time.Duration(0)
+	if os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+		watchInterval = 10 * time.Second
+	}
+	watchConfig := flag.Duration("watch-config-interval", watchInterval, "how often to check the configuration file, directory or url for changes and reload it, 0 to disable, enabled every 10s by default in kubernetes")
+	grpcCertWatch := flag.Duration("grpc-cert-watch-interval", watchInterval, "how often to check the grpc cert, key and CA files for changes and reload them, 0 to disable, enabled every 10s by default in kubernetes, they are also reloaded on SIGHUP")
+	validateConfig := flag.Bool("validate-config", false, "check the configuration and the grpc settings, print every problem found and exit with 1 if there is any, unknown keys included")
+	flag.BoolVar(validateConfig, "validate", false, "same as validate-config")
+	strictConfig := flag.Bool("strict-config", false, "fail to load the configuration when it has unknown keys, like a misspelled one, instead of ignoring them")
 
 	flag.Parse()
 
@@ -82,10 +170,15 @@ func parseArgs() args {
 	}
 
 	executionMode := "server"
-	if *agentOf != "" {
+	if *agentOf != "" || *agentConfig != "" {
 		executionMode = "agent"
 	}
 
+	setFlags := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+
 	return args{
 		ConfigFile:        *configFile,
 		DebugMode:         *debugMode,
@@ -94,34 +187,72 @@ func parseArgs() args {
 		SlackToken:        *slackToken,
 		Address:           *address,
 		APIPath:           *apiPath,
+		APIRunPath:        *apiRunPath,
+		WebhooksPath:      *webhooksPath,
+		AlertmanagerPath:  *alertmanagerPath,
 		MetricsPath:       *metricsPath,
 		AgentOf:           *agentOf,
+		AgentConfigFile:   *agentConfig,
+		AgentLabels:       *agentLabels,
 		GRPCServerAddress: *grpcServerAddress,
 		GRPCServerEnabled: *grpcServerEnabled,
 
 		GRPCSecurityMode: *grpcSecurityMode,
 		GRPCCertPath:     *grpcCertPath,
 		GRPCKeyPath:      *grpcKeyPath,
+		GRPCCAPath:       *grpcCAPath,
+		GRPCRequireToken: *grpcRequireToken,
+		GRPCCompression:  *grpcCompression,
+		GRPCMaxMessage:   *grpcMaxMessageSize,
+		AgentTokenFile:   *agentTokenFile,
+		AgentHeartbeat:   *agentHeartbeat,
+		AgentBacklog:     *agentBacklog,
+		GRPCCertWatch:    *grpcCertWatch,
+
+		GRPCKeepalive:     *grpcKeepalive,
+		GRPCKeepaliveWait: *grpcKeepaliveWait,
+		GRPCKeepaliveMin:  *grpcKeepaliveMin,
+		GRPCDialTimeout:   *grpcDialTimeout,
+		GRPCRPCTimeout:    *grpcRPCTimeout,
+
+		ShutdownGrace:  *shutdownGrace,
+		ExportAudit:    *exportAudit,
+		ValidateConfig: *validateConfig,
+		StrictConfig:   *strictConfig,
+		WatchInterval:  *watchConfig,
 
 		ExecutionMode: executionMode,
+		SetFlags:      setFlags,
 	}
 }
 
 func launch(args args) (shutdownFunc func(), reloadFunc func(), err error) {
-	cnf, err := config.ReadFile(args.ConfigFile)
+	cnf, err := readConfig(args)
 	must("failed to load configuration file: %s", err)
 	must("could not load configuration: %s", config.LoadConfiguration(cnf))
 
+	// The outcome of a reload is also sent to the reload channel, once there
+	// is a chat client to send it with
+	var reportReload func(channelID, text string)
 	reloadFunc = func() {
-		cnf, err := config.ReadFile(args.ConfigFile)
+		diff, err := reloadConfig(args)
+		text := fmt.Sprintf("configuration successfully reloaded, %s", diff)
 		if err != nil {
-			logrus.Warnf("failed to read configuration file %s: %s", args.ConfigFile, err)
-			return
-		}
-		if err = config.LoadConfiguration(cnf); err != nil {
-			logrus.Warnf("failed to reload configuration %s: %s", args.ConfigFile, err)
+			text = fmt.Sprintf("failed to reload configuration %s: %s", configFile(args), err)
+			logrus.Warn(text)
 		} else {
-			logrus.Info("configuration successfully reloaded")
+			logrus.WithFields(logrus.Fields{
+				"commands_added":   diff.CommandsAdded,
+				"commands_removed": diff.CommandsRemoved,
+				"commands_changed": diff.CommandsChanged,
+				"groups_added":     diff.GroupsAdded,
+				"groups_removed":   diff.GroupsRemoved,
+				"groups_changed":   diff.GroupsChanged,
+				"sections_changed": diff.Sections,
+			}).Info("configuration successfully reloaded")
+		}
+		if channelID := config.ReloadChannel(); channelID != "" && reportReload != nil {
+			reportReload(channelID, text)
 		}
 	}
 
@@ -129,56 +260,122 @@ func launch(args args) (shutdownFunc func(), reloadFunc func(), err error) {
 
 	switch args.ExecutionMode {
 	case "server":
-		must("Could not flush running jobs after: %s", persistence.Jobs().FailRunningJobs())
+		executorArgs := executor.Args{
+			ConcurrentTaskCount: cnf.Pool,
+			PoolSizes:           cnf.Pools,
+			WithBuiltinCommands: true,
+			ShutdownGracePeriod: args.ShutdownGrace,
+		}
+
+		// Chat messages are locked so they are run once, in the database
+		// unless they are shared with other replicas through redis
+		executorArgs.Locker = persistence.Locker()
+
+		var redisClient *redis.Client
+		if cnf.Redis.Enabled() {
+			redisClient, err = redis.New(cnf.Redis)
+			must("could not connect to redis: %s", err)
+
+			executorArgs.Queue = redisClient
+			executorArgs.Locker = redisClient
+
+			// Running and queued jobs may belong to other replicas
+			logrus.Info("Sharing the jobs queue through redis, not recovering running or queued jobs")
+		}
 
 		metrics.RegisterServerMetrics()
 		remoteServer, err := startRemoteServer(args)
 		must("could not start GRPC server: %s", err)
 
 		slackClient := connectToSlack(args)
+		reportReload = func(channelID, text string) {
+			slackClient.Reply(formatter.ProgressReply(meeseeks.Request{ChannelID: channelID}).WithOutput(text))
+		}
+		server.SetNotifier(server.Notifier(reportReload))
 		apiService := startAPI(slackClient, args)
+		webhooksService := webhooks.New(slackClient, args.WebhooksPath)
+		webhooksService.RegisterAlertmanagerPath(args.AlertmanagerPath)
 
-		exc := executor.New(executor.Args{
-			ConcurrentTaskCount: 20,
-			WithBuiltinCommands: true,
-			ChatClient:          slackClient,
-		})
+		if redisClient == nil {
+			must("Could not recover interrupted jobs: %s",
+				executor.RecoverInterruptedJobs(slackClient, cnf.Recovery.Notify))
+		}
+
+		executorArgs.ChatClient = slackClient
+		exc := executor.New(executorArgs)
+		if redisClient == nil {
+			must("Could not recover queued jobs: %s",
+				exc.RecoverQueuedJobs(cnf.Recovery.ResumesQueued(), cnf.Recovery.Notify))
+		}
+
+		stopReaper := retention.Start(cnf.Retention.Interval * time.Second)
+		stopSync := ldap.Start()
+		stopRenewal := vault.Start()
+		oidc.RegisterCallback()
+		artifacts.RegisterHandler()
 
 		exc.ListenTo(slackClient)
 		exc.ListenTo(apiService)
+		exc.ListenTo(webhooksService)
 
 		go exc.Run()
 
+		// The grpc certs are reloaded with the configuration, so SIGHUP
+		// rotates them too
+		serverReloadFunc := func() {
+			reloadFunc()
+			if err := remoteServer.ReloadCerts(); err != nil {
+				logrus.Error(err)
+			}
+		}
+		stopWatch := config.Watch(args.ConfigFile, args.WatchInterval, serverReloadFunc)
+
 		return func() {
+			stopWatch()
+			stopReaper()
+			stopSync()
+			stopRenewal()
 			exc.Shutdown()
 			httpServer.Shutdown()
 			remoteServer.Shutdown()
-		}, reloadFunc, nil
+			if redisClient != nil {
+				redisClient.Close()
+			}
+		}, serverReloadFunc, nil
 
 	case "agent":
 		// metrics.RegisterAgentMetrics()
 
-		remoteClient := agent.New(agent.Configuration{
-			ServerURL:    args.AgentOf,
-			Token:        "null-token",
-			GRPCTimeout:  10 * time.Second,
-			Labels:       map[string]string{},
-			SecurityMode: args.GRPCSecurityMode,
-			CertPath:     args.GRPCCertPath,
-		})
+		agentCnf, err := readAgentConfig(args)
+		must("could not load agent configuration: %s", err)
+		must("invalid agent configuration: %s", agentCnf.Validate())
+
+		agentConfiguration := agentCnf.Agent()
+		agentConfiguration.Labels = agent.DiscoverLabels(agentCnf.DiscoverLabels, agentConfiguration.Labels)
+
+		// The agent registers with each of the servers, like an HA pair
+		remoteClient := agent.NewGroup(agentConfiguration, agentCnf.Servers)
 
 		must("could not connect to remote server: %s", remoteClient.Connect())
 
 		go remoteClient.Run()
 
-		logrus.Debugf("agent running connected to remote server: %s", args.AgentOf)
+		logrus.Debugf("agent running connected to remote server: %s", strings.Join(agentCnf.Servers, ","))
+
+		// The servers get the commands of the agent as they are once the
+		// configuration is reloaded, without the agent registering again
+		agentReloadFunc := func() {
+			reloadFunc()
+			if err := remoteClient.UpdateCommands(); err != nil {
+				logrus.Warnf("%s, the servers get them when the agent registers again", err)
+			}
+		}
+		stopWatch := config.Watch(configFile(args), args.WatchInterval, agentReloadFunc)
 
 		return func() {
-				remoteClient.Shutdown()
-			}, func() {
-				reloadFunc()
-				remoteClient.Reconnect()
-			}, nil
+			stopWatch()
+			remoteClient.Shutdown()
+		}, agentReloadFunc, nil
 
 	default:
 		return nil, nil, fmt.Errorf("Invalid execution mode %s, Valid execution modes are server (default), and agent",
@@ -186,6 +383,141 @@ func launch(args args) (shutdownFunc func(), reloadFunc func(), err error) {
 	}
 }
 
+func exportAudit(args args) error {
+	cnf, err := config.ReadFile(args.ConfigFile)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration file: %s", err)
+	}
+	if err = config.LoadConfiguration(cnf); err != nil {
+		return fmt.Errorf("could not load configuration: %s", err)
+	}
+
+	w := os.Stdout
+	if args.ExportAudit != "-" {
+		f, err := os.OpenFile(args.ExportAudit, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			return fmt.Errorf("could not create export file: %s", err)
+		}
+		defer f.Close()
+		w = f
+	}
+	return audit.Export(w, persistence.Audit(), meeseeks.AuditFilter{})
+}
+
+// validateConfig loads the configuration without starting anything and
+// returns all the problems found in it and in the grpc settings
+func validateConfig(args args) []error {
+	cnf, err := readConfig(args)
+	if err != nil {
+		return []error{fmt.Errorf("failed to load configuration file: %s", err)}
+	}
+	problems := config.Check(cnf)
+
+	var remote error
+	switch args.ExecutionMode {
+	case "agent":
+		agentCnf, err := readAgentConfig(args)
+		if err != nil {
+			return append(problems, err)
+		}
+		remote = agentCnf.Validate()
+	default:
+		remote = server.Config{
+			CertPath:     args.GRPCCertPath,
+			KeyPath:      args.GRPCKeyPath,
+			CAPath:       args.GRPCCAPath,
+			SecurityMode: args.GRPCSecurityMode,
+
+			Compression:    args.GRPCCompression,
+			MaxMessageSize: args.GRPCMaxMessage,
+
+			KeepaliveTime:    args.GRPCKeepalive,
+			KeepaliveTimeout: args.GRPCKeepaliveWait,
+			KeepaliveMinTime: args.GRPCKeepaliveMin,
+			DialTimeout:      args.GRPCDialTimeout,
+			RPCTimeout:       args.GRPCRPCTimeout,
+		}.Validate()
+	}
+	if remote != nil {
+		problems = append(problems, fmt.Errorf("grpc: %s", remote))
+	}
+	return problems
+}
+
+// configFile returns the file the configuration is read from, the one of the
+// agent when it has its own
+func configFile(args args) string {
+	if args.AgentConfigFile != "" {
+		return args.AgentConfigFile
+	}
+	return args.ConfigFile
+}
+
+// readConfig reads the configuration the commands are loaded with, from the
+// configuration file of the agent when it has its own
+func readConfig(args args) (config.Config, error) {
+	if args.AgentConfigFile == "" {
+		return config.ReadFile(args.ConfigFile)
+	}
+	agentCnf, err := config.ReadAgentFile(args.AgentConfigFile)
+	if err != nil {
+		return config.Config{}, err
+	}
+	return agentCnf.Config()
+}
+
+func reloadConfig(args args) (config.Diff, error) {
+	if args.AgentConfigFile == "" {
+		return config.ReloadFile(args.ConfigFile)
+	}
+	return config.ReloadAgentFile(args.AgentConfigFile)
+}
+
+// readAgentConfig returns how the agent connects to the servers, from its
+// configuration file when it has one, overridden by the environment and then
+// by the flags that are passed
+func readAgentConfig(args args) (config.AgentConfig, error) {
+	cnf := config.AgentConfig{}
+	if args.AgentConfigFile != "" {
+		var err error
+		if cnf, err = config.ReadAgentFile(args.AgentConfigFile); err != nil {
+			return cnf, err
+		}
+	}
+	if err := cnf.ApplyEnv(); err != nil {
+		return cnf, err
+	}
+
+	if args.AgentOf != "" {
+		cnf.Servers = strings.Split(args.AgentOf, ",")
+	}
+	if args.AgentLabels != "" {
+		if err := cnf.AddLabels(args.AgentLabels); err != nil {
+			return cnf, fmt.Errorf("agent-labels: %s", err)
+		}
+	}
+	for name, override := range map[string]func(){
+		"agent-token-file":         func() { cnf.TokenFile = args.AgentTokenFile },
+		"grpc-security-mode":       func() { cnf.TLS.Mode = args.GRPCSecurityMode },
+		"grpc-cert-path":           func() { cnf.TLS.Cert = args.GRPCCertPath },
+		"grpc-key-path":            func() { cnf.TLS.Key = args.GRPCKeyPath },
+		"grpc-ca-path":             func() { cnf.TLS.CA = args.GRPCCAPath },
+		"grpc-compression":         func() { cnf.Compression = args.GRPCCompression },
+		"grpc-max-message-size":    func() { cnf.MaxMessageSize = args.GRPCMaxMessage },
+		"grpc-keepalive-time":      func() { cnf.KeepaliveTime = args.GRPCKeepalive },
+		"grpc-keepalive-timeout":   func() { cnf.KeepaliveTimeout = args.GRPCKeepaliveWait },
+		"grpc-dial-timeout":        func() { cnf.DialTimeout = args.GRPCDialTimeout },
+		"grpc-rpc-timeout":         func() { cnf.RPCTimeout = args.GRPCRPCTimeout },
+		"agent-heartbeat-interval": func() { cnf.Heartbeat = args.AgentHeartbeat },
+		"agent-backlog-size":       func() { cnf.BacklogSize = args.AgentBacklog },
+	} {
+		if args.SetFlags[name] {
+			override()
+		}
+	}
+	return cnf, nil
+}
+
 func configureLogger(args args) {
 	logrus.AddHook(filename.NewHook())
 	logrus.SetFormatter(&logrus.TextFormatter{
@@ -199,10 +531,13 @@ func configureLogger(args args) {
 
 func connectToSlack(args args) *slack.Client {
 	logrus.Debug("Connecting to slack")
+	token, err := vault.Resolve(args.SlackToken)
+	must("Could not resolve slack token: %s", err)
+
 	slackClient, err := slack.Connect(
 		slack.ConnectionOpts{
 			Debug:   args.DebugSlack,
-			Token:   args.SlackToken,
+			Token:   token,
 			Stealth: args.StealthMode,
 		})
 
@@ -227,14 +562,28 @@ func listenHTTP(args args) *http.Server {
 
 func startAPI(client *slack.Client, args args) *api.Service {
 	logrus.Debug("Starting api server")
-	return api.New(client, args.APIPath)
+	s := api.New(client, args.APIPath)
+	s.RegisterRunPath(args.APIRunPath)
+	return s
 }
 
 func startRemoteServer(args args) (*server.RemoteServer, error) {
 	s, err := server.New(server.Config{
 		CertPath:     args.GRPCCertPath,
 		KeyPath:      args.GRPCKeyPath,
+		CAPath:       args.GRPCCAPath,
 		SecurityMode: args.GRPCSecurityMode,
+		RequireToken: args.GRPCRequireToken,
+
+		WatchInterval:  args.GRPCCertWatch,
+		MaxMessageSize: args.GRPCMaxMessage,
+		Compression:    args.GRPCCompression,
+
+		KeepaliveTime:    args.GRPCKeepalive,
+		KeepaliveTimeout: args.GRPCKeepaliveWait,
+		KeepaliveMinTime: args.GRPCKeepaliveMin,
+		DialTimeout:      args.GRPCDialTimeout,
+		RPCTimeout:       args.GRPCRPCTimeout,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("could not create GRPC Server: %s", err)
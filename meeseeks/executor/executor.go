@@ -3,16 +3,28 @@ package executor
 import (
 	"context"
 	"fmt"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 
 	"gitlab.com/yakshaving.art/meeseeks-box/auth"
+	"gitlab.com/yakshaving.art/meeseeks-box/auth/alerts"
+	"gitlab.com/yakshaving.art/meeseeks-box/auth/approvals"
+	"gitlab.com/yakshaving.art/meeseeks-box/auth/breakglass"
+	"gitlab.com/yakshaving.art/meeseeks-box/auth/oidc"
 	"gitlab.com/yakshaving.art/meeseeks-box/commands"
 	"gitlab.com/yakshaving.art/meeseeks-box/commands/builtins"
 	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks/grafana"
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks/jobs"
 	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks/metrics"
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks/reports"
 	"gitlab.com/yakshaving.art/meeseeks-box/persistence"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/artifacts"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/audit"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/logs/limit"
 	"gitlab.com/yakshaving.art/meeseeks-box/text/formatter"
 )
 
@@ -39,47 +51,172 @@ type Executor struct {
 
 	requestsCh chan meeseeks.Request
 
-	tasksCh        chan task
-	wg             sync.WaitGroup
-	activeCommands *activeCommands
+	tasksCh             chan task
+	wg                  sync.WaitGroup
+	accepting           sync.WaitGroup
+	shutdownGracePeriod time.Duration
+	pools               *pools
+
+	queue         meeseeks.JobQueue
+	locker        meeseeks.Locker
+	stopConsuming chan struct{}
+	consumerDone  chan struct{}
 }
 
 type task struct {
-	job meeseeks.Job
-	cmd meeseeks.Command
+	job  meeseeks.Job
+	cmd  meeseeks.Command
+	kind string
+
+	// release frees the pool slot the task already holds, if any
+	release func()
 }
 
 // Args is handy to set multiple arguments
+//
+// ConcurrentTaskCount is how many jobs of each kind of command can run at the
+// same time, PoolSizes overrides it per kind.
+//
+// ShutdownGracePeriod is how long to wait for running jobs on shutdown before
+// cancelling them, zero means waiting for as long as they take
+//
+// Queue and Locker are optional and shared with other replicas: recorded
+// local jobs are pushed to the queue to be run by whichever replica pops
+// them, and chat requests are locked so only one replica accepts them
 type Args struct {
 	ConcurrentTaskCount int
+	PoolSizes           map[string]int
 	WithBuiltinCommands bool
 	ChatClient          ChatClient
+	ShutdownGracePeriod time.Duration
+	Queue               meeseeks.JobQueue
+	Locker              meeseeks.Locker
 }
 
+// How long a replica waits for a queued job before checking if it should stop
+var queuePollTimeout = time.Second
+
+// How long a chat request is locked for, long enough for any replica to get it
+const requestLockTTL = 10 * time.Minute
+
 // New creates a new Meeseeks service
 func New(args Args) *Executor {
-	ac := newActiveCommands()
+	requestsCh := make(chan meeseeks.Request)
 	if args.WithBuiltinCommands {
 		builtins.LoadBuiltins(
-			builtins.NewCancelJobCommand(ac.Cancel),
-			builtins.NewKillJobCommand(ac.Cancel),
+			builtins.NewCancelJobCommand(jobs.Cancel),
+			builtins.NewKillJobCommand(jobs.Cancel),
+			builtins.NewTailCommand(args.ChatClient.Reply),
+			builtins.NewRerunJobCommand(func(req meeseeks.Request) {
+				// Builtins run as tasks, so the request can't be sent from
+				// here without blocking the executor
+				go func() { requestsCh <- req }()
+			}),
+			builtins.NewApproveCommand(func(req meeseeks.Request) {
+				go func() { requestsCh <- req }()
+			}),
 		)
 	}
 
+	breakglass.SetAnnouncer(func(channelID, text string) {
+		args.ChatClient.Reply(formatter.ProgressReply(meeseeks.Request{ChannelID: channelID}).WithOutput(text))
+	})
+
 	e := Executor{
 		client:     args.ChatClient,
 		tasksCh:    make(chan task, args.ConcurrentTaskCount),
-		requestsCh: make(chan meeseeks.Request),
+		requestsCh: requestsCh,
+
+		wg:                  sync.WaitGroup{},
+		shutdownGracePeriod: args.ShutdownGracePeriod,
+		pools:               newPools(args.ConcurrentTaskCount, args.PoolSizes),
 
-		wg:             sync.WaitGroup{},
-		activeCommands: ac,
+		queue:         args.Queue,
+		locker:        args.Locker,
+		stopConsuming: make(chan struct{}),
+		consumerDone:  make(chan struct{}),
 	}
 
 	go e.processTasks()
 
+	if e.queue != nil {
+		go e.consumeQueue()
+	} else {
+		close(e.consumerDone)
+	}
+
 	return &e
 }
 
+// InterruptedJobNote is attached to the jobs that were still running when the
+// previous process stopped
+const InterruptedJobNote = "the meeseeks stopped while the job was running"
+
+// RecoverInterruptedJobs flags as interrupted the jobs that were left running
+// by a previous process, and lets their channels know when notify is set
+func RecoverInterruptedJobs(client ChatClient, notify bool) error {
+	interrupted, err := persistence.Jobs().InterruptRunningJobs(InterruptedJobNote)
+	if err != nil {
+		return err
+	}
+	if !notify {
+		return nil
+	}
+	for _, job := range interrupted {
+		client.Reply(formatter.FailureReply(job.Request,
+			fmt.Errorf("job %d was interrupted, %s", job.ID, InterruptedJobNote)))
+	}
+	return nil
+}
+
+// FailedQueuedJobNote is attached to the queued jobs that are failed when the
+// process starts instead of being resumed
+const FailedQueuedJobNote = "the meeseeks stopped while the job was queued"
+
+// RecoverQueuedJobs takes care of the jobs that were left queued by a
+// previous process. With resume they are run again, oldest first, otherwise
+// they are flagged as failed. Their channels are told when notify is set
+func (m *Executor) RecoverQueuedJobs(resume, notify bool) error {
+	if !resume {
+		failed, err := persistence.Jobs().FailQueuedJobs(FailedQueuedJobNote)
+		if err != nil {
+			return err
+		}
+		for _, job := range failed {
+			if notify {
+				m.client.Reply(formatter.FailureReply(job.Request,
+					fmt.Errorf("job %d was not run, %s", job.ID, FailedQueuedJobNote)))
+			}
+		}
+		return nil
+	}
+
+	queued, err := persistence.Jobs().QueuedJobs()
+	if err != nil {
+		return err
+	}
+	for _, job := range queued {
+		req := job.Request
+		cmd, found := commands.All()[req.Command]
+		if !found {
+			reports.Errorf(reports.ComponentExecutor, reports.JobTags(job),
+				"Queued job %d runs command '%s' which is not known anymore", job.ID, req.Command)
+			m.client.Reply(formatter.UnknownCommandReply(req))
+			persistence.Jobs().Finish(job.ID, meeseeks.JobFailedStatus)
+			continue
+		}
+
+		logrus.Infof("Resuming queued job %d", job.ID)
+		if notify {
+			m.client.Reply(formatter.ProgressReply(req).WithOutput(
+				fmt.Sprintf("job %d was queued when the meeseeks stopped, resuming it", job.ID)))
+		}
+		m.wg.Add(1)
+		m.tasksCh <- task{job: job, cmd: cmd, kind: commands.KindOf(req.Command)}
+	}
+	return nil
+}
+
 // ListenTo appends a listener to the list and starts listening to it
 func (m *Executor) ListenTo(l Listener) {
 	logrus.Debugf("Executor: adding listener %#v", l)
@@ -90,52 +227,290 @@ func (m *Executor) ListenTo(l Listener) {
 // Run launches the meeseeks to read requests from the requests channel
 func (m *Executor) Run() {
 	for req := range m.requestsCh {
+		if !m.lockRequest(req) {
+			continue
+		}
 		metrics.ReceivedCommandsCount.Inc()
 
 		cmd, ok := commands.Find(&req)
 		if !ok {
 			m.client.Reply(formatter.UnknownCommandReply(req))
 			metrics.UnknownCommandsCount.Inc()
+			recordAudit(meeseeks.AuditEntry{Decision: meeseeks.AuditUnknown, Request: req}, nil)
 			continue
 		}
 
-		if err := auth.Check(req, cmd); err != nil {
-			m.client.Reply(formatter.UnauthorizedCommandReply(req))
-			metrics.RejectedCommandsCount.WithLabelValues(req.Command).Inc()
+		if auth.DecidesRemotely(cmd) {
+			// The service that decides can take up to its timeout, the other
+			// requests are not kept waiting for it
+			m.accepting.Add(1)
+			go func(req meeseeks.Request, cmd meeseeks.Command) {
+				defer m.accepting.Done()
+				m.accept(req, cmd)
+			}(req, cmd)
 			continue
 		}
+		m.accept(req, cmd)
+	}
+}
+
+// accept checks that the request can be run and, when it can, runs it or
+// queues it
+func (m *Executor) accept(req meeseeks.Request, cmd meeseeks.Command) {
+	req = oidc.Identify(req)
+	if err := checkAuth(req, cmd); err != nil {
+		m.client.Reply(formatter.UnauthorizedCommandReply(req))
+		metrics.RejectedCommandsCount.WithLabelValues(req.Command).Inc()
+		recordAudit(meeseeks.AuditEntry{Decision: meeseeks.AuditUnauthorized, Reason: err.Error(), Request: req}, cmd)
+		m.alertUnauthorized(req)
+		return
+	}
+
+	approvers, ok := m.checkApproval(req, cmd)
+	if !ok {
+		return
+	}
+
+	logrus.Infof("Accepted command '%s' from user '%s' on channel '%s' with args: %s",
+		req.Command, req.Username, req.Channel, req.Args)
+	metrics.AcceptedCommandsCount.WithLabelValues(req.Command).Inc()
+
+	t, err := m.createTask(req, cmd)
+	if err != nil {
+		m.client.Reply(formatter.FailureReply(req, fmt.Errorf("could not create task: %s", err)))
+		return
+	}
+
+	recordAudit(meeseeks.AuditEntry{Decision: meeseeks.AuditAccepted, Reason: approvers, JobID: t.job.ID, Request: req}, cmd)
+
+	if m.mustQueue(t) {
+		if err := m.queue.Push(t.job); err != nil {
+			m.client.Reply(formatter.FailureReply(req, fmt.Errorf("could not queue job: %s", err)))
+			persistence.Jobs().Finish(t.job.ID, meeseeks.JobFailedStatus)
+		}
+		return
+	}
+
+	m.wg.Add(1)
+	m.tasksCh <- t
+}
+
+// checkAuth checks that the user can run the command and, when it's required,
+// that it linked an identity. Linking is never required to link one. While
+// break glass is on its groups can run any command but the admin builtins, so
+// they can't give themselves access that outlasts the incident
+func checkAuth(req meeseeks.Request, cmd meeseeks.Command) error {
+	if err := auth.Check(req, cmd); err != nil {
+		if builtins.IsAdminOnly(cmd) {
+			return err
+		}
+		incident, ok := breakglass.Allows(req, time.Now())
+		if !ok {
+			return err
+		}
+		logrus.Warnf("User %s runs command %s as break glass is on for incident %s: %s",
+			req.Username, req.Command, incident.Name, err)
+	}
+	if req.Command == builtins.BuiltinLinkCommand {
+		return nil
+	}
+	return oidc.Check(req)
+}
+
+// checkApproval returns true when the command needs no approvals or the
+// request already got them, along with who approved it. Otherwise the request
+// waits for its approvals and the channel is told how to give them
+func (m *Executor) checkApproval(req meeseeks.Request, cmd meeseeks.Command) (string, bool) {
+	a, ok := cmd.(meeseeks.Approvable)
+	if !ok || !a.GetApproval().Enabled() {
+		return "", true
+	}
+	if p, ok := approvals.Consume(req); ok {
+		return fmt.Sprintf("approved by %s", strings.Join(p.Approvers, ", ")), true
+	}
+
+	p, err := approvals.Open(req, a.GetApproval(), time.Now())
+	if err != nil {
+		reports.Errorf(reports.ComponentExecutor, reports.RequestTags(req),
+			"Could not open the approval of command '%s' from user '%s': %s", req.Command, req.Username, err)
+		m.client.Reply(formatter.FailureReply(req, fmt.Errorf("could not wait for approvals: %s", err)))
+		return "", false
+	}
+	logrus.Infof("Command '%s' from user '%s' waits for %d approvals as request %d",
+		req.Command, req.Username, p.Opts.GetRequired(), p.ID)
+	m.client.Reply(formatter.ProgressReply(req).WithOutput(
+		fmt.Sprintf("%s needs %d approvals, approve it with: %s %d",
+			req.Command, p.Opts.GetRequired(), builtins.BuiltinApproveCommand, p.ID)))
+	recordAudit(meeseeks.AuditEntry{Decision: meeseeks.AuditPending, Request: req}, cmd)
+	return "", false
+}
+
+// alertUnauthorized counts the rejected request and lets the alerts channel
+// know when the user was rejected too many times
+func (m *Executor) alertUnauthorized(req meeseeks.Request) {
+	alert, ok := alerts.Record(req, time.Now())
+	if !ok {
+		return
+	}
+	logrus.Warn(alert.Text)
+	m.client.Reply(formatter.ProgressReply(meeseeks.Request{ChannelID: alert.ChannelID}).WithOutput(alert.Text))
+}
+
+// recordAudit appends the decision taken on a request to the audit log, a
+// failure to do so is logged but doesn't stop the request
+func recordAudit(entry meeseeks.AuditEntry, cmd meeseeks.Command) {
+	entry = auditEntry(entry, cmd)
+	if _, err := persistence.Audit().Record(entry); err != nil {
+		reports.Errorf(reports.ComponentExecutor, reports.RequestTags(entry.Request),
+			"Failed to record %s audit entry for command '%s' from user '%s': %s",
+			entry.Decision, entry.Request.Command, entry.Request.Username, err)
+	}
+}
+
+// auditEntry tags the entries taken while break glass is on with its
+// incident, and the ones of known commands with their owner
+func auditEntry(entry meeseeks.AuditEntry, cmd meeseeks.Command) meeseeks.AuditEntry {
+	if owned, ok := cmd.(meeseeks.Owned); ok {
+		entry.Owner = owned.GetOwner()
+		entry.Source = owned.GetSource()
+	}
+	if incident, ok := breakglass.Current(time.Now()); ok {
+		entry.Incident = incident.Name
+	}
+	return entry
+}
+
+// lockRequest returns false when another replica already took the request,
+// only chat messages are locked as they are the ones delivered to all of them.
+// Approved requests were already taken when they were first sent
+func (m *Executor) lockRequest(req meeseeks.Request) bool {
+	if m.locker == nil || req.Timestamp == "" || req.ApprovalID != 0 {
+		return true
+	}
+
+	locked, err := m.locker.Lock(fmt.Sprintf("request:%s:%s", req.ChannelID, req.Timestamp), requestLockTTL)
+	if err != nil {
+		reports.Errorf(reports.ComponentExecutor, reports.RequestTags(req),
+			"Could not lock request '%s' from user '%s', accepting it anyway: %s", req.Command, req.Username, err)
+		return true
+	}
+	if !locked {
+		logrus.Debugf("Request '%s' from user '%s' was taken by another replica", req.Command, req.Username)
+	}
+	return locked
+}
+
+// mustQueue returns true when the task has to go through the shared queue,
+// builtins, remote commands and untracked jobs depend on this replica state
+// so they are always run locally
+func (m *Executor) mustQueue(t task) bool {
+	return m.canQueue(t.cmd, t.kind)
+}
+
+func (m *Executor) canQueue(cmd meeseeks.Command, kind string) bool {
+	return m.queue != nil && cmd.MustRecord() && kind == commands.KindLocalCommand
+}
+
+// consumeQueue pops jobs from the shared queue and runs them until shutdown.
+// A job is only popped once there is a free slot to run it, so a busy replica
+// leaves the queued jobs to the ones that have room for them
+func (m *Executor) consumeQueue() {
+	defer close(m.consumerDone)
+
+	for {
+		select {
+		case <-m.stopConsuming:
+			return
+		default:
+		}
 
-		logrus.Infof("Accepted command '%s' from user '%s' on channel '%s' with args: %s",
-			req.Command, req.Username, req.Channel, req.Args)
-		metrics.AcceptedCommandsCount.WithLabelValues(req.Command).Inc()
+		// Only local commands are queued
+		release, ok := m.pools.acquireUnless(commands.KindLocalCommand, m.stopConsuming)
+		if !ok {
+			return
+		}
 
-		t, err := m.createTask(req, cmd)
+		job, ok, err := m.queue.Pop(queuePollTimeout)
 		if err != nil {
-			m.client.Reply(formatter.FailureReply(req, fmt.Errorf("could not create task: %s", err)))
+			release()
+			reports.Errorf(reports.ComponentExecutor, reports.Tags{}, "Could not pop a job from the queue: %s", err)
+			time.Sleep(queuePollTimeout)
+			continue
+		}
+		if !ok {
+			release()
+			continue
+		}
+
+		// The request was already resolved when it was queued, so aliases are
+		// not looked up again
+		req := job.Request
+		cmd, found := commands.All()[req.Command]
+		if !found {
+			reports.Errorf(reports.ComponentExecutor, reports.JobTags(job),
+				"Queued job %d runs command '%s' which is unknown to this replica", job.ID, req.Command)
+			m.client.Reply(formatter.UnknownCommandReply(req))
+			persistence.Jobs().Finish(job.ID, meeseeks.JobFailedStatus)
+			release()
 			continue
 		}
 
+		// The job is marked as running when the task actually starts it
 		m.wg.Add(1)
-		m.tasksCh <- t
+		m.tasksCh <- task{job: job, cmd: cmd, kind: commands.KindOf(req.Command), release: release}
 	}
 }
 
 func (m *Executor) createTask(req meeseeks.Request, cmd meeseeks.Command) (task, error) {
 	if !cmd.MustRecord() {
-		return task{job: persistence.Jobs().Null(req), cmd: cmd}, nil
+		return task{job: persistence.Jobs().Null(req), cmd: cmd, kind: commands.KindOf(req.Command)}, nil
 	}
 
-	j, err := persistence.Jobs().Create(req)
-	return task{job: j, cmd: cmd}, err
+	// Jobs are queued until they get a slot to run, so the ones that are
+	// waiting are not lost if the process stops
+	kind := commands.KindOf(req.Command)
+	j, err := persistence.Jobs().Queue(req)
+	if err != nil {
+		return task{}, err
+	}
+
+	if labeled, ok := cmd.(meeseeks.Labeled); ok && len(labeled.GetLabels()) > 0 {
+		if err := persistence.Jobs().AddLabels(j.ID, labeled.GetLabels()); err != nil {
+			reports.Errorf(reports.ComponentExecutor, reports.JobTags(j), "Could not label job %d: %s", j.ID, err)
+		} else {
+			j.Labels = labeled.GetLabels()
+		}
+	}
+	return task{job: j, cmd: cmd, kind: kind}, nil
 }
 
-// Shutdown initiates a shutdown process by waiting for jobs to finish and then
-// closing the tasks channel
+// Shutdown initiates a shutdown process by stopping consuming the shared queue,
+// waiting for jobs to finish and then closing the tasks channel, jobs are
+// cancelled if they are still running after the shutdown grace period
 func (m *Executor) Shutdown() {
 	defer m.closeTasksChannel()
 
+	close(m.stopConsuming)
+	<-m.consumerDone
+	// The requests that wait for their auth have to get their task in first
+	m.accepting.Wait()
+
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+
 	logrus.Info("Waiting for jobs to finish")
-	m.wg.Wait()
+	if m.shutdownGracePeriod > 0 {
+		select {
+		case <-done:
+		case <-time.After(m.shutdownGracePeriod):
+			logrus.Info("Shutdown grace period is over, cancelling running jobs")
+			jobs.CancelAll()
+		}
+	}
+	<-done
 	logrus.Info("Done waiting, exiting")
 }
 
@@ -150,69 +525,152 @@ func (m *Executor) processTasks() {
 			job := t.job
 			req := job.Request
 			cmd := t.cmd
+			defer reports.Recover(reports.ComponentExecutor, reports.JobTags(job))
 
 			if cmd.HasHandshake() {
 				m.client.Reply(formatter.HandshakeReply(req))
 			}
 
-			ctx := m.activeCommands.Add(t)
-			defer m.activeCommands.Cancel(job.ID)
+			release := t.release
+			if release == nil {
+				release = m.pools.acquire(t.kind)
+			}
+			defer release()
+
+			if job.Status == meeseeks.JobQueuedStatus {
+				if err := persistence.Jobs().Start(job.ID); err != nil {
+					reports.Errorf(reports.ComponentExecutor, reports.JobTags(job), "Could not start job %d: %s", job.ID, err)
+					m.client.Reply(formatter.FailureReply(req, fmt.Errorf("could not start job: %s", err)))
+					m.wg.Done()
+					return
+				}
+				job.Status = meeseeks.JobRunningStatus
+			}
 
+			ctx, done := jobs.Start(job.ID, cmd.GetTimeout())
+			defer done()
+			annotated := grafana.Annotate(job)
+
+			stream := startStreaming(m.client, job, cmd)
 			out, err := t.cmd.Execute(ctx, t.job)
+			out = stream.stop(out)
+			status := meeseeks.JobSucceededStatus
 			if err != nil {
 				logrus.Errorf("Command '%s' from user '%s' failed execution with error: %s",
 					req.Command, req.Username, err)
 
-				m.client.Reply(formatter.FailureReply(req, err).WithOutput(out))
+				m.client.Reply(withOutput(formatter.FailureReply(req, err), out, job.ID))
 
-				persistence.Jobs().Fail(job.ID)
+				status = failedStatus(ctx)
+				persistence.Jobs().Finish(job.ID, status)
 
 			} else {
 				logrus.Infof("Command '%s' from user '%s' succeeded execution", req.Command,
 					req.Username)
 
-				m.client.Reply(formatter.SuccessReply(req).WithOutput(out))
+				m.client.Reply(withOutput(formatter.SuccessReply(req), out, job.ID))
 
-				persistence.Jobs().Succeed(job.ID)
+				persistence.Jobs().Finish(job.ID, status)
 			}
+			annotated(status)
+			audit.Publish(persistence.Audit(), auditEntry(meeseeks.AuditEntry{
+				Decision: meeseeks.AuditFinished,
+				JobID:    job.ID,
+				Reason:   string(status),
+				Request:  req,
+			}, cmd))
+			notifyWebhook(cmd, job.ID)
+			m.notifySubscribers(cmd, job.ID)
 			m.wg.Done()
 		}(t)
 	}
 }
 
-type activeCommands struct {
-	ctx map[uint64]context.CancelFunc
-	m   sync.Mutex
-}
+// withOutput adds the output of the job to the reply, truncated to the
+// configured caps, pointing to the whole of it when it doesn't fit, and the
+// links to its artifacts
+func withOutput(reply formatter.Reply, out string, jobID uint64) formatter.Reply {
+	reply = reply.WithArtifacts(artifacts.Links(jobID))
 
-func newActiveCommands() *activeCommands {
-	return &activeCommands{
-		ctx: make(map[uint64]context.CancelFunc),
+	truncated := limit.Output(out)
+	if truncated == out {
+		return reply.WithOutput(out)
 	}
+	return reply.WithTruncatedOutput(truncated, jobID)
 }
 
-func (a *activeCommands) Add(t task) context.Context {
-	defer a.m.Unlock()
-	a.m.Lock()
+// failedStatus returns the status of a job that returned an error, telling
+// apart the jobs that ran out of time and the ones that were cancelled
+func failedStatus(ctx context.Context) meeseeks.JobStatus {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return meeseeks.JobTimedOutStatus
+	case context.Canceled:
+		return meeseeks.JobKilledStatus
+	default:
+		return meeseeks.JobFailedStatus
+	}
+}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	a.ctx[t.job.ID] = cancel
-	return ctx
+// pools limits how many jobs of each kind of command can run at the same time
+type pools struct {
+	defaultSize int
+	slots       map[string]chan struct{}
+	m           sync.Mutex
 }
 
-func (a *activeCommands) Cancel(jobID uint64) {
-	defer a.m.Unlock()
-	a.m.Lock()
+func newPools(defaultSize int, sizes map[string]int) *pools {
+	p := &pools{
+		defaultSize: defaultSize,
+		slots:       make(map[string]chan struct{}),
+	}
+	for kind, size := range sizes {
+		p.slots[kind] = make(chan struct{}, size)
+	}
+	return p
+}
 
-	cancel, ok := a.ctx[jobID]
+// acquire blocks until there is a free slot in the pool for the kind of
+// command and returns the function to release it
+func (p *pools) acquire(kind string) func() {
+	p.m.Lock()
+	slots, ok := p.slots[kind]
 	if !ok {
-		logrus.Debugf("could not cancel job %d because it is not in the active jobs list", jobID)
-		return
+		if p.defaultSize <= 0 {
+			p.m.Unlock()
+			return func() {}
+		}
+		slots = make(chan struct{}, p.defaultSize)
+		p.slots[kind] = slots
 	}
+	p.m.Unlock()
 
-	// Delete the cancel command from the map
-	delete(a.ctx, jobID)
+	if len(slots) == cap(slots) {
+		logrus.Debugf("Pool for %s commands is full, waiting for a free slot", kind)
+	}
+	slots <- struct{}{}
+	return func() { <-slots }
+}
 
-	// Invoke the cancel function
-	cancel()
+// acquireUnless blocks until there is a free slot in the pool for the kind of
+// command, like acquire, or until stop is closed, then it returns false
+func (p *pools) acquireUnless(kind string, stop <-chan struct{}) (func(), bool) {
+	acquired := make(chan func())
+	cancel := make(chan struct{})
+	go func() {
+		release := p.acquire(kind)
+		select {
+		case acquired <- release:
+		case <-cancel:
+			release()
+		}
+	}()
+
+	select {
+	case release := <-acquired:
+		return release, true
+	case <-stop:
+		close(cancel)
+		return func() {}, false
+	}
 }
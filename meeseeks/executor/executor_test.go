@@ -1,15 +1,27 @@
 package executor_test
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"regexp"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 
+	"gitlab.com/yakshaving.art/meeseeks-box/auth/breakglass"
+	"gitlab.com/yakshaving.art/meeseeks-box/commands/builtins"
 	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
 	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks/executor"
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks/subscriptions"
 	"gitlab.com/yakshaving.art/meeseeks-box/mocks"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/redis"
 	"gitlab.com/yakshaving.art/meeseeks-box/text/template"
+	"github.com/alicebob/miniredis"
 	"github.com/renstrom/dedent"
 	"github.com/sirupsen/logrus"
 )
@@ -194,6 +206,940 @@ func Test_MeeseeksInteractions(t *testing.T) {
 			})
 		}
 		e.Shutdown()
+
+		entries, err := persistence.Audit().Find(meeseeks.AuditFilter{Limit: 10})
+		mocks.Must(t, "could not find audit entries", err)
+		decisions := make([]string, 0)
+		for _, entry := range entries {
+			decisions = append(decisions, entry.Decision)
+		}
+		mocks.AssertEquals(t, []string{
+			meeseeks.AuditAccepted,     // fail
+			meeseeks.AuditUnauthorized, // disallowed
+			meeseeks.AuditUnknown,      // unknown-command
+			meeseeks.AuditAccepted,     // args-echo
+			meeseeks.AuditAccepted,     // help
+			meeseeks.AuditAccepted,     // echo
+		}, decisions)
+	})
+
+}
+
+func TestRepeatedUnauthorizedAttemptsAreAlerted(t *testing.T) {
+	mocks.WithTmpDB(func(dbpath string) {
+		client := mocks.NewHarness().
+			WithConfig(dedent.Dedent(`
+			---
+			commands:
+			  disallowed:
+			    command: false
+			    auth_strategy: none
+			alerts:
+			  channel_id: adminsID
+			  attempts: 2
+			`)).WithDBPath(dbpath).Load()
+
+		e := executor.New(executor.Args{
+			ChatClient:          client,
+			ConcurrentTaskCount: 1,
+		})
+		e.ListenTo(client)
+		go e.Run()
+
+		req := meeseeks.Request{
+			Command:   "disallowed",
+			Username:  "myuser",
+			UserLink:  "<@myuser>",
+			ChannelID: "generalID",
+		}
+		client.RequestsCh <- req
+		mocks.AssertEquals(t, "generalID", (<-client.MessagesSent).Channel)
+
+		client.RequestsCh <- req
+		mocks.AssertEquals(t, "generalID", (<-client.MessagesSent).Channel)
+		alert := <-client.MessagesSent
+		mocks.AssertEquals(t, "adminsID", alert.Channel)
+		mocks.AssertEquals(t, "```\nUser myuser was not allowed to run a command 2 times in the last 10m0s, tried: disallowed```",
+			alert.Text)
+
+		e.Shutdown()
+	})
+}
+
+func TestBreakGlassRelaxesAuthAndIsAudited(t *testing.T) {
+	mocks.WithTmpDB(func(dbpath string) {
+		client := mocks.NewHarness().
+			WithConfig(dedent.Dedent(`
+			---
+			commands:
+			  restricted:
+			    command: "true"
+			    auth_strategy: group
+			    allowed_groups: [admin]
+			    no_handshake: true
+			groups:
+			  admin: [admin_user]
+			  oncall: [oncall_user]
+			break_glass:
+			  channel_id: incidentsID
+			  groups: [oncall]
+			`)).WithDBPath(dbpath).Load()
+		defer breakglass.Configure(breakglass.Config{})
+
+		e := executor.New(executor.Args{
+			ChatClient:          client,
+			WithBuiltinCommands: true,
+			ConcurrentTaskCount: 1,
+		})
+		e.ListenTo(client)
+		go e.Run()
+
+		send := func(username, command string, args ...string) {
+			client.RequestsCh <- meeseeks.Request{
+				Command:   command,
+				Args:      args,
+				Username:  username,
+				UserLink:  "<@" + username + ">",
+				ChannelID: "generalID",
+			}
+		}
+
+		send("oncall_user", "restricted")
+		mocks.AssertMatches(t, "^<@oncall_user> .* not allowed to do", (<-client.MessagesSent).Text)
+
+		send("admin_user", builtins.BuiltinBreakGlassCommand, "-for", "1h", "db-outage")
+		announcement := <-client.MessagesSent
+		mocks.AssertEquals(t, "incidentsID", announcement.Channel)
+		mocks.AssertEquals(t, "```\nBreak glass is on for incident db-outage, started by admin_user: "+
+			"members of oncall can run any command for 1h0m0s```", announcement.Text)
+		mocks.AssertMatches(t, "Break glass is on for incident \\*db-outage\\* until", (<-client.MessagesSent).Text)
+
+		send("oncall_user", "restricted")
+		mocks.AssertEquals(t, "generalID", (<-client.MessagesSent).Channel)
+
+		send("oncall_user", builtins.BuiltinGrantCommand, "oncall_user", "restricted", "-for", "1h")
+		mocks.AssertMatches(t, "^<@oncall_user> .* not allowed to do", (<-client.MessagesSent).Text)
+
+		send("admin_user", builtins.BuiltinBreakGlassEndCommand)
+		mocks.AssertEquals(t, "```\nBreak glass is off for incident db-outage, ended by admin_user```",
+			(<-client.MessagesSent).Text)
+		mocks.AssertMatches(t, "Break glass is off for incident \\*db-outage\\*", (<-client.MessagesSent).Text)
+
+		send("oncall_user", "restricted")
+		mocks.AssertMatches(t, "^<@oncall_user> .* not allowed to do", (<-client.MessagesSent).Text)
+
+		e.Shutdown()
+
+		entries, err := persistence.Audit().Find(meeseeks.AuditFilter{
+			Limit: 10,
+			Match: func(e meeseeks.AuditEntry) bool { return e.Incident == "db-outage" },
+		})
+		mocks.Must(t, "could not find audit entries", err)
+		mocks.AssertEquals(t, 3, len(entries))
+		mocks.AssertEquals(t, builtins.BuiltinBreakGlassEndCommand, entries[0].Request.Command)
+		mocks.AssertEquals(t, builtins.BuiltinGrantCommand, entries[1].Request.Command)
+		mocks.AssertEquals(t, meeseeks.AuditUnauthorized, entries[1].Decision)
+		mocks.AssertEquals(t, "restricted", entries[2].Request.Command)
+		mocks.AssertEquals(t, meeseeks.AuditAccepted, entries[2].Decision)
+	})
+}
+
+func TestCommandsWaitForTheirApprovals(t *testing.T) {
+	mocks.WithTmpDB(func(dbpath string) {
+		client := mocks.NewHarness().
+			WithConfig(dedent.Dedent(`
+			---
+			commands:
+			  deploy:
+			    command: echo
+			    args: ["deployed"]
+			    auth_strategy: any
+			    no_handshake: true
+			    approval:
+			      group: leads
+			      required: 2
+			groups:
+			  admin: [admin_user]
+			  leads: [lead_1, lead_2]
+			`)).WithDBPath(dbpath).Load()
+
+		e := executor.New(executor.Args{
+			ChatClient:          client,
+			WithBuiltinCommands: true,
+			ConcurrentTaskCount: 1,
+		})
+		e.ListenTo(client)
+		go e.Run()
+
+		send := func(username, command string, args ...string) {
+			client.RequestsCh <- meeseeks.Request{
+				Command:   command,
+				Args:      args,
+				Username:  username,
+				UserLink:  "<@" + username + ">",
+				ChannelID: "generalID",
+			}
+		}
+
+		send("someone", "deploy")
+		pending := (<-client.MessagesSent).Text
+		mocks.AssertMatches(t, "deploy needs 2 approvals, approve it with: approve [0-9]+", pending)
+		id := regexp.MustCompile("approve ([0-9]+)").FindStringSubmatch(pending)[1]
+
+		send("lead_1", builtins.BuiltinApproveCommand, id)
+		mocks.AssertMatches(t, "Approved request "+id+", it has 1/2 approvals", (<-client.MessagesSent).Text)
+
+		send("lead_1", builtins.BuiltinApproveCommand, id)
+		mocks.AssertMatches(t, "lead_1 already approved request "+id, (<-client.MessagesSent).Text)
+
+		send("lead_2", builtins.BuiltinApproveCommand, id)
+		replies := []string{(<-client.MessagesSent).Text, (<-client.MessagesSent).Text}
+		sort.Strings(replies)
+		mocks.AssertMatches(t, "Request "+id+" got all its approvals, running deploy", replies[0])
+		mocks.AssertMatches(t, "^<@someone> .*\n```\ndeployed\n```", replies[1])
+
+		e.Shutdown()
+
+		entries, err := persistence.Audit().Find(meeseeks.AuditFilter{
+			Limit: 10,
+			Match: func(e meeseeks.AuditEntry) bool { return e.Request.Command == "deploy" },
+		})
+		mocks.Must(t, "could not find audit entries", err)
+		mocks.AssertEquals(t, 2, len(entries))
+		mocks.AssertEquals(t, meeseeks.AuditAccepted, entries[0].Decision)
+		mocks.AssertEquals(t, "approved by lead_1, lead_2", entries[0].Reason)
+		mocks.AssertEquals(t, meeseeks.AuditPending, entries[1].Decision)
+	})
+}
+
+func TestCommandOwnersAreShownAndAudited(t *testing.T) {
+	mocks.WithTmpDB(func(dbpath string) {
+		client := mocks.NewHarness().
+			WithConfig(dedent.Dedent(`
+			---
+			commands:
+			  deploy:
+			    command: echo
+			    args: ["deployed"]
+			    auth_strategy: any
+			    no_handshake: true
+			    owner: team-a
+			    source: https://git.example.com/team-a/commands
+			    help:
+			      summary: deploys things
+			`)).WithDBPath(dbpath).Load()
+
+		e := executor.New(executor.Args{
+			ChatClient:          client,
+			WithBuiltinCommands: true,
+			ConcurrentTaskCount: 1,
+		})
+		e.ListenTo(client)
+		go e.Run()
+
+		client.RequestsCh <- meeseeks.Request{
+			Command:   builtins.BuiltinHelpCommand,
+			Args:      []string{"deploy"},
+			Username:  "someone",
+			ChannelID: "generalID",
+		}
+		mocks.AssertMatches(t, "Owned by \\*team-a\\*\nDefined in _https://git.example.com/team-a/commands_",
+			(<-client.MessagesSent).Text)
+
+		client.RequestsCh <- meeseeks.Request{
+			Command:   "deploy",
+			Username:  "someone",
+			ChannelID: "generalID",
+		}
+		mocks.AssertMatches(t, "deployed", (<-client.MessagesSent).Text)
+
+		e.Shutdown()
+
+		entries, err := persistence.Audit().Find(meeseeks.AuditFilter{
+			Limit: 10,
+			Match: func(e meeseeks.AuditEntry) bool { return e.Request.Command == "deploy" },
+		})
+		mocks.Must(t, "could not find audit entries", err)
+		mocks.AssertEquals(t, 1, len(entries))
+		mocks.AssertEquals(t, "team-a", entries[0].Owner)
+		mocks.AssertEquals(t, "https://git.example.com/team-a/commands", entries[0].Source)
+	})
+}
+
+func TestTruncatedOutputsPointToTheWholeOutput(t *testing.T) {
+	mocks.WithTmpDB(func(dbpath string) {
+		client := mocks.NewHarness().
+			WithConfig(dedent.Dedent(`
+			---
+			output:
+			  max_lines: 2
+			format:
+			  templates:
+			    success: "{{ .output }}"
+			commands:
+			  chatty:
+			    command: sh
+			    args: ["-c", "for i in 1 2 3 4 5; do echo line$i; done"]
+			    auth_strategy: any
+			    no_handshake: true
+			  quiet:
+			    command: echo
+			    args: ["done"]
+			    auth_strategy: any
+			    no_handshake: true
+			`)).WithDBPath(dbpath).Load()
+
+		e := executor.New(executor.Args{
+			ChatClient:          client,
+			ConcurrentTaskCount: 1,
+		})
+		e.ListenTo(client)
+		go e.Run()
+
+		client.RequestsCh <- meeseeks.Request{
+			Command:   "chatty",
+			ChannelID: "generalID",
+		}
+		mocks.AssertEquals(t, "line1\n[... 3 lines (18 bytes) truncated ...]\nline5\n"+
+			"The output was truncated, the whole of it is in `logs 1`", (<-client.MessagesSent).Text)
+
+		client.RequestsCh <- meeseeks.Request{
+			Command:   "quiet",
+			ChannelID: "generalID",
+		}
+		mocks.AssertEquals(t, "done\n", (<-client.MessagesSent).Text)
+
+		e.Shutdown()
 	})
+}
+
+func TestSlowLocalCommandsDoNotBlockBuiltins(t *testing.T) {
+	mocks.WithTmpDB(func(dbpath string) {
+		client := mocks.NewHarness().
+			WithConfig(dedent.Dedent(`
+			---
+			commands:
+			  slow:
+			    command: sleep
+			    args: ["1"]
+			    auth_strategy: any
+			`)).WithDBPath(dbpath).Load()
+
+		e := executor.New(executor.Args{
+			ChatClient:          client,
+			WithBuiltinCommands: true,
+			ConcurrentTaskCount: 1,
+			PoolSizes: map[string]int{
+				"local":   1,
+				"builtin": 1,
+			},
+		})
+		e.ListenTo(client)
+
+		go e.Run()
+
+		send := func(cmd string) {
+			client.RequestsCh <- meeseeks.Request{
+				Command:   cmd,
+				UserLink:  "<@myuser>",
+				ChannelID: "generalID",
+			}
+		}
+
+		send("slow")
+		handshake := <-client.MessagesSent
+		mocks.AssertMatches(t, fmt.Sprintf("^(%s)$", strings.Join(template.DefaultHandshakeMessages, "|")), handshake.Text)
+
+		// The local pool is full, but builtins still get a slot
+		send("slow")
+		send("version")
+		for {
+			reply := <-client.MessagesSent
+			if strings.Contains(reply.Text, "meeseeks-box version") {
+				break
+			}
+			mocks.AssertMatches(t, fmt.Sprintf("^(%s)$", strings.Join(template.DefaultHandshakeMessages, "|")), reply.Text)
+		}
 
+		go func() {
+			for range client.MessagesSent {
+			}
+		}()
+		e.Shutdown()
+	})
+}
+
+func TestReplicasShareTheQueue(t *testing.T) {
+	mocks.WithTmpDB(func(dbpath string) {
+		s, err := miniredis.Run()
+		mocks.Must(t, "could not start redis server", err)
+		defer s.Close()
+
+		r, err := redis.New(redis.Config{Address: s.Addr()})
+		mocks.Must(t, "could not connect to redis", err)
+		defer r.Close()
+
+		client := mocks.NewHarness().
+			WithConfig(dedent.Dedent(`
+			---
+			commands:
+			  echo:
+			    command: echo
+			    auth_strategy: any
+			`)).WithDBPath(dbpath).Load()
+
+		replicas := []*executor.Executor{}
+		for i := 0; i < 2; i++ {
+			replicas = append(replicas, executor.New(executor.Args{
+				ChatClient:          client,
+				ConcurrentTaskCount: 1,
+				Queue:               r,
+				Locker:              r,
+			}))
+		}
+		replicas[0].ListenTo(client)
+		go replicas[0].Run()
+
+		send := func(timestamp string) {
+			client.RequestsCh <- meeseeks.Request{
+				Command:   "echo",
+				Args:      []string{"hello"},
+				UserLink:  "<@myuser>",
+				ChannelID: "generalID",
+				Timestamp: timestamp,
+			}
+		}
+
+		// The same chat message delivered twice is only accepted once
+		send("1")
+		send("1")
+		send("2")
+
+		successes := 0
+		for successes < 2 {
+			reply := <-client.MessagesSent
+			if strings.Contains(reply.Text, "hello") {
+				successes++
+			}
+		}
+
+		recorded, err := persistence.Jobs().Find(meeseeks.JobFilter{Limit: 10})
+		mocks.Must(t, "could not find jobs", err)
+		mocks.AssertEquals(t, 2, len(recorded))
+
+		go func() {
+			for range client.MessagesSent {
+			}
+		}()
+		for _, e := range replicas {
+			e.Shutdown()
+		}
+
+		recorded, err = persistence.Jobs().Find(meeseeks.JobFilter{Limit: 10})
+		mocks.Must(t, "could not find jobs", err)
+		for _, j := range recorded {
+			mocks.AssertEquals(t, meeseeks.JobSucceededStatus, j.Status)
+		}
+	})
+}
+
+func TestSlowExternalAuthDoesNotHoldOtherRequests(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte(`{"allow": true}`))
+	}))
+	defer server.Close()
+	defer close(release)
+
+	mocks.WithTmpDB(func(dbpath string) {
+		client := mocks.NewHarness().
+			WithConfig(dedent.Dedent(fmt.Sprintf(`
+			---
+			external_auth:
+			  url: %s
+			commands:
+			  deploy:
+			    command: "true"
+			    auth_strategy: external
+			    no_handshake: true
+			  echo:
+			    command: echo
+			    auth_strategy: any
+			    no_handshake: true
+			`, server.URL))).WithDBPath(dbpath).Load()
+
+		e := executor.New(executor.Args{
+			ChatClient:          client,
+			ConcurrentTaskCount: 1,
+		})
+		e.ListenTo(client)
+		go e.Run()
+
+		for _, command := range []string{"deploy", "echo"} {
+			client.RequestsCh <- meeseeks.Request{
+				Command:   command,
+				Args:      []string{"hello"},
+				UserLink:  "<@myuser>",
+				ChannelID: "generalID",
+			}
+		}
+
+		mocks.AssertMatches(t, "hello", (<-client.MessagesSent).Text)
+		release <- struct{}{}
+		mocks.AssertMatches(t, "^<@myuser> ", (<-client.MessagesSent).Text)
+		e.Shutdown()
+	})
+}
+
+func TestBusyReplicasLeaveQueuedJobsAlone(t *testing.T) {
+	mocks.WithTmpDB(func(dbpath string) {
+		s, err := miniredis.Run()
+		mocks.Must(t, "could not start redis server", err)
+		defer s.Close()
+
+		r, err := redis.New(redis.Config{Address: s.Addr()})
+		mocks.Must(t, "could not connect to redis", err)
+		defer r.Close()
+
+		client := mocks.NewHarness().
+			WithConfig(dedent.Dedent(`
+			---
+			commands:
+			  slow:
+			    command: sleep
+			    args: ["1"]
+			    auth_strategy: any
+			    no_handshake: true
+			`)).WithDBPath(dbpath).Load()
+
+		e := executor.New(executor.Args{
+			ChatClient:          client,
+			ConcurrentTaskCount: 1,
+			Queue:               r,
+		})
+		e.ListenTo(client)
+		go e.Run()
+
+		for _, timestamp := range []string{"1", "2"} {
+			client.RequestsCh <- meeseeks.Request{
+				Command:   "slow",
+				UserLink:  "<@myuser>",
+				ChannelID: "generalID",
+				Timestamp: timestamp,
+			}
+		}
+
+		// The second job waits in the queue for a free slot, any other
+		// replica could still take it
+		time.Sleep(300 * time.Millisecond)
+		job, err := persistence.Jobs().Get(2)
+		mocks.Must(t, "could not get job", err)
+		mocks.AssertEquals(t, meeseeks.JobQueuedStatus, job.Status)
+
+		<-client.MessagesSent
+		<-client.MessagesSent
+		e.Shutdown()
+
+		for _, id := range []uint64{1, 2} {
+			job, err := persistence.Jobs().Get(id)
+			mocks.Must(t, "could not get job", err)
+			mocks.AssertEquals(t, meeseeks.JobSucceededStatus, job.Status)
+		}
+	})
+}
+
+func TestJobsEndInTheirStatus(t *testing.T) {
+	mocks.WithTmpDB(func(dbpath string) {
+		client := mocks.NewHarness().
+			WithConfig(dedent.Dedent(`
+			---
+			commands:
+			  echo:
+			    command: echo
+			    auth_strategy: any
+			    no_handshake: true
+			  fail:
+			    command: "false"
+			    auth_strategy: any
+			    no_handshake: true
+			  slow:
+			    command: sleep
+			    args: ["5"]
+			    auth_strategy: any
+			    no_handshake: true
+			    timeout: 1
+			`)).WithDBPath(dbpath).Load()
+
+		e := executor.New(executor.Args{
+			ChatClient:          client,
+			ConcurrentTaskCount: 1,
+		})
+		e.ListenTo(client)
+		go e.Run()
+
+		for _, cmd := range []string{"echo", "fail", "slow"} {
+			client.RequestsCh <- meeseeks.Request{
+				Command:   cmd,
+				UserLink:  "<@myuser>",
+				ChannelID: "generalID",
+			}
+			<-client.MessagesSent
+		}
+		e.Shutdown()
+
+		for id, status := range map[uint64]meeseeks.JobStatus{
+			1: meeseeks.JobSucceededStatus,
+			2: meeseeks.JobFailedStatus,
+			3: meeseeks.JobTimedOutStatus,
+		} {
+			job, err := persistence.Jobs().Get(id)
+			mocks.Must(t, "could not get job", err)
+			mocks.AssertEquals(t, status, job.Status)
+		}
+	})
+}
+
+func TestRecoveringInterruptedJobs(t *testing.T) {
+	mocks.WithTmpDB(func(dbpath string) {
+		client := mocks.NewHarness().WithDBPath(dbpath).Load()
+
+		job, err := persistence.Jobs().Create(meeseeks.Request{
+			Command:   "deploy",
+			UserLink:  "<@myuser>",
+			ChannelID: "generalID",
+		})
+		mocks.Must(t, "could not create job", err)
+
+		recovered := make(chan error)
+		go func() {
+			recovered <- executor.RecoverInterruptedJobs(client, true)
+		}()
+
+		reply := <-client.MessagesSent
+		mocks.AssertMatches(t, "^<@myuser> .*job 1 was interrupted, the meeseeks stopped while the job was running$", reply.Text)
+		mocks.AssertEquals(t, "generalID", reply.Channel)
+		mocks.Must(t, "could not recover interrupted jobs", <-recovered)
+
+		job, err = persistence.Jobs().Get(job.ID)
+		mocks.Must(t, "could not get job", err)
+		mocks.AssertEquals(t, meeseeks.JobInterruptedStatus, job.Status)
+		mocks.AssertEquals(t, executor.InterruptedJobNote, job.Note)
+
+		mocks.Must(t, "recovering twice should do nothing", executor.RecoverInterruptedJobs(client, true))
+	})
+}
+
+func TestRecoveringQueuedJobs(t *testing.T) {
+	mocks.WithTmpDB(func(dbpath string) {
+		client := mocks.NewHarness().
+			WithConfig(dedent.Dedent(`
+			---
+			commands:
+			  echo:
+			    command: echo
+			    auth_strategy: any
+			    no_handshake: true
+			`)).WithDBPath(dbpath).Load()
+
+		req := meeseeks.Request{
+			Command:   "echo",
+			Args:      []string{"resumed"},
+			UserLink:  "<@myuser>",
+			ChannelID: "generalID",
+		}
+		resumed, err := persistence.Jobs().Queue(req)
+		mocks.Must(t, "could not queue job", err)
+
+		e := executor.New(executor.Args{
+			ChatClient:          client,
+			ConcurrentTaskCount: 1,
+		})
+		mocks.Must(t, "could not resume queued jobs", e.RecoverQueuedJobs(true, false))
+
+		reply := <-client.MessagesSent
+		mocks.AssertMatches(t, "resumed", reply.Text)
+		e.Shutdown()
+
+		job, err := persistence.Jobs().Get(resumed.ID)
+		mocks.Must(t, "could not get job", err)
+		mocks.AssertEquals(t, meeseeks.JobSucceededStatus, job.Status)
+
+		failed, err := persistence.Jobs().Queue(req)
+		mocks.Must(t, "could not queue job", err)
+
+		e = executor.New(executor.Args{
+			ChatClient:          client,
+			ConcurrentTaskCount: 1,
+		})
+		defer e.Shutdown()
+
+		recovered := make(chan error)
+		go func() {
+			recovered <- e.RecoverQueuedJobs(false, true)
+		}()
+
+		reply = <-client.MessagesSent
+		mocks.AssertMatches(t, "^<@myuser> .*job 2 was not run, the meeseeks stopped while the job was queued$", reply.Text)
+		mocks.Must(t, "could not fail queued jobs", <-recovered)
+
+		job, err = persistence.Jobs().Get(failed.ID)
+		mocks.Must(t, "could not get job", err)
+		mocks.AssertEquals(t, meeseeks.JobFailedStatus, job.Status)
+		mocks.AssertEquals(t, executor.FailedQueuedJobNote, job.Note)
+	})
+}
+
+func TestFinishedJobsArePostedToTheWebhook(t *testing.T) {
+	received := make(chan executor.JobPayload, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		p := executor.JobPayload{}
+		if err := json.Unmarshal(body, &p); err != nil {
+			t.Errorf("invalid job payload %s: %s", body, err)
+		}
+		received <- p
+	}))
+	defer server.Close()
+
+	mocks.WithTmpDB(func(dbpath string) {
+		client := mocks.NewHarness().
+			WithConfig(dedent.Dedent(fmt.Sprintf(`
+			---
+			commands:
+			  deploy:
+			    command: sh
+			    args: ["-c", "for i in 1 2 3 4 5; do echo line$i; done; false"]
+			    auth_strategy: any
+			    no_handshake: true
+			    webhook:
+			      url: %s
+			      output_lines: 2
+			`, server.URL))).WithDBPath(dbpath).Load()
+
+		e := executor.New(executor.Args{
+			ChatClient:          client,
+			ConcurrentTaskCount: 1,
+		})
+		e.ListenTo(client)
+		go e.Run()
+
+		client.RequestsCh <- meeseeks.Request{
+			Command:   "deploy",
+			UserLink:  "<@myuser>",
+			ChannelID: "generalID",
+		}
+		<-client.MessagesSent
+
+		select {
+		case p := <-received:
+			mocks.AssertEquals(t, uint64(1), p.Job.ID)
+			mocks.AssertEquals(t, "deploy", p.Job.Request.Command)
+			mocks.AssertEquals(t, meeseeks.JobFailedStatus, p.Status)
+			mocks.AssertEquals(t, p.Job.EndTime.Sub(p.Job.StartTime).Seconds(), p.Duration)
+			mocks.AssertEquals(t, "line1\n[... 3 lines (18 bytes) truncated ...]\nline5", p.Output)
+		case <-time.After(time.Second):
+			t.Fatal("the webhook was not called")
+		}
+
+		e.Shutdown()
+	})
+}
+
+func TestFinishedJobsAreSentToTheAuditSinks(t *testing.T) {
+	received := make(chan meeseeks.AuditEntry, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		e := meeseeks.AuditEntry{}
+		if err := json.Unmarshal(body, &e); err != nil {
+			t.Errorf("invalid audit entry %s: %s", body, err)
+		}
+		received <- e
+	}))
+	defer server.Close()
+
+	mocks.WithTmpDB(func(dbpath string) {
+		client := mocks.NewHarness().
+			WithConfig(dedent.Dedent(fmt.Sprintf(`
+			---
+			audit:
+			  webhook:
+			    url: %s
+			commands:
+			  deploy:
+			    command: "false"
+			    auth_strategy: any
+			    no_handshake: true
+			`, server.URL))).WithDBPath(dbpath).Load()
+
+		e := executor.New(executor.Args{
+			ChatClient:          client,
+			ConcurrentTaskCount: 1,
+		})
+		e.ListenTo(client)
+		go e.Run()
+
+		client.RequestsCh <- meeseeks.Request{
+			Command:   "deploy",
+			UserLink:  "<@myuser>",
+			ChannelID: "generalID",
+		}
+		<-client.MessagesSent
+
+		decisions := map[string]meeseeks.AuditEntry{}
+		for len(decisions) < 2 {
+			select {
+			case entry := <-received:
+				decisions[entry.Decision] = entry
+			case <-time.After(time.Second):
+				t.Fatalf("the audit sink got %d entries", len(decisions))
+			}
+		}
+		mocks.AssertEquals(t, uint64(1), decisions[meeseeks.AuditAccepted].JobID)
+		mocks.AssertEquals(t, uint64(1), decisions[meeseeks.AuditFinished].JobID)
+		mocks.AssertEquals(t, string(meeseeks.JobFailedStatus), decisions[meeseeks.AuditFinished].Reason)
+		mocks.AssertEquals(t, "deploy", decisions[meeseeks.AuditFinished].Request.Command)
+
+		// Finished jobs are only sent to the sinks
+		entries, err := persistence.Audit().Find(meeseeks.AuditFilter{Limit: 10})
+		mocks.Must(t, "could not find audit entries", err)
+		mocks.AssertEquals(t, 1, len(entries))
+
+		e.Shutdown()
+	})
+}
+
+func TestFinishedJobsAreNotifiedToSubscribers(t *testing.T) {
+	mocks.WithTmpDB(func(dbpath string) {
+		client := mocks.NewHarness().
+			WithConfig(dedent.Dedent(`
+			---
+			commands:
+			  deploy:
+			    command: echo
+			    auth_strategy: any
+			    no_handshake: true
+			    notify:
+			      caller: true
+			`)).WithDBPath(dbpath).Load()
+
+		e := executor.New(executor.Args{
+			ChatClient:          client,
+			ConcurrentTaskCount: 1,
+		})
+		e.ListenTo(client)
+		go e.Run()
+
+		subscriptions.Subscribe(1, "someoneID")
+		client.RequestsCh <- meeseeks.Request{
+			Command:   "deploy",
+			Args:      []string{"production"},
+			UserID:    "myuserID",
+			UserLink:  "<@myuser>",
+			ChannelID: "generalID",
+		}
+		<-client.MessagesSent
+
+		for _, user := range []string{"someoneID", "myuserID"} {
+			msg := <-client.MessagesSent
+			mocks.AssertEquals(t, user, msg.Channel)
+			mocks.AssertMatches(t, "Job 1, deploy production, finished with status Succeeded after 0s", msg.Text)
+		}
+		mocks.AssertEquals(t, []string(nil), subscriptions.Take(1))
+
+		e.Shutdown()
+	})
+}
+
+func TestStreamedOutput(t *testing.T) {
+	mocks.WithTmpDB(func(dbpath string) {
+		client := mocks.NewHarness().
+			WithConfig(dedent.Dedent(`
+			---
+			commands:
+			  deploy:
+			    command: sh
+			    args: ["-c", "echo first; sleep 1.5; echo second"]
+			    auth_strategy: any
+			    no_handshake: true
+			    stream:
+			      lines: 1
+			`)).WithDBPath(dbpath).Load()
+
+		e := executor.New(executor.Args{
+			ChatClient:          client,
+			ConcurrentTaskCount: 1,
+		})
+		e.ListenTo(client)
+		go e.Run()
+
+		client.RequestsCh <- meeseeks.Request{
+			Command:   "deploy",
+			UserLink:  "<@myuser>",
+			ChannelID: "generalID",
+		}
+
+		progress := <-client.MessagesSent
+		mocks.AssertEquals(t, "```\nfirst```", progress.Text)
+
+		done := <-client.MessagesSent
+		mocks.AssertMatches(t, "second", done.Text)
+		if strings.Contains(done.Text, "first") {
+			t.Fatalf("streamed lines should not be sent again, got %s", done.Text)
+		}
+
+		e.Shutdown()
+	})
+}
+
+func TestRerunCreatesALinkedJob(t *testing.T) {
+	mocks.WithTmpDB(func(dbpath string) {
+		client := mocks.NewHarness().
+			WithConfig(dedent.Dedent(`
+			---
+			commands:
+			  echo:
+			    command: echo
+			    auth_strategy: any
+			    no_handshake: true
+			`)).WithDBPath(dbpath).Load()
+
+		e := executor.New(executor.Args{
+			ChatClient:          client,
+			WithBuiltinCommands: true,
+			ConcurrentTaskCount: 1,
+		})
+		e.ListenTo(client)
+		go e.Run()
+
+		client.RequestsCh <- meeseeks.Request{
+			Command:   "echo",
+			Args:      []string{"hello"},
+			Username:  "myuser",
+			UserLink:  "<@myuser>",
+			ChannelID: "generalID",
+		}
+		mocks.AssertMatches(t, "hello", (<-client.MessagesSent).Text)
+
+		client.RequestsCh <- meeseeks.Request{
+			Command:   "rerun",
+			Args:      []string{"1"},
+			Username:  "otheruser",
+			UserLink:  "<@otheruser>",
+			ChannelID: "randomID",
+		}
+		mocks.AssertMatches(t, "Running job 1 again", (<-client.MessagesSent).Text)
+
+		again := <-client.MessagesSent
+		mocks.AssertMatches(t, "(?s)^<@otheruser> .*hello", again.Text)
+		mocks.AssertEquals(t, "generalID", again.Channel)
+
+		e.Shutdown()
+
+		job, err := persistence.Jobs().Get(2)
+		mocks.Must(t, "could not get rerun job", err)
+		mocks.AssertEquals(t, uint64(1), job.Request.RerunOf)
+		mocks.AssertEquals(t, "otheruser", job.Request.Username)
+		mocks.AssertEquals(t, []string{"hello"}, job.Request.Args)
+	})
 }
@@ -0,0 +1,56 @@
+package executor
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks/subscriptions"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence"
+	"gitlab.com/yakshaving.art/meeseeks-box/text/formatter"
+)
+
+// notifySubscribers sends a direct message to the users that asked to be
+// told when the job finishes, and to its caller when the command always tells
+// it and the job took long enough
+func (m *Executor) notifySubscribers(cmd meeseeks.Command, jobID uint64) {
+	if jobID == 0 {
+		return
+	}
+	users := subscriptions.Take(jobID)
+
+	job, err := persistence.Jobs().Get(jobID)
+	if err != nil {
+		logrus.Errorf("Could not get job %d to notify its subscribers: %s", jobID, err)
+		return
+	}
+	duration := job.EndTime.Sub(job.StartTime)
+
+	if n, ok := cmd.(meeseeks.CallerNotifier); ok && n.GetNotify().Caller &&
+		duration >= n.GetNotify().After && !contains(users, job.Request.UserID) {
+		users = append(users, job.Request.UserID)
+	}
+
+	text := fmt.Sprintf("Job %d, %s, finished with status %s after %s",
+		jobID, strings.TrimSpace(job.Request.Command+" "+strings.Join(job.Request.Args, " ")),
+		job.Status, duration.Round(time.Second))
+	for _, user := range users {
+		m.client.Reply(formatter.ProgressReply(meeseeks.Request{
+			UserID:    user,
+			ChannelID: user,
+			IsIM:      true,
+		}).WithOutput(text))
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package executor
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence"
+	"gitlab.com/yakshaving.art/meeseeks-box/text/formatter"
+)
+
+// How often the logs of a streamed job are checked for new lines
+var streamPollInterval = time.Second
+
+// streamer sends the output of a running job to the chat in chunks, reading
+// it from the job logs
+type streamer struct {
+	client ChatClient
+	req    meeseeks.Request
+	jobID  uint64
+	opts   meeseeks.StreamOpts
+
+	sent  int
+	shown []string
+
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+// startStreaming starts streaming the output of the job if the command asks
+// for it, only recorded jobs can be streamed as the output is read from the logs
+func startStreaming(client ChatClient, job meeseeks.Job, cmd meeseeks.Command) *streamer {
+	s, ok := cmd.(meeseeks.Streamer)
+	if !ok || !s.GetStream().Enabled() || job.ID == 0 {
+		return nil
+	}
+
+	st := &streamer{
+		client: client,
+		req:    job.Request,
+		jobID:  job.ID,
+		opts:   s.GetStream(),
+		shown:  make([]string, 0),
+		stopCh: make(chan struct{}),
+		doneCh: make(chan struct{}),
+	}
+	go st.run()
+
+	return st
+}
+
+func (s *streamer) run() {
+	defer close(s.doneCh)
+
+	poll := streamPollInterval
+	if s.opts.Interval > 0 && s.opts.Interval < poll {
+		poll = s.opts.Interval
+	}
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+
+	lastSent := time.Now()
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		lines := s.pending()
+		if len(lines) == 0 {
+			continue
+		}
+		if (s.opts.Lines > 0 && len(lines) >= s.opts.Lines) ||
+			(s.opts.Interval > 0 && time.Since(lastSent) >= s.opts.Interval) {
+			s.send(lines, false)
+			lastSent = time.Now()
+		}
+	}
+}
+
+// pending returns the lines in the job logs that have not been sent yet
+func (s *streamer) pending() []string {
+	jobLog, err := persistence.LogReader().Get(s.jobID)
+	if err != nil || jobLog.Output == "" {
+		return nil
+	}
+	lines := strings.Split(jobLog.Output, "\n")
+	if len(lines) <= s.sent {
+		return nil
+	}
+	return lines[s.sent:]
+}
+
+func (s *streamer) send(lines []string, final bool) {
+	s.sent += len(lines)
+
+	if !s.opts.Edit {
+		s.client.Reply(formatter.ProgressReply(s.req).WithOutput(strings.Join(lines, "\n")))
+		return
+	}
+
+	s.shown = append(s.shown, lines...)
+	reply := formatter.ProgressReply(s.req).
+		WithOutput(strings.Join(s.shown, "\n")).
+		Replacing(fmt.Sprintf("job-%d", s.jobID))
+	if final {
+		reply = reply.Final()
+	}
+	s.client.Reply(reply)
+}
+
+// stop stops streaming and returns what is left to send of the output, which
+// is the whole output if nothing was streamed
+func (s *streamer) stop(out string) string {
+	if s == nil {
+		return out
+	}
+	close(s.stopCh)
+	<-s.doneCh
+
+	if s.sent == 0 {
+		return out
+	}
+
+	rest := s.pending()
+	if s.opts.Edit {
+		s.send(rest, true)
+		return ""
+	}
+	if len(rest) == 0 {
+		return ""
+	}
+	return strings.Join(rest, "\n") + "\n"
+}
@@ -0,0 +1,91 @@
+package executor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/logs/limit"
+)
+
+// How long a webhook call can take when the command sets no timeout
+const defaultWebhookTimeout = 5 * time.Second
+
+// How many output lines are posted when the command doesn't say
+const defaultWebhookOutputLines = 10
+
+// JobPayload is what is posted as JSON to the webhook of a command when one
+// of its jobs finishes, the duration is in seconds
+type JobPayload struct {
+	Job      meeseeks.Job       `json:"job"`
+	Status   meeseeks.JobStatus `json:"status"`
+	Duration float64            `json:"duration"`
+	Output   string             `json:"output"`
+}
+
+// notifyWebhook posts the finished job to the webhook of the command if it
+// has one. The output is read from the job logs, as failed and streamed jobs
+// don't return all of it. It's done in the background so a slow webhook
+// doesn't hold the job back, failures are only logged
+func notifyWebhook(cmd meeseeks.Command, jobID uint64) {
+	n, ok := cmd.(meeseeks.Notifier)
+	if !ok || !n.GetWebhook().Enabled() || jobID == 0 {
+		return
+	}
+
+	job, err := persistence.Jobs().Get(jobID)
+	if err != nil {
+		logrus.Errorf("Could not get job %d to post it to the webhook: %s", jobID, err)
+		return
+	}
+
+	jobLog, err := persistence.LogReader().Get(jobID)
+	if err != nil && err != meeseeks.ErrNoLogsForJob {
+		logrus.Errorf("Could not get job %d logs to post them to the webhook: %s", jobID, err)
+	}
+
+	go func() {
+		if err := postJob(n.GetWebhook(), job, jobLog.Output); err != nil {
+			logrus.Errorf("Could not post job %d to the webhook: %s", jobID, err)
+		}
+	}()
+}
+
+func postJob(opts meeseeks.WebhookOpts, job meeseeks.Job, out string) error {
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = defaultWebhookTimeout
+	}
+	lines := opts.OutputLines
+	if lines <= 0 {
+		lines = defaultWebhookOutputLines
+	}
+
+	payload, err := json.Marshal(JobPayload{
+		Job:      job,
+		Status:   job.Status,
+		Duration: job.EndTime.Sub(job.StartTime).Seconds(),
+		Output:   limit.Truncate(limit.Config{MaxLines: lines}, out),
+	})
+	if err != nil {
+		return fmt.Errorf("could not marshal job: %s", err)
+	}
+
+	client := http.Client{Timeout: timeout}
+	resp, err := client.Post(opts.URL, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("could not post job: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
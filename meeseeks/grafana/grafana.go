@@ -0,0 +1,213 @@
+package grafana
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+)
+
+// DefaultTimeout is how long a call to Grafana can take when no timeout is set
+const DefaultTimeout = 5 * time.Second
+
+// Config holds the Grafana the jobs of some commands are annotated in, so
+// they show up on the dashboards
+//
+// URL is the base url of Grafana and Token an API token or service account
+// token that can write annotations, calls to it can take Timeout seconds.
+// Commands are the names of the commands whose jobs are annotated, from when
+// they start to when they finish, with Tags and the name of the command as
+// tags. DashboardUID and PanelID pin the annotations to a dashboard or a
+// panel, they are shown on all the dashboards that query them by tag
+// otherwise
+type Config struct {
+	URL          string        `yaml:"url"`
+	Token        string        `yaml:"token"`
+	Timeout      time.Duration `yaml:"timeout"`
+	Commands     []string      `yaml:"commands"`
+	Tags         []string      `yaml:"tags"`
+	DashboardUID string        `yaml:"dashboard_uid"`
+	PanelID      int           `yaml:"panel_id"`
+}
+
+// Enabled returns true if a Grafana to annotate is configured
+func (c Config) Enabled() bool {
+	return c.URL != ""
+}
+
+// Validate checks that the configuration is usable
+func (c Config) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("invalid grafana url %s, it has to be an http or https url", c.URL)
+	}
+	if len(c.Commands) == 0 {
+		return fmt.Errorf("grafana requires the commands to annotate")
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("grafana timeout can't be negative")
+	}
+	return nil
+}
+
+func (c Config) annotates(command string) bool {
+	for _, name := range c.Commands {
+		if name == command {
+			return true
+		}
+	}
+	return false
+}
+
+var config Config
+var mutex sync.Mutex
+
+// Configure sets the Grafana the jobs are annotated in, the annotations of
+// the jobs that are running are finished in the one they were started in
+func Configure(cnf Config) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	config = cnf
+}
+
+func getConfig() Config {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return config
+}
+
+// annotation is what is posted to the annotations api of Grafana, times are
+// in milliseconds
+type annotation struct {
+	DashboardUID string   `json:"dashboardUID,omitempty"`
+	PanelID      int      `json:"panelId,omitempty"`
+	Time         int64    `json:"time,omitempty"`
+	TimeEnd      int64    `json:"timeEnd,omitempty"`
+	Tags         []string `json:"tags"`
+	Text         string   `json:"text"`
+}
+
+// Annotate starts the annotation of the job when its command is annotated,
+// and returns the func that finishes it with the status of the job. Grafana
+// is called in the background so a slow one doesn't hold the job back,
+// failures are only logged
+func Annotate(job meeseeks.Job) func(meeseeks.JobStatus) {
+	cnf := getConfig()
+	if !cnf.Enabled() || job.ID == 0 || !cnf.annotates(job.Request.Command) {
+		return func(meeseeks.JobStatus) {}
+	}
+
+	started := time.Now()
+	tags := append(append([]string{}, cnf.Tags...), job.Request.Command)
+	text := describe(job)
+
+	created := make(chan int64, 1)
+	go func() {
+		id, err := cnf.create(annotation{
+			DashboardUID: cnf.DashboardUID,
+			PanelID:      cnf.PanelID,
+			Time:         millis(started),
+			Tags:         tags,
+			Text:         text + " started",
+		})
+		if err != nil {
+			logrus.Errorf("Could not annotate the start of job %d in grafana: %s", job.ID, err)
+		}
+		created <- id
+	}()
+
+	return func(status meeseeks.JobStatus) {
+		finished := time.Now()
+		go func() {
+			id := <-created
+			if id == 0 {
+				return
+			}
+			err := cnf.update(id, annotation{
+				Time:    millis(started),
+				TimeEnd: millis(finished),
+				Tags:    append(tags, strings.ToLower(string(status))),
+				Text: fmt.Sprintf("%s finished with status %s after %s", text, status,
+					finished.Sub(started).Round(time.Second)),
+			})
+			if err != nil {
+				logrus.Errorf("Could not annotate the end of job %d in grafana: %s", job.ID, err)
+			}
+		}()
+	}
+}
+
+// describe returns the job, the command it runs and who called it from where
+func describe(job meeseeks.Job) string {
+	r := job.Request
+	where := "a DM"
+	if !r.IsIM && r.Channel != "" {
+		where = "#" + r.Channel
+	}
+	return fmt.Sprintf("Job %d, %s, called by %s in %s", job.ID,
+		strings.TrimSpace(r.Command+" "+strings.Join(r.Args, " ")), r.Username, where)
+}
+
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func (c Config) create(a annotation) (int64, error) {
+	created := struct {
+		ID int64 `json:"id"`
+	}{}
+	if err := c.call(http.MethodPost, "/api/annotations", a, &created); err != nil {
+		return 0, err
+	}
+	return created.ID, nil
+}
+
+func (c Config) update(id int64, a annotation) error {
+	return c.call(http.MethodPatch, fmt.Sprintf("/api/annotations/%d", id), a, nil)
+}
+
+func (c Config) call(method, path string, a annotation, into interface{}) error {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.URL, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	timeout := c.Timeout * time.Second
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	resp, err := (&http.Client{Timeout: timeout}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("grafana replied %s", resp.Status)
+	}
+	if into == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(into)
+}
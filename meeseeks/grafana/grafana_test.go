@@ -0,0 +1,125 @@
+package grafana_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks/grafana"
+	"gitlab.com/yakshaving.art/meeseeks-box/mocks"
+)
+
+func TestValidate(t *testing.T) {
+	tt := []struct {
+		name string
+		cnf  grafana.Config
+		err  string
+	}{
+		{
+			name: "disabled",
+		},
+		{
+			name: "valid",
+			cnf:  grafana.Config{URL: "https://grafana", Commands: []string{"deploy"}},
+		},
+		{
+			name: "not an http url",
+			cnf:  grafana.Config{URL: "grafana", Commands: []string{"deploy"}},
+			err:  "invalid grafana url grafana, it has to be an http or https url",
+		},
+		{
+			name: "no commands",
+			cnf:  grafana.Config{URL: "https://grafana"},
+			err:  "grafana requires the commands to annotate",
+		},
+		{
+			name: "negative timeout",
+			cnf:  grafana.Config{URL: "https://grafana", Commands: []string{"deploy"}, Timeout: -1},
+			err:  "grafana timeout can't be negative",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.cnf.Validate()
+			if tc.err == "" {
+				mocks.Must(t, "invalid configuration", err)
+				return
+			}
+			mocks.AssertEquals(t, tc.err, err.Error())
+		})
+	}
+}
+
+type call struct {
+	method     string
+	path       string
+	auth       string
+	annotation map[string]interface{}
+}
+
+func TestAnnotatingJobs(t *testing.T) {
+	calls := make(chan call, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := call{method: r.Method, path: r.URL.Path, auth: r.Header.Get("Authorization")}
+		if err := json.NewDecoder(r.Body).Decode(&c.annotation); err != nil {
+			t.Errorf("invalid annotation: %s", err)
+		}
+		calls <- c
+		w.Write([]byte(`{"id": 7, "message": "Annotation added"}`))
+	}))
+	defer server.Close()
+
+	grafana.Configure(grafana.Config{
+		URL:          server.URL,
+		Token:        "secret",
+		Commands:     []string{"deploy"},
+		Tags:         []string{"meeseeks"},
+		DashboardUID: "ops",
+	})
+	defer grafana.Configure(grafana.Config{})
+
+	grafana.Annotate(meeseeks.Job{ID: 2, Request: meeseeks.Request{Command: "echo"}})(meeseeks.JobSucceededStatus)
+
+	finish := grafana.Annotate(meeseeks.Job{ID: 1, Request: meeseeks.Request{
+		Command:  "deploy",
+		Args:     []string{"production"},
+		Username: "someone",
+		Channel:  "general",
+	}})
+	started := next(t, calls)
+	mocks.AssertEquals(t, http.MethodPost, started.method)
+	mocks.AssertEquals(t, "/api/annotations", started.path)
+	mocks.AssertEquals(t, "Bearer secret", started.auth)
+	mocks.AssertEquals(t, "ops", started.annotation["dashboardUID"])
+	mocks.AssertEquals(t, []interface{}{"meeseeks", "deploy"}, started.annotation["tags"])
+	mocks.AssertEquals(t, "Job 1, deploy production, called by someone in #general started", started.annotation["text"])
+
+	finish(meeseeks.JobFailedStatus)
+	finished := next(t, calls)
+	mocks.AssertEquals(t, http.MethodPatch, finished.method)
+	mocks.AssertEquals(t, "/api/annotations/7", finished.path)
+	mocks.AssertEquals(t, started.annotation["time"], finished.annotation["time"])
+	mocks.AssertEquals(t, true, finished.annotation["timeEnd"].(float64) >= finished.annotation["time"].(float64))
+	mocks.AssertEquals(t, []interface{}{"meeseeks", "deploy", "failed"}, finished.annotation["tags"])
+	mocks.AssertEquals(t, "Job 1, deploy production, called by someone in #general finished with status Failed after 0s",
+		finished.annotation["text"])
+
+	select {
+	case c := <-calls:
+		t.Fatalf("unexpected call %#v", c)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func next(t *testing.T, calls chan call) call {
+	select {
+	case c := <-calls:
+		return c
+	case <-time.After(time.Second):
+		t.Fatal("grafana was not called")
+	}
+	return call{}
+}
@@ -0,0 +1,88 @@
+package jobs
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var running = make(map[uint64]context.CancelFunc)
+var m sync.Mutex
+
+// Start registers a job as running and returns the context it has to be
+// executed with. This context is done when the job is cancelled, when the
+// timeout expires or when all the jobs are cancelled on shutdown.
+//
+// A timeout of zero or less means the job has no time limit. Jobs with ID 0
+// are not recorded, so they can't be cancelled by ID.
+//
+// The returned function must be called when the job finishes to release it
+func Start(jobID uint64, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, timeout)
+		cancel = chain(cancelTimeout, cancel)
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	if jobID == 0 {
+		return ctx, cancel
+	}
+	running[jobID] = cancel
+
+	return ctx, func() {
+		m.Lock()
+		delete(running, jobID)
+		m.Unlock()
+
+		cancel()
+	}
+}
+
+// Cancel cancels a running job
+func Cancel(jobID uint64) {
+	m.Lock()
+	defer m.Unlock()
+
+	cancel, ok := running[jobID]
+	if !ok {
+		logrus.Debugf("could not cancel job %d because it is not in the running jobs list", jobID)
+		return
+	}
+	delete(running, jobID)
+	cancel()
+}
+
+// CancelAll cancels all the running jobs
+func CancelAll() {
+	m.Lock()
+	defer m.Unlock()
+
+	for jobID, cancel := range running {
+		logrus.Infof("Cancelling job %d", jobID)
+		delete(running, jobID)
+		cancel()
+	}
+}
+
+// IsRunning returns true if the job is registered as running
+func IsRunning(jobID uint64) bool {
+	m.Lock()
+	defer m.Unlock()
+
+	_, ok := running[jobID]
+	return ok
+}
+
+func chain(funcs ...context.CancelFunc) context.CancelFunc {
+	return func() {
+		for _, f := range funcs {
+			f()
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package jobs_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks/jobs"
+	"gitlab.com/yakshaving.art/meeseeks-box/mocks"
+)
+
+func TestCancellingAJob(t *testing.T) {
+	ctx, done := jobs.Start(1, 0)
+	defer done()
+
+	mocks.AssertEquals(t, true, jobs.IsRunning(1))
+	jobs.Cancel(1)
+
+	<-ctx.Done()
+	mocks.AssertEquals(t, context.Canceled, ctx.Err())
+	mocks.AssertEquals(t, false, jobs.IsRunning(1))
+}
+
+func TestJobsTimeOut(t *testing.T) {
+	ctx, done := jobs.Start(2, time.Millisecond)
+	defer done()
+
+	<-ctx.Done()
+	mocks.AssertEquals(t, context.DeadlineExceeded, ctx.Err())
+}
+
+func TestFinishingAJobReleasesIt(t *testing.T) {
+	ctx, done := jobs.Start(3, time.Minute)
+	mocks.AssertEquals(t, true, jobs.IsRunning(3))
+
+	done()
+	mocks.AssertEquals(t, false, jobs.IsRunning(3))
+	mocks.AssertEquals(t, context.Canceled, ctx.Err())
+}
+
+func TestCancelAll(t *testing.T) {
+	ctx1, done1 := jobs.Start(4, 0)
+	defer done1()
+	ctx2, done2 := jobs.Start(5, 0)
+	defer done2()
+
+	jobs.CancelAll()
+
+	<-ctx1.Done()
+	<-ctx2.Done()
+	mocks.AssertEquals(t, false, jobs.IsRunning(4))
+	mocks.AssertEquals(t, false, jobs.IsRunning(5))
+}
+
+func TestNullJobsAreNotRecorded(t *testing.T) {
+	ctx1, done1 := jobs.Start(0, 0)
+	defer done1()
+	ctx2, done2 := jobs.Start(0, 0)
+	defer done2()
+
+	mocks.AssertEquals(t, false, jobs.IsRunning(0))
+	jobs.Cancel(0)
+
+	mocks.AssertEquals(t, nil, ctx1.Err())
+	mocks.AssertEquals(t, nil, ctx2.Err())
+}
@@ -2,7 +2,10 @@ package meeseeks
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"strings"
 	"time"
 )
 
@@ -29,6 +32,8 @@ type Message interface {
 	GetUserLink() string
 	// IsIM
 	IsIM() bool
+	// The timestamp of the message, or of the thread it belongs to, used to reply in a thread
+	GetTimestamp() string
 }
 
 // LoggerProvider wraps the specific logger implementation
@@ -38,11 +43,38 @@ type LoggerProvider interface {
 }
 
 // LogWriter is an interface to write logs to a given job
+//
+// Append is a shorthand to append a stdout line stamped with the current time
 type LogWriter interface {
 	Append(jobID uint64, content string) error
+	AppendLine(jobID uint64, line LogLine) error
 	SetError(jobID uint64, jobErr error) error
 }
 
+// Streams a log line can come from
+const (
+	StdoutStream = "stdout"
+	StderrStream = "stderr"
+)
+
+// LogLine is a line of the output of a job, lines stored before they had a
+// time and a stream have a zero time and come from stdout
+type LogLine struct {
+	Time   time.Time `json:"Time"`
+	Stream string    `json:"Stream"`
+	Text   string    `json:"Text"`
+}
+
+// NewLogLine returns a line of a stream stamped with the current time
+func NewLogLine(stream, text string) LogLine {
+	return LogLine{Time: time.Now().UTC(), Stream: stream, Text: text}
+}
+
+// LogRemover is implemented by log writers that can drop the logs of a job
+type LogRemover interface {
+	Remove(jobID uint64) error
+}
+
 // ErrNoLogsForJob is returned when we try to extract the logs of a non existing job
 var ErrNoLogsForJob = errors.New("No logs for job")
 
@@ -57,6 +89,11 @@ type LogReader interface {
 }
 
 // Request is a structure that holds a command execution request
+//
+// Identity is the corporate identity linked to the user, if any, and
+// ApprovalID is the approval the request got when its command requires one.
+// CallID identifies a request sent to run a command through the API, so the
+// caller can follow its job
 type Request struct {
 	Command     string   `json:"Command"`
 	Args        []string `json:"Arguments"`
@@ -67,21 +104,63 @@ type Request struct {
 	ChannelID   string   `json:"CannelID"`
 	ChannelLink string   `json:"CannelLink"`
 	IsIM        bool     `json:"IsIM"`
+	Timestamp   string   `json:"Timestamp"`
+	RerunOf     uint64   `json:"RerunOf,omitempty"`
+	Identity    string   `json:"Identity,omitempty"`
+	ApprovalID  uint64   `json:"ApprovalID,omitempty"`
+	CallID      string   `json:"CallID,omitempty"`
 }
 
 // Job represents a request that matched a command and can be executed
+//
+// ULID identifies the job across replicas and in external systems, jobs
+// created before ULIDs were introduced only have the ID. Note explains how
+// the job got to its status when the command didn't, like when it was
+// interrupted by a restart
 type Job struct {
-	ID        uint64    `json:"ID"`
-	Request   Request   `json:"Request"`
-	StartTime time.Time `json:"StartTime"`
-	EndTime   time.Time `json:"EndTime"`
-	Status    string    `json:"Status"`
+	ID        uint64            `json:"ID"`
+	ULID      string            `json:"ULID,omitempty"`
+	Request   Request           `json:"Request"`
+	StartTime time.Time         `json:"StartTime"`
+	EndTime   time.Time         `json:"EndTime"`
+	Status    JobStatus         `json:"Status"`
+	Note      string            `json:"Note,omitempty"`
+	Labels    map[string]string `json:"Labels,omitempty"`
 }
 
 // JobLog represents all the logging information of a given Job
+//
+// Output holds the text of all the lines joined by new lines
 type JobLog struct {
 	Error  string
 	Output string
+	Lines  []LogLine `json:",omitempty"`
+}
+
+// GetLines returns the lines of the log, logs that were stored only as output
+// are split in stdout lines without time
+func (j JobLog) GetLines() []LogLine {
+	if len(j.Lines) > 0 || j.Output == "" {
+		return j.Lines
+	}
+	lines := make([]LogLine, 0)
+	for _, text := range strings.Split(j.Output, "\n") {
+		lines = append(lines, LogLine{Stream: StdoutStream, Text: text})
+	}
+	return lines
+}
+
+// SetLines sets the lines of the log and the output they make
+func (j *JobLog) SetLines(lines []LogLine) {
+	text := make([]string, 0, len(lines))
+	for _, line := range lines {
+		text = append(text, line.Text)
+	}
+	j.Lines = nil
+	if len(lines) > 0 {
+		j.Lines = lines
+	}
+	j.Output = strings.Join(text, "\n")
 }
 
 // GetError returns nil or an error depending on the current JobLog setup
@@ -93,12 +172,47 @@ func (j JobLog) GetError() error {
 }
 
 // APIToken is a persisted API token pointing to a message used to trigger a command request
+//
+// LastUsed is when the token was last used to trigger a command, zero if it
+// was never used
 type APIToken struct {
-	TokenID     string    `json:"token"`
-	UserLink    string    `json:"userLink"`
-	ChannelLink string    `json:"channelLink"`
-	Text        string    `json:"text"`
-	CreatedOn   time.Time `json:"created_on"`
+	TokenID     string         `json:"token"`
+	UserLink    string         `json:"userLink"`
+	ChannelLink string         `json:"channelLink"`
+	Text        string         `json:"text"`
+	CreatedOn   time.Time      `json:"created_on"`
+	Scopes      APITokenScopes `json:"scopes"`
+	LastUsed    time.Time      `json:"last_used"`
+}
+
+// APITokenScopes limit what a token can be used for
+//
+// Commands are the commands the token can call, when the token has no text
+// the caller sends the whole command, and Channels are the links of the
+// channels the caller can pick besides the one of the token. ExpiresAt is
+// when the token stops working, zero if it never expires
+type APITokenScopes struct {
+	Commands  []string  `json:"commands,omitempty"`
+	Channels  []string  `json:"channels,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Expired returns true if the token expired at the time
+func (s APITokenScopes) Expired(now time.Time) bool {
+	return !s.ExpiresAt.IsZero() && !now.Before(s.ExpiresAt)
+}
+
+// AllowsCommand returns true if the token can call the command
+func (s APITokenScopes) AllowsCommand(command string) bool {
+	if len(s.Commands) == 0 {
+		return true
+	}
+	for _, c := range s.Commands {
+		if c == command {
+			return true
+		}
+	}
+	return false
 }
 
 // Command is the base interface for any command
@@ -131,35 +245,165 @@ type Alias struct {
 }
 
 // JobFilter provides the basic tooling to filter jobs when using Find
+//
+// Labels is optional, only jobs that have all of them are considered.
+// Before is optional, only jobs with a lower ID are considered, so the ID of
+// the last job of a page can be used as the cursor to get the next one.
+// Username and ChannelID are optional, only jobs requested by that user or in
+// that channel are considered, they are looked up in an index instead of
+// walking through all the jobs
 type JobFilter struct {
-	Limit int
-	Match func(Job) bool
+	Limit     int
+	Before    uint64
+	Username  string
+	ChannelID string
+	Labels    map[string]string
+	Match     func(Job) bool
 }
 
+// Matches returns true if the job passes the Labels, Username and ChannelID
+// of the filter
+func (f JobFilter) Matches(j Job) bool {
+	if f.Username != "" && f.Username != j.Request.Username {
+		return false
+	}
+	if f.ChannelID != "" && f.ChannelID != j.Request.ChannelID {
+		return false
+	}
+	return j.HasLabels(f.Labels)
+}
+
+// HasLabels returns true if the job has all the labels
+func (j Job) HasLabels(labels map[string]string) bool {
+	for name, value := range labels {
+		if v, ok := j.Labels[name]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// JobStatus is the state of a job
+//
+// Jobs are created as Queued when they wait in the shared queue or as Running
+// otherwise, and they end as Succeeded, Failed, Killed, TimedOut or
+// Interrupted when the process stopped while they ran. Only the transitions in
+// CanMoveTo are allowed, a finished job never changes again
+type JobStatus string
+
 // Jobs status
 const (
-	JobRunningStatus = "Running"
-	JobFailedStatus  = "Failed"
-	JobKilledStatus  = "Killed"
-	JobSuccessStatus = "Successful"
+	JobQueuedStatus      JobStatus = "Queued"
+	JobRunningStatus     JobStatus = "Running"
+	JobSucceededStatus   JobStatus = "Succeeded"
+	JobFailedStatus      JobStatus = "Failed"
+	JobKilledStatus      JobStatus = "Killed"
+	JobTimedOutStatus    JobStatus = "TimedOut"
+	JobInterruptedStatus JobStatus = "Interrupted"
 )
 
+// JobStatuses lists all the statuses a job can be in
+var JobStatuses = []JobStatus{
+	JobQueuedStatus,
+	JobRunningStatus,
+	JobSucceededStatus,
+	JobFailedStatus,
+	JobKilledStatus,
+	JobTimedOutStatus,
+	JobInterruptedStatus,
+}
+
+// legacySuccessStatus is how succeeded jobs were stored before statuses were
+// explicit
+const legacySuccessStatus = "Successful"
+
+var jobTransitions = map[JobStatus][]JobStatus{
+	JobQueuedStatus:  {JobRunningStatus, JobFailedStatus, JobKilledStatus},
+	JobRunningStatus: {JobSucceededStatus, JobFailedStatus, JobKilledStatus, JobTimedOutStatus, JobInterruptedStatus},
+}
+
+// ParseJobStatus returns the status with the name, ignoring the case
+func ParseJobStatus(name string) (JobStatus, error) {
+	if strings.EqualFold(legacySuccessStatus, name) {
+		return JobSucceededStatus, nil
+	}
+	for _, s := range JobStatuses {
+		if strings.EqualFold(string(s), name) {
+			return s, nil
+		}
+	}
+	return "", fmt.Errorf("invalid job status %s", name)
+}
+
+// CanMoveTo returns true if a job in this status can be moved to the next one
+func (s JobStatus) CanMoveTo(next JobStatus) bool {
+	for _, allowed := range jobTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// IsFinished returns true if the job is over, whatever the outcome
+func (s JobStatus) IsFinished() bool {
+	return s != JobQueuedStatus && s != JobRunningStatus
+}
+
+// MoveTo returns the job in the next status or an error if the job can't
+// move to it. The start time is reset when a queued job starts running and
+// the end time is set when it finishes
+func (j Job) MoveTo(next JobStatus) (Job, error) {
+	if !j.Status.CanMoveTo(next) {
+		return j, fmt.Errorf("job %d can't go from %s to %s", j.ID, j.Status, next)
+	}
+	if next == JobRunningStatus {
+		j.StartTime = time.Now().UTC()
+	}
+	if next.IsFinished() {
+		j.EndTime = time.Now().UTC()
+	}
+	j.Status = next
+	return j, nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler to read the jobs stored with the
+// legacy success status
+func (s *JobStatus) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err != nil {
+		return err
+	}
+	if name == legacySuccessStatus {
+		name = string(JobSucceededStatus)
+	}
+	*s = JobStatus(name)
+	return nil
+}
+
 // Jobs provides an interface to handle persistent access to recorded jobs
 type Jobs interface {
 	// Get returns an existing job by id
 	Get(id uint64) (Job, error)
 
+	// GetByULID returns an existing job by its ULID
+	GetByULID(id string) (Job, error)
+
 	// Null returns a null job that will not be tracked
 	Null(r Request) Job
 
-	// Create records a request in the DB and hands off a new job
+	// Create records a request in the DB and hands off a new running job
 	Create(r Request) (Job, error)
 
-	// Fail accounds for the job ending and sets the status.
-	Fail(jobID uint64) error
+	// Queue records a request in the DB and hands off a new queued job
+	Queue(r Request) (Job, error)
+
+	// Start moves a queued job to running
+	Start(jobID uint64) error
 
-	// Succeed accounds for the job ending and sets the status.
-	Succeed(jobID uint64) error
+	// Finish accounts for the job ending and sets the final status, it fails
+	// when the job can't move to it from its current status
+	Finish(jobID uint64, status JobStatus) error
 
 	// Find will walk through the values on the jobs bucket and will apply the Match function
 	// to determine if the job matches a search criteria.
@@ -167,8 +411,24 @@ type Jobs interface {
 	// Returns a list of jobs in descending order that match the filter
 	Find(filter JobFilter) ([]Job, error)
 
-	// FailRunningJobs flags as failed any jobs that is still in running state
-	FailRunningJobs() error
+	// InterruptRunningJobs flags as interrupted, with the note, any job that is
+	// still in running state and returns them
+	InterruptRunningJobs(note string) ([]Job, error)
+
+	// QueuedJobs returns the jobs that are still queued, oldest first
+	QueuedJobs() ([]Job, error)
+
+	// FailQueuedJobs flags as failed, with the note, any job that is still
+	// queued and returns them
+	FailQueuedJobs(note string) ([]Job, error)
+
+	// AddLabels attaches the labels to a job, overwriting the ones with the same name
+	AddLabels(jobID uint64, labels map[string]string) error
+}
+
+// JobRemover is implemented by jobs services that can drop finished jobs
+type JobRemover interface {
+	Remove(jobID uint64) error
 }
 
 // ErrNoJobWithID is returned when we can't find a job with the proposed id
@@ -177,7 +437,7 @@ var ErrNoJobWithID = errors.New("no job could be found")
 // APITokens provides an interface to handle persisted api tokens
 type APITokens interface {
 	// Create creates a new token persistence record and returns the created token.
-	Create(userLink, channelLink, text string) (string, error)
+	Create(userLink, channelLink, text string, scopes APITokenScopes) (string, error)
 
 	// Get returns the token given an ID, it may return ErrTokenNotFound when there is no such token
 	Get(tokenID string) (APIToken, error)
@@ -185,6 +445,9 @@ type APITokens interface {
 	// Revoke destroys a token by ID
 	Revoke(tokenID string) error
 
+	// Touch records when the token was last used
+	Touch(tokenID string, usedAt time.Time) error
+
 	// Find returns a list of tokens that match the filter
 	Find(filter APITokenFilter) ([]APIToken, error)
 }
@@ -210,6 +473,265 @@ type Aliases interface {
 	Remove(userID, alias string) error
 }
 
+// GroupMembership is a runtime change of the configured groups
+//
+// Member is false when the user was removed from the group
+type GroupMembership struct {
+	Group    string `json:"Group"`
+	Username string `json:"Username"`
+	Member   bool   `json:"Member"`
+}
+
+// GroupMemberships provides an interface to persist runtime changes to the configured groups
+type GroupMemberships interface {
+	// Add records that the user belongs to the group
+	Add(group, username string) error
+
+	// Remove records that the user does not belong to the group
+	Remove(group, username string) error
+
+	// List returns all the recorded memberships
+	List() ([]GroupMembership, error)
+}
+
+// Kinds of grants
+const (
+	GrantCommand = "command"
+	GrantGroup   = "group"
+)
+
+// Grant is a temporary permission for a user to run a command, or to belong
+// to a group, until it expires
+type Grant struct {
+	ID        uint64    `json:"ID"`
+	Username  string    `json:"Username"`
+	Kind      string    `json:"Kind"`
+	Target    string    `json:"Target"`
+	GrantedBy string    `json:"GrantedBy"`
+	CreatedAt time.Time `json:"CreatedAt"`
+	ExpiresAt time.Time `json:"ExpiresAt"`
+}
+
+// Active returns true if the grant has not expired at the given time
+func (g Grant) Active(now time.Time) bool {
+	return now.Before(g.ExpiresAt)
+}
+
+// Grants provides an interface to persist temporary grants
+type Grants interface {
+	// Create records the grant setting its ID, the expired grants are removed
+	Create(grant Grant) (Grant, error)
+
+	// List returns the grants that are active at the given time
+	List(now time.Time) ([]Grant, error)
+}
+
+// Approval is a request that waits for approvals, Approvers are the users
+// that approved it so far
+type Approval struct {
+	ID        uint64       `json:"ID"`
+	Request   Request      `json:"Request"`
+	Opts      ApprovalOpts `json:"Opts"`
+	Approvers []string     `json:"Approvers"`
+	ExpiresAt time.Time    `json:"ExpiresAt"`
+}
+
+// Approved returns true if the request got all the approvals it needs
+func (a Approval) Approved() bool {
+	return len(a.Approvers) >= a.Opts.GetRequired()
+}
+
+// Progress returns how many of the needed approvals the request got
+func (a Approval) Progress() string {
+	return fmt.Sprintf("%d/%d", len(a.Approvers), a.Opts.GetRequired())
+}
+
+// ErrNoApproval is returned when there is no approval with the id
+var ErrNoApproval = errors.New("no approval could be found")
+
+// Approvals provides an interface to persist the requests that wait for
+// approvals, so any replica can take them
+type Approvals interface {
+	// Create records the approval setting its ID, the expired ones are removed
+	Create(approval Approval) (Approval, error)
+
+	// Get returns the approval with the id, ErrNoApproval if there is none
+	Get(id uint64) (Approval, error)
+
+	// Update changes the approval with the id within a single transaction, so
+	// the approvals given at the same time are not lost. ErrNoApproval if
+	// there is none
+	Update(id uint64, update func(*Approval) error) (Approval, error)
+
+	// List returns the approvals that have not expired at the given time
+	List(now time.Time) ([]Approval, error)
+
+	// Remove drops the approval, ErrNoApproval if it was already gone
+	Remove(id uint64) error
+}
+
+// Audit decisions taken on a request
+const (
+	AuditAccepted     = "accepted"
+	AuditUnauthorized = "unauthorized"
+	AuditUnknown      = "unknown"
+	AuditPending      = "pending-approval"
+	AuditDispatched   = "dispatched"
+	// AuditFinished is only sent to the audit sinks when a job is done, with
+	// the status it finished with as the reason
+	AuditFinished = "finished"
+)
+
+// AuditEntry is a record of the decision taken on a command request, JobID is
+// only set when the request was accepted and Reason holds why it was not, or
+// who approved it.
+// Incident is the one break glass was on for when the request was taken, and
+// Owner and Source who maintains the command and where it's defined.
+// Agent is the remote agent a job was dispatched to
+type AuditEntry struct {
+	ID       uint64      `json:"ID"`
+	JobID    uint64      `json:"JobID"`
+	Decision string      `json:"Decision"`
+	Reason   string      `json:"Reason,omitempty"`
+	Incident string      `json:"Incident,omitempty"`
+	Owner    string      `json:"Owner,omitempty"`
+	Source   string      `json:"Source,omitempty"`
+	Agent    *AuditAgent `json:"Agent,omitempty"`
+	Request  Request     `json:"Request"`
+	Time     time.Time   `json:"Time"`
+}
+
+// AuditAgent is who a remote job ran on: the ID and labels of the agent, the
+// identity of its client cert with mutual TLS and the name of its token
+type AuditAgent struct {
+	ID       string            `json:"ID"`
+	Identity string            `json:"Identity,omitempty"`
+	Token    string            `json:"Token,omitempty"`
+	Labels   map[string]string `json:"Labels,omitempty"`
+}
+
+// AuditFilter provides the basic tooling to filter audit entries when using Find
+//
+// Since and Until are optional and limit the time range of the returned entries
+type AuditFilter struct {
+	Limit int
+	Since time.Time
+	Until time.Time
+	Match func(AuditEntry) bool
+}
+
+// AuditLog provides an interface to record and query who ran what, where and when
+type AuditLog interface {
+	// Record appends the entry to the audit log, setting its ID and Time
+	Record(entry AuditEntry) (AuditEntry, error)
+
+	// Find walks through the audit log backwards applying the filter.
+	//
+	// Returns a list of entries in descending order that match the filter
+	Find(filter AuditFilter) ([]AuditEntry, error)
+}
+
+// JobQueue holds the jobs that are pending execution so they can be consumed
+// by any of the running replicas
+type JobQueue interface {
+	// Push appends a job to the queue
+	Push(job Job) error
+
+	// Pop waits up to timeout for a job, returns false if there was none
+	Pop(timeout time.Duration) (Job, bool, error)
+}
+
+// Locker provides locks shared by all the running replicas
+type Locker interface {
+	// Lock tries to take the lock identified by key, returns false if it is
+	// already taken. The lock is released after the ttl
+	Lock(key string, ttl time.Duration) (bool, error)
+}
+
+// Identity links a chat user to its account in an OIDC provider, Subject is
+// the stable ID of the account in the Issuer
+type Identity struct {
+	UserID   string    `json:"UserID"`
+	Username string    `json:"Username"`
+	Issuer   string    `json:"Issuer"`
+	Subject  string    `json:"Subject"`
+	Email    string    `json:"Email,omitempty"`
+	LinkedAt time.Time `json:"LinkedAt"`
+}
+
+// Name returns how the identity is shown and matched against the members of
+// the groups, the verified email if there is one. Otherwise it's the subject
+// qualified with its issuer, as a bare subject could be taken for the name of
+// someone else
+func (i Identity) Name() string {
+	if i.Email != "" {
+		return i.Email
+	}
+	return i.Issuer + "#" + i.Subject
+}
+
+// ErrNoIdentity is returned when the user has not linked an identity
+var ErrNoIdentity = errors.New("no identity linked")
+
+// IdentityLink is a link sent to a chat user to link its identity that has
+// not been followed yet, State is the one time value the provider sends back
+type IdentityLink struct {
+	State     string    `json:"State"`
+	UserID    string    `json:"UserID"`
+	Username  string    `json:"Username"`
+	ExpiresAt time.Time `json:"ExpiresAt"`
+}
+
+// ErrNoIdentityLink is returned when there is no link with the state, or it expired
+var ErrNoIdentityLink = errors.New("no such identity link")
+
+// Identities provides an interface to persist the identities linked to chat users
+type Identities interface {
+	// Link stores the identity of the user, replacing the previous one
+	Link(identity Identity) error
+
+	// Get returns the identity linked to the user ID, ErrNoIdentity if there is none
+	Get(userID string) (Identity, error)
+
+	// Unlink removes the identity linked to the user ID
+	Unlink(userID string) error
+
+	// AddLink stores a link sent to a user until it expires, the expired
+	// ones are removed
+	AddLink(link IdentityLink) error
+
+	// TakeLink removes the link with the state and returns it, only once,
+	// ErrNoIdentityLink if there is none or it expired at the given time
+	TakeLink(state string, now time.Time) (IdentityLink, error)
+}
+
+// AgentToken is the token a remote agent registers with, only the hash of
+// the secret is stored
+type AgentToken struct {
+	Name      string    `json:"Name"`
+	Hash      string    `json:"Hash"`
+	CreatedBy string    `json:"CreatedBy"`
+	CreatedAt time.Time `json:"CreatedAt"`
+}
+
+// ErrNoAgentToken is returned when there is no token for the agent
+var ErrNoAgentToken = errors.New("no agent token")
+
+// AgentTokens provides an interface to persist the tokens of the remote agents
+type AgentTokens interface {
+	// Save stores the token, replacing the previous one of the agent
+	Save(token AgentToken) error
+
+	// Get returns the token of the agent, ErrNoAgentToken if there is none
+	Get(name string) (AgentToken, error)
+
+	// List returns all the tokens sorted by name
+	List() ([]AgentToken, error)
+
+	// Revoke removes the token of the agent, ErrNoAgentToken if there is none
+	Revoke(name string) error
+}
+
 // CommandOpts are the options used to build a new shell command
 type CommandOpts struct {
 	Cmd             string
@@ -217,10 +739,168 @@ type CommandOpts struct {
 	AllowedGroups   []string
 	AuthStrategy    string
 	AllowedChannels []string
+	DeniedChannels  []string
+	RestrictedArgs  map[string][]string
+	TimeWindows     TimeWindowOpts
 	ChannelStrategy string
 	Handshake       bool
 	Timeout         time.Duration
 	Help            Help
+	Stream          StreamOpts
+	Labels          map[string]string
+	Webhook         WebhookOpts
+	Notify          NotifyOpts
+	Secrets         map[string]string
+	Approval        ApprovalOpts
+	Owner           string
+	Source          string
+	ANSI            string
+	Limits          ResourceLimits
+	User            string
+	Group           string
+	Artifacts       []string
+}
+
+// StreamOpts configure how the output of a command is sent to the chat while
+// it is running, every Lines lines or every Interval, whatever comes first.
+// Edit replaces the same message with the whole output instead of sending
+// the new lines in a new message each time
+type StreamOpts struct {
+	Lines    int
+	Interval time.Duration
+	Edit     bool
+}
+
+// Enabled returns true if the output should be streamed
+func (s StreamOpts) Enabled() bool {
+	return s.Lines > 0 || s.Interval > 0
+}
+
+// WebhookOpts configure where the outcome of the jobs of a command is posted
+// when they finish. OutputLines is how many lines of the output are sent,
+// keeping the first and the last ones
+type WebhookOpts struct {
+	URL         string
+	Timeout     time.Duration
+	OutputLines int
+}
+
+// Enabled returns true if the jobs should be posted to the webhook
+func (w WebhookOpts) Enabled() bool {
+	return w.URL != ""
+}
+
+// ResourceLimits cap what each job of a command can take from the host it
+// runs on. CPU is in cores, like 0.5 for half of one, Memory is in megabytes
+// and CPUTime is the processor time the job can use before it's killed, in
+// seconds
+type ResourceLimits struct {
+	CPU     float64       `yaml:"cpu"`
+	Memory  int64         `yaml:"memory"`
+	CPUTime time.Duration `yaml:"cpu_time"`
+}
+
+// GetCPUTime returns the processor time each job can use
+func (l ResourceLimits) GetCPUTime() time.Duration {
+	return l.CPUTime * time.Second
+}
+
+// Enabled returns true if any limit is set
+func (l ResourceLimits) Enabled() bool {
+	return l.CPU > 0 || l.Memory > 0 || l.CPUTime > 0
+}
+
+// Validate checks that none of the limits is negative
+func (l ResourceLimits) Validate() error {
+	if l.CPU < 0 || l.Memory < 0 || l.CPUTime < 0 {
+		return fmt.Errorf("resource limits can't be negative")
+	}
+	return nil
+}
+
+// TimeWindowOpts restrict when a command can run to some windows of time in
+// a timezone, the local one if none is set. The users in the override groups
+// can run it at any time
+type TimeWindowOpts struct {
+	Timezone       string       `yaml:"timezone"`
+	Windows        []TimeWindow `yaml:"windows"`
+	OverrideGroups []string     `yaml:"override_groups"`
+}
+
+// Enabled returns true if the command can only run in the windows
+func (t TimeWindowOpts) Enabled() bool {
+	return len(t.Windows) > 0
+}
+
+// TimeWindow is a range of time in some days of the week, From and To are
+// times like 09:00 and no days means every day. A window that ends before it
+// starts goes past midnight into the next day
+type TimeWindow struct {
+	Days []string `yaml:"days"`
+	From string   `yaml:"from"`
+	To   string   `yaml:"to"`
+}
+
+// ApprovalOpts make a command wait for Required approvals from distinct
+// members of Group before it runs, Required is 1 when only the group is set.
+// The request is dropped when it's not approved within Timeout seconds
+type ApprovalOpts struct {
+	Group    string        `yaml:"group"`
+	Required int           `yaml:"required"`
+	Timeout  time.Duration `yaml:"timeout"`
+}
+
+// NotifyOpts configure whether the caller of a job of a command gets a direct
+// message when it finishes, only when it took longer than After
+type NotifyOpts struct {
+	Caller bool
+	After  time.Duration
+}
+
+// Enabled returns true if the command has to be approved before it runs
+func (a ApprovalOpts) Enabled() bool {
+	return a.Group != "" || a.Required > 0
+}
+
+// GetRequired returns how many approvals the command needs
+func (a ApprovalOpts) GetRequired() int {
+	if a.Required <= 0 {
+		return 1
+	}
+	return a.Required
+}
+
+// Approvable is implemented by commands that can require approvals
+type Approvable interface {
+	GetApproval() ApprovalOpts
+}
+
+// Notifier is implemented by commands that post their jobs to a webhook
+type Notifier interface {
+	GetWebhook() WebhookOpts
+}
+
+// CallerNotifier is implemented by commands that tell the callers of their
+// jobs when they finish
+type CallerNotifier interface {
+	GetNotify() NotifyOpts
+}
+
+// Owned is implemented by commands that know who maintains them and where
+// they are defined
+type Owned interface {
+	GetOwner() string
+	GetSource() string
+}
+
+// Labeled is implemented by commands that attach labels to their jobs
+type Labeled interface {
+	GetLabels() map[string]string
+}
+
+// Streamer is implemented by commands which output can be streamed
+type Streamer interface {
+	GetStream() StreamOpts
 }
 
 // HasHandshake indicates if this command should show the handshake message or not
@@ -260,6 +940,27 @@ func (o CommandOpts) GetAllowedChannels() []string {
 	return o.AllowedChannels
 }
 
+// GetDeniedChannels returns the channels in which this command is never allowed
+func (o CommandOpts) GetDeniedChannels() []string {
+	if o.DeniedChannels == nil {
+		return []string{}
+	}
+	return o.DeniedChannels
+}
+
+// GetRestrictedArgs returns the groups allowed to pass each argument pattern
+func (o CommandOpts) GetRestrictedArgs() map[string][]string {
+	if o.RestrictedArgs == nil {
+		return map[string][]string{}
+	}
+	return o.RestrictedArgs
+}
+
+// GetTimeWindows returns when this command can run
+func (o CommandOpts) GetTimeWindows() TimeWindowOpts {
+	return o.TimeWindows
+}
+
 // GetArgs returns the arguments that this command injects by default
 func (o CommandOpts) GetArgs() []string {
 	if o.Args == nil {
@@ -276,6 +977,70 @@ func (o CommandOpts) GetTimeout() time.Duration {
 	return o.Timeout
 }
 
+// GetStream returns how the output of the command is streamed while running
+func (o CommandOpts) GetStream() StreamOpts {
+	return o.Stream
+}
+
+// GetLabels returns the labels attached to the jobs of the command
+func (o CommandOpts) GetLabels() map[string]string {
+	return o.Labels
+}
+
+// GetWebhook returns the webhook the jobs of the command are posted to
+func (o CommandOpts) GetWebhook() WebhookOpts {
+	return o.Webhook
+}
+
+// GetNotify returns whether the callers of the jobs of the command are told
+// when they finish
+func (o CommandOpts) GetNotify() NotifyOpts {
+	return o.Notify
+}
+
+// GetApproval returns the approvals the command needs before it runs
+func (o CommandOpts) GetApproval() ApprovalOpts {
+	return o.Approval
+}
+
+// GetOwner returns who maintains the command
+func (o CommandOpts) GetOwner() string {
+	return o.Owner
+}
+
+// GetSource returns where the command is defined
+func (o CommandOpts) GetSource() string {
+	return o.Source
+}
+
+// GetSecrets returns the environment variables set for the command mapped
+// to the secrets they take their value from
+func (o CommandOpts) GetSecrets() map[string]string {
+	return o.Secrets
+}
+
+// GetLimits returns the resources each job of the command can take
+func (o CommandOpts) GetLimits() ResourceLimits {
+	return o.Limits
+}
+
+// GetUser returns the user and the group the command runs as, empty when it
+// runs as the one that runs the Meeseeks
+func (o CommandOpts) GetUser() (string, string) {
+	return o.User, o.Group
+}
+
+// GetArtifacts returns the patterns of the files each job of the command
+// leaves that are kept as its artifacts
+func (o CommandOpts) GetArtifacts() []string {
+	return o.Artifacts
+}
+
+// GetANSI returns how the escape sequences of the output are handled
+func (o CommandOpts) GetANSI() string {
+	return o.ANSI
+}
+
 // GetCmd returns the command that is actually executed
 func (o CommandOpts) GetCmd() string {
 	return o.Cmd
@@ -54,6 +54,13 @@ var TaskDurations = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 	Help:      "Command execution time distributions in seconds.",
 }, []string{"command", "status"})
 
+// JobStatusChangesCount is the count of jobs that moved to each status
+var JobStatusChangesCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "job_status_changes_count",
+	Help:      "Jobs that moved to each status",
+}, []string{"command", "status"})
+
 // LogLinesCount is the count of tasks that have been accepted
 var LogLinesCount = prometheus.NewCounter(prometheus.CounterOpts{
 	Namespace: namespace,
@@ -61,6 +68,48 @@ var LogLinesCount = prometheus.NewCounter(prometheus.CounterOpts{
 	Help:      "Count of lines that have been written to the log",
 })
 
+// PrunedJobsCount is the count of jobs that have been removed by the retention policies
+var PrunedJobsCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "pruned_jobs_count",
+	Help:      "Jobs that have been removed by the retention policies",
+}, []string{"reason"})
+
+// PrunedLogBytes is the size of the logs that have been removed by the retention policies
+var PrunedLogBytes = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "pruned_log_bytes",
+	Help:      "Bytes of job logs that have been removed by the retention policies",
+})
+
+// AgentExecutedJobsCount is the count of jobs each remote agent executed
+var AgentExecutedJobsCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "agent_executed_jobs_count",
+	Help:      "Jobs executed by each remote agent, as reported in its heartbeats",
+}, []string{"agent", "labels"})
+
+// AgentFailedJobsCount is the count of jobs that failed in each remote agent
+var AgentFailedJobsCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "agent_failed_jobs_count",
+	Help:      "Jobs that failed in each remote agent, as reported in its heartbeats",
+}, []string{"agent", "labels"})
+
+// AgentRunningJobs is the number of jobs each remote agent is running
+var AgentRunningJobs = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "agent_running_jobs",
+	Help:      "Jobs each remote agent is running, as reported in its heartbeats",
+}, []string{"agent", "labels"})
+
+// AgentLoad is the load average of the last minute of the host of each remote agent
+var AgentLoad = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "agent_load1",
+	Help:      "Load average of the last minute of the host of each remote agent, as reported in its heartbeats",
+}, []string{"agent", "labels"})
+
 var bootTime = prometheus.NewGauge(prometheus.GaugeOpts{
 	Namespace: namespace,
 	Name:      "boot_time_seconds",
@@ -89,7 +138,14 @@ func RegisterServerMetrics() {
 	prometheus.MustRegister(RejectedCommandsCount)
 	prometheus.MustRegister(AcceptedCommandsCount)
 	prometheus.MustRegister(TaskDurations)
+	prometheus.MustRegister(JobStatusChangesCount)
 	prometheus.MustRegister(LogLinesCount)
+	prometheus.MustRegister(PrunedJobsCount)
+	prometheus.MustRegister(PrunedLogBytes)
+	prometheus.MustRegister(AgentExecutedJobsCount)
+	prometheus.MustRegister(AgentFailedJobsCount)
+	prometheus.MustRegister(AgentRunningJobs)
+	prometheus.MustRegister(AgentLoad)
 }
 
 // RegisterPath registers prometheus metrics path
@@ -18,5 +18,10 @@ func TestRegisteringServerMetrics(t *testing.T) {
 	mocks.AssertEquals(t, true, prometheus.Unregister(metrics.ReceivedCommandsCount))
 	mocks.AssertEquals(t, true, prometheus.Unregister(metrics.RejectedCommandsCount))
 	mocks.AssertEquals(t, true, prometheus.Unregister(metrics.TaskDurations))
+	mocks.AssertEquals(t, true, prometheus.Unregister(metrics.JobStatusChangesCount))
 	mocks.AssertEquals(t, true, prometheus.Unregister(metrics.UnknownCommandsCount))
+	mocks.AssertEquals(t, true, prometheus.Unregister(metrics.AgentExecutedJobsCount))
+	mocks.AssertEquals(t, true, prometheus.Unregister(metrics.AgentFailedJobsCount))
+	mocks.AssertEquals(t, true, prometheus.Unregister(metrics.AgentRunningJobs))
+	mocks.AssertEquals(t, true, prometheus.Unregister(metrics.AgentLoad))
 }
@@ -0,0 +1,191 @@
+package reports
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+)
+
+// Components the errors are reported from
+const (
+	ComponentExecutor = "executor"
+	ComponentSlack    = "slack"
+	ComponentServer   = "server"
+)
+
+// Event is an internal error or a panic, with the context it happened in
+type Event struct {
+	Component string
+	Message   string
+	Panic     bool
+	Stack     string
+	Tags      Tags
+	Time      time.Time
+}
+
+// Tags are the context of an event, like the job and the command it happened
+// while running
+type Tags map[string]string
+
+// JobTags returns the tags of the job and the request that created it
+func JobTags(job meeseeks.Job) Tags {
+	tags := RequestTags(job.Request)
+	tags["job_id"] = fmt.Sprintf("%d", job.ID)
+	return tags
+}
+
+// RequestTags returns the tags of the command of the request, who called it
+// and where
+func RequestTags(req meeseeks.Request) Tags {
+	tags := Tags{}
+	for name, value := range map[string]string{
+		"command": req.Command,
+		"user":    req.Username,
+		"channel": req.Channel,
+	} {
+		if value != "" {
+			tags[name] = value
+		}
+	}
+	return tags
+}
+
+// Reporter sends the events to an error tracker
+type Reporter interface {
+	Report(Event) error
+}
+
+// Config holds the error trackers the internal errors and panics are
+// reported to, Sentry is enabled with its DSN
+type Config struct {
+	Sentry SentryConfig `yaml:"sentry"`
+}
+
+// Validate checks that the configuration is usable
+func (c Config) Validate() error {
+	if c.Sentry.DSN == "" {
+		return nil
+	}
+	if _, err := parseDSN(c.Sentry.DSN); err != nil {
+		return err
+	}
+	if c.Sentry.Timeout < 0 {
+		return fmt.Errorf("sentry timeout can't be negative")
+	}
+	return nil
+}
+
+var reporters []Reporter
+var mutex sync.Mutex
+
+// Configure sets the error trackers the events are reported to
+func Configure(cnf Config) error {
+	configured := make([]Reporter, 0)
+	if cnf.Sentry.DSN != "" {
+		s, err := NewSentryReporter(cnf.Sentry)
+		if err != nil {
+			return err
+		}
+		configured = append(configured, s)
+	}
+	SetReporters(configured...)
+	return nil
+}
+
+// SetReporters replaces the reporters the events are sent to
+func SetReporters(r ...Reporter) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	reporters = r
+}
+
+func getReporters() []Reporter {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return reporters
+}
+
+// Errorf logs the error and reports it with its context. Reporters are called
+// in the background so a slow tracker doesn't hold the caller back, their
+// failures are only logged
+func Errorf(component string, tags Tags, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	logrus.WithFields(fields(component, tags)).Error(message)
+
+	event := Event{
+		Component: component,
+		Message:   message,
+		Tags:      tags,
+		Time:      time.Now(),
+	}
+	for _, r := range getReporters() {
+		go send(r, event)
+	}
+}
+
+// Recover reports the panic of the calling goroutine with its stack and
+// panics again, it has to be deferred. The panic is reported before the
+// process dies, so the reporters are waited for
+func Recover(component string, tags Tags) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	reportPanic(component, tags, r)
+	panic(r)
+}
+
+// RecoverError reports the panic of the calling goroutine with its stack and
+// sets it as the error, for the calls that can fail without killing the
+// process. It has to be deferred
+func RecoverError(component string, tags Tags, err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	reportPanic(component, tags, r)
+	*err = fmt.Errorf("panic: %v", r)
+}
+
+func reportPanic(component string, tags Tags, r interface{}) {
+	event := Event{
+		Component: component,
+		Message:   fmt.Sprintf("panic: %v", r),
+		Panic:     true,
+		Stack:     string(debug.Stack()),
+		Tags:      tags,
+		Time:      time.Now(),
+	}
+	logrus.WithFields(fields(component, tags)).Errorf("%s\n%s", event.Message, event.Stack)
+
+	wg := sync.WaitGroup{}
+	for _, r := range getReporters() {
+		wg.Add(1)
+		go func(r Reporter) {
+			defer wg.Done()
+			send(r, event)
+		}(r)
+	}
+	wg.Wait()
+}
+
+func send(r Reporter, event Event) {
+	if err := r.Report(event); err != nil {
+		logrus.Errorf("Could not report %q: %s", event.Message, err)
+	}
+}
+
+func fields(component string, tags Tags) logrus.Fields {
+	f := logrus.Fields{"component": component}
+	for name, value := range tags {
+		f[name] = value
+	}
+	return f
+}
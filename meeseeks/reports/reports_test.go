@@ -0,0 +1,68 @@
+package reports_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks/reports"
+	"gitlab.com/yakshaving.art/meeseeks-box/mocks"
+)
+
+type reporterStub chan reports.Event
+
+func (r reporterStub) Report(e reports.Event) error {
+	r <- e
+	return nil
+}
+
+func TestErrorsAreReported(t *testing.T) {
+	reported := make(reporterStub, 1)
+	reports.SetReporters(reported)
+	defer reports.SetReporters()
+
+	job := meeseeks.Job{ID: 42, Request: meeseeks.Request{Command: "deploy", Username: "someone", Channel: "general"}}
+	reports.Errorf(reports.ComponentExecutor, reports.JobTags(job), "Could not start job %d: %s", job.ID, "oops")
+
+	select {
+	case e := <-reported:
+		mocks.AssertEquals(t, reports.ComponentExecutor, e.Component)
+		mocks.AssertEquals(t, "Could not start job 42: oops", e.Message)
+		mocks.AssertEquals(t, false, e.Panic)
+		mocks.AssertEquals(t, reports.Tags{
+			"job_id":  "42",
+			"command": "deploy",
+			"user":    "someone",
+			"channel": "general",
+		}, e.Tags)
+	case <-time.After(time.Second):
+		t.Fatal("the error was not reported")
+	}
+}
+
+func TestPanicsAreReported(t *testing.T) {
+	reported := make(reporterStub, 2)
+	reports.SetReporters(reported)
+	defer reports.SetReporters()
+
+	err := func() (err error) {
+		defer reports.RecoverError(reports.ComponentServer, reports.Tags{"method": "/Append"}, &err)
+		panic("oops")
+	}()
+	mocks.AssertEquals(t, "panic: oops", err.Error())
+
+	recovered := func() (r interface{}) {
+		defer func() { r = recover() }()
+		defer reports.Recover(reports.ComponentSlack, reports.Tags{})
+		panic(fmt.Errorf("oops again"))
+	}()
+	mocks.AssertEquals(t, "oops again", fmt.Sprintf("%s", recovered))
+
+	for _, message := range []string{"panic: oops", "panic: oops again"} {
+		e := <-reported
+		mocks.AssertEquals(t, message, e.Message)
+		mocks.AssertEquals(t, true, e.Panic)
+		mocks.AssertMatches(t, "reports_test.go", e.Stack)
+	}
+}
@@ -0,0 +1,149 @@
+package reports
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/version"
+)
+
+// DefaultSentryTimeout is how long a call to Sentry can take when no timeout
+// is set
+const DefaultSentryTimeout = 5 * time.Second
+
+// SentryConfig holds the configuration of the Sentry reporter, the DSN of the
+// project, the environment the events are tagged with and the Timeout of the
+// calls in seconds
+type SentryConfig struct {
+	DSN         string        `yaml:"dsn"`
+	Environment string        `yaml:"environment"`
+	Timeout     time.Duration `yaml:"timeout"`
+}
+
+type sentryReporter struct {
+	storeURL    string
+	auth        string
+	environment string
+	serverName  string
+	client      *http.Client
+}
+
+// sentryDSN is the url events are stored in and the key they are sent with
+type sentryDSN struct {
+	storeURL  string
+	publicKey string
+}
+
+// parseDSN parses a DSN like https://<key>@sentry.example.com/<project>
+func parseDSN(dsn string) (sentryDSN, error) {
+	u, err := url.Parse(dsn)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return sentryDSN{}, fmt.Errorf("invalid sentry dsn %s, it has to be an http or https url", dsn)
+	}
+	if u.User == nil || u.User.Username() == "" {
+		return sentryDSN{}, fmt.Errorf("invalid sentry dsn %s, it has no key", dsn)
+	}
+	path := strings.Trim(u.Path, "/")
+	project := path[strings.LastIndex(path, "/")+1:]
+	if project == "" {
+		return sentryDSN{}, fmt.Errorf("invalid sentry dsn %s, it has no project", dsn)
+	}
+	prefix := strings.TrimSuffix(path, project)
+
+	return sentryDSN{
+		storeURL:  fmt.Sprintf("%s://%s/%sapi/%s/store/", u.Scheme, u.Host, prefix, project),
+		publicKey: u.User.Username(),
+	}, nil
+}
+
+// NewSentryReporter returns a reporter that stores the events in the project
+// of the DSN, through the store api of Sentry
+func NewSentryReporter(cnf SentryConfig) (Reporter, error) {
+	dsn, err := parseDSN(cnf.DSN)
+	if err != nil {
+		return nil, err
+	}
+	timeout := cnf.Timeout * time.Second
+	if timeout <= 0 {
+		timeout = DefaultSentryTimeout
+	}
+	hostname, _ := os.Hostname()
+
+	return sentryReporter{
+		storeURL: dsn.storeURL,
+		auth: fmt.Sprintf("Sentry sentry_version=7, sentry_client=%s/%s, sentry_key=%s",
+			version.Name, version.Version, dsn.publicKey),
+		environment: cnf.Environment,
+		serverName:  hostname,
+		client:      &http.Client{Timeout: timeout},
+	}, nil
+}
+
+// sentryEvent is the payload of the store api
+type sentryEvent struct {
+	EventID     string            `json:"event_id"`
+	Timestamp   string            `json:"timestamp"`
+	Level       string            `json:"level"`
+	Logger      string            `json:"logger"`
+	Platform    string            `json:"platform"`
+	Message     string            `json:"message"`
+	Release     string            `json:"release,omitempty"`
+	Environment string            `json:"environment,omitempty"`
+	ServerName  string            `json:"server_name,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Extra       map[string]string `json:"extra,omitempty"`
+}
+
+func (s sentryReporter) Report(event Event) error {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Errorf("could not create the id of the event: %s", err)
+	}
+
+	payload := sentryEvent{
+		EventID:     hex.EncodeToString(id),
+		Timestamp:   event.Time.UTC().Format("2006-01-02T15:04:05"),
+		Level:       "error",
+		Logger:      event.Component,
+		Platform:    "go",
+		Message:     event.Message,
+		Release:     version.Version,
+		Environment: s.environment,
+		ServerName:  s.serverName,
+		Tags:        event.Tags,
+	}
+	if event.Panic {
+		payload.Level = "fatal"
+		payload.Extra = map[string]string{"stack": event.Stack}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.storeURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", s.auth)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not send the event to sentry: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("sentry replied %s", resp.Status)
+	}
+	return nil
+}
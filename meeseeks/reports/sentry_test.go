@@ -0,0 +1,102 @@
+package reports_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks/reports"
+	"gitlab.com/yakshaving.art/meeseeks-box/mocks"
+)
+
+func TestValidate(t *testing.T) {
+	tt := []struct {
+		name string
+		dsn  string
+		err  string
+	}{
+		{
+			name: "disabled",
+		},
+		{
+			name: "valid",
+			dsn:  "https://public@sentry.example.com/42",
+		},
+		{
+			name: "not an http url",
+			dsn:  "sentry.example.com/42",
+			err:  "invalid sentry dsn sentry.example.com/42, it has to be an http or https url",
+		},
+		{
+			name: "no key",
+			dsn:  "https://sentry.example.com/42",
+			err:  "invalid sentry dsn https://sentry.example.com/42, it has no key",
+		},
+		{
+			name: "no project",
+			dsn:  "https://public@sentry.example.com/",
+			err:  "invalid sentry dsn https://public@sentry.example.com/, it has no project",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			err := reports.Config{Sentry: reports.SentryConfig{DSN: tc.dsn}}.Validate()
+			if tc.err == "" {
+				mocks.Must(t, "invalid configuration", err)
+				return
+			}
+			mocks.AssertEquals(t, tc.err, err.Error())
+		})
+	}
+}
+
+func TestSentryReporterStoresEvents(t *testing.T) {
+	stored := make(chan map[string]interface{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mocks.AssertEquals(t, "/sentry/api/42/store/", r.URL.Path)
+		mocks.AssertMatches(t, "^Sentry sentry_version=7, sentry_client=meeseeks-box/.*, sentry_key=public$",
+			r.Header.Get("X-Sentry-Auth"))
+
+		event := map[string]interface{}{}
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("invalid event: %s", err)
+		}
+		stored <- event
+	}))
+	defer server.Close()
+
+	reporter, err := reports.NewSentryReporter(reports.SentryConfig{
+		DSN:         strings.Replace(server.URL, "://", "://public@", 1) + "/sentry/42",
+		Environment: "production",
+	})
+	mocks.Must(t, "could not create the reporter", err)
+
+	err = reporter.Report(reports.Event{
+		Component: reports.ComponentExecutor,
+		Message:   "panic: oops",
+		Panic:     true,
+		Stack:     "goroutine 1 [running]",
+		Tags:      reports.Tags{"job_id": "42"},
+		Time:      time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+	})
+	mocks.Must(t, "could not report the event", err)
+
+	event := <-stored
+	mocks.AssertEquals(t, 32, len(event["event_id"].(string)))
+	delete(event, "event_id")
+	delete(event, "server_name")
+	delete(event, "release")
+	mocks.AssertEquals(t, map[string]interface{}{
+		"timestamp":   "2020-01-02T03:04:05",
+		"level":       "fatal",
+		"logger":      "executor",
+		"platform":    "go",
+		"message":     "panic: oops",
+		"environment": "production",
+		"tags":        map[string]interface{}{"job_id": "42"},
+		"extra":       map[string]interface{}{"stack": "goroutine 1 [running]"},
+	}, event)
+}
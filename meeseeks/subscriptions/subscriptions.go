@@ -0,0 +1,58 @@
+package subscriptions
+
+import (
+	"sync"
+)
+
+// subscribers are the IDs of the users that want a direct message when each
+// job finishes, in the order they subscribed. They are kept by each Meeseeks
+// on its own
+var subscribers = map[uint64][]string{}
+var mutex sync.Mutex
+
+// Subscribe adds the user to the ones that are told when the job finishes,
+// returns false when it already was
+func Subscribe(jobID uint64, userID string) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for _, subscriber := range subscribers[jobID] {
+		if subscriber == userID {
+			return false
+		}
+	}
+	subscribers[jobID] = append(subscribers[jobID], userID)
+	return true
+}
+
+// Unsubscribe removes the user from the ones that are told when the job
+// finishes, returns false when it was not one of them
+func Unsubscribe(jobID uint64, userID string) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for i, subscriber := range subscribers[jobID] {
+		if subscriber != userID {
+			continue
+		}
+		remaining := append(append([]string{}, subscribers[jobID][:i]...), subscribers[jobID][i+1:]...)
+		if len(remaining) == 0 {
+			delete(subscribers, jobID)
+		} else {
+			subscribers[jobID] = remaining
+		}
+		return true
+	}
+	return false
+}
+
+// Take returns the users that are told when the job finishes and forgets
+// them, as it's done
+func Take(jobID uint64) []string {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	taken := subscribers[jobID]
+	delete(subscribers, jobID)
+	return taken
+}
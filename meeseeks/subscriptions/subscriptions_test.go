@@ -0,0 +1,24 @@
+package subscriptions_test
+
+import (
+	"testing"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks/subscriptions"
+	"gitlab.com/yakshaving.art/meeseeks-box/mocks"
+)
+
+func TestSubscriptions(t *testing.T) {
+	mocks.AssertEquals(t, true, subscriptions.Subscribe(1, "alice"))
+	mocks.AssertEquals(t, true, subscriptions.Subscribe(1, "bob"))
+	mocks.AssertEquals(t, false, subscriptions.Subscribe(1, "alice"))
+	mocks.AssertEquals(t, true, subscriptions.Subscribe(2, "carol"))
+
+	mocks.AssertEquals(t, true, subscriptions.Unsubscribe(1, "alice"))
+	mocks.AssertEquals(t, false, subscriptions.Unsubscribe(1, "alice"))
+
+	mocks.AssertEquals(t, []string{"bob"}, subscriptions.Take(1))
+	mocks.AssertEquals(t, []string(nil), subscriptions.Take(1))
+
+	mocks.AssertEquals(t, true, subscriptions.Unsubscribe(2, "carol"))
+	mocks.AssertEquals(t, []string(nil), subscriptions.Take(2))
+}
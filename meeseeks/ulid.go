@@ -0,0 +1,34 @@
+package meeseeks
+
+import (
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid"
+)
+
+// The monotonic entropy source is not safe for concurrent use
+var ulidEntropy = struct {
+	sync.Mutex
+	io.Reader
+}{
+	Reader: ulid.Monotonic(rand.New(rand.NewSource(time.Now().UnixNano())), 0),
+}
+
+// NewJobULID returns a new ULID for a job created at the given time, the ones
+// created within the same millisecond keep the order in which they were
+// created
+func NewJobULID(t time.Time) string {
+	ulidEntropy.Lock()
+	defer ulidEntropy.Unlock()
+
+	return ulid.MustNew(ulid.Timestamp(t), ulidEntropy.Reader).String()
+}
+
+// IsJobULID returns true if the string is a valid ULID
+func IsJobULID(id string) bool {
+	_, err := ulid.ParseStrict(id)
+	return err == nil
+}
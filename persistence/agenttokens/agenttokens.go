@@ -0,0 +1,82 @@
+package agenttokens
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/db"
+
+	bolt "github.com/coreos/bbolt"
+)
+
+var agentTokensBucketKey = []byte("agent_tokens")
+
+// AgentTokens provides the interface to the locally persisted agent tokens
+type AgentTokens struct{}
+
+// Save stores the token, replacing the previous one of the agent
+func (AgentTokens) Save(token meeseeks.AgentToken) error {
+	payload, err := json.Marshal(token)
+	if err != nil {
+		return fmt.Errorf("could not marshal agent token: %s", err)
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(agentTokensBucketKey)
+		if err != nil {
+			return fmt.Errorf("could not get agent tokens bucket: %s", err)
+		}
+		return bucket.Put([]byte(token.Name), payload)
+	})
+}
+
+// Get returns the token of the agent, ErrNoAgentToken if there is none
+func (AgentTokens) Get(name string) (meeseeks.AgentToken, error) {
+	token := meeseeks.AgentToken{}
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(agentTokensBucketKey)
+		if bucket == nil {
+			return meeseeks.ErrNoAgentToken
+		}
+		payload := bucket.Get([]byte(name))
+		if payload == nil {
+			return meeseeks.ErrNoAgentToken
+		}
+		if err := json.Unmarshal(payload, &token); err != nil {
+			return fmt.Errorf("failed to load agent token payload: %s", err)
+		}
+		return nil
+	})
+	return token, err
+}
+
+// List returns all the tokens sorted by name
+func (AgentTokens) List() ([]meeseeks.AgentToken, error) {
+	tokens := make([]meeseeks.AgentToken, 0)
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(agentTokensBucketKey)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(_, payload []byte) error {
+			token := meeseeks.AgentToken{}
+			if err := json.Unmarshal(payload, &token); err != nil {
+				return fmt.Errorf("failed to load agent token payload: %s", err)
+			}
+			tokens = append(tokens, token)
+			return nil
+		})
+	})
+	return tokens, err
+}
+
+// Revoke removes the token of the agent, ErrNoAgentToken if there is none
+func (AgentTokens) Revoke(name string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(agentTokensBucketKey)
+		if bucket == nil || bucket.Get([]byte(name)) == nil {
+			return meeseeks.ErrNoAgentToken
+		}
+		return bucket.Delete([]byte(name))
+	})
+}
@@ -0,0 +1,45 @@
+package agenttokens_test
+
+import (
+	"testing"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+	"gitlab.com/yakshaving.art/meeseeks-box/mocks"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence"
+)
+
+func TestGetNonExistingAgentToken(t *testing.T) {
+	mocks.WithTmpDB(func(_ string) {
+		_, err := persistence.AgentTokens().Get("builder")
+		mocks.AssertEquals(t, meeseeks.ErrNoAgentToken, err)
+		mocks.AssertEquals(t, meeseeks.ErrNoAgentToken, persistence.AgentTokens().Revoke("builder"))
+	})
+}
+
+func TestAgentTokenLifecycle(t *testing.T) {
+	mocks.WithTmpDB(func(_ string) {
+		createdAt := time.Date(2019, 5, 1, 10, 0, 0, 0, time.UTC)
+		for _, token := range []meeseeks.AgentToken{
+			{Name: "tester", Hash: "1", CreatedBy: "admin", CreatedAt: createdAt},
+			{Name: "builder", Hash: "2", CreatedBy: "admin", CreatedAt: createdAt},
+			{Name: "builder", Hash: "3", CreatedBy: "someone", CreatedAt: createdAt},
+		} {
+			mocks.Must(t, "could not save agent token", persistence.AgentTokens().Save(token))
+		}
+
+		token, err := persistence.AgentTokens().Get("builder")
+		mocks.Must(t, "could not get agent token", err)
+		mocks.AssertEquals(t, meeseeks.AgentToken{Name: "builder", Hash: "3", CreatedBy: "someone", CreatedAt: createdAt}, token)
+
+		tokens, err := persistence.AgentTokens().List()
+		mocks.Must(t, "could not list agent tokens", err)
+		mocks.AssertEquals(t, 2, len(tokens))
+		mocks.AssertEquals(t, "builder", tokens[0].Name)
+		mocks.AssertEquals(t, "tester", tokens[1].Name)
+
+		mocks.Must(t, "could not revoke agent token", persistence.AgentTokens().Revoke("builder"))
+		_, err = persistence.AgentTokens().Get("builder")
+		mocks.AssertEquals(t, meeseeks.ErrNoAgentToken, err)
+	})
+}
@@ -0,0 +1,137 @@
+package approvals
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/db"
+
+	bolt "github.com/coreos/bbolt"
+)
+
+var approvalsBucketKey = []byte("approvals")
+
+// Approvals provides the interface to the locally persisted requests that
+// wait for approvals
+type Approvals struct{}
+
+// Create records the approval setting its ID, the expired ones are removed
+func (Approvals) Create(approval meeseeks.Approval) (meeseeks.Approval, error) {
+	err := db.Create(approvalsBucketKey, func(id uint64, bucket *bolt.Bucket) error {
+		expired := make([][]byte, 0)
+		err := bucket.ForEach(func(k, payload []byte) error {
+			a := meeseeks.Approval{}
+			if err := json.Unmarshal(payload, &a); err != nil {
+				return fmt.Errorf("failed to load approval payload: %s", err)
+			}
+			if !time.Now().Before(a.ExpiresAt) {
+				expired = append(expired, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err = bucket.Delete(k); err != nil {
+				return fmt.Errorf("could not drop expired approval %d: %s", db.IDFromBytes(k), err)
+			}
+		}
+
+		approval.ID = id
+		payload, err := json.Marshal(approval)
+		if err != nil {
+			return fmt.Errorf("could not marshal approval: %s", err)
+		}
+		return bucket.Put(db.IDToBytes(id), payload)
+	})
+	if err != nil {
+		return meeseeks.Approval{}, fmt.Errorf("failed to create approval: %s", err)
+	}
+	return approval, nil
+}
+
+// Get returns the approval with the id, ErrNoApproval if there is none
+func (Approvals) Get(id uint64) (meeseeks.Approval, error) {
+	approval := meeseeks.Approval{}
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(approvalsBucketKey)
+		if bucket == nil {
+			return meeseeks.ErrNoApproval
+		}
+		payload := bucket.Get(db.IDToBytes(id))
+		if payload == nil {
+			return meeseeks.ErrNoApproval
+		}
+		if err := json.Unmarshal(payload, &approval); err != nil {
+			return fmt.Errorf("failed to load approval payload: %s", err)
+		}
+		return nil
+	})
+	return approval, err
+}
+
+// Update changes the approval with the id within a single transaction
+func (Approvals) Update(id uint64, update func(*meeseeks.Approval) error) (meeseeks.Approval, error) {
+	approval := meeseeks.Approval{}
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(approvalsBucketKey)
+		if bucket == nil {
+			return meeseeks.ErrNoApproval
+		}
+		payload := bucket.Get(db.IDToBytes(id))
+		if payload == nil {
+			return meeseeks.ErrNoApproval
+		}
+		if err := json.Unmarshal(payload, &approval); err != nil {
+			return fmt.Errorf("failed to load approval payload: %s", err)
+		}
+		if err := update(&approval); err != nil {
+			return err
+		}
+		payload, err := json.Marshal(approval)
+		if err != nil {
+			return fmt.Errorf("could not marshal approval: %s", err)
+		}
+		return bucket.Put(db.IDToBytes(id), payload)
+	})
+	if err != nil {
+		return meeseeks.Approval{}, err
+	}
+	return approval, nil
+}
+
+// List returns the approvals that have not expired at the given time
+func (Approvals) List(now time.Time) ([]meeseeks.Approval, error) {
+	approvals := make([]meeseeks.Approval, 0)
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(approvalsBucketKey)
+		if bucket == nil {
+			return nil // nothing has waited for approvals yet
+		}
+		return bucket.ForEach(func(_, payload []byte) error {
+			a := meeseeks.Approval{}
+			if err := json.Unmarshal(payload, &a); err != nil {
+				return fmt.Errorf("failed to load approval payload: %s", err)
+			}
+			if now.Before(a.ExpiresAt) {
+				approvals = append(approvals, a)
+			}
+			return nil
+		})
+	})
+	return approvals, err
+}
+
+// Remove drops the approval, ErrNoApproval if it was already gone
+func (Approvals) Remove(id uint64) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(approvalsBucketKey)
+		if bucket == nil || bucket.Get(db.IDToBytes(id)) == nil {
+			return meeseeks.ErrNoApproval
+		}
+		return bucket.Delete(db.IDToBytes(id))
+	})
+}
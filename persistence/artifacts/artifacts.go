@@ -0,0 +1,323 @@
+package artifacts
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultMaxSize is how big each artifact can be when no size is configured
+const DefaultMaxSize = 10 << 20
+
+// DefaultLinkTTL is how long the links to the artifacts work when no ttl is
+// configured
+const DefaultLinkTTL = 7 * 24 * time.Hour
+
+// HandlerPath is the path the artifacts are downloaded from, followed by the
+// job ID and the name of the artifact
+const HandlerPath = "/artifacts/"
+
+// ErrNoArtifact is returned when the job has no artifact with the name
+var ErrNoArtifact = errors.New("no such artifact")
+
+// Config holds where the artifacts the jobs leave behind are kept, they are
+// not kept unless a path is set
+//
+// URL is the external url of the Meeseeks the links to the artifacts are
+// built with, the replies only name them when it's not set. The links are
+// signed with the SigningKey, which is required with the url, so they can't
+// be guessed, and they expire after LinkTTL seconds
+type Config struct {
+	Path       string        `yaml:"path"`
+	URL        string        `yaml:"url"`
+	SigningKey string        `yaml:"signing_key"`
+	LinkTTL    time.Duration `yaml:"link_ttl"`
+	MaxSize    int64         `yaml:"max_size"`
+}
+
+// Enabled returns true when the artifacts are kept
+func (c Config) Enabled() bool {
+	return c.Path != ""
+}
+
+// Validate checks that the configuration is usable
+func (c Config) Validate() error {
+	if c.MaxSize < 0 {
+		return fmt.Errorf("artifacts max size can't be negative")
+	}
+	if c.LinkTTL < 0 {
+		return fmt.Errorf("artifacts link ttl can't be negative")
+	}
+	if c.URL != "" {
+		u, err := url.Parse(c.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("invalid artifacts url %s, it has to be an http or https url", c.URL)
+		}
+		if c.SigningKey == "" {
+			return fmt.Errorf("artifacts url requires a signing key")
+		}
+	}
+	return nil
+}
+
+// GetLinkTTL returns how long the links to the artifacts work
+func (c Config) GetLinkTTL() time.Duration {
+	if c.LinkTTL == 0 {
+		return DefaultLinkTTL
+	}
+	return c.LinkTTL * time.Second
+}
+
+// GetMaxSize returns how big each artifact can be
+func (c Config) GetMaxSize() int64 {
+	if c.MaxSize == 0 {
+		return DefaultMaxSize
+	}
+	return c.MaxSize
+}
+
+// Store is where the artifacts of the jobs are kept
+type Store interface {
+	Put(jobID uint64, name string, content []byte) error
+	Get(jobID uint64, name string) ([]byte, error)
+	List(jobID uint64) ([]string, error)
+	Remove(jobID uint64) error
+}
+
+var config Config
+var local Store
+var forward Store
+var signingKey []byte
+var mutex sync.Mutex
+
+// Configure sets where the artifacts are kept
+func Configure(cnf Config) error {
+	key := []byte(cnf.SigningKey)
+
+	var store Store
+	if cnf.Enabled() {
+		if err := os.MkdirAll(cnf.Path, 0700); err != nil {
+			return fmt.Errorf("could not create artifacts path %s: %s", cnf.Path, err)
+		}
+		store = localStore{path: cnf.Path}
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	config, local, signingKey = cnf, store, key
+	return nil
+}
+
+// Forward sends the artifacts to the store instead of keeping them, like an
+// agent does with the ones of its jobs, nil keeps them again
+func Forward(store Store) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	forward = store
+}
+
+func current() (Config, Store, []byte) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if forward != nil {
+		return config, forward, signingKey
+	}
+	return config, local, signingKey
+}
+
+// Enabled returns true when the artifacts are kept or forwarded
+func Enabled() bool {
+	_, store, _ := current()
+	return store != nil
+}
+
+// MaxSize returns how big each artifact can be
+func MaxSize() int64 {
+	cnf, _, _ := current()
+	return cnf.GetMaxSize()
+}
+
+// Save keeps the artifact of the job
+func Save(jobID uint64, name string, content []byte) error {
+	cnf, store, _ := current()
+	if store == nil {
+		return fmt.Errorf("artifacts are not enabled")
+	}
+	name, err := validName(name)
+	if err != nil {
+		return err
+	}
+	if size := int64(len(content)); size > cnf.GetMaxSize() {
+		return fmt.Errorf("artifact %s of job %d is %d bytes, more than the %d allowed", name, jobID, size, cnf.GetMaxSize())
+	}
+	return store.Put(jobID, name, content)
+}
+
+// Remove removes the artifacts of the job, like when it's pruned
+func Remove(jobID uint64) error {
+	_, store, _ := current()
+	if store == nil || store != local {
+		return nil
+	}
+	return store.Remove(jobID)
+}
+
+// Links returns the links to the artifacts of the job, or their names when
+// there is no url to build them with
+func Links(jobID uint64) []string {
+	cnf, store, key := current()
+	if store == nil || store != local {
+		return nil
+	}
+	names, err := store.List(jobID)
+	if err != nil {
+		logrus.Errorf("could not list the artifacts of job %d: %s", jobID, err)
+		return nil
+	}
+
+	expires := time.Now().Add(cnf.GetLinkTTL()).Unix()
+	links := make([]string, 0, len(names))
+	for _, name := range names {
+		if cnf.URL == "" || len(key) == 0 {
+			links = append(links, name)
+			continue
+		}
+		links = append(links, fmt.Sprintf("%s%s%d/%s?expires=%d&signature=%s", strings.TrimSuffix(cnf.URL, "/"),
+			HandlerPath, jobID, url.PathEscape(name), expires, sign(key, jobID, name, expires)))
+	}
+	return links
+}
+
+// RegisterHandler starts serving the artifacts, it does nothing when they
+// are not kept
+func RegisterHandler() {
+	if cnf, _, _ := current(); !cnf.Enabled() {
+		return
+	}
+	logrus.Infof("Serving job artifacts on %s", HandlerPath)
+	http.HandleFunc(HandlerPath, HandleGet)
+}
+
+// HandleGet implements the http handle request function interface, it serves
+// the artifact of the signed link
+func HandleGet(w http.ResponseWriter, r *http.Request) {
+	_, store, key := current()
+	if store == nil {
+		http.Error(w, "artifacts are not enabled", http.StatusNotFound)
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, HandlerPath), "/", 2)
+	if len(parts) != 2 {
+		http.Error(w, "the link should have a job ID and an artifact name", http.StatusBadRequest)
+		return
+	}
+	jobID, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid job ID %s", parts[0]), http.StatusBadRequest)
+		return
+	}
+	name := parts[1]
+	expires, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	signature := []byte(r.URL.Query().Get("signature"))
+	if err != nil || len(key) == 0 || time.Now().After(time.Unix(expires, 0)) ||
+		subtle.ConstantTimeCompare(signature, []byte(sign(key, jobID, name, expires))) != 1 {
+		http.Error(w, "the link is invalid or expired", http.StatusForbidden)
+		return
+	}
+
+	content, err := store.Get(jobID, name)
+	if err == ErrNoArtifact {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logrus.Errorf("could not read artifact %s of job %d: %s", name, jobID, err)
+		http.Error(w, "could not read the artifact", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	w.Write(content)
+}
+
+func sign(key []byte, jobID uint64, name string, expires int64) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%d/%s/%d", jobID, name, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validName returns the name of the artifact when it's a plain file name
+func validName(name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("invalid artifact name %q", name)
+	}
+	return name, nil
+}
+
+// localStore keeps the artifacts of each job in a directory named after it
+type localStore struct {
+	path string
+}
+
+// Put implements Store.Put
+func (l localStore) Put(jobID uint64, name string, content []byte) error {
+	dir := filepath.Join(l.path, strconv.FormatUint(jobID, 10))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("could not create the artifacts directory of job %d: %s", jobID, err)
+	}
+	return ioutil.WriteFile(filepath.Join(dir, name), content, 0600)
+}
+
+// Get implements Store.Get
+func (l localStore) Get(jobID uint64, name string) ([]byte, error) {
+	if _, err := validName(name); err != nil {
+		return nil, ErrNoArtifact
+	}
+	content, err := ioutil.ReadFile(filepath.Join(l.path, strconv.FormatUint(jobID, 10), name))
+	if os.IsNotExist(err) {
+		return nil, ErrNoArtifact
+	}
+	return content, err
+}
+
+// List implements Store.List
+func (l localStore) List(jobID uint64) ([]string, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(l.path, strconv.FormatUint(jobID, 10)))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Remove implements Store.Remove
+func (l localStore) Remove(jobID uint64) error {
+	return os.RemoveAll(filepath.Join(l.path, strconv.FormatUint(jobID, 10)))
+}
@@ -0,0 +1,161 @@
+package artifacts_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/mocks"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/artifacts"
+)
+
+func TestArtifactsAreKeptAndServedWithSignedLinks(t *testing.T) {
+	path, err := ioutil.TempDir("", "meeseeks-artifacts")
+	mocks.Must(t, "failed to create artifacts path", err)
+	defer os.RemoveAll(path)
+
+	mocks.Must(t, "failed to configure artifacts", artifacts.Configure(artifacts.Config{
+		Path:       path,
+		URL:        "https://meeseeks.example.com/",
+		SigningKey: "secret",
+		MaxSize:    16,
+	}))
+	defer artifacts.Configure(artifacts.Config{})
+
+	mocks.Must(t, "failed to save artifact", artifacts.Save(7, "report.html", []byte("<p>ok</p>")))
+	mocks.AssertEquals(t, "artifact big.bin of job 7 is 17 bytes, more than the 16 allowed",
+		fmt.Sprint(artifacts.Save(7, "big.bin", []byte(strings.Repeat("x", 17)))))
+	mocks.AssertEquals(t, `invalid artifact name "../passwd"`, fmt.Sprint(artifacts.Save(7, "../passwd", []byte("x"))))
+
+	links := artifacts.Links(7)
+	mocks.AssertEquals(t, 1, len(links))
+	mocks.AssertMatches(t, "^https://meeseeks.example.com/artifacts/7/report.html\\?expires=[0-9]+&signature=[0-9a-f]{64}$", links[0])
+	mocks.AssertEquals(t, 0, len(artifacts.Links(8)))
+
+	tt := []struct {
+		name     string
+		url      string
+		code     int
+		expected string
+	}{
+		{
+			name:     "signed link",
+			url:      strings.TrimPrefix(links[0], "https://meeseeks.example.com"),
+			code:     http.StatusOK,
+			expected: "<p>ok</p>",
+		},
+		{
+			name:     "link of another job",
+			url:      strings.Replace(strings.TrimPrefix(links[0], "https://meeseeks.example.com"), "/7/", "/8/", 1),
+			code:     http.StatusForbidden,
+			expected: "the link is invalid or expired\n",
+		},
+		{
+			name:     "link with another expiry",
+			url:      strings.Replace(strings.TrimPrefix(links[0], "https://meeseeks.example.com"), "expires=", "expires=1", 1),
+			code:     http.StatusForbidden,
+			expected: "the link is invalid or expired\n",
+		},
+		{
+			name:     "unsigned link",
+			url:      "/artifacts/7/report.html",
+			code:     http.StatusForbidden,
+			expected: "the link is invalid or expired\n",
+		},
+		{
+			name:     "no artifact name",
+			url:      "/artifacts/7",
+			code:     http.StatusBadRequest,
+			expected: "the link should have a job ID and an artifact name\n",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			artifacts.HandleGet(w, httptest.NewRequest(http.MethodGet, tc.url, nil))
+			mocks.AssertEquals(t, tc.code, w.Code)
+			mocks.AssertEquals(t, tc.expected, w.Body.String())
+		})
+	}
+
+	mocks.Must(t, "failed to remove artifacts", artifacts.Remove(7))
+	mocks.AssertEquals(t, 0, len(artifacts.Links(7)))
+}
+
+func TestArtifactLinksExpire(t *testing.T) {
+	path, err := ioutil.TempDir("", "meeseeks-artifacts")
+	mocks.Must(t, "failed to create artifacts path", err)
+	defer os.RemoveAll(path)
+
+	mocks.Must(t, "failed to configure artifacts", artifacts.Configure(artifacts.Config{
+		Path:       path,
+		URL:        "https://meeseeks.example.com",
+		SigningKey: "secret",
+		LinkTTL:    1,
+	}))
+	defer artifacts.Configure(artifacts.Config{})
+
+	mocks.Must(t, "failed to save artifact", artifacts.Save(7, "report.html", []byte("<p>ok</p>")))
+	link := strings.TrimPrefix(artifacts.Links(7)[0], "https://meeseeks.example.com")
+
+	time.Sleep(1100 * time.Millisecond)
+
+	w := httptest.NewRecorder()
+	artifacts.HandleGet(w, httptest.NewRequest(http.MethodGet, link, nil))
+	mocks.AssertEquals(t, http.StatusForbidden, w.Code)
+	mocks.AssertEquals(t, "the link is invalid or expired\n", w.Body.String())
+}
+
+func TestValidate(t *testing.T) {
+	tt := []struct {
+		name string
+		cnf  artifacts.Config
+		err  string
+	}{
+		{
+			name: "disabled",
+		},
+		{
+			name: "signed links",
+			cnf:  artifacts.Config{Path: "/tmp", URL: "https://meeseeks", SigningKey: "secret", LinkTTL: 3600},
+		},
+		{
+			name: "url without signing key",
+			cnf:  artifacts.Config{Path: "/tmp", URL: "https://meeseeks"},
+			err:  "artifacts url requires a signing key",
+		},
+		{
+			name: "negative link ttl",
+			cnf:  artifacts.Config{Path: "/tmp", LinkTTL: -1},
+			err:  "artifacts link ttl can't be negative",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.cnf.Validate()
+			if tc.err == "" {
+				mocks.Must(t, "invalid configuration", err)
+				return
+			}
+			mocks.AssertEquals(t, tc.err, err.Error())
+		})
+	}
+}
+
+func TestArtifactsAreNamedWithoutAURL(t *testing.T) {
+	path, err := ioutil.TempDir("", "meeseeks-artifacts")
+	mocks.Must(t, "failed to create artifacts path", err)
+	defer os.RemoveAll(path)
+
+	mocks.Must(t, "failed to configure artifacts", artifacts.Configure(artifacts.Config{Path: path}))
+	defer artifacts.Configure(artifacts.Config{})
+
+	mocks.Must(t, "failed to save artifact", artifacts.Save(9, "b.txt", []byte("b")))
+	mocks.Must(t, "failed to save artifact", artifacts.Save(9, "a.txt", []byte("a")))
+	mocks.AssertEquals(t, []string{"a.txt", "b.txt"}, artifacts.Links(9))
+}
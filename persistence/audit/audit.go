@@ -0,0 +1,87 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/db"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/sirupsen/logrus"
+)
+
+var auditBucketKey = []byte("audit")
+
+// Audit implements the AuditLog interface with a locally stored bucket
+type Audit struct{}
+
+// Record appends the entry to the audit log, setting its ID and Time
+func (Audit) Record(entry meeseeks.AuditEntry) (meeseeks.AuditEntry, error) {
+	return record(entry)
+}
+
+// Find walks through the audit log backwards applying the filter.
+//
+// Returns a list of entries in descending order that match the filter
+func (Audit) Find(filter meeseeks.AuditFilter) ([]meeseeks.AuditEntry, error) {
+	return find(filter)
+}
+
+func record(entry meeseeks.AuditEntry) (meeseeks.AuditEntry, error) {
+	err := db.Create(auditBucketKey, func(id uint64, bucket *bolt.Bucket) error {
+		entry.ID = id
+		entry.Time = time.Now().UTC()
+		logrus.Debugf("Recording audit entry %#v", entry)
+
+		payload, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("could not marshal audit entry: %s", err)
+		}
+		return bucket.Put(db.IDToBytes(id), payload)
+	})
+	if err != nil {
+		return meeseeks.AuditEntry{}, fmt.Errorf("failed to record audit entry: %s", err)
+	}
+	return entry, nil
+}
+
+func find(filter meeseeks.AuditFilter) ([]meeseeks.AuditEntry, error) {
+	if filter.Match == nil {
+		filter.Match = func(_ meeseeks.AuditEntry) bool { return true }
+	}
+
+	entries := make([]meeseeks.AuditEntry, 0)
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(auditBucketKey)
+		if bucket == nil {
+			return nil // an empty audit log is not an error
+		}
+
+		c := bucket.Cursor()
+		for _, payload := c.Last(); payload != nil && len(entries) < filter.Limit; _, payload = c.Prev() {
+			e := meeseeks.AuditEntry{}
+			if err := json.Unmarshal(payload, &e); err != nil {
+				return fmt.Errorf("failed to load audit entry payload: %s", err)
+			}
+			if e.Decision == "" {
+				e.Decision = meeseeks.AuditAccepted // Only accepted requests were recorded before
+			}
+
+			// Entries are stored in chronological order, so we can stop walking
+			// the moment we go past the start of the range
+			if !filter.Since.IsZero() && e.Time.Before(filter.Since) {
+				break
+			}
+			if !filter.Until.IsZero() && e.Time.After(filter.Until) {
+				continue
+			}
+			if filter.Match(e) {
+				entries = append(entries, e)
+			}
+		}
+		return nil
+	})
+	return entries, err
+}
@@ -0,0 +1,68 @@
+package audit_test
+
+import (
+	"testing"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+	"gitlab.com/yakshaving.art/meeseeks-box/mocks"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence"
+)
+
+func TestFindOnEmptyAuditLog(t *testing.T) {
+	mocks.Must(t, "failed to find on an empty audit log", mocks.WithTmpDB(func(_ string) {
+		entries, err := persistence.Audit().Find(meeseeks.AuditFilter{Limit: 5})
+		mocks.Must(t, "could not find entries", err)
+		mocks.AssertEquals(t, 0, len(entries))
+	}))
+}
+
+func TestAuditRecordAndFind(t *testing.T) {
+	mocks.Must(t, "failed to record and find audit entries", mocks.WithTmpDB(func(_ string) {
+		r1 := meeseeks.Request{Command: "echo", Username: "someone", Args: []string{"hello"}}
+		r2 := meeseeks.Request{Command: "version", Username: "someoneelse"}
+
+		e1, err := persistence.Audit().Record(meeseeks.AuditEntry{
+			Decision: meeseeks.AuditAccepted, JobID: 1, Request: r1})
+		mocks.Must(t, "could not record entry", err)
+		e2, err := persistence.Audit().Record(meeseeks.AuditEntry{
+			Decision: meeseeks.AuditUnauthorized, Reason: "not allowed", Request: r2})
+		mocks.Must(t, "could not record entry", err)
+
+		mocks.AssertEquals(t, uint64(1), e1.ID)
+		mocks.AssertEquals(t, uint64(2), e2.ID)
+
+		entries, err := persistence.Audit().Find(meeseeks.AuditFilter{Limit: 5})
+		mocks.Must(t, "could not find entries", err)
+		mocks.AssertEquals(t, 2, len(entries))
+		mocks.AssertEquals(t, uint64(2), entries[0].ID)
+		mocks.AssertEquals(t, uint64(0), entries[0].JobID)
+		mocks.AssertEquals(t, meeseeks.AuditUnauthorized, entries[0].Decision)
+		mocks.AssertEquals(t, "not allowed", entries[0].Reason)
+		mocks.AssertEquals(t, r2, entries[0].Request)
+		mocks.AssertEquals(t, uint64(1), entries[1].JobID)
+		mocks.AssertEquals(t, r1, entries[1].Request)
+
+		entries, err = persistence.Audit().Find(meeseeks.AuditFilter{
+			Limit: 5,
+			Match: func(e meeseeks.AuditEntry) bool { return e.Request.Username == "someone" },
+		})
+		mocks.Must(t, "could not find entries", err)
+		mocks.AssertEquals(t, 1, len(entries))
+		mocks.AssertEquals(t, uint64(1), entries[0].ID)
+
+		entries, err = persistence.Audit().Find(meeseeks.AuditFilter{
+			Limit: 5,
+			Since: time.Now().Add(time.Hour),
+		})
+		mocks.Must(t, "could not find entries", err)
+		mocks.AssertEquals(t, 0, len(entries))
+
+		entries, err = persistence.Audit().Find(meeseeks.AuditFilter{
+			Limit: 5,
+			Until: time.Now().Add(-time.Hour),
+		})
+		mocks.Must(t, "could not find entries", err)
+		mocks.AssertEquals(t, 0, len(entries))
+	}))
+}
@@ -0,0 +1,28 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+)
+
+// Export writes all the entries of the audit log that match the filter as
+// JSON lines, in chronological order. The filter limit is ignored
+func Export(w io.Writer, log meeseeks.AuditLog, filter meeseeks.AuditFilter) error {
+	filter.Limit = math.MaxInt32
+	entries, err := log.Find(filter)
+	if err != nil {
+		return fmt.Errorf("could not read audit entries: %s", err)
+	}
+
+	encoder := json.NewEncoder(w)
+	for i := len(entries) - 1; i >= 0; i-- {
+		if err := encoder.Encode(entries[i]); err != nil {
+			return fmt.Errorf("could not export audit entry %d: %s", entries[i].ID, err)
+		}
+	}
+	return nil
+}
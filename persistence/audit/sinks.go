@@ -0,0 +1,265 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultSyslogTag is the tag used to send entries to syslog when none is set
+const DefaultSyslogTag = "meeseeks-audit"
+
+// DefaultWebhookTimeout is how long a webhook call can take when no timeout
+// is set
+const DefaultWebhookTimeout = 5 * time.Second
+
+// KafkaContentType is the content type of the records posted to a Kafka REST
+// proxy
+const KafkaContentType = "application/vnd.kafka.json.v2+json"
+
+// Config holds the sinks every audit entry is copied to once it's recorded
+//
+// Syslog is enabled with its enabled flag, an empty network and address send
+// the entries to the local syslog daemon. Webhook is enabled with its url,
+// entries are posted to it as JSON. Kafka is enabled with its REST proxy,
+// entries are produced to the topic through it
+type Config struct {
+	Syslog  SyslogConfig  `yaml:"syslog"`
+	Webhook WebhookConfig `yaml:"webhook"`
+	Kafka   KafkaConfig   `yaml:"kafka"`
+}
+
+// SyslogConfig holds the configuration of the syslog sink
+type SyslogConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Network string `yaml:"network"`
+	Address string `yaml:"address"`
+	Tag     string `yaml:"tag"`
+}
+
+// WebhookConfig holds the configuration of the webhook sink, the entries are
+// posted to URL with a timeout in seconds
+type WebhookConfig struct {
+	URL     string        `yaml:"url"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// KafkaConfig holds the configuration of the kafka sink, the url of the REST
+// proxy and the topic the entries are produced to, keyed by the user of the
+// request so the ones of each user keep their order, with a timeout in seconds
+type KafkaConfig struct {
+	RESTProxy string        `yaml:"rest_proxy"`
+	Topic     string        `yaml:"topic"`
+	Timeout   time.Duration `yaml:"timeout"`
+}
+
+// Validate checks that the configuration is usable
+func (c Config) Validate() error {
+	if c.Webhook.URL != "" && !isHTTP(c.Webhook.URL) {
+		return fmt.Errorf("invalid audit webhook url %s, it has to be an http or https url", c.Webhook.URL)
+	}
+	if c.Kafka.RESTProxy == "" && c.Kafka.Topic == "" {
+		return nil
+	}
+	if !isHTTP(c.Kafka.RESTProxy) {
+		return fmt.Errorf("invalid audit kafka rest proxy %s, it has to be an http or https url", c.Kafka.RESTProxy)
+	}
+	if c.Kafka.Topic == "" {
+		return fmt.Errorf("audit kafka requires a topic")
+	}
+	return nil
+}
+
+func isHTTP(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https")
+}
+
+// Sink receives a copy of the audit entries as they are recorded
+type Sink interface {
+	Send(entry meeseeks.AuditEntry) error
+	Close() error
+}
+
+// NewSinks creates the sinks that are enabled in the configuration
+func NewSinks(cnf Config) ([]Sink, error) {
+	sinks := make([]Sink, 0)
+	if cnf.Syslog.Enabled {
+		s, err := NewSyslogSink(cnf.Syslog)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, s)
+	}
+	if cnf.Webhook.URL != "" {
+		sinks = append(sinks, NewWebhookSink(cnf.Webhook))
+	}
+	if cnf.Kafka.RESTProxy != "" {
+		sinks = append(sinks, NewKafkaSink(cnf.Kafka))
+	}
+	return sinks, nil
+}
+
+type webhookSink struct {
+	url    string
+	client *http.Client
+}
+
+// NewWebhookSink returns a sink that posts the entries as JSON to a url
+func NewWebhookSink(cnf WebhookConfig) Sink {
+	timeout := cnf.Timeout * time.Second
+	if timeout <= 0 {
+		timeout = DefaultWebhookTimeout
+	}
+	return webhookSink{
+		url:    cnf.URL,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+func (s webhookSink) Send(entry meeseeks.AuditEntry) error {
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("could not marshal audit entry: %s", err)
+	}
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("could not post audit entry: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("audit webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (s webhookSink) Close() error {
+	return nil
+}
+
+type kafkaSink struct {
+	url    string
+	client *http.Client
+}
+
+// NewKafkaSink returns a sink that produces the entries as JSON to a topic
+// through a Kafka REST proxy
+func NewKafkaSink(cnf KafkaConfig) Sink {
+	timeout := cnf.Timeout * time.Second
+	if timeout <= 0 {
+		timeout = DefaultWebhookTimeout
+	}
+	return kafkaSink{
+		url:    strings.TrimSuffix(cnf.RESTProxy, "/") + "/topics/" + url.PathEscape(cnf.Topic),
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+type kafkaRecord struct {
+	Key   *string             `json:"key"`
+	Value meeseeks.AuditEntry `json:"value"`
+}
+
+func (s kafkaSink) Send(entry meeseeks.AuditEntry) error {
+	record := kafkaRecord{Value: entry}
+	if entry.Request.UserID != "" {
+		record.Key = &entry.Request.UserID
+	}
+	payload, err := json.Marshal(map[string][]kafkaRecord{"records": {record}})
+	if err != nil {
+		return fmt.Errorf("could not marshal audit entry: %s", err)
+	}
+	resp, err := s.client.Post(s.url, KafkaContentType, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("could not produce audit entry: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("kafka rest proxy returned %s", resp.Status)
+	}
+
+	// The proxy replies OK with the error of each record that failed
+	produced := struct {
+		Offsets []struct {
+			Error string `json:"error"`
+		} `json:"offsets"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&produced); err != nil {
+		return fmt.Errorf("invalid kafka rest proxy response: %s", err)
+	}
+	for _, offset := range produced.Offsets {
+		if offset.Error != "" {
+			return fmt.Errorf("kafka rejected audit entry: %s", offset.Error)
+		}
+	}
+	return nil
+}
+
+func (s kafkaSink) Close() error {
+	return nil
+}
+
+// WithSinks returns an audit log that copies every recorded entry to the
+// sinks. Sinks are called in the background so a slow one doesn't hold
+// requests back, their failures are only logged
+func WithSinks(log meeseeks.AuditLog, sinks ...Sink) meeseeks.AuditLog {
+	return sinkingLog{AuditLog: log, sinks: sinks}
+}
+
+type sinkingLog struct {
+	meeseeks.AuditLog
+	sinks []Sink
+}
+
+// Record implements AuditLog.Record
+func (l sinkingLog) Record(entry meeseeks.AuditEntry) (meeseeks.AuditEntry, error) {
+	entry, err := l.AuditLog.Record(entry)
+	if err != nil {
+		return entry, err
+	}
+	l.send(entry)
+	return entry, nil
+}
+
+func (l sinkingLog) send(entry meeseeks.AuditEntry) {
+	for _, sink := range l.sinks {
+		go func(sink Sink) {
+			if err := sink.Send(entry); err != nil {
+				logrus.Errorf("Could not send %s audit entry %d to sink: %s", entry.Decision, entry.ID, err)
+			}
+		}(sink)
+	}
+}
+
+// Publish sends the entry to the sinks of the audit log without recording it,
+// like the status a job finished with. It does nothing when the log has no
+// sinks
+func Publish(log meeseeks.AuditLog, entry meeseeks.AuditEntry) {
+	l, ok := log.(sinkingLog)
+	if !ok {
+		return
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+	l.send(entry)
+}
+
+// Unwrap returns the audit log the sinks were added to, or the same log if
+// it has no sinks
+func Unwrap(log meeseeks.AuditLog) meeseeks.AuditLog {
+	if l, ok := log.(sinkingLog); ok {
+		return l.AuditLog
+	}
+	return log
+}
@@ -0,0 +1,193 @@
+package audit_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+	"gitlab.com/yakshaving.art/meeseeks-box/mocks"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/audit"
+)
+
+func TestValidateWebhook(t *testing.T) {
+	tt := []struct {
+		name     string
+		url      string
+		expected string
+	}{
+		{name: "no webhook", url: ""},
+		{name: "http webhook", url: "http://localhost:8080/audit"},
+		{
+			name:     "not an http url",
+			url:      "ftp://localhost/audit",
+			expected: "invalid audit webhook url ftp://localhost/audit, it has to be an http or https url",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			err := audit.Config{Webhook: audit.WebhookConfig{URL: tc.url}}.Validate()
+			if tc.expected == "" {
+				mocks.Must(t, "valid configuration failed", err)
+				return
+			}
+			mocks.AssertEquals(t, tc.expected, err.Error())
+		})
+	}
+}
+
+func TestWebhookSinkGetsRecordedEntries(t *testing.T) {
+	received := make(chan meeseeks.AuditEntry, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		e := meeseeks.AuditEntry{}
+		if err := json.Unmarshal(body, &e); err != nil {
+			t.Errorf("invalid audit entry %s: %s", body, err)
+		}
+		received <- e
+	}))
+	defer server.Close()
+
+	mocks.Must(t, "failed to send entries to a webhook", mocks.WithTmpDB(func(_ string) {
+		sinks, err := audit.NewSinks(audit.Config{Webhook: audit.WebhookConfig{URL: server.URL}})
+		mocks.Must(t, "could not create sinks", err)
+		mocks.AssertEquals(t, 1, len(sinks))
+
+		log := audit.WithSinks(persistence.Audit(), sinks...)
+		recorded, err := log.Record(meeseeks.AuditEntry{
+			Decision: meeseeks.AuditUnknown,
+			Request:  meeseeks.Request{Command: "nope", Username: "someone"},
+		})
+		mocks.Must(t, "could not record entry", err)
+
+		select {
+		case e := <-received:
+			mocks.AssertEquals(t, recorded.ID, e.ID)
+			mocks.AssertEquals(t, meeseeks.AuditUnknown, e.Decision)
+			mocks.AssertEquals(t, "nope", e.Request.Command)
+		case <-time.After(time.Second):
+			t.Fatal("the webhook was not called")
+		}
+
+		mocks.AssertEquals(t, persistence.Audit(), audit.Unwrap(log))
+	}))
+}
+
+func TestValidateKafka(t *testing.T) {
+	tt := []struct {
+		name     string
+		kafka    audit.KafkaConfig
+		expected string
+	}{
+		{name: "no kafka"},
+		{name: "rest proxy and topic", kafka: audit.KafkaConfig{RESTProxy: "http://kafka-rest:8082", Topic: "audit"}},
+		{
+			name:     "topic without rest proxy",
+			kafka:    audit.KafkaConfig{Topic: "audit"},
+			expected: "invalid audit kafka rest proxy , it has to be an http or https url",
+		},
+		{
+			name:     "no topic",
+			kafka:    audit.KafkaConfig{RESTProxy: "http://kafka-rest:8082"},
+			expected: "audit kafka requires a topic",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			err := audit.Config{Kafka: tc.kafka}.Validate()
+			if tc.expected == "" {
+				mocks.Must(t, "valid configuration failed", err)
+				return
+			}
+			mocks.AssertEquals(t, tc.expected, err.Error())
+		})
+	}
+}
+
+func TestKafkaSinkProducesEntries(t *testing.T) {
+	type record struct {
+		Key   *string             `json:"key"`
+		Value meeseeks.AuditEntry `json:"value"`
+	}
+	received := make(chan record, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mocks.AssertEquals(t, "/topics/meeseeks-audit", r.URL.Path)
+		mocks.AssertEquals(t, audit.KafkaContentType, r.Header.Get("Content-Type"))
+		produced := struct {
+			Records []record `json:"records"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&produced); err != nil || len(produced.Records) != 1 {
+			t.Errorf("invalid records: %v", err)
+		}
+		w.Write([]byte(`{"offsets": [{"partition": 0, "offset": 1}]}`))
+		received <- produced.Records[0]
+	}))
+	defer server.Close()
+
+	mocks.Must(t, "failed to produce entries to kafka", mocks.WithTmpDB(func(_ string) {
+		sinks, err := audit.NewSinks(audit.Config{Kafka: audit.KafkaConfig{RESTProxy: server.URL + "/", Topic: "meeseeks-audit"}})
+		mocks.Must(t, "could not create sinks", err)
+		log := audit.WithSinks(persistence.Audit(), sinks...)
+
+		recorded, err := log.Record(meeseeks.AuditEntry{
+			Decision: meeseeks.AuditUnauthorized,
+			Request:  meeseeks.Request{Command: "deploy", UserID: "someoneID"},
+		})
+		mocks.Must(t, "could not record entry", err)
+		select {
+		case r := <-received:
+			mocks.AssertEquals(t, "someoneID", *r.Key)
+			mocks.AssertEquals(t, recorded.ID, r.Value.ID)
+			mocks.AssertEquals(t, meeseeks.AuditUnauthorized, r.Value.Decision)
+		case <-time.After(time.Second):
+			t.Fatal("the entry was not produced")
+		}
+
+		audit.Publish(log, meeseeks.AuditEntry{Decision: meeseeks.AuditFinished, JobID: 1, Reason: "Succeeded"})
+		select {
+		case r := <-received:
+			mocks.AssertEquals(t, (*string)(nil), r.Key)
+			mocks.AssertEquals(t, meeseeks.AuditFinished, r.Value.Decision)
+			mocks.AssertEquals(t, "Succeeded", r.Value.Reason)
+			if r.Value.Time.IsZero() {
+				t.Fatal("the published entry has no time")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("the published entry was not produced")
+		}
+
+		entries, err := persistence.Audit().Find(meeseeks.AuditFilter{Limit: 10})
+		mocks.Must(t, "could not find entries", err)
+		mocks.AssertEquals(t, 1, len(entries))
+	}))
+}
+
+func TestExportWritesJSONLines(t *testing.T) {
+	mocks.Must(t, "failed to export the audit log", mocks.WithTmpDB(func(_ string) {
+		for _, command := range []string{"first", "second", "third"} {
+			_, err := persistence.Audit().Record(meeseeks.AuditEntry{
+				Decision: meeseeks.AuditAccepted,
+				Request:  meeseeks.Request{Command: command},
+			})
+			mocks.Must(t, "could not record entry", err)
+		}
+
+		b := bytes.NewBuffer([]byte{})
+		mocks.Must(t, "could not export", audit.Export(b, persistence.Audit(), meeseeks.AuditFilter{}))
+
+		lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+		mocks.AssertEquals(t, 3, len(lines))
+		for i, command := range []string{"first", "second", "third"} {
+			e := meeseeks.AuditEntry{}
+			mocks.Must(t, "invalid json line", json.Unmarshal([]byte(lines[i]), &e))
+			mocks.AssertEquals(t, uint64(i+1), e.ID)
+			mocks.AssertEquals(t, command, e.Request.Command)
+		}
+	}))
+}
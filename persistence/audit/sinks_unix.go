@@ -0,0 +1,45 @@
+//go:build !windows
+// +build !windows
+
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/syslog"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+)
+
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+// NewSyslogSink returns a sink that writes the entries to syslog as JSON, the
+// accepted ones with info priority and the rest as warnings
+func NewSyslogSink(cnf SyslogConfig) (Sink, error) {
+	tag := cnf.Tag
+	if tag == "" {
+		tag = DefaultSyslogTag
+	}
+	w, err := syslog.Dial(cnf.Network, cnf.Address, syslog.LOG_INFO|syslog.LOG_AUTH, tag)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to syslog: %s", err)
+	}
+	return syslogSink{w: w}, nil
+}
+
+func (s syslogSink) Send(entry meeseeks.AuditEntry) error {
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("could not marshal audit entry: %s", err)
+	}
+	if entry.Decision == meeseeks.AuditAccepted {
+		return s.w.Info(string(payload))
+	}
+	return s.w.Warning(string(payload))
+}
+
+func (s syslogSink) Close() error {
+	return s.w.Close()
+}
@@ -0,0 +1,13 @@
+//go:build windows
+// +build windows
+
+package audit
+
+import (
+	"fmt"
+)
+
+// NewSyslogSink fails on windows, there is no syslog there
+func NewSyslogSink(_ SyslogConfig) (Sink, error) {
+	return nil, fmt.Errorf("the syslog audit sink is not supported on windows")
+}
@@ -14,35 +14,52 @@ var databaseConfig DatabaseConfig
 var database *bolt.DB
 var mutex = sync.Mutex{}
 
-// DatabaseConfig holds the configuration for the BoltDB database
+// DatabaseConfig holds the configuration for the database, BoltDB is used
+// unless a SQL driver is picked, in which case DSN is used to connect
 type DatabaseConfig struct {
 	Path    string        `yaml:"path"`
 	Timeout time.Duration `yaml:"timeout"`
 	Mode    os.FileMode   `yaml:"file_mode"`
+	Driver  string        `yaml:"driver"`
+	DSN     string        `yaml:"dsn"`
 }
 
-// Configure loads the required configuration to be able of connecting to a database
+// Configure loads the required configuration to be able of connecting to a
+// database, and brings it up to date applying the pending migrations. The
+// database that is open is kept when its path didn't change, otherwise the
+// new one is opened before the previous one is closed
 func Configure(cnf DatabaseConfig) error {
 	mutex.Lock()
 	defer mutex.Unlock()
 
-	if database != nil { // Close the database if it is currently open. This is probably candidate for a mutex
-		database.Close()
+	if database != nil && databaseConfig.Path == cnf.Path {
+		databaseConfig = cnf
+		if err := migrate(database); err != nil {
+			return fmt.Errorf("could not migrate database: %s", err)
+		}
+		return nil
 	}
 
-	databaseConfig = cnf
-	db, err := open()
+	db, err := open(cnf)
 	if err != nil {
 		return err
 	}
-	database = db
+	if err = migrate(db); err != nil {
+		db.Close()
+		return fmt.Errorf("could not migrate database: %s", err)
+	}
+	previous := database
+	database, databaseConfig = db, cnf
+	if previous != nil {
+		previous.Close()
+	}
 	return nil
 }
 
 // Open opens a new connection to the database
-func open() (*bolt.DB, error) {
-	return bolt.Open(databaseConfig.Path, databaseConfig.Mode, &bolt.Options{
-		Timeout: databaseConfig.Timeout,
+func open(cnf DatabaseConfig) (*bolt.DB, error) {
+	return bolt.Open(cnf.Path, cnf.Mode, &bolt.Options{
+		Timeout: cnf.Timeout,
 	})
 }
 
@@ -0,0 +1,99 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/sirupsen/logrus"
+)
+
+var metaBucketKey = []byte("meta")
+var versionKey = []byte("version")
+
+// Migration changes the buckets from one version of the schema to the next
+type Migration struct {
+	Version int
+	Name    string
+	Apply   func(tx *bolt.Tx) error
+}
+
+var migrations = make(map[int]Migration)
+
+// RegisterMigration adds a migration to apply when the database is opened,
+// it's meant to be called from the init of the package that owns the buckets.
+//
+// Versions are shared by all the packages, so registering one twice panics
+func RegisterMigration(m Migration) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if existing, ok := migrations[m.Version]; ok {
+		panic(fmt.Sprintf("migration %d (%s) is already registered as %s", m.Version, m.Name, existing.Name))
+	}
+	migrations[m.Version] = m
+}
+
+// Version returns the version of the schema of the database, 0 if it was
+// never migrated
+func Version() (int, error) {
+	version := 0
+	err := View(func(tx *bolt.Tx) error {
+		version = readVersion(tx)
+		return nil
+	})
+	return version, err
+}
+
+// Migrate applies in order the migrations that are newer than the version of
+// the database. Each one is applied in its own transaction along with the new
+// version, so a failed migration leaves the database in the previous one
+func Migrate() error {
+	return WithDB(migrate)
+}
+
+func migrate(db *bolt.DB) error {
+	versions := make([]int, 0, len(migrations))
+	for version := range migrations {
+		versions = append(versions, version)
+	}
+	sort.Ints(versions)
+
+	for _, version := range versions {
+		m := migrations[version]
+		err := db.Update(func(tx *bolt.Tx) error {
+			if readVersion(tx) >= m.Version {
+				return nil
+			}
+			logrus.Infof("Applying database migration %d: %s", m.Version, m.Name)
+			if err := m.Apply(tx); err != nil {
+				return err
+			}
+			return writeVersion(tx, m.Version)
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %s", m.Version, m.Name, err)
+		}
+	}
+	return nil
+}
+
+func readVersion(tx *bolt.Tx) int {
+	meta := tx.Bucket(metaBucketKey)
+	if meta == nil {
+		return 0
+	}
+	version := meta.Get(versionKey)
+	if version == nil {
+		return 0
+	}
+	return int(IDFromBytes(version))
+}
+
+func writeVersion(tx *bolt.Tx, version int) error {
+	meta, err := tx.CreateBucketIfNotExists(metaBucketKey)
+	if err != nil {
+		return fmt.Errorf("could not create meta bucket: %s", err)
+	}
+	return meta.Put(versionKey, IDToBytes(uint64(version)))
+}
@@ -0,0 +1,58 @@
+package db_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/mocks"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/db"
+
+	bolt "github.com/coreos/bbolt"
+)
+
+// Migrations are shared by all the packages, so the ones of the test use
+// versions far from the real ones
+func TestMigrations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meeseeks-migrations")
+	mocks.Must(t, "could not create tmp dir", err)
+	defer os.RemoveAll(dir)
+
+	cnf := db.DatabaseConfig{
+		Path:    path.Join(dir, "meeseeks.db"),
+		Mode:    0600,
+		Timeout: 1 * time.Second,
+	}
+
+	applied := 0
+	db.RegisterMigration(db.Migration{
+		Version: 1001,
+		Name:    "create a bucket",
+		Apply: func(tx *bolt.Tx) error {
+			applied++
+			_, err := tx.CreateBucket([]byte("migrated"))
+			return err
+		},
+	})
+	mocks.Must(t, "could not configure the database", db.Configure(cnf))
+	mocks.Must(t, "could not configure the database again", db.Configure(cnf))
+	mocks.AssertEquals(t, 1, applied)
+
+	db.RegisterMigration(db.Migration{
+		Version: 1002,
+		Name:    "broken",
+		Apply: func(tx *bolt.Tx) error {
+			return errors.New("nope")
+		},
+	})
+	mocks.AssertEquals(t, "could not migrate database: migration 1002 (broken) failed: nope",
+		db.Configure(cnf).Error())
+
+	defer func() {
+		mocks.AssertEquals(t, "migration 1001 (again) is already registered as create a bucket", recover())
+	}()
+	db.RegisterMigration(db.Migration{Version: 1001, Name: "again"})
+}
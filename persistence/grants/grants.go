@@ -0,0 +1,75 @@
+package grants
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/db"
+
+	bolt "github.com/coreos/bbolt"
+)
+
+var grantsBucketKey = []byte("grants")
+
+// Grants provides the interface to the locally persisted temporary grants
+type Grants struct{}
+
+// Create records the grant setting its ID, the expired grants are removed
+func (Grants) Create(grant meeseeks.Grant) (meeseeks.Grant, error) {
+	err := db.Create(grantsBucketKey, func(id uint64, bucket *bolt.Bucket) error {
+		expired := make([][]byte, 0)
+		err := bucket.ForEach(func(k, payload []byte) error {
+			g := meeseeks.Grant{}
+			if err := json.Unmarshal(payload, &g); err != nil {
+				return fmt.Errorf("failed to load grant payload: %s", err)
+			}
+			if !g.Active(time.Now()) {
+				expired = append(expired, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err = bucket.Delete(k); err != nil {
+				return fmt.Errorf("could not drop expired grant %d: %s", db.IDFromBytes(k), err)
+			}
+		}
+
+		grant.ID = id
+		payload, err := json.Marshal(grant)
+		if err != nil {
+			return fmt.Errorf("could not marshal grant: %s", err)
+		}
+		return bucket.Put(db.IDToBytes(id), payload)
+	})
+	if err != nil {
+		return meeseeks.Grant{}, fmt.Errorf("failed to create grant: %s", err)
+	}
+	return grant, nil
+}
+
+// List returns the grants that are active at the given time
+func (Grants) List(now time.Time) ([]meeseeks.Grant, error) {
+	grants := make([]meeseeks.Grant, 0)
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(grantsBucketKey)
+		if bucket == nil {
+			return nil // nothing has been granted yet
+		}
+		return bucket.ForEach(func(_, payload []byte) error {
+			g := meeseeks.Grant{}
+			if err := json.Unmarshal(payload, &g); err != nil {
+				return fmt.Errorf("failed to load grant payload: %s", err)
+			}
+			if g.Active(now) {
+				grants = append(grants, g)
+			}
+			return nil
+		})
+	})
+	return grants, err
+}
@@ -0,0 +1,78 @@
+package groups
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/db"
+
+	bolt "github.com/coreos/bbolt"
+)
+
+var groupsBucketKey = []byte("groups")
+
+// Groups provides the interface to locally persisted group memberships
+type Groups struct{}
+
+// Add records that the user belongs to the group
+func (Groups) Add(group, username string) error {
+	return put(meeseeks.GroupMembership{
+		Group:    group,
+		Username: username,
+		Member:   true,
+	})
+}
+
+// Remove records that the user does not belong to the group
+func (Groups) Remove(group, username string) error {
+	return put(meeseeks.GroupMembership{
+		Group:    group,
+		Username: username,
+		Member:   false,
+	})
+}
+
+// List returns all the recorded memberships
+func (Groups) List() ([]meeseeks.GroupMembership, error) {
+	return list()
+}
+
+func put(m meeseeks.GroupMembership) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(groupsBucketKey)
+		if err != nil {
+			return fmt.Errorf("could not get groups bucket: %s", err)
+		}
+		groupBucket, err := bucket.CreateBucketIfNotExists([]byte(m.Group))
+		if err != nil {
+			return fmt.Errorf("could not get bucket for group %s: %s", m.Group, err)
+		}
+		payload, err := json.Marshal(m)
+		if err != nil {
+			return fmt.Errorf("could not marshal group membership: %s", err)
+		}
+		return groupBucket.Put([]byte(m.Username), payload)
+	})
+}
+
+func list() ([]meeseeks.GroupMembership, error) {
+	memberships := make([]meeseeks.GroupMembership, 0)
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(groupsBucketKey)
+		if bucket == nil {
+			return nil // nothing has been changed at runtime yet
+		}
+		return bucket.ForEach(func(group, _ []byte) error {
+			return bucket.Bucket(group).ForEach(func(_, payload []byte) error {
+				m := meeseeks.GroupMembership{}
+				if err := json.Unmarshal(payload, &m); err != nil {
+					return fmt.Errorf("failed to load group membership payload: %s", err)
+				}
+				memberships = append(memberships, m)
+				return nil
+			})
+		})
+	})
+	return memberships, err
+}
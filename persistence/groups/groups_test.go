@@ -0,0 +1,34 @@
+package groups_test
+
+import (
+	"testing"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+	"gitlab.com/yakshaving.art/meeseeks-box/mocks"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence"
+)
+
+func TestListEmptyMemberships(t *testing.T) {
+	mocks.Must(t, "failed to list memberships", mocks.WithTmpDB(func(_ string) {
+		memberships, err := persistence.Groups().List()
+		mocks.Must(t, "could not list memberships", err)
+		mocks.AssertEquals(t, []meeseeks.GroupMembership{}, memberships)
+	}))
+}
+
+func TestMembershipsLifecycle(t *testing.T) {
+	mocks.Must(t, "failed to record memberships", mocks.WithTmpDB(func(_ string) {
+		mocks.Must(t, "could not add user", persistence.Groups().Add("admin", "someone"))
+		mocks.Must(t, "could not add user", persistence.Groups().Add("developer", "someone"))
+		mocks.Must(t, "could not remove user", persistence.Groups().Remove("developer", "someone"))
+		mocks.Must(t, "could not remove user", persistence.Groups().Remove("developer", "someoneelse"))
+
+		memberships, err := persistence.Groups().List()
+		mocks.Must(t, "could not list memberships", err)
+		mocks.AssertEquals(t, []meeseeks.GroupMembership{
+			{Group: "admin", Username: "someone", Member: true},
+			{Group: "developer", Username: "someone", Member: false},
+			{Group: "developer", Username: "someoneelse", Member: false},
+		}, memberships)
+	}))
+}
@@ -0,0 +1,125 @@
+package identities
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/db"
+
+	bolt "github.com/coreos/bbolt"
+)
+
+var identitiesBucketKey = []byte("identities")
+var linksBucketKey = []byte("identity_links")
+
+// Identities provides the interface to the locally persisted linked identities
+type Identities struct{}
+
+// Link stores the identity of the user, replacing the previous one
+func (Identities) Link(identity meeseeks.Identity) error {
+	payload, err := json.Marshal(identity)
+	if err != nil {
+		return fmt.Errorf("could not marshal identity: %s", err)
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(identitiesBucketKey)
+		if err != nil {
+			return fmt.Errorf("could not get identities bucket: %s", err)
+		}
+		return bucket.Put([]byte(identity.UserID), payload)
+	})
+}
+
+// Get returns the identity linked to the user ID, ErrNoIdentity if there is none
+func (Identities) Get(userID string) (meeseeks.Identity, error) {
+	identity := meeseeks.Identity{}
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(identitiesBucketKey)
+		if bucket == nil {
+			return meeseeks.ErrNoIdentity
+		}
+		payload := bucket.Get([]byte(userID))
+		if payload == nil {
+			return meeseeks.ErrNoIdentity
+		}
+		if err := json.Unmarshal(payload, &identity); err != nil {
+			return fmt.Errorf("failed to load identity payload: %s", err)
+		}
+		return nil
+	})
+	return identity, err
+}
+
+// Unlink removes the identity linked to the user ID
+func (Identities) Unlink(userID string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(identitiesBucketKey)
+		if bucket == nil || bucket.Get([]byte(userID)) == nil {
+			return meeseeks.ErrNoIdentity
+		}
+		return bucket.Delete([]byte(userID))
+	})
+}
+
+// AddLink stores a link sent to a user until it expires, the expired ones are
+// removed
+func (Identities) AddLink(link meeseeks.IdentityLink) error {
+	payload, err := json.Marshal(link)
+	if err != nil {
+		return fmt.Errorf("could not marshal identity link: %s", err)
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(linksBucketKey)
+		if err != nil {
+			return fmt.Errorf("could not get identity links bucket: %s", err)
+		}
+
+		expired := [][]byte{}
+		now := time.Now()
+		err = bucket.ForEach(func(k, v []byte) error {
+			l := meeseeks.IdentityLink{}
+			if err := json.Unmarshal(v, &l); err != nil {
+				return fmt.Errorf("failed to load identity link payload: %s", err)
+			}
+			if now.After(l.ExpiresAt) {
+				expired = append(expired, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return bucket.Put([]byte(link.State), payload)
+	})
+}
+
+// TakeLink removes the link with the state and returns it, ErrNoIdentityLink
+// if there is none or it expired at the given time
+func (Identities) TakeLink(state string, now time.Time) (meeseeks.IdentityLink, error) {
+	link := meeseeks.IdentityLink{}
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(linksBucketKey)
+		if bucket == nil {
+			return meeseeks.ErrNoIdentityLink
+		}
+		payload := bucket.Get([]byte(state))
+		if payload == nil {
+			return meeseeks.ErrNoIdentityLink
+		}
+		if err := json.Unmarshal(payload, &link); err != nil {
+			return fmt.Errorf("failed to load identity link payload: %s", err)
+		}
+		return bucket.Delete([]byte(state))
+	})
+	if err == nil && now.After(link.ExpiresAt) {
+		return meeseeks.IdentityLink{}, meeseeks.ErrNoIdentityLink
+	}
+	return link, err
+}
@@ -14,6 +14,11 @@ import (
 
 var jobsBucketKey = []byte("jobs")
 var runningJobsBucketKey = []byte("running-jobs")
+var queuedJobsBucketKey = []byte("queued-jobs")
+var labelsBucketKey = []byte("job-labels")
+var usersBucketKey = []byte("job-users")
+var channelsBucketKey = []byte("job-channels")
+var ulidsBucketKey = []byte("job-ulids")
 
 // Jobs creates a new Jobs object
 type Jobs struct{}
@@ -23,29 +28,53 @@ func (Jobs) Get(id uint64) (meeseeks.Job, error) {
 	return get(id)
 }
 
+// GetByULID returns an existing job by its ULID
+func (Jobs) GetByULID(id string) (meeseeks.Job, error) {
+	return getByULID(id)
+}
+
 // Null returns a null job that will not be tracked
 func (Jobs) Null(r meeseeks.Request) meeseeks.Job {
 	return null(r)
 }
 
-// Create records a request in the DB and hands off a new job
+// Create records a request in the DB and hands off a new running job
 func (Jobs) Create(r meeseeks.Request) (meeseeks.Job, error) {
-	return create(r)
+	return create(r, meeseeks.JobRunningStatus)
+}
+
+// Queue records a request in the DB and hands off a new queued job
+func (Jobs) Queue(r meeseeks.Request) (meeseeks.Job, error) {
+	return create(r, meeseeks.JobQueuedStatus)
+}
+
+// Start moves a queued job to running
+func (Jobs) Start(jobID uint64) error {
+	return moveTo(jobID, meeseeks.JobRunningStatus)
+}
+
+// Finish accounts for the job ending and sets the final status
+func (Jobs) Finish(jobID uint64, status meeseeks.JobStatus) error {
+	if !status.IsFinished() {
+		return fmt.Errorf("invalid status %s", status)
+	}
+	return moveTo(jobID, status)
 }
 
-// Fail accounds for the job ending and sets the status.
-func (Jobs) Fail(jobID uint64) error {
-	return finish(jobID, meeseeks.JobFailedStatus)
+// InterruptRunningJobs flags as interrupted any job that is still in running
+// state and returns them
+func (Jobs) InterruptRunningJobs(note string) ([]meeseeks.Job, error) {
+	return interruptRunningJobs(note)
 }
 
-// Succeed accounds for the job ending and sets the status.
-func (Jobs) Succeed(jobID uint64) error {
-	return finish(jobID, meeseeks.JobSuccessStatus)
+// QueuedJobs returns the jobs that are still queued, oldest first
+func (Jobs) QueuedJobs() ([]meeseeks.Job, error) {
+	return queuedJobs()
 }
 
-// FailRunningJobs flags as failed any jobs that is still in running state
-func (Jobs) FailRunningJobs() error {
-	return failRunningJobs()
+// FailQueuedJobs flags as failed any job that is still queued and returns them
+func (Jobs) FailQueuedJobs(note string) ([]meeseeks.Job, error) {
+	return failQueuedJobs(note)
 }
 
 // Find will walk through the values on the jobs bucket and will apply the Match function
@@ -56,6 +85,16 @@ func (Jobs) Find(filter meeseeks.JobFilter) ([]meeseeks.Job, error) {
 	return find(filter)
 }
 
+// AddLabels attaches the labels to a job and indexes them
+func (Jobs) AddLabels(jobID uint64, labels map[string]string) error {
+	return addLabels(jobID, labels)
+}
+
+// Remove drops a finished job, running jobs can't be removed
+func (Jobs) Remove(jobID uint64) error {
+	return remove(jobID)
+}
+
 func null(req meeseeks.Request) meeseeks.Job {
 	return meeseeks.Job{
 		ID:        0,
@@ -65,7 +104,7 @@ func null(req meeseeks.Request) meeseeks.Job {
 	}
 }
 
-func create(req meeseeks.Request) (meeseeks.Job, error) {
+func create(req meeseeks.Request, status meeseeks.JobStatus) (meeseeks.Job, error) {
 	var job *meeseeks.Job
 	err := db.Update(func(tx *bolt.Tx) error {
 		jobID, bucket, err := db.NextSequenceFor(jobsBucketKey, tx)
@@ -73,30 +112,69 @@ func create(req meeseeks.Request) (meeseeks.Job, error) {
 			return fmt.Errorf("could not get next sequence for %s: %s", string(jobsBucketKey), err)
 		}
 
+		now := time.Now().UTC()
 		job = &meeseeks.Job{
 			ID:        jobID,
+			ULID:      meeseeks.NewJobULID(now),
 			Request:   req,
-			StartTime: time.Now().UTC(),
-			Status:    meeseeks.JobRunningStatus,
+			StartTime: now,
+			Status:    status,
 		}
 		logrus.Debugf("Creating job %#v", job)
 
-		runningJobsBucket, err := tx.CreateBucketIfNotExists(runningJobsBucketKey)
+		ulidsBucket, err := tx.CreateBucketIfNotExists(ulidsBucketKey)
 		if err != nil {
-			return fmt.Errorf("could not create running jobs bucket: %s", err)
+			return fmt.Errorf("could not create ulids bucket: %s", err)
 		}
-		if err = runningJobsBucket.Put(db.IDToBytes(job.ID), []byte(meeseeks.JobRunningStatus)); err != nil {
-			return fmt.Errorf("could not save running job ID %d: %s", jobID, err)
+		if err = ulidsBucket.Put([]byte(job.ULID), db.IDToBytes(jobID)); err != nil {
+			return fmt.Errorf("could not save ulid of job %d: %s", jobID, err)
+		}
+
+		switch status {
+		case meeseeks.JobRunningStatus:
+			if err = markRunning(tx, jobID); err != nil {
+				return err
+			}
+		case meeseeks.JobQueuedStatus:
+			if err = markQueued(tx, jobID); err != nil {
+				return err
+			}
 		}
 
-		return save(*job, bucket)
+		if err = save(*job, bucket); err != nil {
+			return err
+		}
+		return addToIndexes(tx, *job)
 	})
 	if err != nil {
 		return meeseeks.Job{}, fmt.Errorf("failed to create a job %s", err)
 	}
+	metrics.JobStatusChangesCount.WithLabelValues(req.Command, string(status)).Inc()
 	return *job, nil
 }
 
+func markRunning(tx *bolt.Tx, jobID uint64) error {
+	runningJobsBucket, err := tx.CreateBucketIfNotExists(runningJobsBucketKey)
+	if err != nil {
+		return fmt.Errorf("could not create running jobs bucket: %s", err)
+	}
+	if err = runningJobsBucket.Put(db.IDToBytes(jobID), []byte(meeseeks.JobRunningStatus)); err != nil {
+		return fmt.Errorf("could not save running job ID %d: %s", jobID, err)
+	}
+	return nil
+}
+
+func markQueued(tx *bolt.Tx, jobID uint64) error {
+	queuedJobsBucket, err := tx.CreateBucketIfNotExists(queuedJobsBucketKey)
+	if err != nil {
+		return fmt.Errorf("could not create queued jobs bucket: %s", err)
+	}
+	if err = queuedJobsBucket.Put(db.IDToBytes(jobID), []byte(meeseeks.JobQueuedStatus)); err != nil {
+		return fmt.Errorf("could not save queued job ID %d: %s", jobID, err)
+	}
+	return nil
+}
+
 func get(id uint64) (meeseeks.Job, error) {
 	job := &meeseeks.Job{}
 	err := db.View(func(tx *bolt.Tx) error {
@@ -114,37 +192,137 @@ func get(id uint64) (meeseeks.Job, error) {
 	return *job, err
 }
 
-// Finish sets the status of a job to whatever end state if it's current status is running
-//
-// It also sets the end time of the job
-func finish(jobID uint64, status string) error {
-	if !(status == meeseeks.JobSuccessStatus || status == meeseeks.JobFailedStatus) {
-		return fmt.Errorf("invalid status %s", status)
+func getByULID(id string) (meeseeks.Job, error) {
+	var jobID []byte
+	err := db.View(func(tx *bolt.Tx) error {
+		ulidsBucket := tx.Bucket(ulidsBucketKey)
+		if ulidsBucket == nil {
+			return meeseeks.ErrNoJobWithID
+		}
+		if jobID = ulidsBucket.Get([]byte(id)); jobID == nil {
+			return meeseeks.ErrNoJobWithID
+		}
+		jobID = append([]byte{}, jobID...) // Only valid within the transaction
+		return nil
+	})
+	if err != nil {
+		return meeseeks.Job{}, err
 	}
+	return get(db.IDFromBytes(jobID))
+}
+
+// moveTo sets the status of a job if it can move to it from its current one,
+// keeping the running and queued jobs buckets up to date
+func moveTo(jobID uint64, status meeseeks.JobStatus) error {
 	return db.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket(jobsBucketKey)
 		job, err := get(jobID)
 		if err != nil {
 			return fmt.Errorf("could not get job with id %d: %s", jobID, err)
 		}
-		if job.Status != meeseeks.JobRunningStatus {
-			return fmt.Errorf("job is not in running status but %s", job.Status)
-		}
-		runningJobsBucket := tx.Bucket(runningJobsBucketKey)
-		if err = runningJobsBucket.Delete(db.IDToBytes(jobID)); err != nil {
-			return fmt.Errorf("could not remove job %d from running list: %s", jobID, err)
+		previous := job.Status
+		if job, err = job.MoveTo(status); err != nil {
+			return err
 		}
 
-		job.EndTime = time.Now().UTC()
-		job.Status = status
+		if status == meeseeks.JobRunningStatus {
+			if err = markRunning(tx, jobID); err != nil {
+				return err
+			}
+		} else if previous == meeseeks.JobRunningStatus {
+			runningJobsBucket := tx.Bucket(runningJobsBucketKey)
+			if err = runningJobsBucket.Delete(db.IDToBytes(jobID)); err != nil {
+				return fmt.Errorf("could not remove job %d from running list: %s", jobID, err)
+			}
+		}
+		if previous == meeseeks.JobQueuedStatus {
+			if queuedJobsBucket := tx.Bucket(queuedJobsBucketKey); queuedJobsBucket != nil {
+				if err = queuedJobsBucket.Delete(db.IDToBytes(jobID)); err != nil {
+					return fmt.Errorf("could not remove job %d from queued list: %s", jobID, err)
+				}
+			}
+		}
 
-		difference := job.EndTime.Sub(job.StartTime)
-		metrics.TaskDurations.WithLabelValues(job.Request.Command, status).Observe(difference.Seconds())
+		metrics.JobStatusChangesCount.WithLabelValues(job.Request.Command, string(status)).Inc()
+		if status.IsFinished() {
+			difference := job.EndTime.Sub(job.StartTime)
+			metrics.TaskDurations.WithLabelValues(job.Request.Command, string(status)).Observe(difference.Seconds())
+		}
 
 		return save(job, bucket)
 	})
 }
 
+func remove(jobID uint64) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		job, err := get(jobID)
+		if err != nil {
+			return err
+		}
+		if !job.Status.IsFinished() {
+			return fmt.Errorf("job %d is not finished but %s", jobID, job.Status)
+		}
+		if labelsBucket := tx.Bucket(labelsBucketKey); labelsBucket != nil {
+			for name, value := range job.Labels {
+				if index := labelsBucket.Bucket(labelKey(name, value)); index != nil {
+					if err := index.Delete(db.IDToBytes(jobID)); err != nil {
+						return fmt.Errorf("could not remove job %d from label index: %s", jobID, err)
+					}
+				}
+			}
+		}
+		if err = removeFromIndexes(tx, job); err != nil {
+			return err
+		}
+		if ulidsBucket := tx.Bucket(ulidsBucketKey); ulidsBucket != nil && job.ULID != "" {
+			if err = ulidsBucket.Delete([]byte(job.ULID)); err != nil {
+				return fmt.Errorf("could not remove ulid of job %d: %s", jobID, err)
+			}
+		}
+		return tx.Bucket(jobsBucketKey).Delete(db.IDToBytes(jobID))
+	})
+}
+
+func addLabels(jobID uint64, labels map[string]string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		job, err := get(jobID)
+		if err != nil {
+			return err
+		}
+
+		labelsBucket, err := tx.CreateBucketIfNotExists(labelsBucketKey)
+		if err != nil {
+			return fmt.Errorf("could not create labels bucket: %s", err)
+		}
+		if job.Labels == nil {
+			job.Labels = make(map[string]string)
+		}
+		for name, value := range labels {
+			if old, ok := job.Labels[name]; ok {
+				if index := labelsBucket.Bucket(labelKey(name, old)); index != nil {
+					if err = index.Delete(db.IDToBytes(jobID)); err != nil {
+						return fmt.Errorf("could not remove job %d from label index: %s", jobID, err)
+					}
+				}
+			}
+			index, err := labelsBucket.CreateBucketIfNotExists(labelKey(name, value))
+			if err != nil {
+				return fmt.Errorf("could not create index for label %s=%s: %s", name, value, err)
+			}
+			if err = index.Put(db.IDToBytes(jobID), []byte{}); err != nil {
+				return fmt.Errorf("could not index job %d: %s", jobID, err)
+			}
+			job.Labels[name] = value
+		}
+
+		return save(job, tx.Bucket(jobsBucketKey))
+	})
+}
+
+func labelKey(name, value string) []byte {
+	return []byte(name + "=" + value)
+}
+
 func find(filter meeseeks.JobFilter) ([]meeseeks.Job, error) {
 	latest := make([]meeseeks.Job, 0)
 	matcher := func(job meeseeks.Job) bool {
@@ -154,33 +332,124 @@ func find(filter meeseeks.JobFilter) ([]meeseeks.Job, error) {
 		matcher = filter.Match
 	}
 	err := db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(jobsBucketKey)
-		if bucket == nil {
+		jobsBucket := tx.Bucket(jobsBucketKey)
+		if jobsBucket == nil {
 			return nil
 		}
-		cur := bucket.Cursor()
-		_, payload := cur.Last()
-		for len(latest) < filter.Limit {
-			if payload == nil {
-				break
-			}
+		index := indexFor(tx, filter)
+		if index == nil {
+			return nil // No job has the indexed value
+		}
 
+		cur := index.Cursor()
+		jobID, _ := lastBefore(cur, filter.Before)
+		for len(latest) < filter.Limit && jobID != nil {
 			job := meeseeks.Job{}
-			if err := json.Unmarshal(payload, &job); err != nil {
+			if err := json.Unmarshal(jobsBucket.Get(jobID), &job); err != nil {
 				return fmt.Errorf("failed to load Job payload %s", err)
 			}
-			if matcher(job) {
+			if filter.Matches(job) && matcher(job) {
 				latest = append(latest, job)
 			}
-			_, payload = cur.Prev()
+			jobID, _ = cur.Prev()
 		}
 		return nil
 	})
 	return latest, err
 }
 
-func failRunningJobs() error {
-	return db.Update(func(tx *bolt.Tx) error {
+// indexFor returns the bucket with the IDs of the jobs to walk through for
+// the filter, so only the jobs that have one of the filtered values are
+// loaded. Returns nil when no job has it
+func indexFor(tx *bolt.Tx, filter meeseeks.JobFilter) *bolt.Bucket {
+	for name, value := range filter.Labels {
+		labelsBucket := tx.Bucket(labelsBucketKey)
+		if labelsBucket == nil {
+			return nil
+		}
+		return labelsBucket.Bucket(labelKey(name, value))
+	}
+	if filter.Username != "" {
+		if usersBucket := tx.Bucket(usersBucketKey); usersBucket != nil {
+			return usersBucket.Bucket([]byte(filter.Username))
+		}
+	}
+	if filter.ChannelID != "" {
+		if channelsBucket := tx.Bucket(channelsBucketKey); channelsBucket != nil {
+			return channelsBucket.Bucket([]byte(filter.ChannelID))
+		}
+	}
+	// Before the first job is created with indexes the whole bucket is used
+	return tx.Bucket(jobsBucketKey)
+}
+
+// lastBefore moves the cursor to the last job with an ID lower than before, or
+// to the last job when before is 0
+func lastBefore(cur *bolt.Cursor, before uint64) ([]byte, []byte) {
+	if before == 0 {
+		return cur.Last()
+	}
+	k, v := cur.Seek(db.IDToBytes(before))
+	if k == nil {
+		return cur.Last()
+	}
+	for k != nil && db.IDFromBytes(k) >= before {
+		k, v = cur.Prev()
+	}
+	return k, v
+}
+
+// addToIndexes adds the job to the user and channel indexes
+func addToIndexes(tx *bolt.Tx, job meeseeks.Job) error {
+	for _, idx := range []struct {
+		key   []byte
+		value string
+	}{
+		{usersBucketKey, job.Request.Username},
+		{channelsBucketKey, job.Request.ChannelID},
+	} {
+		bucket, err := tx.CreateBucketIfNotExists(idx.key)
+		if err != nil {
+			return fmt.Errorf("could not create %s bucket: %s", idx.key, err)
+		}
+		if idx.value == "" {
+			continue
+		}
+		index, err := bucket.CreateBucketIfNotExists([]byte(idx.value))
+		if err != nil {
+			return fmt.Errorf("could not create %s index for %s: %s", idx.key, idx.value, err)
+		}
+		if err = index.Put(db.IDToBytes(job.ID), []byte{}); err != nil {
+			return fmt.Errorf("could not index job %d: %s", job.ID, err)
+		}
+	}
+	return nil
+}
+
+func removeFromIndexes(tx *bolt.Tx, job meeseeks.Job) error {
+	for _, idx := range []struct {
+		key   []byte
+		value string
+	}{
+		{usersBucketKey, job.Request.Username},
+		{channelsBucketKey, job.Request.ChannelID},
+	} {
+		bucket := tx.Bucket(idx.key)
+		if bucket == nil || idx.value == "" {
+			continue
+		}
+		if index := bucket.Bucket([]byte(idx.value)); index != nil {
+			if err := index.Delete(db.IDToBytes(job.ID)); err != nil {
+				return fmt.Errorf("could not remove job %d from %s index: %s", job.ID, idx.key, err)
+			}
+		}
+	}
+	return nil
+}
+
+func interruptRunningJobs(note string) ([]meeseeks.Job, error) {
+	interrupted := make([]meeseeks.Job, 0)
+	err := db.Update(func(tx *bolt.Tx) error {
 		runningJobsBucket := tx.Bucket(runningJobsBucketKey)
 		if runningJobsBucket == nil {
 			return nil
@@ -198,18 +467,23 @@ func failRunningJobs() error {
 				break
 			}
 			jobID := db.IDFromBytes(jobIDKey)
-			logrus.Warnf("Found job %d in running state, marking as killed", jobID)
+			logrus.Warnf("Found job %d in running state, marking as interrupted", jobID)
 
 			j := meeseeks.Job{}
 			if err := json.Unmarshal(jobsBucket.Get(jobIDKey), &j); err != nil {
 				return fmt.Errorf("could not read job %d from bucket: %s", jobID, err)
 			}
 
-			j.Status = meeseeks.JobKilledStatus
-			j.EndTime = time.Now().UTC()
+			j, err := j.MoveTo(meeseeks.JobInterruptedStatus)
+			if err != nil {
+				return err
+			}
+			j.Note = note
+			metrics.JobStatusChangesCount.WithLabelValues(j.Request.Command, string(j.Status)).Inc()
 			if err := save(j, jobsBucket); err != nil {
-				return fmt.Errorf("could not save killed job %d: %s", jobID, err)
+				return fmt.Errorf("could not save interrupted job %d: %s", jobID, err)
 			}
+			interrupted = append(interrupted, j)
 
 			if err := runningJobsBucket.Delete(jobIDKey); err != nil {
 				return fmt.Errorf("could not delete running job %d: %s", jobID, err)
@@ -219,6 +493,57 @@ func failRunningJobs() error {
 		}
 		return nil
 	})
+	return interrupted, err
+}
+
+func queuedJobs() ([]meeseeks.Job, error) {
+	queued := make([]meeseeks.Job, 0)
+	err := db.View(func(tx *bolt.Tx) error {
+		queuedJobsBucket := tx.Bucket(queuedJobsBucketKey)
+		jobsBucket := tx.Bucket(jobsBucketKey)
+		if queuedJobsBucket == nil || jobsBucket == nil {
+			return nil
+		}
+		return queuedJobsBucket.ForEach(func(jobIDKey, _ []byte) error {
+			j := meeseeks.Job{}
+			if err := json.Unmarshal(jobsBucket.Get(jobIDKey), &j); err != nil {
+				return fmt.Errorf("could not read job %d from bucket: %s", db.IDFromBytes(jobIDKey), err)
+			}
+			queued = append(queued, j)
+			return nil
+		})
+	})
+	return queued, err
+}
+
+func failQueuedJobs(note string) ([]meeseeks.Job, error) {
+	queued, err := queuedJobs()
+	if err != nil {
+		return nil, err
+	}
+	failed := make([]meeseeks.Job, 0, len(queued))
+	err = db.Update(func(tx *bolt.Tx) error {
+		jobsBucket := tx.Bucket(jobsBucketKey)
+		queuedJobsBucket := tx.Bucket(queuedJobsBucketKey)
+		for _, j := range queued {
+			logrus.Warnf("Found job %d in queued state, marking as failed", j.ID)
+			j, err := j.MoveTo(meeseeks.JobFailedStatus)
+			if err != nil {
+				return err
+			}
+			j.Note = note
+			metrics.JobStatusChangesCount.WithLabelValues(j.Request.Command, string(j.Status)).Inc()
+			if err := save(j, jobsBucket); err != nil {
+				return fmt.Errorf("could not save failed job %d: %s", j.ID, err)
+			}
+			if err := queuedJobsBucket.Delete(db.IDToBytes(j.ID)); err != nil {
+				return fmt.Errorf("could not delete queued job %d: %s", j.ID, err)
+			}
+			failed = append(failed, j)
+		}
+		return nil
+	})
+	return failed, err
 }
 
 func save(job meeseeks.Job, bucket *bolt.Bucket) error {
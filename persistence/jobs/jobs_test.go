@@ -1,11 +1,15 @@
 package jobs_test
 
 import (
+	"encoding/json"
 	"testing"
 
 	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
 	"gitlab.com/yakshaving.art/meeseeks-box/mocks"
 	"gitlab.com/yakshaving.art/meeseeks-box/persistence"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/db"
+
+	bolt "github.com/coreos/bbolt"
 )
 
 var req = meeseeks.Request{
@@ -46,18 +50,33 @@ func Test_CreatingAndThenGettingAJob(t *testing.T) {
 	}))
 }
 
+func TestGettingAJobByULID(t *testing.T) {
+	mocks.Must(t, "failed to run tests", mocks.WithTmpDB(func(_ string) {
+		expected, err := persistence.Jobs().Create(req)
+		mocks.Must(t, "Could not store a job: ", err)
+		mocks.AssertEquals(t, true, meeseeks.IsJobULID(expected.ULID))
+
+		actual, err := persistence.Jobs().GetByULID(expected.ULID)
+		mocks.Must(t, "Could not retrieve a job by ULID: ", err)
+		mocks.AssertEquals(t, expected, actual)
+
+		_, err = persistence.Jobs().GetByULID(meeseeks.NewJobULID(expected.StartTime))
+		mocks.AssertEquals(t, meeseeks.ErrNoJobWithID, err)
+	}))
+}
+
 func Test_MarkSuccessFul(t *testing.T) {
 	mocks.Must(t, "failed to run tests", mocks.WithTmpDB(func(_ string) {
 		job, err := persistence.Jobs().Create(req)
 		mocks.Must(t, "Could not store a job: ", err)
 
-		err = persistence.Jobs().Succeed(job.ID)
+		err = persistence.Jobs().Finish(job.ID, meeseeks.JobSucceededStatus)
 		mocks.Must(t, "could not set as successful", err)
 
 		actual, err := persistence.Jobs().Get(job.ID)
 		mocks.Must(t, "Could not retrieve a job: ", err)
 
-		mocks.AssertEquals(t, actual.Status, meeseeks.JobSuccessStatus)
+		mocks.AssertEquals(t, actual.Status, meeseeks.JobSucceededStatus)
 		if !actual.EndTime.After(job.StartTime) {
 			t.Fatal("End time should be after start time")
 		}
@@ -73,7 +92,7 @@ func Test_MarkFailedWorks(t *testing.T) {
 
 		mocks.AssertEquals(t, running.Status, meeseeks.JobRunningStatus)
 
-		err = persistence.Jobs().Fail(job.ID)
+		err = persistence.Jobs().Finish(job.ID, meeseeks.JobFailedStatus)
 		mocks.Must(t, "could not set as successful", err)
 
 		actual, err := persistence.Jobs().Get(job.ID)
@@ -116,13 +135,285 @@ func Test_FilterReturnsEnough(t *testing.T) {
 	}))
 }
 
-func TestFailRunningJobsLeavesNoJobRunning(t *testing.T) {
+func TestFilterPagesWithBefore(t *testing.T) {
+	mocks.Must(t, "failed to run tests", mocks.WithTmpDB(func(_ string) {
+		for i := 0; i < 5; i++ {
+			persistence.Jobs().Create(req)
+		}
+
+		page, err := persistence.Jobs().Find(meeseeks.JobFilter{Limit: 2, Before: 4})
+		mocks.Must(t, "Failed to get a page of jobs", err)
+		mocks.AssertEquals(t, 2, len(page))
+		mocks.AssertEquals(t, uint64(3), page[0].ID)
+		mocks.AssertEquals(t, uint64(2), page[1].ID)
+
+		page, err = persistence.Jobs().Find(meeseeks.JobFilter{Limit: 2, Before: 2})
+		mocks.Must(t, "Failed to get a page of jobs", err)
+		mocks.AssertEquals(t, 1, len(page))
+		mocks.AssertEquals(t, uint64(1), page[0].ID)
+
+		page, err = persistence.Jobs().Find(meeseeks.JobFilter{Limit: 2, Before: 10})
+		mocks.Must(t, "Failed to get a page of jobs", err)
+		mocks.AssertEquals(t, 2, len(page))
+		mocks.AssertEquals(t, uint64(5), page[0].ID)
+	}))
+}
+
+func TestFilterByUserAndChannel(t *testing.T) {
+	mocks.Must(t, "failed to run tests", mocks.WithTmpDB(func(_ string) {
+		persistence.Jobs().Create(meeseeks.Request{Command: "c", Username: "someone", ChannelID: "general"})
+		persistence.Jobs().Create(meeseeks.Request{Command: "c", Username: "other", ChannelID: "general"})
+		persistence.Jobs().Create(meeseeks.Request{Command: "c", Username: "someone", ChannelID: "random"})
+
+		tt := []struct {
+			name     string
+			filter   meeseeks.JobFilter
+			expected []uint64
+		}{
+			{
+				name:     "by user",
+				filter:   meeseeks.JobFilter{Limit: 5, Username: "someone"},
+				expected: []uint64{3, 1},
+			},
+			{
+				name:     "by channel",
+				filter:   meeseeks.JobFilter{Limit: 5, ChannelID: "general"},
+				expected: []uint64{2, 1},
+			},
+			{
+				name:     "by user and channel",
+				filter:   meeseeks.JobFilter{Limit: 5, Username: "someone", ChannelID: "general"},
+				expected: []uint64{1},
+			},
+			{
+				name:     "by user with a cursor",
+				filter:   meeseeks.JobFilter{Limit: 5, Username: "someone", Before: 3},
+				expected: []uint64{1},
+			},
+			{
+				name:     "by unknown user",
+				filter:   meeseeks.JobFilter{Limit: 5, Username: "nobody"},
+				expected: []uint64{},
+			},
+		}
+		for _, tc := range tt {
+			t.Run(tc.name, func(t *testing.T) {
+				found, err := persistence.Jobs().Find(tc.filter)
+				mocks.Must(t, "Failed to find jobs", err)
+				ids := make([]uint64, 0)
+				for _, j := range found {
+					ids = append(ids, j.ID)
+				}
+				mocks.AssertEquals(t, tc.expected, ids)
+			})
+		}
+	}))
+}
+
+func TestJobsCreatedBeforeTheIndexesAreFound(t *testing.T) {
+	mocks.Must(t, "failed to run tests", mocks.WithTmpDB(func(_ string) {
+		persistence.Jobs().Create(req)
+		persistence.Jobs().Create(req)
+		mocks.Must(t, "could not drop indexes", db.Update(func(tx *bolt.Tx) error {
+			if err := tx.DeleteBucket([]byte("job-users")); err != nil {
+				return err
+			}
+			if err := tx.DeleteBucket([]byte("job-channels")); err != nil {
+				return err
+			}
+			return tx.DeleteBucket([]byte("meta"))
+		}))
+
+		found, err := persistence.Jobs().Find(meeseeks.JobFilter{Limit: 5, Username: req.Username})
+		mocks.Must(t, "Failed to find jobs", err)
+		mocks.AssertEquals(t, 2, len(found))
+
+		mocks.Must(t, "could not migrate", db.Migrate())
+		persistence.Jobs().Create(req)
+		found, err = persistence.Jobs().Find(meeseeks.JobFilter{Limit: 5, Username: req.Username})
+		mocks.Must(t, "Failed to find jobs", err)
+		mocks.AssertEquals(t, 3, len(found))
+	}))
+}
+
+func TestMigratingLegacyJobs(t *testing.T) {
+	mocks.Must(t, "failed to run tests", mocks.WithTmpDB(func(_ string) {
+		version, err := db.Version()
+		mocks.Must(t, "could not get the database version", err)
+		mocks.AssertEquals(t, 4, version)
+
+		mocks.Must(t, "could not store legacy job", db.Update(func(tx *bolt.Tx) error {
+			bucket, err := tx.CreateBucketIfNotExists([]byte("jobs"))
+			if err != nil {
+				return err
+			}
+			if err = bucket.Put(db.IDToBytes(1), []byte(`{"ID":1,"Status":"Successful","StartTime":"2018-01-01T00:00:00Z"}`)); err != nil {
+				return err
+			}
+			return tx.DeleteBucket([]byte("meta"))
+		}))
+		mocks.Must(t, "could not migrate", db.Migrate())
+
+		job, err := persistence.Jobs().Get(1)
+		mocks.Must(t, "could not get job", err)
+		mocks.AssertEquals(t, meeseeks.JobSucceededStatus, job.Status)
+		mocks.AssertEquals(t, true, meeseeks.IsJobULID(job.ULID))
+
+		byULID, err := persistence.Jobs().GetByULID(job.ULID)
+		mocks.Must(t, "could not get job by ULID", err)
+		mocks.AssertEquals(t, job, byULID)
+
+		mocks.Must(t, "could not read stored job", db.View(func(tx *bolt.Tx) error {
+			mocks.AssertMatches(t, `"Status":"Succeeded"`, string(tx.Bucket([]byte("jobs")).Get(db.IDToBytes(1))))
+			return nil
+		}))
+	}))
+}
+
+func TestFilterByLabels(t *testing.T) {
 	mocks.Must(t, "failed to run tests", mocks.WithTmpDB(func(_ string) {
+		prod, err := persistence.Jobs().Create(req)
+		mocks.Must(t, "Could not store a job: ", err)
+		staging, err := persistence.Jobs().Create(req)
+		mocks.Must(t, "Could not store a job: ", err)
 		persistence.Jobs().Create(req)
+
+		mocks.Must(t, "could not label job", persistence.Jobs().AddLabels(prod.ID,
+			map[string]string{"env": "prod", "service": "billing"}))
+		mocks.Must(t, "could not label job", persistence.Jobs().AddLabels(staging.ID,
+			map[string]string{"env": "prod", "service": "billing"}))
+		mocks.Must(t, "could not relabel job", persistence.Jobs().AddLabels(staging.ID,
+			map[string]string{"env": "staging"}))
+
+		actual, err := persistence.Jobs().Get(staging.ID)
+		mocks.Must(t, "Could not retrieve a job: ", err)
+		mocks.AssertEquals(t, map[string]string{"env": "staging", "service": "billing"}, actual.Labels)
+
+		found, err := persistence.Jobs().Find(meeseeks.JobFilter{
+			Limit:  5,
+			Labels: map[string]string{"service": "billing"},
+		})
+		mocks.Must(t, "Failed to find jobs by label", err)
+		mocks.AssertEquals(t, 2, len(found))
+		mocks.AssertEquals(t, staging.ID, found[0].ID)
+		mocks.AssertEquals(t, prod.ID, found[1].ID)
+
+		found, err = persistence.Jobs().Find(meeseeks.JobFilter{
+			Limit:  5,
+			Labels: map[string]string{"env": "prod", "service": "billing"},
+		})
+		mocks.Must(t, "Failed to find jobs by label", err)
+		mocks.AssertEquals(t, 1, len(found))
+		mocks.AssertEquals(t, prod.ID, found[0].ID)
+
+		found, err = persistence.Jobs().Find(meeseeks.JobFilter{
+			Limit:  5,
+			Labels: map[string]string{"env": "dev"},
+		})
+		mocks.Must(t, "Failed to find jobs by label", err)
+		mocks.AssertEquals(t, 0, len(found))
+	}))
+}
+
+func TestQueuedJobsLifecycle(t *testing.T) {
+	mocks.Must(t, "failed to run tests", mocks.WithTmpDB(func(_ string) {
+		job, err := persistence.Jobs().Queue(req)
+		mocks.Must(t, "Could not queue a job: ", err)
+		mocks.AssertEquals(t, meeseeks.JobQueuedStatus, job.Status)
+
+		mocks.AssertEquals(t, "invalid status Running",
+			persistence.Jobs().Finish(job.ID, meeseeks.JobRunningStatus).Error())
+		mocks.AssertEquals(t, "job 1 can't go from Queued to Succeeded",
+			persistence.Jobs().Finish(job.ID, meeseeks.JobSucceededStatus).Error())
+		mocks.AssertEquals(t, "job 1 is not finished but Queued",
+			persistence.Jobs().(meeseeks.JobRemover).Remove(job.ID).Error())
+
+		mocks.Must(t, "Could not start the job: ", persistence.Jobs().Start(job.ID))
+		mocks.Must(t, "Could not time the job out: ",
+			persistence.Jobs().Finish(job.ID, meeseeks.JobTimedOutStatus))
+		mocks.AssertEquals(t, "job 1 can't go from TimedOut to Running",
+			persistence.Jobs().Start(job.ID).Error())
+
+		actual, err := persistence.Jobs().Get(job.ID)
+		mocks.Must(t, "Could not retrieve the job: ", err)
+		mocks.AssertEquals(t, meeseeks.JobTimedOutStatus, actual.Status)
+		mocks.AssertEquals(t, false, actual.EndTime.IsZero())
+	}))
+}
+
+func TestQueuedJobsAreListedUntilTheyMove(t *testing.T) {
+	mocks.Must(t, "failed to run tests", mocks.WithTmpDB(func(_ string) {
+		first, err := persistence.Jobs().Queue(req)
+		mocks.Must(t, "Could not queue a job: ", err)
+		second, err := persistence.Jobs().Queue(req)
+		mocks.Must(t, "Could not queue a job: ", err)
+		third, err := persistence.Jobs().Queue(req)
+		mocks.Must(t, "Could not queue a job: ", err)
+		_, err = persistence.Jobs().Create(req)
+		mocks.Must(t, "Could not create a job: ", err)
+
+		mocks.Must(t, "Could not start the job: ", persistence.Jobs().Start(second.ID))
+
+		queued, err := persistence.Jobs().QueuedJobs()
+		mocks.Must(t, "Could not list queued jobs: ", err)
+		mocks.AssertEquals(t, 2, len(queued))
+		mocks.AssertEquals(t, first.ID, queued[0].ID)
+		mocks.AssertEquals(t, third.ID, queued[1].ID)
+
+		failed, err := persistence.Jobs().FailQueuedJobs("restarted")
+		mocks.Must(t, "Could not fail queued jobs: ", err)
+		mocks.AssertEquals(t, 2, len(failed))
+
+		actual, err := persistence.Jobs().Get(third.ID)
+		mocks.Must(t, "Could not retrieve the job: ", err)
+		mocks.AssertEquals(t, meeseeks.JobFailedStatus, actual.Status)
+		mocks.AssertEquals(t, "restarted", actual.Note)
+
+		queued, err = persistence.Jobs().QueuedJobs()
+		mocks.Must(t, "Could not list queued jobs: ", err)
+		mocks.AssertEquals(t, 0, len(queued))
+	}))
+}
+
+func TestParsingJobStatus(t *testing.T) {
+	tt := []struct {
+		name     string
+		expected meeseeks.JobStatus
+	}{
+		{name: "queued", expected: meeseeks.JobQueuedStatus},
+		{name: "Running", expected: meeseeks.JobRunningStatus},
+		{name: "timedout", expected: meeseeks.JobTimedOutStatus},
+		{name: "successful", expected: meeseeks.JobSucceededStatus},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			status, err := meeseeks.ParseJobStatus(tc.name)
+			mocks.Must(t, "could not parse status", err)
+			mocks.AssertEquals(t, tc.expected, status)
+		})
+	}
+	_, err := meeseeks.ParseJobStatus("done")
+	mocks.AssertEquals(t, "invalid job status done", err.Error())
+}
+
+func TestJobsStoredAsSuccessfulAreSucceeded(t *testing.T) {
+	job := meeseeks.Job{}
+	mocks.Must(t, "could not read legacy job",
+		json.Unmarshal([]byte(`{"ID":1,"Status":"Successful"}`), &job))
+	mocks.AssertEquals(t, meeseeks.JobSucceededStatus, job.Status)
+}
+
+func TestInterruptRunningJobsLeavesNoJobRunning(t *testing.T) {
+	mocks.Must(t, "failed to run tests", mocks.WithTmpDB(func(_ string) {
 		persistence.Jobs().Create(req)
 		persistence.Jobs().Create(req)
+		persistence.Jobs().Create(req)
+		queued, err := persistence.Jobs().Queue(req)
+		mocks.Must(t, "queue job", err)
 
-		mocks.Must(t, "Fail running jobs", persistence.Jobs().FailRunningJobs())
+		interrupted, err := persistence.Jobs().InterruptRunningJobs("restarted")
+		mocks.Must(t, "Interrupt running jobs", err)
+		mocks.AssertEquals(t, 3, len(interrupted))
 
 		running, err := persistence.Jobs().Find(meeseeks.JobFilter{
 			Limit: 5,
@@ -133,14 +424,18 @@ func TestFailRunningJobsLeavesNoJobRunning(t *testing.T) {
 		mocks.Must(t, "get running jobs", err)
 		mocks.AssertEquals(t, 0, len(running))
 
-		killed, err := persistence.Jobs().Find(meeseeks.JobFilter{
+		found, err := persistence.Jobs().Find(meeseeks.JobFilter{
 			Limit: 5,
 			Match: func(j meeseeks.Job) bool {
-				return j.Status == meeseeks.JobKilledStatus
+				return j.Status == meeseeks.JobInterruptedStatus && j.Note == "restarted"
 			},
 		})
-		mocks.Must(t, "get killed jobs", err)
-		mocks.AssertEquals(t, 3, len(killed))
+		mocks.Must(t, "get interrupted jobs", err)
+		mocks.AssertEquals(t, 3, len(found))
+
+		job, err := persistence.Jobs().Get(queued.ID)
+		mocks.Must(t, "get queued job", err)
+		mocks.AssertEquals(t, meeseeks.JobQueuedStatus, job.Status)
 	}))
 }
 
@@ -0,0 +1,132 @@
+package jobs
+
+import (
+	"encoding/json"
+	"fmt"
+
+	bolt "github.com/coreos/bbolt"
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/db"
+)
+
+func init() {
+	db.RegisterMigration(db.Migration{
+		Version: 1,
+		Name:    "index jobs by user and channel",
+		Apply:   indexExistingJobs,
+	})
+	db.RegisterMigration(db.Migration{
+		Version: 2,
+		Name:    "give a ULID to the jobs that have none",
+		Apply:   addMissingULIDs,
+	})
+	db.RegisterMigration(db.Migration{
+		Version: 3,
+		Name:    "store successful jobs as succeeded",
+		Apply:   renameSuccessfulStatus,
+	})
+	db.RegisterMigration(db.Migration{
+		Version: 4,
+		Name:    "list the queued jobs",
+		Apply:   listQueuedJobs,
+	})
+}
+
+// storedJob is a job as it is in the bucket, along with its raw payload
+type storedJob struct {
+	job     meeseeks.Job
+	payload []byte
+}
+
+// allJobs loads every stored job, the bucket can't be changed while it's
+// walked so migrations load them first
+func allJobs(tx *bolt.Tx) ([]storedJob, error) {
+	jobs := make([]storedJob, 0)
+	jobsBucket := tx.Bucket(jobsBucketKey)
+	if jobsBucket == nil {
+		return jobs, nil
+	}
+	err := jobsBucket.ForEach(func(_, payload []byte) error {
+		j := meeseeks.Job{}
+		if err := json.Unmarshal(payload, &j); err != nil {
+			return fmt.Errorf("failed to load Job payload %s", err)
+		}
+		jobs = append(jobs, storedJob{job: j, payload: append([]byte{}, payload...)})
+		return nil
+	})
+	return jobs, err
+}
+
+func indexExistingJobs(tx *bolt.Tx) error {
+	jobs, err := allJobs(tx)
+	if err != nil {
+		return err
+	}
+	for _, j := range jobs {
+		if err := addToIndexes(tx, j.job); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addMissingULIDs(tx *bolt.Tx) error {
+	jobs, err := allJobs(tx)
+	if err != nil {
+		return err
+	}
+	for _, j := range jobs {
+		if j.job.ULID != "" {
+			continue
+		}
+		j.job.ULID = meeseeks.NewJobULID(j.job.StartTime)
+
+		ulidsBucket, err := tx.CreateBucketIfNotExists(ulidsBucketKey)
+		if err != nil {
+			return fmt.Errorf("could not create ulids bucket: %s", err)
+		}
+		if err = ulidsBucket.Put([]byte(j.job.ULID), db.IDToBytes(j.job.ID)); err != nil {
+			return fmt.Errorf("could not save ulid of job %d: %s", j.job.ID, err)
+		}
+		if err = save(j.job, tx.Bucket(jobsBucketKey)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func renameSuccessfulStatus(tx *bolt.Tx) error {
+	jobs, err := allJobs(tx)
+	if err != nil {
+		return err
+	}
+	for _, j := range jobs {
+		stored := struct{ Status string }{}
+		if err := json.Unmarshal(j.payload, &stored); err != nil {
+			return fmt.Errorf("failed to load Job payload %s", err)
+		}
+		if stored.Status == string(j.job.Status) {
+			continue
+		}
+		if err := save(j.job, tx.Bucket(jobsBucketKey)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func listQueuedJobs(tx *bolt.Tx) error {
+	jobs, err := allJobs(tx)
+	if err != nil {
+		return err
+	}
+	for _, j := range jobs {
+		if j.job.Status != meeseeks.JobQueuedStatus {
+			continue
+		}
+		if err := markQueued(tx, j.job.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package locks
+
+import (
+	"fmt"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/db"
+
+	bolt "github.com/coreos/bbolt"
+)
+
+var locksBucketKey = []byte("locks")
+
+// Locks provides locks stored in the local database, as BoltDB can only be
+// opened by one process they are only shared by a single replica
+type Locks struct{}
+
+// Lock implements meeseeks.Locker.Lock, expired locks are dropped as new ones
+// are taken
+func (Locks) Lock(key string, ttl time.Duration) (bool, error) {
+	locked := false
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(locksBucketKey)
+		if err != nil {
+			return fmt.Errorf("could not get locks bucket: %s", err)
+		}
+
+		now := time.Now().UTC()
+		expired := make([][]byte, 0)
+		if err = bucket.ForEach(func(k, v []byte) error {
+			if time.Unix(0, int64(db.IDFromBytes(v))).Before(now) {
+				expired = append(expired, append([]byte{}, k...))
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err = bucket.Delete(k); err != nil {
+				return fmt.Errorf("could not drop expired lock %s: %s", k, err)
+			}
+		}
+
+		if bucket.Get([]byte(key)) != nil {
+			return nil
+		}
+		locked = true
+		return bucket.Put([]byte(key), db.IDToBytes(uint64(now.Add(ttl).UnixNano())))
+	})
+	if err != nil {
+		return false, fmt.Errorf("could not take lock %s: %s", key, err)
+	}
+	return locked, nil
+}
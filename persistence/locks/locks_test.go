@@ -0,0 +1,32 @@
+package locks_test
+
+import (
+	"testing"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/mocks"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence"
+)
+
+func TestLocksAreTakenOnceUntilTheyExpire(t *testing.T) {
+	mocks.Must(t, "failed to lock", mocks.WithTmpDB(func(_ string) {
+		locker := persistence.Locker()
+
+		locked, err := locker.Lock("request:general:1", 50*time.Millisecond)
+		mocks.Must(t, "could not take lock", err)
+		mocks.AssertEquals(t, true, locked)
+
+		locked, err = locker.Lock("request:general:1", 50*time.Millisecond)
+		mocks.Must(t, "could not take lock", err)
+		mocks.AssertEquals(t, false, locked)
+
+		locked, err = locker.Lock("request:general:2", 50*time.Millisecond)
+		mocks.Must(t, "could not take lock", err)
+		mocks.AssertEquals(t, true, locked)
+
+		time.Sleep(100 * time.Millisecond)
+		locked, err = locker.Lock("request:general:1", 50*time.Millisecond)
+		mocks.Must(t, "could not take lock", err)
+		mocks.AssertEquals(t, true, locked)
+	}))
+}
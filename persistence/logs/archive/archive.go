@@ -0,0 +1,239 @@
+package archive
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"text/template"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultKeyLayout is the template used to build the object key of a job log
+// when none is configured
+const DefaultKeyLayout = "jobs/{{ .Year }}/{{ .Month }}/{{ .Day }}/{{ .JobID }}.json"
+
+// ErrNotArchived is returned by a store when there is no object for a key
+var ErrNotArchived = errors.New("not archived")
+
+// Store is where archived logs are kept
+type Store interface {
+	Put(key string, content []byte) error
+	Get(key string) ([]byte, error)
+}
+
+// KeyData is what is available to the key layout template
+type KeyData struct {
+	JobID    uint64
+	Command  string
+	Username string
+	Year     string
+	Month    string
+	Day      string
+}
+
+// Archiver ships the logs of finished jobs to a store and reads them back
+// when they are not available locally anymore
+type Archiver struct {
+	store  Store
+	layout *template.Template
+	jobs   meeseeks.Jobs
+	reader meeseeks.LogReader
+	writer meeseeks.LogWriter
+}
+
+// New creates a new archiver on top of the local jobs and logs
+func New(store Store, keyLayout string, jobs meeseeks.Jobs, reader meeseeks.LogReader, writer meeseeks.LogWriter) (*Archiver, error) {
+	if keyLayout == "" {
+		keyLayout = DefaultKeyLayout
+	}
+	layout, err := template.New("key").Option("missingkey=error").Parse(keyLayout)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse key layout %s: %s", keyLayout, err)
+	}
+
+	return &Archiver{
+		store:  store,
+		layout: layout,
+		jobs:   Unwrap(jobs),
+		reader: UnwrapReader(reader),
+		writer: writer,
+	}, nil
+}
+
+// Key returns the object key in which the job logs are archived
+func (a *Archiver) Key(job meeseeks.Job) (string, error) {
+	b := bytes.NewBufferString("")
+	err := a.layout.Execute(b, KeyData{
+		JobID:    job.ID,
+		Command:  job.Request.Command,
+		Username: job.Request.Username,
+		Year:     job.StartTime.Format("2006"),
+		Month:    job.StartTime.Format("01"),
+		Day:      job.StartTime.Format("02"),
+	})
+	if err != nil {
+		return "", fmt.Errorf("could not build key for job %d: %s", job.ID, err)
+	}
+	return b.String(), nil
+}
+
+// Archive uploads the logs of a job to the store and then drops them locally
+// if the log writer allows it
+func (a *Archiver) Archive(job meeseeks.Job) error {
+	jobLog, err := a.reader.Get(job.ID)
+	if err == meeseeks.ErrNoLogsForJob {
+		return nil // Nothing to archive
+	}
+	if err != nil {
+		return fmt.Errorf("could not read logs for job %d: %s", job.ID, err)
+	}
+
+	key, err := a.Key(job)
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(jobLog)
+	if err != nil {
+		return fmt.Errorf("could not marshal logs for job %d: %s", job.ID, err)
+	}
+	if err = a.store.Put(key, content); err != nil {
+		return fmt.Errorf("could not archive logs for job %d: %s", job.ID, err)
+	}
+	logrus.Debugf("Archived logs for job %d in %s", job.ID, key)
+
+	if remover, ok := a.writer.(meeseeks.LogRemover); ok {
+		if err = remover.Remove(job.ID); err != nil {
+			return fmt.Errorf("could not remove archived logs for job %d: %s", job.ID, err)
+		}
+	}
+	return nil
+}
+
+func (a *Archiver) fetch(jobID uint64) (meeseeks.JobLog, error) {
+	jobLog := meeseeks.JobLog{}
+
+	job, err := a.jobs.Get(jobID)
+	if err != nil {
+		return jobLog, meeseeks.ErrNoLogsForJob
+	}
+	key, err := a.Key(job)
+	if err != nil {
+		return jobLog, err
+	}
+
+	content, err := a.store.Get(key)
+	if err == ErrNotArchived {
+		return jobLog, meeseeks.ErrNoLogsForJob
+	}
+	if err != nil {
+		return jobLog, fmt.Errorf("could not fetch archived logs for job %d: %s", jobID, err)
+	}
+
+	err = json.Unmarshal(content, &jobLog)
+	return jobLog, err
+}
+
+// Jobs returns the jobs service that archives the logs of the jobs when they
+// are finished
+func (a *Archiver) Jobs() meeseeks.Jobs {
+	return archivingJobs{Jobs: a.jobs, archiver: a}
+}
+
+type archivingJobs struct {
+	meeseeks.Jobs
+	archiver *Archiver
+}
+
+// Finish implements Jobs.Finish
+func (j archivingJobs) Finish(jobID uint64, status meeseeks.JobStatus) error {
+	if err := j.Jobs.Finish(jobID, status); err != nil {
+		return err
+	}
+	go j.archive(jobID)
+	return nil
+}
+
+func (j archivingJobs) archive(jobID uint64) {
+	job, err := j.Jobs.Get(jobID)
+	if err != nil {
+		logrus.Errorf("Could not get job %d to archive its logs: %s", jobID, err)
+		return
+	}
+	if err = j.archiver.Archive(job); err != nil {
+		logrus.Errorf("Failed to archive logs: %s", err)
+	}
+}
+
+// LogReader returns a log reader that falls back to the store when the logs
+// are not available locally
+func (a *Archiver) LogReader() meeseeks.LogReader {
+	return archiveReader{LogReader: a.reader, archiver: a}
+}
+
+type archiveReader struct {
+	meeseeks.LogReader
+	archiver *Archiver
+}
+
+// Get implements LogReader.Get
+func (r archiveReader) Get(jobID uint64) (meeseeks.JobLog, error) {
+	jobLog, err := r.LogReader.Get(jobID)
+	if err != meeseeks.ErrNoLogsForJob {
+		return jobLog, err
+	}
+	return r.archiver.fetch(jobID)
+}
+
+// Head implements LogReader.Head
+func (r archiveReader) Head(jobID uint64, limit int) (meeseeks.JobLog, error) {
+	jobLog, err := r.LogReader.Head(jobID, limit)
+	if err != meeseeks.ErrNoLogsForJob {
+		return jobLog, err
+	}
+	jobLog, err = r.archiver.fetch(jobID)
+	if err != nil {
+		return jobLog, err
+	}
+	if lines := jobLog.GetLines(); len(lines) > limit {
+		jobLog.SetLines(lines[:limit])
+	}
+	return jobLog, nil
+}
+
+// Tail implements LogReader.Tail
+func (r archiveReader) Tail(jobID uint64, limit int) (meeseeks.JobLog, error) {
+	jobLog, err := r.LogReader.Tail(jobID, limit)
+	if err != meeseeks.ErrNoLogsForJob {
+		return jobLog, err
+	}
+	jobLog, err = r.archiver.fetch(jobID)
+	if err != nil {
+		return jobLog, err
+	}
+	if lines := jobLog.GetLines(); len(lines) > limit {
+		jobLog.SetLines(lines[len(lines)-limit:])
+	}
+	return jobLog, nil
+}
+
+// Unwrap returns the jobs service an archiver was built on, or the same
+// service if it does not archive logs
+func Unwrap(jobs meeseeks.Jobs) meeseeks.Jobs {
+	if j, ok := jobs.(archivingJobs); ok {
+		return j.Jobs
+	}
+	return jobs
+}
+
+// UnwrapReader returns the log reader an archiver was built on, or the same
+// reader if it does not read archived logs
+func UnwrapReader(reader meeseeks.LogReader) meeseeks.LogReader {
+	if r, ok := reader.(archiveReader); ok {
+		return r.LogReader
+	}
+	return reader
+}
@@ -0,0 +1,120 @@
+package archive_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+	"gitlab.com/yakshaving.art/meeseeks-box/mocks"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/logs/archive"
+)
+
+type memoryStore map[string][]byte
+
+func (m memoryStore) Put(key string, content []byte) error {
+	m[key] = content
+	return nil
+}
+
+func (m memoryStore) Get(key string) ([]byte, error) {
+	content, ok := m[key]
+	if !ok {
+		return nil, archive.ErrNotArchived
+	}
+	return content, nil
+}
+
+func newArchiver(t *testing.T, store archive.Store, layout string) *archive.Archiver {
+	a, err := archive.New(store, layout, persistence.Jobs(), persistence.LogReader(), persistence.LogWriter())
+	mocks.Must(t, "could not create archiver", err)
+	return a
+}
+
+func TestKeyLayout(t *testing.T) {
+	job := meeseeks.Job{
+		ID:        42,
+		Request:   meeseeks.Request{Command: "echo", Username: "someone"},
+		StartTime: time.Date(2018, time.March, 7, 10, 0, 0, 0, time.UTC),
+	}
+
+	tt := []struct {
+		name     string
+		layout   string
+		expected string
+	}{
+		{"default", "", "jobs/2018/03/07/42.json"},
+		{"custom", "{{ .Username }}/{{ .Command }}-{{ .JobID }}", "someone/echo-42"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			key, err := newArchiver(t, memoryStore{}, tc.layout).Key(job)
+			mocks.Must(t, "could not build key", err)
+			mocks.AssertEquals(t, tc.expected, key)
+		})
+	}
+}
+
+func TestInvalidKeyLayout(t *testing.T) {
+	_, err := archive.New(memoryStore{}, "{{ .JobID", nil, nil, nil)
+	if err == nil {
+		t.Fatal("an invalid key layout should fail")
+	}
+}
+
+func TestArchivedLogsAreReadTransparently(t *testing.T) {
+	mocks.Must(t, "failed to archive logs", mocks.WithTmpDB(func(_ string) {
+		store := memoryStore{}
+		a := newArchiver(t, store, "")
+
+		job, err := persistence.Jobs().Create(meeseeks.Request{Command: "echo"})
+		mocks.Must(t, "could not create job", err)
+		for _, line := range []string{"line1", "line2", "line3"} {
+			mocks.Must(t, "could not append line", persistence.LogWriter().Append(job.ID, line))
+		}
+		mocks.Must(t, "could not set error", persistence.LogWriter().SetError(job.ID, errors.New("failed")))
+
+		mocks.Must(t, "could not archive logs", a.Archive(job))
+		mocks.AssertEquals(t, 1, len(store))
+
+		_, err = persistence.LogReader().Get(job.ID)
+		mocks.AssertEquals(t, meeseeks.ErrNoLogsForJob, err)
+
+		reader := a.LogReader()
+		jobLog, err := reader.Get(job.ID)
+		mocks.Must(t, "could not read archived logs", err)
+		mocks.AssertEquals(t, "line1\nline2\nline3", jobLog.Output)
+		mocks.AssertEquals(t, "failed", jobLog.Error)
+
+		jobLog, err = reader.Head(job.ID, 2)
+		mocks.Must(t, "could not read archived head", err)
+		mocks.AssertEquals(t, "line1\nline2", jobLog.Output)
+
+		jobLog, err = reader.Tail(job.ID, 2)
+		mocks.Must(t, "could not read archived tail", err)
+		mocks.AssertEquals(t, "line2\nline3", jobLog.Output)
+
+		_, err = reader.Get(job.ID + 1)
+		mocks.AssertEquals(t, meeseeks.ErrNoLogsForJob, err)
+	}))
+}
+
+func TestJobsWithoutLogsAreNotArchived(t *testing.T) {
+	mocks.Must(t, "failed to archive logs", mocks.WithTmpDB(func(_ string) {
+		store := memoryStore{}
+		a := newArchiver(t, store, "")
+
+		job, err := persistence.Jobs().Create(meeseeks.Request{Command: "echo"})
+		mocks.Must(t, "could not create job", err)
+
+		mocks.Must(t, "could not archive logs", a.Archive(job))
+		mocks.AssertEquals(t, 0, len(store))
+	}))
+}
+
+func TestUnwrap(t *testing.T) {
+	a := newArchiver(t, memoryStore{}, "")
+	mocks.AssertEquals(t, persistence.Jobs(), archive.Unwrap(a.Jobs()))
+	mocks.AssertEquals(t, persistence.LogReader(), archive.UnwrapReader(a.LogReader()))
+}
@@ -0,0 +1,97 @@
+package archive
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+
+	minio "github.com/minio/minio-go"
+)
+
+// Supported providers
+const (
+	ProviderS3  = "s3"
+	ProviderGCS = "gcs"
+)
+
+var defaultEndpoints = map[string]string{
+	ProviderS3:  "s3.amazonaws.com",
+	ProviderGCS: "storage.googleapis.com",
+}
+
+// Config holds the configuration of the object store bucket in which the
+// logs are archived, archival is disabled unless a bucket is set
+//
+// GCS buckets are accessed through their S3 compatible API, so the access
+// and secret keys are HMAC keys
+type Config struct {
+	Provider  string `yaml:"provider"`
+	Endpoint  string `yaml:"endpoint"`
+	Region    string `yaml:"region"`
+	Bucket    string `yaml:"bucket"`
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+	Insecure  bool   `yaml:"insecure"`
+	KeyLayout string `yaml:"key_layout"`
+}
+
+// Enabled returns true when logs archival is configured
+func (c Config) Enabled() bool {
+	return c.Bucket != ""
+}
+
+// Validate checks that the configuration is usable
+func (c Config) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	if _, ok := defaultEndpoints[c.Provider]; !ok {
+		return fmt.Errorf("invalid archive provider %s, valid providers are %s and %s",
+			c.Provider, ProviderS3, ProviderGCS)
+	}
+	return nil
+}
+
+type bucketStore struct {
+	client *minio.Client
+	bucket string
+}
+
+// NewBucketStore returns a store that keeps the logs in an S3 or GCS bucket
+func NewBucketStore(cnf Config) (Store, error) {
+	if err := cnf.Validate(); err != nil {
+		return nil, err
+	}
+
+	endpoint := cnf.Endpoint
+	if endpoint == "" {
+		endpoint = defaultEndpoints[cnf.Provider]
+	}
+	client, err := minio.NewWithRegion(endpoint, cnf.AccessKey, cnf.SecretKey, !cnf.Insecure, cnf.Region)
+	if err != nil {
+		return nil, fmt.Errorf("could not create %s client: %s", cnf.Provider, err)
+	}
+	return bucketStore{client: client, bucket: cnf.Bucket}, nil
+}
+
+// Put implements Store.Put
+func (b bucketStore) Put(key string, content []byte) error {
+	_, err := b.client.PutObject(b.bucket, key, bytes.NewReader(content), int64(len(content)),
+		minio.PutObjectOptions{ContentType: "application/json"})
+	return err
+}
+
+// Get implements Store.Get
+func (b bucketStore) Get(key string) ([]byte, error) {
+	object, err := b.client.GetObject(b.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+
+	content, err := ioutil.ReadAll(object)
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return nil, ErrNotArchived
+	}
+	return content, err
+}
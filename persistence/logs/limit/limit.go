@@ -0,0 +1,438 @@
+package limit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Config holds the caps on the output of each job, a zero value disables a cap
+//
+// MaxLines and MaxBytes apply both to the logs that are stored and to the
+// output that is replied to the chat. When a job goes over any of them the
+// first half of the budget is kept from the head of the output and the second
+// half from the tail, with a marker that tells how much was left out between
+// them.
+type Config struct {
+	MaxLines int `yaml:"max_lines"`
+	MaxBytes int `yaml:"max_bytes"`
+}
+
+// Enabled returns true if any cap is set
+func (c Config) Enabled() bool {
+	return c.MaxLines > 0 || c.MaxBytes > 0
+}
+
+// Validate checks that the configuration is usable
+func (c Config) Validate() error {
+	if c.MaxLines < 0 || c.MaxBytes < 0 {
+		return fmt.Errorf("output limits can't be negative")
+	}
+	return nil
+}
+
+// budget is how many lines and bytes fit in one half of the output, zero
+// means unlimited
+type budget struct {
+	lines int
+	bytes int
+}
+
+func (c Config) half() budget {
+	return budget{lines: (c.MaxLines + 1) / 2, bytes: (c.MaxBytes + 1) / 2}
+}
+
+func (b budget) fits(lines, bytes int) bool {
+	return (b.lines == 0 || lines <= b.lines) && (b.bytes == 0 || bytes <= b.bytes)
+}
+
+// Marker returns the line that replaces the output left out of a job
+func Marker(lines, bytes int) string {
+	return fmt.Sprintf("[... %d lines (%d bytes) truncated ...]", lines, bytes)
+}
+
+var config Config
+var mutex sync.Mutex
+
+// Configure sets the caps used to truncate the output that is replied
+func Configure(cnf Config) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	config = cnf
+}
+
+// Output truncates the output of a job to the configured caps before it is
+// replied
+func Output(output string) string {
+	mutex.Lock()
+	cnf := config
+	mutex.Unlock()
+
+	return Truncate(cnf, output)
+}
+
+// Truncate keeps the head and the tail of the output that fit in the caps,
+// joined by a marker, or returns it as is when it fits
+func Truncate(cnf Config, output string) string {
+	if !cnf.Enabled() || output == "" {
+		return output
+	}
+	trailingNewline := strings.HasSuffix(output, "\n")
+	lines := strings.Split(strings.TrimSuffix(output, "\n"), "\n")
+
+	o := newOutput(cnf.half())
+	head := make([]string, 0)
+	for _, line := range lines {
+		if o.add(meeseeks.LogLine{Text: line}) {
+			head = append(head, line)
+		}
+	}
+	if o.dropped == 0 {
+		return output
+	}
+
+	head = append(head, Marker(o.dropped, o.droppedBytes))
+	for _, line := range o.tail {
+		head = append(head, line.Text)
+	}
+	truncated := strings.Join(head, "\n")
+	if trailingNewline {
+		truncated += "\n"
+	}
+	return truncated
+}
+
+// output tracks the head and the tail of the output of a job
+type output struct {
+	budget budget
+
+	headLines int
+	headBytes int
+
+	tail      []meeseeks.LogLine
+	tailBytes int
+
+	dropped      int
+	droppedBytes int
+	spool        *os.File
+}
+
+func newOutput(b budget) *output {
+	return &output{budget: b, tail: make([]meeseeks.LogLine, 0)}
+}
+
+// add returns true if the line belongs to the head, otherwise it's kept in the
+// tail, dropping the oldest tail lines that don't fit anymore
+func (o *output) add(line meeseeks.LogLine) bool {
+	size := len(line.Text) + 1
+	if o.dropped == 0 && len(o.tail) == 0 && o.budget.fits(o.headLines+1, o.headBytes+size) {
+		o.headLines++
+		o.headBytes += size
+		return true
+	}
+
+	o.tail = append(o.tail, line)
+	o.tailBytes += size
+	for len(o.tail) > 0 && !o.budget.fits(len(o.tail), o.tailBytes) {
+		o.dropped++
+		o.droppedBytes += len(o.tail[0].Text) + 1
+		o.tailBytes -= len(o.tail[0].Text) + 1
+		o.tail = o.tail[1:]
+	}
+	return false
+}
+
+// Limiter caps the logs stored for each job, keeping the whole of them in a
+// spool file until they are archived when spooling is enabled
+type Limiter struct {
+	cnf    Config
+	spool  bool
+	jobs   meeseeks.Jobs
+	reader meeseeks.LogReader
+	writer meeseeks.LogWriter
+
+	outputs map[uint64]*output
+	m       sync.Mutex
+}
+
+// New creates a new limiter on top of the jobs and logs services, spool is
+// meant to be set when the logs are archived so the archive gets them whole
+func New(cnf Config, spool bool, jobs meeseeks.Jobs, reader meeseeks.LogReader, writer meeseeks.LogWriter) *Limiter {
+	return &Limiter{
+		cnf:     cnf,
+		spool:   spool,
+		jobs:    Unwrap(jobs),
+		reader:  UnwrapReader(reader),
+		writer:  UnwrapWriter(writer),
+		outputs: make(map[uint64]*output),
+	}
+}
+
+// Reconfigure changes the caps and the services of the limiter, the jobs
+// that are running keep the caps they started with and are finished by it
+// like the rest, as they still write through it. With no caps the output of
+// the jobs that start is stored as is
+func (l *Limiter) Reconfigure(cnf Config, spool bool, jobs meeseeks.Jobs, reader meeseeks.LogReader, writer meeseeks.LogWriter) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	l.cnf, l.spool = cnf, spool
+	l.jobs, l.reader, l.writer = Unwrap(jobs), UnwrapReader(reader), UnwrapWriter(writer)
+}
+
+func (l *Limiter) output(jobID uint64) *output {
+	o, ok := l.outputs[jobID]
+	if !ok {
+		o = newOutput(l.cnf.half())
+		l.outputs[jobID] = o
+	}
+	return o
+}
+
+// append stores the lines in the head and keeps the rest in memory and in
+// the spool until the job finishes
+func (l *Limiter) append(jobID uint64, line meeseeks.LogLine) error {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if _, ok := l.outputs[jobID]; !ok && !l.cnf.Enabled() {
+		return l.writer.AppendLine(jobID, line)
+	}
+	if line.Text == "" {
+		return nil
+	}
+	o := l.output(jobID)
+	if o.add(line) {
+		return l.writer.AppendLine(jobID, line)
+	}
+	if !l.spool {
+		return nil
+	}
+	if o.spool == nil {
+		f, err := ioutil.TempFile("", fmt.Sprintf("meeseeks-job-%d-", jobID))
+		if err != nil {
+			return fmt.Errorf("could not create spool file for job %d: %s", jobID, err)
+		}
+		o.spool = f
+	}
+	return json.NewEncoder(o.spool).Encode(line)
+}
+
+// flush stores the marker and the tail of a finished job, the output is
+// forgotten unless it's spooled, then it's kept until the logs are removed
+func (l *Limiter) flush(jobID uint64) error {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	o, ok := l.outputs[jobID]
+	if !ok {
+		return nil
+	}
+	if o.spool == nil {
+		delete(l.outputs, jobID)
+	}
+	if o.dropped == 0 && len(o.tail) == 0 {
+		return nil
+	}
+
+	lines := o.tail
+	if o.dropped > 0 {
+		marker := meeseeks.NewLogLine(meeseeks.StdoutStream, Marker(o.dropped, o.droppedBytes))
+		lines = append([]meeseeks.LogLine{marker}, lines...)
+	}
+	for _, line := range lines {
+		if err := l.writer.AppendLine(jobID, line); err != nil {
+			return fmt.Errorf("could not store the tail of job %d: %s", jobID, err)
+		}
+	}
+	return nil
+}
+
+// full returns the whole output of a job from the head in the store and the
+// rest in the spool, or false if the output was not spooled
+func (l *Limiter) full(jobID uint64) (meeseeks.JobLog, bool, error) {
+	l.m.Lock()
+	o, ok := l.outputs[jobID]
+	if !ok || o.spool == nil {
+		l.m.Unlock()
+		return meeseeks.JobLog{}, false, nil
+	}
+	headLines, path, reader := o.headLines, o.spool.Name(), l.reader
+	l.m.Unlock()
+
+	jobLog, err := reader.Head(jobID, headLines)
+	if err != nil && err != meeseeks.ErrNoLogsForJob {
+		return jobLog, true, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return jobLog, true, fmt.Errorf("could not open spool file for job %d: %s", jobID, err)
+	}
+	defer f.Close()
+
+	lines := jobLog.GetLines()
+	decoder := json.NewDecoder(f)
+	for decoder.More() {
+		line := meeseeks.LogLine{}
+		if err := decoder.Decode(&line); err != nil {
+			return jobLog, true, fmt.Errorf("could not read spool file for job %d: %s", jobID, err)
+		}
+		lines = append(lines, line)
+	}
+	jobLog.SetLines(lines)
+	return jobLog, true, nil
+}
+
+// drop forgets the output of a job and removes its spool
+func (l *Limiter) drop(jobID uint64) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	o, ok := l.outputs[jobID]
+	if !ok {
+		return
+	}
+	delete(l.outputs, jobID)
+	if o.spool != nil {
+		o.spool.Close()
+		if err := os.Remove(o.spool.Name()); err != nil {
+			logrus.Errorf("Could not remove spool file of job %d: %s", jobID, err)
+		}
+	}
+}
+
+// Jobs returns the jobs service that stores the tail of the output of the
+// jobs when they finish
+func (l *Limiter) Jobs() meeseeks.Jobs {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	return limitingJobs{Jobs: l.jobs, limiter: l}
+}
+
+type limitingJobs struct {
+	meeseeks.Jobs
+	limiter *Limiter
+}
+
+// Finish implements Jobs.Finish
+func (j limitingJobs) Finish(jobID uint64, status meeseeks.JobStatus) error {
+	if err := j.limiter.flush(jobID); err != nil {
+		logrus.Errorf("Could not store the truncated output: %s", err)
+	}
+	return j.Jobs.Finish(jobID, status)
+}
+
+// LogWriter returns the log writer that caps the logs of every job
+func (l *Limiter) LogWriter() meeseeks.LogWriter {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	return limitingWriter{LogWriter: l.writer, limiter: l}
+}
+
+type limitingWriter struct {
+	meeseeks.LogWriter
+	limiter *Limiter
+}
+
+// Append implements LogWriter.Append
+func (w limitingWriter) Append(jobID uint64, content string) error {
+	return w.AppendLine(jobID, meeseeks.NewLogLine(meeseeks.StdoutStream, content))
+}
+
+// AppendLine implements LogWriter.AppendLine
+func (w limitingWriter) AppendLine(jobID uint64, line meeseeks.LogLine) error {
+	return w.limiter.append(jobID, line)
+}
+
+// Remove implements LogRemover.Remove, dropping the spool along with the logs
+func (w limitingWriter) Remove(jobID uint64) error {
+	w.limiter.drop(jobID)
+	if remover, ok := w.LogWriter.(meeseeks.LogRemover); ok {
+		return remover.Remove(jobID)
+	}
+	return nil
+}
+
+// LogReader returns the log reader that reads the whole logs of the jobs
+// that are spooled
+func (l *Limiter) LogReader() meeseeks.LogReader {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	return limitingReader{LogReader: l.reader, limiter: l}
+}
+
+type limitingReader struct {
+	meeseeks.LogReader
+	limiter *Limiter
+}
+
+// Get implements LogReader.Get
+func (r limitingReader) Get(jobID uint64) (meeseeks.JobLog, error) {
+	jobLog, spooled, err := r.limiter.full(jobID)
+	if !spooled {
+		return r.LogReader.Get(jobID)
+	}
+	return jobLog, err
+}
+
+// Head implements LogReader.Head
+func (r limitingReader) Head(jobID uint64, limit int) (meeseeks.JobLog, error) {
+	jobLog, spooled, err := r.limiter.full(jobID)
+	if !spooled {
+		return r.LogReader.Head(jobID, limit)
+	}
+	if len(jobLog.Lines) > limit {
+		jobLog.SetLines(jobLog.Lines[:limit])
+	}
+	return jobLog, err
+}
+
+// Tail implements LogReader.Tail
+func (r limitingReader) Tail(jobID uint64, limit int) (meeseeks.JobLog, error) {
+	jobLog, spooled, err := r.limiter.full(jobID)
+	if !spooled {
+		return r.LogReader.Tail(jobID, limit)
+	}
+	if len(jobLog.Lines) > limit {
+		jobLog.SetLines(jobLog.Lines[len(jobLog.Lines)-limit:])
+	}
+	return jobLog, err
+}
+
+// Unwrap returns the jobs service a limiter was built on, or the same service
+// if it does not limit the output
+func Unwrap(jobs meeseeks.Jobs) meeseeks.Jobs {
+	if j, ok := jobs.(limitingJobs); ok {
+		return j.Jobs
+	}
+	return jobs
+}
+
+// UnwrapReader returns the log reader a limiter was built on, or the same
+// reader if it does not read spooled logs
+func UnwrapReader(reader meeseeks.LogReader) meeseeks.LogReader {
+	if r, ok := reader.(limitingReader); ok {
+		return r.LogReader
+	}
+	return reader
+}
+
+// UnwrapWriter returns the log writer a limiter was built on, or the same
+// writer if it does not limit the logs
+func UnwrapWriter(writer meeseeks.LogWriter) meeseeks.LogWriter {
+	if w, ok := writer.(limitingWriter); ok {
+		return w.LogWriter
+	}
+	return writer
+}
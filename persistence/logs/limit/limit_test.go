@@ -0,0 +1,103 @@
+package limit_test
+
+import (
+	"fmt"
+	"testing"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+	"gitlab.com/yakshaving.art/meeseeks-box/mocks"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/logs/limit"
+)
+
+func TestTruncate(t *testing.T) {
+	tt := []struct {
+		name     string
+		cnf      limit.Config
+		output   string
+		expected string
+	}{
+		{
+			name:     "no limits",
+			output:   "1\n2\n3\n4\n5\n",
+			expected: "1\n2\n3\n4\n5\n",
+		},
+		{
+			name:     "fits",
+			cnf:      limit.Config{MaxLines: 5},
+			output:   "1\n2\n3\n4\n5\n",
+			expected: "1\n2\n3\n4\n5\n",
+		},
+		{
+			name:     "too many lines",
+			cnf:      limit.Config{MaxLines: 4},
+			output:   "1\n2\n3\n4\n5\n6\n",
+			expected: "1\n2\n[... 2 lines (4 bytes) truncated ...]\n5\n6\n",
+		},
+		{
+			name:     "too many bytes",
+			cnf:      limit.Config{MaxBytes: 8},
+			output:   "aaa\nbbb\nccc\nddd",
+			expected: "aaa\n[... 2 lines (8 bytes) truncated ...]\nddd",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			mocks.AssertEquals(t, tc.expected, limit.Truncate(tc.cnf, tc.output))
+		})
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	mocks.AssertEquals(t, "output limits can't be negative", limit.Config{MaxLines: -1}.Validate().Error())
+}
+
+func appendLines(t *testing.T, w meeseeks.LogWriter, jobID uint64, count int) {
+	for i := 1; i <= count; i++ {
+		mocks.Must(t, "could not append line", w.Append(jobID, fmt.Sprintf("line%d", i)))
+	}
+}
+
+func TestStoredLogsKeepTheHeadAndTheTail(t *testing.T) {
+	mocks.Must(t, "failed to limit logs", mocks.WithTmpDB(func(_ string) {
+		l := limit.New(limit.Config{MaxLines: 4}, false,
+			persistence.Jobs(), persistence.LogReader(), persistence.LogWriter())
+
+		job, err := l.Jobs().Create(meeseeks.Request{Command: "echo"})
+		mocks.Must(t, "could not create job", err)
+		appendLines(t, l.LogWriter(), job.ID, 10)
+
+		jobLog, err := l.LogReader().Get(job.ID)
+		mocks.Must(t, "could not read logs", err)
+		mocks.AssertEquals(t, "line1\nline2", jobLog.Output)
+
+		mocks.Must(t, "could not finish job", l.Jobs().Finish(job.ID, meeseeks.JobSucceededStatus))
+		jobLog, err = l.LogReader().Get(job.ID)
+		mocks.Must(t, "could not read logs", err)
+		mocks.AssertEquals(t, "line1\nline2\n[... 6 lines (36 bytes) truncated ...]\nline9\nline10", jobLog.Output)
+	}))
+}
+
+func TestSpooledLogsAreReadWhole(t *testing.T) {
+	mocks.Must(t, "failed to spool logs", mocks.WithTmpDB(func(_ string) {
+		l := limit.New(limit.Config{MaxLines: 4}, true,
+			persistence.Jobs(), persistence.LogReader(), persistence.LogWriter())
+
+		job, err := l.Jobs().Create(meeseeks.Request{Command: "echo"})
+		mocks.Must(t, "could not create job", err)
+		appendLines(t, l.LogWriter(), job.ID, 6)
+		mocks.Must(t, "could not finish job", l.Jobs().Finish(job.ID, meeseeks.JobSucceededStatus))
+
+		jobLog, err := l.LogReader().Get(job.ID)
+		mocks.Must(t, "could not read logs", err)
+		mocks.AssertEquals(t, "line1\nline2\nline3\nline4\nline5\nline6", jobLog.Output)
+
+		jobLog, err = l.LogReader().Tail(job.ID, 2)
+		mocks.Must(t, "could not read logs tail", err)
+		mocks.AssertEquals(t, "line5\nline6", jobLog.Output)
+
+		mocks.Must(t, "could not remove logs", l.LogWriter().(meeseeks.LogRemover).Remove(job.ID))
+		_, err = l.LogReader().Get(job.ID)
+		mocks.AssertEquals(t, meeseeks.ErrNoLogsForJob, err)
+	}))
+}
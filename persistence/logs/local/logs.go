@@ -1,8 +1,8 @@
 package local
 
 import (
+	"encoding/json"
 	"fmt"
-	"strings"
 
 	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
 	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks/metrics"
@@ -25,23 +25,36 @@ type localWriter struct{}
 
 // Implements LogWriter.Append
 func (l localWriter) Append(jobID uint64, content string) error {
-	if content == "" {
+	return l.AppendLine(jobID, meeseeks.NewLogLine(meeseeks.StdoutStream, content))
+}
+
+// Implements LogWriter.AppendLine
+func (l localWriter) AppendLine(jobID uint64, line meeseeks.LogLine) error {
+	if line.Text == "" {
 		return nil
 	}
+	record, err := json.Marshal(line)
+	if err != nil {
+		return fmt.Errorf("could not marshal log line for job %d: %s", jobID, err)
+	}
 	return db.Update(func(tx *bolt.Tx) error {
 		jobBucket, err := getJobBucket(jobID, tx)
 		if err != nil {
 			return fmt.Errorf("could not get job %d bucket: %s", jobID, err)
 		}
+		linesBucket, err := jobBucket.CreateBucketIfNotExists(linesKey)
+		if err != nil {
+			return fmt.Errorf("could not get lines bucket for job %d: %s", jobID, err)
+		}
 
-		sequence, err := jobBucket.NextSequence()
+		sequence, err := linesBucket.NextSequence()
 		if err != nil {
 			return fmt.Errorf("could not get next sequence for job %d: %s", jobID, err)
 		}
 
 		metrics.LogLinesCount.Inc()
 
-		return jobBucket.Put(db.IDToBytes(sequence), []byte(content))
+		return linesBucket.Put(db.IDToBytes(sequence), record)
 	})
 }
 
@@ -64,69 +77,74 @@ func (l localWriter) SetError(jobID uint64, jobErr error) error {
 	})
 }
 
+// Remove implements LogRemover.Remove
+func (l localWriter) Remove(jobID uint64) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		logsBucket := tx.Bucket(logsBucketKey)
+		if logsBucket == nil || logsBucket.Bucket(db.IDToBytes(jobID)) == nil {
+			return meeseeks.ErrNoLogsForJob
+		}
+		return logsBucket.DeleteBucket(db.IDToBytes(jobID))
+	})
+}
+
 type localReader struct{}
 
 // Get implements LogReader.Get
 func (l localReader) Get(jobID uint64) (meeseeks.JobLog, error) {
-	job := &meeseeks.JobLog{}
-	err := readLogBucket(jobID, func(j *bolt.Bucket) error {
-		c := j.Cursor()
-		_, line := c.First()
-		lines := make([]string, 0)
-		for {
-			if line == nil {
-				break
+	return read(jobID, func(c lineCursor) ([]meeseeks.LogLine, error) {
+		lines := make([]meeseeks.LogLine, 0)
+		for line, err := c.First(); line != nil || err != nil; line, err = c.Next() {
+			if err != nil {
+				return nil, err
 			}
-			lines = append(lines, string(line))
-			_, line = c.Next()
+			lines = append(lines, *line)
 		}
-		job.Output = strings.Join(lines, "\n")
-
-		errorBucket := j.Bucket(errorKey)
-		if errorBucket != nil {
-			job.Error = string(errorBucket.Get(errorKey))
-		}
-		return nil
+		return lines, nil
 	})
-	return *job, err
 }
 
 // Head implements LogReader.Head
 func (l localReader) Head(jobID uint64, limit int) (meeseeks.JobLog, error) {
-	job := &meeseeks.JobLog{}
-	err := readLogBucket(jobID, func(j *bolt.Bucket) error {
-		c := j.Cursor()
-
-		lines := make([]string, 0)
-		_, line := c.First()
-		for i := 0; i < limit && line != nil; i++ {
-			lines = append(lines, string(line))
-			_, line = c.Next()
-		}
-		job.Output = strings.Join(lines, "\n")
-
-		errorBucket := j.Bucket(errorKey)
-		if errorBucket != nil {
-			job.Error = string(errorBucket.Get(errorKey))
+	return read(jobID, func(c lineCursor) ([]meeseeks.LogLine, error) {
+		lines := make([]meeseeks.LogLine, 0)
+		line, err := c.First()
+		for i := 0; i < limit && (line != nil || err != nil); i++ {
+			if err != nil {
+				return nil, err
+			}
+			lines = append(lines, *line)
+			line, err = c.Next()
 		}
-		return nil
+		return lines, nil
 	})
-	return *job, err
 }
 
 // Tail implements LogReader.Tail
 func (l localReader) Tail(jobID uint64, limit int) (meeseeks.JobLog, error) {
+	return read(jobID, func(c lineCursor) ([]meeseeks.LogLine, error) {
+		lines := make([]meeseeks.LogLine, 0)
+		line, err := c.Last()
+		for i := 0; i < limit && (line != nil || err != nil); i++ {
+			if err != nil {
+				return nil, err
+			}
+			lines = append([]meeseeks.LogLine{*line}, lines...)
+			line, err = c.Prev()
+		}
+		return lines, nil
+	})
+}
+
+// read loads the lines picked by f and the error of a job
+func read(jobID uint64, f func(lineCursor) ([]meeseeks.LogLine, error)) (meeseeks.JobLog, error) {
 	job := &meeseeks.JobLog{}
 	err := readLogBucket(jobID, func(j *bolt.Bucket) error {
-		c := j.Cursor()
-		lines := make([]string, 0)
-
-		_, line := c.Last()
-		for i := 0; i < limit && line != nil; i++ {
-			lines = append([]string{string(line)}, lines...)
-			_, line = c.Prev()
+		lines, err := f(newLineCursor(j))
+		if err != nil {
+			return fmt.Errorf("could not read logs of job %d: %s", jobID, err)
 		}
-		job.Output = strings.Join(lines, "\n")
+		job.SetLines(lines)
 
 		errorBucket := j.Bucket(errorKey)
 		if errorBucket != nil {
@@ -137,8 +155,60 @@ func (l localReader) Tail(jobID uint64, limit int) (meeseeks.JobLog, error) {
 	return *job, err
 }
 
+// lineCursor walks through the lines of a job, the ones stored before lines
+// were records are plain text in the job bucket itself
+type lineCursor struct {
+	c      *bolt.Cursor
+	legacy bool
+}
+
+func newLineCursor(j *bolt.Bucket) lineCursor {
+	if lines := j.Bucket(linesKey); lines != nil {
+		return lineCursor{c: lines.Cursor()}
+	}
+	return lineCursor{c: j.Cursor(), legacy: true}
+}
+
+func (c lineCursor) First() (*meeseeks.LogLine, error) {
+	return c.decode(c.c.First())
+}
+
+func (c lineCursor) Next() (*meeseeks.LogLine, error) {
+	return c.decode(c.c.Next())
+}
+
+func (c lineCursor) Last() (*meeseeks.LogLine, error) {
+	k, v := c.c.Last()
+	if c.legacy {
+		// Nested buckets sort after the line sequences and have no value
+		for k != nil && v == nil {
+			k, v = c.c.Prev()
+		}
+	}
+	return c.decode(k, v)
+}
+
+func (c lineCursor) Prev() (*meeseeks.LogLine, error) {
+	return c.decode(c.c.Prev())
+}
+
+func (c lineCursor) decode(_, v []byte) (*meeseeks.LogLine, error) {
+	if v == nil {
+		return nil, nil
+	}
+	if c.legacy {
+		return &meeseeks.LogLine{Stream: meeseeks.StdoutStream, Text: string(v)}, nil
+	}
+	line := &meeseeks.LogLine{}
+	if err := json.Unmarshal(v, line); err != nil {
+		return nil, err
+	}
+	return line, nil
+}
+
 var logsBucketKey = []byte("logs")
 var errorKey = []byte("error")
+var linesKey = []byte("lines")
 
 func getJobBucket(jobID uint64, tx *bolt.Tx) (*bolt.Bucket, error) {
 	logsBucket, err := tx.CreateBucketIfNotExists(logsBucketKey)
@@ -3,10 +3,14 @@ package local_test
 import (
 	"errors"
 	"testing"
+	"time"
 
 	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
 	"gitlab.com/yakshaving.art/meeseeks-box/mocks"
 	"gitlab.com/yakshaving.art/meeseeks-box/persistence"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/db"
+
+	bolt "github.com/coreos/bbolt"
 )
 
 func Test_Logs(t *testing.T) {
@@ -92,7 +96,8 @@ func Test_Logs(t *testing.T) {
 				}
 				actual, err := tc.getter(tc.jobID)
 				mocks.Must(t, "could not get job logs back", err)
-				mocks.AssertEquals(t, tc.expected, actual)
+				mocks.AssertEquals(t, tc.expected.Output, actual.Output)
+				mocks.AssertEquals(t, tc.expected.Error, actual.Error)
 			})
 		}
 	})
@@ -132,3 +137,76 @@ func Test_ErredOutJobHasError(t *testing.T) {
 		mocks.AssertEquals(t, meeseeks.JobLog{Error: "nasty error"}, l)
 	})
 }
+
+func Test_RemoveLogs(t *testing.T) {
+	mocks.WithTmpDB(func(_ string) {
+		lw := persistence.LogWriter()
+		mocks.Must(t, "could not append to log", lw.Append(1, "something"))
+		mocks.Must(t, "could not append to log", lw.Append(2, "something else"))
+
+		remover := lw.(meeseeks.LogRemover)
+		mocks.Must(t, "could not remove logs", remover.Remove(1))
+		mocks.AssertEquals(t, meeseeks.ErrNoLogsForJob, remover.Remove(1))
+
+		_, err := persistence.LogReader().Get(1)
+		mocks.AssertEquals(t, meeseeks.ErrNoLogsForJob, err)
+
+		l, err := persistence.LogReader().Get(2)
+		mocks.Must(t, "should be able to read the logs of another job", err)
+		mocks.AssertEquals(t, "something else", l.Output)
+	})
+}
+
+func Test_LogLinesKeepTheirTimeAndStream(t *testing.T) {
+	mocks.WithTmpDB(func(_ string) {
+		line := meeseeks.LogLine{
+			Time:   time.Date(2018, 1, 1, 0, 0, 1, 0, time.UTC),
+			Stream: meeseeks.StderrStream,
+			Text:   "something went wrong",
+		}
+		lw := persistence.LogWriter()
+		mocks.Must(t, "could not append line", lw.AppendLine(1, line))
+		mocks.Must(t, "could not append to log", lw.Append(1, "but it's fine"))
+
+		l, err := persistence.LogReader().Get(1)
+		mocks.Must(t, "could not get job logs back", err)
+		mocks.AssertEquals(t, "something went wrong\nbut it's fine", l.Output)
+		mocks.AssertEquals(t, 2, len(l.Lines))
+		mocks.AssertEquals(t, line, l.Lines[0])
+		mocks.AssertEquals(t, meeseeks.StdoutStream, l.Lines[1].Stream)
+
+		l, err = persistence.LogReader().Tail(1, 1)
+		mocks.Must(t, "could not get job logs tail", err)
+		mocks.AssertEquals(t, 1, len(l.Lines))
+		mocks.AssertEquals(t, "but it's fine", l.Output)
+	})
+}
+
+func Test_LegacyLogLinesAreStillRead(t *testing.T) {
+	mocks.WithTmpDB(func(_ string) {
+		mocks.Must(t, "could not write legacy lines", db.Update(func(tx *bolt.Tx) error {
+			logs, err := tx.CreateBucketIfNotExists([]byte("logs"))
+			if err != nil {
+				return err
+			}
+			job, err := logs.CreateBucketIfNotExists(db.IDToBytes(1))
+			if err != nil {
+				return err
+			}
+			if err := job.Put(db.IDToBytes(1), []byte("old line 1")); err != nil {
+				return err
+			}
+			return job.Put(db.IDToBytes(2), []byte("old line 2"))
+		}))
+
+		l, err := persistence.LogReader().Get(1)
+		mocks.Must(t, "could not get job logs back", err)
+		mocks.AssertEquals(t, "old line 1\nold line 2", l.Output)
+		mocks.AssertEquals(t, meeseeks.StdoutStream, l.Lines[0].Stream)
+		mocks.AssertEquals(t, true, l.Lines[0].Time.IsZero())
+
+		l, err = persistence.LogReader().Tail(1, 1)
+		mocks.Must(t, "could not get job logs tail", err)
+		mocks.AssertEquals(t, "old line 2", l.Output)
+	})
+}
@@ -2,8 +2,15 @@ package persistence
 
 import (
 	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/agenttokens"
 	"gitlab.com/yakshaving.art/meeseeks-box/persistence/aliases"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/approvals"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/audit"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/grants"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/groups"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/identities"
 	"gitlab.com/yakshaving.art/meeseeks-box/persistence/jobs"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/locks"
 	logs "gitlab.com/yakshaving.art/meeseeks-box/persistence/logs/local"
 	"gitlab.com/yakshaving.art/meeseeks-box/persistence/tokens"
 )
@@ -11,22 +18,42 @@ import (
 var providers Providers
 
 func init() {
-	providers = Providers{
-		Aliases:   aliases.Aliases{},
-		Jobs:      jobs.Jobs{},
-		APITokens: tokens.Tokens{},
-		LogReader: logs.NewReader(),
-		LogWriter: logs.NewWriter(),
+	providers = BoltProviders()
+}
+
+// BoltProviders returns the services that keep everything in the embedded
+// BoltDB database
+func BoltProviders() Providers {
+	return Providers{
+		Aliases:     aliases.Aliases{},
+		Jobs:        jobs.Jobs{},
+		APITokens:   tokens.Tokens{},
+		Audit:       audit.Audit{},
+		Groups:      groups.Groups{},
+		LogReader:   logs.NewReader(),
+		LogWriter:   logs.NewWriter(),
+		Locker:      locks.Locks{},
+		Identities:  identities.Identities{},
+		Grants:      grants.Grants{},
+		AgentTokens: agenttokens.AgentTokens{},
+		Approvals:   approvals.Approvals{},
 	}
 }
 
 // Providers holds different service implementations to access them, must be initialized
 type Providers struct {
-	Aliases   meeseeks.Aliases
-	Jobs      meeseeks.Jobs
-	APITokens meeseeks.APITokens
-	LogReader meeseeks.LogReader
-	LogWriter meeseeks.LogWriter
+	Aliases     meeseeks.Aliases
+	Jobs        meeseeks.Jobs
+	APITokens   meeseeks.APITokens
+	Audit       meeseeks.AuditLog
+	Groups      meeseeks.GroupMemberships
+	LogReader   meeseeks.LogReader
+	LogWriter   meeseeks.LogWriter
+	Locker      meeseeks.Locker
+	Identities  meeseeks.Identities
+	Grants      meeseeks.Grants
+	AgentTokens meeseeks.AgentTokens
+	Approvals   meeseeks.Approvals
 }
 
 // Aliases returns an actual instance of the aliases service
@@ -44,6 +71,16 @@ func APITokens() meeseeks.APITokens {
 	return providers.APITokens
 }
 
+// Audit returns an actual instance of the audit log service
+func Audit() meeseeks.AuditLog {
+	return providers.Audit
+}
+
+// Groups returns an actual instance of the group memberships service
+func Groups() meeseeks.GroupMemberships {
+	return providers.Groups
+}
+
 // LogReader returns an actual instance of the log reader service
 func LogReader() meeseeks.LogReader {
 	return providers.LogReader
@@ -54,15 +91,67 @@ func LogWriter() meeseeks.LogWriter {
 	return providers.LogWriter
 }
 
+// Locker returns an actual instance of the locker service
+func Locker() meeseeks.Locker {
+	return providers.Locker
+}
+
+// Identities returns an actual instance of the linked identities service
+func Identities() meeseeks.Identities {
+	return providers.Identities
+}
+
+// Grants returns an actual instance of the temporary grants service
+func Grants() meeseeks.Grants {
+	return providers.Grants
+}
+
+// AgentTokens returns an actual instance of the agent tokens service
+func AgentTokens() meeseeks.AgentTokens {
+	return providers.AgentTokens
+}
+
+// Approvals returns an actual instance of the approvals service
+func Approvals() meeseeks.Approvals {
+	return providers.Approvals
+}
+
 // Register registers new providers
 func Register(proposed Providers) {
+	if proposed.Aliases != nil {
+		providers.Aliases = proposed.Aliases
+	}
+	if proposed.APITokens != nil {
+		providers.APITokens = proposed.APITokens
+	}
 	if proposed.Jobs != nil {
 		providers.Jobs = proposed.Jobs
 	}
+	if proposed.Audit != nil {
+		providers.Audit = proposed.Audit
+	}
+	if proposed.Groups != nil {
+		providers.Groups = proposed.Groups
+	}
 	if proposed.LogReader != nil {
 		providers.LogReader = proposed.LogReader
 	}
 	if proposed.LogWriter != nil {
 		providers.LogWriter = proposed.LogWriter
 	}
+	if proposed.Locker != nil {
+		providers.Locker = proposed.Locker
+	}
+	if proposed.Identities != nil {
+		providers.Identities = proposed.Identities
+	}
+	if proposed.Grants != nil {
+		providers.Grants = proposed.Grants
+	}
+	if proposed.AgentTokens != nil {
+		providers.AgentTokens = proposed.AgentTokens
+	}
+	if proposed.Approvals != nil {
+		providers.Approvals = proposed.Approvals
+	}
 }
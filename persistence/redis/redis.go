@@ -0,0 +1,126 @@
+package redis
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+
+	redigo "github.com/gomodule/redigo/redis"
+)
+
+// DefaultPrefix is prepended to all the keys when no prefix is configured
+const DefaultPrefix = "meeseeks:"
+
+// Config holds the configuration to connect to Redis, it is disabled unless
+// an address is set
+type Config struct {
+	Address  string `yaml:"address"`
+	Password string `yaml:"password"`
+	DB       int    `yaml:"db"`
+	Prefix   string `yaml:"prefix"`
+}
+
+// Enabled returns true when Redis is configured
+func (c Config) Enabled() bool {
+	return c.Address != ""
+}
+
+// Client implements a job queue and locks on top of Redis so they can be
+// shared by many replicas
+type Client struct {
+	pool   *redigo.Pool
+	prefix string
+}
+
+// New returns a new client and checks that the server can be reached
+func New(cnf Config) (*Client, error) {
+	prefix := cnf.Prefix
+	if prefix == "" {
+		prefix = DefaultPrefix
+	}
+
+	c := &Client{
+		pool: &redigo.Pool{
+			MaxIdle:     3,
+			IdleTimeout: 5 * time.Minute,
+			Dial: func() (redigo.Conn, error) {
+				return redigo.Dial("tcp", cnf.Address,
+					redigo.DialPassword(cnf.Password),
+					redigo.DialDatabase(cnf.DB))
+			},
+		},
+		prefix: prefix,
+	}
+
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("PING"); err != nil {
+		c.pool.Close()
+		return nil, fmt.Errorf("could not connect to redis on %s: %s", cnf.Address, err)
+	}
+	return c, nil
+}
+
+// Close closes all the connections
+func (c *Client) Close() error {
+	return c.pool.Close()
+}
+
+// Push implements meeseeks.JobQueue.Push
+func (c *Client) Push(job meeseeks.Job) error {
+	payload, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("could not marshal job %d: %s", job.ID, err)
+	}
+
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("LPUSH", c.prefix+"jobs", payload); err != nil {
+		return fmt.Errorf("could not queue job %d: %s", job.ID, err)
+	}
+	return nil
+}
+
+// Pop implements meeseeks.JobQueue.Pop, the timeout is rounded up to seconds
+func (c *Client) Pop(timeout time.Duration) (meeseeks.Job, bool, error) {
+	seconds := int((timeout + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	values, err := redigo.ByteSlices(conn.Do("BRPOP", c.prefix+"jobs", seconds))
+	if err == redigo.ErrNil {
+		return meeseeks.Job{}, false, nil
+	}
+	if err != nil {
+		return meeseeks.Job{}, false, fmt.Errorf("could not pop a job: %s", err)
+	}
+
+	job := meeseeks.Job{}
+	if err := json.Unmarshal(values[1], &job); err != nil {
+		return job, false, fmt.Errorf("could not unmarshal queued job: %s", err)
+	}
+	return job, true, nil
+}
+
+// Lock implements meeseeks.Locker.Lock
+func (c *Client) Lock(key string, ttl time.Duration) (bool, error) {
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	_, err := redigo.String(conn.Do("SET", c.prefix+"lock:"+key, "locked", "NX", "PX", int64(ttl/time.Millisecond)))
+	if err == redigo.ErrNil {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("could not take lock %s: %s", key, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,71 @@
+package redis_test
+
+import (
+	"testing"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+	"gitlab.com/yakshaving.art/meeseeks-box/mocks"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/redis"
+
+	"github.com/alicebob/miniredis"
+)
+
+func withRedis(t *testing.T, f func(*redis.Client)) {
+	s, err := miniredis.Run()
+	mocks.Must(t, "could not start redis server", err)
+	defer s.Close()
+
+	c, err := redis.New(redis.Config{Address: s.Addr()})
+	mocks.Must(t, "could not connect to redis", err)
+	defer c.Close()
+
+	f(c)
+}
+
+func TestConnectionFailure(t *testing.T) {
+	_, err := redis.New(redis.Config{Address: "127.0.0.1:1"})
+	if err == nil {
+		t.Fatal("connecting to a closed port should fail")
+	}
+}
+
+func TestQueueIsFIFO(t *testing.T) {
+	withRedis(t, func(c *redis.Client) {
+		_, ok, err := c.Pop(time.Second)
+		mocks.Must(t, "could not pop from empty queue", err)
+		mocks.AssertEquals(t, false, ok)
+
+		for _, id := range []uint64{1, 2} {
+			mocks.Must(t, "could not push job", c.Push(meeseeks.Job{
+				ID:      id,
+				Request: meeseeks.Request{Command: "echo"},
+				Status:  meeseeks.JobRunningStatus,
+			}))
+		}
+
+		for _, id := range []uint64{1, 2} {
+			job, ok, err := c.Pop(time.Second)
+			mocks.Must(t, "could not pop job", err)
+			mocks.AssertEquals(t, true, ok)
+			mocks.AssertEquals(t, id, job.ID)
+			mocks.AssertEquals(t, "echo", job.Request.Command)
+		}
+	})
+}
+
+func TestLocks(t *testing.T) {
+	withRedis(t, func(c *redis.Client) {
+		locked, err := c.Lock("request", time.Minute)
+		mocks.Must(t, "could not take lock", err)
+		mocks.AssertEquals(t, true, locked)
+
+		locked, err = c.Lock("request", time.Minute)
+		mocks.Must(t, "could not try lock", err)
+		mocks.AssertEquals(t, false, locked)
+
+		locked, err = c.Lock("another", time.Minute)
+		mocks.Must(t, "could not take lock", err)
+		mocks.AssertEquals(t, true, locked)
+	})
+}
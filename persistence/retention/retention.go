@@ -0,0 +1,182 @@
+package retention
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks/metrics"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/artifacts"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/logs/archive"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/logs/limit"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultInterval is how often the reaper runs when no interval is configured
+const DefaultInterval = time.Hour
+
+// Reasons for a job to be pruned, used to label metrics
+const (
+	ReasonAge   = "age"
+	ReasonCount = "count"
+	ReasonSize  = "size"
+)
+
+// Config holds the retention policies, a zero value disables a policy
+//
+// MaxAge is how many seconds finished jobs are kept, MaxJobsPerCommand is how
+// many finished jobs are kept for each command and MaxTotalSize is how many
+// bytes of logs are kept overall, the newest jobs are kept first. The reaper
+// runs every Interval seconds.
+type Config struct {
+	MaxAge            time.Duration `yaml:"max_age"`
+	MaxJobsPerCommand int           `yaml:"max_jobs_per_command"`
+	MaxTotalSize      int64         `yaml:"max_total_size"`
+	Interval          time.Duration `yaml:"interval"`
+}
+
+// Enabled returns true if any retention policy is set
+func (c Config) Enabled() bool {
+	return c.MaxAge > 0 || c.MaxJobsPerCommand > 0 || c.MaxTotalSize > 0
+}
+
+// Validate checks that the configuration is usable
+func (c Config) Validate() error {
+	if c.MaxAge < 0 || c.MaxJobsPerCommand < 0 || c.MaxTotalSize < 0 || c.Interval < 0 {
+		return fmt.Errorf("retention policies can't be negative")
+	}
+	return nil
+}
+
+var config Config
+var mutex sync.Mutex
+
+// Configure sets the retention policies used by the reaper
+func Configure(cnf Config) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	config = cnf
+}
+
+// Pruned holds how many jobs were removed and why, and the log bytes freed
+type Pruned struct {
+	Jobs     map[string]int
+	LogBytes int64
+}
+
+// Reap applies the configured retention policies once, removing the logs and
+// the jobs that are not to be kept anymore. Running jobs are never removed.
+func Reap(now time.Time) (Pruned, error) {
+	mutex.Lock()
+	cnf := config
+	mutex.Unlock()
+
+	pruned := Pruned{Jobs: map[string]int{}}
+	if !cnf.Enabled() {
+		return pruned, nil
+	}
+
+	jobs, err := persistence.Jobs().Find(meeseeks.JobFilter{
+		Limit: math.MaxInt32,
+		Match: func(j meeseeks.Job) bool { return j.Status.IsFinished() },
+	})
+	if err != nil {
+		return pruned, fmt.Errorf("could not list jobs: %s", err)
+	}
+
+	reader := archive.UnwrapReader(persistence.LogReader())
+	perCommand := map[string]int{}
+	totalSize := int64(0)
+
+	for _, job := range jobs { // newest first
+		perCommand[job.Request.Command]++
+		size := int64(0)
+		if jobLog, err := reader.Get(job.ID); err == nil {
+			size = int64(len(jobLog.Output) + len(jobLog.Error))
+		}
+		totalSize += size
+
+		reason := ""
+		switch {
+		case cnf.MaxAge > 0 && now.Sub(job.StartTime) > cnf.MaxAge*time.Second:
+			reason = ReasonAge
+		case cnf.MaxJobsPerCommand > 0 && perCommand[job.Request.Command] > cnf.MaxJobsPerCommand:
+			reason = ReasonCount
+		case cnf.MaxTotalSize > 0 && totalSize > cnf.MaxTotalSize:
+			reason = ReasonSize
+		default:
+			continue
+		}
+
+		if err := remove(job.ID); err != nil {
+			return pruned, err
+		}
+		totalSize -= size
+		pruned.Jobs[reason]++
+		pruned.LogBytes += size
+
+		metrics.PrunedJobsCount.WithLabelValues(reason).Inc()
+		metrics.PrunedLogBytes.Add(float64(size))
+	}
+	return pruned, nil
+}
+
+// remove drops the logs, the artifacts and the job itself. The jobs service is
+// looked up first, so nothing is dropped of a job that can't be removed
+func remove(jobID uint64) error {
+	jobs, ok := limit.Unwrap(archive.Unwrap(persistence.Jobs())).(meeseeks.JobRemover)
+	if !ok {
+		return fmt.Errorf("the jobs storage does not allow removing jobs")
+	}
+
+	if remover, ok := persistence.LogWriter().(meeseeks.LogRemover); ok {
+		if err := remover.Remove(jobID); err != nil && err != meeseeks.ErrNoLogsForJob {
+			return fmt.Errorf("could not remove logs for job %d: %s", jobID, err)
+		}
+	}
+
+	if err := artifacts.Remove(jobID); err != nil {
+		return fmt.Errorf("could not remove artifacts for job %d: %s", jobID, err)
+	}
+
+	if err := jobs.Remove(jobID); err != nil {
+		return fmt.Errorf("could not remove job %d: %s", jobID, err)
+	}
+	return nil
+}
+
+// Start launches the reaper in the background, it runs every interval until
+// the returned function is called
+func Start(interval time.Duration) func() {
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				pruned, err := Reap(time.Now().UTC())
+				if err != nil {
+					logrus.Errorf("Failed to apply retention policies: %s", err)
+				}
+				if len(pruned.Jobs) > 0 {
+					logrus.Infof("Retention policies pruned jobs %v and %d bytes of logs", pruned.Jobs, pruned.LogBytes)
+				}
+			}
+		}
+	}()
+
+	return func() { close(stop) }
+}
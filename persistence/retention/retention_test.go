@@ -0,0 +1,137 @@
+package retention_test
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+	"gitlab.com/yakshaving.art/meeseeks-box/mocks"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/logs/limit"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/retention"
+)
+
+// createJobs creates a finished job with the given output for each command,
+// and a last running job
+func createJobs(t *testing.T, cmds ...string) {
+	for _, cmd := range cmds {
+		job, err := persistence.Jobs().Create(meeseeks.Request{Command: cmd})
+		mocks.Must(t, "could not create job", err)
+		mocks.Must(t, "could not append log", persistence.LogWriter().Append(job.ID, strings.Repeat("x", 10)))
+		mocks.Must(t, "could not finish job", persistence.Jobs().Finish(job.ID, meeseeks.JobSucceededStatus))
+	}
+	_, err := persistence.Jobs().Create(meeseeks.Request{Command: "running"})
+	mocks.Must(t, "could not create job", err)
+}
+
+func remainingJobs(t *testing.T) []uint64 {
+	jobs, err := persistence.Jobs().Find(meeseeks.JobFilter{Limit: math.MaxInt32})
+	mocks.Must(t, "could not find jobs", err)
+
+	ids := make([]uint64, 0)
+	for _, j := range jobs {
+		ids = append(ids, j.ID)
+	}
+	return ids
+}
+
+func TestRetentionPolicies(t *testing.T) {
+	now := time.Now().UTC()
+	tt := []struct {
+		name      string
+		cnf       retention.Config
+		now       time.Time
+		pruned    map[string]int
+		remaining []uint64
+	}{
+		{
+			name:      "disabled",
+			now:       now.Add(24 * time.Hour),
+			pruned:    map[string]int{},
+			remaining: []uint64{5, 4, 3, 2, 1},
+		},
+		{
+			name:      "max age",
+			cnf:       retention.Config{MaxAge: 3600},
+			now:       now.Add(2 * time.Hour),
+			pruned:    map[string]int{retention.ReasonAge: 4},
+			remaining: []uint64{5},
+		},
+		{
+			name:      "max jobs per command",
+			cnf:       retention.Config{MaxJobsPerCommand: 1},
+			now:       now,
+			pruned:    map[string]int{retention.ReasonCount: 2},
+			remaining: []uint64{5, 4, 2},
+		},
+		{
+			name:      "max total size",
+			cnf:       retention.Config{MaxTotalSize: 25},
+			now:       now,
+			pruned:    map[string]int{retention.ReasonSize: 2},
+			remaining: []uint64{5, 4, 3},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			mocks.Must(t, "failed to reap jobs", mocks.WithTmpDB(func(_ string) {
+				createJobs(t, "echo", "date", "echo", "echo")
+
+				retention.Configure(tc.cnf)
+				defer retention.Configure(retention.Config{})
+
+				pruned, err := retention.Reap(tc.now)
+				mocks.Must(t, "could not reap jobs", err)
+				mocks.AssertEquals(t, tc.pruned, pruned.Jobs)
+				mocks.AssertEquals(t, tc.remaining, remainingJobs(t))
+
+				for _, id := range []uint64{1, 2, 3, 4} {
+					_, err := persistence.LogReader().Get(id)
+					kept := false
+					for _, r := range tc.remaining {
+						kept = kept || r == id
+					}
+					if kept {
+						mocks.Must(t, "logs of kept jobs should be there", err)
+					} else {
+						mocks.AssertEquals(t, meeseeks.ErrNoLogsForJob, err)
+					}
+				}
+			}))
+		})
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	mocks.AssertEquals(t, "retention policies can't be negative",
+		retention.Config{MaxAge: -3600}.Validate().Error())
+}
+
+func TestRetentionWithOutputLimits(t *testing.T) {
+	mocks.Must(t, "failed to reap jobs", mocks.WithTmpDB(func(_ string) {
+		jobs, reader, writer := persistence.Jobs(), persistence.LogReader(), persistence.LogWriter()
+		limiter := limit.New(limit.Config{MaxLines: 10}, false, jobs, reader, writer)
+		persistence.Register(persistence.Providers{
+			Jobs:      limiter.Jobs(),
+			LogReader: limiter.LogReader(),
+			LogWriter: limiter.LogWriter(),
+		})
+		defer persistence.Register(persistence.Providers{Jobs: jobs, LogReader: reader, LogWriter: writer})
+
+		createJobs(t, "echo", "echo")
+
+		retention.Configure(retention.Config{MaxJobsPerCommand: 1})
+		defer retention.Configure(retention.Config{})
+
+		pruned, err := retention.Reap(time.Now().UTC())
+		mocks.Must(t, "could not reap jobs", err)
+		mocks.AssertEquals(t, map[string]int{retention.ReasonCount: 1}, pruned.Jobs)
+		mocks.AssertEquals(t, []uint64{3, 2}, remainingJobs(t))
+
+		_, err = persistence.LogReader().Get(1)
+		mocks.AssertEquals(t, meeseeks.ErrNoLogsForJob, err)
+	}))
+}
@@ -0,0 +1,70 @@
+package sqldb
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+)
+
+// AgentTokens returns the agent tokens service
+func (s *Store) AgentTokens() meeseeks.AgentTokens {
+	return agentTokensStore{s.db}
+}
+
+type agentTokensStore struct {
+	db *sql.DB
+}
+
+// Save stores the token, replacing the previous one of the agent
+func (a agentTokensStore) Save(token meeseeks.AgentToken) error {
+	payload, err := json.Marshal(token)
+	if err != nil {
+		return fmt.Errorf("could not marshal agent token: %s", err)
+	}
+	_, err = a.db.Exec("REPLACE INTO agent_tokens (name, payload) VALUES (?, ?)",
+		token.Name, string(payload))
+	return err
+}
+
+// Get returns the token of the agent, ErrNoAgentToken if there is none
+func (a agentTokensStore) Get(name string) (meeseeks.AgentToken, error) {
+	token := meeseeks.AgentToken{}
+	err := scanJSON(a.db.QueryRow("SELECT payload FROM agent_tokens WHERE name = ?", name), &token)
+	if err == sql.ErrNoRows {
+		return token, meeseeks.ErrNoAgentToken
+	}
+	return token, err
+}
+
+// List returns all the tokens sorted by name
+func (a agentTokensStore) List() ([]meeseeks.AgentToken, error) {
+	rows, err := a.db.Query("SELECT payload FROM agent_tokens ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := make([]meeseeks.AgentToken, 0)
+	for rows.Next() {
+		token := meeseeks.AgentToken{}
+		if err := scanJSON(rows, &token); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+// Revoke removes the token of the agent, ErrNoAgentToken if there is none
+func (a agentTokensStore) Revoke(name string) error {
+	res, err := a.db.Exec("DELETE FROM agent_tokens WHERE name = ?", name)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return meeseeks.ErrNoAgentToken
+	}
+	return nil
+}
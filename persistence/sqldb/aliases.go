@@ -0,0 +1,77 @@
+package sqldb
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/aliases"
+)
+
+// Aliases returns the aliases service
+func (s *Store) Aliases() meeseeks.Aliases {
+	return aliasesStore{s.db}
+}
+
+type aliasesStore struct {
+	db *sql.DB
+}
+
+// Get returns the command for an alias
+func (a aliasesStore) Get(userID, alias string) (string, []string, error) {
+	al := meeseeks.Alias{}
+	err := scanJSON(a.db.QueryRow("SELECT payload FROM aliases WHERE user_id = ? AND alias = ?", userID, alias), &al)
+	if err == sql.ErrNoRows {
+		return "", nil, aliases.ErrAliasNotFound
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return al.Command, al.Args, nil
+}
+
+// List returns all configured aliases for a user ID
+func (a aliasesStore) List(userID string) ([]meeseeks.Alias, error) {
+	rows, err := a.db.Query("SELECT payload FROM aliases WHERE user_id = ? ORDER BY alias", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := make([]meeseeks.Alias, 0)
+	for rows.Next() {
+		al := meeseeks.Alias{}
+		if err := scanJSON(rows, &al); err != nil {
+			return nil, err
+		}
+		list = append(list, al)
+	}
+	return list, rows.Err()
+}
+
+// Create adds a new alias for a user ID
+func (a aliasesStore) Create(userID, alias, command string, args ...string) error {
+	payload, err := json.Marshal(meeseeks.Alias{
+		Alias:   alias,
+		Command: command,
+		Args:    args,
+	})
+	if err != nil {
+		return fmt.Errorf("could not marshal alias: %s", err)
+	}
+	_, err = a.db.Exec("REPLACE INTO aliases (user_id, alias, payload) VALUES (?, ?, ?)", userID, alias, string(payload))
+	return err
+}
+
+// Remove deletes an alias for a user ID
+func (a aliasesStore) Remove(userID, alias string) error {
+	res, err := a.db.Exec("DELETE FROM aliases WHERE user_id = ? AND alias = ?", userID, alias)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return fmt.Errorf("alias not found")
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package sqldb
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+)
+
+// How many times an approval is updated again when another replica changed it
+// at the same time
+const approvalUpdateAttempts = 5
+
+// Approvals returns the service of the requests that wait for approvals
+func (s *Store) Approvals() meeseeks.Approvals {
+	return approvalsStore{s.db}
+}
+
+type approvalsStore struct {
+	db *sql.DB
+}
+
+// Create records the approval setting its ID, the expired ones are removed
+func (a approvalsStore) Create(approval meeseeks.Approval) (meeseeks.Approval, error) {
+	if _, err := a.db.Exec("DELETE FROM approvals WHERE expires_at <= ?", time.Now().UnixNano()); err != nil {
+		return meeseeks.Approval{}, fmt.Errorf("could not drop expired approvals: %s", err)
+	}
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		return meeseeks.Approval{}, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("INSERT INTO approvals (expires_at, version, payload) VALUES (?, 0, ?)",
+		approval.ExpiresAt.UnixNano(), "{}")
+	if err != nil {
+		return meeseeks.Approval{}, fmt.Errorf("failed to create approval: %s", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return meeseeks.Approval{}, err
+	}
+	approval.ID = uint64(id)
+
+	payload, err := json.Marshal(approval)
+	if err != nil {
+		return meeseeks.Approval{}, fmt.Errorf("could not marshal approval: %s", err)
+	}
+	if _, err = tx.Exec("UPDATE approvals SET payload = ? WHERE id = ?", string(payload), id); err != nil {
+		return meeseeks.Approval{}, fmt.Errorf("failed to create approval: %s", err)
+	}
+	return approval, tx.Commit()
+}
+
+// Get returns the approval with the id, ErrNoApproval if there is none
+func (a approvalsStore) Get(id uint64) (meeseeks.Approval, error) {
+	approval := meeseeks.Approval{}
+	switch err := scanJSON(a.db.QueryRow("SELECT payload FROM approvals WHERE id = ?", id), &approval); err {
+	case nil:
+		return approval, nil
+	case sql.ErrNoRows:
+		return approval, meeseeks.ErrNoApproval
+	default:
+		return approval, fmt.Errorf("failed to load approval payload: %s", err)
+	}
+}
+
+// Update changes the approval with the id. The version of the row is checked
+// when it's written, so when another replica changed it in the meantime the
+// update is applied again on top of its change
+func (a approvalsStore) Update(id uint64, update func(*meeseeks.Approval) error) (meeseeks.Approval, error) {
+	for i := 0; i < approvalUpdateAttempts; i++ {
+		var version int64
+		var payload string
+		err := a.db.QueryRow("SELECT version, payload FROM approvals WHERE id = ?", id).Scan(&version, &payload)
+		switch err {
+		case nil:
+		case sql.ErrNoRows:
+			return meeseeks.Approval{}, meeseeks.ErrNoApproval
+		default:
+			return meeseeks.Approval{}, err
+		}
+
+		approval := meeseeks.Approval{}
+		if err := json.Unmarshal([]byte(payload), &approval); err != nil {
+			return meeseeks.Approval{}, fmt.Errorf("failed to load approval payload: %s", err)
+		}
+		if err := update(&approval); err != nil {
+			return meeseeks.Approval{}, err
+		}
+		updated, err := json.Marshal(approval)
+		if err != nil {
+			return meeseeks.Approval{}, fmt.Errorf("could not marshal approval: %s", err)
+		}
+
+		res, err := a.db.Exec("UPDATE approvals SET payload = ?, version = ? WHERE id = ? AND version = ?",
+			string(updated), version+1, id, version)
+		if err != nil {
+			return meeseeks.Approval{}, fmt.Errorf("failed to update approval %d: %s", id, err)
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return meeseeks.Approval{}, err
+		} else if n == 1 {
+			return approval, nil
+		}
+	}
+	return meeseeks.Approval{}, fmt.Errorf("approval %d is being changed by someone else, try again", id)
+}
+
+// List returns the approvals that have not expired at the given time
+func (a approvalsStore) List(now time.Time) ([]meeseeks.Approval, error) {
+	approvals := make([]meeseeks.Approval, 0)
+	rows, err := a.db.Query("SELECT payload FROM approvals WHERE expires_at > ? ORDER BY id", now.UnixNano())
+	if err != nil {
+		return approvals, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		approval := meeseeks.Approval{}
+		if err := scanJSON(rows, &approval); err != nil {
+			return approvals, fmt.Errorf("failed to load approval payload: %s", err)
+		}
+		approvals = append(approvals, approval)
+	}
+	return approvals, rows.Err()
+}
+
+// Remove drops the approval, ErrNoApproval if it was already gone
+func (a approvalsStore) Remove(id uint64) error {
+	res, err := a.db.Exec("DELETE FROM approvals WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("could not remove approval %d: %s", id, err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return meeseeks.ErrNoApproval
+	}
+	return nil
+}
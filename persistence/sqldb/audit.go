@@ -0,0 +1,88 @@
+package sqldb
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+)
+
+// Audit returns the audit log service
+func (s *Store) Audit() meeseeks.AuditLog {
+	return auditStore{s.db}
+}
+
+type auditStore struct {
+	db *sql.DB
+}
+
+// Record appends the entry to the audit log, setting its ID and Time
+func (a auditStore) Record(entry meeseeks.AuditEntry) (meeseeks.AuditEntry, error) {
+	entry.Time = time.Now().UTC()
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		return meeseeks.AuditEntry{}, fmt.Errorf("failed to record audit entry: %s", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("INSERT INTO audit (created_at, payload) VALUES (?, ?)", entry.Time.UnixNano(), "{}")
+	if err != nil {
+		return meeseeks.AuditEntry{}, fmt.Errorf("failed to record audit entry: %s", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return meeseeks.AuditEntry{}, fmt.Errorf("failed to record audit entry: %s", err)
+	}
+	entry.ID = uint64(id)
+
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		return meeseeks.AuditEntry{}, fmt.Errorf("could not marshal audit entry: %s", err)
+	}
+	if _, err = tx.Exec("UPDATE audit SET payload = ? WHERE id = ?", string(payload), id); err != nil {
+		return meeseeks.AuditEntry{}, fmt.Errorf("failed to record audit entry: %s", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return meeseeks.AuditEntry{}, fmt.Errorf("failed to record audit entry: %s", err)
+	}
+	return entry, nil
+}
+
+// Find walks through the audit log backwards applying the filter.
+func (a auditStore) Find(filter meeseeks.AuditFilter) ([]meeseeks.AuditEntry, error) {
+	if filter.Match == nil {
+		filter.Match = func(_ meeseeks.AuditEntry) bool { return true }
+	}
+	since, until := int64(0), int64(1<<63-1)
+	if !filter.Since.IsZero() {
+		since = filter.Since.UnixNano()
+	}
+	if !filter.Until.IsZero() {
+		until = filter.Until.UnixNano()
+	}
+
+	entries := make([]meeseeks.AuditEntry, 0)
+	rows, err := a.db.Query("SELECT payload FROM audit WHERE created_at >= ? AND created_at <= ? ORDER BY id DESC",
+		since, until)
+	if err != nil {
+		return entries, err
+	}
+	defer rows.Close()
+
+	for len(entries) < filter.Limit && rows.Next() {
+		e := meeseeks.AuditEntry{}
+		if err := scanJSON(rows, &e); err != nil {
+			return entries, fmt.Errorf("failed to load audit entry payload: %s", err)
+		}
+		if e.Decision == "" {
+			e.Decision = meeseeks.AuditAccepted // Only accepted requests were recorded before
+		}
+		if filter.Match(e) {
+			entries = append(entries, e)
+		}
+	}
+	return entries, rows.Err()
+}
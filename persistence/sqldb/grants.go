@@ -0,0 +1,70 @@
+package sqldb
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+)
+
+// Grants returns the temporary grants service
+func (s *Store) Grants() meeseeks.Grants {
+	return grantsStore{s.db}
+}
+
+type grantsStore struct {
+	db *sql.DB
+}
+
+// Create records the grant setting its ID, the expired grants are removed
+func (g grantsStore) Create(grant meeseeks.Grant) (meeseeks.Grant, error) {
+	if _, err := g.db.Exec("DELETE FROM grants WHERE expires_at <= ?", time.Now().UnixNano()); err != nil {
+		return meeseeks.Grant{}, fmt.Errorf("could not drop expired grants: %s", err)
+	}
+
+	tx, err := g.db.Begin()
+	if err != nil {
+		return meeseeks.Grant{}, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("INSERT INTO grants (expires_at, payload) VALUES (?, ?)", grant.ExpiresAt.UnixNano(), "{}")
+	if err != nil {
+		return meeseeks.Grant{}, fmt.Errorf("failed to create grant: %s", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return meeseeks.Grant{}, err
+	}
+	grant.ID = uint64(id)
+
+	payload, err := json.Marshal(grant)
+	if err != nil {
+		return meeseeks.Grant{}, fmt.Errorf("could not marshal grant: %s", err)
+	}
+	if _, err = tx.Exec("UPDATE grants SET payload = ? WHERE id = ?", string(payload), id); err != nil {
+		return meeseeks.Grant{}, fmt.Errorf("failed to create grant: %s", err)
+	}
+	return grant, tx.Commit()
+}
+
+// List returns the grants that are active at the given time
+func (g grantsStore) List(now time.Time) ([]meeseeks.Grant, error) {
+	grants := make([]meeseeks.Grant, 0)
+	rows, err := g.db.Query("SELECT payload FROM grants WHERE expires_at > ? ORDER BY id", now.UnixNano())
+	if err != nil {
+		return grants, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		grant := meeseeks.Grant{}
+		if err := scanJSON(rows, &grant); err != nil {
+			return grants, fmt.Errorf("failed to load grant payload: %s", err)
+		}
+		grants = append(grants, grant)
+	}
+	return grants, rows.Err()
+}
@@ -0,0 +1,57 @@
+package sqldb
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+)
+
+// Groups returns the group memberships service
+func (s *Store) Groups() meeseeks.GroupMemberships {
+	return groupsStore{s.db}
+}
+
+type groupsStore struct {
+	db *sql.DB
+}
+
+// Add records that the user belongs to the group
+func (g groupsStore) Add(group, username string) error {
+	return g.put(meeseeks.GroupMembership{Group: group, Username: username, Member: true})
+}
+
+// Remove records that the user does not belong to the group
+func (g groupsStore) Remove(group, username string) error {
+	return g.put(meeseeks.GroupMembership{Group: group, Username: username, Member: false})
+}
+
+// List returns all the recorded memberships
+func (g groupsStore) List() ([]meeseeks.GroupMembership, error) {
+	memberships := make([]meeseeks.GroupMembership, 0)
+	rows, err := g.db.Query("SELECT payload FROM group_memberships ORDER BY group_name, username")
+	if err != nil {
+		return memberships, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		m := meeseeks.GroupMembership{}
+		if err := scanJSON(rows, &m); err != nil {
+			return memberships, fmt.Errorf("failed to load group membership payload: %s", err)
+		}
+		memberships = append(memberships, m)
+	}
+	return memberships, rows.Err()
+}
+
+func (g groupsStore) put(m meeseeks.GroupMembership) error {
+	payload, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("could not marshal group membership: %s", err)
+	}
+	_, err = g.db.Exec("REPLACE INTO group_memberships (group_name, username, payload) VALUES (?, ?, ?)",
+		m.Group, m.Username, string(payload))
+	return err
+}
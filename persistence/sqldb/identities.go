@@ -0,0 +1,90 @@
+package sqldb
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+)
+
+// Identities returns the linked identities service
+func (s *Store) Identities() meeseeks.Identities {
+	return identitiesStore{s.db}
+}
+
+type identitiesStore struct {
+	db *sql.DB
+}
+
+// Link stores the identity of the user, replacing the previous one
+func (i identitiesStore) Link(identity meeseeks.Identity) error {
+	payload, err := json.Marshal(identity)
+	if err != nil {
+		return fmt.Errorf("could not marshal identity: %s", err)
+	}
+	_, err = i.db.Exec("REPLACE INTO identities (user_id, payload) VALUES (?, ?)",
+		identity.UserID, string(payload))
+	return err
+}
+
+// Get returns the identity linked to the user ID, ErrNoIdentity if there is none
+func (i identitiesStore) Get(userID string) (meeseeks.Identity, error) {
+	identity := meeseeks.Identity{}
+	err := scanJSON(i.db.QueryRow("SELECT payload FROM identities WHERE user_id = ?", userID), &identity)
+	if err == sql.ErrNoRows {
+		return identity, meeseeks.ErrNoIdentity
+	}
+	return identity, err
+}
+
+// Unlink removes the identity linked to the user ID
+func (i identitiesStore) Unlink(userID string) error {
+	res, err := i.db.Exec("DELETE FROM identities WHERE user_id = ?", userID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return meeseeks.ErrNoIdentity
+	}
+	return nil
+}
+
+// AddLink stores a link sent to a user until it expires, the expired ones are
+// removed
+func (i identitiesStore) AddLink(link meeseeks.IdentityLink) error {
+	if _, err := i.db.Exec("DELETE FROM identity_links WHERE expires_at < ?", time.Now().UnixNano()); err != nil {
+		return fmt.Errorf("could not drop expired identity links: %s", err)
+	}
+	payload, err := json.Marshal(link)
+	if err != nil {
+		return fmt.Errorf("could not marshal identity link: %s", err)
+	}
+	_, err = i.db.Exec("INSERT INTO identity_links (state, expires_at, payload) VALUES (?, ?, ?)",
+		link.State, link.ExpiresAt.UnixNano(), string(payload))
+	return err
+}
+
+// TakeLink removes the link with the state and returns it, ErrNoIdentityLink
+// if there is none or it expired at the given time. Only the replica that
+// deletes it gets it, so a link can't be followed twice
+func (i identitiesStore) TakeLink(state string, now time.Time) (meeseeks.IdentityLink, error) {
+	link := meeseeks.IdentityLink{}
+	switch err := scanJSON(i.db.QueryRow("SELECT payload FROM identity_links WHERE state = ?", state), &link); err {
+	case nil:
+	case sql.ErrNoRows:
+		return link, meeseeks.ErrNoIdentityLink
+	default:
+		return link, fmt.Errorf("failed to load identity link payload: %s", err)
+	}
+
+	res, err := i.db.Exec("DELETE FROM identity_links WHERE state = ?", state)
+	if err != nil {
+		return meeseeks.IdentityLink{}, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 || now.After(link.ExpiresAt) {
+		return meeseeks.IdentityLink{}, meeseeks.ErrNoIdentityLink
+	}
+	return link, nil
+}
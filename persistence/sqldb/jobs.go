@@ -0,0 +1,394 @@
+package sqldb
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks/metrics"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Jobs returns the jobs service
+func (s *Store) Jobs() meeseeks.Jobs {
+	return jobs{s.db}
+}
+
+type jobs struct {
+	db *sql.DB
+}
+
+// Get returns an existing job by id
+func (j jobs) Get(id uint64) (meeseeks.Job, error) {
+	return getJob(j.db, id)
+}
+
+// GetByULID returns an existing job by its ULID
+func (j jobs) GetByULID(id string) (meeseeks.Job, error) {
+	job := meeseeks.Job{}
+	err := scanJSON(j.db.QueryRow("SELECT payload FROM jobs WHERE ulid = ?", id), &job)
+	if err == sql.ErrNoRows {
+		return job, meeseeks.ErrNoJobWithID
+	}
+	return job, err
+}
+
+// Null returns a null job that will not be tracked
+func (j jobs) Null(req meeseeks.Request) meeseeks.Job {
+	return meeseeks.Job{
+		ID:        0,
+		Request:   req,
+		StartTime: time.Now().UTC(),
+		Status:    meeseeks.JobRunningStatus,
+	}
+}
+
+// Create records a request in the DB and hands off a new running job
+func (j jobs) Create(req meeseeks.Request) (meeseeks.Job, error) {
+	return j.create(req, meeseeks.JobRunningStatus)
+}
+
+// Queue records a request in the DB and hands off a new queued job
+func (j jobs) Queue(req meeseeks.Request) (meeseeks.Job, error) {
+	return j.create(req, meeseeks.JobQueuedStatus)
+}
+
+func (j jobs) create(req meeseeks.Request, status meeseeks.JobStatus) (meeseeks.Job, error) {
+	now := time.Now().UTC()
+	job := meeseeks.Job{
+		ULID:      meeseeks.NewJobULID(now),
+		Request:   req,
+		StartTime: now,
+		Status:    status,
+	}
+
+	tx, err := j.db.Begin()
+	if err != nil {
+		return meeseeks.Job{}, fmt.Errorf("failed to create a job %s", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("INSERT INTO jobs (status, payload) VALUES (?, ?)", job.Status, "{}")
+	if err != nil {
+		return meeseeks.Job{}, fmt.Errorf("failed to create a job %s", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return meeseeks.Job{}, fmt.Errorf("failed to create a job %s", err)
+	}
+	job.ID = uint64(id)
+	logrus.Debugf("Creating job %#v", job)
+
+	if err = saveJob(tx, job); err != nil {
+		return meeseeks.Job{}, fmt.Errorf("failed to create a job %s", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return meeseeks.Job{}, fmt.Errorf("failed to create a job %s", err)
+	}
+	metrics.JobStatusChangesCount.WithLabelValues(req.Command, string(status)).Inc()
+	return job, nil
+}
+
+// Start moves a queued job to running
+func (j jobs) Start(jobID uint64) error {
+	return j.moveTo(jobID, meeseeks.JobRunningStatus)
+}
+
+// Finish accounts for the job ending and sets the final status
+func (j jobs) Finish(jobID uint64, status meeseeks.JobStatus) error {
+	if !status.IsFinished() {
+		return fmt.Errorf("invalid status %s", status)
+	}
+	return j.moveTo(jobID, status)
+}
+
+func (j jobs) moveTo(jobID uint64, status meeseeks.JobStatus) error {
+	job, err := getJob(j.db, jobID)
+	if err != nil {
+		return fmt.Errorf("could not get job with id %d: %s", jobID, err)
+	}
+	if job, err = job.MoveTo(status); err != nil {
+		return err
+	}
+
+	metrics.JobStatusChangesCount.WithLabelValues(job.Request.Command, string(status)).Inc()
+	if status.IsFinished() {
+		difference := job.EndTime.Sub(job.StartTime)
+		metrics.TaskDurations.WithLabelValues(job.Request.Command, string(status)).Observe(difference.Seconds())
+	}
+
+	return saveJob(j.db, job)
+}
+
+// Remove drops a finished job, running jobs can't be removed
+func (j jobs) Remove(jobID uint64) error {
+	job, err := getJob(j.db, jobID)
+	if err != nil {
+		return err
+	}
+	if !job.Status.IsFinished() {
+		return fmt.Errorf("job %d is not finished but %s", jobID, job.Status)
+	}
+	tx, err := j.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec("DELETE FROM job_labels WHERE job_id = ?", jobID); err != nil {
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM jobs WHERE id = ?", jobID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// AddLabels attaches the labels to a job and indexes them
+func (j jobs) AddLabels(jobID uint64, labels map[string]string) error {
+	job, err := getJob(j.db, jobID)
+	if err != nil {
+		return err
+	}
+
+	tx, err := j.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if job.Labels == nil {
+		job.Labels = make(map[string]string)
+	}
+	for name, value := range labels {
+		if _, err = tx.Exec("REPLACE INTO job_labels (job_id, name, value) VALUES (?, ?, ?)",
+			jobID, name, value); err != nil {
+			return fmt.Errorf("could not index label %s=%s for job %d: %s", name, value, jobID, err)
+		}
+		job.Labels[name] = value
+	}
+	if err = saveJob(tx, job); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Find walks through the jobs in descending order and applies the Match
+// function to determine if the job matches a search criteria.
+func (j jobs) Find(filter meeseeks.JobFilter) ([]meeseeks.Job, error) {
+	latest := make([]meeseeks.Job, 0)
+	if filter.Match == nil {
+		filter.Match = func(_ meeseeks.Job) bool { return true }
+	}
+
+	query := "SELECT payload FROM jobs"
+	args := make([]interface{}, 0)
+	conditions := make([]string, 0)
+	for name, value := range filter.Labels {
+		conditions = append(conditions, "id IN (SELECT job_id FROM job_labels WHERE name = ? AND value = ?)")
+		args = append(args, name, value)
+	}
+	if filter.Before > 0 {
+		conditions = append(conditions, "id < ?")
+		args = append(args, filter.Before)
+	}
+	if filter.Username != "" {
+		conditions = append(conditions, "username = ?")
+		args = append(args, filter.Username)
+	}
+	if filter.ChannelID != "" {
+		conditions = append(conditions, "channel_id = ?")
+		args = append(args, filter.ChannelID)
+	}
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	rows, err := j.db.Query(query+" ORDER BY id DESC", args...)
+	if err != nil {
+		return latest, err
+	}
+	defer rows.Close()
+
+	for len(latest) < filter.Limit && rows.Next() {
+		job := meeseeks.Job{}
+		if err := scanJSON(rows, &job); err != nil {
+			return latest, fmt.Errorf("failed to load Job payload %s", err)
+		}
+		if filter.Match(job) {
+			latest = append(latest, job)
+		}
+	}
+	return latest, rows.Err()
+}
+
+// QueuedJobs returns the jobs that are still queued, oldest first
+func (j jobs) QueuedJobs() ([]meeseeks.Job, error) {
+	rows, err := j.db.Query("SELECT payload FROM jobs WHERE status = ? ORDER BY id", meeseeks.JobQueuedStatus)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	queued := make([]meeseeks.Job, 0)
+	for rows.Next() {
+		job := meeseeks.Job{}
+		if err := scanJSON(rows, &job); err != nil {
+			return nil, fmt.Errorf("could not read queued job: %s", err)
+		}
+		queued = append(queued, job)
+	}
+	return queued, rows.Err()
+}
+
+// FailQueuedJobs flags as failed any job that is still queued and returns them
+func (j jobs) FailQueuedJobs(note string) ([]meeseeks.Job, error) {
+	queued, err := j.QueuedJobs()
+	if err != nil {
+		return nil, err
+	}
+
+	failed := make([]meeseeks.Job, 0, len(queued))
+	for _, job := range queued {
+		logrus.Warnf("Found job %d in queued state, marking as failed", job.ID)
+		job, err := job.MoveTo(meeseeks.JobFailedStatus)
+		if err != nil {
+			return failed, err
+		}
+		job.Note = note
+		metrics.JobStatusChangesCount.WithLabelValues(job.Request.Command, string(job.Status)).Inc()
+		if err := saveJob(j.db, job); err != nil {
+			return failed, fmt.Errorf("could not save failed job %d: %s", job.ID, err)
+		}
+		failed = append(failed, job)
+	}
+	return failed, nil
+}
+
+// InterruptRunningJobs flags as interrupted any job that is still in running
+// state and returns them
+func (j jobs) InterruptRunningJobs(note string) ([]meeseeks.Job, error) {
+	rows, err := j.db.Query("SELECT payload FROM jobs WHERE status = ?", meeseeks.JobRunningStatus)
+	if err != nil {
+		return nil, err
+	}
+	running := make([]meeseeks.Job, 0)
+	for rows.Next() {
+		job := meeseeks.Job{}
+		if err := scanJSON(rows, &job); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("could not read running job: %s", err)
+		}
+		running = append(running, job)
+	}
+	rows.Close()
+
+	interrupted := make([]meeseeks.Job, 0, len(running))
+	for _, job := range running {
+		logrus.Warnf("Found job %d in running state, marking as interrupted", job.ID)
+		job, err := job.MoveTo(meeseeks.JobInterruptedStatus)
+		if err != nil {
+			return interrupted, err
+		}
+		job.Note = note
+		metrics.JobStatusChangesCount.WithLabelValues(job.Request.Command, string(job.Status)).Inc()
+		if err := saveJob(j.db, job); err != nil {
+			return interrupted, fmt.Errorf("could not save interrupted job %d: %s", job.ID, err)
+		}
+		interrupted = append(interrupted, job)
+	}
+	return interrupted, nil
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func getJob(db *sql.DB, id uint64) (meeseeks.Job, error) {
+	job := meeseeks.Job{}
+	err := scanJSON(db.QueryRow("SELECT payload FROM jobs WHERE id = ?", id), &job)
+	if err == sql.ErrNoRows {
+		return job, meeseeks.ErrNoJobWithID
+	}
+	return job, err
+}
+
+func saveJob(e execer, job meeseeks.Job) error {
+	payload, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	// Jobs created before ULIDs were introduced have none, and they can't
+	// share an empty one in the unique index
+	ulid := sql.NullString{String: job.ULID, Valid: job.ULID != ""}
+	_, err = e.Exec("UPDATE jobs SET status = ?, username = ?, channel_id = ?, ulid = ?, payload = ? WHERE id = ?",
+		job.Status, job.Request.Username, job.Request.ChannelID, ulid, string(payload), job.ID)
+	return err
+}
+
+// indexJobs fills the username and channel_id columns of the jobs that were
+// created before they existed
+func indexJobs(tx *sql.Tx, _ dialect) error {
+	pending, err := loadJobs(tx, "SELECT payload FROM jobs WHERE username IS NULL")
+	if err != nil {
+		return err
+	}
+	for _, job := range pending {
+		if err = saveJob(tx, job); err != nil {
+			return fmt.Errorf("could not index job %d: %s", job.ID, err)
+		}
+	}
+	return nil
+}
+
+// addMissingULIDs gives a ULID to the jobs that were created before they had
+// one
+func addMissingULIDs(tx *sql.Tx, _ dialect) error {
+	pending, err := loadJobs(tx, "SELECT payload FROM jobs WHERE ulid IS NULL")
+	if err != nil {
+		return err
+	}
+	for _, job := range pending {
+		job.ULID = meeseeks.NewJobULID(job.StartTime)
+		if err = saveJob(tx, job); err != nil {
+			return fmt.Errorf("could not save ulid of job %d: %s", job.ID, err)
+		}
+	}
+	return nil
+}
+
+// loadJobs loads all the jobs of a query before they are changed, as the rows
+// have to be closed to run other statements in some drivers
+func loadJobs(tx *sql.Tx, query string) ([]meeseeks.Job, error) {
+	rows, err := tx.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := make([]meeseeks.Job, 0)
+	for rows.Next() {
+		job := meeseeks.Job{}
+		if err := scanJSON(rows, &job); err != nil {
+			return nil, fmt.Errorf("failed to load Job payload %s", err)
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+func scanJSON(s scanner, v interface{}) error {
+	var payload string
+	if err := s.Scan(&payload); err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(payload), v)
+}
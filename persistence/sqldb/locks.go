@@ -0,0 +1,44 @@
+package sqldb
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+)
+
+// Locker returns the locker service, locks are shared by all the replicas
+// that use the same database
+func (s *Store) Locker() meeseeks.Locker {
+	return locks{s.db}
+}
+
+type locks struct {
+	db *sql.DB
+}
+
+// Lock implements meeseeks.Locker.Lock, the lock is taken by inserting its
+// key so only one replica can get it, expired locks are dropped first
+func (l locks) Lock(key string, ttl time.Duration) (bool, error) {
+	now := time.Now().UTC()
+	if _, err := l.db.Exec("DELETE FROM locks WHERE expires_at < ?", now.UnixNano()); err != nil {
+		return false, fmt.Errorf("could not drop expired locks: %s", err)
+	}
+
+	_, err := l.db.Exec("INSERT INTO locks (lock_key, expires_at) VALUES (?, ?)", key, now.Add(ttl).UnixNano())
+	if err == nil {
+		return true, nil
+	}
+
+	// The insert fails when another replica holds the lock
+	var expiresAt int64
+	switch lookupErr := l.db.QueryRow("SELECT expires_at FROM locks WHERE lock_key = ?", key).Scan(&expiresAt); lookupErr {
+	case nil:
+		return false, nil
+	case sql.ErrNoRows:
+		return false, fmt.Errorf("could not take lock %s: %s", key, err)
+	default:
+		return false, fmt.Errorf("could not take lock %s: %s", key, lookupErr)
+	}
+}
@@ -0,0 +1,140 @@
+package sqldb
+
+import (
+	"database/sql"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks/metrics"
+)
+
+// LogReader returns the job logs reader
+func (s *Store) LogReader() meeseeks.LogReader {
+	return logs{s.db}
+}
+
+// LogWriter returns the job logs writer
+func (s *Store) LogWriter() meeseeks.LogWriter {
+	return logs{s.db}
+}
+
+type logs struct {
+	db *sql.DB
+}
+
+// Append implements LogWriter.Append
+func (l logs) Append(jobID uint64, content string) error {
+	return l.AppendLine(jobID, meeseeks.NewLogLine(meeseeks.StdoutStream, content))
+}
+
+// AppendLine implements LogWriter.AppendLine
+func (l logs) AppendLine(jobID uint64, line meeseeks.LogLine) error {
+	if line.Text == "" {
+		return nil
+	}
+	createdAt := sql.NullInt64{Int64: line.Time.UnixNano(), Valid: !line.Time.IsZero()}
+	if _, err := l.db.Exec("INSERT INTO job_logs (job_id, created_at, stream, line) VALUES (?, ?, ?, ?)",
+		jobID, createdAt, line.Stream, line.Text); err != nil {
+		return err
+	}
+	metrics.LogLinesCount.Inc()
+	return nil
+}
+
+// SetError implements LogWriter.SetError
+func (l logs) SetError(jobID uint64, jobErr error) error {
+	if jobErr == nil {
+		return nil
+	}
+	_, err := l.db.Exec("REPLACE INTO job_errors (job_id, error) VALUES (?, ?)", jobID, jobErr.Error())
+	return err
+}
+
+// Remove implements LogRemover.Remove
+func (l logs) Remove(jobID uint64) error {
+	tx, err := l.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	lines, err := tx.Exec("DELETE FROM job_logs WHERE job_id = ?", jobID)
+	if err != nil {
+		return err
+	}
+	errs, err := tx.Exec("DELETE FROM job_errors WHERE job_id = ?", jobID)
+	if err != nil {
+		return err
+	}
+
+	removedLines, _ := lines.RowsAffected()
+	removedErrs, _ := errs.RowsAffected()
+	if removedLines+removedErrs == 0 {
+		return meeseeks.ErrNoLogsForJob
+	}
+	return tx.Commit()
+}
+
+// Get implements LogReader.Get
+func (l logs) Get(jobID uint64) (meeseeks.JobLog, error) {
+	return l.read(jobID, "SELECT created_at, stream, line FROM job_logs WHERE job_id = ? ORDER BY id", jobID)
+}
+
+// Head implements LogReader.Head
+func (l logs) Head(jobID uint64, limit int) (meeseeks.JobLog, error) {
+	return l.read(jobID, "SELECT created_at, stream, line FROM job_logs WHERE job_id = ? ORDER BY id LIMIT ?", jobID, limit)
+}
+
+// Tail implements LogReader.Tail
+func (l logs) Tail(jobID uint64, limit int) (meeseeks.JobLog, error) {
+	return l.read(jobID, `SELECT created_at, stream, line FROM (
+		SELECT id, created_at, stream, line FROM job_logs WHERE job_id = ? ORDER BY id DESC LIMIT ?
+	) last_lines ORDER BY id`, jobID, limit)
+}
+
+func (l logs) read(jobID uint64, query string, args ...interface{}) (meeseeks.JobLog, error) {
+	jobLog := meeseeks.JobLog{}
+
+	rows, err := l.db.Query(query, args...)
+	if err != nil {
+		return jobLog, err
+	}
+	defer rows.Close()
+
+	// Lines stored before they had a time and a stream have neither
+	lines := make([]meeseeks.LogLine, 0)
+	for rows.Next() {
+		var createdAt sql.NullInt64
+		var stream sql.NullString
+		line := meeseeks.LogLine{Stream: meeseeks.StdoutStream}
+		if err := rows.Scan(&createdAt, &stream, &line.Text); err != nil {
+			return jobLog, err
+		}
+		if createdAt.Valid {
+			line.Time = time.Unix(0, createdAt.Int64).UTC()
+		}
+		if stream.Valid {
+			line.Stream = stream.String
+		}
+		lines = append(lines, line)
+	}
+	if err := rows.Err(); err != nil {
+		return jobLog, err
+	}
+	jobLog.SetLines(lines)
+
+	err = l.db.QueryRow("SELECT error FROM job_errors WHERE job_id = ?", jobID).Scan(&jobLog.Error)
+	switch {
+	case err == sql.ErrNoRows && len(lines) == 0:
+		var count int
+		if err := l.db.QueryRow("SELECT COUNT(*) FROM job_logs WHERE job_id = ?", jobID).Scan(&count); err != nil {
+			return jobLog, err
+		}
+		if count == 0 {
+			return jobLog, meeseeks.ErrNoLogsForJob
+		}
+	case err != nil && err != sql.ErrNoRows:
+		return jobLog, err
+	}
+	return jobLog, nil
+}
@@ -0,0 +1,212 @@
+package sqldb
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Supported drivers
+const (
+	DriverSQLite = "sqlite"
+	DriverMySQL  = "mysql"
+)
+
+// dialect holds the bits of the schema that differ between databases
+type dialect struct {
+	driverName string
+	idColumn   string
+	keyType    string
+	maxConns   int
+}
+
+var dialects = map[string]dialect{
+	DriverSQLite: {
+		driverName: "sqlite3",
+		idColumn:   "id INTEGER PRIMARY KEY AUTOINCREMENT",
+		keyType:    "VARCHAR(255)",
+		maxConns:   1, // sqlite only allows one writer at a time
+	},
+	DriverMySQL: {
+		driverName: "mysql",
+		idColumn:   "id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY",
+		keyType:    "VARCHAR(255)",
+	},
+}
+
+// migrations are applied in order and recorded in the schema_migrations
+// table, so they must never be changed once released, only appended to.
+//
+// Most of them are statements, where $ID is replaced by the auto incremented
+// id column and $KEY by the type used for string keys. Data migrations are
+// functions that get the same transaction
+var migrations = []migration{
+	statement(`CREATE TABLE jobs (
+		$ID,
+		status VARCHAR(32) NOT NULL,
+		payload TEXT NOT NULL
+	)`),
+	statement(`CREATE INDEX jobs_status ON jobs (status)`),
+	statement(`CREATE TABLE job_logs (
+		$ID,
+		job_id BIGINT NOT NULL,
+		line TEXT NOT NULL
+	)`),
+	statement(`CREATE INDEX job_logs_job_id ON job_logs (job_id)`),
+	statement(`CREATE TABLE job_errors (
+		job_id BIGINT NOT NULL PRIMARY KEY,
+		error TEXT NOT NULL
+	)`),
+	statement(`CREATE TABLE aliases (
+		user_id $KEY NOT NULL,
+		alias $KEY NOT NULL,
+		payload TEXT NOT NULL,
+		PRIMARY KEY (user_id, alias)
+	)`),
+	statement(`CREATE TABLE api_tokens (
+		token_id $KEY NOT NULL PRIMARY KEY,
+		payload TEXT NOT NULL
+	)`),
+	statement(`CREATE TABLE audit (
+		$ID,
+		created_at BIGINT NOT NULL,
+		payload TEXT NOT NULL
+	)`),
+	statement(`CREATE TABLE group_memberships (
+		group_name $KEY NOT NULL,
+		username $KEY NOT NULL,
+		payload TEXT NOT NULL,
+		PRIMARY KEY (group_name, username)
+	)`),
+	statement(`CREATE TABLE job_labels (
+		job_id BIGINT NOT NULL,
+		name $KEY NOT NULL,
+		value $KEY NOT NULL,
+		PRIMARY KEY (job_id, name)
+	)`),
+	statement(`CREATE INDEX job_labels_name_value ON job_labels (name, value)`),
+	statement(`ALTER TABLE jobs ADD COLUMN username $KEY`),
+	statement(`ALTER TABLE jobs ADD COLUMN channel_id $KEY`),
+	statement(`CREATE INDEX jobs_username ON jobs (username)`),
+	statement(`CREATE INDEX jobs_channel_id ON jobs (channel_id)`),
+	statement(`ALTER TABLE jobs ADD COLUMN ulid $KEY`),
+	statement(`CREATE UNIQUE INDEX jobs_ulid ON jobs (ulid)`),
+	statement(`UPDATE jobs SET status = 'Succeeded' WHERE status = 'Successful'`),
+	statement(`ALTER TABLE job_logs ADD COLUMN created_at BIGINT`),
+	statement(`ALTER TABLE job_logs ADD COLUMN stream $KEY`),
+	indexJobs,
+	addMissingULIDs,
+	statement(`CREATE TABLE locks (
+		lock_key $KEY NOT NULL PRIMARY KEY,
+		expires_at BIGINT NOT NULL
+	)`),
+	statement(`CREATE TABLE identities (
+		user_id $KEY NOT NULL PRIMARY KEY,
+		payload TEXT NOT NULL
+	)`),
+	statement(`CREATE TABLE grants (
+		$ID,
+		expires_at BIGINT NOT NULL,
+		payload TEXT NOT NULL
+	)`),
+	statement(`CREATE TABLE agent_tokens (
+		name $KEY NOT NULL PRIMARY KEY,
+		payload TEXT NOT NULL
+	)`),
+	statement(`CREATE TABLE approvals (
+		$ID,
+		expires_at BIGINT NOT NULL,
+		version BIGINT NOT NULL,
+		payload TEXT NOT NULL
+	)`),
+	statement(`CREATE TABLE identity_links (
+		state $KEY NOT NULL PRIMARY KEY,
+		expires_at BIGINT NOT NULL,
+		payload TEXT NOT NULL
+	)`),
+}
+
+// migration changes the schema or the data within the transaction
+type migration func(tx *sql.Tx, d dialect) error
+
+// statement returns a migration that runs a single statement
+func statement(query string) migration {
+	return func(tx *sql.Tx, d dialect) error {
+		_, err := tx.Exec(strings.NewReplacer("$ID", d.idColumn, "$KEY", d.keyType).Replace(query))
+		return err
+	}
+}
+
+// Store provides all the persistence services backed by a SQL database
+type Store struct {
+	db *sql.DB
+}
+
+// Open connects to the database using the driver and DSN and brings the
+// schema up to date
+func Open(driver, dsn string) (*Store, error) {
+	d, ok := dialects[driver]
+	if !ok {
+		return nil, fmt.Errorf("unsupported database driver %s", driver)
+	}
+
+	db, err := sql.Open(d.driverName, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("could not open %s database: %s", driver, err)
+	}
+	if d.maxConns > 0 {
+		db.SetMaxOpenConns(d.maxConns)
+	}
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not connect to %s database: %s", driver, err)
+	}
+
+	if err = migrate(db, d); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not migrate %s database: %s", driver, err)
+	}
+	return &Store{db: db}, nil
+}
+
+// Close closes the database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+func migrate(db *sql.DB, d dialect) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER NOT NULL PRIMARY KEY
+	)`); err != nil {
+		return fmt.Errorf("could not create migrations table: %s", err)
+	}
+
+	var current int
+	if err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&current); err != nil {
+		return fmt.Errorf("could not read schema version: %s", err)
+	}
+
+	for i := current; i < len(migrations); i++ {
+		version := i + 1
+		logrus.Infof("Applying database migration %d", version)
+
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if err = migrations[i](tx, d); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d failed: %s", version, err)
+		}
+		if _, err = tx.Exec("INSERT INTO schema_migrations (version) VALUES (?)", version); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("could not record migration %d: %s", version, err)
+		}
+		if err = tx.Commit(); err != nil {
+			return fmt.Errorf("could not commit migration %d: %s", version, err)
+		}
+	}
+	return nil
+}
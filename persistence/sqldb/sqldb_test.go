@@ -0,0 +1,483 @@
+//go:build cgo
+// +build cgo
+
+package sqldb_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+	"gitlab.com/yakshaving.art/meeseeks-box/mocks"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/aliases"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/sqldb"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/tokens"
+)
+
+func withStore(t *testing.T, f func(dsn string, s *sqldb.Store)) {
+	dir, err := ioutil.TempDir("", "meeseeks-sqldb")
+	mocks.Must(t, "could not create tmp dir", err)
+	defer os.RemoveAll(dir)
+
+	dsn := path.Join(dir, "meeseeks.sqlite")
+	s, err := sqldb.Open(sqldb.DriverSQLite, dsn)
+	mocks.Must(t, "could not open sqlite store", err)
+	defer s.Close()
+
+	f(dsn, s)
+}
+
+func TestOpenUnsupportedDriver(t *testing.T) {
+	_, err := sqldb.Open("postgres", "")
+	mocks.AssertEquals(t, "unsupported database driver postgres", err.Error())
+}
+
+func TestMigrationsAreAppliedOnce(t *testing.T) {
+	withStore(t, func(dsn string, s *sqldb.Store) {
+		_, err := s.Aliases().List("someone")
+		mocks.Must(t, "could not list aliases", err)
+		mocks.Must(t, "could not create alias", s.Aliases().Create("someone", "h", "help"))
+
+		reopened, err := sqldb.Open(sqldb.DriverSQLite, dsn)
+		mocks.Must(t, "could not reopen sqlite store", err)
+		defer reopened.Close()
+
+		cmd, args, err := reopened.Aliases().Get("someone", "h")
+		mocks.Must(t, "could not get alias", err)
+		mocks.AssertEquals(t, "help", cmd)
+		mocks.AssertEquals(t, []string(nil), args)
+	})
+}
+
+func TestJobsLifecycle(t *testing.T) {
+	withStore(t, func(_ string, s *sqldb.Store) {
+		req := meeseeks.Request{Command: "echo", Username: "someone"}
+
+		_, err := s.Jobs().Get(1)
+		mocks.AssertEquals(t, meeseeks.ErrNoJobWithID, err)
+
+		first, err := s.Jobs().Create(req)
+		mocks.Must(t, "could not create job", err)
+		mocks.AssertEquals(t, uint64(1), first.ID)
+
+		second, err := s.Jobs().Create(req)
+		mocks.Must(t, "could not create job", err)
+		mocks.AssertEquals(t, uint64(2), second.ID)
+
+		mocks.Must(t, "could not succeed job", s.Jobs().Finish(first.ID, meeseeks.JobSucceededStatus))
+		mocks.AssertEquals(t, "job 1 can't go from Succeeded to Failed",
+			s.Jobs().Finish(first.ID, meeseeks.JobFailedStatus).Error())
+
+		job, err := s.Jobs().Get(first.ID)
+		mocks.Must(t, "could not get job", err)
+		mocks.AssertEquals(t, meeseeks.JobSucceededStatus, job.Status)
+		mocks.AssertEquals(t, req, job.Request)
+
+		interrupted, err := s.Jobs().InterruptRunningJobs("restarted")
+		mocks.Must(t, "could not interrupt running jobs", err)
+		mocks.AssertEquals(t, 1, len(interrupted))
+		mocks.AssertEquals(t, second.ID, interrupted[0].ID)
+		job, err = s.Jobs().Get(second.ID)
+		mocks.Must(t, "could not get job", err)
+		mocks.AssertEquals(t, meeseeks.JobInterruptedStatus, job.Status)
+		mocks.AssertEquals(t, "restarted", job.Note)
+
+		found, err := s.Jobs().Find(meeseeks.JobFilter{Limit: 1})
+		mocks.Must(t, "could not find jobs", err)
+		mocks.AssertEquals(t, 1, len(found))
+		mocks.AssertEquals(t, second.ID, found[0].ID)
+
+		found, err = s.Jobs().Find(meeseeks.JobFilter{
+			Limit: 5,
+			Match: func(j meeseeks.Job) bool { return j.Status == meeseeks.JobSucceededStatus },
+		})
+		mocks.Must(t, "could not find jobs", err)
+		mocks.AssertEquals(t, 1, len(found))
+		mocks.AssertEquals(t, first.ID, found[0].ID)
+
+		found, err = s.Jobs().Find(meeseeks.JobFilter{Limit: 5, Before: second.ID})
+		mocks.Must(t, "could not find jobs", err)
+		mocks.AssertEquals(t, 1, len(found))
+		mocks.AssertEquals(t, first.ID, found[0].ID)
+
+		_, err = s.Jobs().Create(meeseeks.Request{Command: "echo", Username: "other", ChannelID: "general"})
+		mocks.Must(t, "could not create job", err)
+		found, err = s.Jobs().Find(meeseeks.JobFilter{Limit: 5, Username: "someone"})
+		mocks.Must(t, "could not find jobs", err)
+		mocks.AssertEquals(t, 2, len(found))
+		found, err = s.Jobs().Find(meeseeks.JobFilter{Limit: 5, ChannelID: "general"})
+		mocks.Must(t, "could not find jobs", err)
+		mocks.AssertEquals(t, 1, len(found))
+		mocks.AssertEquals(t, "other", found[0].Request.Username)
+
+		queued, err := s.Jobs().Queue(req)
+		mocks.Must(t, "could not queue job", err)
+		pending, err := s.Jobs().QueuedJobs()
+		mocks.Must(t, "could not list queued jobs", err)
+		mocks.AssertEquals(t, 1, len(pending))
+		mocks.AssertEquals(t, queued.ID, pending[0].ID)
+		failed, err := s.Jobs().FailQueuedJobs("restarted")
+		mocks.Must(t, "could not fail queued jobs", err)
+		mocks.AssertEquals(t, 1, len(failed))
+		mocks.AssertEquals(t, meeseeks.JobFailedStatus, failed[0].Status)
+		pending, err = s.Jobs().QueuedJobs()
+		mocks.Must(t, "could not list queued jobs", err)
+		mocks.AssertEquals(t, 0, len(pending))
+	})
+}
+
+func TestJobLabels(t *testing.T) {
+	withStore(t, func(_ string, s *sqldb.Store) {
+		req := meeseeks.Request{Command: "echo", Username: "someone"}
+
+		prod, err := s.Jobs().Create(req)
+		mocks.Must(t, "could not create job", err)
+		staging, err := s.Jobs().Create(req)
+		mocks.Must(t, "could not create job", err)
+
+		mocks.Must(t, "could not label job", s.Jobs().AddLabels(prod.ID,
+			map[string]string{"env": "prod", "service": "billing"}))
+		mocks.Must(t, "could not label job", s.Jobs().AddLabels(staging.ID,
+			map[string]string{"env": "staging", "service": "billing"}))
+
+		job, err := s.Jobs().Get(prod.ID)
+		mocks.Must(t, "could not get job", err)
+		mocks.AssertEquals(t, map[string]string{"env": "prod", "service": "billing"}, job.Labels)
+
+		found, err := s.Jobs().Find(meeseeks.JobFilter{
+			Limit:  5,
+			Labels: map[string]string{"service": "billing"},
+		})
+		mocks.Must(t, "could not find jobs", err)
+		mocks.AssertEquals(t, 2, len(found))
+
+		found, err = s.Jobs().Find(meeseeks.JobFilter{
+			Limit:  5,
+			Labels: map[string]string{"env": "staging", "service": "billing"},
+		})
+		mocks.Must(t, "could not find jobs", err)
+		mocks.AssertEquals(t, 1, len(found))
+		mocks.AssertEquals(t, staging.ID, found[0].ID)
+	})
+}
+
+func TestJobULIDs(t *testing.T) {
+	withStore(t, func(_ string, s *sqldb.Store) {
+		first, err := s.Jobs().Create(meeseeks.Request{Command: "echo"})
+		mocks.Must(t, "could not create job", err)
+		second, err := s.Jobs().Create(meeseeks.Request{Command: "echo"})
+		mocks.Must(t, "could not create job", err)
+		mocks.AssertEquals(t, true, first.ULID < second.ULID)
+
+		job, err := s.Jobs().GetByULID(second.ULID)
+		mocks.Must(t, "could not get job by ULID", err)
+		mocks.AssertEquals(t, second.ID, job.ID)
+		mocks.AssertEquals(t, second.ULID, job.ULID)
+
+		_, err = s.Jobs().GetByULID("01ARZ3NDEKTSV4RRFFQ69G5FAV")
+		mocks.AssertEquals(t, meeseeks.ErrNoJobWithID, err)
+	})
+}
+
+func TestLogs(t *testing.T) {
+	withStore(t, func(_ string, s *sqldb.Store) {
+		_, err := s.LogReader().Get(1)
+		mocks.AssertEquals(t, meeseeks.ErrNoLogsForJob, err)
+
+		for _, line := range []string{"line1", "", "line2", "line3"} {
+			mocks.Must(t, "could not append line", s.LogWriter().Append(1, line))
+		}
+		mocks.Must(t, "could not set error", s.LogWriter().SetError(1, errors.New("failed")))
+
+		log, err := s.LogReader().Get(1)
+		mocks.Must(t, "could not get logs", err)
+		mocks.AssertEquals(t, "line1\nline2\nline3", log.Output)
+		mocks.AssertEquals(t, "failed", log.Error)
+
+		head, err := s.LogReader().Head(1, 2)
+		mocks.Must(t, "could not get head", err)
+		mocks.AssertEquals(t, "line1\nline2", head.Output)
+
+		tail, err := s.LogReader().Tail(1, 2)
+		mocks.Must(t, "could not get tail", err)
+		mocks.AssertEquals(t, "line2\nline3", tail.Output)
+
+		mocks.Must(t, "could not set error", s.LogWriter().SetError(2, errors.New("only error")))
+		log, err = s.LogReader().Get(2)
+		mocks.Must(t, "could not get logs", err)
+		mocks.AssertEquals(t, meeseeks.JobLog{Error: "only error"}, log)
+
+		remover := s.LogWriter().(meeseeks.LogRemover)
+		mocks.Must(t, "could not remove logs", remover.Remove(1))
+		mocks.AssertEquals(t, meeseeks.ErrNoLogsForJob, remover.Remove(1))
+		_, err = s.LogReader().Get(1)
+		mocks.AssertEquals(t, meeseeks.ErrNoLogsForJob, err)
+	})
+}
+
+func TestLogLines(t *testing.T) {
+	withStore(t, func(_ string, s *sqldb.Store) {
+		line := meeseeks.LogLine{
+			Time:   time.Date(2018, 1, 1, 0, 0, 1, 0, time.UTC),
+			Stream: meeseeks.StderrStream,
+			Text:   "something went wrong",
+		}
+		mocks.Must(t, "could not append line", s.LogWriter().AppendLine(1, line))
+		mocks.Must(t, "could not append line", s.LogWriter().Append(1, "but it's fine"))
+
+		log, err := s.LogReader().Get(1)
+		mocks.Must(t, "could not get logs", err)
+		mocks.AssertEquals(t, "something went wrong\nbut it's fine", log.Output)
+		mocks.AssertEquals(t, 2, len(log.Lines))
+		mocks.AssertEquals(t, line, log.Lines[0])
+		mocks.AssertEquals(t, meeseeks.StdoutStream, log.Lines[1].Stream)
+		mocks.AssertEquals(t, false, log.Lines[1].Time.IsZero())
+	})
+}
+
+func TestLocks(t *testing.T) {
+	withStore(t, func(dsn string, s *sqldb.Store) {
+		other, err := sqldb.Open(sqldb.DriverSQLite, dsn)
+		mocks.Must(t, "could not open another sqlite store", err)
+		defer other.Close()
+
+		locked, err := s.Locker().Lock("request:general:1", 50*time.Millisecond)
+		mocks.Must(t, "could not take lock", err)
+		mocks.AssertEquals(t, true, locked)
+
+		locked, err = other.Locker().Lock("request:general:1", 50*time.Millisecond)
+		mocks.Must(t, "could not take lock", err)
+		mocks.AssertEquals(t, false, locked)
+
+		time.Sleep(100 * time.Millisecond)
+		locked, err = other.Locker().Lock("request:general:1", 50*time.Millisecond)
+		mocks.Must(t, "could not take lock", err)
+		mocks.AssertEquals(t, true, locked)
+	})
+}
+
+func TestIdentities(t *testing.T) {
+	withStore(t, func(_ string, s *sqldb.Store) {
+		_, err := s.Identities().Get("U123")
+		mocks.AssertEquals(t, meeseeks.ErrNoIdentity, err)
+
+		identity := meeseeks.Identity{UserID: "U123", Username: "someone", Issuer: "https://login.example.com",
+			Subject: "00u1abcd", Email: "someone@example.com"}
+		mocks.Must(t, "could not link identity", s.Identities().Link(identity))
+		identity.Email = "someone@corp.example.com"
+		mocks.Must(t, "could not link identity again", s.Identities().Link(identity))
+
+		stored, err := s.Identities().Get("U123")
+		mocks.Must(t, "could not get identity", err)
+		mocks.AssertEquals(t, identity, stored)
+
+		mocks.Must(t, "could not unlink identity", s.Identities().Unlink("U123"))
+		mocks.AssertEquals(t, meeseeks.ErrNoIdentity, s.Identities().Unlink("U123"))
+	})
+}
+
+func TestIdentityLinks(t *testing.T) {
+	withStore(t, func(_ string, s *sqldb.Store) {
+		now := time.Now().UTC().Truncate(time.Second)
+		link := meeseeks.IdentityLink{State: "state-1", UserID: "U123", Username: "someone", ExpiresAt: now.Add(time.Minute)}
+		mocks.Must(t, "could not add link", s.Identities().AddLink(link))
+		mocks.Must(t, "could not add link", s.Identities().AddLink(meeseeks.IdentityLink{
+			State: "state-2", UserID: "U456", Username: "other", ExpiresAt: now.Add(time.Minute)}))
+
+		taken, err := s.Identities().TakeLink("state-1", now)
+		mocks.Must(t, "could not take link", err)
+		mocks.AssertEquals(t, link, taken)
+
+		_, err = s.Identities().TakeLink("state-1", now)
+		mocks.AssertEquals(t, meeseeks.ErrNoIdentityLink, err)
+		_, err = s.Identities().TakeLink("forged", now)
+		mocks.AssertEquals(t, meeseeks.ErrNoIdentityLink, err)
+
+		_, err = s.Identities().TakeLink("state-2", now.Add(2*time.Minute))
+		mocks.AssertEquals(t, meeseeks.ErrNoIdentityLink, err)
+		_, err = s.Identities().TakeLink("state-2", now)
+		mocks.AssertEquals(t, meeseeks.ErrNoIdentityLink, err)
+	})
+}
+
+func TestGrants(t *testing.T) {
+	withStore(t, func(_ string, s *sqldb.Store) {
+		now := time.Now().UTC().Truncate(time.Second)
+		expired, err := s.Grants().Create(meeseeks.Grant{Username: "someone", Kind: meeseeks.GrantGroup,
+			Target: "oncall", GrantedBy: "admin", CreatedAt: now.Add(-2 * time.Hour), ExpiresAt: now.Add(-time.Hour)})
+		mocks.Must(t, "could not create grant", err)
+		mocks.AssertEquals(t, uint64(1), expired.ID)
+
+		grant, err := s.Grants().Create(meeseeks.Grant{Username: "someone", Kind: meeseeks.GrantCommand,
+			Target: "deploy", GrantedBy: "admin", CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+		mocks.Must(t, "could not create grant", err)
+		mocks.AssertEquals(t, uint64(2), grant.ID)
+
+		grants, err := s.Grants().List(now)
+		mocks.Must(t, "could not list grants", err)
+		mocks.AssertEquals(t, []meeseeks.Grant{grant}, grants)
+
+		grants, err = s.Grants().List(now.Add(2 * time.Hour))
+		mocks.Must(t, "could not list grants", err)
+		mocks.AssertEquals(t, 0, len(grants))
+	})
+}
+
+func TestApprovals(t *testing.T) {
+	withStore(t, func(_ string, s *sqldb.Store) {
+		now := time.Now().UTC().Truncate(time.Second)
+		approval, err := s.Approvals().Create(meeseeks.Approval{
+			Request:   meeseeks.Request{Username: "someone", Command: "deploy"},
+			Opts:      meeseeks.ApprovalOpts{Group: "leads", Required: 2},
+			Approvers: []string{},
+			ExpiresAt: now.Add(time.Hour),
+		})
+		mocks.Must(t, "could not create approval", err)
+		mocks.AssertEquals(t, uint64(1), approval.ID)
+
+		for _, approver := range []string{"lead_1", "lead_2"} {
+			_, err = s.Approvals().Update(approval.ID, func(a *meeseeks.Approval) error {
+				a.Approvers = append(a.Approvers, approver)
+				return nil
+			})
+			mocks.Must(t, "could not update approval", err)
+		}
+		_, err = s.Approvals().Update(approval.ID, func(a *meeseeks.Approval) error {
+			return errors.New("rejected")
+		})
+		mocks.AssertEquals(t, "rejected", err.Error())
+
+		approval, err = s.Approvals().Get(approval.ID)
+		mocks.Must(t, "could not get approval", err)
+		mocks.AssertEquals(t, []string{"lead_1", "lead_2"}, approval.Approvers)
+		mocks.AssertEquals(t, true, approval.Approved())
+
+		approvals, err := s.Approvals().List(now)
+		mocks.Must(t, "could not list approvals", err)
+		mocks.AssertEquals(t, []meeseeks.Approval{approval}, approvals)
+		approvals, err = s.Approvals().List(now.Add(2 * time.Hour))
+		mocks.Must(t, "could not list approvals", err)
+		mocks.AssertEquals(t, 0, len(approvals))
+
+		mocks.Must(t, "could not remove approval", s.Approvals().Remove(approval.ID))
+		mocks.AssertEquals(t, meeseeks.ErrNoApproval, s.Approvals().Remove(approval.ID))
+		_, err = s.Approvals().Get(approval.ID)
+		mocks.AssertEquals(t, meeseeks.ErrNoApproval, err)
+		_, err = s.Approvals().Update(approval.ID, func(*meeseeks.Approval) error { return nil })
+		mocks.AssertEquals(t, meeseeks.ErrNoApproval, err)
+	})
+}
+
+func TestAliases(t *testing.T) {
+	withStore(t, func(_ string, s *sqldb.Store) {
+		_, _, err := s.Aliases().Get("someone", "h")
+		mocks.AssertEquals(t, aliases.ErrAliasNotFound, err)
+
+		mocks.Must(t, "could not create alias", s.Aliases().Create("someone", "h", "help", "-all"))
+		mocks.Must(t, "could not create alias", s.Aliases().Create("someone", "e", "echo"))
+		mocks.Must(t, "could not create alias", s.Aliases().Create("someone", "h", "help"))
+
+		list, err := s.Aliases().List("someone")
+		mocks.Must(t, "could not list aliases", err)
+		mocks.AssertEquals(t, []meeseeks.Alias{
+			{Alias: "e", Command: "echo"},
+			{Alias: "h", Command: "help"},
+		}, list)
+
+		mocks.Must(t, "could not remove alias", s.Aliases().Remove("someone", "e"))
+		mocks.AssertEquals(t, "alias not found", s.Aliases().Remove("someone", "e").Error())
+	})
+}
+
+func TestAPITokens(t *testing.T) {
+	withStore(t, func(_ string, s *sqldb.Store) {
+		_, err := s.APITokens().Get("none")
+		mocks.AssertEquals(t, tokens.ErrTokenNotFound, err)
+
+		scopes := meeseeks.APITokenScopes{Commands: []string{"echo"}}
+		id, err := s.APITokens().Create("@someone", "#general", "echo hi", scopes)
+		mocks.Must(t, "could not create token", err)
+
+		token, err := s.APITokens().Get(id)
+		mocks.Must(t, "could not get token", err)
+		mocks.AssertEquals(t, "@someone", token.UserLink)
+		mocks.AssertEquals(t, "echo hi", token.Text)
+		mocks.AssertEquals(t, scopes, token.Scopes)
+
+		usedAt := time.Date(2018, 5, 1, 10, 0, 0, 0, time.UTC)
+		mocks.Must(t, "could not touch token", s.APITokens().Touch(id, usedAt))
+		token, err = s.APITokens().Get(id)
+		mocks.Must(t, "could not get token", err)
+		mocks.AssertEquals(t, usedAt, token.LastUsed)
+
+		found, err := s.APITokens().Find(meeseeks.APITokenFilter{Limit: 5})
+		mocks.Must(t, "could not find tokens", err)
+		mocks.AssertEquals(t, 1, len(found))
+
+		mocks.Must(t, "could not revoke token", s.APITokens().Revoke(id))
+		mocks.AssertEquals(t, tokens.ErrTokenNotFound, s.APITokens().Revoke(id))
+	})
+}
+
+func TestAuditAndGroups(t *testing.T) {
+	withStore(t, func(_ string, s *sqldb.Store) {
+		first, err := s.Audit().Record(meeseeks.AuditEntry{
+			Decision: meeseeks.AuditAccepted, JobID: 1, Request: meeseeks.Request{Command: "echo"}})
+		mocks.Must(t, "could not record entry", err)
+		second, err := s.Audit().Record(meeseeks.AuditEntry{
+			Decision: meeseeks.AuditAccepted, JobID: 2, Request: meeseeks.Request{Command: "help"}})
+		mocks.Must(t, "could not record entry", err)
+
+		entries, err := s.Audit().Find(meeseeks.AuditFilter{Limit: 5})
+		mocks.Must(t, "could not find entries", err)
+		mocks.AssertEquals(t, 2, len(entries))
+		mocks.AssertEquals(t, second.ID, entries[0].ID)
+		mocks.AssertEquals(t, first.ID, entries[1].ID)
+
+		entries, err = s.Audit().Find(meeseeks.AuditFilter{Limit: 5, Since: second.Time})
+		mocks.Must(t, "could not find entries", err)
+		mocks.AssertEquals(t, 1, len(entries))
+		mocks.AssertEquals(t, uint64(2), entries[0].JobID)
+
+		mocks.Must(t, "could not add user", s.Groups().Add("admin", "someone"))
+		mocks.Must(t, "could not remove user", s.Groups().Remove("developer", "someone"))
+		mocks.Must(t, "could not add user", s.Groups().Add("developer", "someone"))
+
+		memberships, err := s.Groups().List()
+		mocks.Must(t, "could not list memberships", err)
+		mocks.AssertEquals(t, []meeseeks.GroupMembership{
+			{Group: "admin", Username: "someone", Member: true},
+			{Group: "developer", Username: "someone", Member: true},
+		}, memberships)
+	})
+}
+
+func TestAgentTokens(t *testing.T) {
+	withStore(t, func(_ string, s *sqldb.Store) {
+		_, err := s.AgentTokens().Get("builder")
+		mocks.AssertEquals(t, meeseeks.ErrNoAgentToken, err)
+
+		now := time.Now().UTC().Truncate(time.Second)
+		builder := meeseeks.AgentToken{Name: "builder", Hash: "first", CreatedBy: "admin", CreatedAt: now}
+		mocks.Must(t, "could not save agent token", s.AgentTokens().Save(builder))
+		builder.Hash = "rotated"
+		mocks.Must(t, "could not save agent token again", s.AgentTokens().Save(builder))
+		deployer := meeseeks.AgentToken{Name: "deployer", Hash: "other", CreatedBy: "admin", CreatedAt: now}
+		mocks.Must(t, "could not save agent token", s.AgentTokens().Save(deployer))
+
+		stored, err := s.AgentTokens().Get("builder")
+		mocks.Must(t, "could not get agent token", err)
+		mocks.AssertEquals(t, builder, stored)
+
+		tokens, err := s.AgentTokens().List()
+		mocks.Must(t, "could not list agent tokens", err)
+		mocks.AssertEquals(t, []meeseeks.AgentToken{builder, deployer}, tokens)
+
+		mocks.Must(t, "could not revoke agent token", s.AgentTokens().Revoke("builder"))
+		mocks.AssertEquals(t, meeseeks.ErrNoAgentToken, s.AgentTokens().Revoke("builder"))
+	})
+}
@@ -0,0 +1,8 @@
+//go:build cgo
+// +build cgo
+
+package sqldb
+
+import (
+	_ "github.com/mattn/go-sqlite3" // registers the sqlite3 driver, it requires cgo
+)
@@ -0,0 +1,115 @@
+package sqldb
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/tokens"
+
+	"github.com/google/uuid"
+)
+
+// APITokens returns the API tokens service
+func (s *Store) APITokens() meeseeks.APITokens {
+	return tokensStore{s.db}
+}
+
+type tokensStore struct {
+	db *sql.DB
+}
+
+// Create creates a new token persistence record and returns the created token.
+func (t tokensStore) Create(userLink, channelLink, text string, scopes meeseeks.APITokenScopes) (string, error) {
+	token := meeseeks.APIToken{
+		TokenID:     uuid.New().String(),
+		UserLink:    userLink,
+		ChannelLink: channelLink,
+		Text:        text,
+		CreatedOn:   time.Now(),
+		Scopes:      scopes,
+	}
+	payload, err := json.Marshal(token)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal token: %s", err)
+	}
+	_, err = t.db.Exec("INSERT INTO api_tokens (token_id, payload) VALUES (?, ?)", token.TokenID, string(payload))
+	return token.TokenID, err
+}
+
+// Get returns the token given an ID, it may return ErrTokenNotFound when there is no such token
+func (t tokensStore) Get(tokenID string) (meeseeks.APIToken, error) {
+	token := meeseeks.APIToken{}
+	err := scanJSON(t.db.QueryRow("SELECT payload FROM api_tokens WHERE token_id = ?", tokenID), &token)
+	if err == sql.ErrNoRows {
+		return token, tokens.ErrTokenNotFound
+	}
+	return token, err
+}
+
+// Revoke destroys a token by ID
+func (t tokensStore) Revoke(tokenID string) error {
+	res, err := t.db.Exec("DELETE FROM api_tokens WHERE token_id = ?", tokenID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return tokens.ErrTokenNotFound
+	}
+	return nil
+}
+
+// Touch records when the token was last used
+func (t tokensStore) Touch(tokenID string, usedAt time.Time) error {
+	tx, err := t.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	token := meeseeks.APIToken{}
+	err = scanJSON(tx.QueryRow("SELECT payload FROM api_tokens WHERE token_id = ?", tokenID), &token)
+	if err == sql.ErrNoRows {
+		return tokens.ErrTokenNotFound
+	}
+	if err != nil {
+		return err
+	}
+	token.LastUsed = usedAt
+
+	payload, err := json.Marshal(token)
+	if err != nil {
+		return fmt.Errorf("could not marshal token: %s", err)
+	}
+	if _, err = tx.Exec("UPDATE api_tokens SET payload = ? WHERE token_id = ?", string(payload), tokenID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Find returns a list of tokens that match the filter
+func (t tokensStore) Find(filter meeseeks.APITokenFilter) ([]meeseeks.APIToken, error) {
+	if filter.Match == nil {
+		filter.Match = func(_ meeseeks.APIToken) bool { return true }
+	}
+
+	list := make([]meeseeks.APIToken, 0)
+	rows, err := t.db.Query("SELECT payload FROM api_tokens ORDER BY token_id")
+	if err != nil {
+		return list, err
+	}
+	defer rows.Close()
+
+	for len(list) < filter.Limit && rows.Next() {
+		token := meeseeks.APIToken{}
+		if err := scanJSON(rows, &token); err != nil {
+			return list, err
+		}
+		if filter.Match(token) {
+			list = append(list, token)
+		}
+	}
+	return list, rows.Err()
+}
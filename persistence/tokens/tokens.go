@@ -22,8 +22,8 @@ var ErrTokenNotFound = fmt.Errorf("no token found")
 type Tokens struct{}
 
 // Create gets a new token request and creates a token persistence record. It returns the created token.
-func (Tokens) Create(userLink, channelLink, text string) (string, error) {
-	return create(userLink, channelLink, text)
+func (Tokens) Create(userLink, channelLink, text string, scopes meeseeks.APITokenScopes) (string, error) {
+	return create(userLink, channelLink, text, scopes)
 }
 
 // Get returns the token given an ID, it may return ErrTokenNotFound when there is no such token
@@ -36,12 +36,17 @@ func (Tokens) Revoke(tokenID string) error {
 	return revoke(tokenID)
 }
 
+// Touch records when the token was last used
+func (Tokens) Touch(tokenID string, usedAt time.Time) error {
+	return touch(tokenID, usedAt)
+}
+
 // Find returns a list of tokens that match the filter
 func (Tokens) Find(filter meeseeks.APITokenFilter) ([]meeseeks.APIToken, error) {
 	return find(filter)
 }
 
-func create(userLink, channelLink, text string) (string, error) {
+func create(userLink, channelLink, text string, scopes meeseeks.APITokenScopes) (string, error) {
 	token := uuid.New().String()
 
 	err := db.Update(func(tx *bolt.Tx) error {
@@ -56,6 +61,7 @@ func create(userLink, channelLink, text string) (string, error) {
 			ChannelLink: channelLink,
 			Text:        text,
 			CreatedOn:   time.Now(),
+			Scopes:      scopes,
 		}
 		tb, err := json.Marshal(t)
 		if err != nil {
@@ -97,6 +103,31 @@ func revoke(tokenID string) error {
 	})
 }
 
+func touch(tokenID string, usedAt time.Time) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(tokensBucketKey)
+		if bucket == nil {
+			return ErrTokenNotFound
+		}
+
+		payload := bucket.Get([]byte(tokenID))
+		if payload == nil {
+			return ErrTokenNotFound
+		}
+		token := meeseeks.APIToken{}
+		if err := json.Unmarshal(payload, &token); err != nil {
+			return err
+		}
+		token.LastUsed = usedAt
+
+		tb, err := json.Marshal(token)
+		if err != nil {
+			return fmt.Errorf("could not marshal token: %s", err)
+		}
+		return bucket.Put([]byte(tokenID), tb)
+	})
+}
+
 // Find returns a list of tokens that match the filter
 func find(filter meeseeks.APITokenFilter) ([]meeseeks.APIToken, error) {
 	if filter.Match == nil {
@@ -2,6 +2,7 @@ package tokens_test
 
 import (
 	"testing"
+	"time"
 
 	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
 	"gitlab.com/yakshaving.art/meeseeks-box/mocks"
@@ -28,6 +29,7 @@ func Test_TokenLifecycle(t *testing.T) {
 			"myuser",
 			"mychannel",
 			"echo hello",
+			meeseeks.APITokenScopes{},
 		)
 		mocks.Must(t, "could not create token", err)
 		if id == "" {
@@ -41,8 +43,16 @@ func Test_TokenLifecycle(t *testing.T) {
 		mocks.AssertEquals(t, "myuser", tk.UserLink)
 		mocks.AssertEquals(t, "mychannel", tk.ChannelLink)
 		mocks.AssertEquals(t, "echo hello", tk.Text)
+		mocks.AssertEquals(t, true, tk.LastUsed.IsZero())
+
+		usedAt := time.Date(2018, 5, 1, 10, 0, 0, 0, time.UTC)
+		mocks.Must(t, "could not touch token", persistence.APITokens().Touch(id, usedAt))
+		tk, err = persistence.APITokens().Get(id)
+		mocks.Must(t, "could not get token back", err)
+		mocks.AssertEquals(t, usedAt, tk.LastUsed)
 
 		mocks.Must(t, "could not revoke token", persistence.APITokens().Revoke(id))
+		mocks.AssertEquals(t, tokens.ErrTokenNotFound, persistence.APITokens().Touch(id, usedAt))
 	})
 }
 
@@ -52,6 +62,7 @@ func Test_TokenListing(t *testing.T) {
 			"echo something",
 			"myuser",
 			"mychannel",
+			meeseeks.APITokenScopes{},
 		)
 		mocks.Must(t, "could not create token", err)
 
@@ -62,6 +73,7 @@ func Test_TokenListing(t *testing.T) {
 			"echo something else",
 			"someone_else",
 			"my_other_channel",
+			meeseeks.APITokenScopes{},
 		)
 		mocks.Must(t, "could not create token", err)
 
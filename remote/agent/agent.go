@@ -9,7 +9,7 @@ import (
 
 	"gitlab.com/yakshaving.art/meeseeks-box/commands"
 	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
-	"gitlab.com/yakshaving.art/meeseeks-box/persistence"
+	"gitlab.com/yakshaving.art/meeseeks-box/remote/agenttokens"
 	"gitlab.com/yakshaving.art/meeseeks-box/remote/api"
 
 	"github.com/google/uuid"
@@ -36,24 +36,55 @@ type RemoteClient struct {
 	ctx        context.Context
 	cancelFunc context.CancelFunc
 
-	agentID string
+	agentID   string
+	stats     *agentStats
+	jobs      *jobRegistry
+	backlog   *backlog
+	logWriter grpcLogWriter
 }
 
 // New creates a new remote requester
 func New(c Configuration) *RemoteClient {
 	logrus.Debugf("creating new remote agent with configuration %#v", c)
 	return &RemoteClient{
-		agentID: uuid.New().String(),
+		agentID: agenttokens.AgentID(c.GetToken(), uuid.New().String()),
 		config:  c,
 		wg:      sync.WaitGroup{},
+		stats:   &agentStats{},
+		jobs:    newJobRegistry(),
+		backlog: newBacklog(c.GetBacklogSize()),
 	}
 }
 
+// agentCredentials sends the id of the agent and its token with every call,
+// so the server checks them on each of them and not only on registration
+type agentCredentials struct {
+	agentID string
+	config  Configuration
+}
+
+func (a agentCredentials) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	return map[string]string{
+		api.AgentIDMetadataKey: a.agentID,
+		api.TokenMetadataKey:   a.config.GetToken(),
+	}, nil
+}
+
+// RequireTransportSecurity is false as agents can connect in insecure mode,
+// where the token is sent in the clear when registering anyway
+func (agentCredentials) RequireTransportSecurity() bool {
+	return false
+}
+
 // Connect creates a connection to the remote server
 func (r *RemoteClient) Connect() error {
 	logrus.Debugf("connecting to remote server: %s", r.config.ServerURL)
 
-	c, err := grpc.Dial(r.config.ServerURL, r.config.GetOptions()...)
+	opts := append(r.config.GetOptions(), grpc.WithPerRPCCredentials(agentCredentials{
+		agentID: r.agentID,
+		config:  r.config,
+	}))
+	c, err := grpc.Dial(r.config.ServerURL, opts...)
 	if err != nil {
 		return fmt.Errorf("could not connect to remote server %s: %s", r.config.ServerURL, err)
 	}
@@ -62,16 +93,12 @@ func (r *RemoteClient) Connect() error {
 	r.cmdClient = api.NewCommandPipelineClient(c)
 	r.logClient = api.NewLogWriterClient(c)
 	r.grpcClient = c
-
-	persistence.Register(
-		persistence.Providers{
-			LogReader: nullReader{},
-			LogWriter: grpcLogWriter{
-				client:         r.logClient,
-				timeoutSeconds: r.config.GetGRPCTimeout(),
-			},
-		},
-	)
+	r.logWriter = grpcLogWriter{
+		client:         r.logClient,
+		timeoutSeconds: r.config.GetRPCTimeout(),
+		backlog:        r.backlog,
+	}
+	r.registerLogWriter()
 
 	return nil
 }
@@ -83,6 +110,22 @@ func (r *RemoteClient) Reconnect() {
 	r.cancelFunc()
 }
 
+// UpdateCommands sends the commands the agent has now to the server, which
+// registers the ones it added and unregisters the ones it removed without the
+// agent registering again
+func (r *RemoteClient) UpdateCommands() error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.config.GetRPCTimeout())
+	defer cancel()
+
+	if _, err := r.cmdClient.UpdateCommands(ctx, &api.AgentCommands{
+		AgentID:  r.agentID,
+		Commands: r.config.createRemoteCommands(),
+	}); err != nil {
+		return fmt.Errorf("could not update the commands of the agent in remote server %s: %s", r.config.ServerURL, err)
+	}
+	return nil
+}
+
 // Run registers this agent in the remote server and launches a command stream to listen for commands to run
 func (r *RemoteClient) Run() {
 
@@ -92,7 +135,15 @@ func (r *RemoteClient) Run() {
 		Factor: 2,
 		Jitter: true,
 	}
+	// Rejected tokens are retried for as long as it takes to replace them
+	authBackoff := &backoff.Backoff{
+		Min:    1 * time.Second,
+		Max:    1 * time.Minute,
+		Factor: 2,
+		Jitter: true,
+	}
 	r.ctx, r.cancelFunc = context.WithCancel(context.Background())
+	go r.sendHeartbeats(r.ctx)
 
 Service:
 	for {
@@ -121,12 +172,22 @@ Service:
 			switch s {
 			case codes.OK:
 				logrus.Debugf("all is good, continue")
+				authBackoff.Reset()
 
 			case codes.Unavailable:
 				logrus.Infof("server is unavailable, reconnecting...")
 				time.Sleep(time.Millisecond)
 				continue Service
 
+			case codes.Unauthenticated:
+				logrus.Warnf("server rejected the agent token: %s, registering again with the current token", err)
+				select {
+				case <-r.ctx.Done():
+					return
+				case <-time.After(authBackoff.Duration()):
+				}
+				continue Service
+
 			case codes.Canceled:
 				logrus.Infof("cancelled, quitting")
 				return
@@ -137,17 +198,78 @@ Service:
 
 			}
 
+			if cmd.GetCancel() {
+				logrus.Infof("job %d was cancelled by the server", cmd.GetJobID())
+				r.jobs.cancel(cmd.GetJobID())
+				continue
+			}
 			logrus.Debugf("received command from pipeline: %#v", cmd)
 
+			// The job is known before the next message, which can cancel it
+			job, first, err := r.jobs.start(*cmd, r)
 			r.wg.Add(1)
-			go r.runCommand(*cmd)
+			go r.runCommand(*cmd, job, first, err)
 		}
 	}
 }
 
-func (r *RemoteClient) runCommand(cmd api.CommandRequest) {
+// sendHeartbeats tells the server the agent is alive, and how many jobs it
+// ran, until the context is done, the server unregisters the agent when they
+// stop coming. Once the server gets them again, the agent is registered and
+// what it missed is replayed
+func (r *RemoteClient) sendHeartbeats(ctx context.Context) {
+	ticker := time.NewTicker(r.config.GetHeartbeatInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		beatCtx, cancel := context.WithTimeout(ctx, r.config.GetRPCTimeout())
+		_, err := r.cmdClient.Heartbeat(beatCtx, r.stats.heartbeat(r.agentID))
+		cancel()
+		if err != nil {
+			logrus.Debugf("failed to send heartbeat to remote server: %s", err)
+			continue
+		}
+		r.replayBacklog(ctx)
+	}
+}
+
+// runCommand runs the job the registry started, or waits for it when another
+// server sent it first
+func (r *RemoteClient) runCommand(cmd api.CommandRequest, job *sharedJob, first bool, err error) {
 	defer r.wg.Done()
 
+	if err != nil {
+		logrus.Warnf("rejected job %d: %s", cmd.GetJobID(), err)
+		r.finish(&api.CommandFinish{
+			AgentID: r.agentID,
+			JobID:   cmd.GetJobID(),
+			Error:   err.Error(),
+		})
+		return
+	}
+	if !first {
+		logrus.Infof("job %d was sent by another server too, waiting for it to finish", cmd.GetJobID())
+		content, errString, err := job.wait(r.ctx)
+		if err != nil {
+			return
+		}
+		r.finish(&api.CommandFinish{
+			AgentID: r.agentID,
+			JobID:   cmd.GetJobID(),
+			Content: content,
+			Error:   errString,
+		})
+		return
+	}
+
+	r.stats.start()
+
 	// add a metric to account for remotely received commands
 	rq := meeseeks.Request{
 		Command:     cmd.Command,
@@ -164,13 +286,13 @@ func (r *RemoteClient) runCommand(cmd api.CommandRequest) {
 	logrus.Debugf("executing request: %#v", rq)
 	localCmd, ok := commands.Find(&rq)
 	if !ok {
-		ctx, cancel := context.WithTimeout(r.ctx, r.config.GetGRPCTimeout())
-		defer cancel()
-
-		r.cmdClient.Finish(ctx, &api.CommandFinish{
+		errString := fmt.Sprintf("could not find command %s in remote agent", cmd.GetCommand())
+		r.stats.finish(true)
+		r.jobs.finish(cmd.GetJobID(), "", errString)
+		r.finish(&api.CommandFinish{
 			AgentID: r.agentID,
 			JobID:   cmd.GetJobID(),
-			Error:   fmt.Sprintf("could not find command %s in remote agent", cmd.GetCommand()),
+			Error:   errString,
 		})
 		return
 	}
@@ -178,6 +300,7 @@ func (r *RemoteClient) runCommand(cmd api.CommandRequest) {
 	logrus.Debugf("found command %#v", localCmd)
 	ctx, cancelShellCmd := context.WithTimeout(r.ctx, localCmd.GetTimeout())
 	defer cancelShellCmd()
+	r.jobs.running(cmd.GetJobID(), cancelShellCmd)
 
 	content, err := localCmd.Execute(ctx, meeseeks.Job{
 		ID:        cmd.GetJobID(),
@@ -186,16 +309,21 @@ func (r *RemoteClient) runCommand(cmd api.CommandRequest) {
 		StartTime: time.Now(),
 	})
 
+	r.stats.finish(err != nil)
+
 	var errString string
 	if err != nil {
 		errString = err.Error()
 	}
+	r.jobs.finish(cmd.GetJobID(), content, errString)
 
-	ctx, cancel := context.WithTimeout(r.ctx, r.config.GetGRPCTimeout())
-	defer cancel()
+	if ctx.Err() == context.Canceled && r.ctx.Err() == nil {
+		logrus.Infof("job %d was cancelled, the server is not waiting for it", cmd.GetJobID())
+		return
+	}
 
 	logrus.Debugf("sending command finish event %#v", cmd)
-	r.cmdClient.Finish(ctx, &api.CommandFinish{
+	r.finish(&api.CommandFinish{
 		AgentID: r.agentID,
 		JobID:   cmd.GetJobID(),
 		Content: content,
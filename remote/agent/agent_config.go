@@ -1,31 +1,90 @@
 package agent
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
 	"time"
 
 	"gitlab.com/yakshaving.art/meeseeks-box/commands"
 	"gitlab.com/yakshaving.art/meeseeks-box/remote/api"
+	"gitlab.com/yakshaving.art/meeseeks-box/version"
 
 	"github.com/grpc-ecosystem/go-grpc-prometheus"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding/gzip"
 	"google.golang.org/grpc/keepalive"
 )
 
 // SecurityModeTLS means TLS security mode with server cert
 const SecurityModeTLS = "tls"
 
+// SecurityModeMTLS means mutual TLS, the agent presents its own cert and
+// validates the one of the server with the CA
+const SecurityModeMTLS = "mtls"
+
+// CompressionGzip compresses the messages with gzip
+const CompressionGzip = "gzip"
+
+// CompressionNone sends the messages as they are, the default
+const CompressionNone = "none"
+
 // Configuration holds the client configuration used to connect to the server
+//
+// Compression is how the messages to the server are compressed, none or gzip,
+// and MaxMessageSize the largest message in bytes the agent sends or receives,
+// like the output of a command, 4MB when it's 0
+//
+// KeepaliveTime is how often the agent pings the server while the connection
+// is idle, every 5 seconds by default, so the NATs and firewalls in between
+// don't drop it, and KeepaliveTimeout how long it waits for the answer before
+// it takes the connection as gone. DialTimeout is how long connecting to the
+// server can take and RPCTimeout the deadline of each call to it, like a
+// heartbeat. GRPCTimeout is the one of all of them that are not set, 10
+// seconds by default
 type Configuration struct {
 	ServerURL   string
 	GRPCTimeout time.Duration
 
+	KeepaliveTime    time.Duration
+	KeepaliveTimeout time.Duration
+	DialTimeout      time.Duration
+	RPCTimeout       time.Duration
+
+	HeartbeatInterval time.Duration
+	BacklogSize       int
+
+	Compression    string
+	MaxMessageSize int
+
 	SecurityMode string
 	CertPath     string
+	KeyPath      string
+	CAPath       string
+
+	Token     string
+	TokenFile string
+	Labels    map[string]string
+}
 
-	Token  string
-	Labels map[string]string
+// GetToken returns the token to register with, read from the token file
+// every time so a rotated token is picked up without a restart
+func (c *Configuration) GetToken() string {
+	if c.TokenFile == "" {
+		return c.Token
+	}
+	b, err := ioutil.ReadFile(c.TokenFile)
+	if err != nil {
+		logrus.Errorf("could not read agent token file: %s", err)
+		return c.Token
+	}
+	return strings.TrimSpace(string(b))
 }
 
 // GetGRPCTimeout returns the configured timeout or a default of 10 seconds
@@ -36,21 +95,83 @@ func (c *Configuration) GetGRPCTimeout() time.Duration {
 	return c.GRPCTimeout
 }
 
+// GetKeepaliveTime returns how often the server is pinged while the
+// connection is idle, by default every 5 seconds
+func (c *Configuration) GetKeepaliveTime() time.Duration {
+	if c.KeepaliveTime == 0 {
+		return 5 * time.Second
+	}
+	return c.KeepaliveTime
+}
+
+// GetKeepaliveTimeout returns how long to wait for the answer to a ping
+func (c *Configuration) GetKeepaliveTimeout() time.Duration {
+	if c.KeepaliveTimeout == 0 {
+		return c.GetGRPCTimeout()
+	}
+	return c.KeepaliveTimeout
+}
+
+// GetDialTimeout returns how long connecting to the server can take
+func (c *Configuration) GetDialTimeout() time.Duration {
+	if c.DialTimeout == 0 {
+		return c.GetGRPCTimeout()
+	}
+	return c.DialTimeout
+}
+
+// GetRPCTimeout returns the deadline of each call to the server
+func (c *Configuration) GetRPCTimeout() time.Duration {
+	if c.RPCTimeout == 0 {
+		return c.GetGRPCTimeout()
+	}
+	return c.RPCTimeout
+}
+
+// GetHeartbeatInterval returns how often the agent tells the server it's
+// alive, by default every 10 seconds
+func (c *Configuration) GetHeartbeatInterval() time.Duration {
+	if c.HeartbeatInterval <= 0 {
+		return 10 * time.Second
+	}
+	return c.HeartbeatInterval
+}
+
+// GetBacklogSize returns how many log lines are kept while the server can't
+// be reached, by default 10000
+func (c *Configuration) GetBacklogSize() int {
+	if c.BacklogSize <= 0 {
+		return DefaultBacklogSize
+	}
+	return c.BacklogSize
+}
+
 // GetOptions returns the grpc connection options
 func (c *Configuration) GetOptions() []grpc.DialOption {
 	opts := []grpc.DialOption{
 		grpc.WithKeepaliveParams(
 			keepalive.ClientParameters{
-				Time:                5 * time.Second,
+				Time:                c.GetKeepaliveTime(),
 				PermitWithoutStream: true,
-				Timeout:             c.GetGRPCTimeout(),
+				Timeout:             c.GetKeepaliveTimeout(),
 			},
 		),
 		grpc.WithBackoffMaxDelay(5 * time.Second),
-		grpc.WithTimeout(c.GetGRPCTimeout()),
+		grpc.WithTimeout(c.GetDialTimeout()),
 		grpc.WithUnaryInterceptor(grpc_prometheus.UnaryClientInterceptor),
 		grpc.WithStreamInterceptor(grpc_prometheus.StreamClientInterceptor),
 	}
+	callOptions := []grpc.CallOption{}
+	if c.Compression == CompressionGzip {
+		callOptions = append(callOptions, grpc.UseCompressor(gzip.Name))
+	}
+	if c.MaxMessageSize > 0 {
+		callOptions = append(callOptions,
+			grpc.MaxCallRecvMsgSize(c.MaxMessageSize),
+			grpc.MaxCallSendMsgSize(c.MaxMessageSize))
+	}
+	opts = append(opts, grpc.WithDefaultCallOptions(callOptions...))
+
 	switch c.SecurityMode {
 	case SecurityModeTLS:
 		creds, err := credentials.NewClientTLSFromFile(c.CertPath, "")
@@ -59,6 +180,13 @@ func (c *Configuration) GetOptions() []grpc.DialOption {
 		}
 		opts = append(opts, grpc.WithTransportCredentials(creds))
 
+	case SecurityModeMTLS:
+		tlsConfig, err := c.mutualTLSConfig()
+		if err != nil {
+			logrus.Fatalf("could not load mtls credentials: %s", err)
+		}
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+
 	default:
 		logrus.Warnf("using insecure client mode")
 		opts = append(opts, grpc.WithInsecure())
@@ -66,12 +194,80 @@ func (c *Configuration) GetOptions() []grpc.DialOption {
 	return opts
 }
 
+// Validate checks that the security mode is known and that its certs and the
+// token file can be read
+func (c *Configuration) Validate() error {
+	switch c.SecurityMode {
+	case "", "insecure":
+	case SecurityModeTLS:
+		if _, err := credentials.NewClientTLSFromFile(c.CertPath, ""); err != nil {
+			return fmt.Errorf("could not load server cert: %s", err)
+		}
+	case SecurityModeMTLS:
+		if _, err := c.mutualTLSConfig(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid security mode %s, it can be insecure, tls or mtls", c.SecurityMode)
+	}
+	if c.TokenFile != "" {
+		if _, err := ioutil.ReadFile(c.TokenFile); err != nil {
+			return fmt.Errorf("could not read agent token file: %s", err)
+		}
+	}
+	switch c.Compression {
+	case "", CompressionNone, CompressionGzip:
+	default:
+		return fmt.Errorf("invalid compression %s, it can be none or gzip", c.Compression)
+	}
+	if c.MaxMessageSize < 0 {
+		return fmt.Errorf("max message size can't be negative")
+	}
+	for _, timeout := range []time.Duration{c.GRPCTimeout, c.KeepaliveTime, c.KeepaliveTimeout, c.DialTimeout, c.RPCTimeout} {
+		if timeout < 0 {
+			return fmt.Errorf("keepalives and timeouts can't be negative")
+		}
+	}
+	return nil
+}
+
+// mutualTLSConfig loads the cert of the agent and the CA the cert of the
+// server has to be signed by
+func (c *Configuration) mutualTLSConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertPath, c.KeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not load agent cert: %s", err)
+	}
+	ca, err := ioutil.ReadFile(c.CAPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not read CA cert: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certs found in CA file %s", c.CAPath)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+	}, nil
+}
+
+// createAgentConfiguration returns what the agent registers with, which
+// includes where it runs and its version
 func (c *Configuration) createAgentConfiguration(agentID string) *api.AgentConfiguration {
+	hostname, err := os.Hostname()
+	if err != nil {
+		logrus.Warnf("could not get the hostname to register with: %s", err)
+	}
 	return &api.AgentConfiguration{
 		Commands: c.createRemoteCommands(),
 		Labels:   c.Labels,
-		Token:    c.Token,
+		Token:    c.GetToken(),
 		AgentID:  agentID,
+		Os:       runtime.GOOS,
+		Arch:     runtime.GOARCH,
+		Hostname: hostname,
+		Version:  version.Version,
 	}
 }
 
@@ -1,6 +1,8 @@
 package agent_test
 
 import (
+	"io/ioutil"
+	"os"
 	"testing"
 	"time"
 
@@ -70,3 +72,87 @@ func TestAgentTLSCanConnectAndRegisterACommand(t *testing.T) {
 
 	client.Shutdown()
 }
+
+func TestAgentMTLSCanConnectAndRegisterACommand(t *testing.T) {
+	s, err := server.New(server.Config{
+		SecurityMode: server.SecurityModeMTLS,
+		CertPath:     "../../config/test-fixtures/mtls/server.pem",
+		KeyPath:      "../../config/test-fixtures/mtls/server-key.pem",
+		CAPath:       "../../config/test-fixtures/mtls/ca.pem",
+	})
+	mocks.Must(t, "failed to create grpc server", err)
+	defer s.Shutdown()
+
+	go func() {
+		mocks.Must(t, "Failed to start server", s.Listen("localhost:9702"))
+	}()
+
+	client := agent.New(agent.Configuration{
+		GRPCTimeout:  1 * time.Second,
+		ServerURL:    "localhost:9702",
+		SecurityMode: agent.SecurityModeMTLS,
+		CertPath:     "../../config/test-fixtures/mtls/agent.pem",
+		KeyPath:      "../../config/test-fixtures/mtls/agent-key.pem",
+		CAPath:       "../../config/test-fixtures/mtls/ca.pem",
+		Labels:       map[string]string{"tier": "testing"},
+	})
+	mocks.Must(t, "failed to connect agent", client.Connect())
+
+	w := make(chan interface{})
+	go func() {
+		w <- true
+		client.Run()
+	}()
+	<-w
+
+	time.Sleep(1 * time.Millisecond)
+
+	client.Shutdown()
+}
+
+func TestAgentTokenIsReadFromTheFileEveryTime(t *testing.T) {
+	f, err := ioutil.TempFile("", "agent-token")
+	mocks.Must(t, "could not create token file", err)
+	defer os.Remove(f.Name())
+
+	c := agent.Configuration{Token: "null-token", TokenFile: f.Name()}
+	mocks.Must(t, "could not write token", ioutil.WriteFile(f.Name(), []byte("builder.first\n"), 0600))
+	mocks.AssertEquals(t, "builder.first", c.GetToken())
+
+	mocks.Must(t, "could not write token", ioutil.WriteFile(f.Name(), []byte("builder.rotated\n"), 0600))
+	mocks.AssertEquals(t, "builder.rotated", c.GetToken())
+}
+
+func TestAgentSettingsAreValidated(t *testing.T) {
+	c := agent.Configuration{
+		SecurityMode: agent.SecurityModeMTLS,
+		CertPath:     "../../config/test-fixtures/mtls/agent.pem",
+		KeyPath:      "../../config/test-fixtures/mtls/agent-key.pem",
+		CAPath:       "../../config/test-fixtures/mtls/ca.pem",
+	}
+	mocks.Must(t, "mtls settings should be valid", c.Validate())
+
+	c.TokenFile = "/non-existing/token"
+	mocks.AssertEquals(t, "could not read agent token file: open /non-existing/token: no such file or directory",
+		c.Validate().Error())
+
+	c = agent.Configuration{SecurityMode: "ssl"}
+	mocks.AssertEquals(t, "invalid security mode ssl, it can be insecure, tls or mtls", c.Validate().Error())
+
+	c = agent.Configuration{Compression: "zstd"}
+	mocks.AssertEquals(t, "invalid compression zstd, it can be none or gzip", c.Validate().Error())
+
+	c = agent.Configuration{MaxMessageSize: -1}
+	mocks.AssertEquals(t, "max message size can't be negative", c.Validate().Error())
+
+	c = agent.Configuration{RPCTimeout: -time.Second}
+	mocks.AssertEquals(t, "keepalives and timeouts can't be negative", c.Validate().Error())
+}
+
+func TestKeepalivesAndTimeoutsFallBackToTheGRPCTimeout(t *testing.T) {
+	c := agent.Configuration{GRPCTimeout: 3 * time.Second, RPCTimeout: time.Second}
+	mocks.AssertEquals(t, 5*time.Second, c.GetKeepaliveTime())
+	mocks.AssertEquals(t, 3*time.Second, c.GetKeepaliveTimeout())
+	mocks.AssertEquals(t, 3*time.Second, c.GetDialTimeout())
+	mocks.AssertEquals(t, time.Second, c.GetRPCTimeout())
+}
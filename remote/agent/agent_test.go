@@ -3,7 +3,9 @@ package agent_test
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
 	"sync"
 	"testing"
 	"time"
@@ -22,6 +24,8 @@ import (
 
 var wg = sync.WaitGroup{}
 var ch = make(chan api.CommandFinish)
+var beats = make(chan api.AgentHeartbeat, 1)
+var updates = make(chan api.AgentCommands, 1)
 
 func init() {
 	logrus.AddHook(filename.NewHook())
@@ -85,6 +89,23 @@ func (m MockServer) Finish(ctx context.Context, fin *api.CommandFinish) (*api.Em
 	return &api.Empty{}, nil
 }
 
+func (m MockServer) Heartbeat(ctx context.Context, beat *api.AgentHeartbeat) (*api.Empty, error) {
+	select {
+	case beats <- *beat:
+	default:
+	}
+	return &api.Empty{}, nil
+}
+
+func (m MockServer) UpdateCommands(ctx context.Context, in *api.AgentCommands) (*api.Empty, error) {
+	updates <- *in
+	return &api.Empty{}, nil
+}
+
+func (m MockServer) UploadArtifact(upload api.CommandPipeline_UploadArtifactServer) error {
+	return upload.SendAndClose(&api.Empty{})
+}
+
 type MockLogger struct {
 	logs []string
 }
@@ -144,6 +165,8 @@ func TestAgentTalksToServer(t *testing.T) {
 		GRPCTimeout: 10 * time.Second,
 		ServerURL:   "localhost:9700",
 		Labels:      map[string]string{"tier": "testing"},
+
+		HeartbeatInterval: 10 * time.Millisecond,
 	})
 	logrus.Infof("agent test: connecting client")
 	err := client.Connect()
@@ -163,6 +186,24 @@ func TestAgentTalksToServer(t *testing.T) {
 
 	logrus.Infof("finished: %#v", cmds)
 
+	var beat api.AgentHeartbeat
+	for beat.GetJobsExecuted() < 2 {
+		select {
+		case beat = <-beats:
+		case <-time.After(time.Second):
+			t.Fatalf("the agent sent no heartbeat with its jobs, the last one was %#v", beat)
+		}
+	}
+	mocks.AssertMatches(t, "^[0-9a-f-]{36}$", beat.GetAgentID())
+	mocks.AssertEquals(t, uint64(1), beat.GetJobsFailed())
+	mocks.AssertEquals(t, int64(0), beat.GetJobsRunning())
+
+	mocks.Must(t, "failed to update the commands of the agent", client.UpdateCommands())
+	update := <-updates
+	mocks.AssertEquals(t, beat.GetAgentID(), update.GetAgentID())
+	_, ok := update.GetCommands()["echo"]
+	mocks.AssertEquals(t, true, ok)
+
 	logrus.Infof("agent test: shutting down client")
 	client.Shutdown()
 
@@ -176,3 +217,315 @@ func TestAgentTalksToServer(t *testing.T) {
 	mocks.AssertEquals(t, "could not find command invalid in remote agent", finished.GetError())
 	mocks.AssertEquals(t, uint64(2), finished.GetJobID())
 }
+
+// ReplayServer sends a job to the first agent that registers, and tells the
+// test the log lines and the finished jobs it gets
+type ReplayServer struct {
+	job      *api.CommandRequest
+	cancel   time.Duration
+	lines    chan string
+	finishes chan api.CommandFinish
+}
+
+func (m ReplayServer) RegisterAgent(in *api.AgentConfiguration, agent api.CommandPipeline_RegisterAgentServer) error {
+	if m.job != nil {
+		if err := agent.Send(m.job); err != nil {
+			return err
+		}
+	}
+	if m.cancel > 0 {
+		time.Sleep(m.cancel)
+		if err := agent.Send(&api.CommandRequest{JobID: m.job.GetJobID(), Cancel: true}); err != nil {
+			return err
+		}
+	}
+	<-agent.Context().Done()
+	return nil
+}
+
+func (m ReplayServer) Finish(ctx context.Context, fin *api.CommandFinish) (*api.Empty, error) {
+	m.finishes <- *fin
+	return &api.Empty{}, nil
+}
+
+func (m ReplayServer) Heartbeat(ctx context.Context, beat *api.AgentHeartbeat) (*api.Empty, error) {
+	return &api.Empty{}, nil
+}
+
+func (m ReplayServer) UpdateCommands(ctx context.Context, in *api.AgentCommands) (*api.Empty, error) {
+	return &api.Empty{}, nil
+}
+
+func (m ReplayServer) UploadArtifact(upload api.CommandPipeline_UploadArtifactServer) error {
+	return upload.SendAndClose(&api.Empty{})
+}
+
+func (m ReplayServer) Append(writer api.LogWriter_AppendServer) error {
+	entry, err := writer.Recv()
+	if err != nil {
+		return err
+	}
+	m.lines <- entry.GetLine()
+	return writer.SendAndClose(&api.Empty{})
+}
+
+func (m ReplayServer) SetError(ctx context.Context, entry *api.ErrorLogEntry) (*api.Empty, error) {
+	return &api.Empty{}, nil
+}
+
+func TestAgentReplaysWhatTheServerMissed(t *testing.T) {
+	mocks.Must(t, "failed to register commands",
+		commands.Register(commands.RegistrationArgs{
+			Action: commands.ActionRegister,
+			Kind:   commands.KindLocalCommand,
+			Commands: []commands.CommandRegistration{
+				{
+					Name: "slow-echo",
+					Cmd: shell.New(meeseeks.CommandOpts{
+						Cmd:     "sh",
+						Args:    []string{"-c", "echo started; sleep 0.5; echo done"},
+						Help:    meeseeks.NewHelp("slow echo"),
+						Timeout: 5 * time.Second,
+					}),
+				},
+			},
+		}))
+	defer commands.Reset()
+
+	serve := func(m ReplayServer) *grpc.Server {
+		s := grpc.NewServer()
+		api.RegisterCommandPipelineServer(s, m)
+		api.RegisterLogWriterServer(s, m)
+		address, err := net.Listen("tcp", "localhost:9709")
+		mocks.Must(t, "could not listen", err)
+		go s.Serve(address)
+		return s
+	}
+	receive := func(c chan string) string {
+		select {
+		case line := <-c:
+			return line
+		case <-time.After(10 * time.Second):
+			t.Fatal("the server got nothing")
+			return ""
+		}
+	}
+
+	// The first server goes away while the job runs
+	first := ReplayServer{
+		job:      &api.CommandRequest{JobID: 7, Command: "slow-echo", Username: "someone"},
+		lines:    make(chan string, 10),
+		finishes: make(chan api.CommandFinish, 10),
+	}
+	s := serve(first)
+
+	client := agent.New(agent.Configuration{
+		GRPCTimeout:       time.Second,
+		ServerURL:         "localhost:9709",
+		HeartbeatInterval: 20 * time.Millisecond,
+	})
+	mocks.Must(t, "failed to connect to remote server", client.Connect())
+	go client.Run()
+	defer client.Shutdown()
+
+	mocks.AssertEquals(t, "started", receive(first.lines))
+	time.Sleep(100 * time.Millisecond) // The agent gets the line acknowledged
+	s.Stop()
+	time.Sleep(time.Second)
+
+	second := ReplayServer{
+		lines:    make(chan string, 10),
+		finishes: make(chan api.CommandFinish, 10),
+	}
+	s = serve(second)
+	defer s.Stop()
+
+	mocks.AssertEquals(t, "done", receive(second.lines))
+	select {
+	case fin := <-second.finishes:
+		mocks.AssertEquals(t, uint64(7), fin.GetJobID())
+		mocks.AssertEquals(t, "started\ndone\n", fin.GetContent())
+		mocks.AssertEquals(t, "", fin.GetError())
+	case <-time.After(10 * time.Second):
+		t.Fatal("the finished job was not replayed")
+	}
+}
+
+func TestAgentRunsTheJobsOfAllItsServersOnce(t *testing.T) {
+	ran, err := ioutil.TempFile("", "meeseeks-ran")
+	mocks.Must(t, "could not create tmp file", err)
+	ran.Close()
+	defer os.Remove(ran.Name())
+
+	mocks.Must(t, "failed to register commands",
+		commands.Register(commands.RegistrationArgs{
+			Action: commands.ActionRegister,
+			Kind:   commands.KindLocalCommand,
+			Commands: []commands.CommandRegistration{
+				{
+					Name: "counted-echo",
+					Cmd: shell.New(meeseeks.CommandOpts{
+						Cmd:     "sh",
+						Args:    []string{"-c", "echo ran >> " + ran.Name() + "; sleep 0.2; echo done"},
+						Help:    meeseeks.NewHelp("counted echo"),
+						Timeout: 5 * time.Second,
+					}),
+				},
+			},
+		}))
+	defer commands.Reset()
+
+	// Both servers of the pair send the same job
+	servers := []ReplayServer{}
+	for _, address := range []string{"localhost:9710", "localhost:9711"} {
+		m := ReplayServer{
+			job:      &api.CommandRequest{JobID: 9, Command: "counted-echo", Username: "someone"},
+			lines:    make(chan string, 10),
+			finishes: make(chan api.CommandFinish, 10),
+		}
+		s := grpc.NewServer()
+		api.RegisterCommandPipelineServer(s, m)
+		api.RegisterLogWriterServer(s, m)
+		listener, err := net.Listen("tcp", address)
+		mocks.Must(t, "could not listen", err)
+		go s.Serve(listener)
+		defer s.Stop()
+
+		servers = append(servers, m)
+	}
+
+	group := agent.NewGroup(agent.Configuration{GRPCTimeout: time.Second}, []string{"localhost:9710", "localhost:9711"})
+	mocks.Must(t, "failed to connect to the servers", group.Connect())
+	go group.Run()
+	defer group.Shutdown()
+
+	for _, m := range servers {
+		select {
+		case fin := <-m.finishes:
+			mocks.AssertEquals(t, uint64(9), fin.GetJobID())
+			mocks.AssertEquals(t, "done\n", fin.GetContent())
+		case <-time.After(5 * time.Second):
+			t.Fatal("a server did not get the job finished")
+		}
+	}
+
+	b, err := ioutil.ReadFile(ran.Name())
+	mocks.Must(t, "could not read tmp file", err)
+	mocks.AssertEquals(t, "ran\n", string(b))
+	mocks.AssertEquals(t, 1, len(servers[0].lines)+len(servers[1].lines))
+}
+
+func TestAgentFailsJobsWithTheIDOfAnotherRunningJob(t *testing.T) {
+	mocks.Must(t, "failed to register commands",
+		commands.Register(commands.RegistrationArgs{
+			Action: commands.ActionRegister,
+			Kind:   commands.KindLocalCommand,
+			Commands: []commands.CommandRegistration{
+				{
+					Name: "slow-echo",
+					Cmd: shell.New(meeseeks.CommandOpts{
+						Cmd:     "sh",
+						Args:    []string{"-c", "sleep 0.5; echo \"$0\""},
+						Help:    meeseeks.NewHelp("slow echo"),
+						Timeout: 5 * time.Second,
+					}),
+				},
+			},
+		}))
+	defer commands.Reset()
+
+	// Servers that don't share their database give different jobs the same ID
+	servers := []ReplayServer{}
+	for address, arg := range map[string]string{"localhost:9718": "first", "localhost:9719": "second"} {
+		m := ReplayServer{
+			job:      &api.CommandRequest{JobID: 11, Command: "slow-echo", Args: []string{arg}, Username: "someone"},
+			lines:    make(chan string, 10),
+			finishes: make(chan api.CommandFinish, 10),
+		}
+		s := grpc.NewServer()
+		api.RegisterCommandPipelineServer(s, m)
+		api.RegisterLogWriterServer(s, m)
+		listener, err := net.Listen("tcp", address)
+		mocks.Must(t, "could not listen", err)
+		go s.Serve(listener)
+		defer s.Stop()
+
+		servers = append(servers, m)
+	}
+
+	group := agent.NewGroup(agent.Configuration{GRPCTimeout: time.Second}, []string{"localhost:9718", "localhost:9719"})
+	mocks.Must(t, "failed to connect to the servers", group.Connect())
+	go group.Run()
+	defer group.Shutdown()
+
+	outcomes := map[string]int{}
+	for _, m := range servers {
+		select {
+		case fin := <-m.finishes:
+			mocks.AssertEquals(t, uint64(11), fin.GetJobID())
+			if fin.GetError() != "" {
+				mocks.AssertEquals(t, "job 11 is already running another request in remote agent", fin.GetError())
+				outcomes["failed"]++
+				continue
+			}
+			mocks.AssertMatches(t, "^(first|second)\n$", fin.GetContent())
+			outcomes["ran"]++
+		case <-time.After(5 * time.Second):
+			t.Fatal("a server did not get the job finished")
+		}
+	}
+	mocks.AssertEquals(t, map[string]int{"failed": 1, "ran": 1}, outcomes)
+}
+
+func TestAgentStopsTheJobsTheServerCancels(t *testing.T) {
+	ran, err := ioutil.TempFile("", "meeseeks-cancelled")
+	mocks.Must(t, "could not create tmp file", err)
+	ran.Close()
+	os.Remove(ran.Name())
+	defer os.Remove(ran.Name())
+
+	mocks.Must(t, "failed to register commands",
+		commands.Register(commands.RegistrationArgs{
+			Action: commands.ActionRegister,
+			Kind:   commands.KindLocalCommand,
+			Commands: []commands.CommandRegistration{
+				{
+					Name: "slow-touch",
+					Cmd: shell.New(meeseeks.CommandOpts{
+						Cmd:     "sh",
+						Args:    []string{"-c", "sleep 0.5; touch " + ran.Name()},
+						Help:    meeseeks.NewHelp("slow touch"),
+						Timeout: 5 * time.Second,
+					}),
+				},
+			},
+		}))
+	defer commands.Reset()
+
+	m := ReplayServer{
+		job:      &api.CommandRequest{JobID: 21, Command: "slow-touch", Username: "someone"},
+		cancel:   100 * time.Millisecond,
+		lines:    make(chan string, 10),
+		finishes: make(chan api.CommandFinish, 10),
+	}
+	s := grpc.NewServer()
+	api.RegisterCommandPipelineServer(s, m)
+	api.RegisterLogWriterServer(s, m)
+	listener, err := net.Listen("tcp", "localhost:9721")
+	mocks.Must(t, "could not listen", err)
+	go s.Serve(listener)
+	defer s.Stop()
+
+	client := agent.New(agent.Configuration{ServerURL: "localhost:9721", GRPCTimeout: time.Second})
+	mocks.Must(t, "failed to connect to the server", client.Connect())
+	go client.Run()
+	defer client.Shutdown()
+
+	select {
+	case fin := <-m.finishes:
+		t.Fatalf("the server was sent the finish of the cancelled job: %#v", fin)
+	case <-time.After(time.Second):
+	}
+	_, err = os.Stat(ran.Name())
+	mocks.AssertEquals(t, true, os.IsNotExist(err))
+}
@@ -0,0 +1,45 @@
+package agent
+
+import (
+	"context"
+	"io"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/remote/api"
+)
+
+// artifactChunkSize is how much of an artifact is sent in each message, so
+// the artifacts fit in the max message size of grpc
+const artifactChunkSize = 64 << 10
+
+// uploadArtifact sends the artifact of the job to the server, which keeps it
+// and links it in the reply
+func (r *RemoteClient) uploadArtifact(jobID uint64, name string, content []byte) error {
+	ctx, cancel := context.WithTimeout(r.ctx, r.config.GetRPCTimeout())
+	defer cancel()
+
+	upload, err := r.cmdClient.UploadArtifact(ctx)
+	if err != nil {
+		return err
+	}
+	for offset := 0; offset == 0 || offset < len(content); offset += artifactChunkSize {
+		end := offset + artifactChunkSize
+		if end > len(content) {
+			end = len(content)
+		}
+		// A broken stream fails with EOF, the reason comes when it's closed
+		err := upload.Send(&api.ArtifactChunk{
+			AgentID: r.agentID,
+			JobID:   jobID,
+			Name:    name,
+			Content: content[offset:end],
+		})
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err = upload.CloseAndRecv()
+	return err
+}
@@ -0,0 +1,179 @@
+package agent
+
+import (
+	"context"
+	"sync"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/remote/api"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultBacklogSize is how many log lines are kept while the server can't be
+// reached when no size is configured
+const DefaultBacklogSize = 10000
+
+// backlog keeps, in the order they happened, the log lines and the finished
+// jobs the server could not get while the agent was disconnected, so they are
+// sent once it's back and the jobs are not left running or without logs.
+// The finished jobs are always kept, the log lines that don't fit are dropped
+type backlog struct {
+	entries []backlogEntry
+	lines   int
+	size    int
+	dropped int
+
+	lock      sync.Mutex
+	replaying sync.Mutex
+}
+
+// backlogEntry is either a log line or a finished job
+type backlogEntry struct {
+	line   *api.LogEntry
+	finish *api.CommandFinish
+}
+
+func newBacklog(size int) *backlog {
+	return &backlog{size: size}
+}
+
+// isDisconnected returns true when the error means the server could not be
+// reached, as opposed to the server rejecting the call
+func isDisconnected(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Canceled:
+		return true
+	}
+	return false
+}
+
+// pending returns true when there is something waiting to be sent, what comes
+// after it has to wait too to keep the order
+func (b *backlog) pending() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return len(b.entries) > 0
+}
+
+// add keeps the entry to send it later
+func (b *backlog) add(entry backlogEntry) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if entry.line != nil {
+		if b.lines >= b.size {
+			b.dropped++
+			return
+		}
+		b.lines++
+	}
+	b.entries = append(b.entries, entry)
+}
+
+// replay sends the entries in order until one fails because the server can't
+// be reached, the ones the server rejects are dropped. The backlog is not
+// locked while an entry is sent, so the jobs keep adding theirs meanwhile
+func (b *backlog) replay(sendLine func(*api.LogEntry) error, sendFinish func(*api.CommandFinish) error) {
+	b.replaying.Lock()
+	defer b.replaying.Unlock()
+
+	if dropped := b.takeDropped(); dropped > 0 {
+		logrus.Warnf("%d log lines were dropped while the server could not be reached", dropped)
+	}
+	for {
+		entry, ok := b.first()
+		if !ok {
+			return
+		}
+
+		var err error
+		if entry.line != nil {
+			err = sendLine(entry.line)
+		} else {
+			err = sendFinish(entry.finish)
+		}
+		if isDisconnected(err) {
+			return
+		}
+		if err != nil {
+			logrus.Errorf("server rejected a replayed entry, dropping it: %s", err)
+		}
+		b.pop()
+	}
+}
+
+// takeDropped returns how many log lines were dropped since it was last called
+func (b *backlog) takeDropped() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	dropped := b.dropped
+	b.dropped = 0
+	return dropped
+}
+
+// first returns the oldest entry, false when there is none
+func (b *backlog) first() (backlogEntry, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if len(b.entries) == 0 {
+		return backlogEntry{}, false
+	}
+	return b.entries[0], true
+}
+
+// pop drops the oldest entry once it's been sent
+func (b *backlog) pop() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.entries[0].line != nil {
+		b.lines--
+	}
+	b.entries = b.entries[1:]
+}
+
+// replayBacklog sends what was kept while the server could not be reached
+func (r *RemoteClient) replayBacklog(ctx context.Context) {
+	if !r.backlog.pending() {
+		return
+	}
+	logrus.Infof("replaying the log lines and the finished jobs the server missed")
+	r.backlog.replay(
+		func(line *api.LogEntry) error {
+			return r.logWriter.send(line)
+		},
+		func(fin *api.CommandFinish) error {
+			finishCtx, cancel := context.WithTimeout(ctx, r.config.GetRPCTimeout())
+			defer cancel()
+
+			_, err := r.cmdClient.Finish(finishCtx, fin)
+			return err
+		})
+}
+
+// finish tells the server the job is finished, or keeps it for later when
+// the server can't be reached
+func (r *RemoteClient) finish(fin *api.CommandFinish) {
+	if r.backlog.pending() {
+		r.backlog.add(backlogEntry{finish: fin})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.ctx, r.config.GetRPCTimeout())
+	defer cancel()
+
+	_, err := r.cmdClient.Finish(ctx, fin)
+	if isDisconnected(err) && r.ctx.Err() == nil {
+		logrus.Warnf("could not reach the server to finish job %d, keeping it until the agent is back: %s", fin.GetJobID(), err)
+		r.backlog.add(backlogEntry{finish: fin})
+		return
+	}
+	if err != nil {
+		logrus.Errorf("failed to finish job %d: %s", fin.GetJobID(), err)
+	}
+}
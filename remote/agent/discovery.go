@@ -0,0 +1,236 @@
+package agent
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Sources the agent can discover its labels from
+const (
+	LabelSourceEC2        = "ec2"
+	LabelSourceGCE        = "gce"
+	LabelSourceKubernetes = "kubernetes"
+	LabelSourceEnv        = "env"
+)
+
+// Discovery sets where the agent discovers labels from when it starts, so the
+// ones like the region, the zone or the instance type don't have to be kept
+// by hand. The sources are read in order, a label of a later one replaces
+// the one of an earlier one, and the labels that are set win over all of them
+//
+// KubernetesLabels is the file the labels of the pod are mounted in with the
+// downward API, /etc/podinfo/labels by default, and EnvPrefix the prefix of
+// the environment variables that are labels, MEESEEKS_LABEL_ by default.
+// Timeout is how many seconds a source can take, 2 by default
+type Discovery struct {
+	Sources          []string      `yaml:"sources"`
+	KubernetesLabels string        `yaml:"kubernetes_labels"`
+	EnvPrefix        string        `yaml:"env_prefix"`
+	Timeout          time.Duration `yaml:"timeout"`
+}
+
+// Validate checks that the sources are known
+func (d Discovery) Validate() error {
+	for _, source := range d.Sources {
+		switch source {
+		case LabelSourceEC2, LabelSourceGCE, LabelSourceKubernetes, LabelSourceEnv:
+		default:
+			return fmt.Errorf("invalid label source %s, it can be %s, %s, %s or %s", source,
+				LabelSourceEC2, LabelSourceGCE, LabelSourceKubernetes, LabelSourceEnv)
+		}
+	}
+	if d.Timeout < 0 {
+		return fmt.Errorf("label discovery timeout can't be negative")
+	}
+	return nil
+}
+
+// DiscoverLabels returns the labels with the ones discovered from the sources
+// added, the labels that are set are kept as they are. A source that can't be
+// read is logged and skipped, so the agent still starts outside the cloud
+func DiscoverLabels(d Discovery, labels map[string]string) map[string]string {
+	discovered := map[string]string{}
+	client := &http.Client{Timeout: d.getTimeout()}
+	for _, source := range d.Sources {
+		var found map[string]string
+		var err error
+		switch source {
+		case LabelSourceEC2:
+			found, err = ec2Labels(client)
+		case LabelSourceGCE:
+			found, err = gceLabels(client)
+		case LabelSourceKubernetes:
+			found, err = kubernetesLabels(d.getKubernetesLabels())
+		case LabelSourceEnv:
+			found = envLabels(d.getEnvPrefix())
+		}
+		if err != nil {
+			logrus.Warnf("could not discover the labels of the agent from %s: %s", source, err)
+			continue
+		}
+		logrus.Debugf("discovered labels %v from %s", found, source)
+		for name, value := range found {
+			discovered[name] = value
+		}
+	}
+	for name, value := range labels {
+		discovered[name] = value
+	}
+	return discovered
+}
+
+func (d Discovery) getTimeout() time.Duration {
+	if d.Timeout == 0 {
+		return 2 * time.Second
+	}
+	return d.Timeout * time.Second
+}
+
+func (d Discovery) getKubernetesLabels() string {
+	if d.KubernetesLabels == "" {
+		return "/etc/podinfo/labels"
+	}
+	return d.KubernetesLabels
+}
+
+func (d Discovery) getEnvPrefix() string {
+	if d.EnvPrefix == "" {
+		return "MEESEEKS_LABEL_"
+	}
+	return d.EnvPrefix
+}
+
+// ec2Labels reads the region, the zone and the instance type from the
+// instance metadata service, with a session token as IMDSv2 requires
+func ec2Labels(client *http.Client) (map[string]string, error) {
+	endpoint := os.Getenv("AWS_EC2_METADATA_SERVICE_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "http://169.254.169.254"
+	}
+	endpoint = strings.TrimSuffix(endpoint, "/")
+
+	token, err := metadata(client, http.MethodPut, endpoint+"/latest/api/token",
+		"X-aws-ec2-metadata-token-ttl-seconds", "60")
+	if err != nil {
+		return nil, err
+	}
+	labels := map[string]string{"cloud": "aws"}
+	for label, path := range map[string]string{
+		"region":        "/latest/meta-data/placement/region",
+		"zone":          "/latest/meta-data/placement/availability-zone",
+		"instance-type": "/latest/meta-data/instance-type",
+	} {
+		value, err := metadata(client, http.MethodGet, endpoint+path, "X-aws-ec2-metadata-token", token)
+		if err != nil {
+			return nil, err
+		}
+		labels[label] = value
+	}
+	return labels, nil
+}
+
+// gceLabels reads the zone and the machine type from the metadata server, the
+// region is the zone without its last part
+func gceLabels(client *http.Client) (map[string]string, error) {
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = "metadata.google.internal"
+	}
+	endpoint := "http://" + host + "/computeMetadata/v1/instance/"
+
+	// Both come as projects/<project>/<kind>/<name>
+	zone, err := metadata(client, http.MethodGet, endpoint+"zone", "Metadata-Flavor", "Google")
+	if err != nil {
+		return nil, err
+	}
+	zone = zone[strings.LastIndex(zone, "/")+1:]
+	machineType, err := metadata(client, http.MethodGet, endpoint+"machine-type", "Metadata-Flavor", "Google")
+	if err != nil {
+		return nil, err
+	}
+
+	labels := map[string]string{
+		"cloud":         "gcp",
+		"zone":          zone,
+		"instance-type": machineType[strings.LastIndex(machineType, "/")+1:],
+	}
+	if i := strings.LastIndex(zone, "-"); i > 0 {
+		labels["region"] = zone[:i]
+	}
+	return labels, nil
+}
+
+func metadata(client *http.Client, method, url, header, value string) (string, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set(header, value)
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s answered %s", url, resp.Status)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// kubernetesLabels reads the labels of the pod from the file the downward
+// API mounts them in, one name="value" per line
+func kubernetesLabels(filename string) (map[string]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	labels := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid label %q in %s", line, filename)
+		}
+		value, err := strconv.Unquote(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid label %q in %s", line, filename)
+		}
+		labels[parts[0]] = value
+	}
+	return labels, scanner.Err()
+}
+
+// envLabels returns the environment variables with the prefix as labels,
+// named after the rest of the variable in lower case and with dashes, like
+// MEESEEKS_LABEL_INSTANCE_TYPE for instance-type
+func envLabels(prefix string) map[string]string {
+	labels := map[string]string{}
+	for _, env := range os.Environ() {
+		parts := strings.SplitN(env, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], prefix) || parts[0] == prefix {
+			continue
+		}
+		name := strings.Replace(strings.ToLower(strings.TrimPrefix(parts[0], prefix)), "_", "-", -1)
+		labels[name] = parts[1]
+	}
+	return labels
+}
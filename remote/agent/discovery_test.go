@@ -0,0 +1,98 @@
+package agent_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/mocks"
+	"gitlab.com/yakshaving.art/meeseeks-box/remote/agent"
+)
+
+func TestLabelsAreDiscovered(t *testing.T) {
+	ec2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/latest/api/token" {
+			mocks.AssertEquals(t, http.MethodPut, r.Method)
+			w.Write([]byte("session-token"))
+			return
+		}
+		if r.Header.Get("X-aws-ec2-metadata-token") != "session-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(map[string]string{
+			"/latest/meta-data/placement/region":            "eu-west-1",
+			"/latest/meta-data/placement/availability-zone": "eu-west-1a",
+			"/latest/meta-data/instance-type":               "m5.large",
+		}[r.URL.Path]))
+	}))
+	defer ec2.Close()
+
+	gce := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(map[string]string{
+			"/computeMetadata/v1/instance/zone":         "projects/1234/zones/us-central1-b",
+			"/computeMetadata/v1/instance/machine-type": "projects/1234/machineTypes/n1-standard-2",
+		}[r.URL.Path]))
+	}))
+	defer gce.Close()
+
+	dir, err := ioutil.TempDir("", "meeseeks-podinfo")
+	mocks.Must(t, "failed to create temp dir", err)
+	defer os.RemoveAll(dir)
+	podLabels := filepath.Join(dir, "labels")
+	mocks.Must(t, "failed to write pod labels", ioutil.WriteFile(podLabels,
+		[]byte("app=\"meeseeks\"\ntier=\"batch\"\n"), 0600))
+
+	os.Setenv("AWS_EC2_METADATA_SERVICE_ENDPOINT", ec2.URL)
+	os.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(gce.URL, "http://"))
+	os.Setenv("MEESEEKS_LABEL_INSTANCE_TYPE", "big")
+	defer os.Unsetenv("AWS_EC2_METADATA_SERVICE_ENDPOINT")
+	defer os.Unsetenv("GCE_METADATA_HOST")
+	defer os.Unsetenv("MEESEEKS_LABEL_INSTANCE_TYPE")
+
+	tt := []struct {
+		name      string
+		discovery agent.Discovery
+		labels    map[string]string
+		expected  map[string]string
+	}{
+		{
+			name:      "ec2",
+			discovery: agent.Discovery{Sources: []string{"ec2"}},
+			labels:    map[string]string{"tier": "web"},
+			expected: map[string]string{"cloud": "aws", "region": "eu-west-1", "zone": "eu-west-1a",
+				"instance-type": "m5.large", "tier": "web"},
+		},
+		{
+			name:      "gce",
+			discovery: agent.Discovery{Sources: []string{"gce"}},
+			labels:    map[string]string{"region": "mine"},
+			expected: map[string]string{"cloud": "gcp", "region": "mine", "zone": "us-central1-b",
+				"instance-type": "n1-standard-2"},
+		},
+		{
+			name:      "kubernetes and then env",
+			discovery: agent.Discovery{Sources: []string{"kubernetes", "env"}, KubernetesLabels: podLabels},
+			expected:  map[string]string{"app": "meeseeks", "tier": "batch", "instance-type": "big"},
+		},
+		{
+			name:      "missing sources are skipped",
+			discovery: agent.Discovery{Sources: []string{"kubernetes"}, KubernetesLabels: filepath.Join(dir, "missing")},
+			labels:    map[string]string{"tier": "web"},
+			expected:  map[string]string{"tier": "web"},
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			mocks.AssertEquals(t, tc.expected, agent.DiscoverLabels(tc.discovery, tc.labels))
+		})
+	}
+}
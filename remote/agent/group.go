@@ -0,0 +1,298 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/artifacts"
+	"gitlab.com/yakshaving.art/meeseeks-box/remote/agenttokens"
+	"gitlab.com/yakshaving.art/meeseeks-box/remote/api"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// finishedJobsTTL is how long the outcome of a job is kept for the servers
+// that send it after it finished
+const finishedJobsTTL = 10 * time.Minute
+
+// Group is an agent registered with several servers at once, like an active
+// HA pair. A job that more than one of them sends, with the same ID and the
+// same request, runs once and all of them get its outcome
+type Group struct {
+	clients []*RemoteClient
+}
+
+// NewGroup creates an agent for each of the servers, they share the agent ID
+// and the jobs
+func NewGroup(c Configuration, serverURLs []string) *Group {
+	agentID := agenttokens.AgentID(c.GetToken(), uuid.New().String())
+	jobs := newJobRegistry()
+	stats := &agentStats{}
+
+	g := &Group{}
+	for _, serverURL := range serverURLs {
+		config := c
+		config.ServerURL = serverURL
+
+		client := New(config)
+		client.agentID = agentID
+		client.jobs = jobs
+		client.stats = stats
+		g.clients = append(g.clients, client)
+	}
+	return g
+}
+
+// Connect creates the connections to all the servers
+func (g *Group) Connect() error {
+	for _, client := range g.clients {
+		if err := client.Connect(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run registers the agent in all the servers and listens for the commands of
+// all of them until they are all gone
+func (g *Group) Run() {
+	wg := sync.WaitGroup{}
+	for _, client := range g.clients {
+		wg.Add(1)
+		go func(client *RemoteClient) {
+			defer wg.Done()
+			client.Run()
+		}(client)
+	}
+	wg.Wait()
+}
+
+// Reconnect closes the connection pipelines of all the servers
+func (g *Group) Reconnect() {
+	for _, client := range g.clients {
+		client.Reconnect()
+	}
+}
+
+// UpdateCommands sends the commands the agent has now to all the servers, it
+// returns the first error but still sends them to the rest
+func (g *Group) UpdateCommands() error {
+	var first error
+	for _, client := range g.clients {
+		if err := client.UpdateCommands(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Shutdown closes the streams of all the servers and waits for all the
+// commands to finish execution
+func (g *Group) Shutdown() {
+	for _, client := range g.clients {
+		client.Shutdown()
+	}
+}
+
+// sharedJob is a job that one or more servers sent, it runs once, and its log
+// goes to the server that sent it first
+type sharedJob struct {
+	request  string
+	owner    *RemoteClient
+	done     chan struct{}
+	content  string
+	err      string
+	finished time.Time
+
+	cancel    context.CancelFunc
+	cancelled bool
+}
+
+// jobRegistry keeps the jobs the agent is running and the ones it finished
+// recently, and sends the log lines of each to its owner
+type jobRegistry struct {
+	jobs map[uint64]*sharedJob
+	lock sync.Mutex
+}
+
+func newJobRegistry() *jobRegistry {
+	return &jobRegistry{
+		jobs: make(map[uint64]*sharedJob),
+	}
+}
+
+// start returns the job of the request, and true when the server is the
+// first to send it and so it has to run it. Servers that don't share their
+// database can send different jobs with the same ID, a job is only the same
+// when the request is too. The log lines only carry the ID, so a job can't
+// start while another one with its ID is running
+func (j *jobRegistry) start(cmd api.CommandRequest, server *RemoteClient) (*sharedJob, bool, error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	for id, job := range j.jobs {
+		if !job.finished.IsZero() && time.Since(job.finished) > finishedJobsTTL {
+			delete(j.jobs, id)
+		}
+	}
+	request := requestKey(cmd)
+	if job, ok := j.jobs[cmd.GetJobID()]; ok {
+		if job.request == request {
+			return job, false, nil
+		}
+		if job.finished.IsZero() {
+			return nil, false, fmt.Errorf("job %d is already running another request in remote agent", cmd.GetJobID())
+		}
+	}
+	job := &sharedJob{
+		request: request,
+		owner:   server,
+		done:    make(chan struct{}),
+	}
+	j.jobs[cmd.GetJobID()] = job
+	return job, true, nil
+}
+
+// requestKey returns what makes the request of a job the same one no matter
+// which server sent it
+func requestKey(cmd api.CommandRequest) string {
+	return fmt.Sprintf("%q %q %q %q", cmd.GetCommand(), cmd.GetArgs(), cmd.GetUserID(), cmd.GetChannelID())
+}
+
+// running keeps how to cancel the job, which is cancelled right away when the
+// server cancelled it before it started
+func (j *jobRegistry) running(jobID uint64, cancel context.CancelFunc) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	job, ok := j.jobs[jobID]
+	if !ok {
+		return
+	}
+	job.cancel = cancel
+	if job.cancelled {
+		cancel()
+	}
+}
+
+// cancel stops the job when it's running, or as soon as it starts
+func (j *jobRegistry) cancel(jobID uint64) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	job, ok := j.jobs[jobID]
+	if !ok || !job.finished.IsZero() {
+		return
+	}
+	job.cancelled = true
+	if job.cancel != nil {
+		job.cancel()
+	}
+}
+
+// finish keeps the outcome of the job for the servers that are waiting for it
+// or send it later
+func (j *jobRegistry) finish(jobID uint64, content, err string) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	job, ok := j.jobs[jobID]
+	if !ok {
+		return
+	}
+	job.content, job.err, job.finished = content, err, time.Now()
+	close(job.done)
+}
+
+// wait waits for the job that another server sent to finish
+func (s *sharedJob) wait(ctx context.Context) (string, string, error) {
+	select {
+	case <-ctx.Done():
+		return "", "", ctx.Err()
+	case <-s.done:
+		return s.content, s.err, nil
+	}
+}
+
+// ownerOf returns the server the job belongs to, or the server given when
+// it's not a job of the agent
+func (j *jobRegistry) ownerOf(jobID uint64, fallback *RemoteClient) *RemoteClient {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if job, ok := j.jobs[jobID]; ok {
+		return job.owner
+	}
+	return fallback
+}
+
+// writerOf returns the log writer of the server the job belongs to
+func (j *jobRegistry) writerOf(jobID uint64, fallback *RemoteClient) grpcLogWriter {
+	return j.ownerOf(jobID, fallback).logWriter
+}
+
+// jobsLogWriter sends the log lines of each job to the server it belongs to
+type jobsLogWriter struct {
+	jobs     *jobRegistry
+	fallback *RemoteClient
+}
+
+// Append implements LogWriter.Append
+func (w jobsLogWriter) Append(jobID uint64, content string) error {
+	return w.jobs.writerOf(jobID, w.fallback).Append(jobID, content)
+}
+
+// AppendLine implements LogWriter.AppendLine
+func (w jobsLogWriter) AppendLine(jobID uint64, line meeseeks.LogLine) error {
+	return w.jobs.writerOf(jobID, w.fallback).AppendLine(jobID, line)
+}
+
+// SetError implements LogWriter.SetError
+func (w jobsLogWriter) SetError(jobID uint64, err error) error {
+	return w.jobs.writerOf(jobID, w.fallback).SetError(jobID, err)
+}
+
+// jobsArtifactStore sends the artifacts of each job to the server it belongs
+// to, which keeps them
+type jobsArtifactStore struct {
+	jobs     *jobRegistry
+	fallback *RemoteClient
+}
+
+// Put implements artifacts.Store.Put
+func (s jobsArtifactStore) Put(jobID uint64, name string, content []byte) error {
+	return s.jobs.ownerOf(jobID, s.fallback).uploadArtifact(jobID, name, content)
+}
+
+// Get implements artifacts.Store.Get, the agent keeps no artifacts
+func (jobsArtifactStore) Get(_ uint64, _ string) ([]byte, error) {
+	return nil, artifacts.ErrNoArtifact
+}
+
+// List implements artifacts.Store.List, the agent keeps no artifacts
+func (jobsArtifactStore) List(_ uint64) ([]string, error) {
+	return nil, nil
+}
+
+// Remove implements artifacts.Store.Remove, the agent keeps no artifacts
+func (jobsArtifactStore) Remove(_ uint64) error {
+	return nil
+}
+
+// registerLogWriter makes the log lines and the artifacts of the jobs go to
+// their servers
+func (r *RemoteClient) registerLogWriter() {
+	logrus.Debugf("sending the log lines of the jobs to the servers that sent them")
+	persistence.Register(
+		persistence.Providers{
+			LogReader: nullReader{},
+			LogWriter: jobsLogWriter{jobs: r.jobs, fallback: r},
+		},
+	)
+	artifacts.Forward(jobsArtifactStore{jobs: r.jobs, fallback: r})
+}
@@ -3,6 +3,7 @@ package agent
 import (
 	"context"
 	"fmt"
+	"io"
 	"time"
 
 	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
@@ -14,29 +15,58 @@ import (
 type grpcLogWriter struct {
 	client         api.LogWriterClient
 	timeoutSeconds time.Duration
+	backlog        *backlog
 }
 
-// Append implements LogWritter.Append
+// Append implements LogWritter.Append, the lines are kept in the backlog
+// while the server can't be reached
 func (g grpcLogWriter) Append(jobID uint64, content string) error {
+	line := &api.LogEntry{
+		JobID: jobID,
+		Line:  content,
+	}
+	if g.backlog.pending() {
+		g.backlog.add(backlogEntry{line: line})
+		return nil
+	}
+
+	logrus.Debugf("sending log job %d - '%s'", jobID, content)
+	err := g.send(line)
+	if isDisconnected(err) {
+		logrus.Debugf("could not reach the server to send log of job %d, keeping it until the agent is back: %s", jobID, err)
+		g.backlog.add(backlogEntry{line: line})
+		return nil
+	}
+	if err != nil {
+		logrus.Errorf("failed to send log to remote appender %d - '%s'", jobID, err)
+		return fmt.Errorf("Failed to send log of job %d to the remote appender: %s", jobID, err)
+	}
+	return nil
+}
+
+// send sends the line and waits for the server to get it
+func (g grpcLogWriter) send(line *api.LogEntry) error {
 	ctx, cancel := context.WithTimeout(context.Background(), g.timeoutSeconds)
 	defer cancel()
 
 	w, err := g.client.Append(ctx)
 	if err != nil {
-		return fmt.Errorf("Failed to get a remote appender for job %d: %s", jobID, err)
+		return err
 	}
-
-	logrus.Debugf("sending log job %d - '%s'", jobID, content)
-	err = w.Send(&api.LogEntry{
-		JobID: jobID,
-		Line:  content,
-	})
-	if err != nil {
-		logrus.Errorf("failed to send log to remote appender %d - '%s'", jobID, err)
+	// A broken stream fails with EOF, the reason comes when it's closed
+	if err := w.Send(line); err != nil && err != io.EOF {
+		return err
 	}
+	_, err = w.CloseAndRecv()
 	return err
 }
 
+// AppendLine implements LogWriter.AppendLine, the remote API only carries the
+// text of the line so the server stamps it when it's received
+func (g grpcLogWriter) AppendLine(jobID uint64, line meeseeks.LogLine) error {
+	return g.Append(jobID, line.Text)
+}
+
 func (g grpcLogWriter) SetError(jobID uint64, err error) error {
 	return nil
 }
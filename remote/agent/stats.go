@@ -0,0 +1,75 @@
+package agent
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/remote/api"
+)
+
+// loadAvgPath is where the load average of the host is read from, it only
+// exists on linux, elsewhere the load is reported as 0
+const loadAvgPath = "/proc/loadavg"
+
+// agentStats counts the jobs the agent executed, they are reported to the
+// server with the heartbeats
+type agentStats struct {
+	executed uint64
+	failed   uint64
+	running  int64
+
+	lock sync.Mutex
+}
+
+// start counts a job as running
+func (s *agentStats) start() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.running++
+}
+
+// finish counts a running job as executed, and as failed when it did
+func (s *agentStats) finish(failed bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.running--
+	s.executed++
+	if failed {
+		s.failed++
+	}
+}
+
+// heartbeat returns the heartbeat of the agent with its current stats
+func (s *agentStats) heartbeat(agentID string) *api.AgentHeartbeat {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return &api.AgentHeartbeat{
+		AgentID:      agentID,
+		JobsExecuted: s.executed,
+		JobsFailed:   s.failed,
+		JobsRunning:  s.running,
+		Load:         hostLoad(),
+	}
+}
+
+// hostLoad returns the load average of the last minute of the host
+func hostLoad() float64 {
+	b, err := ioutil.ReadFile(loadAvgPath)
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) == 0 {
+		return 0
+	}
+	load, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0
+	}
+	return load
+}
@@ -0,0 +1,157 @@
+package agenttokens
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence"
+)
+
+// ErrInvalidToken is returned when an agent registers with a token that was
+// never issued, or was rotated or revoked
+var ErrInvalidToken = errors.New("invalid agent token")
+
+var validName = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+var watchers = map[string][]chan struct{}{}
+var mutex sync.Mutex
+
+// Issue creates the token of a new agent, the returned token is the only
+// time the secret is shown
+func Issue(name, createdBy string) (string, error) {
+	if !validName.MatchString(name) {
+		return "", fmt.Errorf("invalid agent name %s, it can only have letters, numbers, - and _", name)
+	}
+	switch _, err := persistence.AgentTokens().Get(name); err {
+	case nil:
+		return "", fmt.Errorf("agent %s already has a token, rotate it instead", name)
+	case meeseeks.ErrNoAgentToken:
+	default:
+		return "", err
+	}
+	return save(name, createdBy)
+}
+
+// Rotate replaces the token of the agent, the agents that registered with the
+// previous one are disconnected so they register again with the new one
+func Rotate(name, createdBy string) (string, error) {
+	if _, err := persistence.AgentTokens().Get(name); err != nil {
+		return "", err
+	}
+	token, err := save(name, createdBy)
+	if err != nil {
+		return "", err
+	}
+	notify(name)
+	return token, nil
+}
+
+// Revoke removes the token of the agent and disconnects the agents that
+// registered with it
+func Revoke(name string) error {
+	if err := persistence.AgentTokens().Revoke(name); err != nil {
+		return err
+	}
+	notify(name)
+	return nil
+}
+
+// Verify returns the name of the agent the token was issued to
+func Verify(token string) (string, error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return "", ErrInvalidToken
+	}
+	stored, err := persistence.AgentTokens().Get(parts[0])
+	if err == meeseeks.ErrNoAgentToken {
+		return "", ErrInvalidToken
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not get agent token: %s", err)
+	}
+	if subtle.ConstantTimeCompare([]byte(hash(parts[1])), []byte(stored.Hash)) != 1 {
+		return "", ErrInvalidToken
+	}
+	return stored.Name, nil
+}
+
+// AgentID returns the id an agent registers with, prefixed with the name of
+// the agent of its token so the id can only be used with that token
+func AgentID(token, id string) string {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return id
+	}
+	return parts[0] + "/" + id
+}
+
+// Owns returns true if the id of the agent was created with the token of name
+func Owns(name, agentID string) bool {
+	return strings.HasPrefix(agentID, name+"/")
+}
+
+// Watch returns a channel that is closed when the token of the agent is
+// rotated or revoked, and a function to stop watching it
+func Watch(name string) (<-chan struct{}, func()) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	ch := make(chan struct{})
+	watchers[name] = append(watchers[name], ch)
+
+	return ch, func() {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		for i, w := range watchers[name] {
+			if w == ch {
+				watchers[name] = append(watchers[name][:i], watchers[name][i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+func notify(name string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for _, ch := range watchers[name] {
+		close(ch)
+	}
+	delete(watchers, name)
+}
+
+// save stores a new secret for the agent, returning the token, which is the
+// name of the agent followed by the secret
+func save(name, createdBy string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("could not create agent token: %s", err)
+	}
+	secret := hex.EncodeToString(b)
+
+	if err := persistence.AgentTokens().Save(meeseeks.AgentToken{
+		Name:      name,
+		Hash:      hash(secret),
+		CreatedBy: createdBy,
+		CreatedAt: time.Now().UTC(),
+	}); err != nil {
+		return "", fmt.Errorf("could not save agent token: %s", err)
+	}
+	return name + "." + secret, nil
+}
+
+func hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
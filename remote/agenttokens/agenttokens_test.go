@@ -0,0 +1,102 @@
+package agenttokens_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/mocks"
+	"gitlab.com/yakshaving.art/meeseeks-box/remote/agenttokens"
+)
+
+func TestIssuingAndVerifyingTokens(t *testing.T) {
+	mocks.Must(t, "failed to issue tokens", mocks.WithTmpDB(func(_ string) {
+		_, err := agenttokens.Issue("not valid", "admin")
+		mocks.AssertEquals(t, "invalid agent name not valid, it can only have letters, numbers, - and _", err.Error())
+
+		token, err := agenttokens.Issue("builder", "admin")
+		mocks.Must(t, "could not issue token", err)
+		mocks.AssertMatches(t, "^builder\\.[0-9a-f]{64}$", token)
+
+		_, err = agenttokens.Issue("builder", "admin")
+		mocks.AssertEquals(t, "agent builder already has a token, rotate it instead", err.Error())
+
+		name, err := agenttokens.Verify(token)
+		mocks.Must(t, "could not verify token", err)
+		mocks.AssertEquals(t, "builder", name)
+
+		for _, invalid := range []string{"", "builder", "builder.secret", "tester." + strings.Split(token, ".")[1]} {
+			_, err := agenttokens.Verify(invalid)
+			mocks.AssertEquals(t, agenttokens.ErrInvalidToken, err)
+		}
+	}))
+}
+
+func TestRotatingAndRevokingTokensDisconnectsTheAgents(t *testing.T) {
+	mocks.Must(t, "failed to rotate tokens", mocks.WithTmpDB(func(_ string) {
+		token, err := agenttokens.Issue("builder", "admin")
+		mocks.Must(t, "could not issue token", err)
+
+		rotatedCh, stop := agenttokens.Watch("builder")
+		defer stop()
+
+		rotated, err := agenttokens.Rotate("builder", "admin")
+		mocks.Must(t, "could not rotate token", err)
+		waitClosed(t, rotatedCh)
+
+		_, err = agenttokens.Verify(token)
+		mocks.AssertEquals(t, agenttokens.ErrInvalidToken, err)
+		_, err = agenttokens.Verify(rotated)
+		mocks.Must(t, "could not verify rotated token", err)
+
+		revokedCh, stop := agenttokens.Watch("builder")
+		defer stop()
+
+		mocks.Must(t, "could not revoke token", agenttokens.Revoke("builder"))
+		waitClosed(t, revokedCh)
+
+		_, err = agenttokens.Verify(rotated)
+		mocks.AssertEquals(t, agenttokens.ErrInvalidToken, err)
+		_, err = agenttokens.Rotate("builder", "admin")
+		mocks.AssertEquals(t, "no agent token", err.Error())
+	}))
+}
+
+func TestAgentIDsBelongToTheirToken(t *testing.T) {
+	tt := []struct {
+		name     string
+		token    string
+		expected string
+	}{
+		{
+			name:     "with a token",
+			token:    "builder.secret",
+			expected: "builder/7",
+		},
+		{
+			name:     "without a token",
+			expected: "7",
+		},
+		{
+			name:     "with a token without secret",
+			token:    "builder",
+			expected: "7",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			mocks.AssertEquals(t, tc.expected, agenttokens.AgentID(tc.token, "7"))
+		})
+	}
+	mocks.AssertEquals(t, true, agenttokens.Owns("builder", "builder/7"))
+	mocks.AssertEquals(t, false, agenttokens.Owns("builder", "builder-2/7"))
+	mocks.AssertEquals(t, false, agenttokens.Owns("build", "builder/7"))
+}
+
+func waitClosed(t *testing.T, ch <-chan struct{}) {
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Fatal("the agents were not disconnected")
+	}
+}
@@ -35,7 +35,7 @@ func (m *AgentRegistration) Reset()         { *m = AgentRegistration{} }
 func (m *AgentRegistration) String() string { return proto.CompactTextString(m) }
 func (*AgentRegistration) ProtoMessage()    {}
 func (*AgentRegistration) Descriptor() ([]byte, []int) {
-	return fileDescriptor_api_117924c65de44d70, []int{0}
+	return fileDescriptor_api_1ccb1bab528ef6b7, []int{0}
 }
 func (m *AgentRegistration) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_AgentRegistration.Unmarshal(m, b)
@@ -80,7 +80,7 @@ func (m *AgentPrivateToken) Reset()         { *m = AgentPrivateToken{} }
 func (m *AgentPrivateToken) String() string { return proto.CompactTextString(m) }
 func (*AgentPrivateToken) ProtoMessage()    {}
 func (*AgentPrivateToken) Descriptor() ([]byte, []int) {
-	return fileDescriptor_api_117924c65de44d70, []int{1}
+	return fileDescriptor_api_1ccb1bab528ef6b7, []int{1}
 }
 func (m *AgentPrivateToken) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_AgentPrivateToken.Unmarshal(m, b)
@@ -112,6 +112,10 @@ type AgentConfiguration struct {
 	Commands             map[string]*RemoteCommand `protobuf:"bytes,2,rep,name=commands,proto3" json:"commands,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
 	Labels               map[string]string         `protobuf:"bytes,3,rep,name=Labels,proto3" json:"Labels,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
 	AgentID              string                    `protobuf:"bytes,4,opt,name=agentID,proto3" json:"agentID,omitempty"`
+	Os                   string                    `protobuf:"bytes,5,opt,name=os,proto3" json:"os,omitempty"`
+	Arch                 string                    `protobuf:"bytes,6,opt,name=arch,proto3" json:"arch,omitempty"`
+	Hostname             string                    `protobuf:"bytes,7,opt,name=hostname,proto3" json:"hostname,omitempty"`
+	Version              string                    `protobuf:"bytes,8,opt,name=version,proto3" json:"version,omitempty"`
 	XXX_NoUnkeyedLiteral struct{}                  `json:"-"`
 	XXX_unrecognized     []byte                    `json:"-"`
 	XXX_sizecache        int32                     `json:"-"`
@@ -121,7 +125,7 @@ func (m *AgentConfiguration) Reset()         { *m = AgentConfiguration{} }
 func (m *AgentConfiguration) String() string { return proto.CompactTextString(m) }
 func (*AgentConfiguration) ProtoMessage()    {}
 func (*AgentConfiguration) Descriptor() ([]byte, []int) {
-	return fileDescriptor_api_117924c65de44d70, []int{2}
+	return fileDescriptor_api_1ccb1bab528ef6b7, []int{2}
 }
 func (m *AgentConfiguration) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_AgentConfiguration.Unmarshal(m, b)
@@ -169,6 +173,80 @@ func (m *AgentConfiguration) GetAgentID() string {
 	return ""
 }
 
+func (m *AgentConfiguration) GetOs() string {
+	if m != nil {
+		return m.Os
+	}
+	return ""
+}
+
+func (m *AgentConfiguration) GetArch() string {
+	if m != nil {
+		return m.Arch
+	}
+	return ""
+}
+
+func (m *AgentConfiguration) GetHostname() string {
+	if m != nil {
+		return m.Hostname
+	}
+	return ""
+}
+
+func (m *AgentConfiguration) GetVersion() string {
+	if m != nil {
+		return m.Version
+	}
+	return ""
+}
+
+type AgentCommands struct {
+	AgentID              string                    `protobuf:"bytes,1,opt,name=agentID,proto3" json:"agentID,omitempty"`
+	Commands             map[string]*RemoteCommand `protobuf:"bytes,2,rep,name=commands,proto3" json:"commands,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	XXX_NoUnkeyedLiteral struct{}                  `json:"-"`
+	XXX_unrecognized     []byte                    `json:"-"`
+	XXX_sizecache        int32                     `json:"-"`
+}
+
+func (m *AgentCommands) Reset()         { *m = AgentCommands{} }
+func (m *AgentCommands) String() string { return proto.CompactTextString(m) }
+func (*AgentCommands) ProtoMessage()    {}
+func (*AgentCommands) Descriptor() ([]byte, []int) {
+	return fileDescriptor_api_1ccb1bab528ef6b7, []int{3}
+}
+func (m *AgentCommands) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_AgentCommands.Unmarshal(m, b)
+}
+func (m *AgentCommands) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_AgentCommands.Marshal(b, m, deterministic)
+}
+func (dst *AgentCommands) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_AgentCommands.Merge(dst, src)
+}
+func (m *AgentCommands) XXX_Size() int {
+	return xxx_messageInfo_AgentCommands.Size(m)
+}
+func (m *AgentCommands) XXX_DiscardUnknown() {
+	xxx_messageInfo_AgentCommands.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_AgentCommands proto.InternalMessageInfo
+
+func (m *AgentCommands) GetAgentID() string {
+	if m != nil {
+		return m.AgentID
+	}
+	return ""
+}
+
+func (m *AgentCommands) GetCommands() map[string]*RemoteCommand {
+	if m != nil {
+		return m.Commands
+	}
+	return nil
+}
+
 type CommandFinish struct {
 	JobID                uint64   `protobuf:"varint,1,opt,name=jobID,proto3" json:"jobID,omitempty"`
 	Content              string   `protobuf:"bytes,2,opt,name=content,proto3" json:"content,omitempty"`
@@ -183,7 +261,7 @@ func (m *CommandFinish) Reset()         { *m = CommandFinish{} }
 func (m *CommandFinish) String() string { return proto.CompactTextString(m) }
 func (*CommandFinish) ProtoMessage()    {}
 func (*CommandFinish) Descriptor() ([]byte, []int) {
-	return fileDescriptor_api_117924c65de44d70, []int{3}
+	return fileDescriptor_api_1ccb1bab528ef6b7, []int{4}
 }
 func (m *CommandFinish) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_CommandFinish.Unmarshal(m, b)
@@ -231,6 +309,76 @@ func (m *CommandFinish) GetAgentID() string {
 	return ""
 }
 
+type AgentHeartbeat struct {
+	AgentID              string   `protobuf:"bytes,1,opt,name=agentID,proto3" json:"agentID,omitempty"`
+	JobsExecuted         uint64   `protobuf:"varint,2,opt,name=jobsExecuted,proto3" json:"jobsExecuted,omitempty"`
+	JobsFailed           uint64   `protobuf:"varint,3,opt,name=jobsFailed,proto3" json:"jobsFailed,omitempty"`
+	JobsRunning          int64    `protobuf:"varint,4,opt,name=jobsRunning,proto3" json:"jobsRunning,omitempty"`
+	Load                 float64  `protobuf:"fixed64,5,opt,name=load,proto3" json:"load,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *AgentHeartbeat) Reset()         { *m = AgentHeartbeat{} }
+func (m *AgentHeartbeat) String() string { return proto.CompactTextString(m) }
+func (*AgentHeartbeat) ProtoMessage()    {}
+func (*AgentHeartbeat) Descriptor() ([]byte, []int) {
+	return fileDescriptor_api_1ccb1bab528ef6b7, []int{5}
+}
+func (m *AgentHeartbeat) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_AgentHeartbeat.Unmarshal(m, b)
+}
+func (m *AgentHeartbeat) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_AgentHeartbeat.Marshal(b, m, deterministic)
+}
+func (dst *AgentHeartbeat) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_AgentHeartbeat.Merge(dst, src)
+}
+func (m *AgentHeartbeat) XXX_Size() int {
+	return xxx_messageInfo_AgentHeartbeat.Size(m)
+}
+func (m *AgentHeartbeat) XXX_DiscardUnknown() {
+	xxx_messageInfo_AgentHeartbeat.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_AgentHeartbeat proto.InternalMessageInfo
+
+func (m *AgentHeartbeat) GetAgentID() string {
+	if m != nil {
+		return m.AgentID
+	}
+	return ""
+}
+
+func (m *AgentHeartbeat) GetJobsExecuted() uint64 {
+	if m != nil {
+		return m.JobsExecuted
+	}
+	return 0
+}
+
+func (m *AgentHeartbeat) GetJobsFailed() uint64 {
+	if m != nil {
+		return m.JobsFailed
+	}
+	return 0
+}
+
+func (m *AgentHeartbeat) GetJobsRunning() int64 {
+	if m != nil {
+		return m.JobsRunning
+	}
+	return 0
+}
+
+func (m *AgentHeartbeat) GetLoad() float64 {
+	if m != nil {
+		return m.Load
+	}
+	return 0
+}
+
 type Help struct {
 	Summary              string   `protobuf:"bytes,1,opt,name=Summary,proto3" json:"Summary,omitempty"`
 	Args                 []string `protobuf:"bytes,2,rep,name=Args,proto3" json:"Args,omitempty"`
@@ -243,7 +391,7 @@ func (m *Help) Reset()         { *m = Help{} }
 func (m *Help) String() string { return proto.CompactTextString(m) }
 func (*Help) ProtoMessage()    {}
 func (*Help) Descriptor() ([]byte, []int) {
-	return fileDescriptor_api_117924c65de44d70, []int{4}
+	return fileDescriptor_api_1ccb1bab528ef6b7, []int{6}
 }
 func (m *Help) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_Help.Unmarshal(m, b)
@@ -294,7 +442,7 @@ func (m *RemoteCommand) Reset()         { *m = RemoteCommand{} }
 func (m *RemoteCommand) String() string { return proto.CompactTextString(m) }
 func (*RemoteCommand) ProtoMessage()    {}
 func (*RemoteCommand) Descriptor() ([]byte, []int) {
-	return fileDescriptor_api_117924c65de44d70, []int{5}
+	return fileDescriptor_api_1ccb1bab528ef6b7, []int{7}
 }
 func (m *RemoteCommand) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_RemoteCommand.Unmarshal(m, b)
@@ -373,7 +521,7 @@ func (m *Empty) Reset()         { *m = Empty{} }
 func (m *Empty) String() string { return proto.CompactTextString(m) }
 func (*Empty) ProtoMessage()    {}
 func (*Empty) Descriptor() ([]byte, []int) {
-	return fileDescriptor_api_117924c65de44d70, []int{6}
+	return fileDescriptor_api_1ccb1bab528ef6b7, []int{8}
 }
 func (m *Empty) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_Empty.Unmarshal(m, b)
@@ -404,6 +552,7 @@ type CommandRequest struct {
 	ChannelLink          string   `protobuf:"bytes,8,opt,name=channelLink,proto3" json:"channelLink,omitempty"`
 	IsIM                 bool     `protobuf:"varint,9,opt,name=isIM,proto3" json:"isIM,omitempty"`
 	JobID                uint64   `protobuf:"varint,10,opt,name=jobID,proto3" json:"jobID,omitempty"`
+	Cancel               bool     `protobuf:"varint,11,opt,name=cancel,proto3" json:"cancel,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -413,7 +562,7 @@ func (m *CommandRequest) Reset()         { *m = CommandRequest{} }
 func (m *CommandRequest) String() string { return proto.CompactTextString(m) }
 func (*CommandRequest) ProtoMessage()    {}
 func (*CommandRequest) Descriptor() ([]byte, []int) {
-	return fileDescriptor_api_117924c65de44d70, []int{7}
+	return fileDescriptor_api_1ccb1bab528ef6b7, []int{9}
 }
 func (m *CommandRequest) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_CommandRequest.Unmarshal(m, b)
@@ -503,6 +652,13 @@ func (m *CommandRequest) GetJobID() uint64 {
 	return 0
 }
 
+func (m *CommandRequest) GetCancel() bool {
+	if m != nil {
+		return m.Cancel
+	}
+	return false
+}
+
 type LogEntry struct {
 	JobID                uint64   `protobuf:"varint,1,opt,name=jobID,proto3" json:"jobID,omitempty"`
 	Line                 string   `protobuf:"bytes,2,opt,name=line,proto3" json:"line,omitempty"`
@@ -515,7 +671,7 @@ func (m *LogEntry) Reset()         { *m = LogEntry{} }
 func (m *LogEntry) String() string { return proto.CompactTextString(m) }
 func (*LogEntry) ProtoMessage()    {}
 func (*LogEntry) Descriptor() ([]byte, []int) {
-	return fileDescriptor_api_117924c65de44d70, []int{8}
+	return fileDescriptor_api_1ccb1bab528ef6b7, []int{10}
 }
 func (m *LogEntry) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_LogEntry.Unmarshal(m, b)
@@ -561,7 +717,7 @@ func (m *ErrorLogEntry) Reset()         { *m = ErrorLogEntry{} }
 func (m *ErrorLogEntry) String() string { return proto.CompactTextString(m) }
 func (*ErrorLogEntry) ProtoMessage()    {}
 func (*ErrorLogEntry) Descriptor() ([]byte, []int) {
-	return fileDescriptor_api_117924c65de44d70, []int{9}
+	return fileDescriptor_api_1ccb1bab528ef6b7, []int{11}
 }
 func (m *ErrorLogEntry) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_ErrorLogEntry.Unmarshal(m, b)
@@ -595,19 +751,85 @@ func (m *ErrorLogEntry) GetError() string {
 	return ""
 }
 
+type ArtifactChunk struct {
+	AgentID              string   `protobuf:"bytes,1,opt,name=agentID,proto3" json:"agentID,omitempty"`
+	JobID                uint64   `protobuf:"varint,2,opt,name=jobID,proto3" json:"jobID,omitempty"`
+	Name                 string   `protobuf:"bytes,3,opt,name=name,proto3" json:"name,omitempty"`
+	Content              []byte   `protobuf:"bytes,4,opt,name=content,proto3" json:"content,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ArtifactChunk) Reset()         { *m = ArtifactChunk{} }
+func (m *ArtifactChunk) String() string { return proto.CompactTextString(m) }
+func (*ArtifactChunk) ProtoMessage()    {}
+func (*ArtifactChunk) Descriptor() ([]byte, []int) {
+	return fileDescriptor_api_1ccb1bab528ef6b7, []int{12}
+}
+func (m *ArtifactChunk) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ArtifactChunk.Unmarshal(m, b)
+}
+func (m *ArtifactChunk) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ArtifactChunk.Marshal(b, m, deterministic)
+}
+func (dst *ArtifactChunk) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ArtifactChunk.Merge(dst, src)
+}
+func (m *ArtifactChunk) XXX_Size() int {
+	return xxx_messageInfo_ArtifactChunk.Size(m)
+}
+func (m *ArtifactChunk) XXX_DiscardUnknown() {
+	xxx_messageInfo_ArtifactChunk.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ArtifactChunk proto.InternalMessageInfo
+
+func (m *ArtifactChunk) GetAgentID() string {
+	if m != nil {
+		return m.AgentID
+	}
+	return ""
+}
+
+func (m *ArtifactChunk) GetJobID() uint64 {
+	if m != nil {
+		return m.JobID
+	}
+	return 0
+}
+
+func (m *ArtifactChunk) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+func (m *ArtifactChunk) GetContent() []byte {
+	if m != nil {
+		return m.Content
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterType((*AgentRegistration)(nil), "api.AgentRegistration")
 	proto.RegisterType((*AgentPrivateToken)(nil), "api.AgentPrivateToken")
 	proto.RegisterType((*AgentConfiguration)(nil), "api.AgentConfiguration")
 	proto.RegisterMapType((map[string]*RemoteCommand)(nil), "api.AgentConfiguration.CommandsEntry")
 	proto.RegisterMapType((map[string]string)(nil), "api.AgentConfiguration.LabelsEntry")
+	proto.RegisterType((*AgentCommands)(nil), "api.AgentCommands")
+	proto.RegisterMapType((map[string]*RemoteCommand)(nil), "api.AgentCommands.CommandsEntry")
 	proto.RegisterType((*CommandFinish)(nil), "api.CommandFinish")
+	proto.RegisterType((*AgentHeartbeat)(nil), "api.AgentHeartbeat")
 	proto.RegisterType((*Help)(nil), "api.Help")
 	proto.RegisterType((*RemoteCommand)(nil), "api.RemoteCommand")
 	proto.RegisterType((*Empty)(nil), "api.Empty")
 	proto.RegisterType((*CommandRequest)(nil), "api.CommandRequest")
 	proto.RegisterType((*LogEntry)(nil), "api.LogEntry")
 	proto.RegisterType((*ErrorLogEntry)(nil), "api.ErrorLogEntry")
+	proto.RegisterType((*ArtifactChunk)(nil), "api.ArtifactChunk")
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -618,9 +840,8 @@ var _ grpc.ClientConn
 // is compatible with the grpc package it is being compiled against.
 const _ = grpc.SupportPackageIsVersion4
 
-// RegistrationClient is the client API for Registration service.
-//
-// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+// Client API for Registration service
+
 type RegistrationClient interface {
 	Register(ctx context.Context, in *AgentRegistration, opts ...grpc.CallOption) (*AgentPrivateToken, error)
 }
@@ -635,14 +856,15 @@ func NewRegistrationClient(cc *grpc.ClientConn) RegistrationClient {
 
 func (c *registrationClient) Register(ctx context.Context, in *AgentRegistration, opts ...grpc.CallOption) (*AgentPrivateToken, error) {
 	out := new(AgentPrivateToken)
-	err := c.cc.Invoke(ctx, "/api.Registration/Register", in, out, opts...)
+	err := grpc.Invoke(ctx, "/api.Registration/Register", in, out, c.cc, opts...)
 	if err != nil {
 		return nil, err
 	}
 	return out, nil
 }
 
-// RegistrationServer is the server API for Registration service.
+// Server API for Registration service
+
 type RegistrationServer interface {
 	Register(context.Context, *AgentRegistration) (*AgentPrivateToken, error)
 }
@@ -682,12 +904,14 @@ var _Registration_serviceDesc = grpc.ServiceDesc{
 	Metadata: "api.proto",
 }
 
-// CommandPipelineClient is the client API for CommandPipeline service.
-//
-// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+// Client API for CommandPipeline service
+
 type CommandPipelineClient interface {
 	RegisterAgent(ctx context.Context, in *AgentConfiguration, opts ...grpc.CallOption) (CommandPipeline_RegisterAgentClient, error)
 	Finish(ctx context.Context, in *CommandFinish, opts ...grpc.CallOption) (*Empty, error)
+	Heartbeat(ctx context.Context, in *AgentHeartbeat, opts ...grpc.CallOption) (*Empty, error)
+	UploadArtifact(ctx context.Context, opts ...grpc.CallOption) (CommandPipeline_UploadArtifactClient, error)
+	UpdateCommands(ctx context.Context, in *AgentCommands, opts ...grpc.CallOption) (*Empty, error)
 }
 
 type commandPipelineClient struct {
@@ -699,7 +923,7 @@ func NewCommandPipelineClient(cc *grpc.ClientConn) CommandPipelineClient {
 }
 
 func (c *commandPipelineClient) RegisterAgent(ctx context.Context, in *AgentConfiguration, opts ...grpc.CallOption) (CommandPipeline_RegisterAgentClient, error) {
-	stream, err := c.cc.NewStream(ctx, &_CommandPipeline_serviceDesc.Streams[0], "/api.CommandPipeline/RegisterAgent", opts...)
+	stream, err := grpc.NewClientStream(ctx, &_CommandPipeline_serviceDesc.Streams[0], c.cc, "/api.CommandPipeline/RegisterAgent", opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -732,17 +956,73 @@ func (x *commandPipelineRegisterAgentClient) Recv() (*CommandRequest, error) {
 
 func (c *commandPipelineClient) Finish(ctx context.Context, in *CommandFinish, opts ...grpc.CallOption) (*Empty, error) {
 	out := new(Empty)
-	err := c.cc.Invoke(ctx, "/api.CommandPipeline/Finish", in, out, opts...)
+	err := grpc.Invoke(ctx, "/api.CommandPipeline/Finish", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *commandPipelineClient) Heartbeat(ctx context.Context, in *AgentHeartbeat, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := grpc.Invoke(ctx, "/api.CommandPipeline/Heartbeat", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *commandPipelineClient) UploadArtifact(ctx context.Context, opts ...grpc.CallOption) (CommandPipeline_UploadArtifactClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_CommandPipeline_serviceDesc.Streams[1], c.cc, "/api.CommandPipeline/UploadArtifact", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &commandPipelineUploadArtifactClient{stream}
+	return x, nil
+}
+
+type CommandPipeline_UploadArtifactClient interface {
+	Send(*ArtifactChunk) error
+	CloseAndRecv() (*Empty, error)
+	grpc.ClientStream
+}
+
+type commandPipelineUploadArtifactClient struct {
+	grpc.ClientStream
+}
+
+func (x *commandPipelineUploadArtifactClient) Send(m *ArtifactChunk) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *commandPipelineUploadArtifactClient) CloseAndRecv() (*Empty, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(Empty)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *commandPipelineClient) UpdateCommands(ctx context.Context, in *AgentCommands, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := grpc.Invoke(ctx, "/api.CommandPipeline/UpdateCommands", in, out, c.cc, opts...)
 	if err != nil {
 		return nil, err
 	}
 	return out, nil
 }
 
-// CommandPipelineServer is the server API for CommandPipeline service.
+// Server API for CommandPipeline service
+
 type CommandPipelineServer interface {
 	RegisterAgent(*AgentConfiguration, CommandPipeline_RegisterAgentServer) error
 	Finish(context.Context, *CommandFinish) (*Empty, error)
+	Heartbeat(context.Context, *AgentHeartbeat) (*Empty, error)
+	UploadArtifact(CommandPipeline_UploadArtifactServer) error
+	UpdateCommands(context.Context, *AgentCommands) (*Empty, error)
 }
 
 func RegisterCommandPipelineServer(s *grpc.Server, srv CommandPipelineServer) {
@@ -788,6 +1068,68 @@ func _CommandPipeline_Finish_Handler(srv interface{}, ctx context.Context, dec f
 	return interceptor(ctx, in, info, handler)
 }
 
+func _CommandPipeline_Heartbeat_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AgentHeartbeat)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CommandPipelineServer).Heartbeat(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.CommandPipeline/Heartbeat",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CommandPipelineServer).Heartbeat(ctx, req.(*AgentHeartbeat))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CommandPipeline_UploadArtifact_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(CommandPipelineServer).UploadArtifact(&commandPipelineUploadArtifactServer{stream})
+}
+
+type CommandPipeline_UploadArtifactServer interface {
+	SendAndClose(*Empty) error
+	Recv() (*ArtifactChunk, error)
+	grpc.ServerStream
+}
+
+type commandPipelineUploadArtifactServer struct {
+	grpc.ServerStream
+}
+
+func (x *commandPipelineUploadArtifactServer) SendAndClose(m *Empty) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *commandPipelineUploadArtifactServer) Recv() (*ArtifactChunk, error) {
+	m := new(ArtifactChunk)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _CommandPipeline_UpdateCommands_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AgentCommands)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CommandPipelineServer).UpdateCommands(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.CommandPipeline/UpdateCommands",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CommandPipelineServer).UpdateCommands(ctx, req.(*AgentCommands))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 var _CommandPipeline_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "api.CommandPipeline",
 	HandlerType: (*CommandPipelineServer)(nil),
@@ -796,6 +1138,14 @@ var _CommandPipeline_serviceDesc = grpc.ServiceDesc{
 			MethodName: "Finish",
 			Handler:    _CommandPipeline_Finish_Handler,
 		},
+		{
+			MethodName: "Heartbeat",
+			Handler:    _CommandPipeline_Heartbeat_Handler,
+		},
+		{
+			MethodName: "UpdateCommands",
+			Handler:    _CommandPipeline_UpdateCommands_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
@@ -803,13 +1153,17 @@ var _CommandPipeline_serviceDesc = grpc.ServiceDesc{
 			Handler:       _CommandPipeline_RegisterAgent_Handler,
 			ServerStreams: true,
 		},
+		{
+			StreamName:    "UploadArtifact",
+			Handler:       _CommandPipeline_UploadArtifact_Handler,
+			ClientStreams: true,
+		},
 	},
 	Metadata: "api.proto",
 }
 
-// LogWriterClient is the client API for LogWriter service.
-//
-// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+// Client API for LogWriter service
+
 type LogWriterClient interface {
 	Append(ctx context.Context, opts ...grpc.CallOption) (LogWriter_AppendClient, error)
 	SetError(ctx context.Context, in *ErrorLogEntry, opts ...grpc.CallOption) (*Empty, error)
@@ -824,7 +1178,7 @@ func NewLogWriterClient(cc *grpc.ClientConn) LogWriterClient {
 }
 
 func (c *logWriterClient) Append(ctx context.Context, opts ...grpc.CallOption) (LogWriter_AppendClient, error) {
-	stream, err := c.cc.NewStream(ctx, &_LogWriter_serviceDesc.Streams[0], "/api.LogWriter/Append", opts...)
+	stream, err := grpc.NewClientStream(ctx, &_LogWriter_serviceDesc.Streams[0], c.cc, "/api.LogWriter/Append", opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -859,14 +1213,15 @@ func (x *logWriterAppendClient) CloseAndRecv() (*Empty, error) {
 
 func (c *logWriterClient) SetError(ctx context.Context, in *ErrorLogEntry, opts ...grpc.CallOption) (*Empty, error) {
 	out := new(Empty)
-	err := c.cc.Invoke(ctx, "/api.LogWriter/SetError", in, out, opts...)
+	err := grpc.Invoke(ctx, "/api.LogWriter/SetError", in, out, c.cc, opts...)
 	if err != nil {
 		return nil, err
 	}
 	return out, nil
 }
 
-// LogWriterServer is the server API for LogWriter service.
+// Server API for LogWriter service
+
 type LogWriterServer interface {
 	Append(LogWriter_AppendServer) error
 	SetError(context.Context, *ErrorLogEntry) (*Empty, error)
@@ -939,53 +1294,67 @@ var _LogWriter_serviceDesc = grpc.ServiceDesc{
 	Metadata: "api.proto",
 }
 
-func init() { proto.RegisterFile("api.proto", fileDescriptor_api_117924c65de44d70) }
-
-var fileDescriptor_api_117924c65de44d70 = []byte{
-	// 711 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x84, 0x55, 0x4d, 0x6f, 0xd3, 0x4a,
-	0x14, 0x6d, 0x3e, 0x1b, 0xdf, 0x34, 0xaf, 0xef, 0xcd, 0xab, 0xfa, 0xac, 0xe8, 0x21, 0x45, 0x06,
-	0x44, 0x40, 0xa8, 0x42, 0xa1, 0x0b, 0xa0, 0x6c, 0xac, 0x36, 0xd0, 0x48, 0x41, 0x54, 0x6e, 0x25,
-	0xd6, 0x93, 0x76, 0x70, 0x86, 0xd8, 0x33, 0xc6, 0x1e, 0x17, 0x65, 0xc7, 0x9a, 0x25, 0xbf, 0x8c,
-	0x9f, 0x84, 0xe6, 0xce, 0xd8, 0xb1, 0x4b, 0x0b, 0xbb, 0x7b, 0xae, 0xef, 0x39, 0x73, 0xbf, 0x66,
-	0x0c, 0x0e, 0x4d, 0xf8, 0x41, 0x92, 0x4a, 0x25, 0x49, 0x8b, 0x26, 0xdc, 0x9b, 0xc2, 0x3f, 0x7e,
-	0xc8, 0x84, 0x0a, 0x58, 0xc8, 0x33, 0x95, 0x52, 0xc5, 0xa5, 0x20, 0x7b, 0xd0, 0xb9, 0x90, 0x2b,
-	0x26, 0xdc, 0xc6, 0xa8, 0x31, 0x76, 0x02, 0x03, 0xc8, 0x10, 0x7a, 0xa7, 0x32, 0x53, 0x82, 0xc6,
-	0xcc, 0x6d, 0xe2, 0x87, 0x12, 0x7b, 0x8f, 0xad, 0xcc, 0x59, 0xca, 0xaf, 0xa9, 0x62, 0x86, 0x70,
-	0xab, 0x8c, 0xf7, 0xa3, 0x09, 0x04, 0x63, 0x8f, 0xa5, 0xf8, 0xc8, 0xc3, 0xfc, 0xb7, 0x67, 0xfa,
-	0xd0, 0xbb, 0x94, 0x71, 0x4c, 0xc5, 0x55, 0xe6, 0x36, 0x47, 0xad, 0x71, 0x7f, 0xf2, 0xf0, 0x40,
-	0x57, 0xf0, 0xab, 0xc0, 0xc1, 0xb1, 0x8d, 0x9b, 0x0a, 0x95, 0xae, 0x83, 0x92, 0x46, 0x8e, 0xa0,
-	0x3b, 0xa7, 0x0b, 0x16, 0x65, 0x6e, 0x0b, 0x05, 0xee, 0xdf, 0x25, 0x60, 0xa2, 0x0c, 0xdd, 0x52,
-	0x88, 0x0b, 0xdb, 0x54, 0x47, 0xce, 0x4e, 0xdc, 0x36, 0xe6, 0x55, 0xc0, 0xe1, 0x7b, 0x18, 0xd4,
-	0x4e, 0x24, 0x7f, 0x43, 0x6b, 0xc5, 0xd6, 0x36, 0x7d, 0x6d, 0x92, 0x31, 0x74, 0xae, 0x69, 0x94,
-	0x9b, 0x6e, 0xf5, 0x27, 0x04, 0x0f, 0x0e, 0x58, 0x2c, 0x15, 0xb3, 0xd4, 0xc0, 0x04, 0xbc, 0x6a,
-	0xbe, 0x68, 0x0c, 0x5f, 0x42, 0xbf, 0x92, 0xc1, 0x2d, 0x72, 0x7b, 0x55, 0x39, 0xa7, 0x42, 0xf5,
-	0x64, 0x99, 0xcb, 0x1b, 0x2e, 0x78, 0xb6, 0xd4, 0xa1, 0x9f, 0xe4, 0x62, 0x76, 0x82, 0xf4, 0x76,
-	0x60, 0x80, 0x2e, 0xe6, 0x52, 0x0a, 0xc5, 0x84, 0xb2, 0x12, 0x05, 0xd4, 0xf1, 0x2c, 0x4d, 0x65,
-	0xea, 0xb6, 0x8c, 0x34, 0x82, 0xbb, 0x8b, 0xf7, 0x0e, 0xa1, 0x7d, 0xca, 0xa2, 0x44, 0x47, 0x9c,
-	0xe7, 0x71, 0x4c, 0xd3, 0x22, 0xd1, 0x02, 0x12, 0x02, 0x6d, 0x3f, 0x0d, 0xcd, 0xd0, 0x9c, 0x00,
-	0x6d, 0xef, 0x5b, 0x13, 0x06, 0xb5, 0xf2, 0x35, 0xff, 0x82, 0xc7, 0x4c, 0xe6, 0x0a, 0xf9, 0xad,
-	0xa0, 0x80, 0xc4, 0x83, 0x1d, 0x3f, 0x57, 0xcb, 0x73, 0xbd, 0x92, 0x2c, 0x5c, 0xdb, 0x84, 0x6b,
-	0x3e, 0xf2, 0x00, 0x06, 0x7e, 0x14, 0xc9, 0x2f, 0xec, 0xea, 0x6d, 0x2a, 0xf3, 0xc4, 0x0c, 0xd8,
-	0x09, 0xea, 0x4e, 0x32, 0x86, 0xdd, 0xe3, 0x25, 0x15, 0x82, 0x45, 0xa5, 0x98, 0xa9, 0xe6, 0xa6,
-	0x5b, 0x47, 0x5a, 0xaa, 0xfd, 0x92, 0xb9, 0x1d, 0x54, 0xbc, 0xe9, 0x26, 0xf7, 0xa0, 0xbd, 0x64,
-	0x51, 0xe2, 0x76, 0x71, 0xb0, 0x0e, 0x0e, 0x56, 0x37, 0x24, 0x40, 0xb7, 0x4e, 0x7e, 0x49, 0xb3,
-	0x53, 0xbd, 0x1b, 0x4b, 0xba, 0x62, 0xee, 0xf6, 0xa8, 0x31, 0xee, 0x05, 0x35, 0x9f, 0xb7, 0x0d,
-	0x9d, 0x69, 0x9c, 0xa8, 0xb5, 0xf7, 0xbd, 0x09, 0x7f, 0x15, 0xeb, 0xc0, 0x3e, 0xe7, 0x2c, 0x53,
-	0x66, 0x50, 0xe8, 0x29, 0xda, 0x6a, 0xa1, 0x6e, 0x2b, 0xad, 0xb4, 0x55, 0xdb, 0xfa, 0x5e, 0xe6,
-	0x19, 0x4b, 0xf1, 0x5e, 0x9a, 0xf9, 0x95, 0x98, 0xec, 0x43, 0x57, 0xdb, 0xe5, 0x04, 0x2d, 0x2a,
-	0x38, 0x73, 0x2e, 0x56, 0x6e, 0x67, 0xc3, 0xd1, 0x18, 0x4f, 0x37, 0x85, 0x62, 0x7d, 0xfa, 0x74,
-	0x03, 0xc9, 0xff, 0xe0, 0x58, 0x73, 0x76, 0x82, 0x45, 0x39, 0xc1, 0xc6, 0x41, 0x46, 0xd0, 0xb7,
-	0x00, 0x65, 0x7b, 0xf8, 0xbd, 0xea, 0xd2, 0xd9, 0xf3, 0x6c, 0xf6, 0xce, 0x75, 0xb0, 0x1f, 0x68,
-	0x6f, 0x56, 0x15, 0x2a, 0xab, 0xea, 0x1d, 0x42, 0x6f, 0x2e, 0x43, 0x73, 0x13, 0x6e, 0x5f, 0x66,
-	0x02, 0xed, 0x88, 0x8b, 0xe2, 0x32, 0xa0, 0xed, 0x1d, 0xc1, 0x60, 0xaa, 0x37, 0xf7, 0x0f, 0xd4,
-	0x72, 0xdb, 0x9b, 0x95, 0x6d, 0x9f, 0xcc, 0x61, 0xa7, 0xf6, 0x08, 0xbe, 0x86, 0x9e, 0xc1, 0x2c,
-	0x25, 0xfb, 0x9b, 0x37, 0xa3, 0x1a, 0x33, 0xac, 0xf8, 0xab, 0x2f, 0x9f, 0xb7, 0x35, 0xf9, 0xda,
-	0x80, 0x5d, 0x3b, 0xd5, 0x33, 0x9e, 0x30, 0x9d, 0x1e, 0xf1, 0xf5, 0xfa, 0x1b, 0x45, 0xa4, 0x90,
-	0xff, 0xee, 0x78, 0x8a, 0x86, 0xff, 0xe2, 0x87, 0xfa, 0x56, 0x78, 0x5b, 0xcf, 0x1a, 0xe4, 0x09,
-	0x74, 0xed, 0x15, 0x27, 0xd5, 0x10, 0xe3, 0x1b, 0x02, 0xfa, 0xcc, 0x5a, 0x6d, 0x4d, 0x16, 0xe0,
-	0xcc, 0x65, 0xf8, 0x21, 0xe5, 0xba, 0x82, 0x47, 0xd0, 0xf5, 0x93, 0x84, 0x89, 0x2b, 0x32, 0xc0,
-	0xa0, 0xa2, 0x45, 0x75, 0xce, 0xb8, 0x41, 0x9e, 0x42, 0xef, 0x9c, 0x29, 0x6c, 0xa3, 0x3d, 0xa3,
-	0xd6, 0xd2, 0x7a, 0xfc, 0xa2, 0x8b, 0xbf, 0x92, 0xe7, 0x3f, 0x03, 0x00, 0x00, 0xff, 0xff, 0xde,
-	0xce, 0xc9, 0x96, 0x57, 0x06, 0x00, 0x00,
+func init() { proto.RegisterFile("api.proto", fileDescriptor_api_1ccb1bab528ef6b7) }
+
+var fileDescriptor_api_1ccb1bab528ef6b7 = []byte{
+	// 934 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xac, 0x56, 0x51, 0x6f, 0xe3, 0x44,
+	0x10, 0x6e, 0x9c, 0x34, 0x8d, 0x27, 0x4d, 0x0f, 0xf6, 0x4e, 0xc5, 0x8a, 0x00, 0x55, 0x06, 0x44,
+	0x40, 0xa8, 0x42, 0xa1, 0x0f, 0xc0, 0xdd, 0x4b, 0xd4, 0xcb, 0xd1, 0x4a, 0x41, 0x9c, 0xdc, 0x43,
+	0x3c, 0x6f, 0x92, 0xbd, 0x78, 0xaf, 0xf6, 0xae, 0x59, 0xaf, 0x0b, 0xfd, 0x0b, 0xfc, 0x04, 0x9e,
+	0x79, 0xba, 0x5f, 0xc0, 0xcf, 0x43, 0x3b, 0xbb, 0xeb, 0xd8, 0x6d, 0x73, 0xbc, 0xdc, 0xdb, 0x7c,
+	0x9f, 0x67, 0x66, 0x77, 0xbe, 0x9d, 0x99, 0x04, 0x42, 0x5a, 0xf0, 0xd3, 0x42, 0x49, 0x2d, 0x49,
+	0x97, 0x16, 0x3c, 0x9e, 0xc3, 0x87, 0xb3, 0x0d, 0x13, 0x3a, 0x61, 0x1b, 0x5e, 0x6a, 0x45, 0x35,
+	0x97, 0x82, 0x3c, 0x81, 0xfd, 0x57, 0xf2, 0x9a, 0x89, 0xa8, 0x73, 0xd2, 0x99, 0x84, 0x89, 0x05,
+	0x64, 0x0c, 0x83, 0x0b, 0x59, 0x6a, 0x41, 0x73, 0x16, 0x05, 0xf8, 0xa1, 0xc6, 0xf1, 0x57, 0x2e,
+	0xcd, 0x4b, 0xc5, 0x6f, 0xa8, 0x66, 0x36, 0xe0, 0xc1, 0x34, 0xf1, 0xdb, 0x2e, 0x10, 0xf4, 0x3d,
+	0x97, 0xe2, 0x35, 0xdf, 0x54, 0xef, 0x3c, 0x73, 0x06, 0x83, 0x95, 0xcc, 0x73, 0x2a, 0xd6, 0x65,
+	0x14, 0x9c, 0x74, 0x27, 0xc3, 0xe9, 0x17, 0xa7, 0xa6, 0x82, 0xfb, 0x09, 0x4e, 0xcf, 0x9d, 0xdf,
+	0x5c, 0x68, 0x75, 0x9b, 0xd4, 0x61, 0xe4, 0x29, 0xf4, 0x17, 0x74, 0xc9, 0xb2, 0x32, 0xea, 0x62,
+	0x82, 0xcf, 0x76, 0x25, 0xb0, 0x5e, 0x36, 0xdc, 0x85, 0x90, 0x08, 0x0e, 0xa8, 0xf1, 0xbc, 0x7c,
+	0x1e, 0xf5, 0xf0, 0x5e, 0x1e, 0x92, 0x23, 0x08, 0x64, 0x19, 0xed, 0x23, 0x19, 0xc8, 0x92, 0x10,
+	0xe8, 0x51, 0xb5, 0x4a, 0xa3, 0x3e, 0x32, 0x68, 0x1b, 0xc5, 0x52, 0xaf, 0xd8, 0x81, 0x55, 0xcc,
+	0x63, 0x93, 0xf9, 0x86, 0xa9, 0x92, 0x4b, 0x11, 0x0d, 0x6c, 0x66, 0x07, 0xc7, 0xbf, 0xc0, 0xa8,
+	0x55, 0x0b, 0xf9, 0x00, 0xba, 0xd7, 0xec, 0xd6, 0x09, 0x63, 0x4c, 0x32, 0x81, 0xfd, 0x1b, 0x9a,
+	0x55, 0xf6, 0x1d, 0x86, 0x53, 0x82, 0x25, 0x25, 0x2c, 0x97, 0x9a, 0xb9, 0xd0, 0xc4, 0x3a, 0xfc,
+	0x18, 0x7c, 0xdf, 0x19, 0xff, 0x00, 0xc3, 0x46, 0x6d, 0x0f, 0xa4, 0x7b, 0xd2, 0x4c, 0x17, 0x36,
+	0x42, 0xe3, 0x7f, 0x3b, 0x30, 0x72, 0x52, 0x39, 0x39, 0x1b, 0x8a, 0x74, 0xda, 0x8a, 0x3c, 0xbb,
+	0xf7, 0x56, 0x27, 0x4d, 0xa9, 0xed, 0x97, 0x5d, 0xcf, 0xf4, 0xde, 0xab, 0x8e, 0x65, 0x9d, 0xf0,
+	0x05, 0x17, 0xbc, 0x4c, 0x4d, 0x95, 0x6f, 0xe4, 0xd2, 0xdd, 0xbb, 0x97, 0x58, 0x60, 0xea, 0x59,
+	0x49, 0xa1, 0x99, 0xd0, 0xae, 0x7a, 0x0f, 0x8d, 0x3f, 0x53, 0x4a, 0xaa, 0xa8, 0x6b, 0x55, 0x41,
+	0xb0, 0xbb, 0x23, 0xe2, 0x7f, 0x3a, 0x70, 0x84, 0xb5, 0x5e, 0x30, 0xaa, 0xf4, 0x92, 0x51, 0xfd,
+	0x0e, 0xb1, 0x62, 0x38, 0x7c, 0x23, 0x97, 0xe5, 0xfc, 0x4f, 0xb6, 0xaa, 0x34, 0x5b, 0xe3, 0xd9,
+	0xbd, 0xa4, 0xc5, 0x91, 0x4f, 0x01, 0x0c, 0x7e, 0x41, 0x79, 0xc6, 0xd6, 0x78, 0x8b, 0x5e, 0xd2,
+	0x60, 0xc8, 0x09, 0x0c, 0x0d, 0x4a, 0x2a, 0x21, 0xb8, 0xd8, 0xe0, 0x75, 0xba, 0x49, 0x93, 0x32,
+	0x4d, 0x99, 0x49, 0xba, 0xc6, 0x36, 0xed, 0x24, 0x68, 0xc7, 0x67, 0xd0, 0xbb, 0x60, 0x59, 0x61,
+	0xee, 0x76, 0x55, 0xe5, 0x39, 0x55, 0x5e, 0x63, 0x0f, 0x4d, 0xd4, 0x4c, 0x6d, 0xec, 0x23, 0x86,
+	0x09, 0xda, 0xf1, 0x5f, 0x01, 0x8c, 0x5a, 0x52, 0x9b, 0xf8, 0x57, 0x3c, 0x67, 0xb2, 0xd2, 0x18,
+	0xdf, 0x4d, 0x3c, 0x34, 0xb5, 0xcd, 0x2a, 0x9d, 0x5e, 0x99, 0x75, 0xc2, 0x36, 0xb7, 0x4e, 0xd7,
+	0x16, 0x47, 0x3e, 0x87, 0xd1, 0x2c, 0xcb, 0xe4, 0x1f, 0x6c, 0xfd, 0x93, 0x92, 0x55, 0x61, 0x87,
+	0x33, 0x4c, 0xda, 0x24, 0x99, 0xc0, 0xa3, 0xf3, 0x94, 0x0a, 0xc1, 0xb2, 0x3a, 0x99, 0x15, 0xfd,
+	0x2e, 0x6d, 0x3c, 0x5d, 0xa8, 0xfb, 0x62, 0x66, 0xd3, 0x64, 0xbc, 0x4b, 0x93, 0x4f, 0xa0, 0x97,
+	0xb2, 0xac, 0xc0, 0x41, 0x1d, 0x4e, 0x43, 0x6c, 0x22, 0x23, 0x48, 0x82, 0xb4, 0xb9, 0x7c, 0x4a,
+	0xcb, 0x0b, 0xd3, 0x87, 0x29, 0xbd, 0xb6, 0x73, 0x3b, 0x48, 0x5a, 0x5c, 0x7c, 0x00, 0xfb, 0xf3,
+	0xbc, 0xd0, 0xb7, 0xf1, 0xdb, 0x00, 0x8e, 0x7c, 0xeb, 0xb1, 0xdf, 0x2b, 0x56, 0x6a, 0xdb, 0x4f,
+	0xc8, 0x78, 0x59, 0x1d, 0xb4, 0x1b, 0x62, 0x2b, 0xab, 0xb1, 0xcd, 0x86, 0xa8, 0x4a, 0xa6, 0x70,
+	0x43, 0xd8, 0x36, 0xab, 0x31, 0x39, 0x86, 0xbe, 0xb1, 0xeb, 0x46, 0x73, 0xc8, 0xc7, 0x2c, 0xb8,
+	0xb8, 0x76, 0xfb, 0xa7, 0xc6, 0x78, 0xba, 0x2d, 0xd4, 0x2d, 0x22, 0x0f, 0xc9, 0xc7, 0x10, 0x3a,
+	0xf3, 0xf2, 0xb9, 0x5b, 0x46, 0x5b, 0xc2, 0xb4, 0x92, 0x03, 0x98, 0xd6, 0x6e, 0xa4, 0x26, 0x65,
+	0x6e, 0xcf, 0xcb, 0xcb, 0x9f, 0xa3, 0x10, 0xf5, 0x40, 0x7b, 0x3b, 0x51, 0xd0, 0x9c, 0xa8, 0x63,
+	0xe8, 0xaf, 0xa8, 0x58, 0xb1, 0x2c, 0x1a, 0xa2, 0xaf, 0x43, 0xf1, 0x19, 0x0c, 0x16, 0x72, 0x63,
+	0x87, 0xfb, 0xe1, 0x59, 0x34, 0xed, 0xca, 0x85, 0x5f, 0x43, 0x68, 0xc7, 0x4f, 0x61, 0x34, 0x37,
+	0x83, 0xf7, 0x3f, 0xa1, 0xf5, 0xb0, 0x06, 0x8d, 0x61, 0x8d, 0x73, 0x18, 0xcd, 0x94, 0xe6, 0xaf,
+	0xe9, 0x4a, 0x9f, 0xa7, 0x95, 0xd5, 0x67, 0xc7, 0x40, 0xd6, 0x69, 0x83, 0x3b, 0x37, 0x6a, 0xbc,
+	0x4d, 0xcf, 0x6f, 0x6e, 0xbf, 0x31, 0xcc, 0xc3, 0x1c, 0xd6, 0x1b, 0x63, 0xba, 0x80, 0xc3, 0xd6,
+	0xef, 0xe8, 0x33, 0x18, 0x58, 0xcc, 0x14, 0x39, 0xde, 0xee, 0xc2, 0xa6, 0xcf, 0xb8, 0xc1, 0x37,
+	0x7f, 0x3c, 0xe3, 0xbd, 0xe9, 0xdf, 0x01, 0x3c, 0x72, 0xcd, 0xf5, 0x92, 0x17, 0xcc, 0xa8, 0x41,
+	0x66, 0x30, 0xb2, 0xd1, 0x4c, 0x61, 0x08, 0xf9, 0x68, 0xc7, 0xaf, 0xd9, 0xf8, 0x31, 0x7e, 0x68,
+	0x37, 0x67, 0xbc, 0xf7, 0x6d, 0x87, 0x7c, 0x0d, 0x7d, 0xb7, 0x10, 0x49, 0xd3, 0xc5, 0x72, 0x63,
+	0x40, 0xce, 0x76, 0xf7, 0x1e, 0x39, 0x85, 0x70, 0xbb, 0xcc, 0x1e, 0x6f, 0x8f, 0xaa, 0xc9, 0x3b,
+	0xfe, 0x67, 0x70, 0xf4, 0x6b, 0x61, 0xb6, 0x8c, 0x57, 0xdd, 0x9d, 0xd1, 0x7a, 0x84, 0x76, 0xcc,
+	0xa4, 0x43, 0xa6, 0x26, 0x6a, 0x4d, 0xeb, 0xd5, 0x52, 0x12, 0xb2, 0x3d, 0xca, 0x73, 0xed, 0xa8,
+	0xe9, 0x12, 0xc2, 0x85, 0xdc, 0xfc, 0xa6, 0xb8, 0xd1, 0xf6, 0x4b, 0xe8, 0xcf, 0x8a, 0x82, 0x89,
+	0x35, 0x19, 0xa1, 0x93, 0xef, 0x95, 0x7b, 0x27, 0x7d, 0x03, 0x83, 0x2b, 0xa6, 0xb1, 0x9f, 0xdc,
+	0x19, 0xad, 0xde, 0x6a, 0xfb, 0x2f, 0xfb, 0xf8, 0x3f, 0xe9, 0xbb, 0xff, 0x06, 0x00, 0xc7, 0x08,
+	0x91, 0x09, 0x34, 0x09, 0x00, 0x00,
 }
@@ -0,0 +1,8 @@
+package api
+
+// Metadata the agents send with every call, so the server can check who is
+// calling on each of them and not only when the agent registers
+const (
+	AgentIDMetadataKey = "meeseeks-agent-id"
+	TokenMetadataKey   = "meeseeks-agent-token"
+)
@@ -0,0 +1,98 @@
+package registry
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Agent is a remote agent that is registered, with where it runs and what it
+// runs
+type Agent struct {
+	ID           string
+	Identity     string
+	Labels       map[string]string
+	OS           string
+	Arch         string
+	Hostname     string
+	Version      string
+	Commands     []string
+	RegisteredAt time.Time
+}
+
+// Implicit labels every agent gets from where it runs, the ones the agent
+// sets itself win
+const (
+	LabelOS       = "os"
+	LabelArch     = "arch"
+	LabelHostname = "hostname"
+	LabelVersion  = "version"
+)
+
+var agents = map[string]Agent{}
+var mutex sync.Mutex
+
+// Add adds the agent, replacing it when it was already registered
+func Add(agent Agent) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	agents[agent.ID] = agent
+}
+
+// SetCommands replaces the commands of the agent when it changes them while
+// it's registered
+func SetCommands(agentID string, commands []string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	agent, ok := agents[agentID]
+	if !ok {
+		return
+	}
+	agent.Commands = commands
+	agents[agentID] = agent
+}
+
+// Remove removes the agent once it's gone
+func Remove(agentID string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	delete(agents, agentID)
+}
+
+// List returns the registered agents sorted by their ID
+func List() []Agent {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	list := make([]Agent, 0, len(agents))
+	for _, agent := range agents {
+		list = append(list, agent)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// ImplicitLabels returns the labels of the agent with the implicit ones it
+// doesn't set itself
+func ImplicitLabels(labels map[string]string, agent Agent) map[string]string {
+	merged := map[string]string{
+		LabelOS:       agent.OS,
+		LabelArch:     agent.Arch,
+		LabelHostname: agent.Hostname,
+		LabelVersion:  agent.Version,
+	}
+	for name, value := range merged {
+		if value == "" {
+			delete(merged, name)
+		}
+	}
+	for name, value := range labels {
+		merged[name] = value
+	}
+	return merged
+}
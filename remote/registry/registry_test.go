@@ -0,0 +1,45 @@
+package registry_test
+
+import (
+	"testing"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/mocks"
+	"gitlab.com/yakshaving.art/meeseeks-box/remote/registry"
+)
+
+func TestImplicitLabels(t *testing.T) {
+	tt := []struct {
+		name     string
+		labels   map[string]string
+		agent    registry.Agent
+		expected map[string]string
+	}{
+		{
+			name:     "no labels",
+			expected: map[string]string{},
+		},
+		{
+			name:   "where the agent runs",
+			labels: map[string]string{"tier": "web"},
+			agent:  registry.Agent{OS: "linux", Arch: "arm64", Hostname: "web-01", Version: "1.2.3"},
+			expected: map[string]string{
+				"tier":     "web",
+				"os":       "linux",
+				"arch":     "arm64",
+				"hostname": "web-01",
+				"version":  "1.2.3",
+			},
+		},
+		{
+			name:     "the labels of the agent win",
+			labels:   map[string]string{"hostname": "web"},
+			agent:    registry.Agent{Hostname: "web-01"},
+			expected: map[string]string{"hostname": "web"},
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			mocks.AssertEquals(t, tc.expected, registry.ImplicitLabels(tc.labels, tc.agent))
+		})
+	}
+}
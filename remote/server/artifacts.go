@@ -0,0 +1,69 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks/reports"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/artifacts"
+	"gitlab.com/yakshaving.art/meeseeks-box/remote/api"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// UploadArtifact keeps an artifact a job left on the agent that runs it, the
+// agent sends it in chunks before it finishes the job
+func (p *commandPipelineServer) UploadArtifact(upload api.CommandPipeline_UploadArtifactServer) error {
+	var first *api.ArtifactChunk
+	content := bytes.NewBuffer(nil)
+	for {
+		chunk, err := upload.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if first == nil {
+			if err := p.checkUpload(upload.Context(), chunk); err != nil {
+				logrus.Warnf("rejected artifact %s of job %d from agent %s: %s", chunk.GetName(), chunk.GetJobID(), chunk.GetAgentID(), err)
+				return status.Error(codes.PermissionDenied, err.Error())
+			}
+			first = chunk
+		}
+		if int64(content.Len()+len(chunk.GetContent())) > artifacts.MaxSize() {
+			return status.Errorf(codes.ResourceExhausted, "artifact %s of job %d is bigger than the %d bytes allowed",
+				first.GetName(), first.GetJobID(), artifacts.MaxSize())
+		}
+		content.Write(chunk.GetContent())
+	}
+	if first == nil {
+		return status.Error(codes.InvalidArgument, "the artifact had no chunks")
+	}
+
+	if err := artifacts.Save(first.GetJobID(), first.GetName(), content.Bytes()); err != nil {
+		reports.Errorf(reports.ComponentServer, reports.Tags{
+			"job_id": fmt.Sprintf("%d", first.GetJobID()),
+			"agent":  first.GetAgentID(),
+		}, "could not keep artifact %s of job %d: %s", first.GetName(), first.GetJobID(), err)
+		return status.Error(codes.Internal, err.Error())
+	}
+	logrus.Infof("kept artifact %s of job %d from agent %s", first.GetName(), first.GetJobID(), first.GetAgentID())
+	return upload.SendAndClose(&api.Empty{})
+}
+
+// checkUpload checks that the artifact comes from the agent that calls and
+// belongs to a job that is running in it
+func (p *commandPipelineServer) checkUpload(ctx context.Context, chunk *api.ArtifactChunk) error {
+	if !artifacts.Enabled() {
+		return fmt.Errorf("artifacts are not enabled")
+	}
+	if err := p.checkCaller(ctx, chunk.GetAgentID()); err != nil {
+		return err
+	}
+	return p.checkDispatched(chunk.GetJobID(), chunk.GetAgentID())
+}
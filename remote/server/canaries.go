@@ -0,0 +1,71 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"sync"
+)
+
+// Canary sends a share of the jobs of a command to the agents that have its
+// labels, like the ones of a new version of the agent or the command, and
+// the rest to the ones that don't, so it can be tried on real traffic before
+// it's rolled out everywhere. Percent is the share of the jobs, spread evenly
+// over them, like 1 of every 20 with 5
+type Canary struct {
+	Labels  map[string]string `yaml:"labels"`
+	Percent float64           `yaml:"percent"`
+}
+
+// Canaries are the canaries of each command
+type Canaries map[string]Canary
+
+// Validate checks that the canaries have labels and a share of the jobs
+func (c Canaries) Validate() error {
+	for command, canary := range c {
+		if len(canary.Labels) == 0 {
+			return fmt.Errorf("canary of command %s has no labels", command)
+		}
+		if canary.Percent < 0 || canary.Percent > 100 {
+			return fmt.Errorf("canary of command %s has to get between 0 and 100 percent of the jobs", command)
+		}
+	}
+	return nil
+}
+
+var canaries Canaries
+var canariesLock sync.Mutex
+
+// ConfigureCanaries sets the canaries of the commands
+func ConfigureCanaries(configured Canaries) {
+	canariesLock.Lock()
+	defer canariesLock.Unlock()
+
+	canaries = configured
+}
+
+func canaryOf(command string) (Canary, bool) {
+	canariesLock.Lock()
+	defer canariesLock.Unlock()
+
+	canary, ok := canaries[command]
+	return canary, ok
+}
+
+// canaryCount is how many jobs of a command were sent while it had both
+// canary and stable agents, and how many of them went to the canaries
+type canaryCount struct {
+	jobs    int
+	canary  int
+	percent float64
+}
+
+// next returns true when the next job goes to the canaries, the ones that
+// went to them are kept at their share of all the jobs
+func (c *canaryCount) next() bool {
+	c.jobs++
+	if c.canary < int(math.Floor(float64(c.jobs)*c.percent/100+1e-9)) {
+		c.canary++
+		return true
+	}
+	return false
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// certificates holds the cert and key of the server, and the bundle of CAs
+// the certs of the agents are verified with in mtls. They are loaded again
+// when they are reloaded or their files change, the agents that are already
+// connected keep their connection and the new ones get the new material
+type certificates struct {
+	config Config
+
+	cert        *tls.Certificate
+	cas         *x509.CertPool
+	fingerprint string
+
+	lock sync.RWMutex
+}
+
+func newCertificates(c Config) (*certificates, error) {
+	certs := &certificates{config: c}
+	if err := certs.load(); err != nil {
+		return nil, err
+	}
+	return certs, nil
+}
+
+// load reads the cert, the key and the CAs again, the ones that were loaded
+// before are kept when they can't be read
+func (c *certificates) load() error {
+	// The fingerprint is taken first so the files that are replaced while
+	// they are loaded are picked up by the next check
+	fingerprint, _ := c.config.fingerprint()
+
+	cert, err := tls.LoadX509KeyPair(c.config.CertPath, c.config.KeyPath)
+	if err != nil {
+		return fmt.Errorf("could not load server cert: %s", err)
+	}
+	var cas *x509.CertPool
+	if c.config.SecurityMode == SecurityModeMTLS {
+		if cas, err = loadCABundle(c.config.CAPath); err != nil {
+			return err
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.cert, c.cas, c.fingerprint = &cert, cas, fingerprint
+	return nil
+}
+
+// changed returns true when the content of the files is not the one that was
+// loaded last
+func (c *certificates) changed() bool {
+	fingerprint, err := c.config.fingerprint()
+	if err != nil {
+		logrus.Debugf("could not check the grpc certs for changes: %s", err)
+		return false
+	}
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return fingerprint != c.fingerprint
+}
+
+// tlsConfig returns the tls configuration of the server, which picks the
+// material that is loaded when each agent connects
+func (c *certificates) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c.lock.RLock()
+			defer c.lock.RUnlock()
+
+			current := &tls.Config{
+				Certificates: []tls.Certificate{*c.cert},
+				NextProtos:   []string{"h2"},
+			}
+			if c.cas != nil {
+				current.ClientAuth = tls.RequireAndVerifyClientCert
+				current.ClientCAs = c.cas
+			}
+			return current, nil
+		},
+	}
+}
+
+// watch loads the material again every time its files change until stop is
+// closed
+func (c *certificates) watch(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		if !c.changed() {
+			continue
+		}
+		logrus.Infof("grpc certs changed, reloading them")
+		if err := c.load(); err != nil {
+			logrus.Errorf("failed to reload grpc certs, keeping the previous ones: %s", err)
+		}
+	}
+}
+
+// loadCABundle loads all the CAs of the file, more than one can be trusted
+// while the certs move from one to another
+func loadCABundle(path string) (*x509.CertPool, error) {
+	ca, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read CA cert: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certs found in CA file %s", path)
+	}
+	return pool, nil
+}
+
+// fingerprint returns a hash of the content of the cert, key and CA files
+func (c Config) fingerprint() (string, error) {
+	h := sha256.New()
+	for _, name := range []string{c.CertPath, c.KeyPath, c.CAPath} {
+		if name == "" {
+			continue
+		}
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			return "", fmt.Errorf("could not read %s: %s", name, err)
+		}
+		fmt.Fprintf(h, "%s %d\n", name, len(b))
+		h.Write(b)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
@@ -5,16 +5,25 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"gitlab.com/yakshaving.art/meeseeks-box/commands"
 	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks/metrics"
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks/reports"
 	"gitlab.com/yakshaving.art/meeseeks-box/persistence"
+	"gitlab.com/yakshaving.art/meeseeks-box/remote/agenttokens"
 	"gitlab.com/yakshaving.art/meeseeks-box/remote/api"
+	"gitlab.com/yakshaving.art/meeseeks-box/remote/registry"
 
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
 )
 
@@ -23,43 +32,148 @@ type finishPayload struct {
 }
 
 type commandPipelineServer struct {
-	runningJobs map[uint64]chan finishedJob
+	runningJobs map[uint64]runningJob
+
+	requireToken bool
+
+	identities map[string]agentIdentity
+	beats      map[string]time.Time
+	agents     map[string]*remoteAgent
+
+	pools *agentPools
 
 	lock *sync.Mutex
 }
 
-func newCommandPipelineServer() *commandPipelineServer {
+func newCommandPipelineServer(requireToken bool) *commandPipelineServer {
 	return &commandPipelineServer{
-		runningJobs: make(map[uint64]chan finishedJob),
+		runningJobs:  make(map[uint64]runningJob),
+		requireToken: requireToken,
+		identities:   make(map[string]agentIdentity),
+		beats:        make(map[string]time.Time),
+		agents:       make(map[string]*remoteAgent),
+		pools:        newAgentPools(),
 
 		lock: &sync.Mutex{},
 	}
 }
 
+// agentIdentity is the identity of the cert and the name of the token an
+// agent registered with, and how many times it's registered as an agent can
+// reconnect before its previous stream is gone
+type agentIdentity struct {
+	identity      string
+	tokenName     string
+	labels        map[string]string
+	registrations int
+}
+
+// runningJob is a job that was dispatched to an agent, and the channel its
+// finish is sent to
+type runningJob struct {
+	agentID  string
+	finished chan finishedJob
+}
+
 type jobStarter interface {
-	StartJob(req api.CommandRequest) chan finishedJob
+	StartJob(agentID string, req api.CommandRequest) chan finishedJob
+	StopJob(jobID uint64, agentID string)
 }
 
 // RegisterAgent registers a new agent service
 func (p *commandPipelineServer) RegisterAgent(in *api.AgentConfiguration, agent api.CommandPipeline_RegisterAgentServer) error {
-	// TODO: check the in.GetToken()
-	// TODO: register the commands using the in.GetLabels()
+	revoked := make(<-chan struct{})
+	tokenName, err := agenttokens.Verify(in.GetToken())
+	if err != nil && p.requireToken {
+		logrus.Warnf("rejected registration of remote agent %s: %s", in.GetAgentID(), err)
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+	if err == nil && !agenttokens.Owns(tokenName, in.GetAgentID()) {
+		err = fmt.Errorf("agent %s does not belong to the token of %s", in.GetAgentID(), tokenName)
+		logrus.Warnf("rejected registration of remote agent %s: %s", in.GetAgentID(), err)
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	if err == nil {
+		logrus.Infof("agent %s registered with the token of %s", in.GetAgentID(), tokenName)
+
+		var stopWatching func()
+		revoked, stopWatching = agenttokens.Watch(tokenName)
+		defer stopWatching()
+	}
 
-	pipe, err := p.registerAgent(in)
+	if err := checkPolicies(tokenName, in); err != nil {
+		logrus.Warnf("rejected registration of remote agent %s: %s", in.GetAgentID(), err)
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	identity := peerIdentity(agent.Context())
+	if err := p.bindIdentity(in.GetAgentID(), identity, tokenName, in.GetLabels()); err != nil {
+		logrus.Warnf("rejected registration of remote agent %s: %s", in.GetAgentID(), err)
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	defer p.unbindIdentity(in.GetAgentID())
+
+	registered, err := p.registerAgent(in, identity, tokenName)
+	if status.Code(err) == codes.AlreadyExists {
+		logrus.Warnf("rejected registration of remote agent %s: %s", in.GetAgentID(), err)
+		return err
+	}
 	if err != nil {
 		return fmt.Errorf("failed to register remote agent %s: %s", in.GetAgentID(), err)
 	}
-
+	info := agentInfo(in, identity)
+	info.Commands = registered.commandNames()
+	registry.Add(info)
+	pipe := registered.agentPipe
+
+	// The watcher only tells the loop to stop, the pipe is never closed as
+	// the jobs picked for the agent may still be sending to it
+	beats := heartbeatsConfig()
+	kicked := make(chan struct{})
+	unhealthy := make(chan struct{})
+	stop := make(chan struct{})
 	go func() {
-		select {
-		case <-agent.Context().Done():
-			logrus.Infof("agent %s context is done in server with error %s, closing pipe", in.GetAgentID(), agent.Context().Err())
-			close(pipe)
+		defer close(stop)
+
+		ticker := time.NewTicker(beats.interval())
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-agent.Context().Done():
+				logrus.Infof("agent %s context is done in server with error %s, stopping", in.GetAgentID(), agent.Context().Err())
+				return
+			case <-registered.done:
+				return
+			case <-revoked:
+				logrus.Infof("the token of agent %s was rotated or revoked, stopping", in.GetAgentID())
+				close(kicked)
+				return
+			case <-ticker.C:
+				if tokenName != "" && !stillValid(in) {
+					logrus.Infof("the token of agent %s is no longer valid, stopping", in.GetAgentID())
+					close(kicked)
+					return
+				}
+				if !p.missedHeartbeats(in.GetAgentID(), beats) {
+					continue
+				}
+				logrus.Warnf("agent %s missed %d heartbeats, stopping", in.GetAgentID(), beats.misses())
+				close(unhealthy)
+				return
+			}
 		}
 	}()
 
 Loop:
-	for req := range pipe {
+	for {
+		var req api.CommandRequest
+		select {
+		case <-stop:
+			break Loop
+		case req = <-pipe:
+		}
+
 		err := agent.Send(&req)
 		logrus.Debugf("request %#v sent to remote agent %s", req, in.GetAgentID())
 
@@ -71,7 +185,6 @@ Loop:
 				content: "",
 				err:     fmt.Sprintf("remote agent %s erred out with EOF, it seems to be gone", in.GetAgentID()),
 			})
-			close(pipe)
 			break Loop
 		}
 
@@ -88,19 +201,39 @@ Loop:
 			logrus.Errorf("agent %s erred out with: %v - %s", in.GetAgentID(), errCode, err)
 
 		}
-		close(pipe)
 		break Loop
 	}
 
+	// The agent is taken out of the pools first so no job picks it once the
+	// jobs that are waiting to be sent to it are told it's gone
 	logrus.Infof("unregistering remote agent %s", in.GetAgentID())
-	p.deRegisterAgentCommands(in)
+	p.deRegisterAgentCommands(in, registered)
+	registered.shutdown()
+	<-stop
 
-	return nil
+	select {
+	case <-kicked:
+		return status.Error(codes.Unauthenticated, "the agent token was rotated or revoked")
+	case <-unhealthy:
+		notifyUnhealthy(fmt.Sprintf("agent %s missed %d heartbeats and was marked unhealthy, it no longer runs %s",
+			in.GetAgentID(), beats.misses(), strings.Join(registered.commandNames(), ", ")))
+		return status.Error(codes.Unavailable, fmt.Sprintf("the agent missed %d heartbeats", beats.misses()))
+	default:
+		return nil
+	}
 }
 
 // Finish implements the finish server method
 func (p *commandPipelineServer) Finish(ctx context.Context, fin *api.CommandFinish) (*api.Empty, error) {
 	logrus.Debugf("got %#v from remote agent", fin)
+	if err := p.checkCaller(ctx, fin.GetAgentID()); err != nil {
+		logrus.Warnf("rejected finish of job %d: %s", fin.GetJobID(), err)
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+	if err := p.checkDispatched(fin.GetJobID(), fin.GetAgentID()); err != nil {
+		logrus.Warnf("rejected finish of job %d: %s", fin.GetJobID(), err)
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
 	return &api.Empty{}, p.finishJob(finishedJob{
 		agentID: fin.GetAgentID(),
 		jobID:   fin.GetJobID(),
@@ -109,43 +242,206 @@ func (p *commandPipelineServer) Finish(ctx context.Context, fin *api.CommandFini
 	})
 }
 
-func (p *commandPipelineServer) registerAgent(in *api.AgentConfiguration) (chan api.CommandRequest, error) {
+// Heartbeat records that the agent is still alive, and exports the metrics
+// it reports tagged with its labels
+func (p *commandPipelineServer) Heartbeat(ctx context.Context, beat *api.AgentHeartbeat) (*api.Empty, error) {
+	if err := p.checkCaller(ctx, beat.GetAgentID()); err != nil {
+		logrus.Warnf("rejected heartbeat of agent %s: %s", beat.GetAgentID(), err)
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.beats[beat.GetAgentID()] = time.Now()
+
+	labels := formatSelector(p.identities[beat.GetAgentID()].labels)
+	metrics.AgentExecutedJobsCount.WithLabelValues(beat.GetAgentID(), labels).Set(float64(beat.GetJobsExecuted()))
+	metrics.AgentFailedJobsCount.WithLabelValues(beat.GetAgentID(), labels).Set(float64(beat.GetJobsFailed()))
+	metrics.AgentRunningJobs.WithLabelValues(beat.GetAgentID(), labels).Set(float64(beat.GetJobsRunning()))
+	metrics.AgentLoad.WithLabelValues(beat.GetAgentID(), labels).Set(beat.GetLoad())
+	return &api.Empty{}, nil
+}
+
+// missedHeartbeats returns true when the agent sent heartbeats and then
+// missed the ones it should have sent, its last heartbeat is forgotten so it
+// starts over when it registers again
+func (p *commandPipelineServer) missedHeartbeats(agentID string, beats Heartbeats) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	last, ok := p.beats[agentID]
+	if !ok || time.Since(last) <= time.Duration(beats.misses())*beats.interval() {
+		return false
+	}
+	delete(p.beats, agentID)
+	return true
+}
+
+// bindIdentity binds the identity of the cert and the token to the agent, an
+// agent can't be registered again with a different one while it's connected
+func (p *commandPipelineServer) bindIdentity(agentID, identity, tokenName string, labels map[string]string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	bound, ok := p.identities[agentID]
+	if ok && (bound.identity != identity || bound.tokenName != tokenName) {
+		return fmt.Errorf("agent %s is already registered with another identity", agentID)
+	}
+	if identity != "" {
+		logrus.Infof("agent %s presented identity %s", agentID, identity)
+	}
+	p.identities[agentID] = agentIdentity{
+		identity:      identity,
+		tokenName:     tokenName,
+		labels:        labels,
+		registrations: bound.registrations + 1,
+	}
+	return nil
+}
+
+// unbindIdentity drops the identity of the agent and its metrics when its last
+// registration is gone
+func (p *commandPipelineServer) unbindIdentity(agentID string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	bound := p.identities[agentID]
+	if bound.registrations <= 1 {
+		delete(p.identities, agentID)
+		delete(p.beats, agentID)
+
+		labels := formatSelector(bound.labels)
+		metrics.AgentExecutedJobsCount.DeleteLabelValues(agentID, labels)
+		metrics.AgentFailedJobsCount.DeleteLabelValues(agentID, labels)
+		metrics.AgentRunningJobs.DeleteLabelValues(agentID, labels)
+		metrics.AgentLoad.DeleteLabelValues(agentID, labels)
+		registry.Remove(agentID)
+		return
+	}
+	bound.registrations--
+	p.identities[agentID] = bound
+}
+
+// checkCaller checks that the call comes from the identity the agent
+// registered with, and with its token. The token is verified on every call
+// so one that was rotated or revoked in another server stops working too
+func (p *commandPipelineServer) checkCaller(ctx context.Context, agentID string) error {
+	identity := peerIdentity(ctx)
+
+	p.lock.Lock()
+	bound, ok := p.identities[agentID]
+	p.lock.Unlock()
+
+	if !ok {
+		return fmt.Errorf("agent %s is not registered", agentID)
+	}
+	if bound.identity != identity {
+		return fmt.Errorf("identity %s does not match the one agent %s registered with", identity, agentID)
+	}
+	if bound.tokenName == "" {
+		return nil
+	}
+	tokenName, err := agenttokens.Verify(fromMetadata(ctx, api.TokenMetadataKey))
+	if err != nil {
+		return fmt.Errorf("agent %s did not call with a valid token: %s", agentID, err)
+	}
+	if tokenName != bound.tokenName {
+		return fmt.Errorf("agent %s called with the token of %s, not the one it registered with", agentID, tokenName)
+	}
+	return nil
+}
+
+// stillValid returns false when the token the agent registered with was
+// rotated or revoked, failing to check it doesn't kick the agent out
+func stillValid(in *api.AgentConfiguration) bool {
+	_, err := agenttokens.Verify(in.GetToken())
+	if err != nil && err != agenttokens.ErrInvalidToken {
+		logrus.Errorf("could not verify the token of agent %s: %s", in.GetAgentID(), err)
+		return true
+	}
+	return err == nil
+}
+
+// fromMetadata returns the first value of the key in the metadata of the
+// call, empty when it has none
+func fromMetadata(ctx context.Context, key string) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok || len(md.Get(key)) == 0 {
+		return ""
+	}
+	return md.Get(key)[0]
+}
+
+// peerIdentity returns the common name of the verified cert of the peer, or
+// its first DNS name, and empty when the peer presented no cert
+func peerIdentity(ctx context.Context) string {
+	pr, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	info, ok := pr.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	cert := info.State.VerifiedChains[0][0]
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	return ""
+}
+
+// registerAgent adds the agent to the ones of each of its commands, the
+// commands that no other agent has are registered. A command that is
+// registered with other options is handled with its conflicts policy, the
+// agent is rejected with an already exists status when it says so
+func (p *commandPipelineServer) registerAgent(in *api.AgentConfiguration, identity, tokenName string) (*remoteAgent, error) {
 	logrus.Infof("registering agent %s", in.GetAgentID())
 
-	agentPipe := make(chan api.CommandRequest)
+	p.lock.Lock()
+	defer p.lock.Unlock()
 
-	agent := remoteAgent{
+	resolved, err := p.resolveConflicts(in)
+	if err != nil {
+		return nil, status.Error(codes.AlreadyExists, err.Error())
+	}
+	agent := &remoteAgent{
 		agentID:   in.GetAgentID(),
-		agentPipe: agentPipe,
+		labels:    registry.ImplicitLabels(in.GetLabels(), agentInfo(in, "")),
+		identity:  identity,
+		tokenName: tokenName,
+		config:    in,
+		commands:  resolved,
+		agentPipe: make(chan api.CommandRequest),
+		done:      make(chan struct{}),
 
 		jobStarter: p,
 	}
+	if err := p.addCommands(agent, resolved); err != nil {
+		return nil, err
+	}
+	p.agents[agent.agentID] = agent
+
+	logrus.Infof("Done registering commands, returning pipeline")
+
+	return agent, nil
+}
 
+// addCommands adds the agent to the ones of each of the commands, the
+// commands that no other agent has are registered
+func (p *commandPipelineServer) addCommands(agent *remoteAgent, added map[string]agentCommand) error {
 	cmds := make([]commands.CommandRegistration, 0)
-	for name, cmd := range in.Commands {
-		cmds = append(cmds, commands.CommandRegistration{
-			Name: name,
-			Cmd: remoteCommand{
-				agent: agent,
-				CommandOpts: meeseeks.CommandOpts{
-					Cmd:             name,
-					AllowedChannels: cmd.GetAllowedChannels(),
-					AllowedGroups:   cmd.GetAllowedGroups(),
-					AuthStrategy:    cmd.GetAuthStrategy(),
-					ChannelStrategy: cmd.GetChannelStrategy(),
-					Handshake:       cmd.GetHasHandshake(),
-					Timeout:         time.Duration(cmd.GetTimeout()) * time.Second,
-					Help: meeseeks.NewHelp(
-						cmd.GetHelp().GetSummary(),
-						cmd.GetHelp().GetArgs()...),
-				},
-			},
-		})
+	for name, cmd := range added {
+		if p.pools.has(name) {
+			logrus.Infof("remote agent %s joins the agents of command %s", agent.agentID, name)
+			continue
+		}
+		cmds = append(cmds, p.commandRegistration(name, cmd))
 	}
 
-	p.lock.Lock()
-	defer p.lock.Unlock()
-
 	logrus.Infof("remote agent is registering commands %#v", cmds)
 	if err := commands.Register(
 		commands.RegistrationArgs{
@@ -153,57 +449,191 @@ func (p *commandPipelineServer) registerAgent(in *api.AgentConfiguration) (chan
 			Action:   commands.ActionRegister,
 			Commands: cmds,
 		}); err != nil {
-		return nil, fmt.Errorf("failed to register remote commands: %s", err)
+		return fmt.Errorf("failed to register remote commands: %s", err)
 	}
+	for name, cmd := range added {
+		p.pools.add(name, agent, cmd.cmd)
+	}
+	return nil
+}
 
-	logrus.Infof("Done registering commands, returning pipeline")
+// removeCommands takes the agent out of the ones of each of the commands, the
+// commands that are left without agents are unregistered
+func (p *commandPipelineServer) removeCommands(agent *remoteAgent, removed map[string]agentCommand) error {
+	cmds := make([]commands.CommandRegistration, 0)
+	for name, cmd := range removed {
+		if !p.pools.remove(name, agent) {
+			continue
+		}
+		cmds = append(cmds, p.commandRegistration(name, cmd))
+	}
 
-	return agentPipe, nil
+	return commands.Register(commands.RegistrationArgs{
+		Action:   commands.ActionUnregister,
+		Kind:     commands.KindRemoteCommand,
+		Commands: cmds,
+	})
 }
 
-func (p *commandPipelineServer) deRegisterAgentCommands(in *api.AgentConfiguration) {
-	cmds := make([]commands.CommandRegistration, 0)
-	for name, cmd := range in.Commands {
-		cmds = append(cmds, commands.CommandRegistration{
-			Name: name,
-			Cmd: remoteCommand{
-				CommandOpts: meeseeks.CommandOpts{
-					Cmd:             name,
-					AllowedChannels: cmd.GetAllowedChannels(),
-					AllowedGroups:   cmd.GetAllowedGroups(),
-					AuthStrategy:    cmd.GetAuthStrategy(),
-					ChannelStrategy: cmd.GetChannelStrategy(),
-					Handshake:       cmd.GetHasHandshake(),
-					Timeout:         time.Duration(cmd.GetTimeout()) * time.Second,
-					Help: meeseeks.NewHelp(
-						cmd.GetHelp().GetSummary(),
-						cmd.GetHelp().GetArgs()...),
-				},
-			},
-		})
+// UpdateCommands replaces the commands of a registered agent with the ones it
+// has now, like when its configuration is reloaded, without it registering
+// again. The commands it no longer has, or has with other options, are
+// removed first, and the ones it adds go through its policies and conflicts
+// like they do when it registers
+func (p *commandPipelineServer) UpdateCommands(ctx context.Context, in *api.AgentCommands) (*api.Empty, error) {
+	if err := p.checkCaller(ctx, in.GetAgentID()); err != nil {
+		logrus.Warnf("rejected the commands of agent %s: %s", in.GetAgentID(), err)
+		return nil, status.Error(codes.PermissionDenied, err.Error())
 	}
 
 	p.lock.Lock()
 	defer p.lock.Unlock()
 
-	if err := commands.Register(commands.RegistrationArgs{
-		Action:   commands.ActionUnregister,
-		Kind:     commands.KindRemoteCommand,
-		Commands: cmds,
-	}); err != nil {
-		logrus.Errorf("failed to unregister agent %s: %s", in.AgentID, err)
+	agent, ok := p.agents[in.GetAgentID()]
+	if !ok {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("agent %s is not registered", in.GetAgentID()))
+	}
+	updated := &api.AgentConfiguration{
+		AgentID:  agent.config.GetAgentID(),
+		Labels:   agent.config.GetLabels(),
+		Version:  agent.config.GetVersion(),
+		Commands: in.GetCommands(),
+	}
+	if err := checkPolicies(agent.tokenName, updated); err != nil {
+		logrus.Warnf("rejected the commands of agent %s: %s", in.GetAgentID(), err)
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	kept := make(map[string]agentCommand, len(agent.commands))
+	removed := make(map[string]agentCommand)
+	for name, command := range agent.commands {
+		cmd, ok := in.GetCommands()[command.name]
+		if ok && len(optionDifferences(command.cmd, cmd)) == 0 {
+			kept[command.name] = command
+			continue
+		}
+		removed[name] = command
+	}
+	added := &api.AgentConfiguration{
+		AgentID:  updated.GetAgentID(),
+		Version:  updated.GetVersion(),
+		Commands: make(map[string]*api.RemoteCommand),
+	}
+	for name, cmd := range in.GetCommands() {
+		if _, ok := kept[name]; !ok {
+			added.Commands[name] = cmd
+		}
+	}
+
+	if err := p.removeCommands(agent, removed); err != nil {
+		return nil, fmt.Errorf("failed to unregister the commands of agent %s: %s", in.GetAgentID(), err)
+	}
+	resolved, err := p.resolveConflicts(added)
+	if err != nil {
+		logrus.Warnf("rejected the commands of agent %s: %s", in.GetAgentID(), err)
+		if err := p.addCommands(agent, removed); err != nil {
+			reports.Errorf(reports.ComponentServer, reports.Tags{"agent": in.GetAgentID()},
+				"failed to register the commands of agent %s again: %s", in.GetAgentID(), err)
+		}
+		return nil, status.Error(codes.AlreadyExists, err.Error())
+	}
+	if err := p.addCommands(agent, resolved); err != nil {
+		return nil, err
+	}
+
+	current := make(map[string]agentCommand, len(kept)+len(resolved))
+	for name, command := range agent.commands {
+		if _, ok := removed[name]; !ok {
+			current[name] = command
+		}
+	}
+	for name, command := range resolved {
+		current[name] = command
+	}
+	agent.commands = current
+	registry.SetCommands(agent.agentID, agent.commandNames())
+
+	logrus.Infof("agent %s updated its commands to %s", agent.agentID, strings.Join(agent.commandNames(), ", "))
+	return &api.Empty{}, nil
+}
+
+// deRegisterAgentCommands removes the agent from the ones of each of its
+// commands, the commands that are left without agents are unregistered
+func (p *commandPipelineServer) deRegisterAgentCommands(in *api.AgentConfiguration, agent *remoteAgent) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.agents[agent.agentID] == agent {
+		delete(p.agents, agent.agentID)
+	}
+	if err := p.removeCommands(agent, agent.commands); err != nil {
+		reports.Errorf(reports.ComponentServer, reports.Tags{"agent": in.AgentID},
+			"failed to unregister agent %s: %s", in.AgentID, err)
+	}
+}
+
+// agentInfo returns what the agent registered with, and the identity of its
+// cert
+func agentInfo(in *api.AgentConfiguration, identity string) registry.Agent {
+	return registry.Agent{
+		ID:           in.GetAgentID(),
+		Identity:     identity,
+		Labels:       in.GetLabels(),
+		OS:           in.GetOs(),
+		Arch:         in.GetArch(),
+		Hostname:     in.GetHostname(),
+		Version:      in.GetVersion(),
+		Commands:     commandNames(in),
+		RegisteredAt: time.Now(),
+	}
+}
+
+// commandNames returns the sorted names of the commands of the agent
+func commandNames(in *api.AgentConfiguration) []string {
+	names := make([]string, 0, len(in.GetCommands()))
+	for name := range in.GetCommands() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (p *commandPipelineServer) commandRegistration(name string, command agentCommand) commands.CommandRegistration {
+	cmd := command.cmd
+	return commands.CommandRegistration{
+		Name: name,
+		Cmd: remoteCommand{
+			router:       p.pools,
+			agentCommand: command.name,
+			CommandOpts: meeseeks.CommandOpts{
+				Cmd:             name,
+				AllowedChannels: cmd.GetAllowedChannels(),
+				AllowedGroups:   cmd.GetAllowedGroups(),
+				AuthStrategy:    cmd.GetAuthStrategy(),
+				ChannelStrategy: cmd.GetChannelStrategy(),
+				Handshake:       cmd.GetHasHandshake(),
+				Timeout:         time.Duration(cmd.GetTimeout()) * time.Second,
+				Help: meeseeks.NewHelp(
+					cmd.GetHelp().GetSummary(),
+					cmd.GetHelp().GetArgs()...),
+			},
+		},
 	}
 }
 
 func (p *commandPipelineServer) finishJob(f finishedJob) error {
-	c, err := p.PopJob(f.jobID)
+	c, err := p.PopJob(f.jobID, f.agentID)
 	if err != nil {
-		return fmt.Errorf("could not fetch command finish channel: %s", err)
+		if dispatchedErr := dispatchedBefore(f.jobID, f.agentID); dispatchedErr != nil {
+			return fmt.Errorf("could not fetch command finish channel: %s", err)
+		}
+		return finishUnwatched(f)
 	}
 
 	if f.getError() != nil {
 		if err := persistence.LogWriter().SetError(f.jobID, f.getError()); err != nil {
-			logrus.Errorf("Failed to set error for job %d: %s", f.jobID, err)
+			reports.Errorf(reports.ComponentServer, reports.Tags{"job_id": fmt.Sprintf("%d", f.jobID), "agent": f.agentID},
+				"Failed to set error for job %d: %s", f.jobID, err)
 		}
 	}
 
@@ -214,57 +644,210 @@ func (p *commandPipelineServer) finishJob(f finishedJob) error {
 	return nil
 }
 
-func (p *commandPipelineServer) StartJob(req api.CommandRequest) chan finishedJob {
+func (p *commandPipelineServer) StartJob(agentID string, req api.CommandRequest) chan finishedJob {
 	p.lock.Lock()
 	defer p.lock.Unlock()
 
-	c := make(chan finishedJob)
-	p.runningJobs[req.GetJobID()] = c
+	// A finish that the agent replays once the job gave up waiting must not
+	// block
+	c := make(chan finishedJob, 1)
+	p.runningJobs[req.GetJobID()] = runningJob{agentID: agentID, finished: c}
 	return c
 }
 
-func (p *commandPipelineServer) PopJob(jobID uint64) (chan finishedJob, error) {
+// StopJob forgets the job when it's still running in the agent, its finish is
+// no longer waited for
+func (p *commandPipelineServer) StopJob(jobID uint64, agentID string) {
 	p.lock.Lock()
 	defer p.lock.Unlock()
 
-	c, ok := p.runningJobs[jobID]
+	if job, ok := p.runningJobs[jobID]; ok && job.agentID == agentID {
+		delete(p.runningJobs, jobID)
+	}
+}
+
+// checkDispatched checks that the job is running in the agent, so an agent
+// can't write to or finish the jobs of another one
+func (p *commandPipelineServer) checkDispatched(jobID uint64, agentID string) error {
+	p.lock.Lock()
+	job, ok := p.runningJobs[jobID]
+	p.lock.Unlock()
+
+	if !ok {
+		return dispatchedBefore(jobID, agentID)
+	}
+	if job.agentID != agentID {
+		return fmt.Errorf("job %d was not dispatched to agent %s", jobID, agentID)
+	}
+	return nil
+}
+
+// dispatchedBefore checks that the job is still running and that the audit
+// log says it was dispatched to the agent, for the jobs no one in this server
+// is waiting for, like when it restarted while the agent couldn't reach it
+func dispatchedBefore(jobID uint64, agentID string) error {
+	job, err := persistence.Jobs().Get(jobID)
+	if err != nil || job.Status != meeseeks.JobRunningStatus {
+		return fmt.Errorf("job %d is not running", jobID)
+	}
+	entries, err := persistence.Audit().Find(meeseeks.AuditFilter{
+		Limit: 1,
+		Since: job.StartTime,
+		Match: func(entry meeseeks.AuditEntry) bool {
+			return entry.JobID == jobID && entry.Decision == meeseeks.AuditDispatched
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("could not find the agent job %d was dispatched to: %s", jobID, err)
+	}
+	if len(entries) == 0 || entries[0].Agent == nil || entries[0].Agent.ID != agentID {
+		return fmt.Errorf("job %d was not dispatched to agent %s", jobID, agentID)
+	}
+	return nil
+}
+
+// finishUnwatched finishes a job that is running but no one is waiting for,
+// its log already has the lines the agent sent so only its status is left
+func finishUnwatched(f finishedJob) error {
+	status := meeseeks.JobSucceededStatus
+	if f.getError() != nil {
+		status = meeseeks.JobFailedStatus
+		if err := persistence.LogWriter().SetError(f.jobID, f.getError()); err != nil {
+			reports.Errorf(reports.ComponentServer, reports.Tags{"job_id": fmt.Sprintf("%d", f.jobID), "agent": f.agentID},
+				"Failed to set error for job %d: %s", f.jobID, err)
+		}
+	}
+	if err := persistence.Jobs().Finish(f.jobID, status); err != nil {
+		return fmt.Errorf("could not finish job %d: %s", f.jobID, err)
+	}
+	logrus.Infof("job %d was finished by agent %s with no one waiting for it", f.jobID, f.agentID)
+	return nil
+}
+
+// PopJob takes the job the agent finished out of the running ones, and
+// returns the channel its finish is sent to
+func (p *commandPipelineServer) PopJob(jobID uint64, agentID string) (chan finishedJob, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	job, ok := p.runningJobs[jobID]
 	if !ok {
 		return nil, fmt.Errorf("could not find job with ID %d in the running jobs list", jobID)
 	}
+	if job.agentID != agentID {
+		return nil, fmt.Errorf("job %d was not dispatched to agent %s", jobID, agentID)
+	}
 
 	delete(p.runningJobs, jobID)
 
-	return c, nil
+	return job.finished, nil
 }
 
 type remoteAgent struct {
-	agentID string
+	agentID   string
+	labels    map[string]string
+	identity  string
+	tokenName string
+	config    *api.AgentConfiguration
+	commands  map[string]agentCommand
 
 	agentPipe chan api.CommandRequest
+	done      chan struct{}
+	closing   sync.Once
 
 	jobStarter
 }
 
-func (r *remoteAgent) start(req api.CommandRequest) chan finishedJob {
-	c := r.StartJob(req)
-	r.agentPipe <- req
+// commandNames returns the sorted names the commands of the agent are
+// registered with
+func (r *remoteAgent) commandNames() []string {
+	names := make([]string, 0, len(r.commands))
+	for name := range r.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
 
-	return c
+// auditAgent returns who the agent is in the audit log
+func (r *remoteAgent) auditAgent() *meeseeks.AuditAgent {
+	return &meeseeks.AuditAgent{
+		ID:       r.agentID,
+		Identity: r.identity,
+		Token:    r.tokenName,
+		Labels:   r.labels,
+	}
+}
+
+// start sends the request to the agent, it fails when the agent is gone
+// before it takes it
+func (r *remoteAgent) start(req api.CommandRequest) (chan finishedJob, error) {
+	c := r.StartJob(r.agentID, req)
+	select {
+	case r.agentPipe <- req:
+		return c, nil
+	case <-r.done:
+		r.StopJob(req.GetJobID(), r.agentID)
+		return nil, fmt.Errorf("remote agent %s is gone", r.agentID)
+	}
+}
+
+// cancel tells the agent to stop running the job, its finish is no longer
+// waited for
+func (r *remoteAgent) cancel(jobID uint64) {
+	r.StopJob(jobID, r.agentID)
+	select {
+	case r.agentPipe <- api.CommandRequest{JobID: jobID, Cancel: true}:
+		logrus.Infof("job %d was cancelled in remote agent %s", jobID, r.agentID)
+	case <-r.done:
+	}
+}
+
+// shutdown tells the jobs that are sending requests to the agent that it's
+// gone, it's safe to call more than once
+func (r *remoteAgent) shutdown() {
+	r.closing.Do(func() {
+		close(r.done)
+	})
+}
+
+type agentRouter interface {
+	pick(command string, selector map[string]string) (*remoteAgent, error)
+	done(agent *remoteAgent)
 }
 
+// remoteCommand is a command that runs on the agents that registered it, the
+// agentCommand is the name they know it by, which is not the one it's
+// registered with when it's versioned
 type remoteCommand struct {
 	meeseeks.CommandOpts
 
-	agent remoteAgent
+	router       agentRouter
+	agentCommand string
 }
 
 func (r remoteCommand) Execute(ctx context.Context, job meeseeks.Job) (string, error) {
 	logrus.Debugf("start execution of job %#v", job)
 
 	req := job.Request
-	c := r.agent.start(api.CommandRequest{
-		Command: req.Command,
-		Args:    req.Args,
+	selector, args, err := selectorFromArgs(req.Args)
+	if err != nil {
+		return "", err
+	}
+	if selector == nil {
+		selector = routeOf(r.GetCmd())
+	}
+	agent, err := r.router.pick(r.GetCmd(), selector)
+	if err != nil {
+		return "", err
+	}
+	defer r.router.done(agent)
+	logrus.Debugf("job %d of command %s goes to agent %s", job.ID, r.GetCmd(), agent.agentID)
+	recordDispatch(job, agent)
+
+	c, err := agent.start(api.CommandRequest{
+		Command: r.agentCommand,
+		Args:    args,
 
 		IsIM:        req.IsIM,
 		Channel:     req.Channel,
@@ -276,22 +859,42 @@ func (r remoteCommand) Execute(ctx context.Context, job meeseeks.Job) (string, e
 
 		JobID: job.ID,
 	})
+	if err != nil {
+		return "", err
+	}
 
 	logrus.Debugf("waiting for remote request to finish %#v", req)
 
 	select {
 	case <-ctx.Done():
 		logrus.Debugf("job %#v failed with error %s", job, ctx.Err())
+		agent.cancel(job.ID)
 		return "", fmt.Errorf("command failed because of context done: %s", ctx.Err())
 
 	case f := <-c:
 		logrus.Debugf("successful execution of job %#v with result %#v", job, f)
-		// TODO: check that the agent that finished the command is the same that started it
 		return f.getContent(), f.getError()
 
 	}
 }
 
+// recordDispatch appends the job and the agent it was dispatched to to the
+// audit log, so what ran remotely can be traced to the machine that ran it. A
+// failure to do so is logged but doesn't stop the job
+func recordDispatch(job meeseeks.Job, agent *remoteAgent) {
+	if _, err := persistence.Audit().Record(meeseeks.AuditEntry{
+		JobID:    job.ID,
+		Decision: meeseeks.AuditDispatched,
+		Agent:    agent.auditAgent(),
+		Request:  job.Request,
+	}); err != nil {
+		tags := reports.JobTags(job)
+		tags["agent"] = agent.agentID
+		reports.Errorf(reports.ComponentServer, tags,
+			"Failed to record the dispatch of job %d to agent %s: %s", job.ID, agent.agentID, err)
+	}
+}
+
 type finishedJob struct {
 	agentID string
 	jobID   uint64
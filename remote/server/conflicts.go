@@ -0,0 +1,187 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/remote/api"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The policies for an agent that registers a command that is registered with
+// other options, like another auth strategy or timeout
+const (
+	// ConflictJoin joins the agents of the command, which keeps the options
+	// it was registered with, unless they differ in who can run it
+	ConflictJoin = "join"
+	// ConflictReject rejects the registration of the agent, the default
+	ConflictReject = "reject"
+	// ConflictVersion registers the command of the agent with the version of
+	// the agent, like deploy@1.2.0, or its ID when it has no version
+	ConflictVersion = "version"
+)
+
+// Conflicts sets what to do when an agent registers a command that is
+// registered with other options, Policy is the one of every command but the
+// ones set in Commands
+type Conflicts struct {
+	Policy   string            `yaml:"policy"`
+	Commands map[string]string `yaml:"commands"`
+}
+
+// Validate checks that the policies are known
+func (c Conflicts) Validate() error {
+	if err := validateConflictPolicy(c.Policy); err != nil {
+		return err
+	}
+	for _, policy := range c.Commands {
+		if err := validateConflictPolicy(policy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateConflictPolicy(policy string) error {
+	switch policy {
+	case "", ConflictJoin, ConflictReject, ConflictVersion:
+		return nil
+	}
+	return fmt.Errorf("invalid agent conflicts policy %s, valid ones are %s, %s and %s",
+		policy, ConflictJoin, ConflictReject, ConflictVersion)
+}
+
+var conflicts Conflicts
+var conflictsLock sync.Mutex
+
+// ConfigureConflicts sets what to do with the commands that are registered
+// with other options
+func ConfigureConflicts(configured Conflicts) {
+	conflictsLock.Lock()
+	defer conflictsLock.Unlock()
+
+	conflicts = configured
+}
+
+func conflictPolicyOf(command string) string {
+	conflictsLock.Lock()
+	defer conflictsLock.Unlock()
+
+	if policy, ok := conflicts.Commands[command]; ok && policy != "" {
+		return policy
+	}
+	if conflicts.Policy != "" {
+		return conflicts.Policy
+	}
+	return ConflictReject
+}
+
+// accessOptions are the options that decide who can run a command and where,
+// an agent can't join a command that is registered with other ones
+var accessOptions = map[string]bool{
+	"auth strategy":    true,
+	"allowed groups":   true,
+	"channel strategy": true,
+	"allowed channels": true,
+}
+
+// agentCommand is a command of an agent, with the name the agent knows it by
+type agentCommand struct {
+	name string
+	cmd  *api.RemoteCommand
+}
+
+// resolveConflicts returns the commands of the agent by the name they are
+// registered with, the one of the agent unless it conflicts with the options
+// of a command that is registered and the policy versions it
+func (p *commandPipelineServer) resolveConflicts(in *api.AgentConfiguration) (map[string]agentCommand, error) {
+	resolved := make(map[string]agentCommand, len(in.GetCommands()))
+	for _, name := range commandNames(in) {
+		cmd := in.GetCommands()[name]
+		registered, ok := p.pools.options(name)
+		if !ok {
+			resolved[name] = agentCommand{name: name, cmd: cmd}
+			continue
+		}
+		differences := optionDifferences(registered, cmd)
+		if len(differences) == 0 {
+			resolved[name] = agentCommand{name: name, cmd: cmd}
+			continue
+		}
+
+		conflict := fmt.Errorf("command %s is already registered with a different %s", name, strings.Join(differences, ", "))
+		switch conflictPolicyOf(name) {
+		case ConflictJoin:
+			for _, difference := range differences {
+				if accessOptions[difference] {
+					return nil, conflict
+				}
+			}
+			logrus.Warnf("agent %s: %s, it joins the agents of the command with the options it was registered with",
+				in.GetAgentID(), conflict)
+			resolved[name] = agentCommand{name: name, cmd: cmd}
+
+		case ConflictVersion:
+			version := in.GetVersion()
+			if version == "" {
+				version = in.GetAgentID()
+			}
+			versioned := name + "@" + version
+			if registered, ok := p.pools.options(versioned); ok {
+				if differences := optionDifferences(registered, cmd); len(differences) > 0 {
+					return nil, fmt.Errorf("command %s is already registered with a different %s", versioned,
+						strings.Join(differences, ", "))
+				}
+			}
+			resolved[versioned] = agentCommand{name: name, cmd: cmd}
+
+		default:
+			return nil, conflict
+		}
+	}
+	return resolved, nil
+}
+
+// optionDifferences returns the options the commands don't agree on, the help
+// is not an option
+func optionDifferences(a, b *api.RemoteCommand) []string {
+	differences := make([]string, 0)
+	if a.GetAuthStrategy() != b.GetAuthStrategy() {
+		differences = append(differences, "auth strategy")
+	}
+	if !sameSet(a.GetAllowedGroups(), b.GetAllowedGroups()) {
+		differences = append(differences, "allowed groups")
+	}
+	if a.GetChannelStrategy() != b.GetChannelStrategy() {
+		differences = append(differences, "channel strategy")
+	}
+	if !sameSet(a.GetAllowedChannels(), b.GetAllowedChannels()) {
+		differences = append(differences, "allowed channels")
+	}
+	if a.GetTimeout() != b.GetTimeout() {
+		differences = append(differences, "timeout")
+	}
+	if a.GetHasHandshake() != b.GetHasHandshake() {
+		differences = append(differences, "handshake")
+	}
+	return differences
+}
+
+func sameSet(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string{}, a...)
+	b = append([]string{}, b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultHeartbeatInterval is how often the agents are expected to send a
+// heartbeat when no interval is configured
+const DefaultHeartbeatInterval = 10 * time.Second
+
+// DefaultHeartbeatMisses is how many heartbeats an agent can miss before it's
+// unregistered when no number is configured
+const DefaultHeartbeatMisses = 3
+
+// Heartbeats sets when an agent is considered gone
+//
+// An agent that sent a heartbeat and then misses Misses of them, one every
+// Interval seconds, is marked unhealthy and its commands are unregistered.
+// ChannelID is the channel that is notified when it happens. Agents that never
+// sent a heartbeat, like older ones, are not watched
+type Heartbeats struct {
+	Interval  time.Duration `yaml:"interval"`
+	Misses    int           `yaml:"misses"`
+	ChannelID string        `yaml:"channel_id"`
+}
+
+// Validate checks that the configuration is usable
+func (h Heartbeats) Validate() error {
+	if h.Interval < 0 {
+		return fmt.Errorf("agent heartbeats interval can't be negative")
+	}
+	if h.Misses < 0 {
+		return fmt.Errorf("agent heartbeats misses can't be negative")
+	}
+	return nil
+}
+
+func (h Heartbeats) interval() time.Duration {
+	if h.Interval <= 0 {
+		return DefaultHeartbeatInterval
+	}
+	return h.Interval * time.Second
+}
+
+func (h Heartbeats) misses() int {
+	if h.Misses <= 0 {
+		return DefaultHeartbeatMisses
+	}
+	return h.Misses
+}
+
+// Notifier sends a text to a chat channel
+type Notifier func(channelID, text string)
+
+var heartbeats Heartbeats
+var notifier Notifier
+var heartbeatsLock sync.Mutex
+
+// ConfigureHeartbeats sets when an agent is considered gone, the agents that
+// are already connected keep checking at the interval they started with
+func ConfigureHeartbeats(configured Heartbeats) {
+	heartbeatsLock.Lock()
+	defer heartbeatsLock.Unlock()
+
+	heartbeats = configured
+}
+
+// SetNotifier sets how the channel of the heartbeats is notified of the
+// agents that are gone
+func SetNotifier(n Notifier) {
+	heartbeatsLock.Lock()
+	defer heartbeatsLock.Unlock()
+
+	notifier = n
+}
+
+func heartbeatsConfig() Heartbeats {
+	heartbeatsLock.Lock()
+	defer heartbeatsLock.Unlock()
+
+	return heartbeats
+}
+
+// notifyUnhealthy sends the text to the channel of the heartbeats, if there
+// is one and a notifier to send it with
+func notifyUnhealthy(text string) {
+	heartbeatsLock.Lock()
+	channelID, notify := heartbeats.ChannelID, notifier
+	heartbeatsLock.Unlock()
+
+	if channelID == "" || notify == nil {
+		return
+	}
+	notify(channelID, text)
+}
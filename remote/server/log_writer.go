@@ -3,8 +3,10 @@ package server
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
 
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks/reports"
 	"gitlab.com/yakshaving.art/meeseeks-box/persistence"
 	"gitlab.com/yakshaving.art/meeseeks-box/remote/api"
 	"github.com/sirupsen/logrus"
@@ -13,9 +15,18 @@ import (
 	"google.golang.org/grpc/status"
 )
 
-type logWriterServer struct{}
+// logWriterServer writes the logs of the jobs that run in the agents of the
+// pipeline, the agent that calls is sent in the metadata of the call
+type logWriterServer struct {
+	pipeline *commandPipelineServer
+}
 
-func (logWriterServer) Append(writer api.LogWriter_AppendServer) error {
+func (l logWriterServer) Append(writer api.LogWriter_AppendServer) error {
+	agentID := fromMetadata(writer.Context(), api.AgentIDMetadataKey)
+	if err := l.pipeline.checkCaller(writer.Context(), agentID); err != nil {
+		logrus.Warnf("rejected log of agent %s: %s", agentID, err)
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
 Loop:
 	for {
 		entry, err := writer.Recv()
@@ -39,9 +50,15 @@ Loop:
 
 		}
 
+		if err := l.pipeline.checkDispatched(entry.GetJobID(), agentID); err != nil {
+			logrus.Warnf("rejected log of job %d from agent %s: %s", entry.GetJobID(), agentID, err)
+			return status.Error(codes.PermissionDenied, err.Error())
+		}
+
 		err = persistence.LogWriter().Append(entry.GetJobID(), entry.GetLine())
 		if err != nil {
-			logrus.Errorf("got error receiving log entry: %s", err)
+			reports.Errorf(reports.ComponentServer, reports.Tags{"job_id": fmt.Sprintf("%d", entry.GetJobID())},
+				"got error receiving log entry: %s", err)
 		} else {
 			logrus.Debugf("appended new log line to job %d", entry.GetJobID())
 		}
@@ -52,7 +69,16 @@ Loop:
 }
 
 // SetError implements LogWriterServer SetError
-func (logWriterServer) SetError(ctx context.Context, entry *api.ErrorLogEntry) (*api.Empty, error) {
+func (l logWriterServer) SetError(ctx context.Context, entry *api.ErrorLogEntry) (*api.Empty, error) {
+	agentID := fromMetadata(ctx, api.AgentIDMetadataKey)
+	if err := l.pipeline.checkCaller(ctx, agentID); err != nil {
+		logrus.Warnf("rejected error of job %d from agent %s: %s", entry.GetJobID(), agentID, err)
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+	if err := l.pipeline.checkDispatched(entry.GetJobID(), agentID); err != nil {
+		logrus.Warnf("rejected error of job %d from agent %s: %s", entry.GetJobID(), agentID, err)
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
 	// Do I even need this?
 	return &api.Empty{}, persistence.LogWriter().SetError(entry.GetJobID(), errors.New(entry.GetError()))
 }
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"fmt"
+	"path"
+	"sync"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/auth"
+	"gitlab.com/yakshaving.art/meeseeks-box/remote/api"
+)
+
+// AgentPolicy restricts the commands that the agents it matches can register
+//
+// An agent matches when it registered with the token of Token, if set, and
+// has all the Labels. Commands are the patterns of the command names it can
+// register, and AuthStrategies the auth strategies those commands can have,
+// any of them when empty
+type AgentPolicy struct {
+	Token          string            `yaml:"token"`
+	Labels         map[string]string `yaml:"labels"`
+	Commands       []string          `yaml:"commands"`
+	AuthStrategies []string          `yaml:"auth_strategies"`
+}
+
+// Validate checks that the policy is usable
+func (p AgentPolicy) Validate() error {
+	if len(p.Commands) == 0 {
+		return fmt.Errorf("agent policy requires at least one command pattern")
+	}
+	for _, pattern := range p.Commands {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid command pattern %s: %s", pattern, err)
+		}
+	}
+	for _, strategy := range p.AuthStrategies {
+		if !auth.ValidAuthStrategy(strategy) {
+			return fmt.Errorf("invalid auth strategy %s", strategy)
+		}
+	}
+	return nil
+}
+
+func (p AgentPolicy) matches(tokenName string, labels map[string]string) bool {
+	if p.Token != "" && p.Token != tokenName {
+		return false
+	}
+	for name, value := range p.Labels {
+		if labels[name] != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (p AgentPolicy) allows(name string, cmd *api.RemoteCommand) bool {
+	allowed := false
+	for _, pattern := range p.Commands {
+		if ok, _ := path.Match(pattern, name); ok {
+			allowed = true
+			break
+		}
+	}
+	if !allowed || len(p.AuthStrategies) == 0 {
+		return allowed
+	}
+	for _, strategy := range p.AuthStrategies {
+		if strategy == cmd.GetAuthStrategy() {
+			return true
+		}
+	}
+	return false
+}
+
+var policies []AgentPolicy
+var policiesLock sync.Mutex
+
+// ConfigurePolicies sets the policies the agents are checked against when
+// they register, without policies agents can register any command
+func ConfigurePolicies(configured []AgentPolicy) {
+	policiesLock.Lock()
+	defer policiesLock.Unlock()
+
+	policies = configured
+}
+
+// checkPolicies checks that every command the agent registers is allowed by
+// one of the policies that match the agent
+func checkPolicies(tokenName string, in *api.AgentConfiguration) error {
+	policiesLock.Lock()
+	configured := policies
+	policiesLock.Unlock()
+
+	if len(configured) == 0 {
+		return nil
+	}
+
+	matching := make([]AgentPolicy, 0)
+	for _, p := range configured {
+		if p.matches(tokenName, in.GetLabels()) {
+			matching = append(matching, p)
+		}
+	}
+	if len(matching) == 0 {
+		return fmt.Errorf("agent %s matches no policy", in.GetAgentID())
+	}
+
+Commands:
+	for name, cmd := range in.GetCommands() {
+		for _, p := range matching {
+			if p.allows(name, cmd) {
+				continue Commands
+			}
+		}
+		return fmt.Errorf("agent %s is not allowed to register command %s with auth strategy %s",
+			in.GetAgentID(), name, cmd.GetAuthStrategy())
+	}
+	return nil
+}
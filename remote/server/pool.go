@@ -0,0 +1,247 @@
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/remote/api"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The strategies to pick the agent that runs a job out of the ones that
+// registered its command
+const (
+	// StrategyFirst picks the agent with the lowest ID, the default
+	StrategyFirst = "first"
+	// StrategyRoundRobin picks each agent in turn
+	StrategyRoundRobin = "round-robin"
+	// StrategyLeastBusy picks the agent that runs the fewest jobs
+	StrategyLeastBusy = "least-busy"
+	// StrategyRandom picks any agent
+	StrategyRandom = "random"
+)
+
+// Dispatch sets how the jobs are spread over the agents of a command,
+// Strategy is the one of every command but the ones set in Commands
+type Dispatch struct {
+	Strategy string            `yaml:"strategy"`
+	Commands map[string]string `yaml:"commands"`
+}
+
+// Validate checks that the strategies are known
+func (d Dispatch) Validate() error {
+	if err := validateStrategy(d.Strategy); err != nil {
+		return err
+	}
+	for _, strategy := range d.Commands {
+		if err := validateStrategy(strategy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateStrategy(strategy string) error {
+	switch strategy {
+	case "", StrategyFirst, StrategyRoundRobin, StrategyLeastBusy, StrategyRandom:
+		return nil
+	}
+	return fmt.Errorf("invalid agent dispatch strategy %s, valid ones are %s, %s, %s and %s",
+		strategy, StrategyFirst, StrategyRoundRobin, StrategyLeastBusy, StrategyRandom)
+}
+
+var dispatch Dispatch
+var dispatchLock sync.Mutex
+
+// ConfigureDispatch sets the strategies to pick the agents that run the jobs
+func ConfigureDispatch(configured Dispatch) {
+	dispatchLock.Lock()
+	defer dispatchLock.Unlock()
+
+	dispatch = configured
+}
+
+func strategyOf(command string) string {
+	dispatchLock.Lock()
+	defer dispatchLock.Unlock()
+
+	if strategy, ok := dispatch.Commands[command]; ok && strategy != "" {
+		return strategy
+	}
+	if dispatch.Strategy != "" {
+		return dispatch.Strategy
+	}
+	return StrategyFirst
+}
+
+// agentPools keeps the agents that registered each command, in the order
+// they did, the options each command was registered with, how many jobs each
+// of them is running and how many jobs of each command went to its canaries
+type agentPools struct {
+	agents   map[string][]*remoteAgent
+	opts     map[string]*api.RemoteCommand
+	inFlight map[*remoteAgent]int
+	turns    map[string]int
+	canaries map[string]*canaryCount
+
+	lock sync.Mutex
+}
+
+func newAgentPools() *agentPools {
+	return &agentPools{
+		agents:   make(map[string][]*remoteAgent),
+		opts:     make(map[string]*api.RemoteCommand),
+		inFlight: make(map[*remoteAgent]int),
+		turns:    make(map[string]int),
+		canaries: make(map[string]*canaryCount),
+	}
+}
+
+// has returns true when an agent registered the command
+func (a *agentPools) has(command string) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return len(a.agents[command]) > 0
+}
+
+// options returns the options the command was registered with by its first
+// agent
+func (a *agentPools) options(command string) (*api.RemoteCommand, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	opts, ok := a.opts[command]
+	return opts, ok
+}
+
+// add adds the agent to the ones of the command, the first one sets the
+// options of the command
+func (a *agentPools) add(command string, agent *remoteAgent, opts *api.RemoteCommand) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if _, ok := a.opts[command]; !ok {
+		a.opts[command] = opts
+	}
+	a.agents[command] = append(a.agents[command], agent)
+}
+
+// remove takes the agent out of the ones of the command, and returns true
+// when the command is left without agents
+func (a *agentPools) remove(command string, agent *remoteAgent) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	left := make([]*remoteAgent, 0, len(a.agents[command]))
+	for _, other := range a.agents[command] {
+		if other != agent {
+			left = append(left, other)
+		}
+	}
+	if len(left) > 0 {
+		a.agents[command] = left
+		return false
+	}
+	delete(a.agents, command)
+	delete(a.opts, command)
+	delete(a.turns, command)
+	delete(a.canaries, command)
+	return true
+}
+
+// pick picks the agent that runs a job of the command out of the ones that
+// have the labels of the selector with the strategy of the command, and
+// counts the job as running on it until it's done. An agent that registered
+// again while it reconnected is only counted once, as the last registration.
+// When the command has a canary, its share of the jobs is picked out of the
+// canary agents and the rest out of the others
+func (a *agentPools) pick(command string, selector map[string]string) (*remoteAgent, error) {
+	strategy := strategyOf(command)
+	canary, hasCanary := canaryOf(command)
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	byID := make(map[string]*remoteAgent)
+	for _, agent := range a.agents[command] {
+		if matchesSelector(agent.labels, selector) {
+			byID[agent.agentID] = agent
+		}
+	}
+	if len(byID) == 0 {
+		return nil, fmt.Errorf("no agent with labels %s has command %s", formatSelector(selector), command)
+	}
+	candidates := make([]*remoteAgent, 0, len(byID))
+	for _, agent := range byID {
+		candidates = append(candidates, agent)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].agentID < candidates[j].agentID
+	})
+	if hasCanary {
+		candidates = a.canaryCandidates(command, canary, candidates)
+	}
+
+	picked := candidates[0]
+	switch strategy {
+	case StrategyRoundRobin:
+		picked = candidates[a.turns[command]%len(candidates)]
+		a.turns[command]++
+	case StrategyLeastBusy:
+		for _, agent := range candidates {
+			if a.inFlight[agent] < a.inFlight[picked] {
+				picked = agent
+			}
+		}
+	case StrategyRandom:
+		picked = candidates[rand.Intn(len(candidates))]
+	}
+	a.inFlight[picked]++
+	return picked, nil
+}
+
+// canaryCandidates returns the canary agents when the next job of the command
+// goes to them, and the others when it doesn't. All the candidates are
+// returned when they are all canaries or none of them is
+func (a *agentPools) canaryCandidates(command string, canary Canary, candidates []*remoteAgent) []*remoteAgent {
+	canaryAgents := make([]*remoteAgent, 0, len(candidates))
+	stableAgents := make([]*remoteAgent, 0, len(candidates))
+	for _, agent := range candidates {
+		if matchesSelector(agent.labels, canary.Labels) {
+			canaryAgents = append(canaryAgents, agent)
+		} else {
+			stableAgents = append(stableAgents, agent)
+		}
+	}
+	if len(canaryAgents) == 0 || len(stableAgents) == 0 {
+		return candidates
+	}
+
+	count, ok := a.canaries[command]
+	if !ok || count.percent != canary.Percent {
+		// The share starts over when it changes
+		count = &canaryCount{percent: canary.Percent}
+		a.canaries[command] = count
+	}
+	if count.next() {
+		logrus.Debugf("the next job of command %s goes to its canaries", command)
+		return canaryAgents
+	}
+	return stableAgents
+}
+
+// done counts the job that ran on the agent as finished
+func (a *agentPools) done(agent *remoteAgent) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.inFlight[agent] <= 1 {
+		delete(a.inFlight, agent)
+		return
+	}
+	a.inFlight[agent]--
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// OnFlag is the flag of a request that picks the agents that can run it by
+// their labels, like --on tier=web,region=eu, it's removed from the args. It
+// has to come before the args of the command, so an arg of the command is
+// never taken for it
+const OnFlag = "--on"
+
+// Routes are the labels the agents that run each command have to have
+type Routes map[string]map[string]string
+
+var routes Routes
+var routesLock sync.Mutex
+
+// ConfigureRoutes sets the labels the agents that run each command have to
+// have when the request doesn't pick them with the on flag
+func ConfigureRoutes(configured Routes) {
+	routesLock.Lock()
+	defer routesLock.Unlock()
+
+	routes = configured
+}
+
+func routeOf(command string) map[string]string {
+	routesLock.Lock()
+	defer routesLock.Unlock()
+
+	return routes[command]
+}
+
+// parseSelector parses the labels of a selector like tier=web,region=eu
+func parseSelector(selector string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, label := range strings.Split(selector, ",") {
+		parts := strings.SplitN(label, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid label selector %s, it should be like tier=web,region=eu", selector)
+		}
+		labels[parts[0]] = parts[1]
+	}
+	return labels, nil
+}
+
+// selectorFromArgs takes the selector of the on flag out of the first args,
+// it's nil when there is none
+func selectorFromArgs(args []string) (map[string]string, []string, error) {
+	switch {
+	case len(args) == 0:
+		return nil, args, nil
+
+	case args[0] == OnFlag:
+		if len(args) == 1 {
+			return nil, nil, fmt.Errorf("%s requires a label selector, like tier=web", OnFlag)
+		}
+		selector, err := parseSelector(args[1])
+		return selector, args[2:], err
+
+	case strings.HasPrefix(args[0], OnFlag+"="):
+		selector, err := parseSelector(strings.TrimPrefix(args[0], OnFlag+"="))
+		return selector, args[1:], err
+	}
+	return nil, args, nil
+}
+
+// matchesSelector returns true when the labels have all the ones of the
+// selector
+func matchesSelector(labels, selector map[string]string) bool {
+	for name, value := range selector {
+		if v, ok := labels[name]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// formatSelector writes the selector sorted by label
+func formatSelector(selector map[string]string) string {
+	labels := make([]string, 0, len(selector))
+	for name, value := range selector {
+		labels = append(labels, name+"="+value)
+	}
+	sort.Strings(labels)
+	return strings.Join(labels, ",")
+}
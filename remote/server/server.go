@@ -1,9 +1,12 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"time"
 
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks/reports"
 	"gitlab.com/yakshaving.art/meeseeks-box/remote/api"
 
 	"github.com/grpc-ecosystem/go-grpc-prometheus"
@@ -11,57 +14,206 @@ import (
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+	// Registers the gzip compressor so the agents can use it
+	_ "google.golang.org/grpc/encoding/gzip"
 )
 
 // SecurityModeTLS means TLS security mode with server cert
 const SecurityModeTLS = "tls"
 
+// SecurityModeMTLS means mutual TLS, agents present a cert signed by the CA
+const SecurityModeMTLS = "mtls"
+
+// CompressionGzip compresses the messages with gzip
+const CompressionGzip = "gzip"
+
+// CompressionNone sends the messages as they are, the default
+const CompressionNone = "none"
+
 // RemoteServer is a remote server, duh
 type RemoteServer struct {
 	server *grpc.Server
 	config Config
+
+	certs     *certificates
+	stopWatch chan struct{}
 }
 
 // Config represents the grpc server configuration
+//
+// RequireToken rejects the agents that don't register with a token issued
+// with the agent-token-new builtin
+//
+// CAPath is a bundle of the CAs the certs of the agents can be signed by with
+// mtls, more than one while they are rotated. The cert, the key and the CAs
+// are loaded again with ReloadCerts, and every WatchInterval when their files
+// change if it's set, without dropping the agents that are connected
+//
+// MaxMessageSize is the largest message in bytes the server sends or
+// receives, like the output of a command, 4MB when it's 0. Compression is the
+// one of the agents, the server always answers a compressed call compressed
+//
+// KeepaliveTime is how often the server pings an agent whose connection is
+// idle, every 2 hours by default, and KeepaliveTimeout how long it waits for
+// the answer before it drops the connection, 20 seconds by default.
+// KeepaliveMinTime is how often the agents can ping the server, every 5
+// seconds by default like they do, the ones that ping more often are
+// disconnected. DialTimeout is how long the handshake of a new connection can
+// take, 2 minutes by default, and RPCTimeout the deadline of each call an
+// agent makes that is not a stream, like a heartbeat
 type Config struct {
-	CertPath     string
-	KeyPath      string
-	SecurityMode string
+	CertPath       string
+	KeyPath        string
+	CAPath         string
+	SecurityMode   string
+	RequireToken   bool
+	WatchInterval  time.Duration
+	MaxMessageSize int
+	Compression    string
+
+	KeepaliveTime    time.Duration
+	KeepaliveTimeout time.Duration
+	KeepaliveMinTime time.Duration
+	DialTimeout      time.Duration
+	RPCTimeout       time.Duration
+}
+
+// GetKeepaliveMinTime returns how often the agents can ping the server
+func (c Config) GetKeepaliveMinTime() time.Duration {
+	if c.KeepaliveMinTime == 0 {
+		return 5 * time.Second
+	}
+	return c.KeepaliveMinTime
 }
 
 // New creates a new RemoteServer with an address
 func New(c Config) (*RemoteServer, error) {
 
 	options := []grpc.ServerOption{
-		grpc.StreamInterceptor(grpc_prometheus.StreamServerInterceptor),
-		grpc.UnaryInterceptor(grpc_prometheus.UnaryServerInterceptor),
+		grpc.StreamInterceptor(streamInterceptor),
+		grpc.UnaryInterceptor(unaryInterceptor(c.RPCTimeout)),
+		grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:    c.KeepaliveTime,
+			Timeout: c.KeepaliveTimeout,
+		}),
+		// The agents ping the server even while they run no command, which
+		// is dropped as abuse unless it's allowed
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             c.GetKeepaliveMinTime(),
+			PermitWithoutStream: true,
+		}),
+	}
+	if c.DialTimeout > 0 {
+		options = append(options, grpc.ConnectionTimeout(c.DialTimeout))
 	}
 
+	var certs *certificates
 	switch c.SecurityMode {
-	case SecurityModeTLS:
-		creds, err := credentials.NewServerTLSFromFile(c.CertPath, c.KeyPath)
-		if err != nil {
-			return nil, fmt.Errorf("could not configure tls credentials: %s", err)
+	case SecurityModeTLS, SecurityModeMTLS:
+		var err error
+		if certs, err = newCertificates(c); err != nil {
+			return nil, fmt.Errorf("could not configure %s credentials: %s", c.SecurityMode, err)
 		}
-		options = append(options, grpc.Creds(creds))
+		options = append(options, grpc.Creds(credentials.NewTLS(certs.tlsConfig())))
 
 	default:
 		logrus.Warnf("starting server in insecure mode (without encryption)")
 	}
 
+	if !c.RequireToken {
+		logrus.Warnf("agents can register without a token")
+	}
+	if c.MaxMessageSize > 0 {
+		options = append(options,
+			grpc.MaxRecvMsgSize(c.MaxMessageSize),
+			grpc.MaxSendMsgSize(c.MaxMessageSize))
+	}
+
 	s := grpc.NewServer(options...)
 
-	api.RegisterLogWriterServer(s, logWriterServer{})
-	api.RegisterCommandPipelineServer(s, newCommandPipelineServer())
+	pipeline := newCommandPipelineServer(c.RequireToken)
+	api.RegisterLogWriterServer(s, logWriterServer{pipeline: pipeline})
+	api.RegisterCommandPipelineServer(s, pipeline)
 
 	grpc_prometheus.Register(s)
 
+	stopWatch := make(chan struct{})
+	if certs != nil && c.WatchInterval > 0 {
+		go certs.watch(c.WatchInterval, stopWatch)
+	}
+
 	return &RemoteServer{
 		server: s,
 		config: c,
+
+		certs:     certs,
+		stopWatch: stopWatch,
 	}, nil
 }
 
+// ReloadCerts loads the cert, the key and the CAs again, the agents that
+// connect from now on get the new ones
+func (s RemoteServer) ReloadCerts() error {
+	if s.certs == nil {
+		return nil
+	}
+	if err := s.certs.load(); err != nil {
+		return fmt.Errorf("could not reload grpc certs: %s", err)
+	}
+	logrus.Infof("grpc certs reloaded")
+	return nil
+}
+
+// Validate checks that the security mode is known and that its certs can be
+// loaded
+func (c Config) Validate() error {
+	switch c.SecurityMode {
+	case "", "insecure":
+	case SecurityModeTLS, SecurityModeMTLS:
+		if _, err := newCertificates(c); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid security mode %s, it can be insecure, tls or mtls", c.SecurityMode)
+	}
+	switch c.Compression {
+	case "", CompressionNone, CompressionGzip:
+	default:
+		return fmt.Errorf("invalid compression %s, it can be none or gzip", c.Compression)
+	}
+	if c.MaxMessageSize < 0 {
+		return fmt.Errorf("max message size can't be negative")
+	}
+	for _, timeout := range []time.Duration{c.KeepaliveTime, c.KeepaliveTimeout, c.KeepaliveMinTime, c.DialTimeout, c.RPCTimeout} {
+		if timeout < 0 {
+			return fmt.Errorf("keepalives and timeouts can't be negative")
+		}
+	}
+	return nil
+}
+
+// streamInterceptor measures the streams, and reports their panics as errors
+// so an agent can't take the server down
+func streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer reports.RecoverError(reports.ComponentServer, reports.Tags{"method": info.FullMethod}, &err)
+	return grpc_prometheus.StreamServerInterceptor(srv, ss, info, handler)
+}
+
+// unaryInterceptor measures the calls that are not streams, and gives them
+// the deadline when there is one. Their panics are reported as errors
+func unaryInterceptor(deadline time.Duration) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (_ interface{}, err error) {
+		defer reports.RecoverError(reports.ComponentServer, reports.Tags{"method": info.FullMethod}, &err)
+		if deadline > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, deadline)
+			defer cancel()
+		}
+		return grpc_prometheus.UnaryServerInterceptor(ctx, req, info, handler)
+	}
+}
+
 // Listen starts the listening of a remote server
 func (s RemoteServer) Listen(addr string) error {
 	address, err := net.Listen("tcp", addr)
@@ -78,6 +230,7 @@ func (s RemoteServer) Listen(addr string) error {
 // Shutdown stops listening for requests
 func (s RemoteServer) Shutdown() {
 	logrus.Debugf("gracefully stopping grpc server")
+	close(s.stopWatch)
 	s.server.Stop()
 	logrus.Debugf("grpc server stopped")
 }
@@ -2,18 +2,37 @@ package server_test
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"gitlab.com/yakshaving.art/meeseeks-box/commands"
 	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks/metrics"
 	"gitlab.com/yakshaving.art/meeseeks-box/mocks"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence/artifacts"
+	"gitlab.com/yakshaving.art/meeseeks-box/remote/agent"
+	"gitlab.com/yakshaving.art/meeseeks-box/remote/agenttokens"
 	"gitlab.com/yakshaving.art/meeseeks-box/remote/api"
+	"gitlab.com/yakshaving.art/meeseeks-box/remote/registry"
 	"gitlab.com/yakshaving.art/meeseeks-box/remote/server"
 
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/sirupsen/logrus"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 func TestAgentCanConnect(t *testing.T) {
@@ -81,11 +100,12 @@ func TestAgentCanConnect(t *testing.T) {
 		mocks.AssertEquals(t, uint64(27), cmdReq.JobID)
 		mocks.AssertEquals(t, "echo", cmdReq.Command)
 
+		logCtx := metadata.AppendToOutgoingContext(ctx, api.AgentIDMetadataKey, "agentID1")
 		logClient := api.NewLogWriterClient(client)
-		appender, err := logClient.Append(ctx)
+		appender, err := logClient.Append(logCtx)
 		mocks.Must(t, "could not create log appender", err)
 
-		_, err = logClient.SetError(ctx, &api.ErrorLogEntry{JobID: cmdReq.JobID, Error: "something happened"})
+		_, err = logClient.SetError(logCtx, &api.ErrorLogEntry{JobID: cmdReq.JobID, Error: "something happened"})
 		mocks.Must(t, "could not set error", err)
 
 		mocks.Must(t, "could not send log line", appender.Send(&api.LogEntry{JobID: cmdReq.JobID, Line: "log line 1"}))
@@ -125,3 +145,1403 @@ func TestUsingTLS(t *testing.T) {
 	<-c
 	time.Sleep(1 * time.Millisecond)
 }
+
+func TestMutualTLSBindsTheAgentIdentity(t *testing.T) {
+	fixture := func(name string) string { return "../../config/test-fixtures/mtls/" + name }
+
+	s, err := server.New(server.Config{
+		SecurityMode: server.SecurityModeMTLS,
+		CertPath:     fixture("server.pem"),
+		KeyPath:      fixture("server-key.pem"),
+		CAPath:       fixture("ca.pem"),
+	})
+	mocks.Must(t, "failed to create grpc server", err)
+	defer s.Shutdown()
+
+	go func() {
+		s.Listen("localhost:9701")
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	connect := func(cert string) api.CommandPipelineClient {
+		tlsConfig := &tls.Config{}
+		ca, err := ioutil.ReadFile(fixture("ca.pem"))
+		mocks.Must(t, "could not read ca", err)
+		tlsConfig.RootCAs = x509.NewCertPool()
+		tlsConfig.RootCAs.AppendCertsFromPEM(ca)
+		if cert != "" {
+			c, err := tls.LoadX509KeyPair(fixture(cert+".pem"), fixture(cert+"-key.pem"))
+			mocks.Must(t, "could not load client cert", err)
+			tlsConfig.Certificates = []tls.Certificate{c}
+		}
+		client, err := grpc.Dial("localhost:9701", grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+		mocks.Must(t, "could not create grpc client", err)
+		return api.NewCommandPipelineClient(client)
+	}
+	register := func(client api.CommandPipelineClient) error {
+		pipeline, err := client.RegisterAgent(ctx, &api.AgentConfiguration{
+			AgentID: "agentID1",
+			Commands: map[string]*api.RemoteCommand{
+				"mtls-echo": {AuthStrategy: "any", ChannelStrategy: "any", Timeout: 10},
+			},
+		})
+		if err != nil {
+			return err
+		}
+		recvCtx, cancelRecv := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancelRecv()
+		errCh := make(chan error, 1)
+		go func() {
+			_, err := pipeline.Recv()
+			errCh <- err
+		}()
+		select {
+		case err := <-errCh:
+			return err
+		case <-recvCtx.Done():
+			return nil // registered and waiting for commands
+		}
+	}
+
+	agent := connect("agent")
+	mocks.Must(t, "agent with a cert signed by the CA could not register", register(agent))
+	_, ok := commands.Find(&meeseeks.Request{Command: "mtls-echo"})
+	mocks.AssertEquals(t, true, ok)
+
+	err = register(connect("other-agent"))
+	mocks.AssertEquals(t, codes.PermissionDenied, status.Code(err))
+	mocks.AssertEquals(t, "agent agentID1 is already registered with another identity", status.Convert(err).Message())
+
+	_, err = connect("other-agent").Finish(ctx, &api.CommandFinish{AgentID: "agentID1", JobID: 1})
+	mocks.AssertEquals(t, codes.PermissionDenied, status.Code(err))
+	mocks.AssertEquals(t, "identity agent-2 does not match the one agent agentID1 registered with",
+		status.Convert(err).Message())
+
+	for _, cert := range []string{"rogue", ""} {
+		if err := register(connect(cert)); err == nil {
+			t.Fatalf("agent with cert %q should not be able to register", cert)
+		}
+	}
+}
+
+func TestMutualTLSRequiresACA(t *testing.T) {
+	_, err := server.New(server.Config{
+		SecurityMode: server.SecurityModeMTLS,
+		CertPath:     "../../config/test-fixtures/mtls/server.pem",
+		KeyPath:      "../../config/test-fixtures/mtls/server-key.pem",
+	})
+	mocks.AssertEquals(t, "could not configure mtls credentials: could not read CA cert: open : no such file or directory", err.Error())
+}
+
+func TestValidatingTheSecuritySettings(t *testing.T) {
+	tt := []struct {
+		name     string
+		config   server.Config
+		expected string
+	}{
+		{
+			name:     "insecure",
+			config:   server.Config{SecurityMode: "insecure"},
+			expected: "<nil>",
+		},
+		{
+			name: "tls",
+			config: server.Config{
+				SecurityMode: server.SecurityModeTLS,
+				CertPath:     "../../config/test-fixtures/cert.pem",
+				KeyPath:      "../../config/test-fixtures/key.pem",
+			},
+			expected: "<nil>",
+		},
+		{
+			name:     "tls without a cert",
+			config:   server.Config{SecurityMode: server.SecurityModeTLS},
+			expected: "could not load server cert: open : no such file or directory",
+		},
+		{
+			name: "mtls without a CA",
+			config: server.Config{
+				SecurityMode: server.SecurityModeMTLS,
+				CertPath:     "../../config/test-fixtures/mtls/server.pem",
+				KeyPath:      "../../config/test-fixtures/mtls/server-key.pem",
+			},
+			expected: "could not read CA cert: open : no such file or directory",
+		},
+		{
+			name:     "unknown mode",
+			config:   server.Config{SecurityMode: "ssl"},
+			expected: "invalid security mode ssl, it can be insecure, tls or mtls",
+		},
+		{
+			name:     "gzip",
+			config:   server.Config{Compression: server.CompressionGzip, MaxMessageSize: 16 << 20},
+			expected: "<nil>",
+		},
+		{
+			name:     "unknown compression",
+			config:   server.Config{Compression: "zstd"},
+			expected: "invalid compression zstd, it can be none or gzip",
+		},
+		{
+			name:     "negative max message size",
+			config:   server.Config{MaxMessageSize: -1},
+			expected: "max message size can't be negative",
+		},
+		{
+			name: "keepalives and timeouts",
+			config: server.Config{KeepaliveTime: time.Minute, KeepaliveTimeout: 5 * time.Second,
+				KeepaliveMinTime: time.Second, DialTimeout: 5 * time.Second, RPCTimeout: 5 * time.Second},
+			expected: "<nil>",
+		},
+		{
+			name:     "negative keepalive",
+			config:   server.Config{KeepaliveTime: -time.Second},
+			expected: "keepalives and timeouts can't be negative",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			mocks.AssertEquals(t, tc.expected, fmt.Sprint(tc.config.Validate()))
+		})
+	}
+}
+
+func TestAgentTokensAreRequired(t *testing.T) {
+	mocks.Must(t, "failed to register agents", mocks.WithTmpDB(func(_ string) {
+		server.ConfigureHeartbeats(server.Heartbeats{Interval: 1})
+		defer server.ConfigureHeartbeats(server.Heartbeats{})
+
+		s, err := server.New(server.Config{RequireToken: true})
+		mocks.Must(t, "failed to create grpc server", err)
+		defer s.Shutdown()
+
+		go func() {
+			s.Listen("localhost:9703")
+		}()
+		time.Sleep(10 * time.Millisecond)
+
+		client, err := grpc.Dial("localhost:9703", grpc.WithInsecure())
+		mocks.Must(t, "could not create grpc client", err)
+		defer client.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		register := func(agentID, token string) api.CommandPipeline_RegisterAgentClient {
+			pipeline, err := api.NewCommandPipelineClient(client).RegisterAgent(ctx, &api.AgentConfiguration{
+				AgentID: agentID,
+				Token:   token,
+				Commands: map[string]*api.RemoteCommand{
+					"token-echo": {AuthStrategy: "any", ChannelStrategy: "any", Timeout: 10},
+				},
+			})
+			mocks.Must(t, "could not register agent", err)
+			return pipeline
+		}
+
+		heartbeat := func(token string) error {
+			_, err := api.NewCommandPipelineClient(client).Heartbeat(
+				metadata.AppendToOutgoingContext(ctx, api.TokenMetadataKey, token),
+				&api.AgentHeartbeat{AgentID: "builder/agentID1"})
+			return err
+		}
+
+		_, err = register("agentID1", "null-token").Recv()
+		mocks.AssertEquals(t, codes.Unauthenticated, status.Code(err))
+		mocks.AssertEquals(t, "invalid agent token", status.Convert(err).Message())
+
+		token, err := agenttokens.Issue("builder", "admin")
+		mocks.Must(t, "could not issue agent token", err)
+		mocks.AssertEquals(t, "builder/agentID1", agenttokens.AgentID(token, "agentID1"))
+
+		_, err = register("agentID1", token).Recv()
+		mocks.AssertEquals(t, codes.PermissionDenied, status.Code(err))
+		mocks.AssertEquals(t, "agent agentID1 does not belong to the token of builder", status.Convert(err).Message())
+
+		pipeline := register("builder/agentID1", token)
+		time.Sleep(10 * time.Millisecond)
+		_, ok := commands.Find(&meeseeks.Request{Command: "token-echo"})
+		mocks.AssertEquals(t, true, ok)
+
+		mocks.Must(t, "heartbeat with the token was rejected", heartbeat(token))
+		err = heartbeat("")
+		mocks.AssertEquals(t, codes.PermissionDenied, status.Code(err))
+		mocks.AssertEquals(t, "agent builder/agentID1 did not call with a valid token: invalid agent token",
+			status.Convert(err).Message())
+
+		_, err = agenttokens.Rotate("builder", "admin")
+		mocks.Must(t, "could not rotate agent token", err)
+
+		_, err = pipeline.Recv()
+		mocks.AssertEquals(t, codes.Unauthenticated, status.Code(err))
+		mocks.AssertEquals(t, "the agent token was rotated or revoked", status.Convert(err).Message())
+		_, ok = commands.Find(&meeseeks.Request{Command: "token-echo"})
+		mocks.AssertEquals(t, false, ok)
+
+		_, err = register("builder/agentID1", token).Recv()
+		mocks.AssertEquals(t, codes.Unauthenticated, status.Code(err))
+
+		rotated, err := agenttokens.Rotate("builder", "admin")
+		mocks.Must(t, "could not rotate agent token", err)
+		pipeline = register("builder/agentID1", rotated)
+		time.Sleep(10 * time.Millisecond)
+		mocks.Must(t, "heartbeat with the rotated token was rejected", heartbeat(rotated))
+
+		// Revoked by another server, which doesn't tell this one
+		mocks.Must(t, "could not revoke agent token", persistence.AgentTokens().Revoke("builder"))
+		mocks.AssertEquals(t, codes.PermissionDenied, status.Code(heartbeat(rotated)))
+
+		_, err = pipeline.Recv()
+		mocks.AssertEquals(t, codes.Unauthenticated, status.Code(err))
+		mocks.AssertEquals(t, "the agent token was rotated or revoked", status.Convert(err).Message())
+	}))
+}
+
+func TestAgentPolicies(t *testing.T) {
+	mocks.Must(t, "failed to register agents", mocks.WithTmpDB(func(_ string) {
+		server.ConfigurePolicies([]server.AgentPolicy{
+			{Token: "builder", Commands: []string{"build-*"}, AuthStrategies: []string{"group"}},
+			{Labels: map[string]string{"tier": "testing"}, Commands: []string{"test-*"}},
+		})
+		defer server.ConfigurePolicies(nil)
+
+		s, err := server.New(server.Config{})
+		mocks.Must(t, "failed to create grpc server", err)
+		defer s.Shutdown()
+
+		go func() {
+			s.Listen("localhost:9704")
+		}()
+		time.Sleep(10 * time.Millisecond)
+
+		client, err := grpc.Dial("localhost:9704", grpc.WithInsecure())
+		mocks.Must(t, "could not create grpc client", err)
+		defer client.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+
+		builderToken, err := agenttokens.Issue("builder", "admin")
+		mocks.Must(t, "could not issue agent token", err)
+
+		register := func(token string, labels map[string]string, commands map[string]*api.RemoteCommand) error {
+			pipeline, err := api.NewCommandPipelineClient(client).RegisterAgent(ctx, &api.AgentConfiguration{
+				AgentID:  agenttokens.AgentID(token, "agentID1"),
+				Token:    token,
+				Labels:   labels,
+				Commands: commands,
+			})
+			mocks.Must(t, "could not register agent", err)
+
+			errCh := make(chan error, 1)
+			go func() {
+				_, err := pipeline.Recv()
+				errCh <- err
+			}()
+			select {
+			case err := <-errCh:
+				return err
+			case <-time.After(50 * time.Millisecond):
+				return nil // registered and waiting for commands
+			}
+		}
+
+		tt := []struct {
+			name     string
+			token    string
+			labels   map[string]string
+			commands map[string]*api.RemoteCommand
+			err      string
+		}{
+			{
+				name:     "allowed by token",
+				token:    builderToken,
+				commands: map[string]*api.RemoteCommand{"build-policy": {AuthStrategy: "group"}},
+			},
+			{
+				name:     "allowed by label",
+				labels:   map[string]string{"tier": "testing"},
+				commands: map[string]*api.RemoteCommand{"test-policy": {AuthStrategy: "any"}},
+			},
+			{
+				name:     "shadowing a command",
+				token:    builderToken,
+				commands: map[string]*api.RemoteCommand{"deploy": {AuthStrategy: "group"}},
+				err:      "agent builder/agentID1 is not allowed to register command deploy with auth strategy group",
+			},
+			{
+				name:     "granting itself any auth",
+				token:    builderToken,
+				commands: map[string]*api.RemoteCommand{"build-policy": {AuthStrategy: "any"}},
+				err:      "agent builder/agentID1 is not allowed to register command build-policy with auth strategy any",
+			},
+			{
+				name:     "matching no policy",
+				labels:   map[string]string{"tier": "production"},
+				commands: map[string]*api.RemoteCommand{"test-policy": {AuthStrategy: "any"}},
+				err:      "agent agentID1 matches no policy",
+			},
+		}
+		for _, tc := range tt {
+			t.Run(tc.name, func(t *testing.T) {
+				err := register(tc.token, tc.labels, tc.commands)
+				if tc.err == "" {
+					mocks.Must(t, "agent could not register", err)
+					return
+				}
+				mocks.AssertEquals(t, codes.PermissionDenied, status.Code(err))
+				mocks.AssertEquals(t, tc.err, status.Convert(err).Message())
+			})
+		}
+	}))
+}
+
+func TestCommandsAreRoutedByTheLabelsOfTheAgents(t *testing.T) {
+	mocks.Must(t, "failed to route commands", mocks.WithTmpDB(func(_ string) {
+		s, err := server.New(server.Config{})
+		mocks.Must(t, "failed to create grpc server", err)
+		defer s.Shutdown()
+
+		go func() {
+			s.Listen("localhost:9705")
+		}()
+		time.Sleep(10 * time.Millisecond)
+
+		client, err := grpc.Dial("localhost:9705", grpc.WithInsecure())
+		mocks.Must(t, "could not create grpc client", err)
+		defer client.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		cmdClient := api.NewCommandPipelineClient(client)
+		pipelines := map[string]api.CommandPipeline_RegisterAgentClient{}
+		for agentID, tier := range map[string]string{"agent-a": "web", "agent-b": "db"} {
+			pipeline, err := cmdClient.RegisterAgent(ctx, &api.AgentConfiguration{
+				AgentID: agentID,
+				Labels:  map[string]string{"tier": tier},
+				Commands: map[string]*api.RemoteCommand{
+					"routed-echo": {AuthStrategy: "any", ChannelStrategy: "any", Timeout: 10},
+				},
+				Os:       "linux",
+				Arch:     "amd64",
+				Hostname: tier + "-01",
+			})
+			mocks.Must(t, "could not register agent", err)
+			pipelines[agentID] = pipeline
+		}
+		time.Sleep(20 * time.Millisecond)
+
+		agents := registry.List()
+		mocks.AssertEquals(t, 2, len(agents))
+		mocks.AssertEquals(t, "web-01", agents[0].Hostname)
+		mocks.AssertEquals(t, "linux", agents[1].OS)
+		mocks.AssertEquals(t, []string{"routed-echo"}, agents[1].Commands)
+
+		received := make(chan *api.CommandRequest, 2)
+		for agentID, pipeline := range pipelines {
+			go func(agentID string, pipeline api.CommandPipeline_RegisterAgentClient) {
+				for {
+					req, err := pipeline.Recv()
+					if err != nil {
+						return
+					}
+					received <- req
+					cmdClient.Finish(ctx, &api.CommandFinish{AgentID: agentID, JobID: req.JobID, Content: agentID})
+				}
+			}(agentID, pipeline)
+		}
+
+		tt := []struct {
+			name     string
+			route    map[string]string
+			args     []string
+			sent     []string
+			expected string
+			err      string
+		}{
+			{
+				name:     "lowest agent ID without a selector",
+				args:     []string{"hello"},
+				expected: "agent-a",
+			},
+			{
+				name:     "the flag after the args is an arg",
+				args:     []string{"hello", "--on", "tier=db"},
+				sent:     []string{"hello", "--on", "tier=db"},
+				expected: "agent-a",
+			},
+			{
+				name:     "selected by the request",
+				args:     []string{"--on", "tier=db", "hello"},
+				expected: "agent-b",
+			},
+			{
+				name:     "selected by the request with an equal sign",
+				args:     []string{"--on=tier=db", "hello"},
+				expected: "agent-b",
+			},
+			{
+				name:     "selected by an implicit label",
+				args:     []string{"--on", "os=linux,hostname=db-01", "hello"},
+				expected: "agent-b",
+			},
+			{
+				name:     "selected by the configuration",
+				route:    map[string]string{"tier": "db"},
+				args:     []string{"hello"},
+				expected: "agent-b",
+			},
+			{
+				name:     "the request wins over the configuration",
+				route:    map[string]string{"tier": "db"},
+				args:     []string{"--on", "tier=web", "hello"},
+				expected: "agent-a",
+			},
+			{
+				name: "no agent has the labels",
+				args: []string{"--on", "tier=cache,region=eu", "hello"},
+				err:  "no agent with labels region=eu,tier=cache has command routed-echo",
+			},
+			{
+				name: "invalid selector",
+				args: []string{"--on", "cache", "hello"},
+				err:  "invalid label selector cache, it should be like tier=web,region=eu",
+			},
+		}
+		for i, tc := range tt {
+			t.Run(tc.name, func(t *testing.T) {
+				server.ConfigureRoutes(server.Routes{"routed-echo": tc.route})
+				defer server.ConfigureRoutes(nil)
+
+				cmd, ok := commands.Find(&meeseeks.Request{Command: "routed-echo"})
+				mocks.AssertEquals(t, true, ok)
+
+				out, err := cmd.Execute(ctx, meeseeks.Job{
+					ID:      uint64(100 + i),
+					Request: meeseeks.Request{Command: "routed-echo", Args: tc.args},
+				})
+				if tc.err != "" {
+					mocks.AssertEquals(t, tc.err, fmt.Sprint(err))
+					return
+				}
+				mocks.Must(t, "could not execute routed command", err)
+				mocks.AssertEquals(t, tc.expected, out)
+
+				sent := tc.sent
+				if sent == nil {
+					sent = []string{"hello"}
+				}
+				req := <-received
+				mocks.AssertEquals(t, sent, req.Args)
+			})
+		}
+	}))
+}
+
+func TestJobsAreSpreadOverTheAgentsWithTheirStrategy(t *testing.T) {
+	mocks.Must(t, "failed to dispatch jobs", mocks.WithTmpDB(func(_ string) {
+		s, err := server.New(server.Config{})
+		mocks.Must(t, "failed to create grpc server", err)
+		defer s.Shutdown()
+
+		go func() {
+			s.Listen("localhost:9706")
+		}()
+		time.Sleep(10 * time.Millisecond)
+
+		client, err := grpc.Dial("localhost:9706", grpc.WithInsecure())
+		mocks.Must(t, "could not create grpc client", err)
+		defer client.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		// The agents tell which one got each job, and wait for the test to
+		// finish them
+		type received struct {
+			agentID string
+			jobID   uint64
+		}
+		jobs := make(chan received, 10)
+		cmdClient := api.NewCommandPipelineClient(client)
+		for _, agentID := range []string{"agent-a", "agent-b"} {
+			pipeline, err := cmdClient.RegisterAgent(ctx, &api.AgentConfiguration{
+				AgentID: agentID,
+				Labels:  map[string]string{"version": map[string]string{"agent-a": "v1", "agent-b": "v2"}[agentID]},
+				Commands: map[string]*api.RemoteCommand{
+					"pooled-echo": {AuthStrategy: "any", ChannelStrategy: "any", Timeout: 10},
+				},
+			})
+			mocks.Must(t, "could not register agent", err)
+			go func(agentID string) {
+				for {
+					req, err := pipeline.Recv()
+					if err != nil {
+						return
+					}
+					jobs <- received{agentID: agentID, jobID: req.JobID}
+				}
+			}(agentID)
+		}
+		time.Sleep(20 * time.Millisecond)
+
+		cmd, ok := commands.Find(&meeseeks.Request{Command: "pooled-echo"})
+		mocks.AssertEquals(t, true, ok)
+
+		jobID := uint64(200)
+		start := func() (received, chan error) {
+			jobID++
+			errs := make(chan error, 1)
+			go func(id uint64) {
+				_, err := cmd.Execute(ctx, meeseeks.Job{ID: id, Request: meeseeks.Request{Command: "pooled-echo"}})
+				errs <- err
+			}(jobID)
+			return <-jobs, errs
+		}
+		finish := func(r received, errs chan error) {
+			_, err := cmdClient.Finish(ctx, &api.CommandFinish{AgentID: r.agentID, JobID: r.jobID})
+			mocks.Must(t, "could not finish job", err)
+			mocks.Must(t, "job failed", <-errs)
+		}
+		run := func() string {
+			r, errs := start()
+			finish(r, errs)
+			return r.agentID
+		}
+
+		t.Run("first", func(t *testing.T) {
+			server.ConfigureDispatch(server.Dispatch{})
+			mocks.AssertEquals(t, []string{"agent-a", "agent-a", "agent-a"}, []string{run(), run(), run()})
+		})
+
+		t.Run("round robin", func(t *testing.T) {
+			server.ConfigureDispatch(server.Dispatch{Strategy: server.StrategyRoundRobin})
+			defer server.ConfigureDispatch(server.Dispatch{})
+			mocks.AssertEquals(t, []string{"agent-a", "agent-b", "agent-a", "agent-b"}, []string{run(), run(), run(), run()})
+		})
+
+		t.Run("least busy", func(t *testing.T) {
+			server.ConfigureDispatch(server.Dispatch{Commands: map[string]string{"pooled-echo": server.StrategyLeastBusy}})
+			defer server.ConfigureDispatch(server.Dispatch{})
+
+			first, firstErrs := start()
+			second, secondErrs := start()
+			mocks.AssertEquals(t, "agent-a", first.agentID)
+			mocks.AssertEquals(t, "agent-b", second.agentID)
+
+			finish(second, secondErrs)
+			mocks.AssertEquals(t, "agent-b", run())
+			finish(first, firstErrs)
+			mocks.AssertEquals(t, "agent-a", run())
+		})
+
+		t.Run("random", func(t *testing.T) {
+			server.ConfigureDispatch(server.Dispatch{Strategy: server.StrategyRandom})
+			defer server.ConfigureDispatch(server.Dispatch{})
+			mocks.AssertMatches(t, "^agent-(a|b)$", run())
+		})
+
+		t.Run("canary", func(t *testing.T) {
+			server.ConfigureCanaries(server.Canaries{
+				"pooled-echo": {Labels: map[string]string{"version": "v2"}, Percent: 25},
+			})
+			defer server.ConfigureCanaries(nil)
+
+			picked := make([]string, 0, 8)
+			for i := 0; i < 8; i++ {
+				picked = append(picked, run())
+			}
+			mocks.AssertEquals(t, []string{"agent-a", "agent-a", "agent-a", "agent-b",
+				"agent-a", "agent-a", "agent-a", "agent-b"}, picked)
+		})
+	}))
+}
+
+func TestAgentsThatMissTheirHeartbeatsAreUnregistered(t *testing.T) {
+	mocks.Must(t, "failed to watch heartbeats", mocks.WithTmpDB(func(_ string) {
+		notified := make(chan string, 1)
+		server.SetNotifier(func(channelID, text string) {
+			notified <- channelID + ": " + text
+		})
+		defer server.SetNotifier(nil)
+		server.ConfigureHeartbeats(server.Heartbeats{Interval: 1, Misses: 2, ChannelID: "C0ADMIN"})
+		defer server.ConfigureHeartbeats(server.Heartbeats{})
+
+		s, err := server.New(server.Config{})
+		mocks.Must(t, "failed to create grpc server", err)
+		defer s.Shutdown()
+
+		go func() {
+			s.Listen("localhost:9707")
+		}()
+		time.Sleep(10 * time.Millisecond)
+
+		client, err := grpc.Dial("localhost:9707", grpc.WithInsecure())
+		mocks.Must(t, "could not create grpc client", err)
+		defer client.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		cmdClient := api.NewCommandPipelineClient(client)
+		register := func(agentID, command string) api.CommandPipeline_RegisterAgentClient {
+			pipeline, err := cmdClient.RegisterAgent(ctx, &api.AgentConfiguration{
+				AgentID: agentID,
+				Labels:  map[string]string{"tier": "web", "region": "eu"},
+				Commands: map[string]*api.RemoteCommand{
+					command: {AuthStrategy: "any", ChannelStrategy: "any", Timeout: 10},
+				},
+			})
+			mocks.Must(t, "could not register agent", err)
+			return pipeline
+		}
+		beat := func(agentID string) error {
+			_, err := cmdClient.Heartbeat(ctx, &api.AgentHeartbeat{
+				AgentID:      agentID,
+				JobsExecuted: 12,
+				JobsFailed:   2,
+				JobsRunning:  1,
+				Load:         0.5,
+			})
+			return err
+		}
+		gauge := func(vec *prometheus.GaugeVec, agentID string) float64 {
+			m := &dto.Metric{}
+			mocks.Must(t, "could not read metric", vec.WithLabelValues(agentID, "region=eu,tier=web").Write(m))
+			return m.GetGauge().GetValue()
+		}
+
+		mocks.AssertEquals(t, "rpc error: code = PermissionDenied desc = agent stranger is not registered", fmt.Sprint(beat("stranger")))
+
+		// The healthy agent keeps beating, the hung one stops after its
+		// first heartbeat and the old one never sends any
+		register("healthy", "healthy-echo")
+		hung := register("hung", "hung-echo")
+		register("old", "old-echo")
+		time.Sleep(20 * time.Millisecond)
+
+		mocks.Must(t, "could not send heartbeat", beat("hung"))
+		for i := 0; i < 16; i++ {
+			mocks.Must(t, "could not send heartbeat", beat("healthy"))
+			time.Sleep(250 * time.Millisecond)
+		}
+
+		select {
+		case text := <-notified:
+			mocks.AssertEquals(t, "C0ADMIN: agent hung missed 2 heartbeats and was marked unhealthy, it no longer runs hung-echo", text)
+		case <-time.After(time.Second):
+			t.Fatal("the admin channel was not notified")
+		}
+		_, err = hung.Recv()
+		mocks.AssertEquals(t, "rpc error: code = Unavailable desc = the agent missed 2 heartbeats", fmt.Sprint(err))
+
+		for command, registered := range map[string]bool{"healthy-echo": true, "hung-echo": false, "old-echo": true} {
+			_, ok := commands.Find(&meeseeks.Request{Command: command})
+			mocks.AssertEquals(t, registered, ok)
+		}
+
+		// The metrics the healthy agent reports are exported with its labels
+		mocks.AssertEquals(t, []float64{12, 2, 1, 0.5}, []float64{
+			gauge(metrics.AgentExecutedJobsCount, "healthy"),
+			gauge(metrics.AgentFailedJobsCount, "healthy"),
+			gauge(metrics.AgentRunningJobs, "healthy"),
+			gauge(metrics.AgentLoad, "healthy"),
+		})
+	}))
+}
+
+func TestCertsAreRotatedWithoutDroppingTheAgents(t *testing.T) {
+	fixture := func(name string) string { return "../../config/test-fixtures/mtls/" + name }
+	read := func(names ...string) []byte {
+		content := []byte{}
+		for _, name := range names {
+			b, err := ioutil.ReadFile(fixture(name))
+			mocks.Must(t, "could not read fixture", err)
+			content = append(content, b...)
+		}
+		return content
+	}
+
+	dir, err := ioutil.TempDir("", "meeseeks-certs")
+	mocks.Must(t, "could not create tmp dir", err)
+	defer os.RemoveAll(dir)
+
+	certPath, keyPath, caPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem")
+	install := func(cert, key string, cas ...string) {
+		mocks.Must(t, "could not write cert", ioutil.WriteFile(certPath, read(cert), 0600))
+		mocks.Must(t, "could not write key", ioutil.WriteFile(keyPath, read(key), 0600))
+		mocks.Must(t, "could not write CA", ioutil.WriteFile(caPath, read(cas...), 0600))
+	}
+	install("server.pem", "server-key.pem", "ca.pem")
+
+	s, err := server.New(server.Config{
+		SecurityMode:  server.SecurityModeMTLS,
+		CertPath:      certPath,
+		KeyPath:       keyPath,
+		CAPath:        caPath,
+		WatchInterval: 10 * time.Millisecond,
+	})
+	mocks.Must(t, "failed to create grpc server", err)
+	defer s.Shutdown()
+
+	go func() {
+		s.Listen("localhost:9708")
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The agents trust the CA the server cert is signed by
+	connect := func(cert string, cas ...string) api.CommandPipelineClient {
+		tlsConfig := &tls.Config{RootCAs: x509.NewCertPool()}
+		tlsConfig.RootCAs.AppendCertsFromPEM(read(cas...))
+		c, err := tls.LoadX509KeyPair(fixture(cert+".pem"), fixture(cert+"-key.pem"))
+		mocks.Must(t, "could not load client cert", err)
+		tlsConfig.Certificates = []tls.Certificate{c}
+
+		client, err := grpc.Dial("localhost:9708", grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+		mocks.Must(t, "could not create grpc client", err)
+		return api.NewCommandPipelineClient(client)
+	}
+	register := func(client api.CommandPipelineClient, agentID string) error {
+		pipeline, err := client.RegisterAgent(ctx, &api.AgentConfiguration{
+			AgentID: agentID,
+			Commands: map[string]*api.RemoteCommand{
+				agentID + "-echo": {AuthStrategy: "any", ChannelStrategy: "any", Timeout: 10},
+			},
+		})
+		if err != nil {
+			return err
+		}
+		errCh := make(chan error, 1)
+		go func() {
+			_, err := pipeline.Recv()
+			errCh <- err
+		}()
+		select {
+		case err := <-errCh:
+			return err
+		case <-time.After(100 * time.Millisecond):
+			return nil // registered and waiting for commands
+		}
+	}
+
+	connected := connect("agent", "ca.pem")
+	mocks.Must(t, "agent signed by the first CA could not register", register(connected, "before"))
+	if err := register(connect("rotated-agent", "ca-2.pem"), "rejected"); err == nil {
+		t.Fatal("agent signed by the second CA should not register before the rotation")
+	}
+
+	install("rotated-server.pem", "rotated-server-key.pem", "ca.pem", "ca-2.pem")
+	time.Sleep(50 * time.Millisecond)
+
+	mocks.Must(t, "agent signed by the second CA could not register after the rotation",
+		register(connect("rotated-agent", "ca-2.pem"), "after"))
+	_, err = connected.Heartbeat(ctx, &api.AgentHeartbeat{AgentID: "before"})
+	mocks.Must(t, "the connected agent was dropped by the rotation", err)
+
+	mocks.Must(t, "could not write CA", ioutil.WriteFile(caPath, []byte("not a cert"), 0600))
+	mocks.AssertEquals(t, fmt.Sprintf("could not reload grpc certs: no certs found in CA file %s", caPath), fmt.Sprint(s.ReloadCerts()))
+	mocks.Must(t, "the previous certs were not kept when the new ones failed to load",
+		register(connect("other-agent", "ca-2.pem"), "kept"))
+}
+
+func TestLargeOutputsFitInTheMaxMessageSize(t *testing.T) {
+	mocks.Must(t, "failed to send large outputs", mocks.WithTmpDB(func(_ string) {
+		s, err := server.New(server.Config{MaxMessageSize: 8 << 20})
+		mocks.Must(t, "failed to create grpc server", err)
+		defer s.Shutdown()
+
+		go func() {
+			s.Listen("localhost:9712")
+		}()
+		time.Sleep(10 * time.Millisecond)
+
+		// The agent compresses what it sends, the server has to understand it
+		options := (&agent.Configuration{Compression: agent.CompressionGzip, MaxMessageSize: 8 << 20}).GetOptions()
+		client, err := grpc.Dial("localhost:9712", options...)
+		mocks.Must(t, "could not create grpc client", err)
+		defer client.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		cmdClient := api.NewCommandPipelineClient(client)
+		pipeline, err := cmdClient.RegisterAgent(ctx, &api.AgentConfiguration{
+			AgentID: "large-agent",
+			Commands: map[string]*api.RemoteCommand{
+				"large-echo": {AuthStrategy: "any", ChannelStrategy: "any", Timeout: 10},
+			},
+		})
+		mocks.Must(t, "could not register agent", err)
+		jobs := make(chan uint64, 1)
+		go func() {
+			for {
+				req, err := pipeline.Recv()
+				if err != nil {
+					return
+				}
+				jobs <- req.JobID
+			}
+		}()
+		time.Sleep(20 * time.Millisecond)
+
+		cmd, ok := commands.Find(&meeseeks.Request{Command: "large-echo"})
+		mocks.AssertEquals(t, true, ok)
+
+		// Larger than the 4MB grpc allows by default
+		output := strings.Repeat("terraform plan output\n", 5<<20/22)
+		outputs := make(chan string, 1)
+		go func() {
+			content, err := cmd.Execute(ctx, meeseeks.Job{ID: 300, Request: meeseeks.Request{Command: "large-echo"}})
+			mocks.Must(t, "large job failed", err)
+			outputs <- content
+		}()
+		_, err = cmdClient.Finish(ctx, &api.CommandFinish{AgentID: "large-agent", JobID: <-jobs, Content: output})
+		mocks.Must(t, "could not finish job with a large output", err)
+		mocks.AssertEquals(t, len(output), len(<-outputs))
+
+		_, err = cmdClient.Finish(ctx, &api.CommandFinish{AgentID: "large-agent", JobID: 301, Content: output + output})
+		mocks.AssertEquals(t, codes.ResourceExhausted, status.Code(err))
+	}))
+}
+
+func TestAgentsUploadTheArtifactsOfTheirJobs(t *testing.T) {
+	mocks.Must(t, "failed to upload artifacts", mocks.WithTmpDB(func(_ string) {
+		path, err := ioutil.TempDir("", "meeseeks-artifacts")
+		mocks.Must(t, "failed to create artifacts path", err)
+		defer os.RemoveAll(path)
+
+		mocks.Must(t, "failed to configure artifacts", artifacts.Configure(artifacts.Config{Path: path}))
+		defer artifacts.Configure(artifacts.Config{})
+
+		s, err := server.New(server.Config{})
+		mocks.Must(t, "failed to create grpc server", err)
+		defer s.Shutdown()
+
+		go func() {
+			s.Listen("localhost:9713")
+		}()
+		time.Sleep(10 * time.Millisecond)
+
+		client, err := grpc.Dial("localhost:9713", grpc.WithInsecure())
+		mocks.Must(t, "could not create grpc client", err)
+		defer client.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		cmdClient := api.NewCommandPipelineClient(client)
+		pipeline, err := cmdClient.RegisterAgent(ctx, &api.AgentConfiguration{
+			AgentID: "artifacts-agent",
+			Commands: map[string]*api.RemoteCommand{
+				"build": {AuthStrategy: "any", ChannelStrategy: "any", Timeout: 10},
+			},
+		})
+		mocks.Must(t, "could not register agent", err)
+		_, err = cmdClient.RegisterAgent(ctx, &api.AgentConfiguration{
+			AgentID: "intruder-agent",
+			Commands: map[string]*api.RemoteCommand{
+				"lint": {AuthStrategy: "any", ChannelStrategy: "any", Timeout: 10},
+			},
+		})
+		mocks.Must(t, "could not register agent", err)
+		time.Sleep(20 * time.Millisecond)
+
+		uploadAs := func(agentID string, jobID uint64, chunks ...string) error {
+			stream, err := cmdClient.UploadArtifact(ctx)
+			if err != nil {
+				return err
+			}
+			for _, chunk := range chunks {
+				stream.Send(&api.ArtifactChunk{AgentID: agentID, JobID: jobID, Name: "report.txt", Content: []byte(chunk)})
+			}
+			_, err = stream.CloseAndRecv()
+			return err
+		}
+		upload := func(jobID uint64, chunks ...string) error {
+			return uploadAs("artifacts-agent", jobID, chunks...)
+		}
+
+		intruded := make(chan error, 1)
+		go func() {
+			req, err := pipeline.Recv()
+			if err != nil {
+				return
+			}
+			intruded <- uploadAs("intruder-agent", req.JobID, "all tests passed, trust me")
+			mocks.Must(t, "could not upload artifact", upload(req.JobID, "all tests ", "passed"))
+			cmdClient.Finish(ctx, &api.CommandFinish{AgentID: "artifacts-agent", JobID: req.JobID, Content: "built"})
+		}()
+
+		cmd, ok := commands.Find(&meeseeks.Request{Command: "build"})
+		mocks.AssertEquals(t, true, ok)
+
+		out, err := cmd.Execute(ctx, meeseeks.Job{ID: 400, Request: meeseeks.Request{Command: "build"}})
+		mocks.Must(t, "build job failed", err)
+		mocks.AssertEquals(t, "built", out)
+
+		err = <-intruded
+		mocks.AssertEquals(t, codes.PermissionDenied, status.Code(err))
+		mocks.AssertEquals(t, "job 400 was not dispatched to agent intruder-agent", status.Convert(err).Message())
+
+		mocks.AssertEquals(t, []string{"report.txt"}, artifacts.Links(400))
+		content, err := ioutil.ReadFile(filepath.Join(path, "400", "report.txt"))
+		mocks.Must(t, "could not read uploaded artifact", err)
+		mocks.AssertEquals(t, "all tests passed", string(content))
+
+		err = upload(400, "too late")
+		mocks.AssertEquals(t, codes.PermissionDenied, status.Code(err))
+		mocks.AssertEquals(t, "job 400 is not running", status.Convert(err).Message())
+	}))
+}
+
+func TestConflictingCommandsFollowTheirPolicy(t *testing.T) {
+	mocks.Must(t, "failed to register agents", mocks.WithTmpDB(func(_ string) {
+		s, err := server.New(server.Config{})
+		mocks.Must(t, "failed to create grpc server", err)
+		defer s.Shutdown()
+
+		go func() {
+			s.Listen("localhost:9714")
+		}()
+		time.Sleep(10 * time.Millisecond)
+
+		client, err := grpc.Dial("localhost:9714", grpc.WithInsecure())
+		mocks.Must(t, "could not create grpc client", err)
+		defer client.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		cmdClient := api.NewCommandPipelineClient(client)
+		requests := make(chan *api.CommandRequest, 1)
+		register := func(agentID, version string, cmd *api.RemoteCommand) error {
+			pipeline, err := cmdClient.RegisterAgent(ctx, &api.AgentConfiguration{
+				AgentID:  agentID,
+				Version:  version,
+				Commands: map[string]*api.RemoteCommand{"conflicted": cmd},
+			})
+			mocks.Must(t, "could not register agent", err)
+
+			errCh := make(chan error, 1)
+			go func() {
+				for {
+					req, err := pipeline.Recv()
+					if err != nil {
+						errCh <- err
+						return
+					}
+					requests <- req
+				}
+			}()
+			select {
+			case err := <-errCh:
+				return err
+			case <-time.After(50 * time.Millisecond):
+				return nil // registered and waiting for commands
+			}
+		}
+
+		mocks.Must(t, "first agent could not register", register("agent-a", "1.0.0",
+			&api.RemoteCommand{AuthStrategy: "any", ChannelStrategy: "any", Timeout: 10}))
+
+		t.Run("reject by default", func(t *testing.T) {
+			err := register("agent-b", "1.0.0", &api.RemoteCommand{AuthStrategy: "none", ChannelStrategy: "any", Timeout: 10})
+			mocks.AssertEquals(t, codes.AlreadyExists, status.Code(err))
+			mocks.AssertEquals(t, "command conflicted is already registered with a different auth strategy",
+				status.Convert(err).Message())
+		})
+
+		t.Run("version", func(t *testing.T) {
+			server.ConfigureConflicts(server.Conflicts{Policy: server.ConflictVersion})
+			defer server.ConfigureConflicts(server.Conflicts{})
+
+			mocks.Must(t, "versioned agent could not register", register("agent-c", "2.0.0",
+				&api.RemoteCommand{AuthStrategy: "any", ChannelStrategy: "any", Timeout: 20}))
+
+			cmd, ok := commands.Find(&meeseeks.Request{Command: "conflicted@2.0.0"})
+			mocks.AssertEquals(t, true, ok)
+			mocks.AssertEquals(t, 20*time.Second, cmd.GetTimeout())
+
+			errs := make(chan error, 1)
+			go func() {
+				_, err := cmd.Execute(ctx, meeseeks.Job{ID: 301, Request: meeseeks.Request{Command: "conflicted@2.0.0"}})
+				errs <- err
+			}()
+			req := <-requests
+			mocks.AssertEquals(t, "conflicted", req.Command)
+			_, err := cmdClient.Finish(ctx, &api.CommandFinish{AgentID: "agent-c", JobID: req.JobID})
+			mocks.Must(t, "could not finish job", err)
+			mocks.Must(t, "job failed", <-errs)
+		})
+
+		t.Run("join", func(t *testing.T) {
+			server.ConfigureConflicts(server.Conflicts{Commands: map[string]string{"conflicted": server.ConflictJoin}})
+			defer server.ConfigureConflicts(server.Conflicts{})
+
+			mocks.Must(t, "joining agent could not register", register("agent-d", "3.0.0",
+				&api.RemoteCommand{AuthStrategy: "any", ChannelStrategy: "any", Timeout: 30}))
+
+			cmd, ok := commands.Find(&meeseeks.Request{Command: "conflicted"})
+			mocks.AssertEquals(t, true, ok)
+			mocks.AssertEquals(t, 10*time.Second, cmd.GetTimeout())
+		})
+
+		t.Run("join with other access", func(t *testing.T) {
+			server.ConfigureConflicts(server.Conflicts{Commands: map[string]string{"conflicted": server.ConflictJoin}})
+			defer server.ConfigureConflicts(server.Conflicts{})
+
+			err := register("agent-e", "3.0.0", &api.RemoteCommand{
+				AuthStrategy: "group", AllowedGroups: []string{"admin"}, ChannelStrategy: "any", Timeout: 10})
+			mocks.AssertEquals(t, codes.AlreadyExists, status.Code(err))
+			mocks.AssertEquals(t, "command conflicted is already registered with a different auth strategy, allowed groups",
+				status.Convert(err).Message())
+		})
+	}))
+}
+
+func TestDispatchedJobsAreAudited(t *testing.T) {
+	mocks.Must(t, "failed to audit remote jobs", mocks.WithTmpDB(func(_ string) {
+		s, err := server.New(server.Config{})
+		mocks.Must(t, "failed to create grpc server", err)
+		defer s.Shutdown()
+
+		go func() {
+			s.Listen("localhost:9715")
+		}()
+		time.Sleep(10 * time.Millisecond)
+
+		client, err := grpc.Dial("localhost:9715", grpc.WithInsecure())
+		mocks.Must(t, "could not create grpc client", err)
+		defer client.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		token, err := agenttokens.Issue("builder", "admin")
+		mocks.Must(t, "could not issue agent token", err)
+
+		cmdClient := api.NewCommandPipelineClient(client)
+		pipeline, err := cmdClient.RegisterAgent(ctx, &api.AgentConfiguration{
+			AgentID: "builder/audited-agent",
+			Token:   token,
+			Labels:  map[string]string{"region": "eu"},
+			Commands: map[string]*api.RemoteCommand{
+				"audited-echo": {AuthStrategy: "any", ChannelStrategy: "any", Timeout: 10},
+			},
+		})
+		mocks.Must(t, "could not register agent", err)
+		time.Sleep(20 * time.Millisecond)
+
+		cmd, ok := commands.Find(&meeseeks.Request{Command: "audited-echo"})
+		mocks.AssertEquals(t, true, ok)
+
+		errs := make(chan error, 1)
+		go func() {
+			_, err := cmd.Execute(ctx, meeseeks.Job{ID: 401, Request: meeseeks.Request{
+				Command: "audited-echo", Username: "someone"}})
+			errs <- err
+		}()
+		req, err := pipeline.Recv()
+		mocks.Must(t, "agent did not get the job", err)
+		_, err = cmdClient.Finish(metadata.AppendToOutgoingContext(ctx, api.TokenMetadataKey, token),
+			&api.CommandFinish{AgentID: "builder/audited-agent", JobID: req.JobID})
+		mocks.Must(t, "could not finish job", err)
+		mocks.Must(t, "job failed", <-errs)
+
+		entries, err := persistence.Audit().Find(meeseeks.AuditFilter{Limit: 10})
+		mocks.Must(t, "could not find audit entries", err)
+		mocks.AssertEquals(t, 1, len(entries))
+		mocks.AssertEquals(t, meeseeks.AuditDispatched, entries[0].Decision)
+		mocks.AssertEquals(t, uint64(401), entries[0].JobID)
+		mocks.AssertEquals(t, "someone", entries[0].Request.Username)
+		mocks.AssertEquals(t, "builder/audited-agent", entries[0].Agent.ID)
+		mocks.AssertEquals(t, "builder", entries[0].Agent.Token)
+		mocks.AssertEquals(t, "eu", entries[0].Agent.Labels["region"])
+	}))
+}
+
+func TestCancelledJobsAreCancelledInTheAgent(t *testing.T) {
+	mocks.Must(t, "failed to cancel remote jobs", mocks.WithTmpDB(func(_ string) {
+		s, err := server.New(server.Config{})
+		mocks.Must(t, "failed to create grpc server", err)
+		defer s.Shutdown()
+
+		go func() {
+			s.Listen("localhost:9722")
+		}()
+		time.Sleep(10 * time.Millisecond)
+
+		client, err := grpc.Dial("localhost:9722", grpc.WithInsecure())
+		mocks.Must(t, "could not create grpc client", err)
+		defer client.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		cmdClient := api.NewCommandPipelineClient(client)
+		pipeline, err := cmdClient.RegisterAgent(ctx, &api.AgentConfiguration{
+			AgentID: "cancelled-agent",
+			Commands: map[string]*api.RemoteCommand{
+				"cancelled-echo": {AuthStrategy: "any", ChannelStrategy: "any", Timeout: 10},
+			},
+		})
+		mocks.Must(t, "could not register agent", err)
+		time.Sleep(20 * time.Millisecond)
+
+		cmd, ok := commands.Find(&meeseeks.Request{Command: "cancelled-echo"})
+		mocks.AssertEquals(t, true, ok)
+
+		jobCtx, cancelJob := context.WithCancel(ctx)
+		errs := make(chan error, 1)
+		go func() {
+			_, err := cmd.Execute(jobCtx, meeseeks.Job{ID: 402, Request: meeseeks.Request{
+				Command: "cancelled-echo", Username: "someone"}})
+			errs <- err
+		}()
+		req, err := pipeline.Recv()
+		mocks.Must(t, "agent did not get the job", err)
+		mocks.AssertEquals(t, false, req.GetCancel())
+
+		cancelJob()
+		mocks.AssertEquals(t, "command failed because of context done: context canceled", fmt.Sprint(<-errs))
+
+		req, err = pipeline.Recv()
+		mocks.Must(t, "agent did not get the cancel", err)
+		mocks.AssertEquals(t, uint64(402), req.GetJobID())
+		mocks.AssertEquals(t, true, req.GetCancel())
+
+		// The job is no longer running in the agent, its finish is rejected
+		_, err = cmdClient.Finish(ctx, &api.CommandFinish{AgentID: "cancelled-agent", JobID: 402})
+		mocks.AssertEquals(t, codes.PermissionDenied, status.Code(err))
+	}))
+}
+
+func TestAgentsUpdateTheirCommandsWithoutRegisteringAgain(t *testing.T) {
+	mocks.Must(t, "failed to update the commands", mocks.WithTmpDB(func(_ string) {
+		s, err := server.New(server.Config{})
+		mocks.Must(t, "failed to create grpc server", err)
+		defer s.Shutdown()
+
+		go func() {
+			s.Listen("localhost:9716")
+		}()
+		time.Sleep(10 * time.Millisecond)
+
+		client, err := grpc.Dial("localhost:9716", grpc.WithInsecure())
+		mocks.Must(t, "could not create grpc client", err)
+		defer client.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		cmdClient := api.NewCommandPipelineClient(client)
+		for agentID, cmds := range map[string][]string{
+			"updating-agent": {"update-kept", "update-dropped"},
+			"other-agent":    {"update-shared"},
+		} {
+			registered := map[string]*api.RemoteCommand{}
+			for _, name := range cmds {
+				registered[name] = &api.RemoteCommand{AuthStrategy: "any", ChannelStrategy: "any", Timeout: 10}
+			}
+			_, err := cmdClient.RegisterAgent(ctx, &api.AgentConfiguration{AgentID: agentID, Commands: registered})
+			mocks.Must(t, "could not register agent", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+
+		timeoutOf := func(command string) time.Duration {
+			cmd, ok := commands.Find(&meeseeks.Request{Command: command})
+			if !ok {
+				return 0
+			}
+			return cmd.GetTimeout()
+		}
+
+		_, err = cmdClient.UpdateCommands(ctx, &api.AgentCommands{
+			AgentID: "updating-agent",
+			Commands: map[string]*api.RemoteCommand{
+				"update-kept":  {AuthStrategy: "any", ChannelStrategy: "any", Timeout: 20},
+				"update-added": {AuthStrategy: "any", ChannelStrategy: "any", Timeout: 10},
+			},
+		})
+		mocks.Must(t, "could not update the commands", err)
+		mocks.AssertEquals(t, 20*time.Second, timeoutOf("update-kept"))
+		mocks.AssertEquals(t, 10*time.Second, timeoutOf("update-added"))
+		mocks.AssertEquals(t, time.Duration(0), timeoutOf("update-dropped"))
+		for _, a := range registry.List() {
+			if a.ID == "updating-agent" {
+				mocks.AssertEquals(t, []string{"update-added", "update-kept"}, a.Commands)
+			}
+		}
+
+		server.ConfigureConflicts(server.Conflicts{Policy: server.ConflictReject})
+		defer server.ConfigureConflicts(server.Conflicts{})
+		_, err = cmdClient.UpdateCommands(ctx, &api.AgentCommands{
+			AgentID: "updating-agent",
+			Commands: map[string]*api.RemoteCommand{
+				"update-shared": {AuthStrategy: "none", ChannelStrategy: "any", Timeout: 10},
+			},
+		})
+		mocks.AssertEquals(t, codes.AlreadyExists, status.Code(err))
+		mocks.AssertEquals(t, 20*time.Second, timeoutOf("update-kept"))
+		mocks.AssertEquals(t, 10*time.Second, timeoutOf("update-added"))
+
+		_, err = cmdClient.UpdateCommands(ctx, &api.AgentCommands{AgentID: "unknown-agent"})
+		mocks.AssertEquals(t, codes.PermissionDenied, status.Code(err))
+		mocks.AssertEquals(t, "agent unknown-agent is not registered", status.Convert(err).Message())
+	}))
+}
+
+func TestAgentsOnlyWriteTheJobsDispatchedToThem(t *testing.T) {
+	mocks.Must(t, "failed to write jobs", mocks.WithTmpDB(func(_ string) {
+		s, err := server.New(server.Config{})
+		mocks.Must(t, "failed to create grpc server", err)
+		defer s.Shutdown()
+
+		go func() {
+			s.Listen("localhost:9717")
+		}()
+		time.Sleep(10 * time.Millisecond)
+
+		client, err := grpc.Dial("localhost:9717", grpc.WithInsecure())
+		mocks.Must(t, "could not create grpc client", err)
+		defer client.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		cmdClient := api.NewCommandPipelineClient(client)
+		logClient := api.NewLogWriterClient(client)
+		pipeline, err := cmdClient.RegisterAgent(ctx, &api.AgentConfiguration{
+			AgentID: "writing-agent",
+			Commands: map[string]*api.RemoteCommand{
+				"write": {AuthStrategy: "any", ChannelStrategy: "any", Timeout: 10},
+			},
+		})
+		mocks.Must(t, "could not register agent", err)
+		_, err = cmdClient.RegisterAgent(ctx, &api.AgentConfiguration{
+			AgentID: "intruder-agent",
+			Commands: map[string]*api.RemoteCommand{
+				"intrude": {AuthStrategy: "any", ChannelStrategy: "any", Timeout: 10},
+			},
+		})
+		mocks.Must(t, "could not register agent", err)
+		time.Sleep(20 * time.Millisecond)
+
+		appendAs := func(agentID string, jobID uint64, line string) error {
+			appender, err := logClient.Append(metadata.AppendToOutgoingContext(ctx, api.AgentIDMetadataKey, agentID))
+			if err != nil {
+				return err
+			}
+			appender.Send(&api.LogEntry{JobID: jobID, Line: line})
+			_, err = appender.CloseAndRecv()
+			return err
+		}
+
+		intruded := make(chan []error, 1)
+		go func() {
+			req, err := pipeline.Recv()
+			if err != nil {
+				return
+			}
+			_, setErr := logClient.SetError(metadata.AppendToOutgoingContext(ctx, api.AgentIDMetadataKey, "intruder-agent"),
+				&api.ErrorLogEntry{JobID: req.JobID, Error: "failed, trust me"})
+			_, finishErr := cmdClient.Finish(ctx, &api.CommandFinish{AgentID: "intruder-agent", JobID: req.JobID, Content: "failed"})
+			intruded <- []error{appendAs("intruder-agent", req.JobID, "deployed nothing"), setErr, finishErr}
+
+			mocks.Must(t, "could not append log", appendAs("writing-agent", req.JobID, "written"))
+			cmdClient.Finish(ctx, &api.CommandFinish{AgentID: "writing-agent", JobID: req.JobID, Content: "written"})
+		}()
+
+		cmd, ok := commands.Find(&meeseeks.Request{Command: "write"})
+		mocks.AssertEquals(t, true, ok)
+
+		out, err := cmd.Execute(ctx, meeseeks.Job{ID: 402, Request: meeseeks.Request{Command: "write"}})
+		mocks.Must(t, "write job failed", err)
+		mocks.AssertEquals(t, "written", out)
+
+		for _, err := range <-intruded {
+			mocks.AssertEquals(t, codes.PermissionDenied, status.Code(err))
+			mocks.AssertEquals(t, "job 402 was not dispatched to agent intruder-agent", status.Convert(err).Message())
+		}
+		log, err := persistence.LogReader().Get(402)
+		mocks.Must(t, "could not read the log of the job", err)
+		mocks.AssertEquals(t, "written", log.Output)
+		mocks.AssertEquals(t, "", log.Error)
+	}))
+}
+
+func TestAgentsFinishTheJobsOfAServerThatRestarted(t *testing.T) {
+	mocks.Must(t, "failed to finish jobs", mocks.WithTmpDB(func(_ string) {
+		s, err := server.New(server.Config{})
+		mocks.Must(t, "failed to create grpc server", err)
+		defer s.Shutdown()
+
+		go func() {
+			s.Listen("localhost:9720")
+		}()
+		time.Sleep(10 * time.Millisecond)
+
+		client, err := grpc.Dial("localhost:9720", grpc.WithInsecure())
+		mocks.Must(t, "could not create grpc client", err)
+		defer client.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		cmdClient := api.NewCommandPipelineClient(client)
+		for agentID, command := range map[string]string{"returning-agent": "resumed", "intruder-agent": "intrude"} {
+			_, err = cmdClient.RegisterAgent(ctx, &api.AgentConfiguration{
+				AgentID: agentID,
+				Commands: map[string]*api.RemoteCommand{
+					command: {AuthStrategy: "any", ChannelStrategy: "any", Timeout: 10},
+				},
+			})
+			mocks.Must(t, "could not register agent", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+
+		// The server that dispatched the job is gone, the job is still running
+		job, err := persistence.Jobs().Create(meeseeks.Request{Command: "resumed", Username: "someone"})
+		mocks.Must(t, "could not create job", err)
+		_, err = persistence.Audit().Record(meeseeks.AuditEntry{
+			JobID:    job.ID,
+			Decision: meeseeks.AuditDispatched,
+			Agent:    &meeseeks.AuditAgent{ID: "returning-agent"},
+			Request:  job.Request,
+		})
+		mocks.Must(t, "could not record dispatch", err)
+
+		_, err = cmdClient.Finish(ctx, &api.CommandFinish{AgentID: "intruder-agent", JobID: job.ID})
+		mocks.AssertEquals(t, codes.PermissionDenied, status.Code(err))
+		mocks.AssertEquals(t, fmt.Sprintf("job %d was not dispatched to agent intruder-agent", job.ID), status.Convert(err).Message())
+
+		appender, err := api.NewLogWriterClient(client).Append(
+			metadata.AppendToOutgoingContext(ctx, api.AgentIDMetadataKey, "returning-agent"))
+		mocks.Must(t, "could not create log appender", err)
+		mocks.Must(t, "could not send log line", appender.Send(&api.LogEntry{JobID: job.ID, Line: "replayed"}))
+		_, err = appender.CloseAndRecv()
+		mocks.Must(t, "the replayed line was rejected", err)
+
+		_, err = cmdClient.Finish(ctx, &api.CommandFinish{AgentID: "returning-agent", JobID: job.ID, Error: "it broke"})
+		mocks.Must(t, "the replayed finish was rejected", err)
+
+		finished, err := persistence.Jobs().Get(job.ID)
+		mocks.Must(t, "could not get job", err)
+		mocks.AssertEquals(t, meeseeks.JobFailedStatus, finished.Status)
+		log, err := persistence.LogReader().Get(job.ID)
+		mocks.Must(t, "could not read the log of the job", err)
+		mocks.AssertEquals(t, "replayed", log.Output)
+		mocks.AssertEquals(t, "it broke", log.Error)
+
+		_, err = cmdClient.Finish(ctx, &api.CommandFinish{AgentID: "returning-agent", JobID: job.ID})
+		mocks.AssertEquals(t, codes.PermissionDenied, status.Code(err))
+		mocks.AssertEquals(t, fmt.Sprintf("job %d is not running", job.ID), status.Convert(err).Message())
+	}))
+}
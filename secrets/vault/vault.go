@@ -0,0 +1,372 @@
+package vault
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Prefix marks the values that are references to a secret in Vault
+const Prefix = "vault:"
+
+// Ways to log in to Vault
+const (
+	AuthToken      = "token"
+	AuthKubernetes = "kubernetes"
+)
+
+// DefaultKubernetesMount is where the kubernetes auth method is mounted when
+// no mount is configured
+const DefaultKubernetesMount = "kubernetes"
+
+// DefaultServiceAccountTokenFile is where kubernetes mounts the token of the
+// service account of the pod
+const DefaultServiceAccountTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// How long a call to Vault can take
+const requestTimeout = 10 * time.Second
+
+// How often the token and the leases are checked for renewal
+var renewCheckInterval = 10 * time.Second
+
+// Config holds how to reach and log in to Vault
+//
+// With the token auth the token is read from TokenFile, or the VAULT_TOKEN
+// environment variable, while the kubernetes auth logs in with the Role and
+// the token of the service account of the pod
+type Config struct {
+	Address                 string `yaml:"address"`
+	Namespace               string `yaml:"namespace"`
+	Auth                    string `yaml:"auth"`
+	TokenFile               string `yaml:"token_file"`
+	Role                    string `yaml:"role"`
+	Mount                   string `yaml:"mount"`
+	ServiceAccountTokenFile string `yaml:"service_account_token_file"`
+}
+
+// Enabled returns true if Vault is configured
+func (c Config) Enabled() bool {
+	return c.Address != ""
+}
+
+// Validate checks that the configuration is usable
+func (c Config) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	u, err := url.Parse(c.Address)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid vault address %s, it has to be an http or https url", c.Address)
+	}
+	switch c.Auth {
+	case "", AuthToken:
+	case AuthKubernetes:
+		if c.Role == "" {
+			return fmt.Errorf("vault kubernetes auth requires a role")
+		}
+	default:
+		return fmt.Errorf("invalid vault auth %s, valid auths are %s and %s", c.Auth, AuthToken, AuthKubernetes)
+	}
+	return nil
+}
+
+// IsReference returns true if the value points to a secret in Vault
+func IsReference(value string) bool {
+	return strings.HasPrefix(value, Prefix)
+}
+
+// lease is something that expires unless it's renewed, it's renewed when
+// half of its duration is gone
+type lease struct {
+	renewAt time.Time
+}
+
+func newLease(seconds int, now time.Time) lease {
+	return lease{renewAt: now.Add(time.Duration(seconds) * time.Second / 2)}
+}
+
+var config Config
+var token string
+var tokenLease *lease
+var leases = map[string]lease{}
+var mutex sync.Mutex
+
+// Configure logs in to Vault, unless it's already logged in with the same
+// configuration, so reloads keep the token and the leases
+func Configure(cnf Config) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if reflect.DeepEqual(cnf, config) && (token != "" || !cnf.Enabled()) {
+		return nil
+	}
+
+	config, token, tokenLease, leases = Config{}, "", nil, map[string]lease{}
+	if !cnf.Enabled() {
+		return nil
+	}
+	t, l, err := login(cnf, time.Now())
+	if err != nil {
+		return err
+	}
+	config, token, tokenLease = cnf, t, l
+	return nil
+}
+
+// Resolve returns the value of the secret the value points to, values that
+// are not references are returned as they are. A reference is like
+// vault:secret/data/meeseeks#slack_token, the path of the secret and the
+// field to take from it. The leases of dynamic secrets are renewed
+func Resolve(value string) (string, error) {
+	if !IsReference(value) {
+		return value, nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(value, Prefix), "#", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", fmt.Errorf("invalid vault reference %s, it has to be like vault:path#field", value)
+	}
+	path, field := strings.Trim(parts[0], "/"), parts[1]
+
+	mutex.Lock()
+	cnf, t := config, token
+	mutex.Unlock()
+	if !cnf.Enabled() {
+		return "", fmt.Errorf("vault is not configured, can't resolve %s", value)
+	}
+
+	secret := struct {
+		LeaseID       string                 `json:"lease_id"`
+		LeaseDuration int                    `json:"lease_duration"`
+		Renewable     bool                   `json:"renewable"`
+		Data          map[string]interface{} `json:"data"`
+	}{}
+	if err := call(cnf, http.MethodGet, path, t, nil, &secret); err != nil {
+		return "", fmt.Errorf("could not read secret %s: %s", path, err)
+	}
+
+	data := secret.Data
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok { // KV version 2 nests the secret
+			data = inner
+		}
+	}
+	v, ok := data[field]
+	if !ok {
+		return "", fmt.Errorf("secret %s has no field %s", path, field)
+	}
+
+	if secret.LeaseID != "" && secret.Renewable {
+		mutex.Lock()
+		leases[secret.LeaseID] = newLease(secret.LeaseDuration, time.Now())
+		mutex.Unlock()
+	}
+
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	return fmt.Sprint(v), nil
+}
+
+// Renew renews the token and the leases that are past half of their
+// duration. When the token can't be renewed it logs in again, and leases that
+// can't be renewed are dropped as they will expire anyway
+func Renew(now time.Time) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if !config.Enabled() {
+		return nil
+	}
+
+	var err error
+	if tokenLease != nil && !now.Before(tokenLease.renewAt) {
+		auth := struct {
+			Auth struct {
+				LeaseDuration int `json:"lease_duration"`
+			} `json:"auth"`
+		}{}
+		if renewErr := call(config, http.MethodPost, "auth/token/renew-self", token, nil, &auth); renewErr == nil {
+			tokenLease = tokenLeaseOf(auth.Auth.LeaseDuration, true, now)
+		} else if t, l, loginErr := login(config, now); loginErr == nil {
+			logrus.Infof("Could not renew the vault token, logged in again: %s", renewErr)
+			token, tokenLease = t, l
+		} else {
+			err = fmt.Errorf("could not renew the vault token: %s", renewErr)
+		}
+	}
+
+	for id, l := range leases {
+		if now.Before(l.renewAt) {
+			continue
+		}
+		renewed := struct {
+			LeaseDuration int  `json:"lease_duration"`
+			Renewable     bool `json:"renewable"`
+		}{}
+		if renewErr := call(config, http.MethodPut, "sys/leases/renew", token,
+			map[string]string{"lease_id": id}, &renewed); renewErr != nil {
+			logrus.Warnf("Could not renew vault lease %s, dropping it: %s", id, renewErr)
+			delete(leases, id)
+			continue
+		}
+		if !renewed.Renewable {
+			delete(leases, id)
+			continue
+		}
+		leases[id] = newLease(renewed.LeaseDuration, now)
+	}
+	return err
+}
+
+// Start renews the token and the leases in the background until the returned
+// function is called, it does nothing when Vault is not configured
+func Start() func() {
+	mutex.Lock()
+	enabled := config.Enabled()
+	mutex.Unlock()
+
+	if !enabled {
+		return func() {}
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(renewCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-ticker.C:
+				if err := Renew(now); err != nil {
+					logrus.Errorf("Failed to renew vault token: %s", err)
+				}
+			}
+		}
+	}()
+
+	return func() { close(stop) }
+}
+
+// login gets a token with the configured auth, along with its lease when it
+// expires
+func login(cnf Config, now time.Time) (string, *lease, error) {
+	if cnf.Auth == AuthKubernetes {
+		jwtFile := cnf.ServiceAccountTokenFile
+		if jwtFile == "" {
+			jwtFile = DefaultServiceAccountTokenFile
+		}
+		jwt, err := ioutil.ReadFile(jwtFile)
+		if err != nil {
+			return "", nil, fmt.Errorf("could not read service account token: %s", err)
+		}
+		mount := cnf.Mount
+		if mount == "" {
+			mount = DefaultKubernetesMount
+		}
+
+		auth := struct {
+			Auth struct {
+				ClientToken   string `json:"client_token"`
+				LeaseDuration int    `json:"lease_duration"`
+				Renewable     bool   `json:"renewable"`
+			} `json:"auth"`
+		}{}
+		if err := call(cnf, http.MethodPost, fmt.Sprintf("auth/%s/login", strings.Trim(mount, "/")), "",
+			map[string]string{"role": cnf.Role, "jwt": strings.TrimSpace(string(jwt))}, &auth); err != nil {
+			return "", nil, fmt.Errorf("could not log in to vault: %s", err)
+		}
+		if auth.Auth.ClientToken == "" {
+			return "", nil, fmt.Errorf("could not log in to vault: no token was returned")
+		}
+		return auth.Auth.ClientToken, tokenLeaseOf(auth.Auth.LeaseDuration, auth.Auth.Renewable, now), nil
+	}
+
+	t := os.Getenv("VAULT_TOKEN")
+	if cnf.TokenFile != "" {
+		b, err := ioutil.ReadFile(cnf.TokenFile)
+		if err != nil {
+			return "", nil, fmt.Errorf("could not read vault token: %s", err)
+		}
+		t = strings.TrimSpace(string(b))
+	}
+	if t == "" {
+		return "", nil, fmt.Errorf("there is no vault token, set token_file or VAULT_TOKEN")
+	}
+
+	self := struct {
+		Data struct {
+			TTL       int  `json:"ttl"`
+			Renewable bool `json:"renewable"`
+		} `json:"data"`
+	}{}
+	if err := call(cnf, http.MethodGet, "auth/token/lookup-self", t, nil, &self); err != nil {
+		return "", nil, fmt.Errorf("could not look up vault token: %s", err)
+	}
+	return t, tokenLeaseOf(self.Data.TTL, self.Data.Renewable, now), nil
+}
+
+// tokenLeaseOf returns the lease of a token, nil if it never expires or
+// can't be renewed
+func tokenLeaseOf(seconds int, renewable bool, now time.Time) *lease {
+	if seconds <= 0 || !renewable {
+		return nil
+	}
+	l := newLease(seconds, now)
+	return &l
+}
+
+// call sends a request to the API of Vault and decodes the response into v
+func call(cnf Config, method, path, t string, body interface{}, v interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, strings.TrimSuffix(cnf.Address, "/")+"/v1/"+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	if t != "" {
+		req.Header.Set("X-Vault-Token", t)
+	}
+	if cnf.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", cnf.Namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	client := http.Client{Timeout: requestTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		failure := struct {
+			Errors []string `json:"errors"`
+		}{}
+		json.NewDecoder(resp.Body).Decode(&failure)
+		if len(failure.Errors) > 0 {
+			return fmt.Errorf("vault returned %s: %s", resp.Status, strings.Join(failure.Errors, ", "))
+		}
+		return fmt.Errorf("vault returned %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
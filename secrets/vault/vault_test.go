@@ -0,0 +1,174 @@
+package vault_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/mocks"
+	"gitlab.com/yakshaving.art/meeseeks-box/secrets/vault"
+)
+
+// fakeVault serves a KV version 2 secret, a dynamic database secret with a
+// lease, and the token and kubernetes auth endpoints
+type fakeVault struct {
+	sync.Mutex
+	calls []string
+}
+
+func (f *fakeVault) called(call string) {
+	f.Lock()
+	defer f.Unlock()
+	f.calls = append(f.calls, call)
+}
+
+func (f *fakeVault) server(t *testing.T) *httptest.Server {
+	authorized := func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Header.Get("X-Vault-Token") != "s.meeseeks" {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string][]string{"errors": {"permission denied"}})
+			return false
+		}
+		return true
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/auth/token/lookup-self", func(w http.ResponseWriter, r *http.Request) {
+		if authorized(w, r) {
+			f.called("lookup-self")
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"ttl": 60, "renewable": true}})
+		}
+	})
+	mux.HandleFunc("/v1/auth/token/renew-self", func(w http.ResponseWriter, r *http.Request) {
+		if authorized(w, r) {
+			f.called("renew-self")
+			json.NewEncoder(w).Encode(map[string]interface{}{"auth": map[string]interface{}{"lease_duration": 60}})
+		}
+	})
+	mux.HandleFunc("/v1/auth/k8s/login", func(w http.ResponseWriter, r *http.Request) {
+		body := map[string]string{}
+		json.NewDecoder(r.Body).Decode(&body)
+		mocks.AssertEquals(t, map[string]string{"role": "meeseeks", "jwt": "service-account-jwt"}, body)
+		f.called("kubernetes-login")
+		json.NewEncoder(w).Encode(map[string]interface{}{"auth": map[string]interface{}{
+			"client_token": "s.meeseeks", "lease_duration": 60, "renewable": true}})
+	})
+	mux.HandleFunc("/v1/secret/data/meeseeks", func(w http.ResponseWriter, r *http.Request) {
+		if authorized(w, r) {
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+				"data":     map[string]interface{}{"slack_token": "xoxb-secret"},
+				"metadata": map[string]interface{}{"version": 3},
+			}})
+		}
+	})
+	mux.HandleFunc("/v1/database/creds/meeseeks", func(w http.ResponseWriter, r *http.Request) {
+		if authorized(w, r) {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"lease_id": "database/creds/meeseeks/abcd", "lease_duration": 60, "renewable": true,
+				"data": map[string]interface{}{"username": "v-meeseeks", "password": "pass"},
+			})
+		}
+	})
+	mux.HandleFunc("/v1/sys/leases/renew", func(w http.ResponseWriter, r *http.Request) {
+		if authorized(w, r) {
+			body := map[string]string{}
+			json.NewDecoder(r.Body).Decode(&body)
+			f.called("renew " + body["lease_id"])
+			json.NewEncoder(w).Encode(map[string]interface{}{"lease_duration": 60, "renewable": true})
+		}
+	})
+	return httptest.NewServer(mux)
+}
+
+func withFile(t *testing.T, content string, f func(string)) {
+	dir, err := ioutil.TempDir("", "vault")
+	mocks.Must(t, "could not create tmp dir", err)
+	defer os.RemoveAll(dir)
+
+	file := path.Join(dir, "token")
+	mocks.Must(t, "could not write file", ioutil.WriteFile(file, []byte(content+"\n"), 0600))
+	f(file)
+}
+
+func TestResolvingSecrets(t *testing.T) {
+	fake := &fakeVault{}
+	server := fake.server(t)
+	defer server.Close()
+	defer vault.Configure(vault.Config{})
+
+	withFile(t, "s.meeseeks", func(tokenFile string) {
+		mocks.Must(t, "could not configure vault", vault.Configure(vault.Config{Address: server.URL, TokenFile: tokenFile}))
+	})
+
+	value, err := vault.Resolve("plain value")
+	mocks.Must(t, "could not resolve plain value", err)
+	mocks.AssertEquals(t, "plain value", value)
+
+	value, err = vault.Resolve("vault:secret/data/meeseeks#slack_token")
+	mocks.Must(t, "could not resolve kv secret", err)
+	mocks.AssertEquals(t, "xoxb-secret", value)
+
+	value, err = vault.Resolve("vault:database/creds/meeseeks#password")
+	mocks.Must(t, "could not resolve dynamic secret", err)
+	mocks.AssertEquals(t, "pass", value)
+
+	_, err = vault.Resolve("vault:secret/data/meeseeks#nothing")
+	mocks.AssertEquals(t, "secret secret/data/meeseeks has no field nothing", err.Error())
+	_, err = vault.Resolve("vault:secret/data/meeseeks")
+	mocks.AssertEquals(t, "invalid vault reference vault:secret/data/meeseeks, it has to be like vault:path#field", err.Error())
+	_, err = vault.Resolve("vault:secret/data/other#field")
+	mocks.AssertEquals(t, "could not read secret secret/data/other: vault returned 404 Not Found", err.Error())
+
+	// Nothing is renewed until half of the lease is gone
+	mocks.Must(t, "could not renew", vault.Renew(time.Now()))
+	mocks.Must(t, "could not renew", vault.Renew(time.Now().Add(time.Minute)))
+	mocks.AssertEquals(t, []string{"lookup-self", "renew-self", "renew database/creds/meeseeks/abcd"}, fake.calls)
+}
+
+func TestKubernetesAuth(t *testing.T) {
+	fake := &fakeVault{}
+	server := fake.server(t)
+	defer server.Close()
+	defer vault.Configure(vault.Config{})
+
+	withFile(t, "service-account-jwt", func(jwtFile string) {
+		cnf := vault.Config{Address: server.URL, Auth: vault.AuthKubernetes, Role: "meeseeks", Mount: "k8s",
+			ServiceAccountTokenFile: jwtFile}
+		mocks.Must(t, "invalid config", cnf.Validate())
+		mocks.Must(t, "could not configure vault", vault.Configure(cnf))
+
+		// Reloading the same configuration keeps the token
+		mocks.Must(t, "could not configure vault", vault.Configure(cnf))
+	})
+	mocks.AssertEquals(t, []string{"kubernetes-login"}, fake.calls)
+
+	value, err := vault.Resolve("vault:/secret/data/meeseeks#slack_token")
+	mocks.Must(t, "could not resolve kv secret", err)
+	mocks.AssertEquals(t, "xoxb-secret", value)
+}
+
+func TestInvalidConfig(t *testing.T) {
+	tt := []struct {
+		name     string
+		cnf      vault.Config
+		expected string
+	}{
+		{"invalid address", vault.Config{Address: "vault:8200"}, "invalid vault address vault:8200, it has to be an http or https url"},
+		{"invalid auth", vault.Config{Address: "https://vault:8200", Auth: "ldap"}, "invalid vault auth ldap, valid auths are token and kubernetes"},
+		{"kubernetes without role", vault.Config{Address: "https://vault:8200", Auth: "kubernetes"}, "vault kubernetes auth requires a role"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			mocks.AssertEquals(t, tc.expected, tc.cnf.Validate().Error())
+		})
+	}
+
+	_, err := vault.Resolve("vault:secret/data/meeseeks#slack_token")
+	mocks.AssertEquals(t, "vault is not configured, can't resolve vault:secret/data/meeseeks#slack_token", err.Error())
+}
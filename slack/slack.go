@@ -5,10 +5,12 @@ import (
 	"fmt"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"gitlab.com/yakshaving.art/meeseeks-box/auth"
 	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks/reports"
 	"gitlab.com/yakshaving.art/meeseeks-box/text/formatter"
 	"gitlab.com/yakshaving.art/meeseeks-box/text/parser"
 
@@ -21,6 +23,7 @@ var errNoCommandToRun = fmt.Errorf("no command to run")
 
 const (
 	textStyle     = "text"
+	reactionStyle = "reaction"
 	nullStyle     = "null"
 	nilStyle      = "nil"
 	disabledStyle = "disabled"
@@ -32,8 +35,9 @@ type Client struct {
 	// TODO: remove the rtm as it should only be inside the message matcher.
 	// It should simply be inside there and it should pop messages matched out
 	// through a channel
-	rtm     *slack.RTM
-	matcher messageMatcher
+	rtm      *slack.RTM
+	matcher  messageMatcher
+	replaced *replacedMessages
 }
 
 // ParseChannelLink implements the messenger.MessengerClient interface
@@ -94,9 +98,11 @@ func (c Client) getReplyStyle(style string) replyStyle {
 	case nullStyle, disabledStyle, nilStyle:
 		return nullReplyStyle{}
 	case textStyle:
-		return textReplyStyle{client: c.apiClient}
+		return textReplyStyle{client: c.apiClient, replaced: c.replaced}
+	case reactionStyle:
+		return reactionReplyStyle{client: c.apiClient, replaced: c.replaced}
 	default:
-		return attachmentReplyStyle{client: c.apiClient}
+		return attachmentReplyStyle{client: c.apiClient, replaced: c.replaced}
 	}
 }
 
@@ -136,6 +142,9 @@ func Connect(opts ConnectionOpts) (*Client, error) {
 		apiClient: slackClient,
 		rtm:       rtm,
 		matcher:   newMessageMatcher(rtm, opts.Stealth),
+		replaced: &replacedMessages{
+			timestamps: make(map[string]string),
+		},
 	}, nil
 }
 
@@ -157,7 +166,8 @@ func newMessageMatcher(rtm *slack.RTM, stealth bool) messageMatcher {
 func (m *messageMatcher) getUser(userID string) string {
 	u, err := m.rtm.GetUserInfo(userID)
 	if err != nil {
-		logrus.Errorf("could not find user with id %s because %s, weeeird", userID, err)
+		reports.Errorf(reports.ComponentSlack, reports.Tags{"user_id": userID},
+			"could not find user with id %s because %s, weeeird", userID, err)
 		return "unknown-user"
 	}
 	return u.Name
@@ -189,7 +199,8 @@ func (m *messageMatcher) getChannel(channelID string) string {
 
 	ch, err := m.rtm.GetChannelInfo(channelID)
 	if err != nil {
-		logrus.Errorf("could not find channel with id %s: %s", channelID, err)
+		reports.Errorf(reports.ComponentSlack, reports.Tags{"channel_id": channelID},
+			"could not find channel with id %s: %s", channelID, err)
 		return "unknown-channel"
 	}
 	return ch.Name
@@ -212,6 +223,11 @@ func (m *messageMatcher) Matches(msg *slack.MessageEvent) (message, error) {
 		channel := m.getChannel(msg.Channel)
 		isIM := m.isIMChannel(msg.Channel)
 
+		timestamp := msg.ThreadTimestamp
+		if timestamp == "" {
+			timestamp = msg.Timestamp
+		}
+
 		return message{
 			text:      text,
 			userID:    msg.User,
@@ -219,6 +235,7 @@ func (m *messageMatcher) Matches(msg *slack.MessageEvent) (message, error) {
 			username:  username,
 			channel:   channel,
 			isIM:      isIM,
+			timestamp: timestamp,
 		}, nil
 	}
 	return message{}, errIgnoredMessage
@@ -259,6 +276,7 @@ func (m *messageMatcher) shouldCare(message *slack.MessageEvent) (string, bool)
 // Listen listens to slack messages and sends the matching ones through the channel as requests
 func (c *Client) Listen(ch chan<- meeseeks.Request) {
 	logrus.Infof("Listening Slack RTM Messages")
+	defer reports.Recover(reports.ComponentSlack, reports.Tags{})
 
 	for msg := range c.rtm.IncomingEvents {
 		switch ev := msg.Data.(type) {
@@ -294,14 +312,55 @@ type replyStyle interface {
 	Reply(formatter.Reply)
 }
 
+// replacedMessages keeps the timestamps of the messages sent with a replace
+// key so later replies with the same key can update them
+type replacedMessages struct {
+	timestamps map[string]string
+	m          sync.Mutex
+}
+
+// postMessage posts the message, or updates the previous one when the reply
+// replaces it
+func (rm *replacedMessages) postMessage(client *slack.Client, r formatter.Reply, text string,
+	params slack.PostMessageParameters) error {
+	options := []slack.MsgOption{
+		slack.MsgOptionText(text, params.EscapeText),
+		slack.MsgOptionAttachments(params.Attachments...),
+		slack.MsgOptionPostMessageParameters(params),
+	}
+
+	key := r.ReplaceKey()
+	if key == "" {
+		_, _, _, err := client.SendMessage(r.ChannelID(), options...)
+		return err
+	}
+
+	rm.m.Lock()
+	defer rm.m.Unlock()
+
+	if timestamp, ok := rm.timestamps[key]; ok {
+		options = append(options, slack.MsgOptionUpdate(timestamp))
+	}
+	_, timestamp, _, err := client.SendMessage(r.ChannelID(), options...)
+	switch {
+	case r.IsFinal():
+		delete(rm.timestamps, key)
+	case err == nil:
+		rm.timestamps[key] = timestamp
+	}
+	return err
+}
+
 type attachmentReplyStyle struct {
-	client *slack.Client
+	client   *slack.Client
+	replaced *replacedMessages
 }
 
 func (a attachmentReplyStyle) Reply(r formatter.Reply) {
 	content, err := r.Render()
 	if err != nil {
-		logrus.Errorf("failed to render reply %#v: %s", r, err)
+		reports.Errorf(reports.ComponentSlack, reports.Tags{"channel_id": r.ChannelID()},
+			"failed to render reply %#v: %s", r, err)
 		return
 	}
 	color := r.Color()
@@ -317,33 +376,66 @@ func (a attachmentReplyStyle) Reply(r formatter.Reply) {
 				MarkdownIn: []string{"text"},
 			},
 		},
+		ThreadTimestamp: r.ThreadTimestamp(),
 	}
 	logrus.Debugf("Replying in Slack %s with %#v", r.ChannelID(), params)
-	if _, _, err = a.client.PostMessage(r.ChannelID(), "", params); err != nil {
-		logrus.Errorf("failed post attachment message %s on %s: %s", content, r.ChannelID(), err)
+	if err = a.replaced.postMessage(a.client, r, "", params); err != nil {
+		reports.Errorf(reports.ComponentSlack, reports.Tags{"channel_id": r.ChannelID()},
+			"failed post attachment message %s on %s: %s", content, r.ChannelID(), err)
 	}
 }
 
 type textReplyStyle struct {
-	client *slack.Client
+	client   *slack.Client
+	replaced *replacedMessages
 }
 
 func (t textReplyStyle) Reply(r formatter.Reply) {
 	content, err := r.Render()
 	if err != nil {
-		logrus.Errorf("failed to render reply %#v: %s", r, err)
+		reports.Errorf(reports.ComponentSlack, reports.Tags{"channel_id": r.ChannelID()},
+			"failed to render reply %#v: %s", r, err)
 		return
 	}
 
 	params := slack.PostMessageParameters{
-		AsUser:      true,
-		Markdown:    true,
-		UnfurlLinks: true,
-		UnfurlMedia: true,
+		AsUser:          true,
+		Markdown:        true,
+		UnfurlLinks:     true,
+		UnfurlMedia:     true,
+		ThreadTimestamp: r.ThreadTimestamp(),
 	}
 	logrus.Debugf("Replying in Slack %s with %#v and text: %s", r.ChannelID(), params, content)
-	if _, _, err = t.client.PostMessage(r.ChannelID(), content, params); err != nil {
-		logrus.Errorf("failed post message %s on %s: %s", content, r.ChannelID(), err)
+	if err = t.replaced.postMessage(t.client, r, content, params); err != nil {
+		reports.Errorf(reports.ComponentSlack, reports.Tags{"channel_id": r.ChannelID()},
+			"failed post message %s on %s: %s", content, r.ChannelID(), err)
+	}
+}
+
+// reactionReplyStyle reacts to the message of the request with an emoji and
+// only replies when the command failed, to keep frequent commands quiet
+type reactionReplyStyle struct {
+	client   *slack.Client
+	replaced *replacedMessages
+}
+
+func (s reactionReplyStyle) Reply(r formatter.Reply) {
+	attachment := attachmentReplyStyle{client: s.client, replaced: s.replaced}
+	if r.MessageTimestamp() == "" { // There is no message to react to, like with the API
+		attachment.Reply(r)
+		return
+	}
+
+	if reaction := r.Reaction(); reaction != "" {
+		logrus.Debugf("Reacting in Slack %s to %s with %s", r.ChannelID(), r.MessageTimestamp(), reaction)
+		err := s.client.AddReaction(reaction, slack.NewRefToMessage(r.ChannelID(), r.MessageTimestamp()))
+		if err != nil {
+			reports.Errorf(reports.ComponentSlack, reports.Tags{"channel_id": r.ChannelID()},
+				"failed to react with %s on %s: %s", reaction, r.ChannelID(), err)
+		}
+	}
+	if r.IsFailure() {
+		attachment.Reply(r)
 	}
 }
 
@@ -362,6 +454,7 @@ type message struct {
 	username  string
 	userID    string
 	isIM      bool
+	timestamp string
 }
 
 // GetText returns the message text
@@ -404,6 +497,11 @@ func (m message) IsIM() bool {
 	return m.isIM
 }
 
+// GetTimestamp returns the timestamp of the thread the message belongs to
+func (m message) GetTimestamp() string {
+	return m.timestamp
+}
+
 func requestFromMessage(msg meeseeks.Message) (meeseeks.Request, error) {
 	args, err := parser.Parse(msg.GetText())
 	logrus.Debugf("Command '%s' parsed as %#v", msg.GetText(), args)
@@ -426,5 +524,6 @@ func requestFromMessage(msg meeseeks.Message) (meeseeks.Request, error) {
 		ChannelID:   msg.GetChannelID(),
 		ChannelLink: msg.GetChannelLink(),
 		IsIM:        msg.IsIM(),
+		Timestamp:   msg.GetTimestamp(),
 	}, nil
 }
@@ -0,0 +1,111 @@
+package ansi
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The ways to handle the escape sequences of the output of a command
+const (
+	// Strip removes them, the default
+	Strip = "strip"
+	// Keep leaves the output as it is
+	Keep = "keep"
+	// Emphasis turns bold and colored text into bold and italic text into
+	// italic, and removes the rest
+	Emphasis = "emphasis"
+)
+
+var (
+	// Control sequences, like colors and cursor moves, operating system
+	// commands, like links, and the two character escapes
+	sequence = regexp.MustCompile("\x1b\\[[0-?]*[ -/]*[@-~]|\x1b\\][^\x07\x1b]*(\x07|\x1b\\\\)|\x1b[@-Z\\\\-_]")
+	graphics = regexp.MustCompile("^\x1b\\[([0-9;]*)m$")
+)
+
+// Validate checks that the mode is one of the known ones, empty is Strip
+func Validate(mode string) error {
+	switch mode {
+	case "", Strip, Keep, Emphasis:
+		return nil
+	}
+	return fmt.Errorf("invalid ansi mode %s, it should be %s, %s or %s", mode, Strip, Keep, Emphasis)
+}
+
+// Process handles the escape sequences of a line of output in the mode
+func Process(mode, line string) string {
+	if !strings.Contains(line, "\x1b") {
+		return line
+	}
+	switch mode {
+	case Keep:
+		return line
+	case Emphasis:
+		return emphasize(line)
+	default:
+		return sequence.ReplaceAllString(line, "")
+	}
+}
+
+// emphasize replaces the graphics sequences with the markup of the chat, and
+// closes what is still open at the end of the line
+func emphasize(line string) string {
+	bold, italic := false, false
+	b := strings.Builder{}
+	set := func(wantBold, wantItalic bool) {
+		// Italic is opened inside bold, so it's closed before it
+		if italic && (!wantItalic || bold != wantBold) {
+			b.WriteString("_")
+			italic = false
+		}
+		if bold != wantBold {
+			b.WriteString("*")
+			bold = wantBold
+		}
+		if wantItalic && !italic {
+			b.WriteString("_")
+			italic = true
+		}
+	}
+
+	last := 0
+	for _, loc := range sequence.FindAllStringIndex(line, -1) {
+		b.WriteString(line[last:loc[0]])
+		last = loc[1]
+
+		m := graphics.FindStringSubmatch(line[loc[0]:loc[1]])
+		if m == nil {
+			continue
+		}
+		wantBold, wantItalic := bold, italic
+		codes := strings.Split(m[1], ";")
+		for i := 0; i < len(codes); i++ {
+			code, _ := strconv.Atoi(codes[i]) // Empty is a reset
+			switch {
+			case code == 0:
+				wantBold, wantItalic = false, false
+			case code == 1, code >= 30 && code <= 37, code >= 90 && code <= 97:
+				wantBold = true
+			case code == 38, code == 48: // 256 colors or RGB, their values are skipped
+				wantBold = wantBold || code == 38
+				if i+1 < len(codes) && codes[i+1] == "5" {
+					i += 2
+				} else if i+1 < len(codes) && codes[i+1] == "2" {
+					i += 4
+				}
+			case code == 22, code == 39:
+				wantBold = false
+			case code == 3:
+				wantItalic = true
+			case code == 23:
+				wantItalic = false
+			}
+		}
+		set(wantBold, wantItalic)
+	}
+	b.WriteString(line[last:])
+	set(false, false)
+	return b.String()
+}
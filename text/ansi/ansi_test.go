@@ -0,0 +1,80 @@
+package ansi_test
+
+import (
+	"fmt"
+	"testing"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/mocks"
+	"gitlab.com/yakshaving.art/meeseeks-box/text/ansi"
+)
+
+func Test_ProcessingEscapeSequences(t *testing.T) {
+	tt := []struct {
+		name     string
+		mode     string
+		line     string
+		expected string
+	}{
+		{
+			name:     "plain line",
+			mode:     ansi.Emphasis,
+			line:     "no changes. Your infrastructure matches the configuration.",
+			expected: "no changes. Your infrastructure matches the configuration.",
+		},
+		{
+			name:     "colors are stripped by default",
+			mode:     "",
+			line:     "\x1b[0m\x1b[1m\x1b[32mApply complete!\x1b[0m Resources: 1 added",
+			expected: "Apply complete! Resources: 1 added",
+		},
+		{
+			name:     "cursor moves, links and 256 colors are stripped",
+			mode:     ansi.Strip,
+			line:     "\x1b[2K\x1b[1Gpod \x1b]8;;https://example.com\x07web-1\x1b]8;;\x07 is \x1b[38;5;196mdown\x1b[m",
+			expected: "pod web-1 is down",
+		},
+		{
+			name:     "kept as they are",
+			mode:     ansi.Keep,
+			line:     "\x1b[31merror\x1b[0m",
+			expected: "\x1b[31merror\x1b[0m",
+		},
+		{
+			name:     "colors are bold",
+			mode:     ansi.Emphasis,
+			line:     "\x1b[1m\x1b[32mApply complete!\x1b[0m Resources: 1 added",
+			expected: "*Apply complete!* Resources: 1 added",
+		},
+		{
+			name:     "italic inside bold",
+			mode:     ansi.Emphasis,
+			line:     "\x1b[31mError: \x1b[3mnot found\x1b[0m",
+			expected: "*Error: _not found_*",
+		},
+		{
+			name:     "closed at the end of the line",
+			mode:     ansi.Emphasis,
+			line:     "\x1b[38;2;255;0;0mwarning\x1b[2K",
+			expected: "*warning*",
+		},
+		{
+			name:     "background colors are stripped",
+			mode:     ansi.Emphasis,
+			line:     "\x1b[48;5;33mhighlighted\x1b[49m",
+			expected: "highlighted",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			mocks.AssertEquals(t, tc.expected, ansi.Process(tc.mode, tc.line))
+		})
+	}
+}
+
+func Test_ValidatingModes(t *testing.T) {
+	for _, mode := range []string{"", ansi.Strip, ansi.Keep, ansi.Emphasis} {
+		mocks.Must(t, "valid mode "+mode, ansi.Validate(mode))
+	}
+	mocks.AssertEquals(t, "invalid ansi mode colors, it should be strip, keep or emphasis",
+		fmt.Sprint(ansi.Validate("colors")))
+}
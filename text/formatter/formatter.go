@@ -1,7 +1,9 @@
 package formatter
 
 import (
+	"fmt"
 	"strings"
+	"time"
 
 	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
 	"gitlab.com/yakshaving.art/meeseeks-box/text/template"
@@ -17,6 +19,27 @@ const (
 	DefaultErrColorMessage     = "danger"
 )
 
+// DefaultLogsLink is the reference to the whole output appended to the
+// replies that have it truncated, along with the builtin command to read it
+const DefaultLogsLink = "The output was truncated, the whole of it is in `logs {{ .jobid }}`"
+
+// ArtifactsLine lists the artifacts of the job at the end of its reply
+const ArtifactsLine = "Artifacts: %s"
+
+// FallbackMessage is the reply sent when a template can't be rendered, with
+// the user link, the action, the command and the error
+const FallbackMessage = "%s the %s reply of %s could not be rendered: %s"
+
+// DefaultReactions are the emojis the reaction reply style adds to the
+// message of the request for each action, the progress has none
+var DefaultReactions = map[string]string{
+	template.Handshake:      "eyes",
+	template.Success:        "white_check_mark",
+	template.Failure:        "x",
+	template.Unauthorized:   "no_entry_sign",
+	template.UnknownCommand: "question",
+}
+
 // MessageColors contains the configured reply message colora
 type MessageColors struct {
 	Info    string `yaml:"info"`
@@ -25,29 +48,94 @@ type MessageColors struct {
 }
 
 // FormatConfig contains the formatting configurations
+//
+// Locale is the language of the default messages, like es or pt-BR, which
+// falls back to a more general one, and to English, for the messages that
+// are not translated. The messages that are set win over the default ones
+//
+// LogsLink is the template of the reference to the whole output that is
+// appended to the replies with a truncated output, rendered with the jobid.
+// It can point to the logs command or to a url
+//
+// Reactions are the emojis, without colons, that the reaction reply style
+// adds for each action instead of replying, they are merged with the default
+// ones, and an empty one adds no reaction
+//
+// Limits are the caps on the time and size of the execution of every
+// template, the ones that go over them reply with the fallback message
+//
+// Channels holds the formats of the channels, by name or ID, that override
+// the global ones for the replies sent to them
+//
+// Commands holds the templates, reply styles and colors of each command that
+// override the global ones and the ones of the channel, they are set with the
+// commands and not in the format section
 type FormatConfig struct {
+	Locale     string                   `yaml:"locale"`
+	Colors     MessageColors            `yaml:"colors"`
+	ReplyStyle map[string]string        `yaml:"reply_styles"`
+	Templates  map[string]string        `yaml:"templates"`
+	Messages   map[string][]string      `yaml:"messages"`
+	LogsLink   string                   `yaml:"logs_link"`
+	Reactions  map[string]string        `yaml:"reactions"`
+	Limits     template.Limits          `yaml:"limits"`
+	Channels   map[string]ChannelFormat `yaml:"channels"`
+	Commands   map[string]CommandFormat `yaml:"-"`
+}
+
+// ChannelFormat contains the locale, colors, reply styles, templates and
+// messages of a channel, the ones it doesn't set are the global ones
+type ChannelFormat struct {
+	Locale     string              `yaml:"locale"`
 	Colors     MessageColors       `yaml:"colors"`
 	ReplyStyle map[string]string   `yaml:"reply_styles"`
 	Templates  map[string]string   `yaml:"templates"`
 	Messages   map[string][]string `yaml:"messages"`
 }
 
+// CommandFormat contains the templates, reply styles and colors of a
+// command, and the language of its output, which is detected unless it's set
+type CommandFormat struct {
+	ReplyStyle map[string]string
+	Templates  map[string]string
+	Colors     MessageColors
+	Language   string
+}
+
 // Formatter keeps the colors and templates used to format a reply message
 type Formatter struct {
 	colors     MessageColors
 	templates  *template.TemplatesBuilder
 	replyStyle replyStyle
+	logsLink   template.Renderer
+	reactions  map[string]string
+	channels   map[string]ChannelFormat
+	commands   map[string]CommandFormat
 }
 
 var formatter *Formatter
 
 // Configure sets up the singleton formatter
 func Configure(cnf FormatConfig) {
-	builder := template.NewBuilder().WithMessages(cnf.Messages).WithTemplates(cnf.Templates)
+	template.SetLimits(cnf.Limits)
+
+	builder := template.NewBuilder().WithLocale(cnf.Locale).WithMessages(cnf.Messages).WithTemplates(cnf.Templates)
+	if cnf.LogsLink == "" {
+		cnf.LogsLink = DefaultLogsLink
+	}
+	logsLink, err := template.New("logs_link", cnf.LogsLink)
+	if err != nil {
+		logrus.Errorf("Could not parse the logs link, using the default one: %s", err)
+		logsLink, _ = template.New("logs_link", DefaultLogsLink)
+	}
 	formatter = &Formatter{
 		replyStyle: replyStyle{cnf.ReplyStyle},
 		colors:     cnf.Colors,
+		logsLink:   logsLink,
+		reactions:  reactions(cnf.Reactions),
 		templates:  builder,
+		channels:   cnf.Channels,
+		commands:   cnf.Commands,
 	}
 }
 
@@ -76,20 +164,82 @@ func SuccessReply(req meeseeks.Request) Reply {
 	return formatter.newReplier(template.Success, req)
 }
 
+// ProgressReply creates a reply to send partial output of a command that is still running
+func ProgressReply(req meeseeks.Request) Reply {
+	return formatter.newReplier(template.Progress, req)
+}
+
 func (f Formatter) newReplier(action string, req meeseeks.Request) Reply {
 	style := f.replyStyle.Get(action)
+	colors := f.colors
+	templates := f.templates.Clone()
+	language := LanguageAuto
+	if channel, ok := f.channelFormat(req); ok {
+		if s := (replyStyle{channel.ReplyStyle}).Get(action); s != "" {
+			style = s
+		}
+		colors = colors.override(channel.Colors)
+		templates.WithLocale(channel.Locale).WithMessages(channel.Messages).WithTemplates(channel.Templates)
+	}
+	if cmd, ok := f.commands[req.Command]; ok {
+		if s := (replyStyle{cmd.ReplyStyle}).Get(action); s != "" {
+			style = s
+		}
+		colors = colors.override(cmd.Colors)
+		templates.WithTemplates(cmd.Templates)
+		language = cmd.Language
+	}
 	logrus.Debugf("creating replier '%s' for action %s", style, action)
 
 	return Reply{
 		action:  action,
 		request: req,
 
-		templates: f.templates.Clone(),
+		templates: templates,
 		style:     style,
-		colors:    f.colors,
+		colors:    colors,
+		logsLink:  f.logsLink,
+		language:  language,
+		reaction:  f.reactions[action],
 	}
 }
 
+// reactions returns the default reactions with the configured ones
+func reactions(configured map[string]string) map[string]string {
+	all := make(map[string]string, len(DefaultReactions))
+	for action, reaction := range DefaultReactions {
+		all[action] = reaction
+	}
+	for action, reaction := range configured {
+		all[action] = strings.Trim(reaction, ":")
+	}
+	return all
+}
+
+// channelFormat returns the format of the channel of the request, by its name
+// or its ID
+func (f Formatter) channelFormat(req meeseeks.Request) (ChannelFormat, bool) {
+	if channel, ok := f.channels[req.Channel]; ok && req.Channel != "" {
+		return channel, true
+	}
+	channel, ok := f.channels[req.ChannelID]
+	return channel, ok && req.ChannelID != ""
+}
+
+// override returns the colors with the ones that are set in the others
+func (c MessageColors) override(others MessageColors) MessageColors {
+	if others.Info != "" {
+		c.Info = others.Info
+	}
+	if others.Success != "" {
+		c.Success = others.Success
+	}
+	if others.Error != "" {
+		c.Error = others.Error
+	}
+	return c
+}
+
 type replyStyle struct {
 	styles map[string]string
 }
@@ -100,7 +250,8 @@ func (r replyStyle) Get(mode string) string {
 		template.UnknownCommand,
 		template.Unauthorized,
 		template.Failure,
-		template.Success:
+		template.Success,
+		template.Progress:
 
 		if style, ok := r.styles[mode]; ok {
 			return style
@@ -115,10 +266,19 @@ type Reply struct {
 	request meeseeks.Request
 	output  string
 	err     error
+	thread  bool
+	replace string
+	final   bool
+	fullLog uint64
+
+	artifacts []string
 
 	colors    MessageColors
 	templates *template.TemplatesBuilder
 	style     string
+	logsLink  template.Renderer
+	language  string
+	reaction  string
 }
 
 // WithOutput stores the text payload to render in the reply
@@ -127,14 +287,69 @@ func (r Reply) WithOutput(output string) Reply {
 	return r
 }
 
+// WithTruncatedOutput stores the text payload to render in the reply, which
+// was truncated, along with the job the whole of it can be read from
+func (r Reply) WithTruncatedOutput(output string, jobID uint64) Reply {
+	r.output = output
+	r.fullLog = jobID
+	return r
+}
+
+// WithArtifacts stores the links to the artifacts of the job, they are
+// listed at the end of the reply
+func (r Reply) WithArtifacts(links []string) Reply {
+	r.artifacts = links
+	return r
+}
+
 // WithError stores an error to render
 func (r Reply) WithError(err error) Reply {
 	r.err = err
 	return r
 }
 
-// Render renders the message returning the rendered text, or an error if something goes wrong.
+// InThread flags the reply to be sent in the thread of the original message
+func (r Reply) InThread() Reply {
+	r.thread = true
+	return r
+}
+
+// Replacing flags the reply to replace the last one sent with the same key
+// instead of being sent as a new message, when the chat allows it
+func (r Reply) Replacing(key string) Reply {
+	r.replace = key
+	return r
+}
+
+// Final flags the reply as the last one replacing the message with its key
+func (r Reply) Final() Reply {
+	r.final = true
+	return r
+}
+
+// IsFinal returns true when no more replies will replace this one
+func (r Reply) IsFinal() bool {
+	return r.final
+}
+
+// ReplaceKey returns the key of the message this reply replaces, or empty
+// if it should be sent as a new message
+func (r Reply) ReplaceKey() string {
+	return r.replace
+}
+
+// Render renders the message returning the rendered text. When the template
+// fails, or goes over the limits, the reply is a fallback message instead
 func (r Reply) Render() (string, error) {
+	out, err := r.render()
+	if err != nil {
+		logrus.Errorf("could not render the %s reply of %s: %s", r.action, r.request.Command, err)
+		return fmt.Sprintf(FallbackMessage, r.request.UserLink, r.action, r.request.Command, err), nil
+	}
+	return out, nil
+}
+
+func (r Reply) render() (string, error) {
 	payload := make(map[string]interface{})
 	payload["command"] = r.request.Command
 	payload["args"] = strings.Join(r.request.Args, " ")
@@ -149,8 +364,30 @@ func (r Reply) Render() (string, error) {
 
 	payload["error"] = r.err
 	payload["output"] = r.output
+	payload["artifacts"] = r.artifacts
+	payload["language"] = outputLanguage(r.language, r.output)
+	payload["now"] = time.Now()
+
+	templates, err := r.templates.Build()
+	if err != nil {
+		return "", err
+	}
+	out, err := templates.Render(r.action, payload)
+	if err != nil {
+		return out, err
+	}
 
-	return r.templates.Build().Render(r.action, payload)
+	if r.fullLog != 0 {
+		link, err := r.logsLink.Render(map[string]interface{}{"jobid": r.fullLog})
+		if err != nil {
+			return "", err
+		}
+		out = strings.TrimSuffix(out, "\n") + "\n" + link
+	}
+	if len(r.artifacts) > 0 {
+		out = strings.TrimSuffix(out, "\n") + "\n" + fmt.Sprintf(ArtifactsLine, strings.Join(r.artifacts, " "))
+	}
+	return out, nil
 }
 
 // ChannelID returns the channel ID in which to reply
@@ -158,15 +395,46 @@ func (r Reply) ChannelID() string {
 	return r.request.ChannelID
 }
 
+// ThreadTimestamp returns the timestamp of the thread in which to reply, or empty
+// if the reply should go to the channel
+func (r Reply) ThreadTimestamp() string {
+	if r.thread {
+		return r.request.Timestamp
+	}
+	return ""
+}
+
 // ReplyStyle returns the style to use to reply
 func (r Reply) ReplyStyle() string {
 	return r.style
 }
 
+// Reaction returns the emoji to react with to the message of the request
+// instead of replying, or empty when there is none
+func (r Reply) Reaction() string {
+	return r.reaction
+}
+
+// MessageTimestamp returns the timestamp of the message of the request, to
+// react to it, it's empty when the request didn't come from a message
+func (r Reply) MessageTimestamp() string {
+	return r.request.Timestamp
+}
+
+// IsFailure returns true when the reply is about a command that failed or
+// could not run
+func (r Reply) IsFailure() bool {
+	switch r.action {
+	case template.UnknownCommand, template.Unauthorized, template.Failure:
+		return true
+	}
+	return false
+}
+
 // Color returns the color to use when decorating the reply
 func (r Reply) Color() string {
 	switch r.action {
-	case template.Handshake:
+	case template.Handshake, template.Progress:
 		return r.colors.Info
 	case template.UnknownCommand, template.Unauthorized, template.Failure:
 		return r.colors.Error
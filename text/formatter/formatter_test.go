@@ -2,6 +2,7 @@ package formatter_test
 
 import (
 	"errors"
+	"regexp"
 	"testing"
 
 	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
@@ -93,6 +94,12 @@ func TestFormatterTemplates(t *testing.T) {
 			expectedText:  "test unknown!",
 			expectedStyle: "attachment",
 			expectedColor: "red",
+		}, {
+			name:          template.Progress,
+			f:             formatter.ProgressReply,
+			expectedText:  "",
+			expectedStyle: "",
+			expectedColor: "blue",
 		},
 	}
 	for _, tc := range tt {
@@ -111,3 +118,364 @@ func TestFormatterTemplates(t *testing.T) {
 		})
 	}
 }
+
+func TestThreadedReplies(t *testing.T) {
+	formatter.Configure(formatter.FormatConfig{})
+
+	r := formatter.ProgressReply(meeseeks.Request{
+		Command:   "test",
+		ChannelID: "channel",
+		Timestamp: "1234.5678",
+	})
+	mocks.AssertEquals(t, "", r.ThreadTimestamp())
+	mocks.AssertEquals(t, "1234.5678", r.InThread().ThreadTimestamp())
+
+	s, err := r.WithOutput("some output").Render()
+	mocks.Must(t, "could not render progress reply", err)
+	mocks.AssertEquals(t, "```\nsome output```", s)
+}
+
+func TestChannelsOverrideTheFormat(t *testing.T) {
+	formatter.Configure(formatter.FormatConfig{
+		Colors: formatter.MessageColors{
+			Success: formatter.DefaultSuccessColorMessage,
+			Error:   formatter.DefaultErrColorMessage,
+		},
+		Templates: map[string]string{
+			template.Success: "{{ AnyValue \"success\" . }} {{ .command }}",
+		},
+		ReplyStyle: map[string]string{
+			template.Success: "attachment",
+		},
+		Messages: map[string][]string{
+			template.Success: {"Uuuuh, nice!"},
+		},
+		Channels: map[string]formatter.ChannelFormat{
+			"alerts": {
+				Colors: formatter.MessageColors{
+					Success: "#00ff00",
+				},
+				ReplyStyle: map[string]string{
+					template.Success: "text",
+				},
+				Messages: map[string][]string{
+					template.Success: {"ok"},
+				},
+			},
+			"C0OPS": {
+				Templates: map[string]string{
+					template.Success: "{{ .command }} done",
+				},
+			},
+		},
+		Commands: map[string]formatter.CommandFormat{
+			"deploy": {
+				ReplyStyle: map[string]string{
+					template.Success: "attachment",
+				},
+			},
+		},
+	})
+
+	tt := []struct {
+		name     string
+		req      meeseeks.Request
+		expected string
+		style    string
+		color    string
+	}{
+		{
+			name:     "global format",
+			req:      meeseeks.Request{Command: "echo", Channel: "general", ChannelID: "C0GENERAL"},
+			expected: "Uuuuh, nice! echo",
+			style:    "attachment",
+			color:    formatter.DefaultSuccessColorMessage,
+		},
+		{
+			name:     "channel by name",
+			req:      meeseeks.Request{Command: "echo", Channel: "alerts", ChannelID: "C0ALERTS"},
+			expected: "ok echo",
+			style:    "text",
+			color:    "#00ff00",
+		},
+		{
+			name:     "channel by ID",
+			req:      meeseeks.Request{Command: "echo", Channel: "ops", ChannelID: "C0OPS"},
+			expected: "echo done",
+			style:    "attachment",
+			color:    formatter.DefaultSuccessColorMessage,
+		},
+		{
+			name:     "command wins over the channel",
+			req:      meeseeks.Request{Command: "deploy", Channel: "alerts", ChannelID: "C0ALERTS"},
+			expected: "ok deploy",
+			style:    "attachment",
+			color:    "#00ff00",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			r := formatter.SuccessReply(tc.req)
+			s, err := r.Render()
+			mocks.Must(t, "could not render the reply", err)
+			mocks.AssertEquals(t, tc.expected, s)
+			mocks.AssertEquals(t, tc.style, r.ReplyStyle())
+			mocks.AssertEquals(t, tc.color, r.Color())
+		})
+	}
+
+	r := formatter.FailureReply(meeseeks.Request{Command: "echo", Channel: "alerts"}, errors.New("boom"))
+	mocks.AssertEquals(t, formatter.DefaultErrColorMessage, r.Color())
+}
+
+func TestChannelsReplyInTheirLocale(t *testing.T) {
+	formatter.Configure(formatter.FormatConfig{
+		Locale: "pt-BR",
+		Channels: map[string]formatter.ChannelFormat{
+			"soporte": {
+				Locale: "es",
+			},
+		},
+	})
+
+	s, err := formatter.FailureReply(meeseeks.Request{Channel: "general", UserLink: "<@alice>"},
+		errors.New("boom")).Render()
+	mocks.Must(t, "could not render the reply", err)
+	mocks.AssertEquals(t, "<@alice> Uuuh!, não, falhou :disappointed: boom", s)
+
+	s, err = formatter.FailureReply(meeseeks.Request{Channel: "soporte", UserLink: "<@alice>"},
+		errors.New("boom")).Render()
+	mocks.Must(t, "could not render the reply", err)
+	mocks.AssertEquals(t, "<@alice> ¡Uuuh!, no, falló :disappointed: boom", s)
+}
+
+func TestTruncatedOutputsLinkToTheLogs(t *testing.T) {
+	formatter.Configure(formatter.FormatConfig{
+		Templates: map[string]string{
+			template.Success: "{{ .output }}",
+		},
+		LogsLink: "Whole output at https://meeseeks.example.com/jobs/{{ .jobid }}/logs",
+	})
+
+	s, err := formatter.SuccessReply(meeseeks.Request{}).WithTruncatedOutput("head\n[...]\ntail\n", 42).Render()
+	mocks.Must(t, "could not render the reply", err)
+	mocks.AssertEquals(t, "head\n[...]\ntail\nWhole output at https://meeseeks.example.com/jobs/42/logs", s)
+
+	s, err = formatter.SuccessReply(meeseeks.Request{}).WithOutput("all of it\n").Render()
+	mocks.Must(t, "could not render the reply", err)
+	mocks.AssertEquals(t, "all of it\n", s)
+
+	s, err = formatter.SuccessReply(meeseeks.Request{}).WithTruncatedOutput("head\n[...]\ntail\n", 42).
+		WithArtifacts([]string{"report.html", "coverage.out"}).Render()
+	mocks.Must(t, "could not render the reply", err)
+	mocks.AssertEquals(t, "head\n[...]\ntail\nWhole output at https://meeseeks.example.com/jobs/42/logs\n"+
+		"Artifacts: report.html coverage.out", s)
+}
+
+func TestCommandsOverrideTheFormat(t *testing.T) {
+	formatter.Configure(formatter.FormatConfig{
+		Templates: map[string]string{
+			template.Success: "{{ .command }} success!",
+		},
+		ReplyStyle: map[string]string{
+			template.Success: "text",
+		},
+		Commands: map[string]formatter.CommandFormat{
+			"deploy": {
+				Templates: map[string]string{
+					template.Success: "{{ .command }} shipped it!",
+				},
+				ReplyStyle: map[string]string{
+					template.Success: "attachment",
+				},
+			},
+		},
+	})
+
+	r := formatter.SuccessReply(meeseeks.Request{Command: "deploy"})
+	s, err := r.Render()
+	mocks.Must(t, "could not render the reply of the command", err)
+	mocks.AssertEquals(t, "deploy shipped it!", s)
+	mocks.AssertEquals(t, "attachment", r.ReplyStyle())
+
+	r = formatter.SuccessReply(meeseeks.Request{Command: "echo"})
+	s, err = r.Render()
+	mocks.Must(t, "could not render the reply of another command", err)
+	mocks.AssertEquals(t, "echo success!", s)
+	mocks.AssertEquals(t, "text", r.ReplyStyle())
+}
+
+func TestCommandsOverrideTheColors(t *testing.T) {
+	formatter.Configure(formatter.FormatConfig{
+		Colors: formatter.MessageColors{
+			Info:    "#0000ff",
+			Success: formatter.DefaultSuccessColorMessage,
+			Error:   formatter.DefaultErrColorMessage,
+		},
+		Channels: map[string]formatter.ChannelFormat{
+			"alerts": {
+				Colors: formatter.MessageColors{
+					Success: "#00ff00",
+					Error:   "#ff00ff",
+				},
+			},
+		},
+		Commands: map[string]formatter.CommandFormat{
+			"deploy": {
+				Colors: formatter.MessageColors{
+					Success: "#800080",
+				},
+			},
+		},
+	})
+
+	req := meeseeks.Request{Command: "deploy", Channel: "alerts"}
+	mocks.AssertEquals(t, "#800080", formatter.SuccessReply(req).Color())
+	mocks.AssertEquals(t, "#ff00ff", formatter.FailureReply(req, errors.New("boom")).Color())
+	mocks.AssertEquals(t, "#0000ff", formatter.HandshakeReply(req).Color())
+
+	req = meeseeks.Request{Command: "echo", Channel: "alerts"}
+	mocks.AssertEquals(t, "#00ff00", formatter.SuccessReply(req).Color())
+}
+
+func TestTemplatesThatFailReplyWithTheFallback(t *testing.T) {
+	formatter.Configure(formatter.FormatConfig{
+		Templates: map[string]string{
+			template.Success: "{{ .output }}{{ .output }}",
+			template.Failure: "{{ index .missing 3 }}",
+		},
+		Limits: template.Limits{MaxBytes: 16},
+	})
+	defer formatter.Configure(formatter.FormatConfig{})
+
+	req := meeseeks.Request{Command: "deploy", UserLink: "<@U0ALICE>"}
+	s, err := formatter.SuccessReply(req).WithOutput("0123456789").Render()
+	mocks.Must(t, "the fallback should not fail", err)
+	mocks.AssertMatches(t, "^<@U0ALICE> the success reply of deploy could not be rendered: .*larger than 16 bytes$", s)
+
+	s, err = formatter.FailureReply(req, errors.New("boom")).Render()
+	mocks.Must(t, "the fallback should not fail", err)
+	mocks.AssertMatches(t, "^<@U0ALICE> the failure reply of deploy could not be rendered: .*index of untyped nil", s)
+
+	s, err = formatter.SuccessReply(req).WithOutput("0123").Render()
+	mocks.Must(t, "could not render the reply", err)
+	mocks.AssertEquals(t, "01230123", s)
+}
+
+func TestReactions(t *testing.T) {
+	formatter.Configure(formatter.FormatConfig{
+		Reactions: map[string]string{
+			template.Success:   ":rocket:",
+			template.Handshake: "",
+		},
+	})
+
+	req := meeseeks.Request{Command: "deploy", Timestamp: "1234.5678"}
+	tt := []struct {
+		name     string
+		reply    formatter.Reply
+		reaction string
+		failure  bool
+	}{
+		{
+			name:     "configured",
+			reply:    formatter.SuccessReply(req),
+			reaction: "rocket",
+		},
+		{
+			name:     "disabled",
+			reply:    formatter.HandshakeReply(req),
+			reaction: "",
+		},
+		{
+			name:     "default",
+			reply:    formatter.FailureReply(req, errors.New("boom")),
+			reaction: "x",
+			failure:  true,
+		},
+		{
+			name:     "unauthorized",
+			reply:    formatter.UnauthorizedCommandReply(req),
+			reaction: "no_entry_sign",
+			failure:  true,
+		},
+		{
+			name:     "progress",
+			reply:    formatter.ProgressReply(req),
+			reaction: "",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			mocks.AssertEquals(t, tc.reaction, tc.reply.Reaction())
+			mocks.AssertEquals(t, tc.failure, tc.reply.IsFailure())
+			mocks.AssertEquals(t, "1234.5678", tc.reply.MessageTimestamp())
+		})
+	}
+}
+
+func TestOutputsGetTheirLanguageInTheCodeFence(t *testing.T) {
+	formatter.Configure(formatter.FormatConfig{
+		Commands: map[string]formatter.CommandFormat{
+			"terraform": {Language: "hcl"},
+			"plain":     {Language: formatter.LanguageNone},
+		},
+	})
+
+	tt := []struct {
+		name     string
+		command  string
+		output   string
+		expected string
+	}{
+		{
+			name:     "json",
+			command:  "echo",
+			output:   `{"name": "rick", "age": 70}`,
+			expected: "json",
+		},
+		{
+			name:     "diff",
+			command:  "echo",
+			output:   "--- a/portal.go\n+++ b/portal.go\n@@ -1 +1 @@\n-open\n+close\n",
+			expected: "diff",
+		},
+		{
+			name:     "yaml",
+			command:  "echo",
+			output:   "name: rick\nitems:\n  - portal gun\n  - flask\n",
+			expected: "yaml",
+		},
+		{
+			name:     "plain text",
+			command:  "echo",
+			output:   "all done: 3 pods restarted\n",
+			expected: "",
+		},
+		{
+			name:     "markdown list",
+			command:  "echo",
+			output:   "- echo: \n- deploy: ships it\n",
+			expected: "",
+		},
+		{
+			name:     "set by the command",
+			command:  "terraform",
+			output:   `{"resource": "cluster"}`,
+			expected: "hcl",
+		},
+		{
+			name:     "disabled by the command",
+			command:  "plain",
+			output:   `{"resource": "cluster"}`,
+			expected: "",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := formatter.SuccessReply(meeseeks.Request{Command: tc.command, Username: "myself"}).WithOutput(tc.output).Render()
+			mocks.Must(t, "could not render the reply", err)
+			mocks.AssertMatches(t, "(?s)\n```"+tc.expected+"\n"+regexp.QuoteMeta(tc.output), s)
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package formatter
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// The languages of the output of a command besides the ones that are written
+// in the code fences as they are
+const (
+	// LanguageAuto detects the language from the output, the default
+	LanguageAuto = ""
+	// LanguageNone never sets a language
+	LanguageNone = "none"
+)
+
+var (
+	diffLine = regexp.MustCompile(`^(@@ -[0-9,]+ \+[0-9,]+ @@|diff --git |--- |\+\+\+ )`)
+	yamlLine = regexp.MustCompile(`^(---|\s*- |\s*[A-Za-z0-9_."'-]+:(\s|$)|\s*#)`)
+	yamlHead = regexp.MustCompile(`^(---|[A-Za-z0-9_."'-]+:(\s|$))`)
+)
+
+// outputLanguage returns the language of the code fence of the output, the
+// one of the command unless it's auto detected or disabled
+func outputLanguage(language, output string) string {
+	switch language {
+	case LanguageNone:
+		return ""
+	case LanguageAuto:
+		return detectLanguage(output)
+	}
+	return language
+}
+
+// detectLanguage tells apart the outputs that are JSON, a diff or YAML, so
+// the chat can highlight them, anything else has no language
+func detectLanguage(output string) string {
+	trimmed := strings.TrimSpace(output)
+	if trimmed == "" {
+		return ""
+	}
+
+	if strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[") {
+		if json.Valid([]byte(trimmed)) {
+			return "json"
+		}
+		return ""
+	}
+
+	lines := strings.Split(trimmed, "\n")
+	if diffLine.MatchString(lines[0]) {
+		return "diff"
+	}
+
+	// Most outputs are valid YAML as plain strings, and lists are usually
+	// markdown, so it has to start like a document or a map, every line has to
+	// look like YAML and it has to parse into a map or a list
+	if len(lines) < 2 || !yamlHead.MatchString(lines[0]) {
+		return ""
+	}
+	for _, line := range lines {
+		if strings.TrimSpace(line) != "" && !yamlLine.MatchString(line) && !strings.HasPrefix(line, " ") {
+			return ""
+		}
+	}
+	var parsed interface{}
+	if err := yaml.Unmarshal([]byte(trimmed), &parsed); err != nil {
+		return ""
+	}
+	switch parsed.(type) {
+	case map[interface{}]interface{}, []interface{}:
+		return "yaml"
+	}
+	return ""
+}
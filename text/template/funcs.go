@@ -0,0 +1,91 @@
+package template
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	tmpl "text/template"
+
+	humanize "github.com/dustin/go-humanize"
+)
+
+// builtinFuncs are the functions every template can use, they can't be
+// replaced
+var builtinFuncs = tmpl.FuncMap{
+	"AnyValue":       anyValue,
+	"Elapsed":        elapsed,
+	"HumanizeTime":   humanize.Time,
+	"HumanizeSize":   humanize.Bytes,
+	"HumanizeNumber": humanize.Ftoa,
+	"Join":           strings.Join,
+	"LocalTime":      localTime,
+	"LocalDuration":  localDuration,
+	"Table":          table,
+	"Row":            row,
+}
+
+var customFuncs = tmpl.FuncMap{}
+var funcsMutex sync.Mutex
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// RegisterFunc adds a function that templates can use, so embedders can
+// extend them. It has to be registered before the templates that use it are
+// built, like before the configuration is loaded, and it fails when the name
+// is already taken or the function can't be used by a template, which has to
+// return a single value or a value and an error
+func RegisterFunc(name string, fn interface{}) error {
+	if _, ok := builtinFuncs[name]; ok {
+		return fmt.Errorf("template function %s is a builtin one", name)
+	}
+	t := reflect.TypeOf(fn)
+	if t == nil || t.Kind() != reflect.Func {
+		return fmt.Errorf("template function %s is not a function", name)
+	}
+	switch {
+	case t.NumOut() == 1:
+	case t.NumOut() == 2 && t.Out(1) == errorType:
+	default:
+		return fmt.Errorf("template function %s has to return a single value or a value and an error", name)
+	}
+
+	funcsMutex.Lock()
+	defer funcsMutex.Unlock()
+
+	if _, ok := customFuncs[name]; ok {
+		return fmt.Errorf("template function %s is already registered", name)
+	}
+	if err := validFuncName(name); err != nil {
+		return err
+	}
+	customFuncs[name] = fn
+	return nil
+}
+
+// validFuncName checks that the name can be called from a template, it
+// recovers from the panic of text/template with an invalid one
+func validFuncName(name string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("invalid template function name %s", name)
+		}
+	}()
+	tmpl.New("").Funcs(tmpl.FuncMap{name: func() string { return "" }})
+	return nil
+}
+
+// funcs returns the builtin and the registered functions
+func funcs() tmpl.FuncMap {
+	funcsMutex.Lock()
+	defer funcsMutex.Unlock()
+
+	all := make(tmpl.FuncMap, len(builtinFuncs)+len(customFuncs))
+	for name, fn := range customFuncs {
+		all[name] = fn
+	}
+	for name, fn := range builtinFuncs {
+		all[name] = fn
+	}
+	return all
+}
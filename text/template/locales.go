@@ -0,0 +1,141 @@
+package template
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DefaultLocale is the locale of the default messages, the one every other
+// locale falls back to
+const DefaultLocale = "en"
+
+// localeMessages are the default messages translated to each locale, the
+// ones that are missing are taken from the next locale of the chain
+var localeMessages = map[string]map[string][]string{
+	"es": {
+		Handshake:      {"¡Soy el Señor Meeseeks! ¡Mírenme!", "¡Señor Meeseeks!", "¡Oh, sí! ¡Puedo hacerlo!", "¡Oh, ok!"},
+		Success:        {"¡Listo!", "Señor Meeseeks", "¡Uuuuh, genial!"},
+		Failure:        {"¡Uuuh!, no, falló"},
+		Unauthorized:   {"Uuuuh, ¡sí! no tienes permitido hacer"},
+		UnknownCommand: {"¡Uuuh! no, no sé cómo hacer"},
+	},
+	"pt": {
+		Handshake:      {"Eu sou o Sr. Meeseeks! Olhem para mim!", "Sr. Meeseeks!", "Ooh, sim! Posso fazer!", "Ooh, ok!"},
+		Success:        {"Tudo pronto!", "Sr. Meeseeks", "Uuuuh, legal!"},
+		Failure:        {"Uuuh!, não, falhou"},
+		Unauthorized:   {"Uuuuh, sim! você não tem permissão para"},
+		UnknownCommand: {"Uuuh! não, não sei fazer"},
+	},
+	"fr": {
+		Handshake:      {"Je suis M. Meeseeks ! Regardez-moi !", "M. Meeseeks !", "Ooh, oui ! Je peux le faire !", "Ooh, d'accord !"},
+		Success:        {"C'est fait !", "M. Meeseeks", "Uuuuh, génial !"},
+		Failure:        {"Uuuh !, non, ça a échoué"},
+		Unauthorized:   {"Uuuuh, ouais ! tu n'as pas le droit de faire"},
+		UnknownCommand: {"Uuuh ! non, je ne sais pas faire"},
+	},
+	"de": {
+		Handshake:      {"Ich bin Mr. Meeseeks! Seht mich an!", "Mr. Meeseeks!", "Ooh, ja! Kann ich machen!", "Ooh, ok!"},
+		Success:        {"Alles erledigt!", "Mr. Meeseeks", "Uuuuh, super!"},
+		Failure:        {"Uuuh!, nein, es ist fehlgeschlagen"},
+		Unauthorized:   {"Uuuuh, ja! du darfst nicht"},
+		UnknownCommand: {"Uuuh! nein, ich weiß nicht wie man"},
+	},
+}
+
+// localeFormat is how dates and durations are written in a locale, the units
+// are the singular and the plural of hours, minutes and seconds
+type localeFormat struct {
+	layout string
+	units  [3][2]string
+}
+
+var localeFormats = map[string]localeFormat{
+	"en": {"01/02/2006 15:04", [3][2]string{{"hour", "hours"}, {"minute", "minutes"}, {"second", "seconds"}}},
+	"es": {"02/01/2006 15:04", [3][2]string{{"hora", "horas"}, {"minuto", "minutos"}, {"segundo", "segundos"}}},
+	"pt": {"02/01/2006 15:04", [3][2]string{{"hora", "horas"}, {"minuto", "minutos"}, {"segundo", "segundos"}}},
+	"fr": {"02/01/2006 15:04", [3][2]string{{"heure", "heures"}, {"minute", "minutes"}, {"seconde", "secondes"}}},
+	"de": {"02.01.2006 15:04", [3][2]string{{"Stunde", "Stunden"}, {"Minute", "Minuten"}, {"Sekunde", "Sekunden"}}},
+}
+
+// localeChain returns the locales to look into, from the most specific to the
+// default one, so pt-BR is pt-BR, pt and en
+func localeChain(locale string) []string {
+	chain := make([]string, 0, 3)
+	locale = strings.Replace(locale, "_", "-", -1)
+	for locale != "" {
+		chain = append(chain, locale)
+		i := strings.LastIndex(locale, "-")
+		if i < 0 {
+			break
+		}
+		locale = locale[:i]
+	}
+	return append(chain, DefaultLocale)
+}
+
+// KnownLocale returns true when there are messages in the locale, or in a
+// more general one, like es for es-AR
+func KnownLocale(locale string) bool {
+	chain := localeChain(locale)
+	for i, l := range chain {
+		if _, ok := localeMessages[l]; ok {
+			return true
+		}
+		if l == DefaultLocale { // Only when it's not the one the chain ends with
+			return i < len(chain)-1
+		}
+	}
+	return false
+}
+
+// MessagesFor returns the default messages in the locale, the ones that are
+// not translated fall back along the chain of the locale
+func MessagesFor(locale string) map[string][]string {
+	messages := GetDefaultMessages()
+	chain := localeChain(locale)
+	for i := len(chain) - 1; i >= 0; i-- {
+		for name, m := range localeMessages[chain[i]] {
+			messages[name] = m
+		}
+	}
+	return messages
+}
+
+func formatFor(locale string) localeFormat {
+	for _, l := range localeChain(locale) {
+		if f, ok := localeFormats[l]; ok {
+			return f
+		}
+	}
+	return localeFormats[DefaultLocale]
+}
+
+// localTime writes the time as it's written in the locale
+func localTime(locale string, t time.Time) string {
+	return t.Format(formatFor(locale).layout)
+}
+
+// localDuration writes the duration in the words of the locale, with its two
+// largest units, like 2 minutes 5 seconds
+func localDuration(locale string, d time.Duration) string {
+	units := formatFor(locale).units
+	d = d.Round(time.Second)
+	values := []int64{int64(d / time.Hour), int64(d % time.Hour / time.Minute), int64(d % time.Minute / time.Second)}
+
+	parts := make([]string, 0, 2)
+	for i, v := range values {
+		if v == 0 || len(parts) == 2 {
+			continue
+		}
+		unit := units[i][1]
+		if v == 1 {
+			unit = units[i][0]
+		}
+		parts = append(parts, fmt.Sprintf("%d %s", v, unit))
+	}
+	if len(parts) == 0 {
+		return fmt.Sprintf("0 %s", units[2][1])
+	}
+	return strings.Join(parts, " ")
+}
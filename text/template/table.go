@@ -0,0 +1,47 @@
+package template
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// row returns the cells as a row of a table, so templates can write the
+// header of one
+func row(cells ...string) []string {
+	return cells
+}
+
+// table writes the rows as a table aligned with spaces under the header and
+// a line, to be shown in a monospace block like the output of a command
+func table(header []string, rows [][]string) string {
+	all := append([][]string{header}, rows...)
+
+	widths := make([]int, 0)
+	for _, r := range all {
+		for i, cell := range r {
+			if i == len(widths) {
+				widths = append(widths, 0)
+			}
+			if w := utf8.RuneCountInString(cell); w > widths[i] {
+				widths[i] = w
+			}
+		}
+	}
+
+	line := make([]string, len(widths))
+	for i, w := range widths {
+		line[i] = strings.Repeat("-", w)
+	}
+	all = append([][]string{header, line}, rows...)
+
+	b := strings.Builder{}
+	for _, r := range all {
+		cells := make([]string, len(r))
+		for i, cell := range r {
+			cells[i] = cell + strings.Repeat(" ", widths[i]-utf8.RuneCountInString(cell))
+		}
+		b.WriteString(strings.TrimRight(strings.Join(cells, "  "), " "))
+		b.WriteString("\n")
+	}
+	return b.String()
+}
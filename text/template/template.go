@@ -4,11 +4,9 @@ import (
 	"bytes"
 	"fmt"
 	"math/rand"
-	"strings"
-
-	humanize "github.com/dustin/go-humanize"
-	log "github.com/sirupsen/logrus"
+	"sync"
 	tmpl "text/template"
+	"time"
 )
 
 // Template names used for rendering
@@ -18,19 +16,21 @@ const (
 	Failure        = "failure"
 	UnknownCommand = "unknowncommand"
 	Unauthorized   = "unauthorized"
+	Progress       = "progress"
 )
 
 // Default command templates
 var (
 	DefaultHandshakeTemplate = fmt.Sprintf("{{ AnyValue \"%s\" . }}", Handshake)
 	DefaultSuccessTemplate   = fmt.Sprintf("{{ .userlink }} {{ AnyValue \"%s\" . }}"+
-		"{{ with $out := .output }}\n```\n{{ $out }}```{{ end }}", Success)
+		"{{ with $out := .output }}\n```{{ with $.language }}{{ . }}{{ end }}\n{{ $out }}```{{ end }}", Success)
 	DefaultFailureTemplate = fmt.Sprintf("{{ .userlink }} {{ AnyValue \"%s\" . }} :disappointed: {{ .error }}"+
-		"{{ with $out := .output }}\n```\n{{ $out }}```{{ end }}", Failure)
+		"{{ with $out := .output }}\n```{{ with $.language }}{{ . }}{{ end }}\n{{ $out }}```{{ end }}", Failure)
 	DefaultUnknownCommandTemplate = fmt.Sprintf("{{ .userlink }} {{ AnyValue \"%s\" . }} {{ .command }}",
 		UnknownCommand)
 	DefaultUnauthorizedTemplate = fmt.Sprintf("{{ .userlink }} {{ AnyValue \"%s\" . }} {{ .command }}: {{ .error }}",
 		Unauthorized)
+	DefaultProgressTemplate = "{{ with $out := .output }}```\n{{ $out }}```{{ end }}"
 )
 
 // GetDefaultTemplates returns a map with the default templates
@@ -41,6 +41,7 @@ func GetDefaultTemplates() map[string]string {
 		Failure:        DefaultFailureTemplate,
 		UnknownCommand: DefaultUnknownCommandTemplate,
 		Unauthorized:   DefaultUnauthorizedTemplate,
+		Progress:       DefaultProgressTemplate,
 	}
 }
 
@@ -73,7 +74,11 @@ type Templates struct {
 }
 
 // TemplatesBuilder is a helper object that is used to build the template renderers
+//
+// The messages are the default ones of the locale, with the ones set with
+// WithMessages on top
 type TemplatesBuilder struct {
+	locale    string
 	messages  map[string][]string
 	templates map[string]string
 }
@@ -81,11 +86,21 @@ type TemplatesBuilder struct {
 // NewBuilder creates a new template builder fill with default values
 func NewBuilder() *TemplatesBuilder {
 	return &TemplatesBuilder{
+		locale:    DefaultLocale,
 		templates: GetDefaultTemplates(),
-		messages:  GetDefaultMessages(),
+		messages:  map[string][]string{},
 	}
 }
 
+// WithLocale allows to change the locale of the default messages, it's left
+// as it is when empty
+func (b *TemplatesBuilder) WithLocale(locale string) *TemplatesBuilder {
+	if locale != "" {
+		b.locale = locale
+	}
+	return b
+}
+
 // WithMessages allows to change messages from the template builder
 func (b *TemplatesBuilder) WithMessages(messages map[string][]string) *TemplatesBuilder {
 	for name, message := range messages {
@@ -104,21 +119,27 @@ func (b *TemplatesBuilder) WithTemplates(templates map[string]string) *Templates
 
 // Clone returns a copy of this template builder
 func (b *TemplatesBuilder) Clone() *TemplatesBuilder {
-	return NewBuilder().WithMessages(b.messages).WithTemplates(b.templates)
+	return NewBuilder().WithLocale(b.locale).WithMessages(b.messages).WithTemplates(b.templates)
 }
 
-// Build creates a Templates object will all the necessary renderers initialized
-func (b *TemplatesBuilder) Build() Templates {
+// Build creates a Templates object will all the necessary renderers initialized,
+// it fails when a template doesn't parse
+func (b *TemplatesBuilder) Build() (Templates, error) {
 	renderers := make(map[string]Renderer)
 	for name, template := range b.templates {
 		renderer, err := New(name, template)
 		if err != nil {
-			log.Fatalf("could not parse %s template: %s", name, err)
+			return Templates{}, err
 		}
 		renderers[name] = renderer
 	}
 
-	payload := map[string]interface{}{}
+	payload := map[string]interface{}{
+		"locale": b.locale,
+	}
+	for k, v := range MessagesFor(b.locale) {
+		payload[k] = v
+	}
 	for k, v := range b.messages {
 		payload[k] = v
 	}
@@ -126,7 +147,7 @@ func (b *TemplatesBuilder) Build() Templates {
 	return Templates{
 		renderers:      renderers,
 		defaultPayload: payload,
-	}
+	}, nil
 }
 
 // Render renders the template matching the action with the passed in payload
@@ -169,6 +190,63 @@ func anyValue(key string, payload map[string]interface{}) (string, error) {
 	return slice[rand.Intn(len(slice))], nil
 }
 
+// elapsed returns how long after start a moment was, like +1.5s
+func elapsed(start, t time.Time) string {
+	return fmt.Sprintf("+%s", t.Sub(start).Round(time.Millisecond))
+}
+
+// Limits are the caps on the execution of every template, so a bad one
+// can't hang the replies or flood them. The timeout is in seconds and a zero
+// value takes the default
+type Limits struct {
+	Timeout  time.Duration `yaml:"timeout"`
+	MaxBytes int           `yaml:"max_bytes"`
+}
+
+// Default limits of the execution of the templates
+const (
+	DefaultRenderTimeout  = 5 * time.Second
+	DefaultRenderMaxBytes = 1024 * 1024
+)
+
+var limits = Limits{Timeout: DefaultRenderTimeout, MaxBytes: DefaultRenderMaxBytes}
+var limitsMutex sync.Mutex
+
+// SetLimits sets the caps on the execution of the templates
+func SetLimits(l Limits) {
+	limitsMutex.Lock()
+	defer limitsMutex.Unlock()
+
+	limits = Limits{Timeout: l.Timeout * time.Second, MaxBytes: l.MaxBytes}
+	if limits.Timeout <= 0 {
+		limits.Timeout = DefaultRenderTimeout
+	}
+	if limits.MaxBytes <= 0 {
+		limits.MaxBytes = DefaultRenderMaxBytes
+	}
+}
+
+func getLimits() Limits {
+	limitsMutex.Lock()
+	defer limitsMutex.Unlock()
+
+	return limits
+}
+
+// cappedBuffer fails the writes that go over its size, which stops the
+// execution of the template
+type cappedBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+func (c *cappedBuffer) Write(p []byte) (int, error) {
+	if c.Len()+len(p) > c.max {
+		return 0, fmt.Errorf("the output is larger than %d bytes", c.max)
+	}
+	return c.Buffer.Write(p)
+}
+
 // Renderer is a pre rendered template used to reply
 type Renderer struct {
 	template *tmpl.Template
@@ -176,13 +254,7 @@ type Renderer struct {
 
 // New creates a new ReplyTemplate pre-parsing the template
 func New(name, template string) (Renderer, error) {
-	t, err := tmpl.New(name).Funcs(tmpl.FuncMap{
-		"AnyValue":       anyValue,
-		"HumanizeTime":   humanize.Time,
-		"HumanizeSize":   humanize.Bytes,
-		"HumanizeNumber": humanize.Ftoa,
-		"Join":           strings.Join,
-	}).Parse(template)
+	t, err := tmpl.New(name).Funcs(funcs()).Parse(template)
 	if err != nil {
 		return Renderer{}, fmt.Errorf("could not parse template %s: %s", name, err)
 	}
@@ -191,13 +263,26 @@ func New(name, template string) (Renderer, error) {
 	}, nil
 }
 
-// Render renders the template with the passed in data
+// Render renders the template with the passed in data, it fails when it takes
+// longer or writes more than the limits
 func (r Renderer) Render(data map[string]interface{}) (string, error) {
-	b := bytes.NewBuffer([]byte{})
-	err := r.template.Execute(b, data)
+	l := getLimits()
+	b := &cappedBuffer{max: l.MaxBytes}
 
-	if err != nil {
-		return "", fmt.Errorf("failed to execute template %s: %s", r.template.Name(), err)
+	// The execution can't be stopped, so on a timeout it's left behind writing
+	// to a buffer no one reads
+	done := make(chan error, 1)
+	go func() {
+		done <- r.template.Execute(b, data)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return "", fmt.Errorf("failed to execute template %s: %s", r.template.Name(), err)
+		}
+	case <-time.After(l.Timeout):
+		return "", fmt.Errorf("failed to execute template %s: it took longer than %s", r.template.Name(), l.Timeout)
 	}
 
 	return b.String(), nil
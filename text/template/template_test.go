@@ -5,6 +5,7 @@ import (
 	"regexp"
 	"strings"
 	"testing"
+	"time"
 
 	"gitlab.com/yakshaving.art/meeseeks-box/mocks"
 	"gitlab.com/yakshaving.art/meeseeks-box/text/template"
@@ -48,6 +49,31 @@ func Test_Templating(t *testing.T) {
 			},
 			expected: "list: first=one second=two ",
 		},
+		{
+			name:     "with elapsed time",
+			template: "{{ Elapsed .Start .End }}",
+			data: map[string]interface{}{
+				"Start": time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC),
+				"End":   time.Date(2018, 1, 1, 0, 0, 1, 500000000, time.UTC),
+			},
+			expected: "+1.5s",
+		},
+		{
+			name:     "with a table",
+			template: "{{ Table (Row \"Job\" \"Command\" \"Status\") .Rows }}",
+			data: map[string]interface{}{
+				"Rows": [][]string{
+					{"1", "deploy", "Succeeded"},
+					{"12", "rollback", ""},
+					{"123", "ñandú", "Failed"},
+				},
+			},
+			expected: "Job  Command   Status\n" +
+				"---  --------  ---------\n" +
+				"1    deploy    Succeeded\n" +
+				"12   rollback\n" +
+				"123  ñandú     Failed\n",
+		},
 	}
 	for _, tc := range tt {
 		t.Run(tc.name, func(t *testing.T) {
@@ -132,9 +158,10 @@ func Test_InvalidData(t *testing.T) {
 }
 
 func Test_ChangingTemplate(t *testing.T) {
-	templates := template.NewBuilder().WithTemplates(map[string]string{
+	templates, err := template.NewBuilder().WithTemplates(map[string]string{
 		template.Handshake: "hello!",
 	}).Build()
+	mocks.Must(t, "can't build templates", err)
 	out, err := templates.Render(template.Handshake,
 		map[string]interface{}{
 			"user": "myuser",
@@ -145,16 +172,18 @@ func Test_ChangingTemplate(t *testing.T) {
 }
 
 func Test_ChangingMessages(t *testing.T) {
-	templates := template.NewBuilder().WithMessages(map[string][]string{
+	templates, err := template.NewBuilder().WithMessages(map[string][]string{
 		template.Handshake: {"yo!"},
 	}).Build()
+	mocks.Must(t, "can't build templates", err)
 	out, err := templates.Render(template.Handshake, map[string]interface{}{})
 	mocks.Must(t, "can't render changed handshake template", err)
 	mocks.AssertEquals(t, "yo!", out)
 }
 
 func Test_DefaultTemplates(t *testing.T) {
-	templates := template.NewBuilder().Build()
+	templates, err := template.NewBuilder().Build()
+	mocks.Must(t, "can't build default templates", err)
 
 	handshakeMatcher, err := regexp.Compile(fmt.Sprintf("^(%s)$", strings.Join(template.DefaultHandshakeMessages, "|")))
 	mocks.Must(t, "can't compile default hanshake matcher", err)
@@ -264,3 +293,144 @@ func Test_DefaultTemplates(t *testing.T) {
 		})
 	}
 }
+
+func Test_Locales(t *testing.T) {
+	start := time.Date(2019, time.March, 4, 15, 30, 0, 0, time.UTC)
+	tt := []struct {
+		name     string
+		locale   string
+		messages map[string][]string
+		expected string
+	}{
+		{
+			name:     "default locale",
+			locale:   "",
+			expected: "Uuuh!, no, it failed - 03/04/2019 15:30 - 1 hour 2 minutes",
+		},
+		{
+			name:     "translated locale",
+			locale:   "es",
+			expected: "¡Uuuh!, no, falló - 04/03/2019 15:30 - 1 hora 2 minutos",
+		},
+		{
+			name:     "falls back to the language",
+			locale:   "de-AT",
+			expected: "Uuuh!, nein, es ist fehlgeschlagen - 04.03.2019 15:30 - 1 Stunde 2 Minuten",
+		},
+		{
+			name:     "falls back to english",
+			locale:   "xx",
+			expected: "Uuuh!, no, it failed - 03/04/2019 15:30 - 1 hour 2 minutes",
+		},
+		{
+			name:     "messages win over the locale",
+			locale:   "fr",
+			messages: map[string][]string{template.Failure: {"nope"}},
+			expected: "nope - 04/03/2019 15:30 - 1 heure 2 minutes",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			templates, err := template.NewBuilder().WithLocale(tc.locale).WithMessages(tc.messages).WithTemplates(
+				map[string]string{
+					template.Failure: `{{ AnyValue "failure" . }} - {{ LocalTime .locale .start }} - ` +
+						`{{ LocalDuration .locale .duration }}`,
+				}).Build()
+			mocks.Must(t, "can't build localized templates", err)
+
+			out, err := templates.Render(template.Failure, map[string]interface{}{
+				"start":    start,
+				"duration": time.Hour + 2*time.Minute + 400*time.Millisecond,
+			})
+			mocks.Must(t, "can't render localized template", err)
+			mocks.AssertEquals(t, tc.expected, out)
+		})
+	}
+
+	mocks.AssertEquals(t, true, template.KnownLocale("pt_BR"))
+	mocks.AssertEquals(t, true, template.KnownLocale("en-GB"))
+	mocks.AssertEquals(t, false, template.KnownLocale("xx"))
+}
+
+func Test_RegisteringFunctions(t *testing.T) {
+	mocks.Must(t, "could not register function", template.RegisterFunc("Shout", strings.ToUpper))
+	mocks.Must(t, "could not register function with an error", template.RegisterFunc("Ticket",
+		func(id int) (string, error) {
+			if id <= 0 {
+				return "", fmt.Errorf("invalid ticket %d", id)
+			}
+			return fmt.Sprintf("https://tickets.example.com/%d", id), nil
+		}))
+
+	renderer, err := template.New("custom", "{{ Shout .user }} see {{ Ticket .ticket }}")
+	mocks.Must(t, "could not parse template with registered functions", err)
+	out, err := renderer.Render(map[string]interface{}{"user": "alice", "ticket": 42})
+	mocks.Must(t, "could not render template with registered functions", err)
+	mocks.AssertEquals(t, "ALICE see https://tickets.example.com/42", out)
+
+	tt := []struct {
+		name     string
+		fn       interface{}
+		expected string
+	}{
+		{name: "Join", fn: strings.Join, expected: "template function Join is a builtin one"},
+		{name: "Shout", fn: strings.ToLower, expected: "template function Shout is already registered"},
+		{name: "Nothing", fn: "not a function", expected: "template function Nothing is not a function"},
+		{name: "Void", fn: func() {}, expected: "template function Void has to return a single value or a value and an error"},
+		{name: "not-valid", fn: strings.ToLower, expected: "invalid template function name not-valid"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			mocks.AssertEquals(t, tc.expected, fmt.Sprint(template.RegisterFunc(tc.name, tc.fn)))
+		})
+	}
+}
+
+func Test_RenderingLimits(t *testing.T) {
+	mocks.Must(t, "could not register function", template.RegisterFunc("Nap",
+		func(seconds int) string {
+			time.Sleep(time.Duration(seconds) * time.Second)
+			return "awake"
+		}))
+	template.SetLimits(template.Limits{Timeout: 1, MaxBytes: 10})
+	defer template.SetLimits(template.Limits{})
+
+	tt := []struct {
+		name     string
+		template string
+		expected string
+		err      string
+	}{
+		{
+			name:     "within the limits",
+			template: "{{ .user }}",
+			expected: "alice",
+		},
+		{
+			name:     "too large",
+			template: "{{ range .items }}{{ . }}{{ end }}",
+			err:      "^failed to execute template limits: .*the output is larger than 10 bytes$",
+		},
+		{
+			name:     "too slow",
+			template: "{{ Nap 3 }}",
+			err:      "^failed to execute template limits: it took longer than 1s$",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			renderer, err := template.New("limits", tc.template)
+			mocks.Must(t, "could not parse template", err)
+			out, err := renderer.Render(map[string]interface{}{
+				"user":  "alice",
+				"items": []string{"portal", "gun", "plumbus"},
+			})
+			if tc.err != "" {
+				mocks.AssertMatches(t, tc.err, fmt.Sprint(err))
+				return
+			}
+			mocks.Must(t, "could not render template", err)
+			mocks.AssertEquals(t, tc.expected, out)
+		})
+	}
+}
@@ -0,0 +1,233 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence"
+	"gitlab.com/yakshaving.art/meeseeks-box/secrets/vault"
+)
+
+// The statuses of an alert a rule can run its command on
+const (
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+	AlertAny      = "any"
+)
+
+// Alertmanager is the receiver of the webhooks of an Alertmanager, which runs
+// the command of each rule an alert matches
+//
+// Token is the bearer token the Alertmanager sends in the Authorization
+// header, it can be a vault reference. The commands are called as the User
+// in the Channel, both links, unless the rule sets its own channel
+type Alertmanager struct {
+	Token   string      `yaml:"token"`
+	User    string      `yaml:"user"`
+	Channel string      `yaml:"channel"`
+	Rules   []AlertRule `yaml:"rules"`
+}
+
+// AlertRule runs the Command when an alert with the Alert name, and the
+// Labels that are set, gets to the Status, firing by default. Args are
+// templates rendered with the alertname, status, labels, annotations,
+// fingerprint, startsAt, generatorURL and externalURL of the alert, like
+// {{ .labels.instance }}, each one a single argument
+type AlertRule struct {
+	Alert   string            `yaml:"alert"`
+	Labels  map[string]string `yaml:"labels"`
+	Status  string            `yaml:"status"`
+	Command string            `yaml:"command"`
+	Args    []string          `yaml:"args"`
+	Channel string            `yaml:"channel"`
+}
+
+// Validate checks that the receiver has a token and a user, and that each
+// rule has a command and a channel to run it in
+func (a Alertmanager) Validate() error {
+	if len(a.Rules) == 0 {
+		return nil
+	}
+	if a.Token == "" || a.User == "" {
+		return fmt.Errorf("alertmanager requires a token and a user")
+	}
+	for i, rule := range a.Rules {
+		if err := rule.validate(a.Channel); err != nil {
+			return fmt.Errorf("alertmanager rule %d: %s", i+1, err)
+		}
+	}
+	return nil
+}
+
+func (r AlertRule) validate(channel string) error {
+	if r.Command == "" {
+		return fmt.Errorf("rule requires a command")
+	}
+	if r.Channel == "" && channel == "" {
+		return fmt.Errorf("rule requires a channel when the alertmanager has none")
+	}
+	switch r.Status {
+	case "", AlertFiring, AlertResolved, AlertAny:
+	default:
+		return fmt.Errorf("invalid alert status %s, valid ones are %s, %s and %s",
+			r.Status, AlertFiring, AlertResolved, AlertAny)
+	}
+	_, err := parseArgs(r.Args)
+	return err
+}
+
+func (r AlertRule) matches(alert receivedAlert) bool {
+	switch r.Status {
+	case AlertAny:
+	case "":
+		if alert.Status != AlertFiring {
+			return false
+		}
+	default:
+		if alert.Status != r.Status {
+			return false
+		}
+	}
+	if r.Alert != "" && r.Alert != alert.Labels["alertname"] {
+		return false
+	}
+	for name, value := range r.Labels {
+		if alert.Labels[name] != value {
+			return false
+		}
+	}
+	return true
+}
+
+var alertmanager Alertmanager
+
+// ConfigureAlertmanager sets the rules of the alertmanager receiver,
+// resolving its token
+func ConfigureAlertmanager(configured Alertmanager) error {
+	token, err := vault.Resolve(configured.Token)
+	if err != nil {
+		return fmt.Errorf("could not resolve the token of the alertmanager: %s", err)
+	}
+	configured.Token = token
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	alertmanager = configured
+	return nil
+}
+
+func getAlertmanager() Alertmanager {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return alertmanager
+}
+
+// alertNotification is the body of the calls of an Alertmanager, with the
+// alerts of a group
+type alertNotification struct {
+	ExternalURL string          `json:"externalURL"`
+	Alerts      []receivedAlert `json:"alerts"`
+}
+
+type receivedAlert struct {
+	Status       string            `json:"status"`
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	StartsAt     string            `json:"startsAt"`
+	GeneratorURL string            `json:"generatorURL"`
+	Fingerprint  string            `json:"fingerprint"`
+}
+
+// RegisterAlertmanagerPath starts listening for the calls of an Alertmanager
+// in the path
+func (s *Service) RegisterAlertmanagerPath(path string) {
+	http.HandleFunc(path, s.HandleAlerts)
+}
+
+// HandleAlerts runs the commands of the rules each alert of the call matches.
+// Alertmanager sends the alerts of a group again while they fire, so each
+// command runs once for each time an alert starts firing or is resolved, and
+// again when it's still sent after the deliveries are forgotten
+func (s *Service) HandleAlerts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	receiver := getAlertmanager()
+	if len(receiver.Rules) == 0 {
+		http.Error(w, "the alertmanager receiver is not configured", http.StatusNotFound)
+		return
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !hmac.Equal([]byte(token), []byte(receiver.Token)) {
+		logrus.Warnf("Rejected call from alertmanager: invalid token")
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	notification := alertNotification{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(&notification); err != nil {
+		http.Error(w, fmt.Sprintf("invalid body: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	triggered := 0
+	for _, alert := range notification.Alerts {
+		for i, rule := range receiver.Rules {
+			if !rule.matches(alert) {
+				continue
+			}
+			fresh, err := persistence.Locker().Lock(fmt.Sprintf("alertmanager:%d:%s:%s:%s",
+				i, alert.Fingerprint, alert.StartsAt, alert.Status), deliveryRetention)
+			if err != nil {
+				logrus.Errorf("Could not check if alert %s was already received: %s", alert.Fingerprint, err)
+				http.Error(w, "could not check alerts", http.StatusInternalServerError)
+				return
+			}
+			if !fresh {
+				continue
+			}
+			if err := s.runAlertRule(receiver, rule, notification, alert); err != nil {
+				logrus.Errorf("Could not run %s for alert %s: %s", rule.Command, alert.Labels["alertname"], err)
+				continue
+			}
+			triggered++
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "%d commands triggered\n", triggered)
+}
+
+func (s *Service) runAlertRule(receiver Alertmanager, rule AlertRule, notification alertNotification, alert receivedAlert) error {
+	args, err := renderCommand(rule.Command, rule.Args, map[string]interface{}{
+		"alertname":    alert.Labels["alertname"],
+		"status":       alert.Status,
+		"labels":       alert.Labels,
+		"annotations":  alert.Annotations,
+		"fingerprint":  alert.Fingerprint,
+		"startsAt":     alert.StartsAt,
+		"generatorURL": alert.GeneratorURL,
+		"externalURL":  notification.ExternalURL,
+	})
+	if err != nil {
+		return err
+	}
+	channel := rule.Channel
+	if channel == "" {
+		channel = receiver.Channel
+	}
+	req, err := s.newRequest(receiver.User, channel, args)
+	if err != nil {
+		return err
+	}
+	s.requestsCh <- req
+	return nil
+}
@@ -0,0 +1,364 @@
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence"
+	"gitlab.com/yakshaving.art/meeseeks-box/secrets/vault"
+	"gitlab.com/yakshaving.art/meeseeks-box/text/parser"
+)
+
+// How a mapping checks that a call comes from the system it maps
+const (
+	// AuthHMAC checks the hex HMAC-SHA256 of the body with the secret, sent in
+	// the header with or without a sha256= prefix, like GitHub does
+	AuthHMAC = "hmac"
+	// AuthToken checks that the header has the secret, like GitLab does
+	AuthToken = "token"
+)
+
+// The headers of each auth when the mapping sets none
+const (
+	DefaultHMACHeader  = "X-Hub-Signature-256"
+	DefaultTokenHeader = "X-Webhook-Token"
+)
+
+// deliveryRetention is how long the ID of a delivery is kept to reject it
+// when it's received again
+const deliveryRetention = 24 * time.Hour
+
+// Mapping turns the calls of a system that knows nothing about the Meeseeks,
+// like the webhooks of a forge or an alert manager, into a command
+//
+// Auth is how the calls are checked, hmac (the default) or token, with the
+// Secret, which can be a vault reference, signed or sent in Header. When
+// DeliveryHeader is set, calls with a delivery ID that was already received
+// are rejected. Vars are values picked from the JSON body with paths like
+// $.repository.name, Match the values the body needs to have for the call to
+// run the command, like $.action: opened, and Args the templates of the
+// arguments added to the Command, rendered with the vars, each one a single
+// argument. The command is called as the User in the Channel, both links, and
+// its results are posted there
+type Mapping struct {
+	Auth           string            `yaml:"auth"`
+	Secret         string            `yaml:"secret"`
+	Header         string            `yaml:"header"`
+	DeliveryHeader string            `yaml:"delivery_header"`
+	User           string            `yaml:"user"`
+	Channel        string            `yaml:"channel"`
+	Command        string            `yaml:"command"`
+	Vars           map[string]string `yaml:"vars"`
+	Match          map[string]string `yaml:"match"`
+	Args           []string          `yaml:"args"`
+}
+
+// Validate checks that the mapping is usable
+func (m Mapping) Validate() error {
+	switch m.Auth {
+	case "", AuthHMAC, AuthToken:
+	default:
+		return fmt.Errorf("invalid webhook mapping auth %s, valid ones are %s and %s", m.Auth, AuthHMAC, AuthToken)
+	}
+	if m.Secret == "" {
+		return fmt.Errorf("webhook mapping requires a secret")
+	}
+	if m.User == "" || m.Channel == "" || m.Command == "" {
+		return fmt.Errorf("webhook mapping requires a user, a channel and a command")
+	}
+	if _, err := parser.Parse(m.Command); err != nil {
+		return fmt.Errorf("invalid webhook mapping command %s: %s", m.Command, err)
+	}
+	for name, path := range m.Vars {
+		if _, err := parsePath(path); err != nil {
+			return fmt.Errorf("var %s: %s", name, err)
+		}
+	}
+	for path := range m.Match {
+		if _, err := parsePath(path); err != nil {
+			return fmt.Errorf("match: %s", err)
+		}
+	}
+	if _, err := parseArgs(m.Args); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (m Mapping) header() string {
+	switch {
+	case m.Header != "":
+		return m.Header
+	case m.Auth == AuthToken:
+		return DefaultTokenHeader
+	}
+	return DefaultHMACHeader
+}
+
+// parseArgs parses the templates of the args, which fail to render when they
+// use a value that is missing
+func parseArgs(args []string) ([]*template.Template, error) {
+	templates := make([]*template.Template, 0, len(args))
+	for i, arg := range args {
+		t, err := template.New(fmt.Sprintf("arg%d", i)).Option("missingkey=error").Parse(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid arg %s: %s", arg, err)
+		}
+		templates = append(templates, t)
+	}
+	return templates, nil
+}
+
+// renderCommand returns the command and its arguments followed by the args
+// rendered with the data, each one a single argument
+func renderCommand(command string, args []string, data interface{}) ([]string, error) {
+	templates, err := parseArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	rendered, err := parser.Parse(command)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range templates {
+		b := bytes.Buffer{}
+		if err := t.Execute(&b, data); err != nil {
+			return nil, fmt.Errorf("could not render args: %s", err)
+		}
+		rendered = append(rendered, b.String())
+	}
+	return rendered, nil
+}
+
+var mappings = map[string]Mapping{}
+
+// ConfigureMappings sets the mappings of the webhooks, resolving their secrets
+func ConfigureMappings(configured map[string]Mapping) error {
+	resolved := make(map[string]Mapping, len(configured))
+	for name, mapping := range configured {
+		secret, err := vault.Resolve(mapping.Secret)
+		if err != nil {
+			return fmt.Errorf("could not resolve the secret of webhook mapping %s: %s", name, err)
+		}
+		mapping.Secret = secret
+		resolved[name] = mapping
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	mappings = resolved
+	return nil
+}
+
+func getMapping(name string) (Mapping, bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	m, ok := mappings[name]
+	return m, ok
+}
+
+// handleMapping checks the call and runs the command of the mapping when the
+// body matches it, replying OK without running anything when it doesn't
+func (s *Service) handleMapping(w http.ResponseWriter, name string, mapping Mapping, header http.Header, body []byte) {
+	if err := verifyMapping(name, mapping, header, body); err != nil {
+		logrus.Warnf("Rejected call to webhook mapping %s: %s", name, err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		http.Error(w, fmt.Sprintf("invalid body: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	for _, path := range sortedKeys(mapping.Match) {
+		expected := mapping.Match[path]
+		if value, ok := lookup(doc, path); !ok || value != expected {
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprintf(w, "ignored, %s is not %s\n", path, expected)
+			return
+		}
+	}
+
+	args, err := mapping.render(doc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req, err := s.newRequest(mapping.User, mapping.Channel, args)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.requestsCh <- req
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// verifyMapping checks the secret of the call and, when the mapping has a
+// delivery header, that the delivery was not received before
+func verifyMapping(name string, mapping Mapping, header http.Header, body []byte) error {
+	sent := header.Get(mapping.header())
+	if sent == "" {
+		return fmt.Errorf("the call has no %s", mapping.header())
+	}
+	switch mapping.Auth {
+	case AuthToken:
+		if !hmac.Equal([]byte(sent), []byte(mapping.Secret)) {
+			return fmt.Errorf("invalid token")
+		}
+	default:
+		mac := hmac.New(sha256.New, []byte(mapping.Secret))
+		mac.Write(body)
+		expected := hex.EncodeToString(mac.Sum(nil))
+		if !hmac.Equal([]byte(expected), []byte(strings.ToLower(strings.TrimPrefix(sent, "sha256=")))) {
+			return fmt.Errorf("invalid signature")
+		}
+	}
+
+	if mapping.DeliveryHeader == "" {
+		return nil
+	}
+	delivery := header.Get(mapping.DeliveryHeader)
+	if delivery == "" {
+		return fmt.Errorf("the call has no %s", mapping.DeliveryHeader)
+	}
+	fresh, err := persistence.Locker().Lock(fmt.Sprintf("webhook:%s:delivery:%s", name, delivery), deliveryRetention)
+	if err != nil {
+		return fmt.Errorf("could not check delivery: %s", err)
+	}
+	if !fresh {
+		return fmt.Errorf("the call was already received")
+	}
+	return nil
+}
+
+// render returns the command and the arguments of the mapping, with the args
+// rendered with the vars picked from the body
+func (m Mapping) render(doc interface{}) ([]string, error) {
+	vars := make(map[string]string, len(m.Vars))
+	for _, name := range sortedKeys(m.Vars) {
+		value, ok := lookup(doc, m.Vars[name])
+		if !ok {
+			return nil, fmt.Errorf("the body has no %s for var %s", m.Vars[name], name)
+		}
+		vars[name] = value
+	}
+	return renderCommand(m.Command, m.Args, vars)
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// parsePath splits a path like $.commits[0].author['name'] into the keys and
+// indexes it's made of
+func parsePath(path string) ([]interface{}, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("invalid path %s, it has to start with $", path)
+	}
+	steps := make([]interface{}, 0)
+	rest := path[1:]
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("invalid path %s, it has an empty key", path)
+			}
+			steps = append(steps, rest[:end])
+			rest = rest[end:]
+
+		case '[':
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("invalid path %s, it has an unclosed [", path)
+			}
+			inner := rest[1:end]
+			rest = rest[end+1:]
+			if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+				steps = append(steps, inner[1:len(inner)-1])
+				continue
+			}
+			index, err := strconv.Atoi(inner)
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("invalid path %s, %s is not a quoted key or an index", path, inner)
+			}
+			steps = append(steps, index)
+
+		default:
+			return nil, fmt.Errorf("invalid path %s", path)
+		}
+	}
+	return steps, nil
+}
+
+// lookup returns the value in the path of the body as a string, objects and
+// lists as JSON, and false when the body doesn't have it
+func lookup(doc interface{}, path string) (string, bool) {
+	steps, err := parsePath(path)
+	if err != nil {
+		return "", false
+	}
+	value := doc
+	for _, step := range steps {
+		switch step := step.(type) {
+		case string:
+			object, ok := value.(map[string]interface{})
+			if !ok {
+				return "", false
+			}
+			if value, ok = object[step]; !ok {
+				return "", false
+			}
+		case int:
+			list, ok := value.([]interface{})
+			if !ok || step >= len(list) {
+				return "", false
+			}
+			value = list[step]
+		}
+	}
+
+	switch value := value.(type) {
+	case nil:
+		return "", true
+	case string:
+		return value, true
+	case json.Number:
+		return value.String(), true
+	case bool:
+		return strconv.FormatBool(value), true
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return "", false
+	}
+	return string(b), true
+}
@@ -0,0 +1,281 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/api"
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+	"gitlab.com/yakshaving.art/meeseeks-box/persistence"
+	"gitlab.com/yakshaving.art/meeseeks-box/secrets/vault"
+	"gitlab.com/yakshaving.art/meeseeks-box/text/parser"
+)
+
+// Headers the signature of a call is sent in
+const (
+	TimestampHeader = "X-Meeseeks-Timestamp"
+	NonceHeader     = "X-Meeseeks-Nonce"
+	SignatureHeader = "X-Meeseeks-Signature"
+)
+
+// DefaultTolerance is how old a call can be when the source sets no tolerance
+const DefaultTolerance = 5 * time.Minute
+
+// The biggest body a call can have
+const maxBodySize = 1 << 20
+
+// Source is an external system that triggers a command calling its webhook
+//
+// Secret is the shared secret the calls are signed with, it can be a vault
+// reference. The command is called as the User in the Channel, both links,
+// and Tolerance is how many seconds the timestamp of a call can be from the
+// clock of the Meeseeks
+type Source struct {
+	Secret    string        `yaml:"secret"`
+	User      string        `yaml:"user"`
+	Channel   string        `yaml:"channel"`
+	Command   string        `yaml:"command"`
+	Tolerance time.Duration `yaml:"tolerance"`
+}
+
+// Validate checks that the source is usable
+func (s Source) Validate() error {
+	if s.Secret == "" {
+		return fmt.Errorf("webhook requires a secret")
+	}
+	if s.User == "" || s.Channel == "" || s.Command == "" {
+		return fmt.Errorf("webhook requires a user, a channel and a command")
+	}
+	if s.Tolerance < 0 {
+		return fmt.Errorf("webhook tolerance can't be negative")
+	}
+	return nil
+}
+
+func (s Source) tolerance() time.Duration {
+	if s.Tolerance <= 0 {
+		return DefaultTolerance
+	}
+	return s.Tolerance * time.Second
+}
+
+var sources = map[string]Source{}
+var mutex sync.Mutex
+
+// Configure sets the sources that can call the webhooks, resolving their secrets
+func Configure(configured map[string]Source) error {
+	resolved := make(map[string]Source, len(configured))
+	for name, source := range configured {
+		secret, err := vault.Resolve(source.Secret)
+		if err != nil {
+			return fmt.Errorf("could not resolve the secret of webhook %s: %s", name, err)
+		}
+		source.Secret = secret
+		resolved[name] = source
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	sources = resolved
+	return nil
+}
+
+func getSource(name string) (Source, bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	s, ok := sources[name]
+	return s, ok
+}
+
+// Sign returns the signature of a call, the hex HMAC-SHA256 of the
+// timestamp, the nonce and the body joined by dots
+func Sign(secret, timestamp, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + nonce + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Service takes the calls to the webhooks and turns them into requests
+type Service struct {
+	enricher   api.Enricher
+	path       string
+	requestsCh chan meeseeks.Request
+	shutdown   chan bool
+}
+
+// New returns a new webhooks service, each source is called in the path
+// followed by its name
+func New(enricher api.Enricher, path string) *Service {
+	if !strings.HasSuffix(path, "/") {
+		path += "/"
+	}
+	s := &Service{
+		enricher,
+		path,
+		make(chan meeseeks.Request),
+		make(chan bool),
+	}
+	http.HandleFunc(path, s.HandleCall)
+	return s
+}
+
+// Listen starts listen on the passed in channel
+func (s *Service) Listen(ch chan<- meeseeks.Request) {
+	shutdown := false
+	for !shutdown {
+		select {
+		case r := <-s.requestsCh:
+			ch <- r
+		case shutdown = <-s.shutdown:
+			// nothing to do here
+		}
+	}
+}
+
+// Shutdown stops sending requests
+func (s *Service) Shutdown() error {
+	logrus.Infof("Shutting down webhooks service")
+	s.shutdown <- true
+	close(s.requestsCh)
+
+	return nil
+}
+
+// HandleCall implements the http handle request function interface. The call
+// has to be signed with the secret of the source, and a timestamp and nonce
+// that were not used before. A JSON body with a message appends it to the
+// command of the source. Calls to a mapping are checked and turned into a
+// command as the mapping sets instead
+func (s *Service) HandleCall(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, s.path)
+	source, isSource := getSource(name)
+	mapping, isMapping := getMapping(name)
+	if !isSource && !isMapping {
+		http.Error(w, "unknown webhook", http.StatusNotFound)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		http.Error(w, "could not read body", http.StatusBadRequest)
+		return
+	}
+
+	if !isSource {
+		s.handleMapping(w, name, mapping, r.Header, body)
+		return
+	}
+
+	if err := verify(name, source, r.Header, body, time.Now()); err != nil {
+		logrus.Warnf("Rejected call to webhook %s: %s", name, err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	payload := struct {
+		Message string `json:"message"`
+	}{}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &payload); err != nil {
+			http.Error(w, fmt.Sprintf("invalid body: %s", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	args, err := parser.Parse(source.Command + " " + payload.Message)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req, err := s.newRequest(source.User, source.Channel, args)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.requestsCh <- req
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// verify checks the signature of the call, that it's recent and that its
+// nonce was not used. Nonces are locked in the database so a call can't be
+// replayed on any replica
+func verify(name string, source Source, header http.Header, body []byte, now time.Time) error {
+	timestamp, nonce, signature := header.Get(TimestampHeader), header.Get(NonceHeader), header.Get(SignatureHeader)
+	if timestamp == "" || nonce == "" || signature == "" {
+		return fmt.Errorf("the call is not signed")
+	}
+
+	expected := Sign(source.Secret, timestamp, nonce, body)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return fmt.Errorf("invalid signature")
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp %s", timestamp)
+	}
+	age := now.Sub(time.Unix(seconds, 0))
+	if age < 0 {
+		age = -age
+	}
+	if age > source.tolerance() {
+		return fmt.Errorf("the call is too old")
+	}
+
+	// The nonce is kept for as long as the timestamp is accepted
+	fresh, err := persistence.Locker().Lock(fmt.Sprintf("webhook:%s:%s", name, nonce), 2*source.tolerance())
+	if err != nil {
+		return fmt.Errorf("could not check nonce: %s", err)
+	}
+	if !fresh {
+		return fmt.Errorf("the call was already received")
+	}
+	return nil
+}
+
+// newRequest returns the request of the command and its args called by the
+// user in the channel, both links
+func (s *Service) newRequest(user, channel string, args []string) (meeseeks.Request, error) {
+	channelID, err := s.enricher.ParseChannelLink(channel)
+	if err != nil {
+		return meeseeks.Request{}, fmt.Errorf("invalid channel %s: %s", channel, err)
+	}
+	userID, err := s.enricher.ParseUserLink(user)
+	if err != nil {
+		return meeseeks.Request{}, fmt.Errorf("invalid user %s: %s", user, err)
+	}
+	if len(args) == 0 {
+		return meeseeks.Request{}, fmt.Errorf("no command to run")
+	}
+
+	return meeseeks.Request{
+		Command:     args[0],
+		Args:        args[1:],
+		UserID:      userID,
+		Username:    s.enricher.GetUsername(userID),
+		UserLink:    s.enricher.GetUserLink(userID),
+		ChannelID:   channelID,
+		Channel:     s.enricher.GetChannel(channelID),
+		ChannelLink: s.enricher.GetChannelLink(channelID),
+		IsIM:        s.enricher.IsIM(channelID),
+	}, nil
+}
@@ -0,0 +1,322 @@
+package webhooks_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.com/yakshaving.art/meeseeks-box/meeseeks"
+	"gitlab.com/yakshaving.art/meeseeks-box/mocks"
+	"gitlab.com/yakshaving.art/meeseeks-box/webhooks"
+)
+
+func TestSignedCalls(t *testing.T) {
+	mocks.Must(t, "failed to call webhooks", mocks.WithTmpDB(func(_ string) {
+		mocks.Must(t, "could not configure webhooks", webhooks.Configure(map[string]webhooks.Source{
+			"ci": {
+				Secret:  "shared-secret",
+				User:    "ciLink",
+				Channel: "deploysLink",
+				Command: "deploy",
+			},
+		}))
+		defer webhooks.Configure(nil)
+
+		s := webhooks.New(mocks.EnricherStub{}, "/hooks")
+		defer s.Shutdown()
+
+		ch := make(chan meeseeks.Request, 1)
+		go s.Listen(ch)
+
+		now := fmt.Sprintf("%d", time.Now().Unix())
+		call := func(source, secret, timestamp, nonce, body string) (int, string) {
+			r := httptest.NewRequest(http.MethodPost, "/hooks/"+source, strings.NewReader(body))
+			r.Header.Set(webhooks.TimestampHeader, timestamp)
+			r.Header.Set(webhooks.NonceHeader, nonce)
+			r.Header.Set(webhooks.SignatureHeader, webhooks.Sign(secret, timestamp, nonce, []byte(body)))
+			w := httptest.NewRecorder()
+			s.HandleCall(w, r)
+			return w.Code, strings.TrimSpace(w.Body.String())
+		}
+
+		code, _ := call("ci", "shared-secret", now, "nonce-1", `{"message": "production v1.2"}`)
+		mocks.AssertEquals(t, http.StatusAccepted, code)
+		req := <-ch
+		mocks.AssertEquals(t, "deploy", req.Command)
+		mocks.AssertEquals(t, []string{"production", "v1.2"}, req.Args)
+		mocks.AssertEquals(t, "ci", req.UserID)
+		mocks.AssertEquals(t, "deploys", req.ChannelID)
+
+		tt := []struct {
+			name      string
+			source    string
+			secret    string
+			timestamp string
+			nonce     string
+			code      int
+			body      string
+		}{
+			{"replayed", "ci", "shared-secret", now, "nonce-1", http.StatusUnauthorized, "the call was already received"},
+			{"wrong secret", "ci", "other-secret", now, "nonce-2", http.StatusUnauthorized, "invalid signature"},
+			{"too old", "ci", "shared-secret", fmt.Sprintf("%d", time.Now().Add(-time.Hour).Unix()), "nonce-3",
+				http.StatusUnauthorized, "the call is too old"},
+			{"not signed", "ci", "shared-secret", "", "", http.StatusUnauthorized, "the call is not signed"},
+			{"unknown source", "other", "shared-secret", now, "nonce-4", http.StatusNotFound, "unknown webhook"},
+		}
+		for _, tc := range tt {
+			t.Run(tc.name, func(t *testing.T) {
+				code, body := call(tc.source, tc.secret, tc.timestamp, tc.nonce, `{"message": "production"}`)
+				mocks.AssertEquals(t, tc.code, code)
+				mocks.AssertEquals(t, tc.body, body)
+			})
+		}
+	}))
+}
+
+func TestInvalidSources(t *testing.T) {
+	mocks.AssertEquals(t, "webhook requires a secret", webhooks.Source{}.Validate().Error())
+	mocks.AssertEquals(t, "webhook requires a user, a channel and a command",
+		webhooks.Source{Secret: "secret", User: "ciLink"}.Validate().Error())
+	mocks.AssertEquals(t, "webhook tolerance can't be negative", webhooks.Source{Secret: "secret", User: "ciLink",
+		Channel: "deploysLink", Command: "deploy", Tolerance: -1}.Validate().Error())
+}
+
+func TestMappedCalls(t *testing.T) {
+	mocks.Must(t, "failed to call webhooks", mocks.WithTmpDB(func(_ string) {
+		mocks.Must(t, "could not configure webhook mappings", webhooks.ConfigureMappings(map[string]webhooks.Mapping{
+			"forge": {
+				Secret:         "forge-secret",
+				DeliveryHeader: "X-Delivery",
+				User:           "ciLink",
+				Channel:        "deploysLink",
+				Command:        "deploy --env staging",
+				Vars: map[string]string{
+					"repo":   "$.repository['full_name']",
+					"sha":    "$.commits[0].id",
+					"number": "$.number",
+				},
+				Match: map[string]string{"$.action": "opened"},
+				Args:  []string{"{{ .repo }}#{{ .number }}", "{{ .sha }}"},
+			},
+			"alerts": {
+				Auth:    webhooks.AuthToken,
+				Secret:  "alerts-token",
+				User:    "ciLink",
+				Channel: "deploysLink",
+				Command: "page",
+				Vars:    map[string]string{"labels": "$.labels"},
+				Args:    []string{"{{ .labels }}"},
+			},
+		}))
+		defer webhooks.ConfigureMappings(nil)
+
+		s := webhooks.New(mocks.EnricherStub{}, "/mapped")
+		defer s.Shutdown()
+
+		ch := make(chan meeseeks.Request, 1)
+		go s.Listen(ch)
+
+		sign := func(secret, body string) string {
+			mac := hmac.New(sha256.New, []byte(secret))
+			mac.Write([]byte(body))
+			return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+		}
+		call := func(mapping string, header map[string]string, body string) (int, string) {
+			r := httptest.NewRequest(http.MethodPost, "/mapped/"+mapping, strings.NewReader(body))
+			for name, value := range header {
+				r.Header.Set(name, value)
+			}
+			w := httptest.NewRecorder()
+			s.HandleCall(w, r)
+			return w.Code, strings.TrimSpace(w.Body.String())
+		}
+
+		opened := `{"action": "opened", "number": 12, "repository": {"full_name": "yak/box"}, "commits": [{"id": "abc123"}]}`
+		code, _ := call("forge", map[string]string{
+			webhooks.DefaultHMACHeader: sign("forge-secret", opened),
+			"X-Delivery":               "delivery-1",
+		}, opened)
+		mocks.AssertEquals(t, http.StatusAccepted, code)
+		req := <-ch
+		mocks.AssertEquals(t, "deploy", req.Command)
+		mocks.AssertEquals(t, []string{"--env", "staging", "yak/box#12", "abc123"}, req.Args)
+		mocks.AssertEquals(t, "ci", req.UserID)
+		mocks.AssertEquals(t, "deploys", req.ChannelID)
+
+		alert := `{"labels": {"severity": "page"}}`
+		code, _ = call("alerts", map[string]string{webhooks.DefaultTokenHeader: "alerts-token"}, alert)
+		mocks.AssertEquals(t, http.StatusAccepted, code)
+		req = <-ch
+		mocks.AssertEquals(t, "page", req.Command)
+		mocks.AssertEquals(t, []string{`{"severity":"page"}`}, req.Args)
+
+		closed := `{"action": "closed", "number": 12}`
+		noCommits := `{"action": "opened", "number": 12, "repository": {"full_name": "yak/box"}, "commits": []}`
+		tt := []struct {
+			name    string
+			mapping string
+			header  map[string]string
+			body    string
+			code    int
+			reply   string
+		}{
+			{"replayed", "forge", map[string]string{webhooks.DefaultHMACHeader: sign("forge-secret", opened),
+				"X-Delivery": "delivery-1"}, opened, http.StatusUnauthorized, "the call was already received"},
+			{"wrong secret", "forge", map[string]string{webhooks.DefaultHMACHeader: sign("other-secret", opened),
+				"X-Delivery": "delivery-2"}, opened, http.StatusUnauthorized, "invalid signature"},
+			{"not signed", "forge", map[string]string{"X-Delivery": "delivery-3"}, opened,
+				http.StatusUnauthorized, "the call has no X-Hub-Signature-256"},
+			{"no delivery", "forge", map[string]string{webhooks.DefaultHMACHeader: sign("forge-secret", opened)}, opened,
+				http.StatusUnauthorized, "the call has no X-Delivery"},
+			{"not matching", "forge", map[string]string{webhooks.DefaultHMACHeader: sign("forge-secret", closed),
+				"X-Delivery": "delivery-4"}, closed, http.StatusOK, "ignored, $.action is not opened"},
+			{"missing var", "forge", map[string]string{webhooks.DefaultHMACHeader: sign("forge-secret", noCommits),
+				"X-Delivery": "delivery-5"}, noCommits, http.StatusBadRequest, "the body has no $.commits[0].id for var sha"},
+			{"wrong token", "alerts", map[string]string{webhooks.DefaultTokenHeader: "other-token"}, alert,
+				http.StatusUnauthorized, "invalid token"},
+			{"invalid body", "alerts", map[string]string{webhooks.DefaultTokenHeader: "alerts-token"}, "labels",
+				http.StatusBadRequest, "invalid body: invalid character 'l' looking for beginning of value"},
+		}
+		for _, tc := range tt {
+			t.Run(tc.name, func(t *testing.T) {
+				code, reply := call(tc.mapping, tc.header, tc.body)
+				mocks.AssertEquals(t, tc.code, code)
+				mocks.AssertEquals(t, tc.reply, reply)
+			})
+		}
+	}))
+}
+
+func TestInvalidMappings(t *testing.T) {
+	valid := webhooks.Mapping{Secret: "secret", User: "ciLink", Channel: "deploysLink", Command: "deploy"}
+	tt := []struct {
+		name     string
+		mapping  func(webhooks.Mapping) webhooks.Mapping
+		expected string
+	}{
+		{"unknown auth", func(m webhooks.Mapping) webhooks.Mapping { m.Auth = "basic"; return m },
+			"invalid webhook mapping auth basic, valid ones are hmac and token"},
+		{"no secret", func(m webhooks.Mapping) webhooks.Mapping { m.Secret = ""; return m },
+			"webhook mapping requires a secret"},
+		{"no command", func(m webhooks.Mapping) webhooks.Mapping { m.Command = ""; return m },
+			"webhook mapping requires a user, a channel and a command"},
+		{"empty key", func(m webhooks.Mapping) webhooks.Mapping { m.Vars = map[string]string{"repo": "$..name"}; return m },
+			"var repo: invalid path $..name, it has an empty key"},
+		{"invalid index", func(m webhooks.Mapping) webhooks.Mapping { m.Match = map[string]string{"$.commits[*]": "x"}; return m },
+			"match: invalid path $.commits[*], * is not a quoted key or an index"},
+		{"invalid arg", func(m webhooks.Mapping) webhooks.Mapping { m.Args = []string{"{{ .repo"}; return m },
+			"invalid arg {{ .repo: template: arg0:1: unclosed action"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			mocks.AssertEquals(t, tc.expected, tc.mapping(valid).Validate().Error())
+		})
+	}
+	mocks.Must(t, "valid mapping is invalid", valid.Validate())
+}
+
+func TestAlertmanagerCalls(t *testing.T) {
+	mocks.Must(t, "failed to receive alerts", mocks.WithTmpDB(func(_ string) {
+		mocks.Must(t, "could not configure alertmanager", webhooks.ConfigureAlertmanager(webhooks.Alertmanager{
+			Token:   "alerts-token",
+			User:    "ciLink",
+			Channel: "deploysLink",
+			Rules: []webhooks.AlertRule{
+				{
+					Alert:   "DiskFull",
+					Labels:  map[string]string{"severity": "page"},
+					Command: "diagnose disk",
+					Args:    []string{"{{ .labels.instance }}", "{{ .annotations.summary }}"},
+				},
+				{
+					Alert:   "DiskFull",
+					Status:  webhooks.AlertResolved,
+					Command: "echo",
+					Args:    []string{"{{ .alertname }} is {{ .status }}"},
+					Channel: "generalLink",
+				},
+			},
+		}))
+		defer webhooks.ConfigureAlertmanager(webhooks.Alertmanager{})
+
+		s := webhooks.New(mocks.EnricherStub{}, "/alerting")
+		defer s.Shutdown()
+
+		ch := make(chan meeseeks.Request, 2)
+		go s.Listen(ch)
+
+		call := func(token, body string) (int, string) {
+			r := httptest.NewRequest(http.MethodPost, "/alertmanager", strings.NewReader(body))
+			r.Header.Set("Authorization", "Bearer "+token)
+			w := httptest.NewRecorder()
+			s.HandleAlerts(w, r)
+			return w.Code, strings.TrimSpace(w.Body.String())
+		}
+		alertOf := func(status, name, severity string) string {
+			return fmt.Sprintf(`{"status": "%s", "labels": {"alertname": "%s", "instance": "db-1", "severity": "%s"},
+				"annotations": {"summary": "disk is full"}, "startsAt": "2019-06-01T10:00:00Z", "fingerprint": "%s%s"}`,
+				status, name, severity, name, severity)
+		}
+		notification := func(alerts ...string) string {
+			return fmt.Sprintf(`{"version": "4", "status": "firing", "externalURL": "http://alertmanager", "alerts": [%s]}`,
+				strings.Join(alerts, ","))
+		}
+
+		code, reply := call("alerts-token", notification(alertOf("firing", "DiskFull", "page"),
+			alertOf("firing", "DiskFull", "ticket"), alertOf("firing", "HighLoad", "page")))
+		mocks.AssertEquals(t, http.StatusOK, code)
+		mocks.AssertEquals(t, "1 commands triggered", reply)
+		req := <-ch
+		mocks.AssertEquals(t, "diagnose", req.Command)
+		mocks.AssertEquals(t, []string{"disk", "db-1", "disk is full"}, req.Args)
+		mocks.AssertEquals(t, "ci", req.UserID)
+		mocks.AssertEquals(t, "deploys", req.ChannelID)
+
+		code, reply = call("alerts-token", notification(alertOf("firing", "DiskFull", "page")))
+		mocks.AssertEquals(t, http.StatusOK, code)
+		mocks.AssertEquals(t, "0 commands triggered", reply)
+
+		code, reply = call("alerts-token", notification(alertOf("resolved", "DiskFull", "page")))
+		mocks.AssertEquals(t, http.StatusOK, code)
+		mocks.AssertEquals(t, "1 commands triggered", reply)
+		req = <-ch
+		mocks.AssertEquals(t, "echo", req.Command)
+		mocks.AssertEquals(t, []string{"DiskFull is resolved"}, req.Args)
+		mocks.AssertEquals(t, "general", req.ChannelID)
+
+		code, reply = call("other-token", notification(alertOf("firing", "DiskFull", "page")))
+		mocks.AssertEquals(t, http.StatusUnauthorized, code)
+		mocks.AssertEquals(t, "invalid token", reply)
+	}))
+}
+
+func TestInvalidAlertmanagers(t *testing.T) {
+	rule := webhooks.AlertRule{Alert: "DiskFull", Command: "diagnose"}
+	tt := []struct {
+		name         string
+		alertmanager webhooks.Alertmanager
+		expected     string
+	}{
+		{"no token", webhooks.Alertmanager{User: "ciLink", Channel: "alertsLink", Rules: []webhooks.AlertRule{rule}},
+			"alertmanager requires a token and a user"},
+		{"no channel", webhooks.Alertmanager{Token: "token", User: "ciLink", Rules: []webhooks.AlertRule{rule}},
+			"alertmanager rule 1: rule requires a channel when the alertmanager has none"},
+		{"no command", webhooks.Alertmanager{Token: "token", User: "ciLink", Channel: "alertsLink",
+			Rules: []webhooks.AlertRule{{Alert: "DiskFull"}}}, "alertmanager rule 1: rule requires a command"},
+		{"invalid status", webhooks.Alertmanager{Token: "token", User: "ciLink", Channel: "alertsLink",
+			Rules: []webhooks.AlertRule{rule, {Alert: "DiskFull", Status: "pending", Command: "diagnose"}}},
+			"alertmanager rule 2: invalid alert status pending, valid ones are firing, resolved and any"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			mocks.AssertEquals(t, tc.expected, tc.alertmanager.Validate().Error())
+		})
+	}
+	mocks.Must(t, "no rules is valid", webhooks.Alertmanager{}.Validate())
+}